@@ -0,0 +1,854 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults of APIGateway.
+const (
+	DefaultAPIKeyHeader  = "X-API-Key"
+	DefaultAPIKeyTable   = "api_key"
+	DefaultAPIUsageTable = "api_usage"
+	DefaultAPIMaxKeys    = 10
+	// APIKeyPrefix starts every key, so leaked keys are easy to scan
+	// for.
+	APIKeyPrefix = "gk_"
+)
+
+// Periods of the quota of an APIPlan.
+const (
+	APIPeriodDay   = "day"
+	APIPeriodMonth = "month"
+)
+
+// APIKeyKey is the gin context key holding the APIKey of a request
+// let through by APIGateway.Protect.
+const APIKeyKey = "ghost-api-key"
+
+var (
+	// ErrAPIKeyInvalid is returned for a request without a key, or
+	// with an unknown or revoked one.
+	ErrAPIKeyInvalid = errors.New("missing, unknown or revoked api key")
+	// ErrAPIKeyNotFound is returned when revoking a key the owner does
+	// not have.
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	// ErrAPIKeyLimit is returned by CreateKey once the owner has
+	// MaxKeys active keys.
+	ErrAPIKeyLimit = errors.New("too many api keys")
+	// ErrAPIPlanUnknown is returned for a plan the gateway does not
+	// have.
+	ErrAPIPlanUnknown = errors.New("unknown api plan")
+	// ErrAPIRateLimited is returned by Protect while a key is over the
+	// rate of its plan.
+	ErrAPIRateLimited = errors.New("api rate limit exceeded")
+	// ErrQuotaExceeded is returned by Protect once a key has used the
+	// quota of its plan for the period.
+	ErrQuotaExceeded = errors.New("api quota exceeded")
+)
+
+// APIPlan is a plan of the gateway: a rate of Requests per Per, with
+// bursts of up to Burst, and a Quota of requests per Period, month by
+// default. Zero values are unlimited; the Key of the rule is ignored,
+// plans always limit per key.
+type APIPlan struct {
+	RateLimitRule `yaml:",inline"`
+	Quota         int    `yaml:"quota"`
+	Period        string `yaml:"period"`
+	// Description is shown on the developer portal.
+	Description string `yaml:"description"`
+}
+
+// APIGatewayConfig is the gateway block of ghost.yaml, the plans of
+// the public API served through NewGateway.
+//
+//  gateway:
+//      header: X-API-Key
+//      default-plan: free
+//      max-keys: 5
+//      plans:
+//          free:
+//              requests: 60
+//              per: 1m
+//              quota: 10000
+//              description: 10,000 requests a month
+//          pro:
+//              requests: 600
+//              per: 1m
+//              quota: 1000000
+type APIGatewayConfig struct {
+	Header string `yaml:"header"`
+	// DefaultPlan is the plan of the keys created on the portal.
+	DefaultPlan string             `yaml:"default-plan"`
+	MaxKeys     int                `yaml:"max-keys"`
+	Plans       map[string]APIPlan `yaml:"plans"`
+	KeysTable   string             `yaml:"keys-table"`
+	UsageTable  string             `yaml:"usage-table"`
+}
+
+// APIGatewaySchema defines the tables of APIGateway with the default
+// table names.
+const APIGatewaySchema = `
+DEFINE TABLE api_key SCHEMALESS;
+DEFINE INDEX api_key_owner ON api_key FIELDS owner;
+DEFINE TABLE api_usage SCHEMALESS;
+DEFINE INDEX api_usage_key ON api_usage FIELDS key, day;
+DEFINE INDEX api_usage_owner ON api_usage FIELDS owner, day;
+`
+
+// APIKey is a key of the public API. The key itself is only returned
+// by CreateKey; the gateway keeps its hash.
+type APIKey struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	Plan  string `json:"plan"`
+	// Prefix is the start of the key, to tell keys apart.
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"hash,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// APIUsage is the metered use of a key: the requests to one route on
+// one day, with the owner and plan of the key at the time, for
+// billing.
+type APIUsage struct {
+	Key   string `json:"key"`
+	Owner string `json:"owner"`
+	Plan  string `json:"plan"`
+	Day   string `json:"day"`
+	Route string `json:"route"`
+	Count int    `json:"count"`
+}
+
+// APIUsageTotal is the use of a key over a range of days.
+type APIUsageTotal struct {
+	Key      string `json:"key"`
+	Owner    string `json:"owner"`
+	Plan     string `json:"plan"`
+	Requests int    `json:"requests"`
+}
+
+// APIGateway exposes routes as a public API: each request needs an
+// API key, is held to the rate and quota of the plan of the key, and
+// is metered per key, route and day. MountPortal serves the developer
+// portal, where users manage their keys and read the OpenAPI
+// document of the exposed routes.
+//
+// Example:
+//  gateway, err := ghostConfig.NewGateway(db)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  gateway.Expose(r, "/v1", posts, search)
+//  gateway.MountPortal(r.Group("/developers", sessions.Middleware()))
+type APIGateway struct {
+	DB          GhostDB
+	Plans       map[string]APIPlan
+	DefaultPlan string
+	// Header carries the key, DefaultAPIKeyHeader by default. Keys are
+	// accepted as bearer tokens too.
+	Header string
+	// MaxKeys is the most active keys of an owner, DefaultAPIMaxKeys
+	// by default.
+	MaxKeys    int
+	KeysTable  string
+	UsageTable string
+	// Store keeps the rate buckets of the keys, in memory by default.
+	Store RateLimitStore
+	// Docs documents the exposed routes. Defaults to a document titled
+	// Title.
+	Docs  *OpenAPI
+	Title string
+	// PortalTemplate replaces the built-in portal page, rendered with
+	// an APIPortalView.
+	PortalTemplate string
+
+	portalBase string
+}
+
+// NewGateway returns the gateway of the gateway block, keeping its
+// rate buckets in the store of the rate-limit block.
+//
+// Returns:
+//  *APIGateway
+//  error for an unknown rate-limit store
+func (ghostConfig GhostConfig) NewGateway(db GhostDB) (*APIGateway, error) {
+	limiter, err := ghostConfig.NewRateLimiter()
+	if err != nil {
+		return nil, err
+	}
+	cfg := ghostConfig.Gateway
+	return &APIGateway{
+		DB:          db,
+		Plans:       cfg.Plans,
+		DefaultPlan: cfg.DefaultPlan,
+		Header:      cfg.Header,
+		MaxKeys:     cfg.MaxKeys,
+		KeysTable:   cfg.KeysTable,
+		UsageTable:  cfg.UsageTable,
+		Store:       limiter.Store,
+		Title:       ghostConfig.Name + " API",
+	}, nil
+}
+
+// EnsureSchema runs APIGatewaySchema against the database.
+func (gw *APIGateway) EnsureSchema() error {
+	schema := APIGatewaySchema
+	if gw.usageTable() != DefaultAPIUsageTable {
+		schema = strings.ReplaceAll(schema, DefaultAPIUsageTable, gw.usageTable())
+	}
+	if gw.keysTable() != DefaultAPIKeyTable {
+		schema = strings.ReplaceAll(schema, DefaultAPIKeyTable, gw.keysTable())
+	}
+	_, err := gw.DB.Query(schema, map[string]interface{}{})
+	return err
+}
+
+func (gw *APIGateway) keysTable() string {
+	if gw.KeysTable == "" {
+		return DefaultAPIKeyTable
+	}
+	return gw.KeysTable
+}
+
+func (gw *APIGateway) usageTable() string {
+	if gw.UsageTable == "" {
+		return DefaultAPIUsageTable
+	}
+	return gw.UsageTable
+}
+
+func (gw *APIGateway) header() string {
+	if gw.Header == "" {
+		return DefaultAPIKeyHeader
+	}
+	return gw.Header
+}
+
+func (gw *APIGateway) maxKeys() int {
+	if gw.MaxKeys <= 0 {
+		return DefaultAPIMaxKeys
+	}
+	return gw.MaxKeys
+}
+
+func (gw *APIGateway) store() RateLimitStore {
+	if gw.Store == nil {
+		gw.Store = NewMemoryRateLimitStore()
+	}
+	return gw.Store
+}
+
+// plan returns the plan named name, the default plan for a key of a
+// plan since removed.
+func (gw *APIGateway) plan(name string) APIPlan {
+	if plan, ok := gw.Plans[name]; ok {
+		return plan
+	}
+	return gw.Plans[gw.DefaultPlan]
+}
+
+// docs returns the OpenAPI document of the exposed routes, which
+// documents the key header.
+func (gw *APIGateway) docs() *OpenAPI {
+	if gw.Docs == nil {
+		title := gw.Title
+		if title == "" {
+			title = "API"
+		}
+		gw.Docs = NewOpenAPI(title, "1.0.0")
+	}
+	gw.Docs.APIKeyHeader = gw.header()
+	return gw.Docs
+}
+
+func hashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// periodStart returns the first day of the period of plan holding
+// now, and the start of the next period.
+func periodStart(period string, now time.Time) (string, time.Time) {
+	now = now.UTC()
+	if period == APIPeriodDay {
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return day.Format("2006-01-02"), day.AddDate(0, 0, 1)
+	}
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return month.Format("2006-01-02"), month.AddDate(0, 1, 0)
+}
+
+// CreateKey creates a key of plan, the default plan when empty, for
+// owner.
+//
+// Example:
+//  key, secret, err := gateway.CreateKey(ctx, "user:tobie", "CI", "")
+//  fmt.Println("your key:", secret)   // shown once
+//
+// Returns:
+//  APIKey stored
+//  string the key, which cannot be read again
+//  error, ErrAPIKeyLimit at MaxKeys keys, ErrAPIPlanUnknown
+func (gw *APIGateway) CreateKey(ctx context.Context, owner, name, plan string) (APIKey, string, error) {
+	if plan == "" {
+		plan = gw.DefaultPlan
+	}
+	if _, ok := gw.Plans[plan]; !ok && len(gw.Plans) > 0 {
+		return APIKey{}, "", fmt.Errorf("%w %q", ErrAPIPlanUnknown, plan)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "key"
+	}
+	db := WithContext(ctx, gw.DB)
+	count, _, err := surrealFirst[struct {
+		Total int `json:"total"`
+	}](db, "SELECT count() AS total FROM type::table($tb) WHERE owner = $owner AND revoked_at = NONE GROUP ALL", map[string]interface{}{
+		"tb":    gw.keysTable(),
+		"owner": owner,
+	})
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	if count.Total >= gw.maxKeys() {
+		return APIKey{}, "", ErrAPIKeyLimit
+	}
+	id := randomID(4)
+	raw := APIKeyPrefix + id + "_" + randomID(16)
+	key, _, err := surrealFirst[APIKey](db, "CREATE type::thing($tb, $id) CONTENT $data", map[string]interface{}{
+		"tb": gw.keysTable(),
+		"id": id,
+		"data": map[string]interface{}{
+			"owner":      owner,
+			"name":       name,
+			"plan":       plan,
+			"prefix":     APIKeyPrefix + id,
+			"hash":       hashAPIKey(raw),
+			"created_at": time.Now().UTC(),
+		},
+	})
+	key.Hash = ""
+	return key, raw, err
+}
+
+// Authenticate returns the active key raw is.
+//
+// Returns:
+//  APIKey
+//  error, ErrAPIKeyInvalid for a malformed, unknown or revoked key
+func (gw *APIGateway) Authenticate(ctx context.Context, raw string) (APIKey, error) {
+	rest := strings.TrimPrefix(raw, APIKeyPrefix)
+	id, _, ok := strings.Cut(rest, "_")
+	if rest == raw || !ok || !identifierPattern.MatchString(id) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	key, found, err := surrealFirst[APIKey](WithContext(ctx, gw.DB), "SELECT * FROM type::thing($tb, $id) WHERE revoked_at = NONE", map[string]interface{}{
+		"tb": gw.keysTable(),
+		"id": id,
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	if !found || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKey(raw))) != 1 {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	key.Hash = ""
+	return key, nil
+}
+
+// Keys returns the keys of owner, revoked ones included, the newest
+// first.
+func (gw *APIGateway) Keys(ctx context.Context, owner string) ([]APIKey, error) {
+	keys, err := surrealQuery[APIKey](WithContext(ctx, gw.DB), "SELECT * FROM type::table($tb) WHERE owner = $owner ORDER BY created_at DESC", map[string]interface{}{
+		"tb":    gw.keysTable(),
+		"owner": owner,
+	})
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	return keys, err
+}
+
+// RevokeKey revokes the key id of owner; requests with it fail from
+// then on.
+//
+// Returns:
+//  error, ErrAPIKeyNotFound when owner has no such active key
+func (gw *APIGateway) RevokeKey(ctx context.Context, owner, id string) error {
+	_, id = splitRecordID(id, gw.keysTable())
+	_, found, err := surrealFirst[APIKey](WithContext(ctx, gw.DB), "UPDATE type::thing($tb, $id) SET revoked_at = time::now() WHERE owner = $owner AND revoked_at = NONE RETURN AFTER", map[string]interface{}{
+		"tb":    gw.keysTable(),
+		"id":    id,
+		"owner": owner,
+	})
+	if err == nil && !found {
+		err = ErrAPIKeyNotFound
+	}
+	return err
+}
+
+// SetPlan moves the key id to plan, e.g. once its owner paid for it.
+// The usage of the period so far counts against the new quota.
+//
+// Returns:
+//  error, ErrAPIPlanUnknown, ErrAPIKeyNotFound
+func (gw *APIGateway) SetPlan(ctx context.Context, id, plan string) error {
+	if _, ok := gw.Plans[plan]; !ok {
+		return fmt.Errorf("%w %q", ErrAPIPlanUnknown, plan)
+	}
+	_, id = splitRecordID(id, gw.keysTable())
+	_, found, err := surrealFirst[APIKey](WithContext(ctx, gw.DB), "UPDATE type::thing($tb, $id) SET plan = $plan WHERE revoked_at = NONE RETURN AFTER", map[string]interface{}{
+		"tb":   gw.keysTable(),
+		"id":   id,
+		"plan": plan,
+	})
+	if err == nil && !found {
+		err = ErrAPIKeyNotFound
+	}
+	return err
+}
+
+// meter counts a request of key to route unless the quota of plan is
+// used up. Concurrent requests may take a key a few requests past its
+// quota.
+//
+// Returns:
+//  int the requests of the period before this one
+//  error
+func (gw *APIGateway) meter(ctx context.Context, key APIKey, plan APIPlan, route string) (int, error) {
+	from, _ := periodStart(plan.Period, time.Now())
+	_, keyID := splitRecordID(key.ID, gw.keysTable())
+	statements, err := surrealStatements(WithContext(ctx, gw.DB), `LET $key = type::thing($keys, $key_id);
+LET $used = math::sum((SELECT VALUE count FROM type::table($usage) WHERE key = $key AND day >= $from));
+IF $quota <= 0 OR $used < $quota {
+	UPDATE type::thing($usage, [$key_id, $day, $route]) SET key = $key, owner = $owner, plan = $plan, day = $day, route = $route, count += 1;
+	UPDATE $key SET last_used_at = time::now();
+};
+RETURN $used;`, map[string]interface{}{
+		"keys":   gw.keysTable(),
+		"usage":  gw.usageTable(),
+		"key_id": keyID,
+		"owner":  key.Owner,
+		"plan":   key.Plan,
+		"route":  route,
+		"from":   from,
+		"day":    time.Now().UTC().Format("2006-01-02"),
+		"quota":  plan.Quota,
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return 0, fmt.Errorf("gateway: %s", statement.Detail)
+		}
+	}
+	if len(statements) != 4 {
+		return 0, fmt.Errorf("gateway: %d statements answered", len(statements))
+	}
+	used, _ := statements[3].Result.(float64)
+	return int(used), nil
+}
+
+// Used returns the requests of key in the current period of its plan.
+func (gw *APIGateway) Used(ctx context.Context, key APIKey) (int, error) {
+	from, _ := periodStart(gw.plan(key.Plan).Period, time.Now())
+	_, keyID := splitRecordID(key.ID, gw.keysTable())
+	used, _, err := surrealFirst[struct {
+		Used int `json:"used"`
+	}](WithContext(ctx, gw.DB), "SELECT math::sum(count) AS used FROM type::table($usage) WHERE key = type::thing($keys, $key_id) AND day >= $from GROUP ALL", map[string]interface{}{
+		"keys":   gw.keysTable(),
+		"usage":  gw.usageTable(),
+		"key_id": keyID,
+		"from":   from,
+	})
+	return used.Used, err
+}
+
+// Usage returns the metered use of the keys of owner on the days from
+// from up to, not including, to.
+func (gw *APIGateway) Usage(ctx context.Context, owner string, from, to time.Time) ([]APIUsage, error) {
+	return surrealQuery[APIUsage](WithContext(ctx, gw.DB), "SELECT key, owner, plan, day, route, count FROM type::table($usage) WHERE owner = $owner AND day >= $from AND day < $to ORDER BY day, route", map[string]interface{}{
+		"usage": gw.usageTable(),
+		"owner": owner,
+		"from":  from.UTC().Format("2006-01-02"),
+		"to":    to.UTC().Format("2006-01-02"),
+	})
+}
+
+// UsageReport returns the requests of every key on the days from from
+// up to, not including, to, per plan, as billing needs them.
+//
+// Example:
+//  start := time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)
+//  totals, err := gateway.UsageReport(ctx, start, start.AddDate(0, 1, 0))
+func (gw *APIGateway) UsageReport(ctx context.Context, from, to time.Time) ([]APIUsageTotal, error) {
+	totals, err := surrealQuery[APIUsageTotal](WithContext(ctx, gw.DB), "SELECT key, owner, plan, math::sum(count) AS requests FROM type::table($usage) WHERE day >= $from AND day < $to GROUP BY key, owner, plan", map[string]interface{}{
+		"usage": gw.usageTable(),
+		"from":  from.UTC().Format("2006-01-02"),
+		"to":    to.UTC().Format("2006-01-02"),
+	})
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Owner != totals[j].Owner {
+			return totals[i].Owner < totals[j].Owner
+		}
+		return totals[i].Key < totals[j].Key
+	})
+	return totals, err
+}
+
+// rawKey returns the key sent with the request.
+func (gw *APIGateway) rawKey(c *gin.Context) string {
+	if raw := c.GetHeader(gw.header()); raw != "" {
+		return raw
+	}
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && strings.HasPrefix(token, APIKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+// Protect lets through the requests with an active key within the
+// rate and quota of its plan, counting them. The rate is reported in
+// RateLimit-Limit and RateLimit-Remaining, the quota in X-Quota-Limit,
+// X-Quota-Remaining and X-Quota-Reset, in Unix seconds. The key is
+// stored for CurrentAPIKey, and its owner as the Identity when the
+// request has none.
+func (gw *APIGateway) Protect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		key, err := gw.Authenticate(ctx, gw.rawKey(c))
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		plan := gw.plan(key.Plan)
+		if rule := plan.RateLimitRule; rule.Requests > 0 && rule.Per > 0 {
+			burst := rule.Burst
+			if burst <= 0 {
+				burst = rule.Requests
+			}
+			result, err := gw.store().Take(ctx, "gateway:"+key.ID, float64(rule.Requests)/rule.Per.Seconds(), burst)
+			if err != nil {
+				log.Printf("gateway: rate limit: %v", err)
+			} else {
+				c.Header("RateLimit-Limit", strconv.Itoa(rule.Requests))
+				c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+				if !result.Allowed {
+					c.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(result.RetryAfter.Seconds())))))
+					Fail(c, ErrAPIRateLimited)
+					return
+				}
+			}
+		}
+		used, err := gw.meter(ctx, key, plan, c.Request.Method+" "+c.FullPath())
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		if plan.Quota > 0 {
+			_, reset := periodStart(plan.Period, time.Now())
+			remaining := plan.Quota - used - 1
+			if remaining < 0 {
+				remaining = 0
+			}
+			c.Header("X-Quota-Limit", strconv.Itoa(plan.Quota))
+			c.Header("X-Quota-Remaining", strconv.Itoa(remaining))
+			c.Header("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+			if used >= plan.Quota {
+				Fail(c, ErrQuotaExceeded)
+				return
+			}
+		}
+		c.Set(APIKeyKey, key)
+		if _, ok := CurrentIdentity(c); !ok {
+			SetIdentity(c, Identity{ID: key.Owner})
+		}
+		c.Next()
+	}
+}
+
+// CurrentAPIKey returns the key of a request let through by Protect.
+func CurrentAPIKey(c *gin.Context) (APIKey, bool) {
+	value, ok := c.Get(APIKeyKey)
+	key, _ := value.(APIKey)
+	return key, ok && key.ID != ""
+}
+
+// Expose registers routes on a group of r at path behind Protect, and
+// documents them for the portal.
+//
+// Returns:
+//  *gin.RouterGroup of the public API
+func (gw *APIGateway) Expose(r gin.IRouter, path string, routes ...GhostRoute) *gin.RouterGroup {
+	g := r.Group(path, gw.Protect())
+	for _, route := range routes {
+		route.Route(g)
+	}
+	gw.docs().Add(g.BasePath(), routes...)
+	return g
+}
+
+// APIPortalView is the data of the developer portal page.
+type APIPortalView struct {
+	Title  string
+	Base   string
+	Header string
+	Keys   []APIPortalKey
+	Plans  []APIPortalPlan
+	// NewKey is the key just created, shown once.
+	NewKey    string
+	CanCreate bool
+	CSRF      string
+	CSRFField string
+	Error     string
+}
+
+// APIPortalKey is a key on the portal with its use of the period.
+type APIPortalKey struct {
+	APIKey
+	// Param is the id of the key in the portal URLs.
+	Param  string
+	Used   int
+	Quota  int
+	Period string
+}
+
+// APIPortalPlan is a plan on the portal.
+type APIPortalPlan struct {
+	Name string
+	APIPlan
+}
+
+// MountPortal registers the developer portal on g:
+//  GET     /                   the portal page
+//  POST    /keys               create a key, from the portal form or JSON
+//  POST    /keys/:id/revoke    revoke a key from the portal form
+//  GET     /keys               the keys of the caller
+//  DELETE  /keys/:id           revoke a key
+//  GET     /usage              the use of the keys, ?from= and ?to= days
+//  GET     /openapi.json       the document of the exposed routes
+//  GET     /docs               Swagger UI for it
+// Every route but the documents requires an Identity, usually from a
+// session. Keys created on the portal have the default plan.
+func (gw *APIGateway) MountPortal(g *gin.RouterGroup) {
+	gw.portalBase = strings.TrimRight(g.BasePath(), "/")
+	auth := RequireIdentity()
+	g.GET("", auth, gw.portal)
+	g.POST("/keys", auth, gw.createKey)
+	g.POST("/keys/:id/revoke", auth, gw.revokeKey)
+	g.GET("/keys", auth, gw.listKeys)
+	g.DELETE("/keys/:id", auth, gw.deleteKey)
+	g.GET("/usage", auth, gw.usage)
+	gw.docs().Mount(g)
+}
+
+func (gw *APIGateway) portalView(c *gin.Context) (APIPortalView, error) {
+	identity, _ := CurrentIdentity(c)
+	view := APIPortalView{
+		Title:     gw.docs().Title,
+		Base:      gw.portalBase,
+		Header:    gw.header(),
+		CSRF:      CSRFToken(c),
+		CSRFField: CSRFField,
+	}
+	for name, plan := range gw.Plans {
+		view.Plans = append(view.Plans, APIPortalPlan{Name: name, APIPlan: plan})
+	}
+	sort.Slice(view.Plans, func(i, j int) bool { return view.Plans[i].Name < view.Plans[j].Name })
+	keys, err := gw.Keys(c.Request.Context(), identity.ID)
+	if err != nil {
+		return view, err
+	}
+	active := 0
+	for _, key := range keys {
+		if key.RevokedAt != nil {
+			continue
+		}
+		active++
+		plan := gw.plan(key.Plan)
+		used, err := gw.Used(c.Request.Context(), key)
+		if err != nil {
+			return view, err
+		}
+		period := plan.Period
+		if period == "" {
+			period = APIPeriodMonth
+		}
+		_, param := splitRecordID(key.ID, gw.keysTable())
+		view.Keys = append(view.Keys, APIPortalKey{APIKey: key, Param: param, Used: used, Quota: plan.Quota, Period: period})
+	}
+	view.CanCreate = active < gw.maxKeys()
+	return view, nil
+}
+
+func (gw *APIGateway) renderPortal(c *gin.Context, code int, view APIPortalView) {
+	if gw.PortalTemplate != "" {
+		c.HTML(code, gw.PortalTemplate, withLayout(c, view))
+		return
+	}
+	var out bytes.Buffer
+	if err := portalTemplate.Execute(&out, view); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Data(code, "text/html; charset=utf-8", out.Bytes())
+}
+
+func (gw *APIGateway) portal(c *gin.Context) {
+	view, err := gw.portalView(c)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	gw.renderPortal(c, http.StatusOK, view)
+}
+
+func (gw *APIGateway) createKey(c *gin.Context) {
+	body, ok := BindOrAbort[struct {
+		Name string `json:"name" form:"name" binding:"max=64"`
+	}](c)
+	if !ok {
+		return
+	}
+	identity, _ := CurrentIdentity(c)
+	key, raw, err := gw.CreateKey(c.Request.Context(), identity.ID, body.Name, "")
+	if c.ContentType() == gin.MIMEJSON {
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		Created(c, gin.H{"key": key, "secret": raw})
+		return
+	}
+	view, viewErr := gw.portalView(c)
+	if viewErr != nil {
+		Fail(c, viewErr)
+		return
+	}
+	if err != nil {
+		ghostErr := AsGhostError(err)
+		view.Error = ghostErr.Message
+		gw.renderPortal(c, ghostErr.Status, view)
+		return
+	}
+	view.NewKey = raw
+	gw.renderPortal(c, http.StatusCreated, view)
+}
+
+func (gw *APIGateway) revokeKey(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	if err := gw.RevokeKey(c.Request.Context(), identity.ID, c.Param("id")); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, gw.portalBase+"/")
+}
+
+func (gw *APIGateway) listKeys(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	keys, err := gw.Keys(c.Request.Context(), identity.ID)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, keys)
+}
+
+func (gw *APIGateway) deleteKey(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	if err := gw.RevokeKey(c.Request.Context(), identity.ID, c.Param("id")); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (gw *APIGateway) usage(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	start, _ := periodStart(APIPeriodMonth, time.Now())
+	from, err := time.Parse("2006-01-02", c.DefaultQuery("from", start))
+	if err != nil {
+		Fail(c, NewGhostError(http.StatusBadRequest, "invalid_date", "from must be a day like 2006-01-02"))
+		return
+	}
+	to := time.Now().UTC().AddDate(0, 0, 1)
+	if raw := c.Query("to"); raw != "" {
+		if to, err = time.Parse("2006-01-02", raw); err != nil {
+			Fail(c, NewGhostError(http.StatusBadRequest, "invalid_date", "to must be a day like 2006-01-02"))
+			return
+		}
+	}
+	usage, err := gw.Usage(c.Request.Context(), identity.ID, from, to)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, usage)
+}
+
+var portalTemplate = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+</head>
+<body>
+<main class="api-portal">
+<h1>{{.Title}}</h1>
+<p><a href="{{.Base}}/docs">API reference</a> · <a href="{{.Base}}/openapi.json">OpenAPI document</a></p>
+{{if .Error}}<p class="api-portal-error" role="alert">{{.Error}}</p>{{end}}
+{{if .NewKey}}<section class="api-portal-new-key">
+<h2>Your new key</h2>
+<p>Copy it now, it is not shown again. Send it in the <code>{{.Header}}</code> header.</p>
+<pre><code>{{.NewKey}}</code></pre>
+</section>{{end}}
+<h2>Keys</h2>
+{{if .Keys}}<table class="api-portal-keys">
+<thead><tr><th>Name</th><th>Key</th><th>Plan</th><th>Usage</th><th>Last used</th><th></th></tr></thead>
+<tbody>
+{{range .Keys}}<tr>
+<td>{{.Name}}</td>
+<td><code>{{.Prefix}}…</code></td>
+<td>{{.Plan}}</td>
+<td>{{.Used}}{{if .Quota}} of {{.Quota}} this {{.Period}}{{end}}</td>
+<td>{{with .LastUsedAt}}<time datetime="{{.Format "2006-01-02T15:04:05Z07:00"}}">{{.Format "Jan 2, 2006 15:04"}}</time>{{else}}never{{end}}</td>
+<td><form method="post" action="{{$.Base}}/keys/{{.Param}}/revoke" onsubmit="return confirm('Revoke this key? Requests with it will fail.')">
+<input type="hidden" name="{{$.CSRFField}}" value="{{$.CSRF}}">
+<button type="submit">Revoke</button>
+</form></td>
+</tr>{{end}}
+</tbody>
+</table>{{else}}<p>No keys yet.</p>{{end}}
+{{if .CanCreate}}<form class="api-portal-create" method="post" action="{{.Base}}/keys">
+<input type="hidden" name="{{.CSRFField}}" value="{{.CSRF}}">
+<label>Name <input name="name" maxlength="64" placeholder="e.g. production"></label>
+<button type="submit">Create key</button>
+</form>{{end}}
+{{if .Plans}}<h2>Plans</h2>
+<dl class="api-portal-plans">
+{{range .Plans}}<dt>{{.Name}}</dt><dd>{{if .Description}}{{.Description}}{{else}}{{if .Requests}}{{.Requests}} requests per {{.Per}}{{end}}{{if .Quota}}, {{.Quota}} a {{if .Period}}{{.Period}}{{else}}month{{end}}{{end}}{{end}}</dd>
+{{end}}</dl>{{end}}
+</main>
+</body>
+</html>`))
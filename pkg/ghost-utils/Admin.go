@@ -0,0 +1,615 @@
+package ghostutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminModel is a model served by an Admin, such as an AdminResource.
+type AdminModel interface {
+	// AdminName is the path segment of the pages of the model.
+	AdminName() string
+	// AdminTitle is the title of the model in the admin navigation.
+	AdminTitle() string
+	// viewRoles are the roles that may see the model.
+	viewRoles(admin *Admin) []string
+	mount(admin *Admin, g *gin.RouterGroup)
+}
+
+// AdminResource serves the records of a Repository as admin pages,
+// under the path of its Name:
+//  GET  /users              list, a Table
+//  GET  /users/new          form of a new record
+//  POST /users              create
+//  GET  /users/:id          detail
+//  GET  /users/:id/edit     form of the record
+//  POST /users/:id          update, of the fields of the form
+//  POST /users/:id/delete   delete
+//
+// Forms are the Form of T, so form, label, input and binding tags
+// shape them; the id field is left out.
+type AdminResource[T any] struct {
+	Name       string
+	Title      string
+	Repository *Repository[T]
+	// Table lists the records, linking each to its detail page.
+	Table *Table[T]
+	// Fields are the JSON fields of the detail page, all fields of T
+	// by default.
+	Fields []string
+	// ReadOnly resources only have the list and detail pages.
+	ReadOnly bool
+	// Roles may see the resource, and WriteRoles change its records;
+	// both default to the roles of the Admin.
+	Roles      []string
+	WriteRoles []string
+	// Validate checks a bound record before it is written; errors
+	// added to form with AddError redisplay it.
+	Validate func(c *gin.Context, record *T, form *Form) error
+}
+
+// NewAdminResource returns the admin pages of the records of repo,
+// named after its table, listed with columns, or the first scalar
+// fields of T when there are none.
+//
+// Example:
+//  users := ghostutils.NewAdminResource(userRepo,
+//      ghostutils.TableColumn{Field: "email", Title: "Email", Sortable: true,
+//          Filter: &ghostutils.FilterField{Ops: []string{ghostutils.FilterContains}}},
+//      ghostutils.TableColumn{Field: "created_at", Title: "Joined", Sortable: true},
+//  )
+//  users.Table.DefaultSort = "-created_at"
+//  users.WriteRoles = []string{"superuser"}
+func NewAdminResource[T any](repo *Repository[T], columns ...TableColumn) *AdminResource[T] {
+	fields := adminFields(reflect.TypeOf((*T)(nil)).Elem())
+	if len(columns) == 0 {
+		for _, field := range fields {
+			if field.scalar && len(columns) < 5 {
+				columns = append(columns, TableColumn{Field: field.name, Title: field.label, Sortable: true})
+			}
+		}
+	}
+	res := &AdminResource[T]{
+		Name:       repo.Table,
+		Title:      adminTitle(repo.Table),
+		Repository: repo,
+		Table:      NewTable(repo.Table, repo, columns...),
+	}
+	for _, field := range fields {
+		res.Fields = append(res.Fields, field.name)
+	}
+	return res
+}
+
+// AdminName implements AdminModel.
+func (res *AdminResource[T]) AdminName() string {
+	return res.Name
+}
+
+// AdminTitle implements AdminModel.
+func (res *AdminResource[T]) AdminTitle() string {
+	if res.Title == "" {
+		return adminTitle(res.Name)
+	}
+	return res.Title
+}
+
+type adminField struct {
+	name, label string
+	scalar      bool
+}
+
+// adminFields returns the JSON fields of the struct t but its id, in
+// order, with the fields of untagged embedded structs.
+func adminFields(t reflect.Type) []adminField {
+	t = derefType(t)
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []adminField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _ := parseJSONTag(field)
+		if field.Anonymous && name == "" && derefType(field.Type).Kind() == reflect.Struct {
+			fields = append(fields, adminFields(field.Type)...)
+			continue
+		}
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if name == "id" {
+			continue
+		}
+		kind := derefType(field.Type).Kind()
+		scalar := !formStruct(field.Type) && kind != reflect.Slice && kind != reflect.Map && kind != reflect.Interface
+		fields = append(fields, adminField{name: name, label: formLabel(field), scalar: scalar})
+	}
+	return fields
+}
+
+// adminTitle turns a table name into a title, e.g. "blog_post" into
+// "Blog post".
+func adminTitle(name string) string {
+	name = strings.ReplaceAll(name, "_", " ")
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// Admin serves the admin pages of its models behind RequireRole, with
+// the metrics of Dashboard on its index page.
+//
+// Example:
+//  admin := &ghostutils.Admin{Title: "Blog admin", Dashboard: dash}
+//  admin.Register(
+//      ghostutils.NewAdminResource(userRepo),
+//      ghostutils.NewAdminResource(postRepo),
+//  )
+//  admin.Mount(r.Group("/admin"))
+//
+// Template, when set, renders every page with the AdminView as its
+// data, using {{table .Table}} and {{form .Form}} of TableFuncMap and
+// FormFuncMap.
+type Admin struct {
+	Title string
+	// Roles may use the admin. Defaults to AdminRole.
+	Roles     []string
+	Dashboard *Dashboard
+	Template  string
+
+	models []AdminModel
+	base   string
+}
+
+// Register adds models, shown in the order they were added.
+func (a *Admin) Register(models ...AdminModel) *Admin {
+	a.models = append(a.models, models...)
+	return a
+}
+
+func (a *Admin) roles() []string {
+	if len(a.Roles) == 0 {
+		return []string{AdminRole}
+	}
+	return a.Roles
+}
+
+// Mount registers the index page on g, and the pages of every model
+// under its name, with the metric routes of Dashboard.
+func (a *Admin) Mount(g *gin.RouterGroup) {
+	a.base = strings.TrimRight(g.BasePath(), "/")
+	g.GET("", RequireRole(a.roles()...), a.index)
+	if a.Dashboard != nil {
+		a.Dashboard.Mount(g.Group("", RequireRole(a.roles()...)))
+	}
+	for _, model := range a.models {
+		model.mount(a, g.Group("/"+model.AdminName()))
+	}
+}
+
+// AdminView is the data of an admin page.
+type AdminView struct {
+	Title string
+	// Page is index, list, detail or form.
+	Page     string
+	Base     string
+	Models   []AdminLink
+	Model    AdminLink
+	Metrics  []AdminMetric
+	Table    TableView
+	Form     *Form
+	Record   []AdminValue
+	RecordID string
+	// RecordURL is the detail page of the record.
+	RecordURL string
+	// Actions are links shown on the detail page.
+	Actions   []AdminLink
+	CanWrite  bool
+	CSRF      string
+	CSRFField string
+}
+
+// AdminLink is a model in the admin navigation.
+type AdminLink struct {
+	Name  string
+	Title string
+	URL   string
+}
+
+// AdminMetric is a metric of the Dashboard of an Admin.
+type AdminMetric struct {
+	Name        string
+	Description string
+	Value       interface{}
+	Error       string
+}
+
+// AdminValue is one field of a record on its detail page.
+type AdminValue struct {
+	Label string
+	Value string
+}
+
+func (a *Admin) view(c *gin.Context, page string) AdminView {
+	view := AdminView{
+		Title:     a.Title,
+		Page:      page,
+		Base:      a.base,
+		CSRF:      CSRFToken(c),
+		CSRFField: CSRFField,
+	}
+	if view.Title == "" {
+		view.Title = "Admin"
+	}
+	identity, _ := CurrentIdentity(c)
+	for _, model := range a.models {
+		if identity.HasRole(model.viewRoles(a)...) {
+			view.Models = append(view.Models, AdminLink{Name: model.AdminName(), Title: model.AdminTitle(), URL: a.base + "/" + model.AdminName()})
+		}
+	}
+	return view
+}
+
+func (a *Admin) index(c *gin.Context) {
+	view := a.view(c, "index")
+	if a.Dashboard != nil {
+		for _, name := range a.Dashboard.Names() {
+			metric := AdminMetric{Name: name}
+			value, err := a.Dashboard.Value(c.Request.Context(), name)
+			if err != nil {
+				metric.Error = err.Error()
+			}
+			metric.Value = value
+			a.Dashboard.mu.Lock()
+			metric.Description = a.Dashboard.metrics[name].Description
+			a.Dashboard.mu.Unlock()
+			view.Metrics = append(view.Metrics, metric)
+		}
+	}
+	a.render(c, http.StatusOK, view)
+}
+
+func (a *Admin) render(c *gin.Context, code int, view AdminView) {
+	if a.Template != "" {
+		c.HTML(code, a.Template, withLayout(c, view))
+		return
+	}
+	var out bytes.Buffer
+	if err := adminTemplate.Execute(&out, view); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Data(code, "text/html; charset=utf-8", out.Bytes())
+}
+
+func (res *AdminResource[T]) viewRoles(a *Admin) []string {
+	if len(res.Roles) > 0 {
+		return res.Roles
+	}
+	return a.roles()
+}
+
+func (res *AdminResource[T]) writeRoles(a *Admin) []string {
+	if len(res.WriteRoles) > 0 {
+		return res.WriteRoles
+	}
+	return res.viewRoles(a)
+}
+
+// adminPages serves the pages of one AdminResource.
+type adminPages[T any] struct {
+	*AdminResource[T]
+	admin *Admin
+	base  string
+}
+
+func (res *AdminResource[T]) mount(admin *Admin, g *gin.RouterGroup) {
+	pages := &adminPages[T]{AdminResource: res, admin: admin, base: strings.TrimRight(g.BasePath(), "/")}
+	if res.Table.RowURL == nil {
+		res.Table.RowURL = func(id string) string {
+			_, param := splitRecordID(id, res.Repository.Table)
+			return pages.base + "/" + param
+		}
+	}
+	view := RequireRole(res.viewRoles(admin)...)
+	g.GET("", view, pages.list)
+	g.GET("/:id", view, pages.detail)
+	if res.ReadOnly {
+		return
+	}
+	write := RequireRole(res.writeRoles(admin)...)
+	g.GET("/new", write, pages.newForm)
+	g.POST("", write, pages.create)
+	g.GET("/:id/edit", write, pages.editForm)
+	g.POST("/:id", write, pages.update)
+	g.POST("/:id/delete", write, pages.delete)
+}
+
+func (p *adminPages[T]) view(c *gin.Context, page string) AdminView {
+	view := p.admin.view(c, page)
+	view.Model = AdminLink{Name: p.AdminName(), Title: p.AdminTitle(), URL: p.base}
+	identity, _ := CurrentIdentity(c)
+	view.CanWrite = !p.ReadOnly && identity.HasRole(p.writeRoles(p.admin)...)
+	return view
+}
+
+func (p *adminPages[T]) list(c *gin.Context) {
+	table, err := p.Table.Load(c)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	varyHTMX(c)
+	if WantsFragment(c) {
+		body, err := renderTable(table)
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		HTMX(c).PushURL(c.Request.URL.RequestURI())
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(body))
+		return
+	}
+	view := p.view(c, "list")
+	view.Table = table
+	p.admin.render(c, http.StatusOK, view)
+}
+
+func (p *adminPages[T]) recordView(c *gin.Context, page, id string) AdminView {
+	view := p.view(c, page)
+	view.RecordID = id
+	view.RecordURL = p.base + "/" + id
+	return view
+}
+
+func (p *adminPages[T]) detail(c *gin.Context) {
+	id := c.Param("id")
+	record, err := p.Repository.Get(c, id)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	fields, err := recordFields(record)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	view := p.recordView(c, "detail", id)
+	labels := map[string]string{}
+	for _, field := range adminFields(reflect.TypeOf(record)) {
+		labels[field.name] = field.label
+	}
+	for _, name := range p.Fields {
+		label := labels[name]
+		if label == "" {
+			label = name
+		}
+		view.Record = append(view.Record, AdminValue{Label: label, Value: adminValue(tableValue(fields, name))})
+	}
+	p.admin.render(c, http.StatusOK, view)
+}
+
+// adminValue formats a field of a record, lists and objects as JSON.
+func adminValue(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(data)
+	}
+	return fmt.Sprint(value)
+}
+
+// adminForm drops the id field from form.
+func adminForm(form *Form, action, submit string) *Form {
+	fields := form.Fields[:0]
+	for _, field := range form.Fields {
+		if field.Name != "id" {
+			fields = append(fields, field)
+		}
+	}
+	form.Fields = fields
+	form.Action = action
+	form.Submit = submit
+	return form
+}
+
+func (p *adminPages[T]) newForm(c *gin.Context) {
+	var record T
+	view := p.view(c, "form")
+	view.Form = adminForm(NewForm(c, &record), p.base, "Create")
+	p.admin.render(c, http.StatusOK, view)
+}
+
+func (p *adminPages[T]) editForm(c *gin.Context) {
+	id := c.Param("id")
+	record, err := p.Repository.Get(c, id)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	view := p.recordView(c, "form", id)
+	view.Form = adminForm(NewForm(c, &record), view.RecordURL, "Save")
+	p.admin.render(c, http.StatusOK, view)
+}
+
+// bind binds and validates the submitted record, reporting whether
+// the form was redisplayed.
+func (p *adminPages[T]) bind(c *gin.Context, view AdminView, record *T, action, submit string) (*Form, bool) {
+	form, err := BindForm(c, record)
+	if form == nil {
+		Fail(c, NewGhostError(http.StatusBadRequest, "invalid_form", err.Error()).Wrap(err))
+		return nil, true
+	}
+	adminForm(form, action, submit)
+	if err == nil && p.Validate != nil {
+		err = p.Validate(c, record, form)
+	}
+	if err != nil && !errors.Is(err, ErrFormInvalid) {
+		Fail(c, err)
+		return form, true
+	}
+	if err != nil {
+		view.Form = form
+		p.admin.render(c, http.StatusUnprocessableEntity, view)
+		return form, true
+	}
+	return form, false
+}
+
+// written redisplays form with the errors of an invalid record, or
+// fails the request, reporting whether err was handled.
+func (p *adminPages[T]) written(c *gin.Context, view AdminView, form *Form, err error) bool {
+	if err == nil {
+		return false
+	}
+	var bindErr *BindError
+	if !errors.As(err, &bindErr) {
+		Fail(c, err)
+		return true
+	}
+	for _, field := range bindErr.Fields {
+		if form.Field(field.Field) != nil {
+			form.Field(field.Field).Errors = append(form.Field(field.Field).Errors, field.Message)
+			continue
+		}
+		form.Errors = append(form.Errors, field.Message)
+	}
+	if len(bindErr.Fields) == 0 {
+		form.Errors = append(form.Errors, bindErr.Message)
+	}
+	view.Form = form
+	p.admin.render(c, http.StatusUnprocessableEntity, view)
+	return true
+}
+
+func (p *adminPages[T]) create(c *gin.Context) {
+	var record T
+	view := p.view(c, "form")
+	form, done := p.bind(c, view, &record, p.base, "Create")
+	if done {
+		return
+	}
+	created, err := p.Repository.Create(c, record)
+	if p.written(c, view, form, err) {
+		return
+	}
+	fields, err := recordFields(created)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	_, id := splitRecordID(fields["id"], p.Repository.Table)
+	HXRedirect(c, p.base+"/"+id)
+}
+
+func (p *adminPages[T]) update(c *gin.Context) {
+	id := c.Param("id")
+	var record T
+	view := p.recordView(c, "form", id)
+	form, done := p.bind(c, view, &record, view.RecordURL, "Save")
+	if done {
+		return
+	}
+	content, err := recordContent(record)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	// fields missing from the form, like timestamps, are kept
+	fields := map[string]interface{}{}
+	for _, field := range form.Fields {
+		name := strings.FieldsFunc(field.Name, func(r rune) bool { return r == '.' || r == '[' })[0]
+		if value, ok := content[name]; ok {
+			fields[name] = value
+		}
+	}
+	_, err = p.Repository.Patch(c, id, fields)
+	if p.written(c, view, form, err) {
+		return
+	}
+	HXRedirect(c, view.RecordURL)
+}
+
+func (p *adminPages[T]) delete(c *gin.Context) {
+	if err := p.Repository.Delete(c, c.Param("id")); err != nil {
+		Fail(c, err)
+		return
+	}
+	HXRedirect(c, p.base)
+}
+
+var adminTemplate = template.Must(template.New("admin").Funcs(TableFuncMap()).Funcs(FormFuncMap()).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Model.Title}}{{.Model.Title}} · {{end}}{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0; display: flex; min-height: 100vh; color: #1f2328; }
+nav { width: 14rem; background: #f6f8fa; padding: 1rem; border-right: 1px solid #d0d7de; }
+nav a { display: block; padding: .25rem 0; color: inherit; }
+nav a[aria-current] { font-weight: 600; }
+main { flex: 1; padding: 1rem 2rem; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .4rem .6rem; border-bottom: 1px solid #d0d7de; }
+dl { display: grid; grid-template-columns: max-content 1fr; gap: .4rem 1.5rem; }
+dt { font-weight: 600; }
+dd { margin: 0; white-space: pre-wrap; overflow-wrap: anywhere; }
+.ghost-admin-actions { display: flex; gap: 1rem; align-items: center; margin: 1rem 0; }
+.ghost-admin-metrics { display: grid; grid-template-columns: repeat(auto-fill, minmax(12rem, 1fr)); gap: 1rem; }
+.ghost-admin-metrics div { border: 1px solid #d0d7de; border-radius: 6px; padding: 1rem; }
+.ghost-form-field { margin-bottom: .75rem; }
+.ghost-form-error { color: #cf222e; }
+</style>
+</head>
+<body>
+<nav>
+<a href="{{if .Base}}{{.Base}}{{else}}/{{end}}"><strong>{{.Title}}</strong></a>
+{{$current := .Model.Name}}{{range .Models}}<a href="{{.URL}}"{{if eq .Name $current}} aria-current="page"{{end}}>{{.Title}}</a>
+{{end}}</nav>
+<main>
+{{if eq .Page "index"}}<h1>{{.Title}}</h1>
+{{if .Metrics}}<section class="ghost-admin-metrics">
+{{range .Metrics}}<div><h2>{{.Name}}</h2>{{if .Error}}<p class="ghost-form-error">{{.Error}}</p>{{else}}<p>{{.Value}}</p>{{end}}{{if .Description}}<small>{{.Description}}</small>{{end}}</div>
+{{end}}</section>
+{{end}}<ul>
+{{range .Models}}<li><a href="{{.URL}}">{{.Title}}</a></li>
+{{end}}</ul>
+{{else if eq .Page "list"}}<h1>{{.Model.Title}}</h1>
+{{if .CanWrite}}<p class="ghost-admin-actions"><a href="{{.Model.URL}}/new">New</a></p>
+{{end}}{{table .Table}}
+{{else if eq .Page "detail"}}<h1>{{.Model.Title}} {{.RecordID}}</h1>
+<dl>
+{{range .Record}}<dt>{{.Label}}</dt><dd>{{.Value}}</dd>
+{{end}}</dl>
+<div class="ghost-admin-actions"><a href="{{.Model.URL}}">Back</a>
+{{range .Actions}}<a href="{{.URL}}">{{.Title}}</a>
+{{end}}{{if .CanWrite}}<a href="{{.RecordURL}}/edit">Edit</a>
+<form action="{{.RecordURL}}/delete" method="post" onsubmit="return confirm('Delete this record?')">
+{{if .CSRF}}<input type="hidden" name="{{.CSRFField}}" value="{{.CSRF}}">
+{{end}}<button type="submit">Delete</button>
+</form>
+{{end}}</div>
+{{else if eq .Page "form"}}<h1>{{.Model.Title}}{{if .RecordID}} {{.RecordID}}{{else}}: new{{end}}</h1>
+{{form .Form}}
+<p class="ghost-admin-actions"><a href="{{if .RecordURL}}{{.RecordURL}}{{else}}{{.Model.URL}}{{end}}">Cancel</a></p>
+{{end}}</main>
+</body>
+</html>`))
@@ -0,0 +1,119 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// App is what Setup wired from a config: the router, the connection,
+// the store of the cache block, the engine of the pdf block and the
+// metrics. Setup attaches it to every request of the router and to
+// the jobs of its queue, where the package finds the cache and the
+// engine, see AppFrom. Outside them, pass it along with WithApp.
+//
+// Example:
+//  app, err := ghostConfig.SetupApp(context.Background(), r, nil, nil)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  posts := ghostutils.NewRepository[Post](app.DB, "post")
+//  posts.Cache = app.Cache
+type App struct {
+	Config GhostConfig
+	Engine *gin.Engine
+	DB     GhostDB
+	// Cache is the store of the cache block, see NewCacheStore.
+	Cache CacheStore
+	// CacheTTL is the ttl of the cache block, for the cached values
+	// without their own.
+	CacheTTL time.Duration
+	// PDF is the engine of the pdf block, see NewPDFEngine.
+	PDF PDFEngine
+	// Metrics records the requests when metrics.enabled is set, nil
+	// otherwise.
+	Metrics *Metrics
+
+	mu    sync.Mutex
+	stops []appHook
+}
+
+// appHook is an OnStop hook registered by Setup for the app.
+type appHook struct {
+	hook       LifecycleHook
+	unregister func()
+}
+
+type appKey struct{}
+
+// WithApp returns a copy of ctx carrying app, for the work an app
+// starts outside its requests and jobs.
+//
+// Example:
+//  ctx := ghostutils.WithApp(context.Background(), app)
+//  err := ghostutils.InvalidateCache(ctx, "authors")
+func WithApp(ctx context.Context, app *App) context.Context {
+	return context.WithValue(ctx, appKey{}, app)
+}
+
+// AppFrom returns the app carried by ctx, a *gin.Context or its
+// request context, nil outside one.
+func AppFrom(ctx context.Context) *App {
+	if ctx = cancelContext(ctx); ctx == nil {
+		return nil
+	}
+	app, _ := ctx.Value(appKey{}).(*App)
+	return app
+}
+
+// attach carries the app on the context of every request.
+func (app *App) attach() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(WithApp(c.Request.Context(), app))
+		c.Next()
+	}
+}
+
+// onStop registers hook with OnStop, keeping it for Stop.
+func (app *App) onStop(hook LifecycleHook) {
+	unregister := OnStop(hook)
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.stops = append(app.stops, appHook{hook: hook, unregister: unregister})
+}
+
+// Stop runs the OnStop hooks Setup registered for app, in the
+// reverse order, and removes them, stopping its job queue and closing
+// its connection without Run. Setting up an app again, as tests
+// do, leaves the hooks of the first one behind otherwise.
+//
+// Example:
+//  app, err := ghostConfig.SetupApp(context.Background(), r, nil, nil)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  defer app.Stop(context.Background())
+//
+// Returns:
+//  error of the hooks
+func (app *App) Stop(ctx context.Context) error {
+	app.mu.Lock()
+	stops := app.stops
+	app.stops = nil
+	app.mu.Unlock()
+	var problems []string
+	for i := len(stops) - 1; i >= 0; i-- {
+		stops[i].unregister()
+		if err := stops[i].hook(ctx); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("stop hook: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
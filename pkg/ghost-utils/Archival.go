@@ -0,0 +1,358 @@
+package ghostutils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// ArchivePolicy selects the records of Table to archive: those whose
+// TimeField is more than OlderThan in the past and that match Where.
+type ArchivePolicy struct {
+	Name      string
+	Table     string
+	TimeField string
+	OlderThan time.Duration
+	Where     string
+	Vars      map[string]interface{}
+	// BatchSize is the number of records per archive file. Defaults
+	// to 10000.
+	BatchSize int
+}
+
+// ArchiveIndex describes one archive file.
+type ArchiveIndex struct {
+	ID         string     `json:"id,omitempty"`
+	Policy     string     `json:"policy"`
+	Table      string     `json:"table"`
+	Key        string     `json:"key"`
+	Count      int        `json:"count"`
+	From       time.Time  `json:"from"`
+	To         time.Time  `json:"to"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RestoredAt *time.Time `json:"restored_at,omitempty"`
+	// Types are the fields restored as "datetime" or "record" values,
+	// which JSON keeps as strings.
+	Types map[string]string `json:"types,omitempty"`
+}
+
+// Archiver moves old records to gzipped NDJSON files in Store and
+// keeps an index of the files in IndexTable, "archive_index" by
+// default. Records are deleted only after their file is stored, in
+// the transaction indexing it.
+//
+// Example:
+//  archiver := &ghostutils.Archiver{DB: db, Store: ghostutils.LocalStorage{Root: "./cold"}}
+//  archiver.Add(ghostutils.ArchivePolicy{Name: "events", Table: "event", TimeField: "at", OlderThan: 90 * 24 * time.Hour})
+//  go archiver.Schedule(ctx, 24*time.Hour)
+//  archiver.Mount(r.Group("/admin", ghostutils.RequireRole(ghostutils.AdminRole)))
+type Archiver struct {
+	DB         *surrealdb.DB
+	Store      Storage
+	Prefix     string
+	IndexTable string
+	policies   []ArchivePolicy
+}
+
+// Add registers a policy.
+func (a *Archiver) Add(policy ArchivePolicy) {
+	a.policies = append(a.policies, policy)
+}
+
+func (a *Archiver) indexTable() string {
+	if a.IndexTable == "" {
+		return "archive_index"
+	}
+	return a.IndexTable
+}
+
+// exemptTable lists the restored records later runs leave alone.
+func (a *Archiver) exemptTable() string {
+	return a.indexTable() + "_exempt"
+}
+
+func (a *Archiver) prefix() string {
+	if a.Prefix == "" {
+		return "archive"
+	}
+	return a.Prefix
+}
+
+// Run archives every policy until no matching records remain and
+// returns the files written.
+func (a *Archiver) Run(ctx context.Context) ([]ArchiveIndex, error) {
+	var written []ArchiveIndex
+	for _, policy := range a.policies {
+		for {
+			index, ok, err := a.ArchiveBatch(ctx, policy)
+			if err != nil {
+				return written, fmt.Errorf("archiving %s: %w", policy.Name, err)
+			}
+			if !ok {
+				break
+			}
+			written = append(written, index)
+		}
+	}
+	return written, nil
+}
+
+// Schedule calls Run every interval until ctx is done.
+func (a *Archiver) Schedule(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.Run(ctx); err != nil {
+			log.Printf("archiver: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ArchiveBatch archives up to one batch of policy's oldest records.
+// ok is false when nothing matched.
+func (a *Archiver) ArchiveBatch(ctx context.Context, policy ArchivePolicy) (index ArchiveIndex, ok bool, err error) {
+	if !identifierPattern.MatchString(policy.Table) || !identifierPattern.MatchString(policy.TimeField) {
+		return index, false, fmt.Errorf("invalid table or time field")
+	}
+	batch := policy.BatchSize
+	if batch <= 0 {
+		batch = 10000
+	}
+	sql := fmt.Sprintf("SELECT * FROM %[1]s WHERE %[2]s < <datetime>$archive_before AND id NOTINSIDE (SELECT VALUE target FROM type::table($archive_exempt) WHERE meta::tb(target) = $archive_table)", policy.Table, policy.TimeField)
+	if policy.Where != "" {
+		sql += " AND (" + policy.Where + ")"
+	}
+	sql += fmt.Sprintf(" ORDER BY %s ASC LIMIT %d", policy.TimeField, batch)
+	vars := map[string]interface{}{}
+	for k, v := range policy.Vars {
+		vars[k] = v
+	}
+	vars["archive_before"] = time.Now().Add(-policy.OlderThan).UTC().Format(time.RFC3339Nano)
+	vars["archive_exempt"], vars["archive_table"] = a.exemptTable(), policy.Table
+	rows, err := surrealQuery[map[string]interface{}](a.DB, sql, vars)
+	if err != nil || len(rows) == 0 {
+		return index, false, err
+	}
+	if index.Types, err = archiveTypes(a.DB, policy.Table); err != nil {
+		return index, false, err
+	}
+	index.Types[policy.TimeField] = "datetime"
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	ids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return index, false, err
+		}
+		id, _ := row["id"].(string)
+		if !recordIDPattern.MatchString(id) {
+			return index, false, fmt.Errorf("unexpected record id %q", id)
+		}
+		ids = append(ids, id)
+		if at, err := time.Parse(time.RFC3339Nano, fmt.Sprint(row[policy.TimeField])); err == nil {
+			if index.From.IsZero() || at.Before(index.From) {
+				index.From = at
+			}
+			if at.After(index.To) {
+				index.To = at
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return index, false, err
+	}
+
+	now := time.Now().UTC()
+	index.Policy, index.Table, index.Count, index.CreatedAt = policy.Name, policy.Table, len(rows), now
+	index.Key = fmt.Sprintf("%s/%s/%s-%s.ndjson.gz", a.prefix(), policy.Table, now.Format("20060102T150405"), randomID(4))
+	if err := a.Store.Put(ctx, index.Key, &buf, "application/gzip"); err != nil {
+		return index, false, err
+	}
+	statements, err := surrealStatements(a.DB, "BEGIN TRANSACTION;\nCREATE type::table($tb) CONTENT $index;\nDELETE "+strings.Join(ids, ", ")+";\nCOMMIT TRANSACTION;", map[string]interface{}{
+		"tb":    a.indexTable(),
+		"index": index,
+	})
+	if err == nil && len(statements) != 2 {
+		err = fmt.Errorf("archive transaction returned %d results for 2 statements", len(statements))
+	}
+	for _, statement := range statements {
+		if err == nil && statement.Status != "OK" {
+			err = fmt.Errorf("indexing %s: %s", index.Key, statement.Detail)
+		}
+	}
+	if err != nil {
+		// nothing was deleted, the file is not needed
+		if derr := a.Store.Delete(ctx, index.Key); derr != nil {
+			log.Printf("archiver: removing %s: %v", index.Key, derr)
+		}
+		return index, false, err
+	}
+	var created []ArchiveIndex
+	if err := surrealdb.Unmarshal(statements[0].Result, &created); err == nil && len(created) > 0 {
+		index.ID = created[0].ID
+	}
+	return index, true, nil
+}
+
+// archiveTypes returns the top level fields of table defined as
+// datetimes or record links.
+func archiveTypes(db *surrealdb.DB, table string) (map[string]string, error) {
+	info, err := surrealInfo(db, "INFO FOR TABLE "+table)
+	if err != nil {
+		return nil, err
+	}
+	types := map[string]string{}
+	for name, definition := range info["fields"] {
+		m := fieldTypePattern.FindStringSubmatch(definition)
+		if m == nil || strings.ContainsAny(name, ".[") {
+			continue
+		}
+		typ := strings.TrimPrefix(normalizeSurrealType(strings.ToLower(m[1])), "option<")
+		switch {
+		case strings.HasPrefix(typ, "datetime"):
+			types[name] = "datetime"
+		case strings.HasPrefix(typ, "record"):
+			types[name] = "record"
+		}
+	}
+	return types, nil
+}
+
+// Archives lists the archive index, newest first.
+func (a *Archiver) Archives(ctx context.Context) ([]ArchiveIndex, error) {
+	return surrealQuery[ArchiveIndex](a.DB, "SELECT * FROM type::table($tb) ORDER BY created_at DESC", map[string]interface{}{"tb": a.indexTable()})
+}
+
+// Restore writes the records of an archive back to their table,
+// keeping their ids and the types of the fields in the archive's
+// Types, and marks the archive as restored. Restored records are
+// exempt from later runs.
+func (a *Archiver) Restore(ctx context.Context, id string) (int, error) {
+	index, ok, err := surrealFirst[ArchiveIndex](a.DB, "SELECT * FROM type::thing($tb, $id)", map[string]interface{}{
+		"tb": a.indexTable(),
+		"id": id,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, surrealdb.ErrNoRow
+	}
+	r, err := a.Store.Open(ctx, index.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	restored := 0
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return restored, err
+		}
+		if err := a.restoreRecord(index, record); err != nil {
+			return restored, err
+		}
+		restored++
+	}
+	if err := scanner.Err(); err != nil {
+		return restored, err
+	}
+	now := time.Now().UTC()
+	_, err = a.DB.Change(index.ID, map[string]interface{}{"restored_at": now})
+	return restored, err
+}
+
+// restoreRecord writes record back with the field types of index
+// and exempts it from archiving.
+func (a *Archiver) restoreRecord(index ArchiveIndex, record map[string]interface{}) error {
+	thing, _ := record["id"].(string)
+	if !recordIDPattern.MatchString(thing) || !strings.HasPrefix(thing, index.Table+":") {
+		return fmt.Errorf("unexpected record id %q in %s", thing, index.Key)
+	}
+	_, id := splitRecordID(thing, index.Table)
+	vars := map[string]interface{}{"tb": index.Table, "id": id, "thing": thing, "exempt": a.exemptTable(), "archive": index.ID}
+	fields := make([]string, 0, len(record))
+	for name, value := range record {
+		if name == "id" {
+			continue
+		}
+		key, _ := json.Marshal(name)
+		v := fmt.Sprintf("v%d", len(fields))
+		vars[v] = value
+		text, isString := value.(string)
+		switch {
+		case isString && index.Types[name] == "datetime":
+			fields = append(fields, fmt.Sprintf("%s: <datetime> $%s", key, v))
+		case isString && index.Types[name] == "record":
+			vars[v+"_tb"], vars[v] = splitRecordID(text, "")
+			fields = append(fields, fmt.Sprintf("%s: type::thing($%s_tb, $%s)", key, v, v))
+		default:
+			fields = append(fields, fmt.Sprintf("%s: $%s", key, v))
+		}
+	}
+	statements, err := surrealStatements(a.DB, "BEGIN TRANSACTION;\nUPDATE type::thing($tb, $id) CONTENT { "+strings.Join(fields, ", ")+" };\nUPDATE type::thing($exempt, $thing) SET target = type::thing($tb, $id), archive = $archive, restored_at = time::now();\nCOMMIT TRANSACTION;", vars)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return fmt.Errorf("restoring %s: %s", thing, statement.Detail)
+		}
+	}
+	return nil
+}
+
+// Mount registers GET /archives, POST /archives/run and
+// POST /archives/:id/restore. Protect the group, they are meant for
+// operators.
+func (a *Archiver) Mount(g *gin.RouterGroup) {
+	g.GET("/archives", func(c *gin.Context) {
+		archives, err := a.Archives(c.Request.Context())
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, archives)
+	})
+	g.POST("/archives/run", func(c *gin.Context) {
+		written, err := a.Run(c.Request.Context())
+		if err != nil {
+			Fail(c, AsGhostError(err).WithDetails(gin.H{"written": written}))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"written": written})
+	})
+	g.POST("/archives/:id/restore", func(c *gin.Context) {
+		_, id := splitRecordID(c.Param("id"), "")
+		restored, err := a.Restore(c.Request.Context(), id)
+		if err != nil {
+			Fail(c, AsGhostError(err).WithDetails(gin.H{"restored": restored}))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"restored": restored})
+	})
+}
@@ -0,0 +1,287 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Async task states.
+const (
+	AsyncPending   = "pending"
+	AsyncRunning   = "running"
+	AsyncSucceeded = "succeeded"
+	AsyncFailed    = "failed"
+)
+
+// AsyncTask is the stored state of a long running request.
+type AsyncTask struct {
+	ID        string      `json:"id,omitempty"`
+	Status    string      `json:"status"`
+	Owner     string      `json:"owner,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// AsyncFunc is the work of the tasks of one job type, see
+// RegisterAsync. It runs on a job worker, with the caller's Identity
+// in ctx, and returns the result the client fetches.
+type AsyncFunc[T any] func(ctx context.Context, payload T) (interface{}, error)
+
+// AsyncStore persists async tasks.
+type AsyncStore interface {
+	Save(ctx context.Context, task AsyncTask) error
+	Load(ctx context.Context, id string) (AsyncTask, bool, error)
+}
+
+// Async turns long running handlers into 202 Accepted responses with
+// a status URL the client polls. The work runs as a job of Queue, so
+// it is retried and survives restarts; the task fails once its job
+// is dead.
+//
+// Example:
+//  async := &ghostutils.Async{Store: ghostutils.SurrealAsyncStore{DB: db}, Queue: jobs, BasePath: "/api/async"}
+//  ghostutils.RegisterAsync(async, "report", func(ctx context.Context, req ReportRequest) (interface{}, error) {
+//      return reports.Generate(ctx, req)
+//  })
+//  async.Mount(r.Group("/api/async"))
+//  r.POST("/api/reports", async.Handle("report", func(c *gin.Context) (interface{}, error) {
+//      var req ReportRequest
+//      err := c.ShouldBindJSON(&req)
+//      return req, err
+//  }))
+type Async struct {
+	Store AsyncStore
+	Queue *JobQueue
+	// BasePath is where Mount was called, used for status URLs.
+	BasePath string
+	// Timeout bounds each run of a task. Defaults to 30 minutes; the
+	// Timeout of the jobs block bounds it too.
+	Timeout time.Duration
+}
+
+// asyncJob is the job payload of a task.
+type asyncJob[T any] struct {
+	Task     string   `json:"task"`
+	Identity Identity `json:"identity"`
+	Payload  T        `json:"payload"`
+}
+
+func (a *Async) statusURL(id string) string {
+	return strings.TrimRight(a.BasePath, "/") + "/" + id
+}
+
+// RegisterAsync registers fn to run the tasks of jobType that Handle
+// enqueues, decoding their payload into T.
+func RegisterAsync[T any](a *Async, jobType string, fn AsyncFunc[T]) {
+	RegisterJob(jobType, func(ctx context.Context, job asyncJob[T]) error {
+		task, ok, err := a.Store.Load(ctx, job.Task)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: async task %s not found", ErrJobPermanent, job.Task)
+		}
+		if job.Identity.ID != "" {
+			ctx = WithIdentity(ctx, job.Identity)
+		}
+		return a.execute(ctx, task, func(ctx context.Context) (interface{}, error) {
+			return fn(ctx, job.Payload)
+		})
+	})
+}
+
+// Handle returns a handler that calls prepare with the request, then
+// enqueues the payload it returns as a job of jobType and responds
+// 202 with the task id and status URL. An error from prepare is
+// answered with 400. The task runs with the caller's Identity.
+func (a *Async) Handle(jobType string, prepare func(c *gin.Context) (interface{}, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		payload, err := prepare(c)
+		if err != nil {
+			FailStatus(c, http.StatusBadRequest, err)
+			return
+		}
+		now := time.Now().UTC()
+		task := AsyncTask{ID: randomID(16), Status: AsyncPending, CreatedAt: now, UpdatedAt: now}
+		identity, _ := CurrentIdentity(c)
+		task.Owner = identity.ID
+		if err := a.Store.Save(c.Request.Context(), task); err != nil {
+			Fail(c, err)
+			return
+		}
+		job := asyncJob[interface{}]{Task: task.ID, Identity: identity, Payload: payload}
+		if _, err := a.Queue.Enqueue(c.Request.Context(), jobType, job); err != nil {
+			task.Status, task.Error, task.UpdatedAt = AsyncFailed, "the task could not be queued", time.Now().UTC()
+			_ = a.Store.Save(c.Request.Context(), task)
+			Fail(c, err)
+			return
+		}
+		url := a.statusURL(task.ID)
+		c.Header("Location", url)
+		c.JSON(http.StatusAccepted, gin.H{"id": task.ID, "status": task.Status, "status_url": url})
+	}
+}
+
+// execute runs one attempt of task. A failed attempt the job queue
+// retries leaves the task pending; the last one fails it.
+func (a *Async) execute(ctx context.Context, task AsyncTask, work func(ctx context.Context) (interface{}, error)) error {
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	task.Status, task.UpdatedAt = AsyncRunning, time.Now().UTC()
+	if err := a.Store.Save(ctx, task); err != nil {
+		return err
+	}
+	result, err := func() (result interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return work(ctx)
+	}()
+	task.UpdatedAt = time.Now().UTC()
+	switch {
+	case err == nil:
+		task.Status, task.Result = AsyncSucceeded, result
+	case asyncRetried(ctx, err):
+		task.Status = AsyncPending
+	default:
+		task.Status, task.Error = AsyncFailed, err.Error()
+	}
+	// the task context may have expired, the final state must still
+	// be written
+	if saveErr := a.Store.Save(context.Background(), task); saveErr != nil && err == nil {
+		return saveErr
+	}
+	return err
+}
+
+// asyncRetried reports whether the job queue runs the task of ctx
+// again after err.
+func asyncRetried(ctx context.Context, err error) bool {
+	job, ok := CurrentJob(ctx)
+	return ok && job.Attempts < job.MaxAttempts && !errors.Is(err, ErrJobPermanent)
+}
+
+// Mount registers GET /:id for the task status and GET /:id/result
+// for its result. Tasks created by an identity are only visible to
+// it.
+func (a *Async) Mount(g *gin.RouterGroup) {
+	g.GET("/:id", func(c *gin.Context) {
+		task, ok := a.load(c)
+		if !ok {
+			return
+		}
+		body := gin.H{"id": task.ID, "status": task.Status, "created_at": task.CreatedAt, "updated_at": task.UpdatedAt}
+		switch task.Status {
+		case AsyncSucceeded:
+			body["result_url"] = a.statusURL(task.ID) + "/result"
+		case AsyncFailed:
+			body["error"] = task.Error
+		default:
+			c.Header("Retry-After", "2")
+		}
+		c.JSON(http.StatusOK, body)
+	})
+	g.GET("/:id/result", func(c *gin.Context) {
+		task, ok := a.load(c)
+		if !ok {
+			return
+		}
+		switch task.Status {
+		case AsyncSucceeded:
+			c.JSON(http.StatusOK, task.Result)
+		case AsyncFailed:
+			Fail(c, NewGhostError(http.StatusInternalServerError, "task_failed", task.Error))
+		default:
+			c.Header("Retry-After", "2")
+			c.Header("Location", a.statusURL(task.ID))
+			c.JSON(http.StatusAccepted, gin.H{"id": task.ID, "status": task.Status})
+		}
+	})
+}
+
+func (a *Async) load(c *gin.Context) (AsyncTask, bool) {
+	task, ok, err := a.Store.Load(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		Fail(c, err)
+		return task, false
+	}
+	identity, _ := CurrentIdentity(c)
+	if !ok || (task.Owner != "" && task.Owner != identity.ID) {
+		Fail(c, NewGhostError(http.StatusNotFound, "not_found", "task not found"))
+		return task, false
+	}
+	return task, true
+}
+
+// MemoryAsyncStore keeps tasks in memory. Tasks are lost on restart.
+type MemoryAsyncStore struct {
+	mu    sync.Mutex
+	tasks map[string]AsyncTask
+}
+
+// Save implements AsyncStore.
+func (s *MemoryAsyncStore) Save(ctx context.Context, task AsyncTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tasks == nil {
+		s.tasks = map[string]AsyncTask{}
+	}
+	s.tasks[task.ID] = task
+	return nil
+}
+
+// Load implements AsyncStore.
+func (s *MemoryAsyncStore) Load(ctx context.Context, id string) (AsyncTask, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	return task, ok, nil
+}
+
+// SurrealAsyncStore keeps tasks in a SurrealDB table, "async_task"
+// by default.
+type SurrealAsyncStore struct {
+	DB    *surrealdb.DB
+	Table string
+}
+
+func (s SurrealAsyncStore) table() string {
+	if s.Table == "" {
+		return "async_task"
+	}
+	return s.Table
+}
+
+// Save implements AsyncStore.
+func (s SurrealAsyncStore) Save(ctx context.Context, task AsyncTask) error {
+	id := task.ID
+	task.ID = ""
+	_, err := s.DB.Update(recordID(s.table(), id), task)
+	return err
+}
+
+// Load implements AsyncStore.
+func (s SurrealAsyncStore) Load(ctx context.Context, id string) (AsyncTask, bool, error) {
+	task, ok, err := surrealFirst[AsyncTask](s.DB, "SELECT * FROM type::thing($tb, $id)", map[string]interface{}{
+		"tb": s.table(),
+		"id": id,
+	})
+	task.ID = id
+	return task, ok, err
+}
@@ -0,0 +1,56 @@
+package ghostutils
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// AuditEntry is a single security relevant event.
+type AuditEntry struct {
+	Action string `json:"action"`
+	// Actor is the identity that performed the action, Subject the
+	// record it was performed on or as.
+	Actor   string                 `json:"actor"`
+	Subject string                 `json:"subject,omitempty"`
+	IP      string                 `json:"ip,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	At      time.Time              `json:"at"`
+}
+
+// AuditLog records audit entries.
+type AuditLog interface {
+	Record(ctx context.Context, entry AuditEntry) error
+}
+
+// LogAuditLog writes audit entries to the standard logger.
+type LogAuditLog struct{}
+
+// Record implements AuditLog.
+func (LogAuditLog) Record(ctx context.Context, entry AuditEntry) error {
+	log.Printf("audit: %s actor=%s subject=%s ip=%s details=%v",
+		entry.Action, entry.Actor, entry.Subject, entry.IP, entry.Details)
+	return nil
+}
+
+// SurrealAuditLog appends audit entries to a SurrealDB table.
+type SurrealAuditLog struct {
+	DB *surrealdb.DB
+	// Table defaults to "audit_log".
+	Table string
+}
+
+// Record implements AuditLog.
+func (a SurrealAuditLog) Record(ctx context.Context, entry AuditEntry) error {
+	table := a.Table
+	if table == "" {
+		table = "audit_log"
+	}
+	if entry.At.IsZero() {
+		entry.At = time.Now().UTC()
+	}
+	_, err := a.DB.Create(table, entry)
+	return err
+}
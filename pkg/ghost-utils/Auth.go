@@ -0,0 +1,479 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Defaults applied by NewAuth to the auth block.
+const (
+	DefaultAuthTokenTTL   = 15 * time.Minute
+	DefaultAuthRefreshTTL = 30 * 24 * time.Hour
+)
+
+// Errors returned by Auth.
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidToken       = errors.New("invalid or expired token")
+)
+
+// AuthConfig is the `auth:` block of ghost.yaml. Scope names the
+// SurrealDB scope whose SIGNUP and SIGNIN clauses check credentials;
+// SigningKey signs the tokens issued by ghost and should come from a
+// secret reference.
+//
+// Example:
+//  auth:
+//    scope: account
+//    token-ttl: 15m
+//    refresh-ttl: 720h
+//    signing-key: ${AUTH_SIGNING_KEY}
+type AuthConfig struct {
+	Scope      string        `yaml:"scope"`
+	TokenTTL   time.Duration `yaml:"token-ttl"`
+	RefreshTTL time.Duration `yaml:"refresh-ttl"`
+	SigningKey string        `yaml:"signing-key"`
+	// Issuer is the iss claim of issued tokens, the project name by
+	// default.
+	Issuer string `yaml:"issuer"`
+}
+
+// AuthTokens is the response of signup, signin and refresh.
+type AuthTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Token uses, so a refresh token cannot be used as an access token.
+const (
+	authAccessToken  = "access"
+	authRefreshToken = "refresh"
+)
+
+type authClaims struct {
+	jwt.RegisteredClaims
+	Use string `json:"use"`
+	// Family is the login a refresh token belongs to, see
+	// RefreshTokenStore.
+	Family string `json:"fam,omitempty"`
+}
+
+// RefreshTokenStore keeps the live refresh token of every login, by
+// its jti, so each refresh rotates the token and one used twice, a
+// sign it was stolen, ends the login.
+type RefreshTokenStore interface {
+	// Start records jti as the refresh token of the new login family.
+	Start(ctx context.Context, family, jti string, expires time.Time) error
+	// Rotate replaces jti by next when jti is the live token of
+	// family. Otherwise it ends the family and reports false.
+	Rotate(ctx context.Context, family, jti, next string, expires time.Time) (bool, error)
+}
+
+// Auth signs accounts up and in through a SurrealDB scope and issues
+// its own access and refresh tokens for the record id SurrealDB
+// authenticated.
+type Auth struct {
+	Config AuthConfig
+	// RefreshTokens rotates refresh tokens, in memory by default; use
+	// SurrealRefreshTokenStore when several instances share logins.
+	RefreshTokens RefreshTokenStore
+	// connect opens a connection for one signup or signin, so the
+	// scope session never replaces that of the shared connection.
+	connect   func() (*surrealdb.DB, error)
+	namespace string
+	database  string
+}
+
+// NewAuth builds the auth module from the auth block of the config.
+//
+// Example:
+//  auth, err := ghostConfig.NewAuth()
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  r.Use(auth.Middleware())
+//  auth.Mount(r.Group("/auth"))
+//  r.GET("/me", ghostutils.RequireIdentity(), me)
+//
+// Returns:
+//  *Auth
+//  error if no scope or signing key is configured
+func (ghostConfig GhostConfig) NewAuth() (*Auth, error) {
+	config := ghostConfig.Auth
+	if config.Scope == "" || config.SigningKey == "" {
+		return nil, fmt.Errorf("auth needs auth.scope and auth.signing-key")
+	}
+	if config.TokenTTL == 0 {
+		config.TokenTTL = DefaultAuthTokenTTL
+	}
+	if config.RefreshTTL == 0 {
+		config.RefreshTTL = DefaultAuthRefreshTTL
+	}
+	if config.Issuer == "" {
+		config.Issuer = ghostConfig.Name
+	}
+	url, connection := ghostConfig.SurrealDB.URL, ghostConfig.SurrealDB.Connection
+	return &Auth{
+		Config:        config,
+		RefreshTokens: NewMemoryRefreshTokenStore(),
+		connect:       func() (*surrealdb.DB, error) { return connection.Dial(url) },
+		namespace:     ghostConfig.SurrealDB.Namespace,
+		database:      ghostConfig.SurrealDB.Database,
+	}, nil
+}
+
+// scopeAuth runs signup or signin with the scope variables vars and
+// returns the id of the authenticated record.
+func (a *Auth) scopeAuth(signup bool, vars map[string]interface{}) (string, error) {
+	params := make(map[string]interface{}, len(vars)+3)
+	for name, value := range vars {
+		params[name] = value
+	}
+	params["NS"], params["DB"], params["SC"] = a.namespace, a.database, a.Config.Scope
+	conn, err := a.connect()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	var token interface{}
+	if signup {
+		token, err = conn.Signup(params)
+	} else {
+		token, err = conn.Signin(params)
+	}
+	if credentialFailure(err) {
+		return "", ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", err
+	}
+	raw, ok := token.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected scope token %T", token)
+	}
+	// the token was just issued to us by SurrealDB, only its record id
+	// is needed
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(raw, claims); err != nil {
+		return "", err
+	}
+	id, _ := claims["ID"].(string)
+	if id == "" {
+		return "", fmt.Errorf("scope token has no record id")
+	}
+	return id, nil
+}
+
+// credentialFailure reports whether err is SurrealDB refusing the
+// scope credentials, rather than a failing connection or scope.
+func credentialFailure(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		// the RPC error type of the driver is internal
+		if reflect.TypeOf(err).String() == "*websocket.RPCError" {
+			return strings.Contains(strings.ToLower(err.Error()), "authentication")
+		}
+	}
+	return false
+}
+
+// Signup creates an account through the scope's SIGNUP clause, which
+// receives vars, and returns tokens for it.
+func (a *Auth) Signup(vars map[string]interface{}) (AuthTokens, error) {
+	id, err := a.scopeAuth(true, vars)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	return a.IssueTokens(id)
+}
+
+// Signin checks vars through the scope's SIGNIN clause and returns
+// tokens for the account.
+//
+// Returns:
+//  AuthTokens
+//  error, ErrInvalidCredentials if the scope rejected vars
+func (a *Auth) Signin(vars map[string]interface{}) (AuthTokens, error) {
+	id, err := a.scopeAuth(false, vars)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	return a.IssueTokens(id)
+}
+
+// IssueTokens returns a new access and refresh token for the record
+// id, e.g. after a passkey login, starting a refresh token family.
+func (a *Auth) IssueTokens(id string) (AuthTokens, error) {
+	family, jti := randomID(16), randomID(16)
+	if err := a.RefreshTokens.Start(context.Background(), family, jti, time.Now().Add(a.Config.RefreshTTL)); err != nil {
+		return AuthTokens{}, err
+	}
+	return a.tokens(id, family, jti)
+}
+
+// tokens signs an access token and the refresh token jti of family.
+func (a *Auth) tokens(id, family, jti string) (AuthTokens, error) {
+	access, err := a.sign(id, authAccessToken, a.Config.TokenTTL, "", randomID(16))
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	refresh, err := a.sign(id, authRefreshToken, a.Config.RefreshTTL, family, jti)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	return AuthTokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(a.Config.TokenTTL / time.Second),
+	}, nil
+}
+
+func (a *Auth) sign(id, use string, ttl time.Duration, family, jti string) (string, error) {
+	now := time.Now()
+	claims := authClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   id,
+			Issuer:    a.Config.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Use:    use,
+		Family: family,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(a.Config.SigningKey))
+}
+
+// Verify checks an access token and returns the record id it was
+// issued for.
+func (a *Auth) Verify(token string) (string, error) {
+	claims, err := a.verify(token, authAccessToken)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+func (a *Auth) verify(token, use string) (*authClaims, error) {
+	claims := &authClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(a.Config.SigningKey), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(a.Config.Issuer))
+	if err != nil || claims.Use != use || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// Refresh exchanges a refresh token for new tokens. The refresh token
+// is rotated: using it again fails and ends its login, so a stolen
+// token is only good until either party refreshes.
+//
+// Returns:
+//  AuthTokens
+//  error, ErrInvalidToken for an invalid, expired or reused token
+func (a *Auth) Refresh(refreshToken string) (AuthTokens, error) {
+	claims, err := a.verify(refreshToken, authRefreshToken)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	if claims.Family == "" || claims.ID == "" {
+		return AuthTokens{}, ErrInvalidToken
+	}
+	next := randomID(16)
+	ok, err := a.RefreshTokens.Rotate(context.Background(), claims.Family, claims.ID, next, time.Now().Add(a.Config.RefreshTTL))
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	if !ok {
+		return AuthTokens{}, ErrInvalidToken
+	}
+	return a.tokens(claims.Subject, claims.Family, next)
+}
+
+// Middleware authenticates requests carrying an
+// "Authorization: Bearer" access token, storing the record id as the
+// Identity of the request. Requests without a token continue
+// anonymously, so pair it with RequireIdentity; invalid tokens are
+// answered with 401.
+func (a *Auth) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" {
+			c.Next()
+			return
+		}
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		if token == header {
+			Fail(c, NewGhostError(http.StatusUnauthorized, "unauthenticated", "expected a bearer token"))
+			return
+		}
+		id, err := a.Verify(token)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			FailStatus(c, http.StatusUnauthorized, err)
+			return
+		}
+		SetIdentity(c, Identity{ID: id})
+		c.Next()
+	}
+}
+
+func (a *Auth) scopeHandler(signup bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var vars map[string]interface{}
+		if err := c.ShouldBindJSON(&vars); err != nil {
+			FailStatus(c, http.StatusBadRequest, err)
+			return
+		}
+		var (
+			tokens AuthTokens
+			err    error
+		)
+		if signup {
+			tokens, err = a.Signup(vars)
+		} else {
+			tokens, err = a.Signin(vars)
+		}
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			if signup {
+				Fail(c, NewGhostError(http.StatusBadRequest, "invalid_request", "signup was rejected"))
+			} else {
+				FailStatus(c, http.StatusUnauthorized, err)
+			}
+		case err != nil:
+			Fail(c, err)
+		default:
+			c.Header("Cache-Control", "no-store")
+			c.JSON(http.StatusOK, tokens)
+		}
+	}
+}
+
+// SignupHandler serves signup. The JSON body holds the scope
+// variables, e.g. {"email": ..., "pass": ...}.
+func (a *Auth) SignupHandler() gin.HandlerFunc {
+	return a.scopeHandler(true)
+}
+
+// SigninHandler serves signin with the scope variables as JSON body.
+// Put a LoginGuard in front of it to slow down guessing.
+func (a *Auth) SigninHandler() gin.HandlerFunc {
+	return a.scopeHandler(false)
+}
+
+// RefreshHandler exchanges {"refresh_token": ...} for new tokens.
+func (a *Auth) RefreshHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			FailStatus(c, http.StatusBadRequest, err)
+			return
+		}
+		tokens, err := a.Refresh(body.RefreshToken)
+		if errors.Is(err, ErrInvalidToken) {
+			FailStatus(c, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// Mount registers POST /signup, /signin and /refresh on g.
+func (a *Auth) Mount(g *gin.RouterGroup) {
+	g.POST("/signup", a.SignupHandler())
+	g.POST("/signin", a.SigninHandler())
+	g.POST("/refresh", a.RefreshHandler())
+}
+
+// MemoryRefreshTokenStore keeps refresh token families in process, for
+// a single instance.
+type MemoryRefreshTokenStore struct {
+	mu       sync.Mutex
+	families map[string]memoryRefreshToken
+}
+
+type memoryRefreshToken struct {
+	jti     string
+	expires time.Time
+}
+
+// NewMemoryRefreshTokenStore returns an empty in-memory store.
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{families: map[string]memoryRefreshToken{}}
+}
+
+// Start implements RefreshTokenStore.
+func (s *MemoryRefreshTokenStore) Start(ctx context.Context, family, jti string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for name, token := range s.families {
+		if now.After(token.expires) {
+			delete(s.families, name)
+		}
+	}
+	s.families[family] = memoryRefreshToken{jti: jti, expires: expires}
+	return nil
+}
+
+// Rotate implements RefreshTokenStore.
+func (s *MemoryRefreshTokenStore) Rotate(ctx context.Context, family, jti, next string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.families[family]
+	if !ok || token.jti != jti || time.Now().After(token.expires) {
+		delete(s.families, family)
+		return false, nil
+	}
+	s.families[family] = memoryRefreshToken{jti: next, expires: expires}
+	return true, nil
+}
+
+// SurrealRefreshTokenStore keeps refresh token families in the
+// auth_refresh table, shared between instances.
+type SurrealRefreshTokenStore struct {
+	DB GhostDB
+}
+
+// Start implements RefreshTokenStore.
+func (s SurrealRefreshTokenStore) Start(ctx context.Context, family, jti string, expires time.Time) error {
+	_, err := surrealQuery[map[string]interface{}](WithContext(ctx, s.DB),
+		`CREATE type::thing("auth_refresh", $family) SET jti = $jti, expires = <datetime>$expires`,
+		map[string]interface{}{"family": family, "jti": jti, "expires": expires.UTC().Format(time.RFC3339Nano)})
+	return err
+}
+
+// Rotate implements RefreshTokenStore.
+func (s SurrealRefreshTokenStore) Rotate(ctx context.Context, family, jti, next string, expires time.Time) (bool, error) {
+	db := WithContext(ctx, s.DB)
+	vars := map[string]interface{}{"family": family, "jti": jti, "next": next, "expires": expires.UTC().Format(time.RFC3339Nano)}
+	_, ok, err := surrealFirst[map[string]interface{}](db,
+		`UPDATE type::thing("auth_refresh", $family) SET jti = $next, expires = <datetime>$expires WHERE jti = $jti AND expires > time::now() RETURN AFTER`, vars)
+	if err != nil || ok {
+		return ok, err
+	}
+	_, err = surrealQuery[map[string]interface{}](db, `DELETE type::thing("auth_refresh", $family)`, vars)
+	return false, err
+}
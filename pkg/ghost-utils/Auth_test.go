@@ -0,0 +1,148 @@
+package ghostutils_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+	"github.com/adamkali/ghost_utils/pkg/ghosttest"
+	"github.com/gin-gonic/gin"
+)
+
+func testAuth(t *testing.T, config ghostutils.GhostConfig) *ghostutils.Auth {
+	t.Helper()
+	config.Auth = ghostutils.AuthConfig{Scope: "account", SigningKey: "test-signing-key"}
+	auth, err := config.NewAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func refreshTokenStores(t *testing.T, test func(t *testing.T, store ghostutils.RefreshTokenStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, ghostutils.NewMemoryRefreshTokenStore())
+	})
+	t.Run("surrealdb", func(t *testing.T) {
+		test(t, ghostutils.SurrealRefreshTokenStore{DB: ghosttest.DB(t)})
+	})
+}
+
+func TestAuthRefreshRotates(t *testing.T) {
+	refreshTokenStores(t, func(t *testing.T, store ghostutils.RefreshTokenStore) {
+		auth := testAuth(t, ghostutils.GhostConfig{Name: "ghosttest"})
+		auth.RefreshTokens = store
+		tokens, err := auth.IssueTokens("account:ada")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, err := auth.Verify(tokens.AccessToken); err != nil || id != "account:ada" {
+			t.Fatalf("access token: %q, %v", id, err)
+		}
+		if _, err := auth.Verify(tokens.RefreshToken); !errors.Is(err, ghostutils.ErrInvalidToken) {
+			t.Errorf("refresh token as access token: %v, want ErrInvalidToken", err)
+		}
+		if _, err := auth.Refresh(tokens.AccessToken); !errors.Is(err, ghostutils.ErrInvalidToken) {
+			t.Errorf("access token as refresh token: %v, want ErrInvalidToken", err)
+		}
+
+		next, err := auth.Refresh(tokens.RefreshToken)
+		if err != nil {
+			t.Fatalf("refresh: %v", err)
+		}
+		if _, err := auth.Refresh(tokens.RefreshToken); !errors.Is(err, ghostutils.ErrInvalidToken) {
+			t.Errorf("reused refresh token: %v, want ErrInvalidToken", err)
+		}
+		if _, err := auth.Refresh(next.RefreshToken); !errors.Is(err, ghostutils.ErrInvalidToken) {
+			t.Errorf("refresh token of an ended login: %v, want ErrInvalidToken", err)
+		}
+	})
+}
+
+func TestAuthRejectsOtherKeys(t *testing.T) {
+	auth := testAuth(t, ghostutils.GhostConfig{Name: "ghosttest"})
+	tokens, err := auth.IssueTokens("account:ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := testAuth(t, ghostutils.GhostConfig{Name: "ghosttest"})
+	other.Config.SigningKey = "other-signing-key"
+	if _, err := other.Verify(tokens.AccessToken); !errors.Is(err, ghostutils.ErrInvalidToken) {
+		t.Errorf("token of another key: %v, want ErrInvalidToken", err)
+	}
+	issuer := testAuth(t, ghostutils.GhostConfig{Name: "other"})
+	if _, err := issuer.Verify(tokens.AccessToken); !errors.Is(err, ghostutils.ErrInvalidToken) {
+		t.Errorf("token of another issuer: %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	auth := testAuth(t, ghostutils.GhostConfig{Name: "ghosttest"})
+	r := gin.New()
+	r.Use(auth.Middleware())
+	r.GET("/me", ghostutils.RequireIdentity(), func(c *gin.Context) {
+		identity, _ := ghostutils.CurrentIdentity(c)
+		c.String(http.StatusOK, identity.ID)
+	})
+	tokens, err := auth.IssueTokens("account:ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name, header string
+		want         int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"not bearer", "Basic YWRhOnB3", http.StatusUnauthorized},
+		{"refresh token", "Bearer " + tokens.RefreshToken, http.StatusUnauthorized},
+		{"access token", "Bearer " + tokens.AccessToken, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.want)
+		}
+		if test.want == http.StatusOK && w.Body.String() != "account:ada" {
+			t.Errorf("%s: identity %q", test.name, w.Body)
+		}
+	}
+}
+
+func TestAuthScope(t *testing.T) {
+	srv := ghosttest.NewTestServer(t)
+	ghosttest.Exec(t, srv.DB, `DEFINE SCOPE account SESSION 1h
+		SIGNUP (CREATE account SET email = $email, pass = crypto::argon2::generate($pass))
+		SIGNIN (SELECT * FROM account WHERE email = $email AND crypto::argon2::compare(pass, $pass))`, nil)
+	auth := testAuth(t, srv.Config)
+	auth.Mount(srv.Engine.Group("/auth"))
+
+	var signup ghostutils.AuthTokens
+	srv.PostJSON("/auth/signup", map[string]string{"email": "ada@example.com", "pass": "correct horse"}).
+		AssertStatus(http.StatusOK).
+		AssertHeader("Cache-Control", "no-store").
+		JSON(&signup)
+	id, err := auth.Verify(signup.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signin ghostutils.AuthTokens
+	srv.PostJSON("/auth/signin", map[string]string{"email": "ada@example.com", "pass": "correct horse"}).
+		AssertStatus(http.StatusOK).
+		JSON(&signin)
+	if got, err := auth.Verify(signin.AccessToken); err != nil || got != id {
+		t.Errorf("signin: %q, %v, want %q", got, err, id)
+	}
+	srv.PostJSON("/auth/signin", map[string]string{"email": "ada@example.com", "pass": "wrong"}).
+		AssertStatus(http.StatusUnauthorized)
+	srv.PostJSON("/auth/refresh", map[string]string{"refresh_token": signin.RefreshToken}).
+		AssertStatus(http.StatusOK)
+	srv.PostJSON("/auth/refresh", map[string]string{"refresh_token": signin.RefreshToken}).
+		AssertStatus(http.StatusUnauthorized)
+}
@@ -0,0 +1,321 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/datamatrix"
+	"github.com/boombuler/barcode/ean"
+	"github.com/boombuler/barcode/qr"
+	"github.com/gin-gonic/gin"
+)
+
+// Barcode kinds.
+const (
+	BarcodeQR         = "qr"
+	BarcodeDataMatrix = "datamatrix"
+	BarcodeCode128    = "code128"
+	BarcodeEAN        = "ean"
+)
+
+// Barcode image formats.
+const (
+	BarcodePNG = "png"
+	BarcodeSVG = "svg"
+)
+
+// Defaults of Barcodes.
+const (
+	DefaultBarcodeSize = 256
+	DefaultBarcodeTTL  = 24 * time.Hour
+)
+
+// maxBarcodeSize bounds the size a token may ask for.
+const maxBarcodeSize = 2048
+
+// ErrBarcodeKind is returned for a barcode kind RenderBarcode does not
+// know.
+var ErrBarcodeKind = errors.New("unknown barcode kind")
+
+// RenderBarcode encodes data as a barcode of kind, up to size pixels
+// wide, as a PNG or SVG image. 2D codes are square with a quiet zone
+// of four modules; 1D codes are a quarter as high as they are wide.
+//
+// Example:
+//  image, contentType, err := ghostutils.RenderBarcode(ghostutils.BarcodeQR, "https://example.com/t/42", 300, ghostutils.BarcodeSVG)
+//
+// Returns:
+//  the image
+//  its content type
+//  error for an unknown kind or format, or data the kind cannot encode
+func RenderBarcode(kind, data string, size int, format string) ([]byte, string, error) {
+	var code barcode.Barcode
+	var err error
+	switch kind {
+	case BarcodeQR:
+		code, err = qr.Encode(data, qr.M, qr.Auto)
+	case BarcodeDataMatrix:
+		code, err = datamatrix.Encode(data)
+	case BarcodeCode128:
+		code, err = code128.Encode(data)
+	case BarcodeEAN:
+		code, err = ean.Encode(data)
+	default:
+		return nil, "", fmt.Errorf("%w %q", ErrBarcodeKind, kind)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if size <= 0 {
+		size = DefaultBarcodeSize
+	}
+	grid := newBarcodeGrid(code, kind == BarcodeQR || kind == BarcodeDataMatrix)
+	switch format {
+	case BarcodePNG:
+		var b bytes.Buffer
+		if err := png.Encode(&b, grid.image(size)); err != nil {
+			return nil, "", err
+		}
+		return b.Bytes(), "image/png", nil
+	case BarcodeSVG:
+		return grid.svg(size), "image/svg+xml", nil
+	default:
+		return nil, "", fmt.Errorf("unknown barcode format %q", format)
+	}
+}
+
+// barcodeGrid is the dark modules of a barcode with its quiet zone.
+type barcodeGrid struct {
+	dark          [][]bool
+	width, height int
+	margin        int
+	square        bool
+}
+
+func newBarcodeGrid(code barcode.Barcode, square bool) barcodeGrid {
+	bounds := code.Bounds()
+	grid := barcodeGrid{width: bounds.Dx(), height: bounds.Dy(), margin: 4, square: square}
+	if !square {
+		// 1D codes are one module high, and 10 modules of quiet zone
+		// wide
+		grid.margin = 10
+	}
+	grid.dark = make([][]bool, grid.height)
+	for y := 0; y < grid.height; y++ {
+		grid.dark[y] = make([]bool, grid.width)
+		for x := 0; x < grid.width; x++ {
+			r, _, _, _ := code.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			grid.dark[y][x] = r < 0x8000
+		}
+	}
+	return grid
+}
+
+// dimensions returns the size of the image in modules, the rows of 1D
+// codes stretched to a quarter of the width.
+func (g barcodeGrid) dimensions() (int, int) {
+	if g.square {
+		return g.width + 2*g.margin, g.height + 2*g.margin
+	}
+	width := g.width + 2*g.margin
+	return width, width / 4
+}
+
+func (g barcodeGrid) image(size int) image.Image {
+	width, height := g.dimensions()
+	scale := size / width
+	if scale < 1 {
+		scale = 1
+	}
+	img := image.NewGray(image.Rect(0, 0, width*scale, height*scale))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for py := 0; py < height*scale; py++ {
+		y := py/scale - g.margin
+		if !g.square {
+			y = 0
+		} else if y < 0 || y >= g.height {
+			continue
+		}
+		for px := 0; px < width*scale; px++ {
+			x := px/scale - g.margin
+			if x >= 0 && x < g.width && g.dark[y][x] {
+				img.SetGray(px, py, color.Gray{})
+			}
+		}
+	}
+	return img
+}
+
+func (g barcodeGrid) svg(size int) []byte {
+	width, height := g.dimensions()
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size*height/width, width, height)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, width, height)
+	rows := g.height
+	rowHeight := 1
+	if !g.square {
+		rows, rowHeight = 1, height
+	}
+	for y := 0; y < rows; y++ {
+		for x := 0; x < g.width; x++ {
+			if !g.dark[y][x] {
+				continue
+			}
+			// runs of dark modules are drawn as one rectangle
+			run := 1
+			for x+run < g.width && g.dark[y][x+run] {
+				run++
+			}
+			top := y + g.margin
+			if !g.square {
+				top = 0
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv%dh-%dz", x+g.margin, top, run, rowHeight, run)
+			x += run - 1
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return []byte(b.String())
+}
+
+// barcodeTokenPurpose is the SignToken purpose of the barcode URLs.
+const barcodeTokenPurpose = "barcode"
+
+// barcodeToken is the signed content of a barcode URL.
+type barcodeToken struct {
+	Kind string `json:"k"`
+	Data string `json:"d"`
+	Size int    `json:"s,omitempty"`
+}
+
+// Barcodes serves barcode images of signed payloads, so the endpoint
+// cannot be used to render arbitrary codes. Rendered images are kept
+// in a CacheStore. The payload is signed, not encrypted, and readable
+// in the URL: keep the TTL short for secrets such as the otpauth URIs
+// of 2FA provisioning.
+//
+// Example:
+//  codes := ghostutils.NewBarcodes(ghostConfig.Signer(), "/codes")
+//  codes.Mount(r.Group("/codes"))
+//
+//  src, err := codes.URL(ghostutils.BarcodeQR, totpURI, ghostutils.BarcodeSVG, 10*time.Minute)
+//  // <img src="{{barcodeURL "qr" .Ticket.URL "svg"}}" alt="Ticket">
+type Barcodes struct {
+	Signer *Signer
+	// BasePath is where Mount was called, used for the URLs.
+	BasePath string
+	// Cache keeps the rendered images, the cache of the app when nil,
+	// see AppFrom.
+	Cache CacheStore
+	// Size is the width in pixels of the images, DefaultBarcodeSize
+	// by default.
+	Size int
+	// TTL is the validity of the URLs made by the template helper,
+	// DefaultBarcodeTTL by default.
+	TTL time.Duration
+}
+
+// NewBarcodes returns the barcodes signed by signer and mounted on
+// basePath.
+func NewBarcodes(signer *Signer, basePath string) *Barcodes {
+	return &Barcodes{Signer: signer, BasePath: basePath}
+}
+
+// URL returns the signed URL of the barcode of kind encoding data, as
+// a png or svg image, valid for ttl.
+func (b *Barcodes) URL(kind, data, format string, ttl time.Duration) (string, error) {
+	if format != BarcodePNG && format != BarcodeSVG {
+		return "", fmt.Errorf("unknown barcode format %q", format)
+	}
+	token, err := b.Signer.SignToken(barcodeTokenPurpose, barcodeToken{Kind: kind, Data: data, Size: b.Size}, ttl)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(b.BasePath, "/") + "/" + token + "." + format, nil
+}
+
+func (b *Barcodes) cache(ctx context.Context) CacheStore {
+	if b.Cache == nil {
+		return contextCache(ctx)
+	}
+	return b.Cache
+}
+
+// Mount registers GET /:file, serving the image of a URL made by URL.
+// Invalid or expired URLs answer 404.
+func (b *Barcodes) Mount(g gin.IRoutes) {
+	g.GET("/:file", func(c *gin.Context) {
+		file := c.Param("file")
+		dot := strings.LastIndex(file, ".")
+		if dot < 0 {
+			Fail(c, NewGhostError(http.StatusNotFound, "not_found", "barcode not found"))
+			return
+		}
+		format := file[dot+1:]
+		var token barcodeToken
+		if err := b.Signer.VerifyToken(barcodeTokenPurpose, file[:dot], &token); err != nil {
+			Fail(c, NewGhostError(http.StatusNotFound, "not_found", "barcode not found"))
+			return
+		}
+		if token.Size <= 0 || token.Size > maxBarcodeSize {
+			token.Size = DefaultBarcodeSize
+		}
+		sum := sha256.Sum256([]byte(token.Kind + "\x00" + token.Data + "\x00" + strconv.Itoa(token.Size) + "\x00" + format))
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		// the payload may be a secret, so only the browser keeps it
+		c.Header("Cache-Control", "private, max-age=3600")
+		c.Header("ETag", etag)
+		if c.GetHeader("If-None-Match") == etag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		key := "barcode:" + hex.EncodeToString(sum[:])
+		contentType := "image/png"
+		if format == BarcodeSVG {
+			contentType = "image/svg+xml"
+		}
+		if cached, ok, err := b.cache(c).Get(c.Request.Context(), key); err == nil && ok {
+			c.Data(http.StatusOK, contentType, cached)
+			return
+		}
+		rendered, contentType, err := RenderBarcode(token.Kind, token.Data, token.Size, format)
+		if err != nil {
+			FailStatus(c, http.StatusUnprocessableEntity, err)
+			return
+		}
+		_ = b.cache(c).Set(c.Request.Context(), key, rendered, time.Hour, []string{"barcodes"})
+		c.Data(http.StatusOK, contentType, rendered)
+	})
+}
+
+// FuncMap returns the barcodeURL template helper, which takes the kind,
+// the data and the format and makes a URL valid for TTL:
+//  <img src="{{barcodeURL "qr" .ShareLink "svg"}}" alt="Share">
+func (b *Barcodes) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"barcodeURL": func(kind, data, format string) (string, error) {
+			ttl := b.TTL
+			if ttl <= 0 {
+				ttl = DefaultBarcodeTTL
+			}
+			return b.URL(kind, data, format, ttl)
+		},
+	}
+}
@@ -0,0 +1,176 @@
+package ghostutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BatchRequest is one sub-request of a batch.
+type BatchRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchResponse is the response of one sub-request. JSON bodies are
+// embedded as is, others as strings.
+type BatchResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    interface{}       `json:"body,omitempty"`
+}
+
+// BatchOptions configures BatchHandler.
+type BatchOptions struct {
+	// MaxRequests caps the sub-requests of a batch. Defaults to 20.
+	MaxRequests int
+	// Concurrency caps how many sub-requests run at once. Defaults
+	// to 4.
+	Concurrency int
+	// ForwardHeaders are copied from the batch request to every
+	// sub-request, so each one is authenticated by the routes' own
+	// middleware. Defaults to Authorization, Cookie and
+	// Accept-Language. The forwarding headers of the proxies and the
+	// CSRF token are always copied, and the headers of a sub-request
+	// cannot override them.
+	ForwardHeaders []string
+}
+
+// BatchHandler serves a batch endpoint that runs sub-requests
+// against engine and returns their responses in order. Each
+// sub-request goes through the full middleware chain of its route,
+// so auth, rate limits and validation apply per item. Batches cannot
+// be nested.
+//
+// Example:
+//  r := gin.Default()
+//  r.POST("/batch", ghostutils.BatchHandler(r, ghostutils.BatchOptions{}))
+//
+// Request:
+//  [
+//      {"method": "GET", "path": "/api/me"},
+//      {"method": "POST", "path": "/api/posts", "body": {"title": "hi"}}
+//  ]
+func BatchHandler(engine *gin.Engine, opts BatchOptions) gin.HandlerFunc {
+	if opts.MaxRequests <= 0 {
+		opts.MaxRequests = 20
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	if opts.ForwardHeaders == nil {
+		opts.ForwardHeaders = []string{"Authorization", "Cookie", "Accept-Language"}
+	}
+	return func(c *gin.Context) {
+		if c.GetHeader("X-Ghost-Batch") != "" {
+			Fail(c, NewGhostError(http.StatusBadRequest, "invalid_request", "batches cannot be nested"))
+			return
+		}
+		var reqs []BatchRequest
+		if err := c.ShouldBindJSON(&reqs); err != nil {
+			FailStatus(c, http.StatusBadRequest, err)
+			return
+		}
+		if len(reqs) == 0 || len(reqs) > opts.MaxRequests {
+			Fail(c, NewGhostError(http.StatusBadRequest, "invalid_request", fmt.Sprintf("a batch takes 1 to %d requests", opts.MaxRequests)))
+			return
+		}
+		responses := make([]BatchResponse, len(reqs))
+		sem := make(chan struct{}, opts.Concurrency)
+		var wg sync.WaitGroup
+		for i, sub := range reqs {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, sub BatchRequest) {
+				defer func() { <-sem; wg.Done() }()
+				responses[i] = runBatchRequest(c, engine, sub, opts.ForwardHeaders)
+			}(i, sub)
+		}
+		wg.Wait()
+		c.JSON(http.StatusOK, responses)
+	}
+}
+
+// batchOuterHeaders are copied from the batch request to every
+// sub-request: the client address and scheme set by the proxies, and
+// the CSRF token the batch was checked with.
+var batchOuterHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Port", "X-Real-IP", CSRFHeader}
+
+// batchHeaderAllowed reports whether a sub-request may set the header
+// name itself. The client address, the hop-by-hop headers and the
+// cookies and CSRF token only come from the batch request, so a
+// sub-request cannot pick the IP the rate limits and the login guard
+// see.
+func batchHeaderAllowed(engine *gin.Engine, name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if strings.HasPrefix(name, "X-Forwarded-") || strings.HasPrefix(name, "Proxy-") {
+		return false
+	}
+	for _, header := range engine.RemoteIPHeaders {
+		if name == http.CanonicalHeaderKey(header) {
+			return false
+		}
+	}
+	switch name {
+	case "Forwarded", "X-Real-Ip", "Host", "Cookie", http.CanonicalHeaderKey(CSRFHeader), "X-Ghost-Batch",
+		"Connection", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length":
+		return false
+	}
+	return true
+}
+
+func runBatchRequest(c *gin.Context, engine *gin.Engine, sub BatchRequest, forward []string) BatchResponse {
+	method := strings.ToUpper(sub.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !strings.HasPrefix(sub.Path, "/") {
+		return BatchResponse{Status: http.StatusBadRequest, Body: Envelope{Error: NewGhostError(http.StatusBadRequest, "invalid_request", "path must be absolute")}}
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), method, sub.Path, bytes.NewReader(sub.Body))
+	if err != nil {
+		return BatchResponse{Status: http.StatusBadRequest, Body: Envelope{Error: NewGhostError(http.StatusBadRequest, "invalid_request", err.Error()).Wrap(err)}}
+	}
+	req.RemoteAddr = c.Request.RemoteAddr
+	req.Host = c.Request.Host
+	outer := append(append(append([]string{}, batchOuterHeaders...), engine.RemoteIPHeaders...), forward...)
+	for _, name := range outer {
+		if values := c.Request.Header.Values(name); len(values) > 0 {
+			req.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for name, value := range sub.Headers {
+		if batchHeaderAllowed(engine, name) {
+			req.Header.Set(name, value)
+		}
+	}
+	if len(sub.Body) > 0 && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", gin.MIMEJSON)
+	}
+	req.Header.Set("X-Ghost-Batch", "1")
+
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+
+	res := BatchResponse{Status: rec.Code, Headers: map[string]string{}}
+	for name := range rec.Header() {
+		res.Headers[name] = rec.Header().Get(name)
+	}
+	body := rec.Body.Bytes()
+	switch {
+	case len(body) == 0:
+	case json.Valid(body) && strings.Contains(rec.Header().Get("Content-Type"), "json"):
+		res.Body = json.RawMessage(body)
+	default:
+		res.Body = string(body)
+	}
+	return res
+}
@@ -0,0 +1,85 @@
+package ghostutils_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+	"github.com/gin-gonic/gin"
+)
+
+func TestBatchSubRequestsKeepTheClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := r.SetTrustedProxies([]string{"192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/whoami", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"ip":     c.ClientIP(),
+			"cookie": c.GetHeader("Cookie"),
+			"custom": c.GetHeader("X-Custom"),
+		})
+	})
+	r.POST("/batch", ghostutils.BatchHandler(r, ghostutils.BatchOptions{}))
+
+	body := `[{"method": "GET", "path": "/whoami", "headers": {
+		"X-Forwarded-For": "10.6.6.6",
+		"x-real-ip": "10.6.6.7",
+		"Forwarded": "for=10.6.6.8",
+		"Cookie": "session=stolen",
+		"X-Custom": "kept"
+	}}]`
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:4000"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("Cookie", "session=mine")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	var responses []struct {
+		Status int
+		Body   struct{ IP, Cookie, Custom string }
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || responses[0].Status != http.StatusOK {
+		t.Fatalf("responses %s", w.Body)
+	}
+	got := responses[0].Body
+	if got.IP != "203.0.113.7" {
+		t.Errorf("client IP %q, want the one of the batch request", got.IP)
+	}
+	if got.Cookie != "session=mine" {
+		t.Errorf("cookie %q, want the one of the batch request", got.Cookie)
+	}
+	if got.Custom != "kept" {
+		t.Errorf("X-Custom %q, want kept", got.Custom)
+	}
+}
+
+func TestBatchRejectsNesting(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/batch", ghostutils.BatchHandler(r, ghostutils.BatchOptions{}))
+	body := `[{"method": "POST", "path": "/batch", "body": [{"method": "GET", "path": "/batch"}]}]`
+	req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var responses []ghostutils.BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || responses[0].Status != http.StatusBadRequest {
+		t.Errorf("nested batch answered %s", w.Body)
+	}
+}
@@ -0,0 +1,179 @@
+package ghostutils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError is one invalid field of a request.
+type FieldError struct {
+	// Field is the path of the field as sent, e.g. address.zip or
+	// items[2].sku.
+	Field string `json:"field"`
+	// Rule is the failed validation tag, or "type" when the value did
+	// not decode.
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// BindError is the error of Bind. Fail renders it as
+//  {"error": {"code": "validation_failed", "message": "validation failed", "details": [{"field": "email", "rule": "email", "message": "email must be a valid email address"}]}}
+// with Status 422 for invalid fields and 400, code invalid_request,
+// for bodies that do not decode at all.
+type BindError struct {
+	Status  int          `json:"-"`
+	Message string       `json:"error"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func (e *BindError) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Message
+	}
+	return e.Message + ": " + strings.Join(messages, "; ")
+}
+
+// Bind binds the request body into a new T with BindBody and validates
+// it with its binding tags, see RegisterRule. Messages are in the
+// RequestLocale.
+//
+// Example:
+//  type createUser struct {
+//      Email string `json:"email" binding:"required,email"`
+//      Name  string `json:"name" binding:"required,max=80"`
+//  }
+//
+//  r.POST("/users", func(c *gin.Context) {
+//      input, err := ghostutils.Bind[createUser](c)
+//      if err != nil {
+//          ghostutils.AbortWithBindError(c, err)
+//          return
+//      }
+//      // ...
+//  })
+//
+// Returns:
+//  T
+//  *BindError when the body did not decode or validate
+func Bind[T any](c *gin.Context) (T, error) {
+	var value T
+	err := BindBody(c, &value)
+	return value, newBindError(reflect.TypeOf(value), err, RequestLocale(c))
+}
+
+// BindQuery is Bind for the query string.
+func BindQuery[T any](c *gin.Context) (T, error) {
+	var value T
+	err := c.ShouldBindQuery(&value)
+	return value, newBindError(reflect.TypeOf(value), err, RequestLocale(c))
+}
+
+// BindOrAbort binds like Bind and answers the error itself.
+//
+// Example:
+//  input, ok := ghostutils.BindOrAbort[createUser](c)
+//  if !ok {
+//      return
+//  }
+func BindOrAbort[T any](c *gin.Context) (T, bool) {
+	value, err := Bind[T](c)
+	if err != nil {
+		AbortWithBindError(c, err)
+		return value, false
+	}
+	return value, true
+}
+
+// AbortWithBindError answers err in the envelope as a BindError, with 400
+// for errors that are not one.
+func AbortWithBindError(c *gin.Context, err error) {
+	var bindErr *BindError
+	if !errors.As(err, &bindErr) {
+		bindErr = &BindError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	Fail(c, bindErr)
+}
+
+// newBindError converts the error of binding a value of typ, with
+// messages in locale.
+func newBindError(typ reflect.Type, err error, locale string) error {
+	if err == nil {
+		return nil
+	}
+	var invalid validator.ValidationErrors
+	if errors.As(err, &invalid) {
+		bindErr := &BindError{Status: http.StatusUnprocessableEntity, Message: "validation failed"}
+		for _, fieldErr := range invalid {
+			path := bindFieldPath(typ, fieldErr.StructNamespace())
+			bindErr.Fields = append(bindErr.Fields, FieldError{
+				Field:   path,
+				Rule:    fieldErr.Tag(),
+				Param:   fieldErr.Param(),
+				Message: path + " " + ValidationMessage(fieldErr, locale),
+			})
+		}
+		return bindErr
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return &BindError{Status: http.StatusUnprocessableEntity, Message: "validation failed", Fields: []FieldError{{
+			Field:   typeErr.Field,
+			Rule:    "type",
+			Param:   typeErr.Type.String(),
+			Message: typeErr.Field + " must be of type " + typeErr.Type.String(),
+		}}}
+	}
+	return &BindError{Status: http.StatusBadRequest, Message: err.Error()}
+}
+
+// bindFieldPath turns a validator namespace like User.Items[2].SKU into
+// the path of the names sent, items[2].sku.
+func bindFieldPath(typ reflect.Type, namespace string) string {
+	segments := strings.Split(namespace, ".")
+	// the namespace starts with the name of the type
+	if len(segments) > 1 {
+		segments = segments[1:]
+	}
+	for i, segment := range segments {
+		name, index := segment, ""
+		if j := strings.Index(segment, "["); j >= 0 {
+			name, index = segment[:j], segment[j:]
+		}
+		for typ != nil && (typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array || typ.Kind() == reflect.Map) {
+			typ = typ.Elem()
+		}
+		if typ == nil || typ.Kind() != reflect.Struct {
+			continue
+		}
+		field, ok := typ.FieldByName(name)
+		if !ok {
+			typ = nil
+			continue
+		}
+		segments[i] = bindFieldName(field) + index
+		typ = field.Type
+	}
+	return strings.Join(segments, ".")
+}
+
+// bindFieldName returns the name a field is sent as, preferring the
+// json tag over the form tag.
+func bindFieldName(field reflect.StructField) string {
+	for _, tag := range []string{"json", "form"} {
+		if name := strings.Split(field.Tag.Get(tag), ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return field.Name
+}
@@ -0,0 +1,525 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Reshape maps a record of the old shape, with its "id", to the new
+// shape. The id of the result is ignored: the record keeps its id in
+// the new table.
+//
+// Example:
+//  func splitName(old map[string]interface{}) (map[string]interface{}, error) {
+//      first, last, _ := strings.Cut(fmt.Sprint(old["name"]), " ")
+//      return map[string]interface{}{"first_name": first, "last_name": last, "email": old["email"]}, nil
+//  }
+type Reshape func(record map[string]interface{}) (map[string]interface{}, error)
+
+// DualWrite is a Repository whose writes are mirrored to Target in the
+// new shape, so both tables stay current while a Backfill copies the
+// older records and the app moves over. Reads go to the Repository.
+//
+// Example:
+//  users := ghostutils.NewDualWrite(ghostutils.NewRepository[User](db, "user"), "user_v2", splitName)
+//  user, err := users.Create(c, User{Name: "Ada Lovelace"})   // user:x and user_v2:x
+type DualWrite[T any] struct {
+	*Repository[T]
+	Target  string
+	Reshape Reshape
+	// Strict fails a write whose mirror failed, after the Repository
+	// wrote it. By default the failure goes to OnError, and the
+	// Backfill with Overwrite repairs the record.
+	Strict bool
+	// OnError is told about failed mirrors, which are logged when nil.
+	OnError func(ctx context.Context, id string, err error)
+}
+
+// NewDualWrite returns repo mirrored to target through reshape.
+func NewDualWrite[T any](repo *Repository[T], target string, reshape Reshape) *DualWrite[T] {
+	return &DualWrite[T]{Repository: repo, Target: target, Reshape: reshape}
+}
+
+// Create creates record, then its mirror.
+func (d *DualWrite[T]) Create(ctx context.Context, record T) (T, error) {
+	row, err := d.Repository.Create(ctx, record)
+	if err != nil {
+		return row, err
+	}
+	return row, d.mirror(ctx, row)
+}
+
+// Update replaces the record with id, then its mirror.
+func (d *DualWrite[T]) Update(ctx context.Context, id string, record T) (T, error) {
+	row, err := d.Repository.Update(ctx, id, record)
+	if err != nil {
+		return row, err
+	}
+	return row, d.mirror(ctx, row)
+}
+
+// Patch merges fields into the record with id, then replaces its
+// mirror with the whole merged record.
+func (d *DualWrite[T]) Patch(ctx context.Context, id string, fields map[string]interface{}) (T, error) {
+	row, err := d.Repository.Patch(ctx, id, fields)
+	if err != nil {
+		return row, err
+	}
+	return row, d.mirror(ctx, row)
+}
+
+// Delete removes the record with id, then its mirror.
+func (d *DualWrite[T]) Delete(ctx context.Context, id string) error {
+	if err := d.Repository.Delete(ctx, id); err != nil {
+		return err
+	}
+	_, key := splitRecordID(id, d.Table)
+	_, err := surrealQuery[map[string]interface{}](d.db(ctx), "DELETE type::thing($tb, $id)", map[string]interface{}{"tb": d.Target, "id": key})
+	return d.failed(ctx, key, err)
+}
+
+// mirror writes the new shape of row to Target.
+func (d *DualWrite[T]) mirror(ctx context.Context, row T) error {
+	fields, err := recordFields(row)
+	if err != nil {
+		return d.failed(ctx, "", err)
+	}
+	_, key := splitRecordID(fields["id"], d.Table)
+	shaped, err := reshapeRecord(d.Reshape, fields)
+	if err == nil {
+		_, err = surrealQuery[map[string]interface{}](d.db(ctx), "UPDATE type::thing($tb, $id) CONTENT $data", map[string]interface{}{
+			"tb":   d.Target,
+			"id":   key,
+			"data": shaped,
+		})
+	}
+	return d.failed(ctx, key, err)
+}
+
+// failed reports a failed mirror, returned when Strict.
+func (d *DualWrite[T]) failed(ctx context.Context, id string, err error) error {
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("mirroring %s:%s to %s: %w", d.Table, id, d.Target, err)
+	if d.OnError != nil {
+		d.OnError(ctx, id, err)
+	} else {
+		log.Printf("dual write: %v", err)
+	}
+	if d.Strict {
+		return err
+	}
+	return nil
+}
+
+// reshapeRecord returns the new shape of a copy of record, without id.
+func reshapeRecord(reshape Reshape, record map[string]interface{}) (map[string]interface{}, error) {
+	copied := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		copied[k] = v
+	}
+	if reshape == nil {
+		delete(copied, "id")
+		return copied, nil
+	}
+	shaped, err := reshape(copied)
+	if err != nil {
+		return nil, err
+	}
+	delete(shaped, "id")
+	return shaped, nil
+}
+
+// BackfillProgress is the stored state of a Backfill, resumed from
+// Cursor, the last record id copied.
+type BackfillProgress struct {
+	ID          string     `json:"id,omitempty"`
+	Source      string     `json:"source"`
+	Target      string     `json:"target"`
+	Cursor      string     `json:"cursor"`
+	Copied      int        `json:"copied"`
+	Skipped     int        `json:"skipped"`
+	Total       int        `json:"total"`
+	StartedAt   time.Time  `json:"started_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// Done reports whether every record was copied.
+func (p BackfillProgress) Done() bool {
+	return p.CompletedAt != nil
+}
+
+// Percent is the share of the records seen when the backfill started
+// that were copied or skipped, 0 to 100.
+func (p BackfillProgress) Percent() float64 {
+	if p.Done() {
+		return 100
+	}
+	if p.Total == 0 {
+		return 0
+	}
+	percent := float64(p.Copied+p.Skipped) / float64(p.Total) * 100
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+// BackfillReport compares Source with Target after a backfill. The
+// ids are the first of each kind found.
+type BackfillReport struct {
+	SourceCount   int      `json:"source_count"`
+	TargetCount   int      `json:"target_count"`
+	Checked       int      `json:"checked"`
+	Missing       int      `json:"missing"`
+	Mismatched    int      `json:"mismatched"`
+	MissingIDs    []string `json:"missing_ids,omitempty"`
+	MismatchedIDs []string `json:"mismatched_ids,omitempty"`
+}
+
+// OK reports whether every record checked is in Target in its new
+// shape and both tables hold as many records.
+func (r BackfillReport) OK() bool {
+	return r.Missing == 0 && r.Mismatched == 0 && r.SourceCount == r.TargetCount
+}
+
+// backfillReportIDs bounds the ids listed in a BackfillReport.
+const backfillReportIDs = 100
+
+// Backfill copies the records of Source to Target in their new shape,
+// in id order and BatchSize at a time, at most Rate records a second.
+// Its progress is stored in ProgressTable, "backfill" by default,
+// under Name, so a run picks up where the last one stopped. Records
+// already in Target, written by a DualWrite since, are kept unless
+// Overwrite is set.
+//
+// Example:
+//  backfill := &ghostutils.Backfill{Name: "user-v2", DB: db, Source: "user", Target: "user_v2", Reshape: splitName, Rate: 200}
+//  backfill.Register(jobs)
+//  if err := backfill.Start(ctx); err != nil {
+//      log.Fatal(err)
+//  }
+//  ...
+//  report, err := backfill.Verify(ctx, 0)
+//  if report.OK() {
+//      // read from user_v2, then drop the DualWrite
+//  }
+type Backfill struct {
+	Name    string
+	DB      GhostDB
+	Source  string
+	Target  string
+	Reshape Reshape
+	// BatchSize is the number of records per batch, 500 by default.
+	BatchSize int
+	// Rate bounds the records copied per second, none when 0.
+	Rate          float64
+	Overwrite     bool
+	ProgressTable string
+	queue         *JobQueue
+}
+
+func (b *Backfill) progressTable() string {
+	if b.ProgressTable == "" {
+		return "backfill"
+	}
+	return b.ProgressTable
+}
+
+func (b *Backfill) batchSize() int {
+	if b.BatchSize <= 0 {
+		return 500
+	}
+	return b.BatchSize
+}
+
+func (b *Backfill) check() error {
+	for _, table := range []string{b.Source, b.Target} {
+		if !identifierPattern.MatchString(table) || strings.Contains(table, ".") {
+			return fmt.Errorf("backfill %s: invalid table %q", b.Name, table)
+		}
+	}
+	if b.Name == "" {
+		return fmt.Errorf("backfill of %s needs a name", b.Source)
+	}
+	return nil
+}
+
+// Progress returns the stored progress, a zero one before the first
+// batch.
+func (b *Backfill) Progress(ctx context.Context) (BackfillProgress, error) {
+	progress, _, err := surrealFirst[BackfillProgress](WithContext(ctx, b.DB), "SELECT * FROM type::thing($tb, $id)", map[string]interface{}{
+		"tb": b.progressTable(),
+		"id": b.Name,
+	})
+	return progress, err
+}
+
+func (b *Backfill) save(ctx context.Context, progress *BackfillProgress) error {
+	progress.UpdatedAt = time.Now().UTC()
+	stored := *progress
+	stored.ID = ""
+	_, err := surrealQuery[map[string]interface{}](WithContext(ctx, b.DB), "UPDATE type::thing($tb, $id) CONTENT $data", map[string]interface{}{
+		"tb":   b.progressTable(),
+		"id":   b.Name,
+		"data": stored,
+	})
+	return err
+}
+
+// Reset forgets the progress, so the next run starts over.
+func (b *Backfill) Reset(ctx context.Context) error {
+	_, err := surrealQuery[map[string]interface{}](WithContext(ctx, b.DB), "DELETE type::thing($tb, $id)", map[string]interface{}{
+		"tb": b.progressTable(),
+		"id": b.Name,
+	})
+	return err
+}
+
+// count returns the number of records of table.
+func (b *Backfill) count(ctx context.Context, table string) (int, error) {
+	row, _, err := surrealFirst[struct {
+		Count int `json:"count"`
+	}](WithContext(ctx, b.DB), "SELECT count() FROM type::table($tb) GROUP ALL", map[string]interface{}{"tb": table})
+	return row.Count, err
+}
+
+// page returns up to n records of Source after the id cursor.
+func (b *Backfill) page(ctx context.Context, cursor string, n int) ([]map[string]interface{}, error) {
+	sql := fmt.Sprintf("SELECT * FROM type::table($tb) ORDER BY id LIMIT %d", n)
+	vars := map[string]interface{}{"tb": b.Source}
+	if cursor != "" {
+		sql = fmt.Sprintf("SELECT * FROM type::table($tb) WHERE id > type::thing($tb, $after) ORDER BY id LIMIT %d", n)
+		vars["after"] = cursor
+	}
+	return surrealQuery[map[string]interface{}](WithContext(ctx, b.DB), sql, vars)
+}
+
+// Step copies the next batch and stores the progress.
+//
+// Returns:
+//  BackfillProgress after the batch, Done once Source is exhausted
+//  error of the batch, whose records are copied again by the next
+//  step
+func (b *Backfill) Step(ctx context.Context) (BackfillProgress, error) {
+	if err := b.check(); err != nil {
+		return BackfillProgress{}, err
+	}
+	progress, err := b.Progress(ctx)
+	if err != nil || progress.Done() {
+		return progress, err
+	}
+	if progress.StartedAt.IsZero() {
+		progress = BackfillProgress{Source: b.Source, Target: b.Target, StartedAt: time.Now().UTC()}
+		if progress.Total, err = b.count(ctx, b.Source); err != nil {
+			return progress, err
+		}
+	}
+	rows, err := b.page(ctx, progress.Cursor, b.batchSize())
+	if err != nil {
+		return progress, err
+	}
+	if len(rows) == 0 {
+		now := time.Now().UTC()
+		progress.CompletedAt = &now
+		return progress, b.save(ctx, &progress)
+	}
+	verb := "CREATE"
+	if b.Overwrite {
+		verb = "UPDATE"
+	}
+	var sql strings.Builder
+	vars := map[string]interface{}{"tb": b.Target}
+	for i, row := range rows {
+		_, key := splitRecordID(row["id"], b.Source)
+		shaped, err := reshapeRecord(b.Reshape, row)
+		if err != nil {
+			return progress, fmt.Errorf("reshaping %s:%s: %w", b.Source, key, err)
+		}
+		fmt.Fprintf(&sql, "%s type::thing($tb, $id%d) CONTENT $row%d;\n", verb, i, i)
+		vars[fmt.Sprintf("id%d", i)], vars[fmt.Sprintf("row%d", i)] = key, shaped
+		progress.Cursor = key
+	}
+	statements, err := surrealStatements(WithContext(ctx, b.DB), sql.String(), vars)
+	if err != nil {
+		return progress, err
+	}
+	for _, statement := range statements {
+		switch {
+		case statement.Status == "OK":
+			progress.Copied++
+		case strings.Contains(statement.Detail, "already exists"):
+			progress.Skipped++
+		default:
+			return progress, fmt.Errorf("backfill %s: %s", b.Name, statement.Detail)
+		}
+	}
+	return progress, b.save(ctx, &progress)
+}
+
+// Run copies batches until Source is exhausted or ctx is done, pacing
+// them to Rate.
+//
+// Returns:
+//  BackfillProgress
+//  error of a batch, or ctx.Err() when ctx ended the run
+func (b *Backfill) Run(ctx context.Context) (BackfillProgress, error) {
+	progress, err := b.Progress(ctx)
+	if err != nil {
+		return progress, err
+	}
+	for {
+		start, before := time.Now(), progress.Copied+progress.Skipped
+		if progress, err = b.Step(ctx); err != nil || progress.Done() {
+			return progress, err
+		}
+		wait := time.Duration(0)
+		if b.Rate > 0 {
+			copied := progress.Copied + progress.Skipped - before
+			wait = time.Duration(float64(copied)/b.Rate*float64(time.Second)) - time.Since(start)
+		}
+		select {
+		case <-ctx.Done():
+			return progress, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// jobType is the job type of the backfill.
+func (b *Backfill) jobType() string {
+	return "backfill:" + b.Name
+}
+
+// Register makes the backfill a job of q, of type "backfill:<name>".
+// Each run copies batches for most of the job timeout, then enqueues
+// the next run, so a long backfill survives restarts and deploys of
+// the workers.
+func (b *Backfill) Register(q *JobQueue) {
+	b.queue = q
+	RegisterJob(b.jobType(), func(ctx context.Context, _ struct{}) error {
+		budget := q.timeout() * 4 / 5
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < budget {
+			budget = time.Until(deadline) * 4 / 5
+		}
+		run, cancel := context.WithTimeout(ctx, budget)
+		defer cancel()
+		progress, err := b.Run(run)
+		switch {
+		case err == nil:
+			log.Printf("backfill %s: done, %d copied, %d skipped", b.Name, progress.Copied, progress.Skipped)
+			return nil
+		case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+			_, err = q.Enqueue(ctx, b.jobType(), nil)
+			return err
+		}
+		return err
+	})
+}
+
+// Start enqueues the backfill on the queue it was registered with.
+func (b *Backfill) Start(ctx context.Context) error {
+	if b.queue == nil {
+		return fmt.Errorf("backfill %s is not registered with a job queue", b.Name)
+	}
+	if err := b.check(); err != nil {
+		return err
+	}
+	_, err := b.queue.Enqueue(ctx, b.jobType(), nil)
+	return err
+}
+
+// Verify compares up to limit records of Source, all when 0, with
+// their record in Target: each must be there and equal, as JSON, to
+// the new shape of the old record.
+//
+// Example:
+//  report, err := backfill.Verify(ctx, 1000)
+//  if err == nil && !report.OK() {
+//      log.Printf("%d missing %v, %d mismatched %v", report.Missing, report.MissingIDs, report.Mismatched, report.MismatchedIDs)
+//  }
+func (b *Backfill) Verify(ctx context.Context, limit int) (BackfillReport, error) {
+	var report BackfillReport
+	if err := b.check(); err != nil {
+		return report, err
+	}
+	var err error
+	if report.SourceCount, err = b.count(ctx, b.Source); err != nil {
+		return report, err
+	}
+	if report.TargetCount, err = b.count(ctx, b.Target); err != nil {
+		return report, err
+	}
+	cursor := ""
+	for limit <= 0 || report.Checked < limit {
+		n := b.batchSize()
+		if limit > 0 && limit-report.Checked < n {
+			n = limit - report.Checked
+		}
+		rows, err := b.page(ctx, cursor, n)
+		if err != nil || len(rows) == 0 {
+			return report, err
+		}
+		things := make([]string, len(rows))
+		vars := map[string]interface{}{"tb": b.Target}
+		for i, row := range rows {
+			_, key := splitRecordID(row["id"], b.Source)
+			things[i] = fmt.Sprintf("type::thing($tb, $id%d)", i)
+			vars[fmt.Sprintf("id%d", i)] = key
+			cursor = key
+		}
+		stored, err := surrealQuery[map[string]interface{}](WithContext(ctx, b.DB), "SELECT * FROM "+strings.Join(things, ", "), vars)
+		if err != nil {
+			return report, err
+		}
+		byID := make(map[string]map[string]interface{}, len(stored))
+		for _, row := range stored {
+			_, key := splitRecordID(row["id"], b.Target)
+			byID[key] = row
+		}
+		for _, row := range rows {
+			report.Checked++
+			_, key := splitRecordID(row["id"], b.Source)
+			target, ok := byID[key]
+			if !ok {
+				report.Missing++
+				if len(report.MissingIDs) < backfillReportIDs {
+					report.MissingIDs = append(report.MissingIDs, key)
+				}
+				continue
+			}
+			shaped, err := reshapeRecord(b.Reshape, row)
+			if err != nil {
+				return report, fmt.Errorf("reshaping %s:%s: %w", b.Source, key, err)
+			}
+			delete(target, "id")
+			if !sameJSON(shaped, target) {
+				report.Mismatched++
+				if len(report.MismatchedIDs) < backfillReportIDs {
+					report.MismatchedIDs = append(report.MismatchedIDs, key)
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+// sameJSON reports whether a and b encode to the same JSON value.
+func sameJSON(a, b interface{}) bool {
+	var decoded [2]interface{}
+	for i, v := range []interface{}{a, b} {
+		raw, err := json.Marshal(v)
+		if err != nil || json.Unmarshal(raw, &decoded[i]) != nil {
+			return false
+		}
+	}
+	return reflect.DeepEqual(decoded[0], decoded[1])
+}
@@ -0,0 +1,291 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/metrics"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BudgetConfig is the budgets block of ghost.yaml: what a request may
+// spend on queries, outbound calls and allocations, to catch an N+1
+// before it ships. The limits apply to every route unless Routes has
+// the route, keyed by its method and pattern. A zero limit is no limit.
+// The usage of every request is logged by RequestLogger and set on the
+// span of Tracing.
+//
+//  environments:
+//      development:
+//          budgets:
+//              enabled: true
+//              action: fail
+//              queries: 10
+//              routes:
+//                  GET /dashboard: {queries: 25, calls: 3}
+type BudgetConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	BudgetLimits `yaml:",inline"`
+	Routes       map[string]BudgetLimits `yaml:"routes"`
+	// Action is what happens once a limit is exceeded: warn, the
+	// default, logs the usage at the end of the request; fail also makes
+	// the query or call beyond the limit return ErrBudgetExceeded.
+	Action string `yaml:"action"`
+}
+
+// BudgetLimits are the most a request may spend.
+type BudgetLimits struct {
+	Queries int64 `yaml:"queries"`
+	// Calls are the outbound calls, see BudgetTransport and CountCall.
+	Calls int64 `yaml:"calls"`
+	// AllocBytes is measured, roughly, for the whole process while the
+	// request runs, so it only holds for one request at a time, as in
+	// development.
+	AllocBytes uint64 `yaml:"alloc-bytes"`
+}
+
+// Actions of the budgets block.
+const (
+	BudgetWarn = "warn"
+	BudgetFail = "fail"
+)
+
+// ErrBudgetExceeded is returned by the query or outbound call that
+// goes over the budget of a request whose action is fail.
+var ErrBudgetExceeded = errors.New("request budget exceeded")
+
+// BudgetUsage is what a request spent.
+type BudgetUsage struct {
+	Queries     int64  `json:"queries"`
+	CacheHits   int64  `json:"cache_hits"`
+	CacheMisses int64  `json:"cache_misses"`
+	Calls       int64  `json:"calls"`
+	AllocBytes  uint64 `json:"alloc_bytes"`
+}
+
+// Budget counts what a request spends. The queries are those of the
+// connections bound to the request with WithContext, as the Repository
+// methods given c do.
+type Budget struct {
+	limits BudgetLimits
+	fail   bool
+	allocs uint64
+
+	mu    sync.Mutex
+	ended bool
+	usage BudgetUsage
+}
+
+type budgetKey struct{}
+
+// Budgets counts what every request spends against the limits of
+// config, see BudgetConfig. Install it after RequestLogger and Tracing,
+// which report the usage. Setup installs it when budgets.enabled is set.
+//
+// Example:
+//  r.Use(ghostutils.Budgets(ghostutils.BudgetConfig{
+//      BudgetLimits: ghostutils.BudgetLimits{Queries: 10},
+//      Action:       ghostutils.BudgetFail,
+//  }))
+func Budgets(config BudgetConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limits := config.BudgetLimits
+		if route, ok := config.Routes[c.Request.Method+" "+c.FullPath()]; ok {
+			limits = route
+		}
+		budget := &Budget{limits: limits, fail: config.Action == BudgetFail, allocs: heapAllocs()}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), budgetKey{}, budget))
+
+		c.Next()
+
+		budget.end()
+		usage := budget.Usage()
+		trace.SpanFromContext(c.Request.Context()).SetAttributes(
+			attribute.Int64("ghost.budget.queries", usage.Queries),
+			attribute.Int64("ghost.budget.cache_hits", usage.CacheHits),
+			attribute.Int64("ghost.budget.cache_misses", usage.CacheMisses),
+			attribute.Int64("ghost.budget.calls", usage.Calls),
+			attribute.Int64("ghost.budget.alloc_bytes", int64(usage.AllocBytes)),
+		)
+		if over := budget.Exceeded(); len(over) > 0 {
+			Log(c).Warn("request budget exceeded",
+				"method", c.Request.Method,
+				"route", c.FullPath(),
+				"exceeded", strings.Join(over, ", "),
+				budget.logValue(),
+			)
+		}
+	}
+}
+
+// RequestBudget returns the budget of the request of ctx, a
+// *gin.Context or its request context, nil outside Budgets.
+//
+// Example:
+//  if budget := ghostutils.RequestBudget(c); budget != nil {
+//      c.Header("X-Queries", strconv.FormatInt(budget.Usage().Queries, 10))
+//  }
+func RequestBudget(ctx context.Context) *Budget {
+	if ctx = cancelContext(ctx); ctx == nil {
+		return nil
+	}
+	budget, _ := ctx.Value(budgetKey{}).(*Budget)
+	return budget
+}
+
+// Usage returns what the request spent so far.
+func (b *Budget) Usage() BudgetUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	usage := b.usage
+	if !b.ended {
+		usage.AllocBytes = b.allocated()
+	}
+	return usage
+}
+
+// end stops measuring the allocations once the handlers returned.
+func (b *Budget) end() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.usage.AllocBytes = b.allocated()
+	b.ended = true
+}
+
+func (b *Budget) allocated() uint64 {
+	if allocs := heapAllocs(); allocs > b.allocs {
+		return allocs - b.allocs
+	}
+	return 0
+}
+
+// Exceeded returns the limits the request went over, e.g.
+// "queries 14/10".
+func (b *Budget) Exceeded() []string {
+	usage := b.Usage()
+	var over []string
+	if b.limits.Queries > 0 && usage.Queries > b.limits.Queries {
+		over = append(over, fmt.Sprintf("queries %d/%d", usage.Queries, b.limits.Queries))
+	}
+	if b.limits.Calls > 0 && usage.Calls > b.limits.Calls {
+		over = append(over, fmt.Sprintf("calls %d/%d", usage.Calls, b.limits.Calls))
+	}
+	if b.limits.AllocBytes > 0 && usage.AllocBytes > b.limits.AllocBytes {
+		over = append(over, fmt.Sprintf("alloc-bytes %d/%d", usage.AllocBytes, b.limits.AllocBytes))
+	}
+	return over
+}
+
+// logValue is the usage as the budget group of the request log.
+func (b *Budget) logValue() slog.Attr {
+	usage := b.Usage()
+	return slog.Group("budget",
+		slog.Int64("queries", usage.Queries),
+		slog.Int64("cache_hits", usage.CacheHits),
+		slog.Int64("cache_misses", usage.CacheMisses),
+		slog.Int64("calls", usage.Calls),
+		slog.Uint64("alloc_bytes", usage.AllocBytes),
+	)
+}
+
+// spend counts one query or call, failing once it is beyond limit with
+// the fail action.
+func (b *Budget) spend(counter *int64, limit int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	*counter++
+	if b.fail && limit > 0 && *counter > limit {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
+
+// spendQuery counts a query of the request of ctx.
+func spendQuery(ctx context.Context) error {
+	budget := RequestBudget(ctx)
+	if budget == nil {
+		return nil
+	}
+	return budget.spend(&budget.usage.Queries, budget.limits.Queries)
+}
+
+// countCache counts a cache lookup of the request of ctx.
+func countCache(ctx context.Context, hit bool) {
+	budget := RequestBudget(ctx)
+	if budget == nil {
+		return
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	if hit {
+		budget.usage.CacheHits++
+	} else {
+		budget.usage.CacheMisses++
+	}
+}
+
+// CountCall counts an outbound call of the request of ctx, for the
+// clients BudgetTransport does not cover.
+//
+// Example:
+//  if err := ghostutils.CountCall(c); err != nil {
+//      return err
+//  }
+//  resp, err := grpcClient.Lookup(c, req)
+//
+// Returns:
+//  ErrBudgetExceeded when the call is beyond the budget and its action
+//  is fail
+func CountCall(ctx context.Context) error {
+	budget := RequestBudget(ctx)
+	if budget == nil {
+		return nil
+	}
+	return budget.spend(&budget.usage.Calls, budget.limits.Calls)
+}
+
+// BudgetTransport counts the requests of an http.Client made with the
+// context of a request as its outbound calls, see CountCall. base is
+// http.DefaultTransport when nil.
+//
+// Example:
+//  client := &http.Client{Transport: ghostutils.BudgetTransport(nil)}
+//  req, _ := http.NewRequestWithContext(c, http.MethodGet, url, nil)
+//  resp, err := client.Do(req)
+func BudgetTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return budgetTransport{base}
+}
+
+type budgetTransport struct {
+	base http.RoundTripper
+}
+
+func (t budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := CountCall(req.Context()); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// heapAllocs returns the bytes allocated by the process so far.
+func heapAllocs() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
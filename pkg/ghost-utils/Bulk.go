@@ -0,0 +1,423 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Bulk operations.
+const (
+	BulkCreate = "create"
+	BulkUpdate = "update"
+	BulkDelete = "delete"
+)
+
+// BulkItem is one operation of a bulk request.
+type BulkItem[T any] struct {
+	Op   string `json:"op"`
+	ID   string `json:"id,omitempty"`
+	Data T      `json:"data"`
+	// Fields names the keys given in data when the item was decoded
+	// from JSON. Updates merge only these, so fields left out keep
+	// their stored values; with no Fields the whole of Data is merged.
+	Fields []string `json:"-"`
+}
+
+// UnmarshalJSON decodes the item and records the keys of its data in
+// Fields.
+func (item *BulkItem[T]) UnmarshalJSON(raw []byte) error {
+	var decoded struct {
+		Op   string          `json:"op"`
+		ID   string          `json:"id"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return err
+	}
+	item.Op, item.ID, item.Fields = decoded.Op, decoded.ID, nil
+	if len(decoded.Data) == 0 || string(decoded.Data) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(decoded.Data, &item.Data); err != nil {
+		return err
+	}
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(decoded.Data, &keys) == nil {
+		item.Fields = make([]string, 0, len(keys))
+		for key := range keys {
+			item.Fields = append(item.Fields, key)
+		}
+	}
+	return nil
+}
+
+// patch returns the content an update item merges into the stored
+// record: Data restricted to Fields.
+func (item BulkItem[T]) patch() (map[string]interface{}, error) {
+	content, err := recordContent(item.Data)
+	if err != nil || item.Fields == nil {
+		return content, err
+	}
+	patch := make(map[string]interface{}, len(item.Fields))
+	for _, key := range item.Fields {
+		if v, ok := content[key]; ok {
+			patch[key] = v
+		}
+	}
+	return patch, nil
+}
+
+// BulkRequest is the body of a bulk endpoint. Atomic asks for all or
+// nothing, which needs a store implementing BulkTransactor.
+type BulkRequest[T any] struct {
+	Items  []BulkItem[T] `json:"items"`
+	Atomic bool          `json:"atomic"`
+}
+
+// BulkResult is the outcome of one item, in request order.
+type BulkResult struct {
+	Index  int         `json:"index"`
+	ID     string      `json:"id,omitempty"`
+	Status int         `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// BulkStore applies single items of a bulk request.
+type BulkStore[T any] interface {
+	Create(ctx context.Context, data T) (T, error)
+	Update(ctx context.Context, id string, data T) (T, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// BulkPatcher is implemented by stores that can merge the submitted
+// fields of an update into the stored record. BulkHandler prefers it
+// to Update, which gets the whole of the decoded T.
+type BulkPatcher[T any] interface {
+	Patch(ctx context.Context, id string, fields map[string]interface{}) (T, error)
+}
+
+// BulkTransactor is implemented by stores that can apply a whole
+// bulk request atomically. If any item fails none are applied.
+type BulkTransactor[T any] interface {
+	ApplyAll(ctx context.Context, items []BulkItem[T]) ([]BulkResult, error)
+}
+
+// BulkOptions configures BulkHandler.
+type BulkOptions struct {
+	// MaxItems caps the number of items. Defaults to 1000.
+	MaxItems int
+	// Transactional makes every request atomic.
+	Transactional bool
+}
+
+// ErrAtomicUnsupported is returned when an atomic bulk request is
+// made against a store that is not a BulkTransactor.
+var ErrAtomicUnsupported = errors.New("store does not support atomic bulk operations")
+
+// BulkHandler serves a bulk endpoint over store. Items are validated
+// and applied in order, and the response lists a BulkResult per
+// item. Without atomic the request partially succeeds: the status is
+// 200 when every item succeeded and 207 otherwise. Atomic requests
+// answer 200 or 422 with nothing applied. Updates carrying only some
+// fields are validated by the store once merged, see
+// Repository.ValidateWrites.
+//
+// Example:
+//  store := ghostutils.SurrealBulkStore[User]{DB: db, Table: "user", Authorizer: ghostutils.OwnerAuthorizer{}}
+//  r.POST("/users/bulk", ghostutils.BulkHandler[User](store, ghostutils.BulkOptions{MaxItems: 500}))
+//
+// Request:
+//  {"atomic": false, "items": [
+//      {"op": "create", "data": {"name": "ada"}},
+//      {"op": "update", "id": "user:abc", "data": {"name": "grace"}},
+//      {"op": "delete", "id": "user:def"}
+//  ]}
+func BulkHandler[T any](store BulkStore[T], opts BulkOptions) gin.HandlerFunc {
+	if opts.MaxItems <= 0 {
+		opts.MaxItems = 1000
+	}
+	return func(c *gin.Context) {
+		var req BulkRequest[T]
+		if err := c.ShouldBindJSON(&req); err != nil {
+			FailStatus(c, http.StatusBadRequest, err)
+			return
+		}
+		if len(req.Items) == 0 || len(req.Items) > opts.MaxItems {
+			Fail(c, NewGhostError(http.StatusBadRequest, "invalid_request", fmt.Sprintf("a bulk request takes 1 to %d items", opts.MaxItems)))
+			return
+		}
+		atomic := req.Atomic || opts.Transactional
+		results := make([]BulkResult, len(req.Items))
+		failed := false
+		for i, item := range req.Items {
+			results[i] = BulkResult{Index: i, ID: item.ID}
+			if err := validateBulkItem(item); err != nil {
+				results[i].Status, results[i].Error = http.StatusUnprocessableEntity, err.Error()
+				failed = true
+			}
+		}
+		if atomic {
+			if failed {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"results": results})
+				return
+			}
+			tx, ok := store.(BulkTransactor[T])
+			if !ok {
+				FailStatus(c, http.StatusBadRequest, ErrAtomicUnsupported)
+				return
+			}
+			applied, err := tx.ApplyAll(c.Request.Context(), req.Items)
+			if err != nil {
+				if applied == nil {
+					FailStatus(c, bulkErrorStatus(err), err)
+					return
+				}
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"results": applied})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"results": applied})
+			return
+		}
+		for i, item := range req.Items {
+			if results[i].Status != 0 {
+				continue
+			}
+			results[i] = applyBulkItem(c.Request.Context(), store, i, item)
+			if results[i].Error != "" {
+				failed = true
+			}
+		}
+		status := http.StatusOK
+		if failed {
+			status = http.StatusMultiStatus
+		}
+		c.JSON(status, gin.H{"results": results})
+	}
+}
+
+func validateBulkItem[T any](item BulkItem[T]) error {
+	switch item.Op {
+	case BulkCreate:
+	case BulkUpdate:
+		if item.ID == "" {
+			return errors.New("update requires an id")
+		}
+		if item.Fields != nil {
+			// a partial record, validated after the merge
+			return nil
+		}
+	case BulkDelete:
+		if item.ID == "" {
+			return errors.New("delete requires an id")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown op %q", item.Op)
+	}
+	if binding.Validator == nil {
+		return nil
+	}
+	return binding.Validator.ValidateStruct(item.Data)
+}
+
+func applyBulkItem[T any](ctx context.Context, store BulkStore[T], index int, item BulkItem[T]) BulkResult {
+	result := BulkResult{Index: index, ID: item.ID}
+	var (
+		data T
+		err  error
+	)
+	switch item.Op {
+	case BulkCreate:
+		data, err = store.Create(ctx, item.Data)
+		result.Status, result.Data = http.StatusCreated, data
+	case BulkUpdate:
+		if patcher, ok := store.(BulkPatcher[T]); ok {
+			var fields map[string]interface{}
+			if fields, err = item.patch(); err == nil {
+				data, err = patcher.Patch(ctx, item.ID, fields)
+			}
+		} else {
+			data, err = store.Update(ctx, item.ID, item.Data)
+		}
+		result.Status, result.Data = http.StatusOK, data
+	case BulkDelete:
+		err = store.Delete(ctx, item.ID)
+		result.Status = http.StatusNoContent
+	}
+	if err != nil {
+		result.Status, result.Error, result.Data = bulkErrorStatus(err), err.Error(), nil
+	}
+	return result
+}
+
+func bulkErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, surrealdb.ErrNoRow):
+		return http.StatusNotFound
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// SurrealBulkStore is a BulkStore, BulkPatcher and BulkTransactor
+// over a SurrealDB table. Every item goes through a Repository with
+// the same Authorizer, so records are stamped, authorized and
+// validated as single writes are. Ids may be given with or without
+// the table prefix.
+type SurrealBulkStore[T any] struct {
+	DB         GhostDB
+	Table      string
+	Authorizer RecordAuthorizer
+}
+
+func (s SurrealBulkStore[T]) repository() *Repository[T] {
+	return &Repository[T]{DB: s.DB, Table: s.Table, Authorizer: s.Authorizer, ValidateWrites: true}
+}
+
+// Create implements BulkStore, see Repository.Create.
+func (s SurrealBulkStore[T]) Create(ctx context.Context, data T) (T, error) {
+	return s.repository().Create(ctx, data)
+}
+
+// Update implements BulkStore by merging all of data into the record.
+// Missing records are reported as surrealdb.ErrNoRow rather than
+// created.
+func (s SurrealBulkStore[T]) Update(ctx context.Context, id string, data T) (T, error) {
+	fields, err := recordContent(data)
+	if err != nil {
+		var row T
+		return row, err
+	}
+	return s.repository().Patch(ctx, id, fields)
+}
+
+// Patch implements BulkPatcher, see Repository.Patch.
+func (s SurrealBulkStore[T]) Patch(ctx context.Context, id string, fields map[string]interface{}) (T, error) {
+	return s.repository().Patch(ctx, id, fields)
+}
+
+// Delete implements BulkStore, see Repository.Delete.
+func (s SurrealBulkStore[T]) Delete(ctx context.Context, id string) error {
+	return s.repository().Delete(ctx, id)
+}
+
+// ApplyAll implements BulkTransactor by running every item in one
+// SurrealDB transaction. Items are stamped and authorized before it
+// starts; if any is refused nothing is written and the others are
+// reported as not executed.
+func (s SurrealBulkStore[T]) ApplyAll(ctx context.Context, items []BulkItem[T]) ([]BulkResult, error) {
+	repo := s.repository()
+	content := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		var err error
+		switch item.Op {
+		case BulkCreate:
+			content[i], err = repo.createContent(ctx, item.Data)
+		case BulkUpdate:
+			if content[i], err = item.patch(); err == nil {
+				content[i], err = repo.patchContent(ctx, item.ID, content[i])
+			}
+		case BulkDelete:
+			err = repo.checkWrite(ctx, item.ID, nil)
+		}
+		if err != nil {
+			return bulkRefused(items, i, err), fmt.Errorf("item %d: %w", i, err)
+		}
+	}
+	var sql strings.Builder
+	vars := map[string]interface{}{"tb": s.Table}
+	sql.WriteString("BEGIN TRANSACTION;\n")
+	// index of each item's statement in the results, as updates and
+	// deletes are preceded by an existence check
+	positions := make([]int, len(items))
+	statement := 0
+	for i, item := range items {
+		id, data := fmt.Sprintf("id_%d", i), fmt.Sprintf("data_%d", i)
+		vars[id] = strings.TrimPrefix(item.ID, s.Table+":")
+		vars[data] = content[i]
+		if item.Op != BulkCreate {
+			// a missing record must abort the whole transaction
+			fmt.Fprintf(&sql, "IF (SELECT id FROM type::thing($tb, $%s)) = [] { THROW \"item %d: record not found\" };\n", id, i)
+			statement++
+		}
+		switch item.Op {
+		case BulkCreate:
+			fmt.Fprintf(&sql, "CREATE type::table($tb) CONTENT $%s;\n", data)
+		case BulkUpdate:
+			fmt.Fprintf(&sql, "UPDATE type::thing($tb, $%s) MERGE $%s RETURN AFTER;\n", id, data)
+		case BulkDelete:
+			fmt.Fprintf(&sql, "DELETE type::thing($tb, $%s);\n", id)
+		}
+		positions[i] = statement
+		statement++
+	}
+	sql.WriteString("COMMIT TRANSACTION;")
+	statements, err := surrealStatements(repo.db(ctx), sql.String(), vars)
+	if err != nil {
+		return nil, err
+	}
+	if len(statements) != statement {
+		return nil, fmt.Errorf("bulk transaction returned %d results for %d statements", len(statements), statement)
+	}
+	results := make([]BulkResult, len(items))
+	var failure error
+	for i, item := range items {
+		result := BulkResult{Index: i, ID: item.ID}
+		check, stmt := statements[positions[i]], statements[positions[i]]
+		if item.Op != BulkCreate {
+			check = statements[positions[i]-1]
+		}
+		rows, _ := stmt.Result.([]interface{})
+		switch {
+		case check.Status != "OK" && strings.Contains(check.Detail, "record not found"):
+			result.Status, result.Error = http.StatusNotFound, check.Detail
+		case check.Status != "OK":
+			result.Status, result.Error = http.StatusUnprocessableEntity, check.Detail
+		case stmt.Status != "OK":
+			result.Status, result.Error = http.StatusUnprocessableEntity, stmt.Detail
+		case item.Op == BulkCreate && len(rows) > 0:
+			result.Status, result.Data = http.StatusCreated, rows[0]
+		case item.Op == BulkUpdate && len(rows) > 0:
+			result.Status, result.Data = http.StatusOK, rows[0]
+		default:
+			result.Status = http.StatusNoContent
+		}
+		if result.Error != "" && failure == nil {
+			failure = fmt.Errorf("item %d: %s", i, result.Error)
+		}
+		results[i] = result
+	}
+	if failure != nil {
+		return results, failure
+	}
+	for _, item := range items {
+		if item.Op != BulkCreate {
+			forgetLoaded(ctx, s.Table, item.ID)
+		}
+	}
+	repo.invalidateWrite(ctx)
+	return results, nil
+}
+
+// bulkRefused reports item failed with err and every other item as
+// not executed.
+func bulkRefused[T any](items []BulkItem[T], failed int, err error) []BulkResult {
+	results := make([]BulkResult, len(items))
+	for i, item := range items {
+		results[i] = BulkResult{Index: i, ID: item.ID, Status: http.StatusFailedDependency, Error: "not executed, another item was refused"}
+	}
+	results[failed].Status, results[failed].Error = bulkErrorStatus(err), err.Error()
+	return results
+}
@@ -0,0 +1,119 @@
+package ghostutils
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults applied by CORS to unset lists.
+var (
+	DefaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	DefaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Requested-With"}
+)
+
+// CORSConfig is the cors block of ghost.yaml. Setup installs the CORS
+// middleware when allowed-origins is set. Origins are exact, "*" for
+// any origin, or have a wildcard subdomain like https://*.example.com.
+//
+//  cors:
+//      allowed-origins: [https://app.example.com, "https://*.example.dev"]
+//      allowed-methods: [GET, POST, PATCH, DELETE]
+//      allowed-headers: [Authorization, Content-Type]
+//      exposed-headers: [Link, X-Total-Count]
+//      allow-credentials: true
+//      max-age: 10m
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed-origins"`
+	AllowedMethods   []string      `yaml:"allowed-methods"`
+	AllowedHeaders   []string      `yaml:"allowed-headers"`
+	ExposedHeaders   []string      `yaml:"exposed-headers"`
+	AllowCredentials bool          `yaml:"allow-credentials"`
+	MaxAge           time.Duration `yaml:"max-age"`
+}
+
+// allows reports whether origin may call the API.
+func (config CORSConfig) allows(origin string) bool {
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// https://*.example.com matches https://app.example.com
+		if i := strings.Index(allowed, "*."); i >= 0 {
+			prefix, suffix := strings.ToLower(allowed[:i]), strings.ToLower(allowed[i+1:])
+			lower := strings.ToLower(origin)
+			if strings.HasPrefix(lower, prefix) && strings.HasSuffix(lower, suffix) && len(lower) > len(prefix)+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CORS answers preflight requests and adds the CORS headers to the
+// responses for allowed origins. Requests from other origins are
+// served without them, so browsers block reading the response, and
+// their preflights get 403.
+//
+// Example:
+//  r.Use(ghostutils.CORS(ghostConfig.CORS))
+func CORS(config CORSConfig) gin.HandlerFunc {
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = DefaultCORSMethods
+	}
+	if len(config.AllowedHeaders) == 0 {
+		config.AllowedHeaders = DefaultCORSHeaders
+	}
+	methods := strings.Join(config.AllowedMethods, ", ")
+	headers := strings.Join(config.AllowedHeaders, ", ")
+	exposed := strings.Join(config.ExposedHeaders, ", ")
+	anyOrigin := !config.AllowCredentials && containsString(config.AllowedOrigins, "*")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		header := c.Writer.Header()
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if !anyOrigin {
+			header.Add("Vary", "Origin")
+		}
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+		}
+		if !config.allows(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+		if anyOrigin {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if config.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if exposed != "" {
+				header.Set("Access-Control-Expose-Headers", exposed)
+			}
+			c.Next()
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", methods)
+		header.Set("Access-Control-Allow-Headers", headers)
+		if config.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge/time.Second)))
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,324 @@
+package ghostutils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// CRUDRoute is a GhostRoute serving the records of one table through
+// a Repository:
+//  GET    /path          list, filtered by Filters and paged
+//  GET    /path/:id      one record
+//  POST   /path          create
+//  PUT    /path/:id      replace
+//  PATCH  /path/:id      merge fields
+//  DELETE /path/:id      delete
+//
+// Bodies are bound and responses rendered by content negotiation, see
+// BindBody and Negotiate.
+//
+// Example:
+//  users := ghostutils.NewCRUDRoute[User]("/users", db)
+//  users.Repository.Authorizer = ghostutils.OwnerAuthorizer{}
+//  users.Filters = ghostutils.FilterRules{Fields: map[string]ghostutils.FilterField{"name": {Ops: []string{ghostutils.FilterEq}}}}
+//  users.Validate = func(c *gin.Context, user *User) error {
+//      if user.Email == "" {
+//          return errors.New("email is required")
+//      }
+//      return nil
+//  }
+//  users.Use(ghostutils.RequireIdentity())
+//  users.Route(r.Group("/api"))
+type CRUDRoute[T any] struct {
+	*BasicRoute
+	Repository *Repository[T]
+	// Filters is the allowlist of list query parameters. Without
+	// fields, lists are not filtered.
+	Filters FilterRules
+	// PerPage and MaxPerPage bound ?per_page=. Default to 20 and 100.
+	PerPage    int
+	MaxPerPage int
+	// Validate checks records before they are created or written,
+	// after any binding tags. Its error answers 422.
+	Validate func(c *gin.Context, record *T) error
+	// Serialize turns a record into its response. Defaults to the
+	// record itself.
+	Serialize func(c *gin.Context, record T) (interface{}, error)
+}
+
+// NewCRUDRoute returns a CRUDRoute for path over the table named by
+// its last segment; change Repository.Table for another table.
+func NewCRUDRoute[T any](routePath string, db GhostDB) *CRUDRoute[T] {
+	route := &CRUDRoute[T]{
+		Repository: NewRepository[T](db, strings.Trim(path.Base(routePath), "/")),
+	}
+	route.BasicRoute = NewBasicRoute(db, routePath, func(g *gin.RouterGroup, _ GhostRoute) {
+		g.GET("", route.list)
+		g.GET("/:id", route.get)
+		g.POST("", route.create)
+		g.PUT("/:id", route.update)
+		g.PATCH("/:id", route.patch)
+		g.DELETE("/:id", route.delete)
+	})
+	return route
+}
+
+func (route *CRUDRoute[T]) bindDB(db GhostDB) {
+	route.BasicRoute.bindDB(db)
+	if route.Repository.DB == nil {
+		route.Repository.DB = db
+	}
+}
+
+// Operations implements DocumentedRoute with the six endpoints and
+// the endpoints added with Document. With Serialize set responses are
+// documented as plain objects.
+func (route *CRUDRoute[T]) Operations() []Operation {
+	var record T
+	var response interface{} = record
+	if route.Serialize != nil {
+		response = map[string]interface{}{}
+	}
+	tags := []string{route.Repository.Table}
+	params := []OperationParam{
+		{Name: "page", Type: "integer", Description: "page number, from 1"},
+		{Name: "per_page", Type: "integer", Description: "records per page"},
+	}
+	fields := make([]string, 0, len(route.Filters.Fields))
+	for field := range route.Filters.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		rule := route.Filters.Fields[field]
+		typ := "string"
+		switch rule.Type {
+		case FilterNumber:
+			typ = "number"
+		case FilterBool:
+			typ = "boolean"
+		}
+		ops := rule.Ops
+		if len(ops) == 0 {
+			ops = []string{FilterEq}
+		}
+		for _, op := range ops {
+			name := "filter[" + field + "][" + op + "]"
+			if op == FilterEq {
+				name = "filter[" + field + "]"
+			}
+			params = append(params, OperationParam{Name: name, Type: typ})
+		}
+	}
+	if len(route.Filters.Sort) > 0 {
+		params = append(params, OperationParam{Name: "sort", Description: "one of " + strings.Join(route.Filters.Sort, ", ") + ", - first for descending"})
+	}
+	ops := []Operation{
+		{Method: http.MethodGet, Path: "", Summary: "List " + route.Repository.Table, Params: params, Response: Page[interface{}]{}},
+		{Method: http.MethodGet, Path: "/:id", Summary: "Get a record", Response: response},
+		{Method: http.MethodPost, Path: "", Summary: "Create a record", Request: record, Response: response, Status: http.StatusCreated},
+		{Method: http.MethodPut, Path: "/:id", Summary: "Replace a record", Request: record, Response: response},
+		{Method: http.MethodPatch, Path: "/:id", Summary: "Update fields of a record", Request: map[string]interface{}{}, Response: response},
+		{Method: http.MethodDelete, Path: "/:id", Summary: "Delete a record", Status: http.StatusNoContent},
+	}
+	if route.Serialize == nil {
+		ops[0].Response = Page[T]{}
+	}
+	for i := range ops {
+		ops[i].Tags = tags
+		ops[i].Path = joinRoutePath(route.Path, ops[i].Path)
+	}
+	return append(ops, route.BasicRoute.Operations()...)
+}
+
+func crudErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, surrealdb.ErrNoRow):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func (route *CRUDRoute[T]) fail(c *gin.Context, code int, err error) {
+	var bindErr *BindError
+	if errors.As(err, &bindErr) {
+		// invalid records, from Validate or the repository
+		AbortWithBindError(c, err)
+		return
+	}
+	FailStatus(c, code, err)
+}
+
+func (route *CRUDRoute[T]) respond(c *gin.Context, code int, record T) {
+	body, err := route.serialize(c, record)
+	if err != nil {
+		route.fail(c, http.StatusInternalServerError, err)
+		return
+	}
+	Negotiate(c, code, body)
+}
+
+func (route *CRUDRoute[T]) serialize(c *gin.Context, record T) (interface{}, error) {
+	if route.Serialize == nil {
+		return record, nil
+	}
+	return route.Serialize(c, record)
+}
+
+func (route *CRUDRoute[T]) validate(c *gin.Context, record *T) bool {
+	if route.Validate == nil {
+		return true
+	}
+	if err := route.Validate(c, record); err != nil {
+		route.fail(c, http.StatusUnprocessableEntity, err)
+		return false
+	}
+	return true
+}
+
+func (route *CRUDRoute[T]) list(c *gin.Context) {
+	var filters []ListFilter
+	if len(route.Filters.Fields) > 0 || len(route.Filters.Sort) > 0 {
+		filter, err := ListFilterFrom(c, route.Filters)
+		if err != nil {
+			route.fail(c, http.StatusBadRequest, err)
+			return
+		}
+		filters = append(filters, filter)
+	}
+	perPage, maxPerPage := route.PerPage, route.MaxPerPage
+	if perPage <= 0 {
+		perPage = 20
+	}
+	if maxPerPage <= 0 {
+		maxPerPage = 100
+	}
+	number, size := PageParams(c, perPage, maxPerPage)
+	page, err := route.Repository.Page(c, number, size, filters...)
+	if err != nil {
+		route.fail(c, crudErrorStatus(err), err)
+		return
+	}
+	body := Page[interface{}]{Page: page.Page, PerPage: page.PerPage, Total: page.Total, Items: make([]interface{}, 0, len(page.Items))}
+	for _, record := range page.Items {
+		item, err := route.serialize(c, record)
+		if err != nil {
+			route.fail(c, http.StatusInternalServerError, err)
+			return
+		}
+		body.Items = append(body.Items, item)
+	}
+	SetPageLinks(c, page.Pagination(c.Request.URL))
+	Negotiate(c, http.StatusOK, body)
+}
+
+func (route *CRUDRoute[T]) get(c *gin.Context) {
+	record, err := route.Repository.Get(c, c.Param("id"))
+	if err != nil {
+		route.fail(c, crudErrorStatus(err), err)
+		return
+	}
+	route.respond(c, http.StatusOK, record)
+}
+
+func (route *CRUDRoute[T]) create(c *gin.Context) {
+	var record T
+	if err := BindBody(c, &record); err != nil {
+		AbortWithBindError(c, newBindError(reflect.TypeOf(record), err, RequestLocale(c)))
+		return
+	}
+	if !route.validate(c, &record) {
+		return
+	}
+	created, err := route.Repository.Create(c, record)
+	if err != nil {
+		route.fail(c, crudErrorStatus(err), err)
+		return
+	}
+	route.respond(c, http.StatusCreated, created)
+}
+
+func (route *CRUDRoute[T]) update(c *gin.Context) {
+	var record T
+	if err := BindBody(c, &record); err != nil {
+		AbortWithBindError(c, newBindError(reflect.TypeOf(record), err, RequestLocale(c)))
+		return
+	}
+	if !route.validate(c, &record) {
+		return
+	}
+	updated, err := route.Repository.Update(c, c.Param("id"), record)
+	if err != nil {
+		route.fail(c, crudErrorStatus(err), err)
+		return
+	}
+	route.respond(c, http.StatusOK, updated)
+}
+
+func (route *CRUDRoute[T]) patch(c *gin.Context) {
+	var fields map[string]interface{}
+	if err := c.ShouldBindJSON(&fields); err != nil {
+		route.fail(c, http.StatusBadRequest, err)
+		return
+	}
+	if route.Validate != nil {
+		// validate the record as it will be after the merge
+		stored, err := route.Repository.Get(c, c.Param("id"))
+		if err != nil {
+			route.fail(c, crudErrorStatus(err), err)
+			return
+		}
+		merged, err := mergeRecord(stored, fields)
+		if err != nil {
+			route.fail(c, http.StatusBadRequest, err)
+			return
+		}
+		if !route.validate(c, &merged) {
+			return
+		}
+	}
+	patched, err := route.Repository.Patch(c, c.Param("id"), fields)
+	if err != nil {
+		route.fail(c, crudErrorStatus(err), err)
+		return
+	}
+	route.respond(c, http.StatusOK, patched)
+}
+
+func (route *CRUDRoute[T]) delete(c *gin.Context) {
+	if err := route.Repository.Delete(c, c.Param("id")); err != nil {
+		route.fail(c, crudErrorStatus(err), err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// mergeRecord returns record with fields merged over its JSON form.
+func mergeRecord[T any](record T, fields map[string]interface{}) (T, error) {
+	var merged T
+	current, err := recordFields(record)
+	if err != nil {
+		return merged, err
+	}
+	for key, value := range fields {
+		current[key] = value
+	}
+	raw, err := json.Marshal(current)
+	if err != nil {
+		return merged, err
+	}
+	err = json.Unmarshal(raw, &merged)
+	return merged, err
+}
@@ -0,0 +1,269 @@
+package ghostutils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Names of the CSRF cookie, form field and header.
+const (
+	CSRFCookie = "ghost_csrf"
+	CSRFField  = "_csrf"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// CSRFKey is the gin context key holding the CSRF token of the request.
+const CSRFKey = "ghost-csrf"
+
+// csrfVerifiedKey is set on requests whose CSRF token was checked.
+const csrfVerifiedKey = "ghost-csrf-verified"
+
+// CSRFConfig is the csrf block of ghost.yaml. Setup installs the CSRF
+// middleware when enabled is set. Exempt paths are matched with
+// path.Match, and a pattern ending in /* also matches every path
+// below it, so webhooks can be let through.
+//
+//  csrf:
+//      enabled: true
+//      secret: ${CSRF_SECRET}
+//      cookie-name: ghost_csrf
+//      cookie-domain: example.com
+//      same-site: strict
+//      secure: true
+//      max-age: 12h
+//      exempt: [/webhooks/*, /api/*]
+type CSRFConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Secret signs the tokens, at least 32 bytes.
+	Secret       string `yaml:"secret"`
+	CookieName   string `yaml:"cookie-name"`
+	CookiePath   string `yaml:"cookie-path"`
+	CookieDomain string `yaml:"cookie-domain"`
+	// SameSite is lax, strict or none, which needs secure.
+	SameSite string        `yaml:"same-site"`
+	Secure   bool          `yaml:"secure"`
+	MaxAge   time.Duration `yaml:"max-age"`
+	Exempt   []string      `yaml:"exempt"`
+}
+
+// CSRF protects forms with a double submit token: the token is kept in
+// a cookie and must come back with every POST, PUT, PATCH and DELETE,
+// either as the _csrf form field or the X-CSRF-Token header. Requests
+// with a bearer token that VerifyBearer accepts are not checked,
+// browsers never send one on their own; any other Authorization
+// header is, so a cookie session cannot skip the check by adding one.
+// With a Secret the cookie is signed, so a token planted by a sibling
+// subdomain is replaced rather than trusted.
+//
+// Example:
+//  csrf := &ghostutils.CSRF{Secure: true, Exempt: []string{"/webhooks/*"}}
+//  r.Use(csrf.Middleware())
+//  layout.Provide("CSRF", ghostutils.CSRFLayout)
+type CSRF struct {
+	Secure bool
+	Secret string
+	// Cookie is the name of the cookie, CSRFCookie when empty.
+	Cookie   string
+	Path     string
+	Domain   string
+	SameSite http.SameSite
+	// MaxAge keeps the cookie, which lasts the browser session when 0.
+	MaxAge time.Duration
+	Exempt []string
+	// VerifyBearer reports whether token is a valid bearer token, see
+	// Auth.Verify. NewCSRF sets it from the auth block; without it
+	// every unsafe request is checked.
+	VerifyBearer func(token string) bool
+}
+
+// NewCSRF returns the CSRF protection of the csrf block.
+//
+// Example:
+//  r.Use(ghostConfig.NewCSRF().Middleware())
+func (ghostConfig GhostConfig) NewCSRF() *CSRF {
+	config := ghostConfig.CSRF
+	x := &CSRF{
+		Secure: config.Secure,
+		Secret: config.Secret,
+		Cookie: config.CookieName,
+		Path:   config.CookiePath,
+		Domain: config.CookieDomain,
+		MaxAge: config.MaxAge,
+		Exempt: config.Exempt,
+	}
+	switch strings.ToLower(config.SameSite) {
+	case "strict":
+		x.SameSite = http.SameSiteStrictMode
+	case "none":
+		x.SameSite = http.SameSiteNoneMode
+	default:
+		x.SameSite = http.SameSiteLaxMode
+	}
+	if auth, err := ghostConfig.NewAuth(); err == nil {
+		x.VerifyBearer = func(token string) bool {
+			_, err := auth.Verify(token)
+			return err == nil
+		}
+	}
+	return x
+}
+
+func (x *CSRF) cookie() string {
+	if x.Cookie == "" {
+		return CSRFCookie
+	}
+	return x.Cookie
+}
+
+// issue returns a new token, signed with a Secret.
+func (x *CSRF) issue() string {
+	nonce := randomID(16)
+	if x.Secret == "" {
+		return nonce
+	}
+	return nonce + "." + x.sign(nonce)
+}
+
+func (x *CSRF) sign(nonce string) string {
+	mac := hmac.New(sha256.New, []byte(x.Secret))
+	mac.Write([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// valid reports whether token was issued by x.
+func (x *CSRF) valid(token string) bool {
+	if x.Secret == "" {
+		return len(token) == 32
+	}
+	nonce, sig, ok := strings.Cut(token, ".")
+	return ok && len(nonce) == 32 && hmac.Equal([]byte(sig), []byte(x.sign(nonce)))
+}
+
+// exempt reports whether the path of a request is not checked.
+func (x *CSRF) exempt(p string) bool {
+	for _, pattern := range x.Exempt {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && (p == prefix || strings.HasPrefix(p, prefix+"/")) {
+			return true
+		}
+		if matched, _ := path.Match(pattern, p); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// bearer reports whether the request carries a verified bearer token.
+func (x *CSRF) bearer(c *gin.Context) bool {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return ok && x.VerifyBearer != nil && x.VerifyBearer(strings.TrimSpace(token))
+}
+
+// Middleware issues the token and rejects unsafe requests without it
+// with 403.
+func (x *CSRF) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := c.Cookie(x.cookie())
+		if err != nil || !x.valid(token) {
+			token = x.issue()
+			if x.SameSite != 0 {
+				c.SetSameSite(x.SameSite)
+			}
+			cookiePath := x.Path
+			if cookiePath == "" {
+				cookiePath = "/"
+			}
+			c.SetCookie(x.cookie(), token, int(x.MaxAge/time.Second), cookiePath, x.Domain, x.Secure, true)
+		}
+		c.Set(CSRFKey, token)
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			c.Next()
+			return
+		}
+		if x.exempt(c.Request.URL.Path) || x.bearer(c) {
+			c.Next()
+			return
+		}
+		sent := c.GetHeader(CSRFHeader)
+		if sent == "" {
+			sent = c.PostForm(CSRFField)
+		}
+		if err != nil || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			Fail(c, NewGhostError(http.StatusForbidden, "forbidden", "invalid csrf token"))
+			return
+		}
+		c.Set(csrfVerifiedKey, true)
+		c.Next()
+	}
+}
+
+// RequireCSRF rejects with 403 requests whose CSRF token was not
+// checked by the CSRF middleware, for handlers that change cookie
+// state and must not run without it, exempt or not.
+func RequireCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool(csrfVerifiedKey) {
+			Fail(c, NewGhostError(http.StatusForbidden, "forbidden", "csrf token required"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// CSRFToken returns the token to embed in forms, empty without the CSRF
+// middleware.
+func CSRFToken(c *gin.Context) string {
+	return c.GetString(CSRFKey)
+}
+
+// CSRFLayout provides the CSRF token, for hand written forms and htmx
+// headers.
+//
+// Example:
+//  <input type="hidden" name="_csrf" value="{{.Layout.CSRF}}">
+//  <body hx-headers='{"X-CSRF-Token": "{{.Layout.CSRF}}"}'>
+func CSRFLayout(c *gin.Context) (interface{}, error) {
+	return CSRFToken(c), nil
+}
+
+// CSRFFuncMap returns csrfField, rendering the hidden input of a token
+// or of the request of a *gin.Context, and csrfHeaders, the hx-headers
+// value sending it with every htmx request. Setup adds them to the
+// templates.
+//
+// Example:
+//  <form method="post" action="/posts">
+//      {{csrfField .Layout.CSRF}}
+//      ...
+//  </form>
+//  <body hx-headers='{{csrfHeaders .Layout.CSRF}}'>
+func CSRFFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"csrfField": func(v interface{}) template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, CSRFField, template.HTMLEscapeString(csrfTokenOf(v))))
+		},
+		"csrfHeaders": func(v interface{}) string {
+			return fmt.Sprintf(`{"%s": %q}`, CSRFHeader, csrfTokenOf(v))
+		},
+	}
+}
+
+func csrfTokenOf(v interface{}) string {
+	switch v := v.(type) {
+	case *gin.Context:
+		return CSRFToken(v)
+	case string:
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,147 @@
+package ghostutils_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+	"github.com/adamkali/ghost_utils/pkg/ghosttest"
+	"github.com/gin-gonic/gin"
+)
+
+const testCSRFSecret = "0123456789abcdef0123456789abcdef"
+
+func csrfEngine(x *ghostutils.CSRF) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(x.Middleware())
+	r.GET("/form", func(c *gin.Context) {
+		c.String(http.StatusOK, ghostutils.CSRFToken(c))
+	})
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.POST("/posts", ok)
+	r.POST("/webhooks/stripe", ok)
+	r.POST("/settings", ghostutils.RequireCSRF(), ok)
+	return r
+}
+
+// csrfCookie gets /form and returns the cookie and token it issued.
+func csrfCookie(t *testing.T, r *gin.Engine) (*http.Cookie, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/form", nil))
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == ghostutils.CSRFCookie {
+			if cookie.Value != w.Body.String() || !cookie.HttpOnly {
+				t.Fatalf("cookie %+v, token %q", cookie, w.Body)
+			}
+			return cookie, cookie.Value
+		}
+	}
+	t.Fatalf("no %s cookie issued", ghostutils.CSRFCookie)
+	return nil, ""
+}
+
+func TestCSRFChecksUnsafeRequests(t *testing.T) {
+	x := &ghostutils.CSRF{
+		Secret: testCSRFSecret,
+		Exempt: []string{"/webhooks/*"},
+		VerifyBearer: func(token string) bool {
+			return token == "valid"
+		},
+	}
+	r := csrfEngine(x)
+	cookie, token := csrfCookie(t, r)
+	form := url.Values{ghostutils.CSRFField: {token}}.Encode()
+
+	for _, test := range []struct {
+		name, path, header, auth, body string
+		cookie                         bool
+		want                           int
+	}{
+		{name: "no token", path: "/posts", cookie: true, want: http.StatusForbidden},
+		{name: "header", path: "/posts", cookie: true, header: token, want: http.StatusOK},
+		{name: "form field", path: "/posts", cookie: true, body: form, want: http.StatusOK},
+		{name: "other token", path: "/posts", cookie: true, header: token + "x", want: http.StatusForbidden},
+		{name: "no cookie", path: "/posts", header: token, want: http.StatusForbidden},
+		{name: "exempt", path: "/webhooks/stripe", want: http.StatusOK},
+		{name: "verified bearer", path: "/posts", auth: "Bearer valid", want: http.StatusOK},
+		{name: "unverified bearer", path: "/posts", cookie: true, auth: "Bearer forged", want: http.StatusForbidden},
+		{name: "basic auth", path: "/posts", cookie: true, auth: "Basic YWRhOnB3", want: http.StatusForbidden},
+		{name: "required and checked", path: "/settings", cookie: true, header: token, want: http.StatusOK},
+		{name: "required and bearer", path: "/settings", auth: "Bearer valid", want: http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+		if test.body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if test.cookie {
+			req.AddCookie(cookie)
+		}
+		if test.header != "" {
+			req.Header.Set(ghostutils.CSRFHeader, test.header)
+		}
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestCSRFReplacesUnsignedCookies(t *testing.T) {
+	r := csrfEngine(&ghostutils.CSRF{Secret: testCSRFSecret})
+	// a 32 character token, valid without a Secret, set by a sibling
+	// subdomain
+	planted := &http.Cookie{Name: ghostutils.CSRFCookie, Value: strings.Repeat("a", 32)}
+	req := httptest.NewRequest(http.MethodPost, "/posts", nil)
+	req.AddCookie(planted)
+	req.Header.Set(ghostutils.CSRFHeader, planted.Value)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("planted token: status %d, want 403", w.Code)
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), ghostutils.CSRFCookie+"=") {
+		t.Errorf("planted cookie kept: %q", w.Header().Get("Set-Cookie"))
+	}
+
+	_, token := csrfCookie(t, csrfEngine(&ghostutils.CSRF{Secret: "another secret of at least 32 bytes"}))
+	req = httptest.NewRequest(http.MethodPost, "/posts", nil)
+	req.AddCookie(&http.Cookie{Name: ghostutils.CSRFCookie, Value: token})
+	req.Header.Set(ghostutils.CSRFHeader, token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("token of another secret: status %d, want 403", w.Code)
+	}
+}
+
+func TestCSRFSetup(t *testing.T) {
+	config := ghosttest.DefaultConfig()
+	config.CSRF.Enabled = true
+	config.CSRF.Secret = testCSRFSecret
+	ghosttest.WriteConfig(t, config)
+	srv := ghosttest.NewTestServer(t)
+	srv.Engine.GET("/form", func(c *gin.Context) {
+		c.String(http.StatusOK, ghostutils.CSRFToken(c))
+	})
+	srv.Engine.POST("/posts", func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+
+	token := string(srv.Get("/form").AssertStatus(http.StatusOK).Body)
+	srv.PostForm("/posts", url.Values{"title": {"Hello"}}).AssertStatus(http.StatusForbidden)
+	srv.PostForm("/posts", url.Values{"title": {"Hello"}, ghostutils.CSRFField: {token}}).
+		AssertStatus(http.StatusCreated)
+	srv.NewRequest(http.MethodPost, "/posts").
+		Header(ghostutils.CSRFHeader, token).
+		Do().
+		AssertStatus(http.StatusCreated)
+}
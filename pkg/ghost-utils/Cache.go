@@ -0,0 +1,447 @@
+package ghostutils
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// CacheConfig is the `cache:` block of ghost.yaml, the store of
+// cached repositories, queries and responses, which Setup keeps as
+// the Cache of its App.
+//
+// Example:
+//  cache:
+//    store: redis
+//    redis-url: redis://localhost:6379/1
+//    ttl: 2m
+type CacheConfig struct {
+	Store    string `yaml:"store"`
+	RedisURL string `yaml:"redis-url"`
+	// MaxEntries bounds the memory store, which drops the least
+	// recently used values beyond it, 10000 by default.
+	MaxEntries int `yaml:"max-entries"`
+	// TTL is the lifetime of the cached responses and queries without
+	// their own, five minutes by default.
+	TTL time.Duration `yaml:"ttl"`
+	// CursorTTL is the lifetime of the cursors of PageCursors, 30
+	// minutes by default.
+	CursorTTL time.Duration `yaml:"cursor-ttl"`
+}
+
+// Defaults applied to CacheConfig by Validate.
+const (
+	DefaultCacheMaxEntries = 10000
+	DefaultCacheTTL        = 5 * time.Minute
+	DefaultCursorTTL       = 30 * time.Minute
+)
+
+// CacheStore keeps cached values with the tags that invalidate them.
+type CacheStore interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags []string) error
+	// Invalidate drops every value set with one of tags.
+	Invalidate(ctx context.Context, tags ...string) error
+}
+
+// DefaultCache is the store of repositories without a Cache outside
+// an App, in memory.
+var DefaultCache CacheStore = NewMemoryCacheStore()
+
+// contextCache returns the Cache of the app of ctx, DefaultCache
+// outside one.
+func contextCache(ctx context.Context) CacheStore {
+	if app := AppFrom(ctx); app != nil && app.Cache != nil {
+		return app.Cache
+	}
+	return DefaultCache
+}
+
+// NewCacheStore builds the store of the cache block.
+//
+// Example:
+//  store, err := ghostConfig.NewCacheStore()
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  posts.Cache = store
+//
+// Returns:
+//  CacheStore
+//  error for an unknown store or invalid redis-url
+func (ghostConfig GhostConfig) NewCacheStore() (CacheStore, error) {
+	cfg := ghostConfig.Cache
+	switch cfg.Store {
+	case "", "memory":
+		store := NewMemoryCacheStore()
+		store.MaxEntries = cfg.MaxEntries
+		return store, nil
+	case "redis":
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		return RedisCacheStore{Client: redis.NewClient(opts)}, nil
+	}
+	return nil, fmt.Errorf("unknown cache store %q", cfg.Store)
+}
+
+// repositoryCache is the caching of a repository made by Cached.
+type repositoryCache struct {
+	ttl  time.Duration
+	tags []string
+}
+
+// Cached returns a copy of the repository whose Get, GetMany, List
+// and Page results are cached for ttl. Writes through any repository
+// of the table invalidate them, as do Invalidate and InvalidateCache
+// with one of tags, for reads that depend on other tables. Results
+// are cached per caller when the repository has an Authorizer. Set
+// Cache before calling Cached, so reads and writes share the store.
+//
+// Example:
+//  posts := ghostutils.NewRepository[Post](db, "post")
+//  published := posts.Cached(5*time.Minute, "authors")
+//
+//  list, err := published.List(c, filter)   // cached
+//  _, err = posts.Update(c, id, post)       // invalidates it
+//  ghostutils.InvalidateCache(c, "authors") // after an author changes
+func (r *Repository[T]) Cached(ttl time.Duration, tags ...string) *Repository[T] {
+	cached := *r
+	cached.cache = &repositoryCache{ttl: ttl, tags: append([]string{r.tableTag()}, tags...)}
+	return &cached
+}
+
+// Invalidate drops the cached results of the table.
+func (r *Repository[T]) Invalidate(ctx context.Context) error {
+	return r.cacheStore(ctx).Invalidate(ctx, r.tableTag())
+}
+
+// InvalidateCache drops the cached results of every repository Cached
+// with one of tags, in the cache of the app of ctx.
+func InvalidateCache(ctx context.Context, tags ...string) error {
+	return contextCache(ctx).Invalidate(ctx, tags...)
+}
+
+func (r *Repository[T]) tableTag() string {
+	return "table:" + r.Table
+}
+
+func (r *Repository[T]) cacheStore(ctx context.Context) CacheStore {
+	if r.Cache != nil {
+		return r.Cache
+	}
+	return contextCache(ctx)
+}
+
+// invalidateWrite drops the cached results of the table after a write,
+// whether or not this process cached the table, as another instance
+// sharing the store may have. Failing to is logged to the request, as
+// the write itself succeeded.
+func (r *Repository[T]) invalidateWrite(ctx context.Context) {
+	if err := r.Invalidate(ctx); err != nil {
+		if c, ok := ctx.(*gin.Context); ok {
+			c.Error(err)
+		}
+	}
+}
+
+// cachedRead returns the cached result of method with args, or loads
+// and caches it when r is cached.
+func cachedRead[T, V any](ctx context.Context, r *Repository[T], method string, args interface{}, load func() (V, error)) (V, error) {
+	if r.cache == nil {
+		return load()
+	}
+	var caller interface{}
+	if r.Authorizer != nil || len(r.fetch) > 0 {
+		// authorized reads differ by caller
+		caller = cacheCaller(ctx)
+	}
+	raw, err := json.Marshal([]interface{}{method, args, caller, r.fetch, r.graph})
+	if err != nil {
+		return load()
+	}
+	sum := sha256.Sum256(raw)
+	key := "repo:" + r.Table + ":" + hex.EncodeToString(sum[:16])
+	store := r.cacheStore(ctx)
+	var value V
+	if cached, ok, err := store.Get(ctx, key); err == nil && ok && json.Unmarshal(cached, &value) == nil {
+		countCache(ctx, true)
+		return value, nil
+	}
+	countCache(ctx, false)
+	value, err = load()
+	if err != nil {
+		return value, err
+	}
+	if encoded, err := json.Marshal(value); err == nil {
+		store.Set(ctx, key, encoded, r.cache.ttl, r.cache.tags)
+	}
+	return value, nil
+}
+
+// cacheCaller returns what authorized reads depend on of the caller:
+// the identity, its organization and roles, and who impersonates it.
+func cacheCaller(ctx context.Context) interface{} {
+	identity, ok := IdentityFrom(ctx)
+	if !ok {
+		return "anonymous"
+	}
+	roles := append([]string(nil), identity.Roles...)
+	sort.Strings(roles)
+	return []interface{}{identity.ID, identity.Organization, roles, identity.ImpersonatedBy}
+}
+
+// cacheTTL returns ttl, or the ttl of the cache block of the app of
+// ctx when unset.
+func cacheTTL(ctx context.Context, ttl time.Duration) time.Duration {
+	if ttl > 0 {
+		return ttl
+	}
+	if app := AppFrom(ctx); app != nil && app.CacheTTL > 0 {
+		return app.CacheTTL
+	}
+	return DefaultCacheTTL
+}
+
+// Remember returns the value cached under key in the cache of the app
+// of ctx, see AppFrom, or loads it and caches it as JSON for ttl with
+// tags. Load errors are returned and not cached; failing stores fall
+// back to load.
+//
+// Example:
+//  stats, err := ghostutils.Remember(c, "dashboard:stats", time.Minute, []string{"orders"}, func() (Stats, error) {
+//      return computeStats(c, db)
+//  })
+func Remember[V any](ctx context.Context, key string, ttl time.Duration, tags []string, load func() (V, error)) (V, error) {
+	var value V
+	store := contextCache(ctx)
+	if cached, ok, err := store.Get(ctx, key); err == nil && ok && json.Unmarshal(cached, &value) == nil {
+		countCache(ctx, true)
+		return value, nil
+	}
+	countCache(ctx, false)
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+	if encoded, err := json.Marshal(value); err == nil {
+		store.Set(ctx, key, encoded, cacheTTL(ctx, ttl), tags)
+	}
+	return value, nil
+}
+
+// CachedQuery runs the SurrealQL sql with vars, caching the rows of
+// its last statement like Remember for ttl, or the ttl of the cache
+// block when zero. The rows are tagged with tags, e.g. the tables
+// read, for InvalidateCache; writes through cached repositories drop
+// the rows tagged with "table:" and their table.
+//
+// Example:
+//  top, err := ghostutils.CachedQuery[Post](c, db, 0,
+//      "SELECT * FROM post ORDER BY views DESC LIMIT 10", nil, "table:post")
+//
+// Returns:
+//  the rows
+//  error of the query
+func CachedQuery[T any](ctx context.Context, db *surrealdb.DB, ttl time.Duration, sql string, vars map[string]interface{}, tags ...string) ([]T, error) {
+	raw, err := json.Marshal([]interface{}{sql, vars})
+	if err != nil {
+		return surrealQuery[T](db, sql, vars)
+	}
+	sum := sha256.Sum256(raw)
+	return Remember(ctx, "query:"+hex.EncodeToString(sum[:16]), ttl, tags, func() ([]T, error) {
+		return surrealQuery[T](db, sql, vars)
+	})
+}
+
+// MemoryCacheStore keeps values in process. With MaxEntries set the
+// least recently used values are dropped beyond it.
+type MemoryCacheStore struct {
+	MaxEntries int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	tags    map[string]map[string]bool
+	sets    int
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryCacheStore returns an empty in-memory store, unbounded
+// until MaxEntries is set.
+func NewMemoryCacheStore() *MemoryCacheStore {
+	return &MemoryCacheStore{order: list.New(), entries: map[string]*list.Element{}, tags: map[string]map[string]bool{}}
+}
+
+// Get implements CacheStore.
+func (s *MemoryCacheStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expires) {
+		s.remove(element)
+		return nil, false, nil
+	}
+	s.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+// Set implements CacheStore.
+func (s *MemoryCacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sets++
+	if s.sets%1024 == 0 {
+		// drop expired entries now and then so the store does not grow
+		for element := s.order.Back(); element != nil; {
+			previous := element.Prev()
+			if now.After(element.Value.(*memoryCacheEntry).expires) {
+				s.remove(element)
+			}
+			element = previous
+		}
+		for tag, keys := range s.tags {
+			for k := range keys {
+				if _, ok := s.entries[k]; !ok {
+					delete(keys, k)
+				}
+			}
+			if len(keys) == 0 {
+				delete(s.tags, tag)
+			}
+		}
+	}
+	entry := &memoryCacheEntry{key: key, value: value, expires: now.Add(ttl)}
+	if element, ok := s.entries[key]; ok {
+		element.Value = entry
+		s.order.MoveToFront(element)
+	} else {
+		s.entries[key] = s.order.PushFront(entry)
+	}
+	for _, tag := range tags {
+		if s.tags[tag] == nil {
+			s.tags[tag] = map[string]bool{}
+		}
+		s.tags[tag][key] = true
+	}
+	for s.MaxEntries > 0 && s.order.Len() > s.MaxEntries {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+// Invalidate implements CacheStore.
+func (s *MemoryCacheStore) Invalidate(ctx context.Context, tags ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tag := range tags {
+		for key := range s.tags[tag] {
+			if element, ok := s.entries[key]; ok {
+				s.remove(element)
+			}
+		}
+		delete(s.tags, tag)
+	}
+	return nil
+}
+
+// Len returns the number of values kept, expired ones included until
+// they are dropped.
+func (s *MemoryCacheStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// remove drops element; the tags are pruned by Set.
+func (s *MemoryCacheStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.entries, element.Value.(*memoryCacheEntry).key)
+}
+
+// RedisCacheStore keeps values in Redis, shared between instances.
+// Each tag is a set of the keys set with it.
+type RedisCacheStore struct {
+	Client *redis.Client
+	// Prefix defaults to "ghost:cache:".
+	Prefix string
+}
+
+func (s RedisCacheStore) prefix() string {
+	if s.Prefix == "" {
+		return "ghost:cache:"
+	}
+	return s.Prefix
+}
+
+// Get implements CacheStore.
+func (s RedisCacheStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := s.Client.Get(ctx, s.prefix()+key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+// addTagScript adds ARGV[1] to the tag set KEYS[1] and makes the set live
+// at least ARGV[2] seconds, or forever when zero, so it outlives every
+// value set with the tag.
+const addTagScript = `
+local ttl = redis.call("TTL", KEYS[1])
+redis.call("SADD", KEYS[1], ARGV[1])
+local want = tonumber(ARGV[2])
+if want <= 0 then
+	redis.call("PERSIST", KEYS[1])
+elseif ttl == -2 or (ttl >= 0 and ttl < want) then
+	redis.call("EXPIRE", KEYS[1], want)
+end
+return 1`
+
+// Set implements CacheStore. The set of each tag expires with the
+// longest lived of its values.
+func (s RedisCacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags []string) error {
+	pipe := s.Client.TxPipeline()
+	pipe.Set(ctx, s.prefix()+key, value, ttl)
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	for _, tag := range tags {
+		pipe.Eval(ctx, addTagScript, []string{s.prefix() + "tag:" + tag}, s.prefix()+key, seconds)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Invalidate implements CacheStore.
+func (s RedisCacheStore) Invalidate(ctx context.Context, tags ...string) error {
+	for _, tag := range tags {
+		tagKey := s.prefix() + "tag:" + tag
+		keys, err := s.Client.SMembers(ctx, tagKey).Result()
+		if err != nil {
+			return err
+		}
+		if err := s.Client.Del(ctx, append(keys, tagKey)...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,615 @@
+package ghostutils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// DefaultCalendarProdID is the PRODID of calendars without one.
+const DefaultCalendarProdID = "-//ghost_utils//Calendar//EN"
+
+// ICS time layouts.
+const (
+	icsDate     = "20060102"
+	icsDateTime = "20060102T150405"
+)
+
+// CalendarEvent is a VEVENT. Its JSON names match the fields of a
+// SurrealDB record, so query rows bind to it directly.
+type CalendarEvent struct {
+	// ID is the record id, the UID when UID is empty.
+	ID          string    `json:"id,omitempty"`
+	UID         string    `json:"uid,omitempty"`
+	Summary     string    `json:"summary"`
+	Description string    `json:"description,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	Start       time.Time `json:"start"`
+	// End is exclusive, the day after the last one for AllDay events.
+	End    time.Time `json:"end"`
+	AllDay bool      `json:"all_day,omitempty"`
+	// Status is TENTATIVE, CONFIRMED or CANCELLED.
+	Status    string `json:"status,omitempty"`
+	Organizer string `json:"organizer,omitempty"`
+	// RRule is a recurrence rule such as FREQ=WEEKLY;BYDAY=MO.
+	RRule    string    `json:"rrule,omitempty"`
+	Sequence int       `json:"sequence,omitempty"`
+	Updated  time.Time `json:"updated,omitempty"`
+}
+
+// Calendar is a VCALENDAR of events.
+//
+// Example:
+//  cal := ghostutils.Calendar{Name: "Bookings", Location: berlin}
+//  cal.Events = append(cal.Events, ghostutils.CalendarEvent{
+//      UID:     "booking:42",
+//      Summary: "Haircut",
+//      Start:   start,
+//      End:     start.Add(45 * time.Minute),
+//  })
+//  ghostutils.ServeICS(c, "booking.ics", cal)
+type Calendar struct {
+	Name        string
+	Description string
+	// ProdID names the generator, DefaultCalendarProdID by default.
+	ProdID string
+	// Location is the timezone of the times, written with a VTIMEZONE;
+	// UTC when nil.
+	Location *time.Location
+	// Refresh asks subscribed clients to reload the feed this often.
+	Refresh time.Duration
+	Events  []CalendarEvent
+}
+
+// ICS returns the calendar in the iCalendar format of RFC 5545.
+func (cal Calendar) ICS() []byte {
+	w := &icsWriter{}
+	location := cal.Location
+	if location == nil {
+		location = time.UTC
+	}
+	prodID := cal.ProdID
+	if prodID == "" {
+		prodID = DefaultCalendarProdID
+	}
+	w.line("BEGIN:VCALENDAR")
+	w.line("VERSION:2.0")
+	w.line("PRODID:" + prodID)
+	w.line("CALSCALE:GREGORIAN")
+	w.line("METHOD:PUBLISH")
+	if cal.Name != "" {
+		w.line("X-WR-CALNAME:" + icsEscape(cal.Name))
+	}
+	if cal.Description != "" {
+		w.line("X-WR-CALDESC:" + icsEscape(cal.Description))
+	}
+	if location != time.UTC {
+		w.line("X-WR-TIMEZONE:" + location.String())
+	}
+	if cal.Refresh > 0 {
+		duration := icsDuration(cal.Refresh)
+		w.line("REFRESH-INTERVAL;VALUE=DURATION:" + duration)
+		w.line("X-PUBLISHED-TTL:" + duration)
+	}
+	if location != time.UTC && len(cal.Events) > 0 {
+		writeVTimezone(w, location, cal.Events)
+	}
+	stamp := time.Now().UTC().Format(icsDateTime) + "Z"
+	for _, event := range cal.Events {
+		uid := event.UID
+		if uid == "" {
+			uid = event.ID
+		}
+		w.line("BEGIN:VEVENT")
+		w.line("UID:" + icsEscape(uid))
+		w.line("DTSTAMP:" + stamp)
+		w.line(icsTime("DTSTART", event.Start, event.AllDay, location))
+		if !event.End.IsZero() {
+			w.line(icsTime("DTEND", event.End, event.AllDay, location))
+		}
+		w.line("SUMMARY:" + icsEscape(event.Summary))
+		if event.Description != "" {
+			w.line("DESCRIPTION:" + icsEscape(event.Description))
+		}
+		if event.Location != "" {
+			w.line("LOCATION:" + icsEscape(event.Location))
+		}
+		if event.URL != "" {
+			w.line("URL:" + event.URL)
+		}
+		if event.Status != "" {
+			w.line("STATUS:" + strings.ToUpper(event.Status))
+		}
+		if event.Organizer != "" {
+			organizer := event.Organizer
+			if !strings.Contains(organizer, ":") {
+				organizer = "mailto:" + organizer
+			}
+			w.line("ORGANIZER:" + organizer)
+		}
+		if event.RRule != "" {
+			w.line("RRULE:" + strings.TrimPrefix(event.RRule, "RRULE:"))
+		}
+		if event.Sequence > 0 {
+			w.line("SEQUENCE:" + strconv.Itoa(event.Sequence))
+		}
+		if !event.Updated.IsZero() {
+			w.line("LAST-MODIFIED:" + event.Updated.UTC().Format(icsDateTime) + "Z")
+		}
+		w.line("END:VEVENT")
+	}
+	w.line("END:VCALENDAR")
+	return []byte(w.b.String())
+}
+
+// icsWriter writes content lines folded at 75 octets.
+type icsWriter struct {
+	b strings.Builder
+}
+
+func (w *icsWriter) line(value string) {
+	limit := 75
+	for len(value) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(value[cut]) {
+			cut--
+		}
+		w.b.WriteString(value[:cut] + "\r\n ")
+		value = value[cut:]
+		// the leading space counts
+		limit = 74
+	}
+	w.b.WriteString(value + "\r\n")
+}
+
+// icsEscape escapes a TEXT value.
+func icsEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// icsUnescape reverses icsEscape.
+func icsUnescape(value string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(value)
+}
+
+// icsTime writes the property name of t: a date for all-day events, a
+// UTC time, or a local time of location.
+func icsTime(name string, t time.Time, allDay bool, location *time.Location) string {
+	switch {
+	case allDay:
+		return name + ";VALUE=DATE:" + t.In(location).Format(icsDate)
+	case location == time.UTC:
+		return name + ":" + t.UTC().Format(icsDateTime) + "Z"
+	default:
+		return name + ";TZID=" + location.String() + ":" + t.In(location).Format(icsDateTime)
+	}
+}
+
+// icsDuration formats d as an RFC 5545 duration.
+func icsDuration(d time.Duration) string {
+	var b strings.Builder
+	b.WriteString("P")
+	if days := int(d / (24 * time.Hour)); days > 0 {
+		b.WriteString(strconv.Itoa(days) + "D")
+		d -= time.Duration(days) * 24 * time.Hour
+	}
+	if d > 0 {
+		b.WriteString("T")
+		if hours := int(d / time.Hour); hours > 0 {
+			b.WriteString(strconv.Itoa(hours) + "H")
+			d -= time.Duration(hours) * time.Hour
+		}
+		if minutes := int(d / time.Minute); minutes > 0 {
+			b.WriteString(strconv.Itoa(minutes) + "M")
+			d -= time.Duration(minutes) * time.Minute
+		}
+		if seconds := int(d / time.Second); seconds > 0 {
+			b.WriteString(strconv.Itoa(seconds) + "S")
+		}
+	}
+	if b.Len() == 1 {
+		return "PT0S"
+	}
+	return b.String()
+}
+
+// parseICSDuration parses an RFC 5545 duration such as P1DT2H or PT30M.
+func parseICSDuration(value string) (time.Duration, error) {
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimLeft(value, "+-")
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	var d time.Duration
+	var number string
+	inTime := false
+	for _, r := range value[1:] {
+		switch {
+		case r >= '0' && r <= '9':
+			number += string(r)
+			continue
+		case r == 'T':
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		number = ""
+		switch {
+		case r == 'W':
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case r == 'D':
+			d += time.Duration(n) * 24 * time.Hour
+		case r == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case r == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case r == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
+
+// icsOffset formats a UTC offset in seconds as +hhmm.
+func icsOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	value := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset%3600/60)
+	if offset%60 != 0 {
+		value += fmt.Sprintf("%02d", offset%60)
+	}
+	return value
+}
+
+// writeVTimezone writes the VTIMEZONE of location with its offset
+// transitions from the year of the first event to two years after the
+// last one, for recurring events.
+func writeVTimezone(w *icsWriter, location *time.Location, events []CalendarEvent) {
+	first, last := events[0].Start, events[0].Start
+	for _, event := range events {
+		if event.Start.Before(first) {
+			first = event.Start
+		}
+		if event.End.After(last) {
+			last = event.End
+		}
+		if event.Start.After(last) {
+			last = event.Start
+		}
+	}
+	from := time.Date(first.In(location).Year(), 1, 1, 0, 0, 0, 0, location)
+	to := time.Date(last.In(location).Year()+2, 1, 1, 0, 0, 0, 0, location)
+	w.line("BEGIN:VTIMEZONE")
+	w.line("TZID:" + location.String())
+	observance := func(onset time.Time, fromOffset int) {
+		name, offset := onset.Zone()
+		kind := "STANDARD"
+		if onset.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		w.line("BEGIN:" + kind)
+		// the onset is written in the local time of the offset before it
+		w.line("DTSTART:" + onset.In(time.FixedZone("", fromOffset)).Format(icsDateTime))
+		w.line("TZOFFSETFROM:" + icsOffset(fromOffset))
+		w.line("TZOFFSETTO:" + icsOffset(offset))
+		if name != "" && name[0] != '+' && name[0] != '-' {
+			w.line("TZNAME:" + name)
+		}
+		w.line("END:" + kind)
+	}
+	_, offset := from.Zone()
+	observance(from, offset)
+	for day := from; day.Before(to); day = day.Add(24 * time.Hour) {
+		next := day.Add(24 * time.Hour)
+		if _, nextOffset := next.Zone(); nextOffset == offset {
+			continue
+		}
+		// the transition is the first instant with the new offset
+		lo, hi := day, next
+		for hi.Sub(lo) > time.Second {
+			mid := lo.Add(hi.Sub(lo) / 2)
+			if _, midOffset := mid.Zone(); midOffset == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		onset := hi.Truncate(time.Second).In(location)
+		if _, onsetOffset := onset.Zone(); onsetOffset == offset {
+			onset = onset.Add(time.Second)
+		}
+		observance(onset, offset)
+		_, offset = onset.Zone()
+	}
+	w.line("END:VTIMEZONE")
+}
+
+// ParseICS reads the events of an iCalendar document. Times with a
+// TZID are read in that timezone when it is a known IANA name, else
+// in the X-WR-TIMEZONE of the calendar or UTC. Components other than
+// VEVENT, such as alarms, are skipped.
+//
+// Example:
+//  cal, err := ghostutils.ParseICS(upload)
+//  if err != nil {
+//      ghostutils.Fail(c, err)
+//      return
+//  }
+//  for _, event := range cal.Events {
+//      ...
+//  }
+//
+// Returns:
+//  Calendar
+//  error for a malformed document
+func ParseICS(r io.Reader) (Calendar, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Calendar{}, err
+	}
+	var cal Calendar
+	var stack []string
+	var event *CalendarEvent
+	var duration time.Duration
+	location := time.UTC
+	for i, line := range lines {
+		name, params, value, ok := parseICSLine(line)
+		if !ok {
+			return Calendar{}, fmt.Errorf("ics: line %d: malformed content line", i+1)
+		}
+		switch name {
+		case "BEGIN":
+			stack = append(stack, strings.ToUpper(value))
+			if len(stack) == 2 && stack[0] == "VCALENDAR" && stack[1] == "VEVENT" {
+				event, duration = &CalendarEvent{}, 0
+			}
+			continue
+		case "END":
+			if len(stack) == 0 {
+				return Calendar{}, fmt.Errorf("ics: line %d: END without BEGIN", i+1)
+			}
+			if len(stack) == 2 && event != nil {
+				if event.End.IsZero() && duration > 0 {
+					event.End = event.Start.Add(duration)
+				} else if event.End.IsZero() && event.AllDay {
+					event.End = event.Start.AddDate(0, 0, 1)
+				}
+				cal.Events = append(cal.Events, *event)
+				event = nil
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if len(stack) == 1 {
+			switch name {
+			case "X-WR-CALNAME":
+				cal.Name = icsUnescape(value)
+			case "X-WR-CALDESC":
+				cal.Description = icsUnescape(value)
+			case "PRODID":
+				cal.ProdID = value
+			case "X-WR-TIMEZONE":
+				if loaded, err := time.LoadLocation(value); err == nil {
+					location, cal.Location = loaded, loaded
+				}
+			case "REFRESH-INTERVAL", "X-PUBLISHED-TTL":
+				if d, err := parseICSDuration(value); err == nil {
+					cal.Refresh = d
+				}
+			}
+			continue
+		}
+		if event == nil || len(stack) != 2 {
+			continue
+		}
+		var err error
+		switch name {
+		case "UID":
+			event.UID = icsUnescape(value)
+		case "SUMMARY":
+			event.Summary = icsUnescape(value)
+		case "DESCRIPTION":
+			event.Description = icsUnescape(value)
+		case "LOCATION":
+			event.Location = icsUnescape(value)
+		case "URL":
+			event.URL = value
+		case "STATUS":
+			event.Status = strings.ToUpper(value)
+		case "ORGANIZER":
+			event.Organizer = strings.TrimPrefix(strings.TrimPrefix(value, "mailto:"), "MAILTO:")
+		case "RRULE":
+			event.RRule = value
+		case "SEQUENCE":
+			event.Sequence, _ = strconv.Atoi(value)
+		case "DTSTART":
+			event.Start, event.AllDay, err = parseICSTime(value, params, location)
+		case "DTEND":
+			event.End, _, err = parseICSTime(value, params, location)
+		case "DURATION":
+			duration, err = parseICSDuration(value)
+		case "LAST-MODIFIED":
+			event.Updated, _, err = parseICSTime(value, params, location)
+		}
+		if err != nil {
+			return Calendar{}, fmt.Errorf("ics: line %d: %w", i+1, err)
+		}
+	}
+	if len(stack) != 0 {
+		return Calendar{}, fmt.Errorf("ics: %s is not closed", stack[len(stack)-1])
+	}
+	return cal, nil
+}
+
+// parseICSLine splits a content line into its upper-cased name, its
+// parameters and its value.
+func parseICSLine(line string) (string, map[string]string, string, bool) {
+	quoted := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon <= 0 {
+		return "", nil, "", false
+	}
+	parts := strings.Split(line[:colon], ";")
+	params := map[string]string{}
+	for _, param := range parts[1:] {
+		if key, value, ok := strings.Cut(param, "="); ok {
+			params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, line[colon+1:], true
+}
+
+// parseICSTime parses a DATE or DATE-TIME value, reporting whether it
+// was a date.
+func parseICSTime(value string, params map[string]string, location *time.Location) (time.Time, bool, error) {
+	if tzid := params["TZID"]; tzid != "" {
+		if loaded, err := time.LoadLocation(tzid); err == nil {
+			location = loaded
+		}
+	}
+	if params["VALUE"] == "DATE" || len(value) == len(icsDate) {
+		t, err := time.ParseInLocation(icsDate, value, location)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icsDateTime, strings.TrimSuffix(value, "Z"))
+		return t, false, err
+	}
+	t, err := time.ParseInLocation(icsDateTime, value, location)
+	return t, false, err
+}
+
+// ServeICS answers with cal as the calendar file name, with an ETag
+// so polling clients get 304 while it is unchanged.
+func ServeICS(c *gin.Context, name string, cal Calendar) {
+	body := cal.ICS()
+	// DTSTAMP changes on every render, so it is left out of the ETag
+	var stable strings.Builder
+	for _, line := range strings.Split(string(body), "\r\n") {
+		if !strings.HasPrefix(line, "DTSTAMP:") {
+			stable.WriteString(line)
+		}
+	}
+	sum := sha256.Sum256([]byte(stable.String()))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, max-age=300")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Header("Content-Disposition", `inline; filename="`+name+`"`)
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", body)
+}
+
+// CalendarRoute serves a subscribable feed of the events a SurrealDB
+// query returns, its rows binding to CalendarEvent. Calendar apps
+// subscribe without cookies, so private feeds carry a token in the
+// URL, e.g. one signed with Signer, that Vars turns into the query
+// variables. A tz query parameter with an IANA name overrides the
+// location of the calendar.
+//
+// Example:
+//  feed := ghostutils.NewCalendarRoute(db, "/bookings.ics", "Bookings",
+//      "SELECT *, time AS start, time + duration AS end, service.name AS summary FROM booking WHERE owner = $owner")
+//  feed.Calendar.Location, _ = time.LoadLocation("Europe/Berlin")
+//  feed.Vars = func(c *gin.Context) (map[string]interface{}, error) {
+//      var owner string
+//      if err := signer.VerifyToken("calendar-feed", c.Query("token"), &owner); err != nil {
+//          return nil, ghostutils.ErrUnauthenticated
+//      }
+//      return map[string]interface{}{"owner": owner}, nil
+//  }
+//  feed.Route(r)
+type CalendarRoute struct {
+	*BasicRoute
+	// Calendar holds the name, location and refresh of the feed, its
+	// events are the rows of Query.
+	Calendar Calendar
+	Query    string
+	// Vars returns the variables of Query for the request. Its errors
+	// answer through Fail.
+	Vars func(c *gin.Context) (map[string]interface{}, error)
+}
+
+// NewCalendarRoute returns the feed name of the events of query,
+// served on path and refreshed hourly by subscribed clients.
+func NewCalendarRoute(db *surrealdb.DB, routePath, name, query string) *CalendarRoute {
+	route := &CalendarRoute{
+		Calendar: Calendar{Name: name, Refresh: time.Hour},
+		Query:    query,
+	}
+	route.BasicRoute = NewBasicRoute(db, routePath, func(g *gin.RouterGroup, _ GhostRoute) {
+		g.GET("", route.serve)
+	})
+	return route
+}
+
+func (route *CalendarRoute) serve(c *gin.Context) {
+	var vars map[string]interface{}
+	if route.Vars != nil {
+		var err error
+		if vars, err = route.Vars(c); err != nil {
+			Fail(c, err)
+			return
+		}
+	}
+	events, err := surrealQuery[CalendarEvent](route.DB(), route.Query, vars)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	cal := route.Calendar
+	cal.Events = events
+	if tz := c.Query("tz"); tz != "" {
+		if location, err := time.LoadLocation(tz); err == nil {
+			cal.Location = location
+		}
+	}
+	name := strings.Trim(route.Path[strings.LastIndex(route.Path, "/")+1:], "/")
+	if !strings.HasSuffix(name, ".ics") {
+		name = "calendar.ics"
+	}
+	ServeICS(c, name, cal)
+}
@@ -0,0 +1,268 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/surrealdb/surrealdb.go"
+)
+
+var surrealDurationPattern = regexp.MustCompile(`^([0-9]+(ns|us|ms|s|m|h|d|w|y))+$`)
+
+// EnableChangefeed defines table with a SurrealDB CHANGEFEED kept
+// for retention, e.g. "7d". DEFINE TABLE replaces the table
+// definition, so pass the rest of it in clauses when the table is
+// SCHEMAFULL or has permissions.
+//
+// Example:
+//  err := ghostutils.EnableChangefeed(db, "note", "7d", "SCHEMALESS")
+func EnableChangefeed(db *surrealdb.DB, table, retention string, clauses ...string) error {
+	if !identifierPattern.MatchString(table) {
+		return fmt.Errorf("invalid table name %q", table)
+	}
+	if !surrealDurationPattern.MatchString(retention) {
+		return fmt.Errorf("invalid changefeed retention %q", retention)
+	}
+	sql := fmt.Sprintf("DEFINE TABLE %s %s CHANGEFEED %s", table, strings.Join(clauses, " "), retention)
+	_, err := surrealStatements(db, sql, nil)
+	return err
+}
+
+// ChangefeedSyncLog is a SyncLog reading SurrealDB changefeeds, so
+// every write to a table is synced, including those made outside
+// Sync, and nothing is missed while the app is down. Tables must
+// have a changefeed, see EnableChangefeed. Cursors are versionstamps.
+type ChangefeedSyncLog struct {
+	DB *surrealdb.DB
+}
+
+// Append implements SyncLog. The database records changes itself,
+// so the change is returned as is.
+func (l ChangefeedSyncLog) Append(ctx context.Context, change SyncChange) (SyncChange, error) {
+	return change, nil
+}
+
+// Since implements SyncLog. Change sets are read whole, so more than
+// limit changes are returned when the last set is large.
+func (l ChangefeedSyncLog) Since(ctx context.Context, table, cursor string, limit int) ([]SyncChange, error) {
+	changes, _, err := showChanges(l.DB, table, cursor, limit)
+	return changes, err
+}
+
+// ChangedSince implements SyncLog. It reads the feed after cursor up
+// to the first change of the record, so its cost grows with how far
+// behind cursor is, not with the retained feed.
+func (l ChangefeedSyncLog) ChangedSince(ctx context.Context, table, id, cursor string) (bool, error) {
+	for {
+		changes, last, err := showChanges(l.DB, table, cursor, 1000)
+		if err != nil || last == cursor {
+			return false, err
+		}
+		for _, change := range changes {
+			if change.ID == id {
+				return true, nil
+			}
+		}
+		cursor = last
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// versionCursor formats a versionstamp so cursors sort as strings.
+func versionCursor(versionstamp uint64) string {
+	return fmt.Sprintf("%020d", versionstamp)
+}
+
+// showChanges returns at least limit changes of table after cursor,
+// if there are as many, in whole change sets, and the cursor of the
+// last versionstamp read. SHOW CHANGES limits change sets rather than
+// records, so sets are read until limit records are found. A set
+// changing only the schema becomes one SyncSchema change, so cursors
+// move past it.
+func showChanges(db *surrealdb.DB, table, cursor string, limit int) ([]SyncChange, string, error) {
+	if !identifierPattern.MatchString(table) {
+		return nil, cursor, fmt.Errorf("invalid table name %q", table)
+	}
+	if limit <= 0 {
+		limit = 1
+	}
+	var since uint64
+	if cursor != "" {
+		v, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, cursor, fmt.Errorf("invalid changefeed cursor %q", cursor)
+		}
+		// SINCE is inclusive
+		since = v + 1
+	}
+	type changeSet struct {
+		Versionstamp uint64                              `json:"versionstamp"`
+		Changes      []map[string]map[string]interface{} `json:"changes"`
+	}
+	var changes []SyncChange
+	last := cursor
+	for len(changes) < limit {
+		sets, err := surrealQuery[changeSet](db, fmt.Sprintf("SHOW CHANGES FOR TABLE %s SINCE %d LIMIT %d", table, since, limit-len(changes)), nil)
+		if err != nil {
+			return changes, last, err
+		}
+		if len(sets) == 0 {
+			break
+		}
+		for _, set := range sets {
+			last = versionCursor(set.Versionstamp)
+			since = set.Versionstamp + 1
+			records := 0
+			for _, entry := range set.Changes {
+				change := SyncChange{Cursor: last, Table: table}
+				if record, ok := entry["update"]; ok {
+					change.Op, change.Data = SyncUpsert, record
+				} else if record, ok := entry["delete"]; ok {
+					change.Op = SyncDelete
+					change.Data = nil
+					change.ID, _ = record["id"].(string)
+				} else {
+					// schema changes such as define_table
+					continue
+				}
+				if change.ID == "" {
+					change.ID, _ = change.Data["id"].(string)
+				}
+				_, change.ID = splitRecordID(change.ID, table)
+				changes = append(changes, change)
+				records++
+			}
+			if records == 0 {
+				changes = append(changes, SyncChange{Cursor: last, Table: table, Op: SyncSchema})
+			}
+		}
+	}
+	return changes, last, nil
+}
+
+// CursorStore persists how far a changefeed consumer has read.
+type CursorStore interface {
+	LoadCursor(ctx context.Context, name string) (string, error)
+	SaveCursor(ctx context.Context, name, cursor string) error
+}
+
+// SurrealCursorStore keeps cursors in a SurrealDB table,
+// "changefeed_cursor" by default.
+type SurrealCursorStore struct {
+	DB    *surrealdb.DB
+	Table string
+}
+
+func (s SurrealCursorStore) table() string {
+	if s.Table == "" {
+		return "changefeed_cursor"
+	}
+	return s.Table
+}
+
+// LoadCursor implements CursorStore.
+func (s SurrealCursorStore) LoadCursor(ctx context.Context, name string) (string, error) {
+	row, _, err := surrealFirst[struct {
+		Cursor string `json:"cursor"`
+	}](s.DB, "SELECT cursor FROM type::thing($tb, $id)", map[string]interface{}{"tb": s.table(), "id": name})
+	return row.Cursor, err
+}
+
+// SaveCursor implements CursorStore.
+func (s SurrealCursorStore) SaveCursor(ctx context.Context, name, cursor string) error {
+	_, err := s.DB.Update(recordID(s.table(), name), map[string]interface{}{
+		"cursor":     cursor,
+		"updated_at": time.Now().UTC(),
+	})
+	return err
+}
+
+// Changefeed consumes a table's changefeed, persisting its cursor
+// after every change so a restarted consumer replays exactly what it
+// has not handled yet.
+//
+// Example:
+//  feed := &ghostutils.Changefeed{
+//      DB:      db,
+//      Table:   "order",
+//      Name:    "order-mailer",
+//      Cursors: ghostutils.SurrealCursorStore{DB: db},
+//  }
+//  go feed.Run(ctx, time.Second, func(ctx context.Context, change ghostutils.SyncChange) error {
+//      return mailer.OrderChanged(ctx, change)
+//  })
+type Changefeed struct {
+	DB      *surrealdb.DB
+	Table   string
+	Name    string
+	Cursors CursorStore
+	// Batch is the number of changes read at once. Defaults to 100.
+	Batch int
+}
+
+// Poll handles the changes available now and returns how many it
+// moved past, schema changes included. It stops at the first handler error, leaving the cursor
+// before the failed change so it is retried.
+func (f *Changefeed) Poll(ctx context.Context, handle func(ctx context.Context, change SyncChange) error) (int, error) {
+	batch := f.Batch
+	if batch <= 0 {
+		batch = 100
+	}
+	cursor, err := f.Cursors.LoadCursor(ctx, f.Name)
+	if err != nil {
+		return 0, err
+	}
+	changes, _, err := showChanges(f.DB, f.Table, cursor, batch)
+	if err != nil {
+		return 0, err
+	}
+	for i, change := range changes {
+		// schema changes are not handled, only moved past
+		if change.Op != SyncSchema {
+			if err := handle(ctx, change); err != nil {
+				return i, err
+			}
+		}
+		// changes sharing a versionstamp are committed together, the
+		// cursor only moves past a versionstamp once all are handled
+		if i == len(changes)-1 || changes[i+1].Cursor != change.Cursor {
+			if err := f.Cursors.SaveCursor(ctx, f.Name, change.Cursor); err != nil {
+				return i + 1, err
+			}
+		}
+	}
+	return len(changes), nil
+}
+
+// Replay resets the cursor so the next Poll starts from cursor, ""
+// for the start of the retained feed.
+func (f *Changefeed) Replay(ctx context.Context, cursor string) error {
+	return f.Cursors.SaveCursor(ctx, f.Name, cursor)
+}
+
+// Run polls every interval until ctx is done. Errors are retried on
+// the next tick.
+func (f *Changefeed) Run(ctx context.Context, interval time.Duration, handle func(ctx context.Context, change SyncChange) error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// drain what is available before waiting again
+		for {
+			n, err := f.Poll(ctx, handle)
+			if err != nil || n == 0 {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,1010 @@
+package ghostutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClientOptions configure GenerateClient.
+type ClientOptions struct {
+	// Output is the Go file of the client; Package is its package, the
+	// name of its directory by default.
+	Output  string
+	Package string
+	// TypeScript is the TypeScript file of the client, only written
+	// when set.
+	TypeScript string
+	// Name is the name of the client type, Client by default.
+	Name string
+	// Codes are the error codes of the app, such as "order_paid", on
+	// top of those of the package, for the constants of the clients.
+	Codes []string
+}
+
+// clientErrorCodes are the codes the errors of the package answer
+// with, see AsGhostError.
+var clientErrorCodes = []string{
+	"invalid_request", "invalid_body", "invalid_form", "invalid_date", "invalid_filter", "invalid_cursor",
+	"validation_failed", "unauthenticated", "forbidden", "not_found", "conflict", "expired",
+	"rate_limited", "quota_exceeded", "too_large", "unsupported_media_type",
+	"unavailable", "timeout", "internal", "error",
+}
+
+// GenerateClient writes typed clients of the documented operations: a
+// Go package to opts.Output and, with opts.TypeScript set, a module
+// for the frontends. Every operation is a method named by its ID, or
+// by its method and path, like GetAPIPostsByID for GET /api/posts/:id,
+// taking the path parameters, the body and the query and header
+// parameters, and returning the Response. Responses marked Envelope
+// are unwrapped from their data, and the error envelope of Fail, or
+// the {"error": "..."} of CRUDRoute, becomes an APIError with the code
+// of the error, for which the clients have constants.
+//
+// Run it from go generate with a small program that documents the
+// routes of the app, so the clients are built with it.
+//
+// Example:
+//  // client/generate.go
+//  //go:generate go run ../tools/client
+//
+//  // tools/client/main.go
+//  func main() {
+//      api := ghostutils.NewOpenAPI("Blog API", "1.0.0").Add("/api", app.Routes(nil)...)
+//      err := api.GenerateClient(ghostutils.ClientOptions{
+//          Output:     "client/client_gen.go",
+//          TypeScript: "web/src/api/client.ts",
+//          Codes:      []string{"order_paid"},
+//      })
+//      if err != nil {
+//          log.Fatal(err)
+//      }
+//  }
+//
+//  // a consumer
+//  blog := client.NewClient("https://blog.example.com")
+//  post, err := blog.GetAPIPostsByID(ctx, "post:1")
+//  if client.ErrorCode(err) == client.CodeNotFound {
+//
+// Returns:
+//  error if a type of the API takes a name of the client, or a file
+//  is not written
+func (api *OpenAPI) GenerateClient(opts ClientOptions) error {
+	if opts.Output == "" && opts.TypeScript == "" {
+		return fmt.Errorf("client: no output")
+	}
+	if opts.Output != "" {
+		if opts.Package == "" {
+			abs, err := filepath.Abs(filepath.Dir(opts.Output))
+			if err != nil {
+				return err
+			}
+			opts.Package = strings.NewReplacer("-", "_", ".", "_").Replace(filepath.Base(abs))
+		}
+		source, err := api.GoClient(opts)
+		if err != nil {
+			return err
+		}
+		if err := writeGenerated(opts.Output, source); err != nil {
+			return err
+		}
+	}
+	if opts.TypeScript != "" {
+		source, err := api.TypeScriptClient(opts)
+		if err != nil {
+			return err
+		}
+		return writeGenerated(opts.TypeScript, source)
+	}
+	return nil
+}
+
+func writeGenerated(path string, source []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, source, 0o644)
+}
+
+// clientSpec is what the clients are generated from.
+type clientSpec struct {
+	name  string
+	title string
+	ops   []clientOperation
+	// types are the named structs of the bodies, by name.
+	types []reflect.Type
+	codes []string
+}
+
+type clientOperation struct {
+	Operation
+	name   string
+	path   []clientSegment
+	params []clientParam
+}
+
+// clientSegment is a literal part of a path, or a parameter of it.
+type clientSegment struct {
+	literal  string
+	param    string
+	wildcard bool
+}
+
+type clientParam struct {
+	OperationParam
+	field string
+}
+
+// clientField is a field of a struct body, with those of embedded
+// structs flattened as encoding/json does.
+type clientField struct {
+	name     string
+	json     string
+	tag      string
+	typ      reflect.Type
+	optional bool
+}
+
+// clientReserved are the names parameters of the generated methods
+// cannot take, keywords of Go and TypeScript and the locals.
+var clientReserved = map[string]bool{
+	"c": true, "ctx": true, "params": true, "body": true, "query": true, "header": true, "out": true, "err": true, "init": true,
+	"break": true, "case": true, "catch": true, "class": true, "const": true, "continue": true, "default": true, "delete": true,
+	"do": true, "else": true, "enum": true, "export": true, "extends": true, "false": true, "finally": true, "for": true,
+	"function": true, "if": true, "import": true, "in": true, "instanceof": true, "new": true, "null": true, "return": true,
+	"super": true, "switch": true, "this": true, "throw": true, "true": true, "try": true, "typeof": true, "var": true,
+	"void": true, "while": true, "with": true, "yield": true, "let": true, "static": true, "interface": true, "package": true,
+	"private": true, "protected": true, "public": true, "await": true, "url": true,
+}
+
+var clientInitialisms = map[string]bool{"api": true, "id": true, "ids": true, "url": true, "uri": true, "http": true, "json": true, "uuid": true, "ip": true, "html": true, "sql": true}
+
+// exportedName returns s as an exported Go name: user_id is UserID.
+func exportedName(s string) string {
+	var name strings.Builder
+	for _, word := range schemaNamePattern.Split(s, -1) {
+		switch {
+		case word == "":
+		case clientInitialisms[strings.ToLower(word)]:
+			if strings.ToLower(word) == "ids" {
+				name.WriteString("IDs")
+			} else {
+				name.WriteString(strings.ToUpper(word))
+			}
+		default:
+			name.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	if name.Len() == 0 || (name.String()[0] >= '0' && name.String()[0] <= '9') {
+		return "X" + name.String()
+	}
+	return name.String()
+}
+
+// localName returns s as an unexported name: user_id is userID, id is
+// id.
+func localName(s string) string {
+	words := schemaNamePattern.Split(strings.Trim(schemaNamePattern.ReplaceAllString(s, " "), " "), -1)
+	name := words[0]
+	if clientInitialisms[strings.ToLower(name)] || strings.ToUpper(name) == name {
+		name = strings.ToLower(name)
+	} else if name != "" {
+		name = strings.ToLower(name[:1]) + name[1:]
+	}
+	if len(words) > 1 {
+		name += exportedName(strings.Join(words[1:], "_"))
+	}
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "p" + name
+	}
+	if clientReserved[name] || token.IsKeyword(name) {
+		name += "Param"
+	}
+	return name
+}
+
+// clientSpec collects the operations of the document and the types of
+// their bodies.
+func (api *OpenAPI) clientSpec(opts ClientOptions) (*clientSpec, error) {
+	spec := &clientSpec{name: opts.Name, title: strings.TrimSpace(api.Title + " " + api.Version)}
+	if spec.name == "" {
+		spec.name = "Client"
+	}
+	named := map[string]reflect.Type{}
+	seen := map[reflect.Type]bool{}
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if seen[t] || t == timeType || t == rawMessageType {
+			return
+		}
+		seen[t] = true
+		switch t.Kind() {
+		case reflect.Slice, reflect.Array:
+			collect(t.Elem())
+		case reflect.Map:
+			collect(t.Elem())
+		case reflect.Struct:
+			if t.Name() != "" {
+				named[schemaName(t)] = t
+			}
+			for _, field := range clientFields(t) {
+				collect(field.typ)
+			}
+		}
+	}
+	names := map[string]int{}
+	for _, op := range api.operations {
+		name := clientOperationName(op)
+		if names[name]++; names[name] > 1 {
+			name += strconv.Itoa(names[name])
+		}
+		clientOp := clientOperation{Operation: op, name: name}
+		last := 0
+		for _, match := range ginParamPattern.FindAllStringSubmatchIndex(op.Path, -1) {
+			if match[0] > last {
+				clientOp.path = append(clientOp.path, clientSegment{literal: op.Path[last:match[0]]})
+			}
+			clientOp.path = append(clientOp.path, clientSegment{param: op.Path[match[2]:match[3]], wildcard: op.Path[match[0]] == '*'})
+			last = match[1]
+		}
+		if last < len(op.Path) || last == 0 {
+			literal := op.Path[last:]
+			if literal == "" {
+				literal = "/"
+			}
+			clientOp.path = append(clientOp.path, clientSegment{literal: literal})
+		}
+		fields := map[string]int{}
+		for _, param := range op.Params {
+			if param.In == "" {
+				param.In = "query"
+			}
+			field := exportedName(param.Name)
+			if fields[field]++; fields[field] > 1 {
+				field += strconv.Itoa(fields[field])
+			}
+			clientOp.params = append(clientOp.params, clientParam{OperationParam: param, field: field})
+		}
+		if op.Request != nil {
+			collect(reflect.TypeOf(op.Request))
+		}
+		if op.Response != nil {
+			collect(reflect.TypeOf(op.Response))
+		}
+		spec.ops = append(spec.ops, clientOp)
+	}
+	taken := map[string]bool{spec.name: true, "New" + spec.name: true, "APIError": true, "ErrorCode": true}
+	for _, op := range spec.ops {
+		if len(op.params) > 0 {
+			taken[op.name+"Params"] = true
+		}
+	}
+	typeNames := make([]string, 0, len(named))
+	for name := range named {
+		if taken[name] {
+			return nil, fmt.Errorf("client: the type %s of the API takes a name of the client, set ClientOptions.Name", named[name])
+		}
+		typeNames = append(typeNames, name)
+	}
+	sort.Strings(typeNames)
+	for _, name := range typeNames {
+		spec.types = append(spec.types, named[name])
+	}
+	codes := map[string]bool{}
+	for _, code := range append(append([]string{}, clientErrorCodes...), opts.Codes...) {
+		if !codes[code] {
+			codes[code] = true
+			spec.codes = append(spec.codes, code)
+		}
+	}
+	return spec, nil
+}
+
+// clientOperationName returns the method name of op.
+func clientOperationName(op Operation) string {
+	if op.ID != "" {
+		return exportedName(op.ID)
+	}
+	name := exportedName(strings.ToLower(op.Method))
+	for _, segment := range strings.Split(op.Path, "/") {
+		switch {
+		case segment == "":
+		case segment[0] == ':' || segment[0] == '*':
+			name += "By" + exportedName(segment[1:])
+		default:
+			name += exportedName(segment)
+		}
+	}
+	return name
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+func clientFields(t reflect.Type) []clientField {
+	var fields []clientField
+	seen := map[string]bool{}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			options := strings.Split(tag, ",")
+			name := options[0]
+			if field.Anonymous && name == "" {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Ptr {
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct {
+					walk(embedded)
+					continue
+				}
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			if seen[field.Name] {
+				continue
+			}
+			seen[field.Name] = true
+			fields = append(fields, clientField{
+				name:     field.Name,
+				json:     name,
+				tag:      tag,
+				typ:      field.Type,
+				optional: containsString(options[1:], "omitempty") || field.Type.Kind() == reflect.Ptr,
+			})
+		}
+	}
+	walk(t)
+	return fields
+}
+
+// GoClient returns the source of the Go client of GenerateClient.
+func (api *OpenAPI) GoClient(opts ClientOptions) ([]byte, error) {
+	spec, err := api.clientSpec(opts)
+	if err != nil {
+		return nil, err
+	}
+	pkg := opts.Package
+	if pkg == "" {
+		pkg = "client"
+	}
+	g := &goClientWriter{}
+	var types bytes.Buffer
+	for _, t := range spec.types {
+		fmt.Fprintf(&types, "// %s mirrors %s.\n", schemaName(t), t)
+		fmt.Fprintf(&types, "type %s %s\n\n", schemaName(t), g.structType(t))
+	}
+	var methods bytes.Buffer
+	for _, op := range spec.ops {
+		g.operation(&methods, spec, op)
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by ghostutils.GenerateClient from %s; DO NOT EDIT.\n\n", spec.title)
+	fmt.Fprintf(&out, "// Package %s is a client of %s.\n", pkg, spec.title)
+	fmt.Fprintf(&out, "package %s\n\n", pkg)
+	imports := []string{"bytes", "context", "encoding/json", "errors", "io", "net/http", "net/url", "strconv", "strings"}
+	if g.time {
+		imports = append(imports, "time")
+	}
+	out.WriteString("import (\n")
+	for _, path := range imports {
+		fmt.Fprintf(&out, "%q\n", path)
+	}
+	out.WriteString(")\n\n")
+	g.runtime(&out, api, spec)
+	out.Write(types.Bytes())
+	out.Write(methods.Bytes())
+	source, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	return source, nil
+}
+
+type goClientWriter struct {
+	// time is set once a type uses time.Time.
+	time bool
+}
+
+// typ returns the Go type of t.
+func (g *goClientWriter) typ(t reflect.Type) string {
+	switch {
+	case t == timeType:
+		g.time = true
+		return "time.Time"
+	case t == rawMessageType:
+		return "json.RawMessage"
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		return schemaName(t)
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + g.typ(t.Elem())
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return t.Kind().String()
+	case reflect.Slice:
+		return "[]" + g.typ(t.Elem())
+	case reflect.Array:
+		return "[" + strconv.Itoa(t.Len()) + "]" + g.typ(t.Elem())
+	case reflect.Map:
+		return "map[" + g.typ(t.Key()) + "]" + g.typ(t.Elem())
+	case reflect.Struct:
+		return g.structType(t)
+	}
+	return "interface{}"
+}
+
+func (g *goClientWriter) structType(t reflect.Type) string {
+	var out strings.Builder
+	out.WriteString("struct {\n")
+	for _, field := range clientFields(t) {
+		out.WriteString(field.name + " " + g.typ(field.typ))
+		if field.tag != "" {
+			out.WriteString(" `json:" + strconv.Quote(field.tag) + "`")
+		}
+		out.WriteString("\n")
+	}
+	out.WriteString("}")
+	return out.String()
+}
+
+// operation writes the method of op, and the type of its parameters.
+func (g *goClientWriter) operation(out *bytes.Buffer, spec *clientSpec, op clientOperation) {
+	paramsType := op.name + "Params"
+	if len(op.params) > 0 {
+		fmt.Fprintf(out, "// %s are the parameters of %s.\n", paramsType, op.name)
+		fmt.Fprintf(out, "type %s struct {\n", paramsType)
+		for _, param := range op.params {
+			if param.Description != "" {
+				fmt.Fprintf(out, "// %s\n", param.Description)
+			}
+			fmt.Fprintf(out, "%s %s\n", param.field, goParamType(param.Type))
+		}
+		out.WriteString("}\n\n")
+	}
+	fmt.Fprintf(out, "// %s calls %s %s", op.name, op.Method, op.Path)
+	if op.Summary != "" {
+		fmt.Fprintf(out, ": %s", op.Summary)
+	}
+	out.WriteString(".\n")
+	if op.Deprecated {
+		out.WriteString("//\n// Deprecated: the operation is deprecated.\n")
+	}
+	args := []string{"ctx context.Context"}
+	var path []string
+	for _, segment := range op.path {
+		switch {
+		case segment.param == "":
+			path = append(path, strconv.Quote(segment.literal))
+		case segment.wildcard:
+			args = append(args, localName(segment.param)+" string")
+			path = append(path, localName(segment.param))
+		default:
+			args = append(args, localName(segment.param)+" string")
+			path = append(path, "url.PathEscape("+localName(segment.param)+")")
+		}
+	}
+	body := "nil"
+	if op.Request != nil {
+		args = append(args, "body "+g.typ(reflect.TypeOf(op.Request)))
+		body = "body"
+	}
+	if len(op.params) > 0 {
+		args = append(args, "params *"+paramsType)
+	}
+	result, response := "error", ""
+	if op.Response != nil {
+		response = g.typ(reflect.TypeOf(op.Response))
+		result = "(" + response + ", error)"
+	}
+	fmt.Fprintf(out, "func (c *%s) %s(%s) %s {\n", spec.name, op.name, strings.Join(args, ", "), result)
+	query := "nil, nil"
+	if len(op.params) > 0 {
+		query = "query, header"
+		out.WriteString("query, header := url.Values{}, http.Header{}\n")
+		out.WriteString("if params != nil {\n")
+		for _, param := range op.params {
+			set := "query.Set"
+			if param.In == "header" {
+				set = "header.Set"
+			}
+			value, zero := goParamFormat("params."+param.field, param.Type)
+			if !param.Required {
+				fmt.Fprintf(out, "if %s {\n", zero)
+			}
+			fmt.Fprintf(out, "%s(%q, %s)\n", set, param.Name, value)
+			if !param.Required {
+				out.WriteString("}\n")
+			}
+		}
+		out.WriteString("}\n")
+	}
+	call := fmt.Sprintf("c.do(ctx, %q, %s, %s, %s", op.Method, strings.Join(path, "+"), query, body)
+	if op.Response == nil {
+		fmt.Fprintf(out, "return %s, nil, false)\n}\n\n", call)
+		return
+	}
+	fmt.Fprintf(out, "var out %s\n", response)
+	fmt.Fprintf(out, "err := %s, &out, %t)\n", call, op.Envelope)
+	out.WriteString("return out, err\n}\n\n")
+}
+
+func goParamType(typ string) string {
+	switch typ {
+	case "integer":
+		return "int"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	}
+	return "string"
+}
+
+// goParamFormat returns the expression formatting the parameter v and
+// the condition of it being set.
+func goParamFormat(v, typ string) (string, string) {
+	switch typ {
+	case "integer":
+		return "strconv.Itoa(" + v + ")", v + " != 0"
+	case "number":
+		return "strconv.FormatFloat(" + v + ", 'f', -1, 64)", v + " != 0"
+	case "boolean":
+		return "strconv.FormatBool(" + v + ")", v
+	}
+	return v, v + ` != ""`
+}
+
+// statusCodes are the codes of errors only known by their status, see
+// codeForStatus.
+func statusCodes() [][2]string {
+	var codes [][2]string
+	for status := 400; status < 500; status++ {
+		if code := codeForStatus(status); code != "error" {
+			codes = append(codes, [2]string{strconv.Itoa(status), code})
+		}
+	}
+	return codes
+}
+
+// runtime writes the client type, the errors and the requests.
+func (g *goClientWriter) runtime(out *bytes.Buffer, api *OpenAPI, spec *clientSpec) {
+	fmt.Fprintf(out, "// %s calls %s.\n", spec.name, spec.title)
+	fmt.Fprintf(out, "type %s struct {\n", spec.name)
+	out.WriteString("// BaseURL is the URL the paths are relative to, e.g. https://api.example.com.\nBaseURL string\n")
+	out.WriteString("// HTTPClient sends the requests, http.DefaultClient when nil.\nHTTPClient *http.Client\n")
+	if api.Bearer {
+		out.WriteString("// Token is sent as a bearer token when set.\nToken string\n")
+	}
+	if api.APIKeyHeader != "" {
+		fmt.Fprintf(out, "// APIKey is sent in the %s header when set.\nAPIKey string\n", api.APIKeyHeader)
+	}
+	out.WriteString("}\n\n")
+	fmt.Fprintf(out, "// New%[1]s returns a %[1]s of the API at baseURL.\n", spec.name)
+	fmt.Fprintf(out, "func New%[1]s(baseURL string) *%[1]s {\nreturn &%[1]s{BaseURL: baseURL}\n}\n\n", spec.name)
+
+	out.WriteString("// The codes of the APIErrors of the API.\nconst (\n")
+	for _, code := range spec.codes {
+		fmt.Fprintf(out, "Code%s = %q\n", exportedName(code), code)
+	}
+	out.WriteString(")\n\n")
+	out.WriteString(`// APIError is an error answered by the API, from the error of its
+// envelope.
+type APIError struct {
+	Status  int             ` + "`json:\"-\"`" + `
+	Code    string          ` + "`json:\"code\"`" + `
+	Message string          ` + "`json:\"message\"`" + `
+	Details json.RawMessage ` + "`json:\"details,omitempty\"`" + `
+}
+
+func (e *APIError) Error() string {
+	return strconv.Itoa(e.Status) + " " + e.Code + ": " + e.Message
+}
+
+// ErrorCode returns the code of the APIError err is or wraps, "" for
+// other errors.
+func ErrorCode(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+type envelope struct {
+	Data  json.RawMessage ` + "`json:\"data\"`" + `
+	Error json.RawMessage ` + "`json:\"error\"`" + `
+}
+
+// decodeError returns the APIError of a response.
+func decodeError(status int, data []byte) error {
+	apiErr := &APIError{}
+	var env envelope
+	if json.Unmarshal(data, &env) == nil && len(env.Error) > 0 {
+		if json.Unmarshal(env.Error, apiErr) != nil {
+			// {"error": "message"}
+			json.Unmarshal(env.Error, &apiErr.Message)
+		}
+	}
+	apiErr.Status = status
+	if apiErr.Code == "" {
+		apiErr.Code = codeForStatus(status)
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(status)
+	}
+	return apiErr
+}
+
+// codeForStatus returns the code of errors only known by status.
+func codeForStatus(status int) string {
+	switch status {
+`)
+	for _, code := range statusCodes() {
+		fmt.Fprintf(out, "case %s:\nreturn %q\n", code[0], code[1])
+	}
+	out.WriteString(`}
+	if status >= 500 {
+		return "internal"
+	}
+	return "error"
+}
+
+`)
+	fmt.Fprintf(out, `// do sends a request and decodes its response into out, from the data
+// of the envelope when enveloped is set.
+func (c *%s) do(ctx context.Context, method, path string, query url.Values, header http.Header, body, out interface{}, enveloped bool) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	target := strings.TrimRight(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+`, spec.name)
+	if api.Bearer {
+		out.WriteString("if c.Token != \"\" {\nreq.Header.Set(\"Authorization\", \"Bearer \"+c.Token)\n}\n")
+	}
+	if api.APIKeyHeader != "" {
+		fmt.Fprintf(out, "if c.APIKey != \"\" {\nreq.Header.Set(%q, c.APIKey)\n}\n", api.APIKeyHeader)
+	}
+	out.WriteString(`	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return decodeError(resp.StatusCode, data)
+	}
+	if out == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if enveloped {
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return err
+		}
+		data = env.Data
+	}
+	return json.Unmarshal(data, out)
+}
+
+`)
+}
+
+// TypeScriptClient returns the source of the TypeScript client of
+// GenerateClient, a module using fetch.
+func (api *OpenAPI) TypeScriptClient(opts ClientOptions) ([]byte, error) {
+	spec, err := api.clientSpec(opts)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by ghostutils.GenerateClient from %s; DO NOT EDIT.\n\n", spec.title)
+	out.WriteString("/** The codes of the APIErrors of the API. */\nexport type ErrorCode =")
+	for _, code := range spec.codes {
+		fmt.Fprintf(&out, "\n  | %q", code)
+	}
+	out.WriteString("\n  | (string & {});\n\n")
+	for _, t := range spec.types {
+		fmt.Fprintf(&out, "/** %s mirrors %s. */\nexport interface %s %s\n\n", schemaName(t), t, schemaName(t), tsStructType(t, ""))
+	}
+	out.WriteString(`/** APIError is an error answered by the API, from the error of its envelope. */
+export class APIError extends Error {
+  constructor(
+    public status: number,
+    public code: ErrorCode,
+    message: string,
+    public details?: unknown,
+  ) {
+    super(message);
+    this.name = "APIError";
+  }
+
+  static from(status: number, body: unknown): APIError {
+    const error = (body as { error?: unknown } | undefined)?.error;
+    if (error && typeof error === "object") {
+      const e = error as { code?: string; message?: string; details?: unknown };
+      return new APIError(status, e.code || codeForStatus(status), e.message || "HTTP " + status, e.details);
+    }
+    return new APIError(status, codeForStatus(status), typeof error === "string" ? error : "HTTP " + status);
+  }
+}
+
+/** codeForStatus returns the code of errors only known by status. */
+function codeForStatus(status: number): ErrorCode {
+  switch (status) {
+`)
+	for _, code := range statusCodes() {
+		fmt.Fprintf(&out, "    case %s:\n      return %q;\n", code[0], code[1])
+	}
+	out.WriteString(`  }
+  return status >= 500 ? "internal" : "error";
+}
+
+export interface ClientOptions {
+`)
+	if api.Bearer {
+		out.WriteString("  /** token is sent as a bearer token when set. */\n  token?: string;\n")
+	}
+	if api.APIKeyHeader != "" {
+		fmt.Fprintf(&out, "  /** apiKey is sent in the %s header when set. */\n  apiKey?: string;\n", api.APIKeyHeader)
+	}
+	out.WriteString(`  /** headers are sent with every request. */
+  headers?: Record<string, string>;
+  /** fetch sends the requests, the global fetch by default. */
+  fetch?: typeof fetch;
+}
+
+interface RequestOptions {
+  params?: object;
+  /** headers are the names of params sent as headers. */
+  headers?: string[];
+  body?: unknown;
+  enveloped?: boolean;
+  init?: RequestInit;
+}
+
+`)
+	for _, op := range spec.ops {
+		if len(op.params) == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, "export interface %sParams {\n", op.name)
+		for _, param := range op.params {
+			if param.Description != "" {
+				fmt.Fprintf(&out, "  /** %s */\n", param.Description)
+			}
+			optional := "?"
+			if param.Required {
+				optional = ""
+			}
+			fmt.Fprintf(&out, "  %s%s: %s;\n", tsProperty(param.Name), optional, tsParamType(param.Type))
+		}
+		out.WriteString("}\n\n")
+	}
+	fmt.Fprintf(&out, "/** %s calls %s. */\nexport class %s {\n", spec.name, spec.title, spec.name)
+	out.WriteString(`  constructor(
+    public baseURL: string,
+    public options: ClientOptions = {},
+  ) {}
+`)
+	for _, op := range spec.ops {
+		tsOperation(&out, op)
+	}
+	out.WriteString(`
+  protected async request<T>(method: string, path: string, options: RequestOptions = {}): Promise<T> {
+    const headers: Record<string, string> = { Accept: "application/json", ...this.options.headers };
+    const query = new URLSearchParams();
+    for (const [name, value] of Object.entries(options.params ?? {})) {
+      if (value === undefined || value === null) continue;
+      if (options.headers?.includes(name)) headers[name] = String(value);
+      else query.set(name, String(value));
+    }
+`)
+	if api.Bearer {
+		out.WriteString("    if (this.options.token) headers.Authorization = \"Bearer \" + this.options.token;\n")
+	}
+	if api.APIKeyHeader != "" {
+		fmt.Fprintf(&out, "    if (this.options.apiKey) headers[%q] = this.options.apiKey;\n", api.APIKeyHeader)
+	}
+	out.WriteString(`    let body: string | undefined;
+    if (options.body !== undefined) {
+      body = JSON.stringify(options.body);
+      headers["Content-Type"] = "application/json";
+    }
+    let url = this.baseURL.replace(/\/+$/, "") + path;
+    if (query.toString()) url += "?" + query.toString();
+    const response = await (this.options.fetch ?? fetch)(url, { ...options.init, method, headers, body });
+    const text = await response.text();
+    let data: unknown;
+    try {
+      data = text ? JSON.parse(text) : undefined;
+    } catch {
+      data = undefined;
+    }
+    if (!response.ok) throw APIError.from(response.status, data);
+    return (options.enveloped ? (data as { data?: unknown } | undefined)?.data : data) as T;
+  }
+}
+`)
+	return out.Bytes(), nil
+}
+
+func tsOperation(out *bytes.Buffer, op clientOperation) {
+	out.WriteString("\n  /**\n")
+	fmt.Fprintf(out, "   * %s %s", op.Method, op.Path)
+	if op.Summary != "" {
+		fmt.Fprintf(out, ": %s", op.Summary)
+	}
+	out.WriteString("\n")
+	if op.Deprecated {
+		out.WriteString("   * @deprecated\n")
+	}
+	out.WriteString("   */\n")
+	var args []string
+	var path strings.Builder
+	for _, segment := range op.path {
+		switch {
+		case segment.param == "":
+			path.WriteString(strings.NewReplacer("`", "\\`", "${", "\\${").Replace(segment.literal))
+		case segment.wildcard:
+			args = append(args, localName(segment.param)+": string")
+			path.WriteString("${" + localName(segment.param) + "}")
+		default:
+			args = append(args, localName(segment.param)+": string")
+			path.WriteString("${encodeURIComponent(" + localName(segment.param) + ")}")
+		}
+	}
+	var options []string
+	if op.Request != nil {
+		args = append(args, "body: "+tsType(reflect.TypeOf(op.Request), "  "))
+		options = append(options, "body")
+	}
+	if len(op.params) > 0 {
+		args = append(args, "params?: "+op.name+"Params")
+		options = append(options, "params")
+		var headers []string
+		for _, param := range op.params {
+			if param.In == "header" {
+				headers = append(headers, strconv.Quote(param.Name))
+			}
+		}
+		if len(headers) > 0 {
+			options = append(options, "headers: ["+strings.Join(headers, ", ")+"]")
+		}
+	}
+	if op.Envelope {
+		options = append(options, "enveloped: true")
+	}
+	args = append(args, "init?: RequestInit")
+	options = append(options, "init")
+	response := "void"
+	if op.Response != nil {
+		response = tsType(reflect.TypeOf(op.Response), "  ")
+	}
+	name := strings.ToLower(op.name[:1]) + op.name[1:]
+	fmt.Fprintf(out, "  %s(%s): Promise<%s> {\n", name, strings.Join(args, ", "), response)
+	fmt.Fprintf(out, "    return this.request<%s>(%q, `%s`, { %s });\n  }\n", response, op.Method, path.String(), strings.Join(options, ", "))
+}
+
+// tsType returns the TypeScript type of t, indented by indent when it
+// spans lines.
+func tsType(t reflect.Type, indent string) string {
+	switch {
+	case t == timeType:
+		return "string"
+	case t == rawMessageType:
+		return "unknown"
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		return schemaName(t)
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return tsType(t.Elem(), indent) + " | null"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string"
+		}
+		elem := tsType(t.Elem(), indent)
+		if strings.Contains(elem, "|") {
+			elem = "(" + elem + ")"
+		}
+		return elem + "[]"
+	case reflect.Map:
+		return "Record<string, " + tsType(t.Elem(), indent) + ">"
+	case reflect.Struct:
+		return tsStructType(t, indent)
+	}
+	return "unknown"
+}
+
+func tsStructType(t reflect.Type, indent string) string {
+	var out strings.Builder
+	out.WriteString("{\n")
+	for _, field := range clientFields(t) {
+		optional := ""
+		if field.optional {
+			optional = "?"
+		}
+		fmt.Fprintf(&out, "%s  %s%s: %s;\n", indent, tsProperty(field.json), optional, tsType(field.typ, indent+"  "))
+	}
+	out.WriteString(indent + "}")
+	return out.String()
+}
+
+var tsIdentifierPattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// tsProperty returns name as a property key, quoted unless it is an
+// identifier.
+func tsProperty(name string) string {
+	if tsIdentifierPattern.MatchString(name) {
+		return name
+	}
+	return strconv.Quote(name)
+}
+
+func tsParamType(typ string) string {
+	switch typ {
+	case "integer", "number":
+		return "number"
+	case "boolean":
+		return "boolean"
+	}
+	return "string"
+}
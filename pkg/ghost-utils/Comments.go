@@ -0,0 +1,758 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Comment moderation states.
+const (
+	CommentPending   = "pending"
+	CommentPublished = "published"
+	CommentHidden    = "hidden"
+	CommentDeleted   = "deleted"
+)
+
+// Defaults of Comments.
+const (
+	DefaultCommentTable     = "comment"
+	DefaultCommentMaxDepth  = 4
+	DefaultCommentMaxLength = 5000
+)
+
+// Comment errors, answered 404 and 422 by Fail.
+var (
+	ErrCommentNotFound = errors.New("comment not found")
+	ErrCommentInvalid  = errors.New("invalid comment")
+)
+
+// CommentSchema defines the tables and edges used by Comments with
+// the default table. Run it once, or ship it as a migration. Every
+// comment is related to its subject by a comment_on edge, to the
+// comment it answers by a reply_to edge and to the users it mentions
+// by mentions edges, for graph queries such as
+//  SELECT <-comment_on<-comment FROM post:42
+//  SELECT <-mentions<-comment FROM user:tobie
+const CommentSchema = `
+DEFINE TABLE comment SCHEMALESS;
+DEFINE FIELD subject ON comment TYPE string;
+DEFINE FIELD author ON comment TYPE string;
+DEFINE FIELD state ON comment TYPE string ASSERT $value INSIDE ["pending", "published", "hidden", "deleted"];
+DEFINE FIELD created_at ON comment TYPE datetime;
+DEFINE INDEX comment_subject ON comment FIELDS subject, created_at;
+DEFINE INDEX comment_state ON comment FIELDS state, created_at;
+DEFINE TABLE comment_on SCHEMALESS;
+DEFINE TABLE reply_to SCHEMALESS;
+DEFINE TABLE mentions SCHEMALESS;
+`
+
+// mentionPattern matches @handles that are not part of an address.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])@([A-Za-z0-9_][A-Za-z0-9_.-]{0,38}[A-Za-z0-9_]|[A-Za-z0-9_])`)
+
+// Comment is a comment on a record, or a reply to another comment on
+// it.
+type Comment struct {
+	ID      string `json:"id,omitempty"`
+	Subject string `json:"subject"`
+	Parent  string `json:"parent,omitempty"`
+	Author  string `json:"author"`
+	Body    string `json:"body"`
+	State   string `json:"state"`
+	// Mentions are the users mentioned with @handle, resolved by
+	// ResolveMentions.
+	Mentions  []string   `json:"mentions,omitempty"`
+	Depth     int        `json:"depth"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+}
+
+// CommentNode is a comment with its replies, in the order they were
+// written.
+type CommentNode struct {
+	Comment
+	Replies []*CommentNode `json:"replies,omitempty"`
+}
+
+// Comments stores threads of comments on records of any table and
+// serves them as JSON or, to htmx, as HTML partials.
+//
+// Example:
+//  comments := &ghostutils.Comments{
+//      DB:         db,
+//      BasePath:   "/comments",
+//      Moderation: ghostutils.CommentPending,
+//      Limiter:    limiter.Named("comments"),
+//      Moderator: func(c *gin.Context) bool {
+//          identity, _ := ghostutils.CurrentIdentity(c)
+//          return identity.HasRole("moderator")
+//      },
+//  }
+//  comments.Mount(r.Group("/comments"))
+//
+//  // post.html
+//  <div hx-get="/comments/on/{{.Post.ID}}" hx-trigger="load"></div>
+type Comments struct {
+	DB *surrealdb.DB
+	// Table is DefaultCommentTable by default.
+	Table string
+	// BasePath is where Mount was called, used for the URLs of the
+	// partials.
+	BasePath string
+	// Subjects are the tables that may be commented on, any when empty.
+	Subjects []string
+	// Moderation is the state of new comments: CommentPublished, the
+	// default, or CommentPending for comments approved by moderators.
+	Moderation string
+	// MaxDepth bounds the nesting of replies, DefaultCommentMaxDepth
+	// by default; deeper replies answer the parent of their parent.
+	MaxDepth int
+	// MaxLength bounds the body, DefaultCommentMaxLength by default.
+	MaxLength int
+	// Limiter limits posting, e.g. limiter.Named("comments").
+	Limiter *RateLimiter
+	// Authorize tells whether the caller may read, or write when write
+	// is set, the comments of subject. Its errors answer through Fail.
+	Authorize func(c *gin.Context, subject string, write bool) error
+	// Moderator tells whether the caller moderates comments.
+	Moderator func(c *gin.Context) bool
+	// ResolveMentions returns the user ids of handles, skipping the
+	// unknown ones. Without it @handles are not linked.
+	ResolveMentions func(ctx context.Context, handles []string) ([]string, error)
+	// OnMention is called for every user mentioned by a new comment,
+	// e.g. to notify them.
+	OnMention func(ctx context.Context, comment Comment, user string)
+	// ThreadTemplate and CommentTemplate replace the partials rendered
+	// for htmx, with the data of CommentView.
+	ThreadTemplate  string
+	CommentTemplate string
+}
+
+// EnsureSchema runs CommentSchema against the database.
+func (cm *Comments) EnsureSchema() error {
+	schema := CommentSchema
+	if table := cm.table(); table != DefaultCommentTable {
+		schema = strings.ReplaceAll(schema, "ON comment ", "ON "+table+" ")
+		schema = strings.ReplaceAll(schema, "TABLE comment ", "TABLE "+table+" ")
+	}
+	_, err := cm.DB.Query(schema, map[string]interface{}{})
+	return err
+}
+
+func (cm *Comments) table() string {
+	if cm.Table == "" {
+		return DefaultCommentTable
+	}
+	return cm.Table
+}
+
+func (cm *Comments) maxDepth() int {
+	if cm.MaxDepth <= 0 {
+		return DefaultCommentMaxDepth
+	}
+	return cm.MaxDepth
+}
+
+func (cm *Comments) maxLength() int {
+	if cm.MaxLength <= 0 {
+		return DefaultCommentMaxLength
+	}
+	return cm.MaxLength
+}
+
+// checkSubject accepts record ids of the Subjects tables.
+func (cm *Comments) checkSubject(subject string) error {
+	table, id := splitRecordID(subject, "")
+	if table == "" || id == "" || !identifierPattern.MatchString(table) || strings.Contains(table, ".") {
+		return ErrCommentInvalid
+	}
+	if len(cm.Subjects) == 0 {
+		return nil
+	}
+	for _, allowed := range cm.Subjects {
+		if allowed == table {
+			return nil
+		}
+	}
+	return ErrCommentInvalid
+}
+
+// Mentions returns the @handles of body, once each.
+func Mentions(body string) []string {
+	var handles []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		handle := strings.ToLower(match[1])
+		if !seen[handle] {
+			seen[handle] = true
+			handles = append(handles, handle)
+		}
+	}
+	return handles
+}
+
+// Post stores a comment of author on subject, a record id, answering
+// the comment parent unless it is empty.
+//
+// Returns:
+//  Comment as stored
+//  error, ErrCommentInvalid for an empty or long body or a subject
+//  that may not be commented on, ErrCommentNotFound for a parent of
+//  another subject
+func (cm *Comments) Post(ctx context.Context, subject, parent, author, body string) (Comment, error) {
+	body = strings.TrimSpace(body)
+	if body == "" || len([]rune(body)) > cm.maxLength() {
+		return Comment{}, ErrCommentInvalid
+	}
+	if err := cm.checkSubject(subject); err != nil {
+		return Comment{}, err
+	}
+	comment := Comment{Subject: subject, Author: author, Body: body, State: CommentPublished}
+	if cm.Moderation == CommentPending {
+		comment.State = CommentPending
+	}
+	if parent != "" {
+		answered, err := cm.Get(ctx, parent)
+		if err != nil {
+			return Comment{}, err
+		}
+		if answered.Subject != subject {
+			return Comment{}, ErrCommentNotFound
+		}
+		comment.Parent, comment.Depth = answered.ID, answered.Depth+1
+		if comment.Depth > cm.maxDepth() && answered.Parent != "" {
+			comment.Parent, comment.Depth = answered.Parent, answered.Depth
+		}
+	}
+	if handles := Mentions(body); len(handles) > 0 && cm.ResolveMentions != nil {
+		users, err := cm.ResolveMentions(ctx, handles)
+		if err != nil {
+			return Comment{}, err
+		}
+		comment.Mentions = users
+	}
+	stored, err := cm.create(comment)
+	if err != nil {
+		return stored, err
+	}
+	if err := cm.relate(stored); err != nil {
+		return stored, err
+	}
+	if cm.OnMention != nil {
+		for _, user := range stored.Mentions {
+			cm.OnMention(ctx, stored, user)
+		}
+	}
+	return stored, nil
+}
+
+// create stores comment, with the creation time of the database.
+func (cm *Comments) create(comment Comment) (Comment, error) {
+	sets := []string{"subject = $subject", "author = $author", "body = $body", "state = $state", "depth = $depth", "created_at = time::now()"}
+	vars := map[string]interface{}{
+		"tb":      cm.table(),
+		"subject": comment.Subject,
+		"author":  comment.Author,
+		"body":    comment.Body,
+		"state":   comment.State,
+		"depth":   comment.Depth,
+	}
+	if comment.Parent != "" {
+		sets = append(sets, "parent = $parent")
+		vars["parent"] = comment.Parent
+	}
+	if len(comment.Mentions) > 0 {
+		sets = append(sets, "mentions = $mentions")
+		vars["mentions"] = comment.Mentions
+	}
+	stored, _, err := surrealFirst[Comment](cm.DB, "CREATE type::table($tb) SET "+strings.Join(sets, ", "), vars)
+	return stored, err
+}
+
+// relate adds the edges of comment to its subject, parent and the
+// users it mentions.
+func (cm *Comments) relate(comment Comment) error {
+	commentTable, commentID := splitRecordID(comment.ID, "")
+	subjectTable, subjectID := splitRecordID(comment.Subject, "")
+	sql := []string{
+		"LET $comment = type::thing($comment_tb, $comment_id)",
+		"RELATE $comment->comment_on->(type::thing($subject_tb, $subject_id))",
+	}
+	vars := map[string]interface{}{
+		"comment_tb": commentTable,
+		"comment_id": commentID,
+		"subject_tb": subjectTable,
+		"subject_id": subjectID,
+	}
+	if comment.Parent != "" {
+		parentTable, parentID := splitRecordID(comment.Parent, "")
+		sql = append(sql, "RELATE $comment->reply_to->(type::thing($parent_tb, $parent_id))")
+		vars["parent_tb"], vars["parent_id"] = parentTable, parentID
+	}
+	for i, user := range comment.Mentions {
+		userTable, userID := splitRecordID(user, "")
+		if userID == user {
+			// not a record id
+			continue
+		}
+		sql = append(sql, fmt.Sprintf("RELATE $comment->mentions->(type::thing($user_tb%d, $user_id%d))", i, i))
+		vars[fmt.Sprintf("user_tb%d", i)], vars[fmt.Sprintf("user_id%d", i)] = userTable, userID
+	}
+	statements, err := surrealStatements(cm.DB, strings.Join(sql, ";\n"), vars)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return fmt.Errorf("comments: relating %s: %s", comment.ID, statement.Status)
+		}
+	}
+	return nil
+}
+
+// Get returns the comment with id, or ErrCommentNotFound.
+func (cm *Comments) Get(ctx context.Context, id string) (Comment, error) {
+	table, key := splitRecordID(id, "")
+	if table == "" {
+		table = cm.table()
+	}
+	if table != cm.table() || key == "" {
+		return Comment{}, ErrCommentNotFound
+	}
+	comment, ok, err := surrealFirst[Comment](cm.DB, "SELECT * FROM type::thing($tb, $id)", map[string]interface{}{
+		"tb": table,
+		"id": key,
+	})
+	if err == nil && !ok {
+		err = ErrCommentNotFound
+	}
+	return comment, err
+}
+
+// Thread returns the comments on subject as trees, the oldest first.
+// Pending comments are shown to their author and moderators, hidden
+// ones to moderators only, and deleted ones as placeholders while
+// they have replies.
+func (cm *Comments) Thread(ctx context.Context, subject, viewer string, moderator bool) ([]*CommentNode, error) {
+	comments, err := surrealQuery[Comment](cm.DB, "SELECT * FROM type::table($tb) WHERE subject = $subject ORDER BY created_at", map[string]interface{}{
+		"tb":      cm.table(),
+		"subject": subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]*CommentNode, len(comments))
+	var order []*CommentNode
+	for _, comment := range comments {
+		node := &CommentNode{Comment: comment}
+		nodes[comment.ID] = node
+		order = append(order, node)
+	}
+	var roots []*CommentNode
+	for _, node := range order {
+		if parent, ok := nodes[node.Parent]; ok {
+			parent.Replies = append(parent.Replies, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return visibleComments(roots, viewer, moderator), nil
+}
+
+// visibleComments drops the comments the viewer may not see.
+func visibleComments(nodes []*CommentNode, viewer string, moderator bool) []*CommentNode {
+	visible := nodes[:0]
+	for _, node := range nodes {
+		node.Replies = visibleComments(node.Replies, viewer, moderator)
+		switch node.State {
+		case CommentPending:
+			if !moderator && node.Author != viewer {
+				continue
+			}
+		case CommentHidden:
+			if !moderator {
+				continue
+			}
+		case CommentDeleted:
+			if len(node.Replies) == 0 {
+				continue
+			}
+			node.Body, node.Mentions = "", nil
+		}
+		visible = append(visible, node)
+	}
+	return visible
+}
+
+// Count returns the number of published comments on subject.
+func (cm *Comments) Count(ctx context.Context, subject string) (int, error) {
+	row, _, err := surrealFirst[struct {
+		Total int `json:"total"`
+	}](cm.DB, "SELECT count() AS total FROM type::table($tb) WHERE subject = $subject AND state = $state GROUP ALL", map[string]interface{}{
+		"tb":      cm.table(),
+		"subject": subject,
+		"state":   CommentPublished,
+	})
+	return row.Total, err
+}
+
+// Edit replaces the body of the comment with id, written by author.
+//
+// Returns:
+//  Comment as stored
+//  error, ErrForbidden for the comment of another author
+func (cm *Comments) Edit(ctx context.Context, id, author, body string) (Comment, error) {
+	body = strings.TrimSpace(body)
+	if body == "" || len([]rune(body)) > cm.maxLength() {
+		return Comment{}, ErrCommentInvalid
+	}
+	comment, err := cm.Get(ctx, id)
+	if err != nil {
+		return comment, err
+	}
+	if comment.Author != author || comment.State == CommentDeleted {
+		return comment, ErrForbidden
+	}
+	return cm.change(comment, map[string]interface{}{"body": body}, "edited_at = time::now()")
+}
+
+// Delete marks the comment with id deleted, keeping it as the
+// placeholder of its replies. Only its author and moderators may.
+func (cm *Comments) Delete(ctx context.Context, id, by string, moderator bool) (Comment, error) {
+	comment, err := cm.Get(ctx, id)
+	if err != nil {
+		return comment, err
+	}
+	if comment.Author != by && !moderator {
+		return comment, ErrForbidden
+	}
+	return cm.change(comment, map[string]interface{}{"state": CommentDeleted, "body": "", "mentions": []string{}})
+}
+
+// Moderate sets the state of the comment with id: CommentPublished
+// approves it, CommentHidden hides it.
+func (cm *Comments) Moderate(ctx context.Context, id, state string) (Comment, error) {
+	if state != CommentPublished && state != CommentHidden && state != CommentPending {
+		return Comment{}, ErrCommentInvalid
+	}
+	comment, err := cm.Get(ctx, id)
+	if err != nil {
+		return comment, err
+	}
+	if comment.State == CommentDeleted {
+		return comment, ErrCommentNotFound
+	}
+	return cm.change(comment, map[string]interface{}{"state": state})
+}
+
+// Pending returns the comments awaiting moderation, the oldest first.
+func (cm *Comments) Pending(ctx context.Context, limit int) ([]Comment, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	return surrealQuery[Comment](cm.DB, "SELECT * FROM type::table($tb) WHERE state = $state ORDER BY created_at LIMIT $limit", map[string]interface{}{
+		"tb":    cm.table(),
+		"state": CommentPending,
+		"limit": limit,
+	})
+}
+
+// change sets fields on comment, and the SurrealQL assignments of
+// sets, such as those of time::now().
+func (cm *Comments) change(comment Comment, fields map[string]interface{}, sets ...string) (Comment, error) {
+	table, key := splitRecordID(comment.ID, cm.table())
+	vars := map[string]interface{}{"tb": table, "id": key}
+	for _, name := range sortedKeys(fields) {
+		sets = append(sets, name+" = $"+name)
+		vars[name] = fields[name]
+	}
+	updated, ok, err := surrealFirst[Comment](cm.DB, "UPDATE type::thing($tb, $id) SET "+strings.Join(sets, ", ")+" RETURN AFTER", vars)
+	if err == nil && !ok {
+		err = ErrCommentNotFound
+	}
+	return updated, err
+}
+
+// Mount registers the endpoints of the comments on g, answering JSON,
+// or the partials to htmx requests:
+//  GET    /on/:subject   the thread of a record
+//  POST   /on/:subject   post a comment, or a reply with parent
+//  GET    /pending       the comments awaiting moderation
+//  PATCH  /:id           edit a comment
+//  DELETE /:id           delete a comment
+//  POST   /:id/moderate  set the state of a comment
+// Writing requires an Identity.
+func (cm *Comments) Mount(g *gin.RouterGroup) {
+	post := []gin.HandlerFunc{RequireIdentity()}
+	if cm.Limiter != nil {
+		post = append(post, cm.Limiter.Middleware())
+	}
+	g.GET("/on/:subject", cm.thread)
+	g.POST("/on/:subject", append(post, cm.post)...)
+	g.GET("/pending", cm.requireModerator, cm.pending)
+	g.PATCH("/:id", RequireIdentity(), cm.edit)
+	g.DELETE("/:id", RequireIdentity(), cm.delete)
+	g.POST("/:id/moderate", cm.requireModerator, cm.moderate)
+}
+
+func (cm *Comments) isModerator(c *gin.Context) bool {
+	return cm.Moderator != nil && cm.Moderator(c)
+}
+
+func (cm *Comments) requireModerator(c *gin.Context) {
+	if !cm.isModerator(c) {
+		Fail(c, ErrForbidden)
+	}
+}
+
+func (cm *Comments) authorize(c *gin.Context, subject string, write bool) bool {
+	if err := cm.checkSubject(subject); err != nil {
+		Fail(c, err)
+		return false
+	}
+	if cm.Authorize != nil {
+		if err := cm.Authorize(c, subject, write); err != nil {
+			Fail(c, err)
+			return false
+		}
+	}
+	return true
+}
+
+// CommentView is the data of the partials: the thread, or the comment
+// in Node, with what the viewer may do.
+type CommentView struct {
+	Subject     string
+	Comments    []*CommentNode
+	Node        *CommentNode
+	Viewer      string
+	CanPost     bool
+	CanModerate bool
+	// Action is the URL comments on Subject are posted to, Base the
+	// URL of the comment endpoints.
+	Action    string
+	Base      string
+	MaxDepth  int
+	MaxLength int
+}
+
+func (cm *Comments) view(c *gin.Context, subject string) CommentView {
+	identity, ok := CurrentIdentity(c)
+	base := strings.TrimRight(cm.BasePath, "/")
+	return CommentView{
+		Subject:     subject,
+		Viewer:      identity.ID,
+		CanPost:     ok,
+		CanModerate: cm.isModerator(c),
+		Action:      base + "/on/" + subject,
+		Base:        base,
+		MaxDepth:    cm.maxDepth(),
+		MaxLength:   cm.maxLength(),
+	}
+}
+
+// render answers a partial to htmx and data in the envelope otherwise.
+func (cm *Comments) render(c *gin.Context, code int, custom, builtin string, view CommentView, data interface{}) {
+	if !IsHTMX(c) {
+		if code == http.StatusCreated {
+			Created(c, data)
+		} else {
+			OK(c, data)
+		}
+		return
+	}
+	if custom != "" {
+		c.HTML(code, custom, withLayout(c, view))
+		return
+	}
+	var out bytes.Buffer
+	if err := commentTemplates.ExecuteTemplate(&out, builtin, view); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Data(code, "text/html; charset=utf-8", out.Bytes())
+}
+
+func (cm *Comments) thread(c *gin.Context) {
+	subject := c.Param("subject")
+	if !cm.authorize(c, subject, false) {
+		return
+	}
+	view := cm.view(c, subject)
+	comments, err := cm.Thread(c.Request.Context(), subject, view.Viewer, view.CanModerate)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	view.Comments = comments
+	cm.render(c, http.StatusOK, cm.ThreadTemplate, "comment-thread", view, comments)
+}
+
+func (cm *Comments) post(c *gin.Context) {
+	subject := c.Param("subject")
+	if !cm.authorize(c, subject, true) {
+		return
+	}
+	body, ok := BindOrAbort[struct {
+		Body   string `json:"body" form:"body" binding:"required"`
+		Parent string `json:"parent" form:"parent"`
+	}](c)
+	if !ok {
+		return
+	}
+	identity, _ := CurrentIdentity(c)
+	comment, err := cm.Post(c.Request.Context(), subject, body.Parent, identity.ID, body.Body)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	view := cm.view(c, subject)
+	view.Node = &CommentNode{Comment: comment}
+	if IsHTMX(c) && comment.Parent != "" {
+		// replies past MaxDepth go to the list of the grandparent
+		c.Header("HX-Retarget", "#"+commentDOMID(comment.Parent)+"-replies")
+	}
+	cm.render(c, http.StatusCreated, cm.CommentTemplate, "comment", view, comment)
+}
+
+func (cm *Comments) pending(c *gin.Context) {
+	comments, err := cm.Pending(c.Request.Context(), 100)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, comments)
+}
+
+// changed answers the changed comment, as its content to htmx.
+func (cm *Comments) changed(c *gin.Context, comment Comment, err error) {
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	view := cm.view(c, comment.Subject)
+	view.Node = &CommentNode{Comment: comment}
+	cm.render(c, http.StatusOK, cm.CommentTemplate, "comment-content", view, comment)
+}
+
+func (cm *Comments) edit(c *gin.Context) {
+	body, ok := BindOrAbort[struct {
+		Body string `json:"body" form:"body" binding:"required"`
+	}](c)
+	if !ok {
+		return
+	}
+	identity, _ := CurrentIdentity(c)
+	comment, err := cm.Edit(c.Request.Context(), c.Param("id"), identity.ID, body.Body)
+	cm.changed(c, comment, err)
+}
+
+func (cm *Comments) delete(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	comment, err := cm.Delete(c.Request.Context(), c.Param("id"), identity.ID, cm.isModerator(c))
+	cm.changed(c, comment, err)
+}
+
+func (cm *Comments) moderate(c *gin.Context) {
+	body, ok := BindOrAbort[struct {
+		State string `json:"state" form:"state" binding:"required"`
+	}](c)
+	if !ok {
+		return
+	}
+	comment, err := cm.Moderate(c.Request.Context(), c.Param("id"), body.State)
+	cm.changed(c, comment, err)
+}
+
+// commentDOMID turns a record id into an HTML id usable in selectors.
+func commentDOMID(id string) string {
+	return "c-" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, id)
+}
+
+// CommentsFuncMap returns the commentThread template helper, rendering
+// the built-in thread partial for a CommentView, for pages rendering
+// the thread themselves rather than loading it with htmx.
+//
+// Example:
+//  view, err := comments.ThreadView(c, post.ID)
+//  ghostutils.HTML(c, http.StatusOK, "post.html", gin.H{"Post": post, "Comments": view})
+//
+//  // post.html
+//  {{commentThread .Comments}}
+func CommentsFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"commentThread": func(view CommentView) (template.HTML, error) {
+			var out bytes.Buffer
+			if err := commentTemplates.ExecuteTemplate(&out, "comment-thread", view); err != nil {
+				return "", err
+			}
+			return template.HTML(out.String()), nil
+		},
+	}
+}
+
+// ThreadView returns the CommentView of the thread on subject for the
+// caller, for CommentsFuncMap.
+func (cm *Comments) ThreadView(c *gin.Context, subject string) (CommentView, error) {
+	view := cm.view(c, subject)
+	comments, err := cm.Thread(c.Request.Context(), subject, view.Viewer, view.CanModerate)
+	view.Comments = comments
+	return view, err
+}
+
+var commentTemplates = template.Must(template.New("comments").Funcs(template.FuncMap{
+	"domID": commentDOMID,
+	"reply": func(view CommentView, node *CommentNode) CommentView {
+		view.Node = node
+		return view
+	},
+	"moderationStates": func() []string {
+		return []string{CommentPublished, CommentHidden}
+	},
+}).Parse(`{{define "comment-thread"}}<section class="comments" id="{{domID .Subject}}-comments">
+<ol class="comment-list" id="{{domID .Subject}}-replies">
+{{range .Comments}}{{template "comment" (reply $ .)}}{{end}}</ol>
+{{if .CanPost}}<form class="comment-form" hx-post="{{.Action}}" hx-target="#{{domID .Subject}}-replies" hx-swap="beforeend" hx-on::after-request="if (event.detail.successful) this.reset()">
+<textarea name="body" required maxlength="{{.MaxLength}}" aria-label="Comment"></textarea>
+<button type="submit">Comment</button>
+</form>{{end}}
+</section>{{end}}
+{{define "comment"}}<li class="comment" id="{{domID .Node.ID}}">
+{{template "comment-content" .}}
+{{if and .CanPost (lt .Node.Depth .MaxDepth) (ne .Node.State "deleted")}}<details class="comment-reply"><summary>Reply</summary>
+<form hx-post="{{.Action}}" hx-target="#{{domID .Node.ID}}-replies" hx-swap="beforeend" hx-on::after-request="if (event.detail.successful) this.reset()">
+<input type="hidden" name="parent" value="{{.Node.ID}}">
+<textarea name="body" required maxlength="{{.MaxLength}}" aria-label="Reply"></textarea>
+<button type="submit">Reply</button>
+</form></details>{{end}}
+<ol class="comment-replies" id="{{domID .Node.ID}}-replies">
+{{range .Node.Replies}}{{template "comment" (reply $ .)}}{{end}}</ol>
+</li>{{end}}
+{{define "comment-content"}}<div class="comment-content comment-{{.Node.State}}" id="{{domID .Node.ID}}-content">
+{{if eq .Node.State "deleted"}}<p class="comment-removed">Comment deleted</p>{{else}}<header>
+<span class="comment-author">{{.Node.Author}}</span>
+<time datetime="{{.Node.CreatedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.Node.CreatedAt.Format "Jan 2, 2006 15:04"}}</time>
+{{if .Node.EditedAt}}<span class="comment-edited">edited</span>{{end}}
+{{if eq .Node.State "pending"}}<span class="comment-pending">awaiting moderation</span>{{end}}
+{{if eq .Node.State "hidden"}}<span class="comment-hidden">hidden</span>{{end}}
+</header>
+<p class="comment-body" style="white-space: pre-line">{{.Node.Body}}</p>
+{{if or (eq .Node.Author .Viewer) .CanModerate}}<div class="comment-actions">
+{{if .CanModerate}}{{$node := .Node}}{{$base := .Base}}{{range moderationStates}}{{if ne . $node.State}}<button type="button" hx-post="{{$base}}/{{$node.ID}}/moderate" hx-vals='{"state": "{{.}}"}' hx-target="#{{domID $node.ID}}-content" hx-swap="outerHTML">{{if eq . "published"}}Publish{{else}}Hide{{end}}</button>{{end}}{{end}}{{end}}
+<button type="button" hx-delete="{{.Base}}/{{.Node.ID}}" hx-confirm="Delete this comment?" hx-target="#{{domID .Node.ID}}-content" hx-swap="outerHTML">Delete</button>
+</div>{{end}}{{end}}
+</div>{{end}}`))
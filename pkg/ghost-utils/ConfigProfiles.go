@@ -0,0 +1,153 @@
+package ghostutils
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvVariable selects the ghost.yaml profile used by Load.
+const EnvVariable = "GHOST_ENV"
+
+// NewForEnv loads ./ghost.yaml resolved for the env profile. The top
+// level of the file is the shared base; each entry under
+// environments overrides it, and may extend another profile:
+//
+//  name: blog
+//  port: 8080
+//  surrealdb:
+//      surrealdb-url: ws://localhost:8000/rpc
+//      surrealdb-namespace: blog
+//  environments:
+//      production:
+//          port: 80
+//          surrealdb:
+//              surrealdb-url: wss://db.example.com/rpc
+//      staging:
+//          extends: production
+//          surrealdb:
+//              surrealdb-namespace: blog-staging
+//
+// Maps are merged key by key, every other value is replaced. String
+// values may then reference secrets as ${ENV_VAR} or
+// file:/run/secrets/name; a reference that cannot be resolved fails
+// the load.
+//
+// Example:
+//  ghostConfig, err := ghostutils.NewForEnv("production")
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  GhostConfig struct, validated with Validate
+//  error if the file cannot be read, env is not defined, a secret
+//  reference is missing or the config is invalid
+func NewForEnv(env string) (GhostConfig, error) {
+	return loadConfig("./ghost.yaml", env)
+}
+
+// NewFromPath is NewForEnv for a config file at path.
+func NewFromPath(path, env string) (GhostConfig, error) {
+	return loadConfig(path, env)
+}
+
+func loadConfig(path, env string) (GhostConfig, error) {
+	ghostConfig := GhostConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ghostConfig, err
+	}
+	resolved, err := resolveProfile(data, env)
+	if err != nil {
+		return ghostConfig, err
+	}
+	if err := yaml.Unmarshal(resolved, &ghostConfig); err != nil {
+		return ghostConfig, err
+	}
+	ghostConfig.Env = env
+	ghostConfig.Path = path
+	if err := ghostConfig.interpolate(); err != nil {
+		return ghostConfig, err
+	}
+	ghostConfig.modeFromEnv()
+	err = ghostConfig.Validate()
+	return ghostConfig, err
+}
+
+// resolveProfile merges the env profile of a ghost.yaml document
+// onto its base and returns the resulting document.
+func resolveProfile(data []byte, env string) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	profiles, _ := doc["environments"].(map[string]interface{})
+	delete(doc, "environments")
+	if env == "" {
+		return yaml.Marshal(doc)
+	}
+	chain, err := profileChain(profiles, env)
+	if err != nil {
+		return nil, err
+	}
+	// apply the furthest ancestor first so env has the last word
+	for i := len(chain) - 1; i >= 0; i-- {
+		doc = mergeYAML(doc, chain[i])
+	}
+	return yaml.Marshal(doc)
+}
+
+// profileChain returns env's profile followed by the profiles it
+// extends.
+func profileChain(profiles map[string]interface{}, env string) ([]map[string]interface{}, error) {
+	var chain []map[string]interface{}
+	seen := map[string]bool{}
+	for name := env; name != ""; {
+		if seen[name] {
+			return nil, fmt.Errorf("ghost.yaml: environment %q extends itself", name)
+		}
+		seen[name] = true
+		raw, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("ghost.yaml: environment %q is not defined", name)
+		}
+		profile, _ := raw.(map[string]interface{})
+		if profile == nil {
+			profile = map[string]interface{}{}
+		}
+		parent, _ := profile["extends"].(string)
+		overlay := make(map[string]interface{}, len(profile))
+		for k, v := range profile {
+			if k != "extends" {
+				overlay[k] = v
+			}
+		}
+		chain = append(chain, overlay)
+		name = parent
+	}
+	return chain, nil
+}
+
+// mergeYAML returns base with overlay applied. Nested maps are
+// merged, other values replaced.
+func mergeYAML(base, overlay map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(base)+len(overlay))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range overlay {
+		nested, isMap := v.(map[string]interface{})
+		existing, wasMap := out[k].(map[string]interface{})
+		if isMap && wasMap {
+			out[k] = mergeYAML(existing, nested)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package ghostutils
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+var envReferencePattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolate resolves secret references in every string field of
+// ghostConfig. Two forms are supported:
+//
+//  surrealdb-password: ${SURREAL_PASS}            the environment variable
+//  surrealdb-password: file:/run/secrets/surreal  the file, without trailing newlines
+//
+// ${...} may appear anywhere in a value and $$ is a literal $. A file:
+// reference must be the whole value. Every unresolved reference is
+// reported in one *ConfigError.
+func (ghostConfig *GhostConfig) interpolate() error {
+	problems := &ConfigError{}
+	interpolateValue(reflect.ValueOf(ghostConfig).Elem(), "", problems)
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func interpolateValue(v reflect.Value, path string, problems *ConfigError) {
+	switch v.Kind() {
+	case reflect.String:
+		if !v.CanSet() {
+			return
+		}
+		resolved, err := interpolateString(v.String())
+		if err != nil {
+			problems.add("%s: %v", path, err)
+			return
+		}
+		v.SetString(resolved)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if field.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			interpolateValue(v.Field(i), joinConfigPath(path, name), problems)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			interpolateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			// map values are not settable, such as the databases
+			for _, key := range v.MapKeys() {
+				elem := reflect.New(v.Type().Elem()).Elem()
+				elem.Set(v.MapIndex(key))
+				interpolateValue(elem, fmt.Sprintf("%s.%v", path, key), problems)
+				v.SetMapIndex(key, elem)
+			}
+			return
+		}
+		for _, key := range v.MapKeys() {
+			resolved, err := interpolateString(v.MapIndex(key).String())
+			if err != nil {
+				problems.add("%s.%v: %v", path, key, err)
+				continue
+			}
+			v.SetMapIndex(key, reflect.ValueOf(resolved).Convert(v.Type().Elem()))
+		}
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			interpolateValue(v.Elem(), path, problems)
+		}
+	}
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func interpolateString(s string) (string, error) {
+	if strings.HasPrefix(s, "file:") {
+		path := strings.TrimPrefix(s, "file:")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading secret file %s: %w", path, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var missing []string
+	resolved := envReferencePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		name := ref[2 : len(ref)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return resolved, nil
+}
@@ -0,0 +1,739 @@
+package ghostutils
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults applied by Validate.
+const (
+	DefaultPort      = 8080
+	DefaultNamespace = "ghost"
+	DefaultViews     = "src/views"
+	DefaultContent   = "src/content"
+)
+
+// ConfigError lists every problem found by Validate.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	if len(e.Problems) == 1 {
+		return "ghost.yaml: " + e.Problems[0]
+	}
+	return fmt.Sprintf("ghost.yaml: %d problems:\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Validate applies defaults to unset fields and checks the config,
+// returning a *ConfigError that lists every problem at once. Load and
+// NewForEnv call it, so a config that loads is usable by Setup.
+//
+// Defaults:
+//  port                 8080
+//  mode                 all
+//  surrealdb-namespace  the project name, or "ghost"
+//  views                src/views
+//  content              src/content
+//  migrations.dir       migrations
+//  templates            **/*.html, layouts, partials and the base layout
+//  shutdown.timeout     15s
+//  surrealdb-retry      10 attempts from 500ms to 10s, 0.2 jitter
+//  databases            the unset fields of the surrealdb block
+//
+// Example:
+//  ghostConfig := ghostutils.GhostConfig{}
+//  ghostConfig.SurrealDB.URL = "ws://localhost:8000/rpc"
+//  ghostConfig.SurrealDB.Database = "blog"
+//  if err := ghostConfig.Validate(); err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  nil or *ConfigError
+func (ghostConfig *GhostConfig) Validate() error {
+	problems := &ConfigError{}
+
+	if ghostConfig.Port == 0 {
+		ghostConfig.Port = DefaultPort
+	}
+	if ghostConfig.Port < 1 || ghostConfig.Port > 65535 {
+		problems.add("port %d is out of range 1-65535", ghostConfig.Port)
+	}
+	switch ghostConfig.Mode {
+	case "":
+		ghostConfig.Mode = ModeAll
+	case ModeAll, ModeWeb, ModeWorker:
+	default:
+		problems.add("mode %q must be all, web or worker", ghostConfig.Mode)
+	}
+	if ghostConfig.Views == "" {
+		ghostConfig.Views = DefaultViews
+	}
+	if ghostConfig.Content == "" {
+		ghostConfig.Content = DefaultContent
+	}
+	if ghostConfig.Migrations.Dir == "" {
+		ghostConfig.Migrations.Dir = DefaultMigrationsDir
+	}
+	if ghostConfig.Shutdown.Timeout == 0 {
+		ghostConfig.Shutdown.Timeout = DefaultShutdownTimeout
+	}
+	templates := &ghostConfig.Templates
+	if templates.Glob == "" {
+		templates.Glob = DefaultTemplateGlob
+	}
+	if templates.Layouts == "" {
+		templates.Layouts = DefaultTemplateLayouts
+	}
+	if templates.Partials == "" {
+		templates.Partials = DefaultTemplatePartials
+	}
+	if templates.Layout == "" {
+		templates.Layout = DefaultTemplateLayout
+	}
+	if !validTemplateGlob(templates.Glob) {
+		problems.add("templates.glob %q is not a valid pattern", templates.Glob)
+	}
+	if templates.Layouts == templates.Partials {
+		problems.add("templates.layouts and templates.partials must differ")
+	}
+
+	db := &ghostConfig.SurrealDB
+	if db.Namespace == "" {
+		db.Namespace = ghostConfig.Name
+		if db.Namespace == "" {
+			db.Namespace = DefaultNamespace
+		}
+	}
+	validateSurrealDB("surrealdb", db, problems)
+	names := make([]string, 0, len(ghostConfig.Databases))
+	for name := range ghostConfig.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" || name == DefaultDatabase {
+			problems.add("databases.%s: the name %q is taken by the surrealdb block", name, DefaultDatabase)
+			continue
+		}
+		// unset fields are those of the surrealdb block
+		named := ghostConfig.Databases[name]
+		if named.URL == "" {
+			named.URL = db.URL
+		}
+		if named.Username == "" && named.Password == "" {
+			named.Username, named.Password = db.Username, db.Password
+		}
+		if named.Namespace == "" {
+			named.Namespace = db.Namespace
+		}
+		if named.Database == "" {
+			named.Database = db.Database
+		}
+		if named.Retry == (RetryConfig{}) {
+			named.Retry = db.Retry
+		}
+		if named.Connection == (ConnectionConfig{}) {
+			named.Connection = db.Connection
+		}
+		if named.Embedded == (EmbeddedConfig{}) {
+			named.Embedded = db.Embedded
+		}
+		validateSurrealDB("databases."+name, &named, problems)
+		ghostConfig.Databases[name] = named
+	}
+
+	routing := &ghostConfig.ReadRouting
+	if routing.Primary == "" {
+		routing.Primary = DefaultDatabase
+	}
+	if routing.ProbeInterval == 0 {
+		routing.ProbeInterval = DefaultProbeInterval
+	}
+	if routing.ProbeTimeout == 0 {
+		routing.ProbeTimeout = DefaultProbeTimeout
+	}
+	if routing.ProbeInterval < 0 || routing.ProbeTimeout < 0 {
+		problems.add("read-routing.probe-interval and read-routing.probe-timeout must not be negative")
+	}
+	known := func(name string) bool {
+		_, ok := ghostConfig.Databases[name]
+		return ok || name == DefaultDatabase
+	}
+	if !known(routing.Primary) {
+		problems.add("read-routing.primary %q is not in databases", routing.Primary)
+	}
+	routed := map[string]bool{routing.Primary: true}
+	for _, name := range routing.Replicas {
+		switch {
+		case !known(name):
+			problems.add("read-routing.replicas %q is not in databases", name)
+		case routed[name]:
+			problems.add("read-routing.replicas lists %q twice, or the primary", name)
+		}
+		routed[name] = true
+	}
+
+	if (ghostConfig.TailwindCSS.Input == "") != (ghostConfig.TailwindCSS.Output == "") {
+		problems.add("tailwindcss.input and tailwindcss.output must be set together")
+	}
+	if (len(ghostConfig.Scripts.Input) == 0) != (ghostConfig.Scripts.Outdir == "") {
+		problems.add("esbuild.input and esbuild.outdir must be set together")
+	}
+	if format := ghostConfig.Scripts.Format; format != "" && format != "iife" && format != "esm" {
+		problems.add("esbuild.format %q must be iife or esm", format)
+	}
+
+	seen := map[string]bool{}
+	for i, key := range ghostConfig.Signing.Keys {
+		if key.ID == "" || key.Secret == "" {
+			problems.add("signing.keys[%d] needs an id and a secret", i)
+		}
+		if seen[key.ID] {
+			problems.add("signing.keys[%d]: duplicate id %q", i, key.ID)
+		}
+		seen[key.ID] = true
+	}
+
+	if ghostConfig.WebAuthn.RPID != "" && len(ghostConfig.WebAuthn.RPOrigins) == 0 {
+		problems.add("webauthn.rp-origins is required when webauthn.rp-id is set")
+	}
+
+	if sms := ghostConfig.Notifications.SMS; sms.Provider != "" && sms.Provider != "twilio" {
+		problems.add("notifications.sms.provider %q is not supported", sms.Provider)
+	}
+	if push := ghostConfig.Notifications.Push; push.Provider != "" && push.Provider != "webpush" {
+		problems.add("notifications.push.provider %q is not supported", push.Provider)
+	}
+
+	health := &ghostConfig.Health
+	if health.LivenessPath == "" {
+		health.LivenessPath = DefaultLivenessPath
+	}
+	if health.ReadinessPath == "" {
+		health.ReadinessPath = DefaultReadinessPath
+	}
+	if health.Timeout == 0 {
+		health.Timeout = DefaultHealthTimeout
+	}
+	if !strings.HasPrefix(health.LivenessPath, "/") || !strings.HasPrefix(health.ReadinessPath, "/") {
+		problems.add("health paths must start with /")
+	}
+	if health.LivenessPath == health.ReadinessPath {
+		problems.add("health.liveness-path and health.readiness-path must differ")
+	}
+
+	metrics := &ghostConfig.Metrics
+	if metrics.Path == "" {
+		metrics.Path = DefaultMetricsPath
+	}
+	if metrics.Namespace == "" {
+		metrics.Namespace = DefaultMetricsNamespace
+	}
+	if !strings.HasPrefix(metrics.Path, "/") {
+		problems.add("metrics.path must start with /")
+	}
+	if !identifierPattern.MatchString(metrics.Namespace) || strings.Contains(metrics.Namespace, ".") {
+		problems.add("metrics.namespace %q must be a metric name", metrics.Namespace)
+	}
+	if !sort.Float64sAreSorted(metrics.Buckets) {
+		problems.add("metrics.buckets must be increasing")
+	}
+	explain := &metrics.Explain
+	if explain.Threshold > 0 && explain.Rate == 0 {
+		explain.Rate = DefaultExplainRate
+	}
+	if explain.Threshold > 0 && explain.MaxPlans == 0 {
+		explain.MaxPlans = DefaultExplainMaxPlans
+	}
+	if explain.Threshold < 0 || explain.MaxPlans < 0 {
+		problems.add("metrics.explain values must not be negative")
+	}
+	if explain.Rate < 0 || explain.Rate > 1 {
+		problems.add("metrics.explain.rate %v is out of range 0-1", explain.Rate)
+	}
+
+	telemetry := &ghostConfig.Telemetry
+	if telemetry.Enabled && telemetry.SampleRate == 0 {
+		telemetry.SampleRate = 1
+	}
+	if telemetry.SampleRate < 0 || telemetry.SampleRate > 1 {
+		problems.add("telemetry.sample-rate %v is out of range 0-1", telemetry.SampleRate)
+	}
+	if strings.Contains(telemetry.Endpoint, "://") {
+		problems.add("telemetry.endpoint must be host:port, without a scheme")
+	}
+
+	pwa := &ghostConfig.PWA
+	if pwa.Display == "" {
+		pwa.Display = DefaultPWADisplay
+	}
+	if pwa.StartURL == "" {
+		pwa.StartURL = DefaultPWAStartURL
+	}
+	switch pwa.Display {
+	case "standalone", "fullscreen", "minimal-ui", "browser":
+	default:
+		problems.add("pwa.display %q must be standalone, fullscreen, minimal-ui or browser", pwa.Display)
+	}
+	if !strings.HasPrefix(pwa.StartURL, "/") {
+		problems.add("pwa.start-url must start with /")
+	}
+	if pwa.Enabled && ghostConfig.Name == "" && pwa.ShortName == "" {
+		problems.add("pwa.enabled needs a name or pwa.short-name")
+	}
+
+	jobs := &ghostConfig.Jobs
+	if jobs.Table == "" {
+		jobs.Table = DefaultJobsTable
+	}
+	if jobs.Concurrency == 0 {
+		jobs.Concurrency = DefaultJobsConcurrency
+	}
+	if jobs.PollInterval == 0 {
+		jobs.PollInterval = DefaultJobsPollInterval
+	}
+	if jobs.Timeout == 0 {
+		jobs.Timeout = DefaultJobsTimeout
+	}
+	if jobs.Retry.MaxAttempts == 0 {
+		jobs.Retry.MaxAttempts = DefaultJobsAttempts
+	}
+	if jobs.Retry.InitialDelay == 0 {
+		jobs.Retry.InitialDelay = DefaultJobsInitialDelay
+	}
+	if jobs.Retry.MaxDelay == 0 {
+		jobs.Retry.MaxDelay = DefaultJobsMaxDelay
+	}
+	if jobs.Retry.Jitter == 0 {
+		jobs.Retry.Jitter = DefaultRetryJitter
+	}
+	if !identifierPattern.MatchString(jobs.Table) || strings.Contains(jobs.Table, ".") {
+		problems.add("jobs.table %q is not a table name", jobs.Table)
+	}
+	if jobs.Concurrency < 0 || jobs.PollInterval < 0 || jobs.Timeout < 0 ||
+		jobs.Retry.MaxAttempts < 0 || jobs.Retry.InitialDelay < 0 || jobs.Retry.MaxDelay < 0 {
+		problems.add("jobs values must not be negative")
+	}
+	if jobs.Retry.Jitter < 0 || jobs.Retry.Jitter > 1 {
+		problems.add("jobs.retry.jitter %v is out of range 0-1", jobs.Retry.Jitter)
+	}
+
+	scheduler := &ghostConfig.Scheduler
+	if scheduler.LockTable == "" {
+		scheduler.LockTable = DefaultSchedulerLockTable
+	}
+	if scheduler.LockTTL == 0 {
+		scheduler.LockTTL = DefaultSchedulerLockTTL
+	}
+	location := time.Local
+	if scheduler.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(scheduler.Timezone); err != nil {
+			problems.add("scheduler.timezone %q is not a known timezone", scheduler.Timezone)
+		}
+	}
+	taskNames := make([]string, 0, len(scheduler.Tasks))
+	for name := range scheduler.Tasks {
+		taskNames = append(taskNames, name)
+	}
+	sort.Strings(taskNames)
+	for _, name := range taskNames {
+		if _, err := parseSchedule(scheduler.Tasks[name], location); err != nil {
+			problems.add("scheduler.tasks.%s: %v", name, err)
+		}
+	}
+	if !identifierPattern.MatchString(scheduler.LockTable) || strings.Contains(scheduler.LockTable, ".") {
+		problems.add("scheduler.lock-table %q is not a table name", scheduler.LockTable)
+	}
+	if scheduler.LockTTL < 0 {
+		problems.add("scheduler.lock-ttl must not be negative")
+	}
+
+	pdf := &ghostConfig.PDF
+	if pdf.Engine == "" {
+		pdf.Engine = "chromium"
+	}
+	if pdf.Timeout == 0 {
+		pdf.Timeout = DefaultPDFTimeout
+	}
+	if _, err := ghostConfig.NewPDFEngine(); err != nil {
+		problems.add("%v", err)
+	}
+	if pdf.Timeout < 0 {
+		problems.add("pdf.timeout must not be negative")
+	}
+
+	uploads := &ghostConfig.Uploads
+	if uploads.MaxSize == 0 {
+		uploads.MaxSize = DefaultUploadMaxSize
+	}
+	if uploads.Storage == "" {
+		uploads.Storage = "local"
+	}
+	if uploads.Storage == "local" && uploads.Root == "" {
+		uploads.Root = DefaultUploadRoot
+	}
+	if _, err := ghostConfig.NewStorage(); err != nil {
+		problems.add("%v", err)
+	}
+	if uploads.MaxSize < 0 {
+		problems.add("uploads.max-size must not be negative")
+	}
+	if uploads.Table != "" && (!identifierPattern.MatchString(uploads.Table) || strings.Contains(uploads.Table, ".")) {
+		problems.add("uploads.table %q is not a table name", uploads.Table)
+	}
+	for _, accepted := range uploads.Types {
+		if _, _, err := mime.ParseMediaType(strings.ReplaceAll(accepted, "*", "x")); err != nil || !strings.Contains(accepted, "/") {
+			problems.add("uploads.types: %q is not a MIME type", accepted)
+		}
+	}
+
+	gateway := &ghostConfig.Gateway
+	if gateway.DefaultPlan == "" && len(gateway.Plans) == 1 {
+		for name := range gateway.Plans {
+			gateway.DefaultPlan = name
+		}
+	}
+	if _, ok := gateway.Plans[gateway.DefaultPlan]; len(gateway.Plans) > 0 && !ok {
+		problems.add("gateway.default-plan %q is not one of gateway.plans", gateway.DefaultPlan)
+	}
+	for name, plan := range gateway.Plans {
+		if plan.Period != "" && plan.Period != APIPeriodDay && plan.Period != APIPeriodMonth {
+			problems.add("gateway.plans.%s.period %q must be day or month", name, plan.Period)
+		}
+		if plan.Requests < 0 || plan.Per < 0 || plan.Burst < 0 || plan.Quota < 0 {
+			problems.add("gateway.plans.%s values must not be negative", name)
+		}
+	}
+	for _, table := range []string{gateway.KeysTable, gateway.UsageTable} {
+		if table != "" && (!identifierPattern.MatchString(table) || strings.Contains(table, ".")) {
+			problems.add("gateway table %q is not a table name", table)
+		}
+	}
+	if gateway.MaxKeys < 0 {
+		problems.add("gateway.max-keys must not be negative")
+	}
+
+	if ghostConfig.Mock.Latency < 0 {
+		problems.add("mock.latency must not be negative")
+	}
+	switch strings.ToLower(filepath.Ext(ghostConfig.Mock.Spec)) {
+	case "", ".json", ".yaml", ".yml":
+		if ghostConfig.Mock.Spec == "" && ghostConfig.Mock.Enabled {
+			problems.add("mock.enabled needs mock.spec")
+		}
+	default:
+		problems.add("mock.spec %q must be a .json, .yaml or .yml file", ghostConfig.Mock.Spec)
+	}
+
+	objectives := map[string]bool{}
+	for i, objective := range ghostConfig.SLO.Objectives {
+		if objective.Name == "" {
+			problems.add("slo.objectives[%d] needs a name", i)
+		} else if objectives[objective.Name] {
+			problems.add("slo.objectives[%d]: duplicate name %q", i, objective.Name)
+		}
+		objectives[objective.Name] = true
+		if objective.Tag == "" && len(objective.Routes) == 0 {
+			problems.add("slo.objectives[%d] needs a tag or routes", i)
+		}
+		if objective.Target <= 0 || objective.Target >= 1 {
+			problems.add("slo.objectives[%d].target %v must be between 0 and 1", i, objective.Target)
+		}
+	}
+
+	if watchdog := ghostConfig.Watchdog; watchdog.MaxHeapMB < 0 || watchdog.MaxGoroutines < 0 || watchdog.Sustained < 0 || watchdog.Interval < 0 {
+		problems.add("watchdog values must not be negative")
+	} else if watchdog.MaxPoolUsage < 0 || watchdog.MaxPoolUsage > 1 {
+		problems.add("watchdog.max-pool-usage %v is out of range 0-1", watchdog.MaxPoolUsage)
+	}
+
+	auth := ghostConfig.Auth
+	if auth.Scope != "" && len(auth.SigningKey) < 32 {
+		problems.add("auth.signing-key must be at least 32 bytes")
+	}
+	if auth.TokenTTL < 0 || auth.RefreshTTL < 0 {
+		problems.add("auth token ttls must not be negative")
+	}
+
+	if session := ghostConfig.Session; session.TTL < 0 {
+		problems.add("session.ttl must not be negative")
+	} else if sameSite := strings.ToLower(session.SameSite); sameSite != "" && sameSite != "lax" && sameSite != "strict" && sameSite != "none" {
+		problems.add("session.same-site %q must be lax, strict or none", session.SameSite)
+	} else if sameSite == "none" && !session.Secure {
+		problems.add("session.same-site none requires session.secure")
+	} else if session.Table != "" && !identifierPattern.MatchString(session.Table) {
+		problems.add("session.table %q is not a valid table name", session.Table)
+	}
+
+	budgets := &ghostConfig.Budgets
+	switch budgets.Action {
+	case "":
+		budgets.Action = BudgetWarn
+	case BudgetWarn, BudgetFail:
+	default:
+		problems.add("budgets.action %q must be warn or fail", budgets.Action)
+	}
+	if budgets.Queries < 0 || budgets.Calls < 0 {
+		problems.add("budgets limits must not be negative")
+	}
+	budgetRoutes := make([]string, 0, len(budgets.Routes))
+	for route := range budgets.Routes {
+		budgetRoutes = append(budgetRoutes, route)
+	}
+	sort.Strings(budgetRoutes)
+	for _, route := range budgetRoutes {
+		limits := budgets.Routes[route]
+		if method, pattern, ok := strings.Cut(route, " "); !ok || method == "" || !strings.HasPrefix(pattern, "/") {
+			problems.add("budgets.routes %q must be a method and a path, e.g. GET /posts/:id", route)
+		}
+		if limits.Queries < 0 || limits.Calls < 0 {
+			problems.add("budgets.routes %q limits must not be negative", route)
+		}
+	}
+
+	doctor := &ghostConfig.Doctor
+	if doctor.MaxClockSkew == 0 {
+		doctor.MaxClockSkew = DefaultMaxClockSkew
+	}
+	if doctor.MaxClockSkew < 0 {
+		problems.add("doctor.max-clock-skew must not be negative")
+	}
+	for _, table := range doctor.Tables {
+		if !identifierPattern.MatchString(table) {
+			problems.add("doctor.tables %q is not a valid table name", table)
+		}
+	}
+
+	transformTags := make([]string, 0, len(ghostConfig.Transforms))
+	for tag := range ghostConfig.Transforms {
+		transformTags = append(transformTags, tag)
+	}
+	sort.Strings(transformTags)
+	for _, tag := range transformTags {
+		for i, step := range ghostConfig.Transforms[tag] {
+			if step.Use == "" {
+				problems.add("transforms.%s[%d].use is required", tag, i)
+			}
+		}
+	}
+
+	if csrf := ghostConfig.CSRF; csrf.Secret != "" && len(csrf.Secret) < 32 {
+		problems.add("csrf.secret must be at least 32 bytes")
+	} else if csrf.MaxAge < 0 {
+		problems.add("csrf.max-age must not be negative")
+	} else if sameSite := strings.ToLower(csrf.SameSite); sameSite != "" && sameSite != "lax" && sameSite != "strict" && sameSite != "none" {
+		problems.add("csrf.same-site %q must be lax, strict or none", csrf.SameSite)
+	} else if sameSite == "none" && !csrf.Secure {
+		problems.add("csrf.same-site none requires csrf.secure")
+	}
+	for _, pattern := range ghostConfig.CSRF.Exempt {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+			problems.add("csrf.exempt %q is not a valid path pattern", pattern)
+		}
+	}
+
+	for i, origin := range ghostConfig.CORS.AllowedOrigins {
+		if origin == "*" {
+			if ghostConfig.CORS.AllowCredentials {
+				problems.add("cors.allowed-origins \"*\" cannot be used with allow-credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") || strings.Trim(u.Path, "/") != "" {
+			problems.add("cors.allowed-origins[%d] %q must be a scheme and host like https://app.example.com", i, origin)
+		}
+	}
+	if ghostConfig.CORS.MaxAge < 0 {
+		problems.add("cors.max-age must not be negative")
+	}
+
+	for i, proxy := range ghostConfig.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				problems.add("trusted-proxies[%d] %q must be an IP address or CIDR", i, proxy)
+			}
+		}
+	}
+
+	rateLimit := ghostConfig.RateLimit
+	if rateLimit.Enabled && (rateLimit.Requests <= 0 || rateLimit.Per <= 0) {
+		problems.add("rate-limit.requests and rate-limit.per are required when rate-limit.enabled is set")
+	}
+	if rateLimit.Enabled && rateLimit.Key == RateLimitByUser {
+		// the global limiter runs before any route authenticates
+		problems.add("rate-limit.key user needs an identity, which the global limiter runs before; use it for rate-limit.routes")
+	}
+	checkRule := func(path string, rule RateLimitRule) {
+		if rule.Requests < 0 || rule.Per < 0 || rule.Burst < 0 {
+			problems.add("%s values must not be negative", path)
+		}
+		if rule.Key != "" && rule.Key != RateLimitByIP && rule.Key != RateLimitByUser {
+			problems.add("%s.key %q must be ip or user", path, rule.Key)
+		}
+	}
+	checkRule("rate-limit", rateLimit.RateLimitRule)
+	routeNames := make([]string, 0, len(rateLimit.Routes))
+	for name := range rateLimit.Routes {
+		routeNames = append(routeNames, name)
+	}
+	sort.Strings(routeNames)
+	for _, name := range routeNames {
+		rule := rateLimit.Routes[name]
+		if rule.Requests <= 0 || rule.Per <= 0 {
+			problems.add("rate-limit.routes.%s needs requests and per", name)
+		}
+		checkRule("rate-limit.routes."+name, rule)
+	}
+	switch rateLimit.Store {
+	case "", "memory":
+	case "redis":
+		if rateLimit.RedisURL == "" {
+			problems.add("rate-limit.redis-url is required for the redis store")
+		}
+	default:
+		problems.add("rate-limit.store %q must be memory or redis", rateLimit.Store)
+	}
+
+	tlsConfig := &ghostConfig.TLS
+	if tlsConfig.Enabled() && tlsConfig.HTTPPort == 0 {
+		tlsConfig.HTTPPort = DefaultTLSHTTPPort
+	}
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		problems.add("tls.cert-file and tls.key-file must be set together")
+	}
+	if tlsConfig.CertFile != "" && len(tlsConfig.Autocert.Hosts) > 0 {
+		problems.add("tls.cert-file and tls.autocert cannot be used together")
+	}
+	if len(tlsConfig.Autocert.Hosts) == 0 && (tlsConfig.Autocert.Email != "" || tlsConfig.Autocert.CacheDir != "") {
+		problems.add("tls.autocert.hosts is required for autocert")
+	}
+	if tlsConfig.HTTPPort < 0 || tlsConfig.HTTPPort > 65535 {
+		problems.add("tls.http-port %d is out of range 1-65535", tlsConfig.HTTPPort)
+	} else if tlsConfig.Enabled() && tlsConfig.HTTPPort == ghostConfig.Port {
+		problems.add("tls.http-port and port must differ")
+	}
+
+	cache := &ghostConfig.Cache
+	if cache.MaxEntries == 0 {
+		cache.MaxEntries = DefaultCacheMaxEntries
+	}
+	if cache.TTL == 0 {
+		cache.TTL = DefaultCacheTTL
+	}
+	if cache.CursorTTL == 0 {
+		cache.CursorTTL = DefaultCursorTTL
+	}
+	switch cache.Store {
+	case "", "memory":
+	case "redis":
+		if cache.RedisURL == "" {
+			problems.add("cache.redis-url is required for the redis store")
+		}
+	default:
+		problems.add("cache.store %q must be memory or redis", cache.Store)
+	}
+	if cache.MaxEntries < 0 || cache.TTL < 0 || cache.CursorTTL < 0 {
+		problems.add("cache values must not be negative")
+	}
+
+	if ghostConfig.Shutdown.Timeout < 0 || ghostConfig.Shutdown.Delay < 0 {
+		problems.add("shutdown values must not be negative")
+	}
+
+	if _, err := ParseLogLevel(ghostConfig.Logging.Level); err != nil {
+		problems.add("logging.level: %v", err)
+	}
+	if format := ghostConfig.Logging.Format; format != "" && format != "text" && format != "json" {
+		problems.add("logging.format %q must be text or json", format)
+	}
+	if sampling := ghostConfig.Logging.Sampling; sampling.Initial < 0 || sampling.Thereafter < 0 || sampling.Tick < 0 {
+		problems.add("logging.sampling values must not be negative")
+	}
+
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// validateSurrealDB applies the defaults of a connection and checks it,
+// naming its problems after prefix.
+func validateSurrealDB(prefix string, db *SurrealDBConfig, problems *ConfigError) {
+	if db.URL == "" {
+		problems.add("%s.surrealdb-url is required", prefix)
+	} else if u, err := url.Parse(db.URL); err != nil || u.Host == "" {
+		problems.add("%s.surrealdb-url %q is not a valid URL", prefix, db.URL)
+	} else if u.Scheme == EmbeddedScheme {
+		if !embeddedEngines[u.Host] {
+			problems.add("%s.surrealdb-url %q must be embedded://memory, embedded://rocksdb or embedded://surrealkv", prefix, db.URL)
+		}
+		if db.Username == "" && db.Password == "" {
+			db.Username, db.Password = "root", "root"
+		}
+	} else if u.Scheme != "ws" && u.Scheme != "wss" {
+		problems.add("%s.surrealdb-url must use ws://, wss:// or embedded://, got %q", prefix, u.Scheme)
+	}
+	embedded := &db.Embedded
+	if embedded.DataDir == "" {
+		embedded.DataDir = DefaultEmbeddedDataDir
+	}
+	if embedded.Log == "" {
+		embedded.Log = DefaultEmbeddedLog
+	}
+	if embedded.StartTimeout == 0 {
+		embedded.StartTimeout = DefaultEmbeddedStartTimeout
+	}
+	if embedded.Port < 0 || embedded.Port > 65535 || embedded.StartTimeout < 0 {
+		problems.add("%s.surrealdb-embedded port or start-timeout is out of range", prefix)
+	}
+	if db.Database == "" {
+		problems.add("%s.surrealdb-database is required", prefix)
+	}
+	retry := &db.Retry
+	if retry.MaxAttempts == 0 {
+		retry.MaxAttempts = DefaultRetryAttempts
+	}
+	if retry.InitialDelay == 0 {
+		retry.InitialDelay = DefaultRetryInitialDelay
+	}
+	if retry.MaxDelay == 0 {
+		retry.MaxDelay = DefaultRetryMaxDelay
+	}
+	if retry.Jitter == 0 {
+		retry.Jitter = DefaultRetryJitter
+	}
+	if retry.MaxAttempts < 0 || retry.InitialDelay < 0 || retry.MaxDelay < 0 {
+		problems.add("%s.surrealdb-retry values must not be negative", prefix)
+	}
+	if retry.Jitter < 0 || retry.Jitter > 1 {
+		problems.add("%s.surrealdb-retry.jitter %v is out of range 0-1", prefix, retry.Jitter)
+	}
+	connection := db.Connection
+	if connection.CompressionLevel < 0 || connection.CompressionLevel > 9 {
+		problems.add("%s.surrealdb-connection.compression-level %d is out of range 1-9", prefix, connection.CompressionLevel)
+	}
+	if connection.ReadLimit < 0 || connection.ReadBufferSize < 0 || connection.WriteBufferSize < 0 || connection.Timeout < 0 {
+		problems.add("%s.surrealdb-connection values must not be negative", prefix)
+	}
+	if db.Pool.Size < 0 || db.Pool.HealthInterval < 0 {
+		problems.add("%s.surrealdb-pool values must not be negative", prefix)
+	}
+	if (db.Username == "") != (db.Password == "") {
+		problems.add("%s.surrealdb-username and surrealdb-password must be set together", prefix)
+	}
+}
@@ -0,0 +1,156 @@
+package ghostutils
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// RestartFields are the config paths read only at startup. Changing
+// one in a running instance has no effect until it restarts.
+var RestartFields = []string{
+	"port",
+	"views",
+	"surrealdb.surrealdb-url",
+	"surrealdb.surrealdb-username",
+	"surrealdb.surrealdb-password",
+	"surrealdb.surrealdb-database",
+	"surrealdb.surrealdb-namespace",
+}
+
+// RestartRequired returns the RestartFields that differ between old
+// and updated.
+func RestartRequired(old, updated GhostConfig) []string {
+	oldValues, newValues := configValues(old), configValues(updated)
+	var changed []string
+	for _, path := range RestartFields {
+		if oldValues[path] != newValues[path] {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// configValues flattens the scalar fields of a config by yaml path.
+func configValues(ghostConfig GhostConfig) map[string]interface{} {
+	values := map[string]interface{}{}
+	var walk func(v reflect.Value, path string)
+	walk = func(v reflect.Value, path string) {
+		if v.Kind() != reflect.Struct {
+			if v.Type().Comparable() {
+				values[path] = v.Interface()
+			}
+			return
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if field.PkgPath != "" || name == "-" || name == "" {
+				continue
+			}
+			walk(v.Field(i), joinConfigPath(path, name))
+		}
+	}
+	walk(reflect.ValueOf(ghostConfig), "")
+	return values
+}
+
+// Watch reloads the file ghostConfig was loaded from whenever it
+// changes and calls onChange with the previous and the new config.
+// The file is reloaded with the same profile and goes through the same
+// interpolation and validation; a config that fails to load is logged
+// and ignored, so onChange only ever sees valid configs. Changes to
+// RestartFields are logged as requiring a restart.
+//
+// The directory is watched rather than the file so editors that save
+// by renaming and Kubernetes ConfigMap updates are picked up. Watch
+// returns once the watcher is running and stops when ctx is done.
+//
+// Example:
+//  err := ghostConfig.Watch(ctx, func(old, updated ghostutils.GhostConfig) {
+//      limiter.SetLimit(updated.LoginGuard.MaxAttempts)
+//  })
+//
+// Returns:
+//  error if the file cannot be watched
+func (ghostConfig GhostConfig) Watch(ctx context.Context, onChange func(old, updated GhostConfig)) error {
+	path := ghostConfig.Path
+	if path == "" {
+		path = "./ghost.yaml"
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	var (
+		mu      sync.Mutex
+		current = ghostConfig
+		timer   *time.Timer
+	)
+	reload := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		updated, err := loadConfig(path, current.Env)
+		if err != nil {
+			log.Printf("config: reloading %s: %v", path, err)
+			return
+		}
+		if reflect.DeepEqual(current, updated) {
+			return
+		}
+		if restart := RestartRequired(current, updated); len(restart) > 0 {
+			log.Printf("config: %s changed and requires a restart to take effect", strings.Join(restart, ", "))
+		}
+		old := current
+		current = updated
+		onChange(old, updated)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// ConfigMaps swap a ..data symlink instead of writing the file
+				name := filepath.Base(event.Name)
+				if name != filepath.Base(path) && name != "..data" {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				// editors emit several events per save
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(100*time.Millisecond, reload)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("config: watching %s: %v", path, err)
+			}
+		}
+	}()
+	return nil
+}
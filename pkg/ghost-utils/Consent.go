@@ -0,0 +1,233 @@
+package ghostutils
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Consent categories. Necessary cookies never need consent, the
+// others are opt in.
+const (
+	ConsentNecessary = "necessary"
+	ConsentCookies   = "cookies"
+	ConsentAnalytics = "analytics"
+	ConsentMarketing = "marketing"
+)
+
+// consentTokenPurpose is the purpose of the signed consent cookie.
+const consentTokenPurpose = "consent"
+
+// ConsentKey is the gin context key holding the request's Consent.
+const ConsentKey = "ghost-consent"
+
+// Consent is the set of categories a visitor agreed to.
+type Consent struct {
+	Categories map[string]bool `json:"categories"`
+	Version    string          `json:"version,omitempty"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// Allows reports whether the visitor consented to category.
+func (c Consent) Allows(category string) bool {
+	return category == ConsentNecessary || c.Categories[category]
+}
+
+// ConsentManager stores consent in a signed cookie and, for
+// authenticated users, in the consent table as proof of consent.
+type ConsentManager struct {
+	Signer *Signer
+	DB     *surrealdb.DB
+	// Categories offered in the banner, in display order.
+	Categories []string
+	// Version is bumped when the categories change so visitors are
+	// asked again.
+	Version string
+	// CookieName defaults to "ghost_consent", Table to "consent".
+	CookieName string
+	Table      string
+	MaxAge     time.Duration
+	Secure     bool
+}
+
+type consentRecord struct {
+	User       string          `json:"user"`
+	Categories map[string]bool `json:"categories"`
+	Version    string          `json:"version"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"user_agent"`
+	At         time.Time       `json:"at"`
+}
+
+func (m *ConsentManager) cookieName() string {
+	if m.CookieName == "" {
+		return "ghost_consent"
+	}
+	return m.CookieName
+}
+
+// Middleware loads the visitor's consent from the cookie into the
+// context. Consent given for an older Version is ignored.
+func (m *ConsentManager) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var consent Consent
+		if token, err := c.Cookie(m.cookieName()); err == nil {
+			if m.Signer.VerifyToken(consentTokenPurpose, token, &consent) != nil || consent.Version != m.Version {
+				consent = Consent{}
+			}
+		}
+		c.Set(ConsentKey, consent)
+		c.Next()
+	}
+}
+
+// CurrentConsent returns the consent loaded by Middleware.
+func CurrentConsent(c *gin.Context) (Consent, bool) {
+	value, ok := c.Get(ConsentKey)
+	consent, _ := value.(Consent)
+	return consent, ok && !consent.UpdatedAt.IsZero()
+}
+
+// HasConsent reports whether the visitor consented to category.
+func HasConsent(c *gin.Context, category string) bool {
+	consent, _ := CurrentConsent(c)
+	return consent.Allows(category)
+}
+
+// RequireConsent gates a non-essential integration, such as an
+// analytics beacon or marketing pixel, on consent for category.
+func RequireConsent(category string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasConsent(c, category) {
+			Fail(c, NewGhostError(http.StatusForbidden, "consent_required", "consent required").WithDetails(gin.H{"category": category}))
+			return
+		}
+		c.Next()
+	}
+}
+
+// Mount registers POST /consent on g. The request carries the
+// accepted categories as repeated "category" form values or a JSON
+// {"categories": [...]} body, and a CSRF token checked by the CSRF
+// middleware, see RequireCSRF. Forms are redirected to their "next"
+// value or the referring page, when either is a local path.
+func (m *ConsentManager) Mount(g *gin.RouterGroup) {
+	g.POST("/consent", RequireCSRF(), m.save)
+}
+
+func (m *ConsentManager) save(c *gin.Context) {
+	var body struct {
+		Categories []string `json:"categories" form:"category"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		FailStatus(c, http.StatusBadRequest, err)
+		return
+	}
+	consent := Consent{Categories: map[string]bool{}, Version: m.Version, UpdatedAt: time.Now().UTC()}
+	for _, category := range m.Categories {
+		consent.Categories[category] = false
+	}
+	for _, category := range body.Categories {
+		if _, offered := consent.Categories[category]; offered {
+			consent.Categories[category] = true
+		}
+	}
+	maxAge := m.MaxAge
+	if maxAge == 0 {
+		maxAge = 180 * 24 * time.Hour
+	}
+	token, err := m.Signer.SignToken(consentTokenPurpose, consent, maxAge)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(m.cookieName(), token, int(maxAge.Seconds()), "/", "", m.Secure, true)
+	c.Set(ConsentKey, consent)
+
+	if identity, ok := CurrentIdentity(c); ok && m.DB != nil {
+		table := m.Table
+		if table == "" {
+			table = "consent"
+		}
+		if _, err := m.DB.Create(table, consentRecord{
+			User:       identity.ID,
+			Categories: consent.Categories,
+			Version:    consent.Version,
+			IP:         c.ClientIP(),
+			UserAgent:  c.Request.UserAgent(),
+			At:         consent.UpdatedAt,
+		}); err != nil {
+			Fail(c, err)
+			return
+		}
+	}
+	if next := consentRedirect(c); next != "" && c.ContentType() != gin.MIMEJSON {
+		c.Redirect(http.StatusSeeOther, next)
+		return
+	}
+	c.JSON(http.StatusOK, consent)
+}
+
+// consentRedirect returns the local path a consent form goes back to:
+// its next value, or the path of a referer on this host.
+func consentRedirect(c *gin.Context) string {
+	if next := c.PostForm("next"); localRedirect(next) {
+		return next
+	}
+	ref, err := url.Parse(c.Request.Referer())
+	if err != nil || ref.Host != c.Request.Host || !localRedirect(ref.RequestURI()) {
+		return ""
+	}
+	return ref.RequestURI()
+}
+
+// ConsentData returns the values the banner template needs. Pass it
+// to the page as .Consent.
+func (m *ConsentManager) ConsentData(c *gin.Context) gin.H {
+	consent, given := CurrentConsent(c)
+	return gin.H{
+		"Given":      given,
+		"Categories": m.Categories,
+		"Consent":    consent,
+		"CSRF":       CSRFToken(c),
+	}
+}
+
+var consentBannerTemplate = template.Must(template.New("consent-banner").Parse(`
+{{- if not .Given -}}
+<form class="ghost-consent" method="post" action="{{ .Action }}">
+  <input type="hidden" name="_csrf" value="{{ .CSRF }}">
+  <p>We use cookies to improve your experience. Choose what you allow.</p>
+  {{- range .Categories }}
+  <label><input type="checkbox" name="category" value="{{ . }}"> {{ . }}</label>
+  {{- end }}
+  <button type="submit">Save</button>
+</form>
+{{- end -}}`))
+
+// FuncMap returns template helpers for consent:
+//  hasConsent .Consent.Consent "marketing"
+//  consentBanner .Consent "/consent"
+func (m *ConsentManager) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"hasConsent": func(consent Consent, category string) bool {
+			return consent.Allows(category)
+		},
+		"consentBanner": func(data gin.H, action string) (template.HTML, error) {
+			var buf bytes.Buffer
+			err := consentBannerTemplate.Execute(&buf, gin.H{
+				"Given":      data["Given"],
+				"Categories": data["Categories"],
+				"Action":     action,
+				"CSRF":       data["CSRF"],
+			})
+			return template.HTML(buf.String()), err
+		},
+	}
+}
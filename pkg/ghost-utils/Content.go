@@ -0,0 +1,503 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// ContentEntry is one markdown file of a Collection.
+type ContentEntry[T any] struct {
+	// Slug is the path of the file without its extension, e.g.
+	// "2024/hello-world", or the slug of its front matter. An index.md
+	// takes the slug of its directory.
+	Slug string
+	Path string
+	// Meta is the front matter decoded into T, Params the same as a
+	// map, which filters and sorts read.
+	Meta     T
+	Params   map[string]interface{}
+	Body     template.HTML
+	Markdown string
+	Modified time.Time
+}
+
+// Collection is a directory of markdown files with YAML front matter,
+// loaded into memory so blog posts and docs are served without a
+// database. Entries are queried with the same ListFilter as records,
+// by front matter key or "slug", and a front matter of draft: true
+// hides an entry unless Drafts is set.
+//
+// Example:
+//  type Post struct {
+//      Title string    `yaml:"title"`
+//      Date  time.Time `yaml:"date"`
+//      Tags  []string  `yaml:"tags"`
+//  }
+//
+//  // src/content/posts/hello-world.md:
+//  //  ---
+//  //  title: Hello world
+//  //  date: 2024-06-01
+//  //  tags: [intro]
+//  //  ---
+//  //  # Hello
+//
+//  posts, err := ghostutils.OpenCollection[Post](filepath.Join(ghostConfig.Content, "posts"), gin.IsDebugging())
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  r.GET("/blog/:slug", posts.Handler("post.html"))
+//
+//  latest := posts.Query(ghostutils.ListFilter{
+//      Conditions: []ghostutils.FilterCondition{{Field: "tags", Op: ghostutils.FilterContains, Value: "intro"}},
+//      Sort:       []ghostutils.SortField{{Field: "date", Desc: true}},
+//  })
+type Collection[T any] struct {
+	FS fs.FS
+	// Drafts includes entries marked draft, usually in development.
+	Drafts bool
+	// Markdown renders the bodies. Defaults to GitHub flavored markdown
+	// with heading ids; raw HTML is left out unless the renderer allows
+	// it.
+	Markdown goldmark.Markdown
+	mu       sync.RWMutex
+	entries  []ContentEntry[T]
+	bySlug   map[string]int
+}
+
+// contentExtensions are the file extensions loaded as entries.
+var contentExtensions = map[string]bool{".md": true, ".markdown": true}
+
+// NewCollection returns an empty collection over fsys, call Load to
+// read it.
+func NewCollection[T any](fsys fs.FS) *Collection[T] {
+	return &Collection[T]{FS: fsys, bySlug: map[string]int{}}
+}
+
+// OpenCollection loads the collection in dir. With dev set drafts are
+// included and the files are reloaded whenever they change.
+//
+// Returns:
+//  *Collection[T]
+//  error if a file cannot be read or its front matter parsed
+func OpenCollection[T any](dir string, dev bool) (*Collection[T], error) {
+	collection := NewCollection[T](os.DirFS(dir))
+	collection.Drafts = dev
+	if err := collection.Load(); err != nil {
+		return nil, err
+	}
+	if dev {
+		if err := collection.Watch(context.Background(), dir); err != nil {
+			return nil, err
+		}
+	}
+	return collection, nil
+}
+
+// Load reads every markdown file of the collection, replacing the
+// entries at once so readers never see a partial collection.
+func (c *Collection[T]) Load() error {
+	markdown := c.Markdown
+	if markdown == nil {
+		markdown = goldmark.New(
+			goldmark.WithExtensions(extension.GFM),
+			goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+		)
+	}
+	var entries []ContentEntry[T]
+	bySlug := map[string]int{}
+	err := fs.WalkDir(c.FS, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !contentExtensions[path.Ext(name)] {
+			return err
+		}
+		entry, err := c.loadEntry(markdown, name, d)
+		if err != nil {
+			return fmt.Errorf("content %s: %w", name, err)
+		}
+		if draft, _ := entry.Params["draft"].(bool); draft && !c.Drafts {
+			return nil
+		}
+		if other, ok := bySlug[entry.Slug]; ok {
+			return fmt.Errorf("content %s: slug %q is already used by %s", name, entry.Slug, entries[other].Path)
+		}
+		bySlug[entry.Slug] = len(entries)
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.entries, c.bySlug = entries, bySlug
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Collection[T]) loadEntry(markdown goldmark.Markdown, name string, d fs.DirEntry) (ContentEntry[T], error) {
+	entry := ContentEntry[T]{Path: name, Params: map[string]interface{}{}}
+	raw, err := fs.ReadFile(c.FS, name)
+	if err != nil {
+		return entry, err
+	}
+	if info, err := d.Info(); err == nil {
+		entry.Modified = info.ModTime()
+	}
+	front, body := splitFrontMatter(raw)
+	if len(front) > 0 {
+		if err := yaml.Unmarshal(front, &entry.Meta); err != nil {
+			return entry, err
+		}
+		if err := yaml.Unmarshal(front, &entry.Params); err != nil {
+			return entry, err
+		}
+	}
+	entry.Slug = strings.TrimSuffix(name, path.Ext(name))
+	if dir, file := path.Split(entry.Slug); file == "index" && dir != "" {
+		entry.Slug = strings.TrimSuffix(dir, "/")
+	}
+	if slug, ok := entry.Params["slug"].(string); ok && slug != "" {
+		entry.Slug = strings.Trim(slug, "/")
+	}
+	var html bytes.Buffer
+	if err := markdown.Convert(body, &html); err != nil {
+		return entry, err
+	}
+	entry.Markdown = string(body)
+	entry.Body = template.HTML(html.String())
+	return entry, nil
+}
+
+// splitFrontMatter splits the YAML between the leading --- lines from
+// the markdown after them.
+func splitFrontMatter(raw []byte) (front, body []byte) {
+	normalized := bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	if !bytes.HasPrefix(normalized, []byte("---\n")) {
+		return nil, raw
+	}
+	rest := normalized[len("---\n"):]
+	if bytes.HasPrefix(rest, []byte("---\n")) {
+		return nil, rest[len("---\n"):]
+	}
+	end := bytes.Index(rest, []byte("\n---\n"))
+	if end < 0 {
+		if !bytes.HasSuffix(rest, []byte("\n---")) {
+			return nil, raw
+		}
+		return rest[:len(rest)-len("\n---")], nil
+	}
+	return rest[:end], rest[end+len("\n---\n"):]
+}
+
+// Watch reloads the collection whenever a file under dir, the
+// directory of its FS, changes, until ctx is done. A reload that
+// fails is logged and the previous entries are kept.
+func (c *Collection[T]) Watch(ctx context.Context, dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// fsnotify does not watch subdirectories on its own
+	err = filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return watcher.Add(name)
+	})
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	var timer *time.Timer
+	reload := func() {
+		if err := c.Load(); err != nil {
+			log.Printf("content: reloading %s: %v", dir, err)
+		}
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						watcher.Add(event.Name)
+					}
+				}
+				// editors emit several events per save
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(100*time.Millisecond, reload)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("content: watching %s: %v", dir, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// All returns the entries in slug order.
+func (c *Collection[T]) All() []ContentEntry[T] {
+	return c.Query()
+}
+
+// Get returns the entry with slug.
+func (c *Collection[T]) Get(slug string) (ContentEntry[T], bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	i, ok := c.bySlug[strings.Trim(slug, "/")]
+	if !ok {
+		return ContentEntry[T]{}, false
+	}
+	return c.entries[i], true
+}
+
+// Query returns the entries matching every condition of filters,
+// sorted by the sort of the first filter with one, in slug order
+// otherwise. Entries without a sorted key come last.
+func (c *Collection[T]) Query(filters ...ListFilter) []ContentEntry[T] {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var order []SortField
+	matched := make([]ContentEntry[T], 0, len(c.entries))
+	for _, filter := range filters {
+		if order == nil && len(filter.Sort) > 0 {
+			order = filter.Sort
+		}
+	}
+entries:
+	for _, entry := range c.entries {
+		for _, filter := range filters {
+			for _, cond := range filter.Conditions {
+				if !contentMatches(entry.value(cond.Field), cond) {
+					continue entries
+				}
+			}
+		}
+		matched = append(matched, entry)
+	}
+	if order == nil {
+		order = []SortField{{Field: "slug"}}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		for _, key := range order {
+			a, b := matched[i].value(key.Field), matched[j].value(key.Field)
+			switch {
+			case a == nil && b == nil:
+				continue
+			case a == nil:
+				return false
+			case b == nil:
+				return true
+			}
+			cmp, ok := contentCompare(a, b)
+			if !ok || cmp == 0 {
+				continue
+			}
+			return (cmp < 0) != key.Desc
+		}
+		return false
+	})
+	return matched
+}
+
+// Page returns one page of Query, numbered from 1.
+func (c *Collection[T]) Page(page, perPage int, filters ...ListFilter) Page[ContentEntry[T]] {
+	if page < 1 {
+		page = 1
+	}
+	matched := c.Query(filters...)
+	result := Page[ContentEntry[T]]{Page: page, PerPage: perPage, Total: len(matched), Items: []ContentEntry[T]{}}
+	start := (page - 1) * perPage
+	if perPage <= 0 || start >= len(matched) {
+		return result
+	}
+	end := start + perPage
+	if end > len(matched) {
+		end = len(matched)
+	}
+	result.Items = matched[start:end]
+	return result
+}
+
+// Handler renders the template name with the entry of the slug route
+// parameter as "Entry", answering 404 for unknown slugs. Use a
+// *slug wildcard for nested slugs.
+//
+// Example:
+//  r.GET("/docs/*slug", docs.Handler("doc.html"))
+//
+//  // doc.html: <h1>{{.Entry.Meta.Title}}</h1>{{.Entry.Body}}
+func (c *Collection[T]) Handler(name string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		entry, ok := c.Get(ctx.Param("slug"))
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if !entry.Modified.IsZero() {
+			ctx.Header("Last-Modified", entry.Modified.UTC().Format(http.TimeFormat))
+		}
+		HTML(ctx, http.StatusOK, name, gin.H{"Entry": entry})
+	}
+}
+
+// value returns the front matter value of a dotted field, or the slug.
+func (e ContentEntry[T]) value(field string) interface{} {
+	if field == "slug" {
+		return e.Slug
+	}
+	return tableValue(e.Params, field)
+}
+
+func contentMatches(value interface{}, cond FilterCondition) bool {
+	equal := func(a, b interface{}) bool {
+		cmp, ok := contentCompare(a, b)
+		return ok && cmp == 0
+	}
+	if value == nil {
+		return cond.Op == FilterNe
+	}
+	switch cond.Op {
+	case FilterEq:
+		return equal(value, cond.Value)
+	case FilterNe:
+		return !equal(value, cond.Value)
+	case FilterIn:
+		list, _ := cond.Value.([]interface{})
+		for _, candidate := range list {
+			if equal(value, candidate) {
+				return true
+			}
+		}
+		return false
+	case FilterContains:
+		if list, ok := value.([]interface{}); ok {
+			for _, element := range list {
+				if equal(element, cond.Value) {
+					return true
+				}
+			}
+			return false
+		}
+		text, ok := value.(string)
+		return ok && strings.Contains(text, fmt.Sprint(cond.Value))
+	}
+	cmp, ok := contentCompare(value, cond.Value)
+	if !ok {
+		return false
+	}
+	switch cond.Op {
+	case FilterGt:
+		return cmp > 0
+	case FilterGte:
+		return cmp >= 0
+	case FilterLt:
+		return cmp < 0
+	case FilterLte:
+		return cmp <= 0
+	}
+	return false
+}
+
+// contentCompare compares two front matter or filter values, as times,
+// numbers, strings or booleans. ok is false when they do not compare.
+func contentCompare(a, b interface{}) (cmp int, ok bool) {
+	if at, ok := contentTime(a); ok {
+		if bt, ok := contentTime(b); ok {
+			switch {
+			case at.Before(bt):
+				return -1, true
+			case at.After(bt):
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if an, ok := contentNumber(a); ok {
+		if bn, ok := contentNumber(b); ok {
+			switch {
+			case an < bn:
+				return -1, true
+			case an > bn:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, true
+			case b:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func contentTime(value interface{}) (time.Time, bool) {
+	switch value := value.(type) {
+	case time.Time:
+		return value, true
+	case string:
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+			if at, err := time.Parse(layout, value); err == nil {
+				return at, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func contentNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
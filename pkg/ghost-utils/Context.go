@@ -0,0 +1,124 @@
+package ghostutils
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextDB is a GhostDB whose calls give up once its context is done.
+type contextDB struct {
+	ctx context.Context
+	db  GhostDB
+}
+
+// WithContext returns db bound to ctx: its calls return ctx.Err() once
+// ctx is canceled or past its deadline, without waiting for SurrealDB.
+// The driver cannot cancel a request it sent, so SurrealDB still runs
+// it; its result is dropped. The Repository methods and the functions
+// taking a ctx bind their queries this way. A *gin.Context is bound to
+// its request, so the client leaving or a deadline of RequestTimeout
+// ends the queries of a handler passing c.
+//
+// Example:
+//  ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+//  defer cancel()
+//  err := ghostutils.WithTransaction(ghostutils.WithContext(ctx, db), func(tx *ghostutils.Tx) error {
+//      tx.Query("UPDATE account:1 SET balance -= 10", nil)
+//      tx.Query("UPDATE account:2 SET balance += 10", nil)
+//      return nil
+//  })
+func WithContext(ctx context.Context, db GhostDB) GhostDB {
+	ctx = cancelContext(ctx)
+	if ctx == nil || (ctx.Done() == nil && RequestBudget(ctx) == nil) {
+		return db
+	}
+	if bound, ok := db.(contextDB); ok {
+		db = bound.db
+	}
+	return contextDB{ctx: ctx, db: db}
+}
+
+// cancelContext returns the context whose Done ends the work of ctx:
+// the request of a *gin.Context, whose own Done is nil unless the
+// engine sets ContextWithFallback.
+func cancelContext(ctx context.Context) context.Context {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		return c.Request.Context()
+	}
+	return ctx
+}
+
+// run calls fn, returning early with the error of the context, and
+// counts it in the budget of the request.
+func (d contextDB) run(fn func() (interface{}, error)) (interface{}, error) {
+	if err := d.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := spendQuery(d.ctx); err != nil {
+		return nil, err
+	}
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-d.ctx.Done():
+		return nil, d.ctx.Err()
+	}
+}
+
+func (d contextDB) Query(sql string, vars interface{}) (interface{}, error) {
+	return d.run(func() (interface{}, error) { return d.db.Query(sql, vars) })
+}
+
+func (d contextDB) Create(thing string, data interface{}) (interface{}, error) {
+	return d.run(func() (interface{}, error) { return d.db.Create(thing, data) })
+}
+
+func (d contextDB) Select(what string) (interface{}, error) {
+	return d.run(func() (interface{}, error) { return d.db.Select(what) })
+}
+
+func (d contextDB) Update(what string, data interface{}) (interface{}, error) {
+	return d.run(func() (interface{}, error) { return d.db.Update(what, data) })
+}
+
+func (d contextDB) Delete(what string) (interface{}, error) {
+	return d.run(func() (interface{}, error) { return d.db.Delete(what) })
+}
+
+func (d contextDB) Signin(vars interface{}) (interface{}, error) {
+	return d.run(func() (interface{}, error) { return d.db.Signin(vars) })
+}
+
+func (d contextDB) Use(ns, database string) (interface{}, error) {
+	return d.run(func() (interface{}, error) { return d.db.Use(ns, database) })
+}
+
+// RequestTimeout bounds each request to d: the request context gets
+// the deadline, so the queries bound to it end with
+// context.DeadlineExceeded, which Fail answers 504.
+//
+// Example:
+//  api := r.Group("/api", ghostutils.RequestTimeout(5*time.Second))
+func RequestTimeout(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		if ctx.Err() == context.DeadlineExceeded && !c.Writer.Written() {
+			c.AbortWithStatus(http.StatusGatewayTimeout)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package ghostutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// PageCursors keeps the cursors of PaginateStored server side: clients
+// get an opaque token, the position and the total of the list stay in
+// the store for TTL. The token only works for the query it was made
+// for, so it can neither be forged nor replayed against another filter.
+type PageCursors struct {
+	// Store keeps the cursors, the cache of the app when nil, see
+	// AppFrom, so a redis cache shares them between the instances of
+	// the app.
+	Store CacheStore
+	// TTL is the lifetime of a cursor, DefaultCursorTTL when 0.
+	TTL time.Duration
+}
+
+// NewPageCursors returns the PageCursors of the cache block, keeping
+// the cursors in the cache of the app for cursor-ttl.
+//
+// Example:
+//  posts := ghostutils.NewRepository[Post](db, "post")
+//  posts.Cursors = ghostConfig.NewPageCursors()
+func (ghostConfig GhostConfig) NewPageCursors() *PageCursors {
+	return &PageCursors{TTL: ghostConfig.Cache.CursorTTL}
+}
+
+// storedCursor is what a token stands for: the cursor of
+// PaginateCursor, the query it belongs to and the total of the list.
+type storedCursor struct {
+	Query  string `json:"q"`
+	Cursor string `json:"c"`
+	Total  int    `json:"t"`
+}
+
+func (s *PageCursors) store(ctx context.Context) CacheStore {
+	if s.Store != nil {
+		return s.Store
+	}
+	return contextCache(ctx)
+}
+
+func (s *PageCursors) ttl() time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return DefaultCursorTTL
+}
+
+func (s *PageCursors) save(ctx context.Context, cursor storedCursor) (string, error) {
+	raw, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	token := randomID(16)
+	return token, s.store(ctx).Set(ctx, "cursor:"+token, raw, s.ttl(), nil)
+}
+
+// load returns the cursor of token, ErrInvalidCursor once it expired.
+func (s *PageCursors) load(ctx context.Context, token string) (storedCursor, error) {
+	var cursor storedCursor
+	raw, ok, err := s.store(ctx).Get(ctx, "cursor:"+token)
+	if err != nil {
+		return cursor, err
+	}
+	if !ok || json.Unmarshal(raw, &cursor) != nil {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// cursorQuery identifies the list a cursor walks.
+func cursorQuery(q *SelectQuery, field string, desc bool) (string, error) {
+	sql, vars, err := q.Build()
+	if err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal([]interface{}{sql, vars, field, desc})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// PaginateStored is PaginateCursor with its cursors kept in cursors:
+// Next and Prev are its tokens, and the total is counted for the
+// first page only, then kept with the cursors, so walking deep into a
+// large list runs a single indexed range query per page. The total
+// does not follow the rows written while the list is walked.
+//
+// Example:
+//  cursors := ghostConfig.NewPageCursors()
+//  cursor, perPage := ghostutils.CursorParams(c, 20, 100)
+//  posts, err := ghostutils.PaginateStored[Post](c, db, cursors, ghostutils.Select().From("post"), "created_at", true, cursor, perPage)
+//  if err != nil {
+//      ghostutils.Fail(c, err)
+//      return
+//  }
+//  ghostutils.RespondPage(c, posts.Envelope(c.Request.URL))
+//
+// Returns:
+//  CursorPage[T] with the rows, the total and the tokens
+//  error if a query fails, ErrInvalidCursor for an unknown or expired
+//  token, or a token of another query
+func PaginateStored[T any](ctx context.Context, db GhostDB, cursors *PageCursors, q *SelectQuery, field string, desc bool, token string, perPage int) (CursorPage[T], error) {
+	query, err := cursorQuery(q, field, desc)
+	if err != nil {
+		return CursorPage[T]{PerPage: perPage}, err
+	}
+	current := storedCursor{Query: query, Total: -1}
+	if token != "" {
+		if current, err = cursors.load(ctx, token); err != nil {
+			return CursorPage[T]{PerPage: perPage}, err
+		}
+		if current.Query != query {
+			return CursorPage[T]{PerPage: perPage}, ErrInvalidCursor
+		}
+	}
+	result, err := paginateCursor[T](WithContext(ctx, db), q, field, desc, current.Cursor, perPage, current.Total)
+	if err != nil {
+		return result, err
+	}
+	for _, cursor := range []*string{&result.Next, &result.Prev} {
+		if *cursor == "" {
+			continue
+		}
+		if *cursor, err = cursors.save(ctx, storedCursor{Query: query, Cursor: *cursor, Total: result.Total}); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
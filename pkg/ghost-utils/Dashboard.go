@@ -0,0 +1,186 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// DashboardMetric is a named value shown on dashboards. It is
+// computed by Func, or by the SurrealQL Query whose first statement
+// result is the value. Values are cached for TTL, 30 seconds by
+// default.
+type DashboardMetric struct {
+	Name  string
+	Query string
+	Vars  map[string]interface{}
+	Func  func(ctx context.Context) (interface{}, error)
+	TTL   time.Duration
+	// Description is shown next to the value by admin templates.
+	Description string
+}
+
+type dashboardValue struct {
+	value interface{}
+	err   error
+	at    time.Time
+}
+
+// Dashboard serves registered metrics to dashboards as JSON, as a
+// server-sent event stream and to templates.
+//
+// Example:
+//  dash := &ghostutils.Dashboard{DB: db}
+//  dash.Register(ghostutils.DashboardMetric{Name: "signups_today", Query: "SELECT count() FROM user WHERE created_at > time::floor(time::now(), 1d) GROUP ALL"})
+//  dash.Register(ghostutils.DashboardMetric{Name: "queue_depth", Func: queue.Depth, TTL: 5 * time.Second})
+//  dash.Mount(r.Group("/", ghostutils.RequireRole(ghostutils.AdminRole)))
+//
+// Templates use {{ metric "signups_today" }} with dash.FuncMap(), and
+// pages refresh with an EventSource on
+// /ghost/metrics-data/stream?names=signups_today,queue_depth.
+type Dashboard struct {
+	DB *surrealdb.DB
+	// RefreshInterval is how often the stream sends values. Defaults
+	// to 5 seconds.
+	RefreshInterval time.Duration
+
+	mu      sync.Mutex
+	metrics map[string]DashboardMetric
+	cache   map[string]dashboardValue
+}
+
+// Register adds a metric, replacing any with the same name.
+func (d *Dashboard) Register(metric DashboardMetric) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.metrics == nil {
+		d.metrics, d.cache = map[string]DashboardMetric{}, map[string]dashboardValue{}
+	}
+	d.metrics[metric.Name] = metric
+	delete(d.cache, metric.Name)
+}
+
+// Names returns the registered metric names, sorted.
+func (d *Dashboard) Names() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.metrics))
+	for name := range d.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Value returns the metric's value, from the cache when fresh.
+func (d *Dashboard) Value(ctx context.Context, name string) (interface{}, error) {
+	d.mu.Lock()
+	metric, ok := d.metrics[name]
+	cached, hit := d.cache[name]
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q", name)
+	}
+	ttl := metric.TTL
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	if hit && time.Since(cached.at) < ttl {
+		return cached.value, cached.err
+	}
+	var (
+		value interface{}
+		err   error
+	)
+	if metric.Func != nil {
+		value, err = metric.Func(ctx)
+	} else {
+		vars := metric.Vars
+		if vars == nil {
+			vars = map[string]interface{}{}
+		}
+		value, err = surrealdb.SmartUnmarshal[interface{}](d.DB.Query(metric.Query, vars))
+		// single row aggregates read better as the row itself
+		if rows, ok := value.([]interface{}); ok && len(rows) == 1 {
+			value = rows[0]
+		}
+	}
+	d.mu.Lock()
+	d.cache[name] = dashboardValue{value: value, err: err, at: time.Now()}
+	d.mu.Unlock()
+	return value, err
+}
+
+// Values returns the values of names, or of every metric when names
+// is empty. Failed metrics are reported as the error envelope of
+// Fail, {"error": {"code": ..., "message": ...}}.
+func (d *Dashboard) Values(ctx context.Context, names []string) map[string]interface{} {
+	if len(names) == 0 {
+		names = d.Names()
+	}
+	out := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		value, err := d.Value(ctx, name)
+		if err != nil {
+			out[name] = Envelope{Error: AsGhostError(err)}
+			continue
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// Mount registers GET /ghost/metrics-data?names=a,b and its server
+// sent event stream GET /ghost/metrics-data/stream?names=a,b, which
+// sends a "metrics" event every RefreshInterval.
+func (d *Dashboard) Mount(g *gin.RouterGroup) {
+	g.GET("/ghost/metrics-data", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, d.Values(c.Request.Context(), splitList(c.Query("names"))))
+	})
+	g.GET("/ghost/metrics-data/stream", func(c *gin.Context) {
+		interval := d.RefreshInterval
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		names := splitList(c.Query("names"))
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		c.Header("Cache-Control", "no-store")
+		c.Header("X-Accel-Buffering", "no")
+		c.SSEvent("metrics", d.Values(c.Request.Context(), names))
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case <-ticker.C:
+				c.SSEvent("metrics", d.Values(c.Request.Context(), names))
+				return true
+			}
+		})
+	})
+}
+
+// FuncMap returns template helpers for dashboards:
+//  metric "signups_today"
+//  metricDescription "signups_today"
+func (d *Dashboard) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"metric": func(name string) (interface{}, error) {
+			return d.Value(context.Background(), name)
+		},
+		"metricDescription": func(name string) string {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			return d.metrics[name].Description
+		},
+	}
+}
@@ -0,0 +1,246 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SurrealDBConfig is one SurrealDB connection of ghost.yaml: the
+// surrealdb block, and every entry of the databases map, whose unset
+// fields are those of the surrealdb block.
+//
+//  surrealdb:
+//      surrealdb-url: ws://localhost:8000/rpc
+//      surrealdb-username: root
+//      surrealdb-password: root
+//      surrealdb-namespace: app
+//      surrealdb-database: users
+//  databases:
+//      analytics:
+//          surrealdb-namespace: events
+//          surrealdb-database: events
+//          surrealdb-pool:
+//              size: 8
+type SurrealDBConfig struct {
+	URL        string           `yaml:"surrealdb-url"`
+	Username   string           `yaml:"surrealdb-username"`
+	Password   string           `yaml:"surrealdb-password"`
+	Database   string           `yaml:"surrealdb-database"`
+	Namespace  string           `yaml:"surrealdb-namespace"`
+	Retry      RetryConfig      `yaml:"surrealdb-retry"`
+	Connection ConnectionConfig `yaml:"surrealdb-connection"`
+	// Pool makes the connection a SurrealPool in ConnectDatabases when
+	// its size is set.
+	Pool PoolConfig `yaml:"surrealdb-pool"`
+	// Embedded runs the server of an embedded:// URL, see EmbeddedScheme.
+	Embedded EmbeddedConfig `yaml:"surrealdb-embedded"`
+}
+
+// DefaultDatabase is the name of the surrealdb block in a
+// DatabaseRegistry.
+const DefaultDatabase = "default"
+
+// DatabasesKey is the gin context key holding the DatabaseRegistry of
+// SetupDatabases.
+const DatabasesKey = "ghost-databases"
+
+// DatabaseRegistry holds the connections of the app by name.
+type DatabaseRegistry struct {
+	dbs     map[string]GhostDB
+	closers []func()
+}
+
+// NewDatabaseRegistry returns an empty DatabaseRegistry.
+func NewDatabaseRegistry() *DatabaseRegistry {
+	return &DatabaseRegistry{dbs: map[string]GhostDB{}}
+}
+
+// Add registers db under name, replacing the one registered before.
+func (reg *DatabaseRegistry) Add(name string, db GhostDB) {
+	reg.dbs[name] = db
+}
+
+// Lookup returns the connection named name.
+func (reg *DatabaseRegistry) Lookup(name string) (GhostDB, bool) {
+	db, ok := reg.dbs[name]
+	return db, ok
+}
+
+// DB returns the connection named name. Routes take their connection
+// while the app is set up, so an unknown name panics.
+//
+// Example:
+//  events := ghostutils.NewRepository[Event](databases.DB("analytics"), "event")
+func (reg *DatabaseRegistry) DB(name string) GhostDB {
+	db, ok := reg.dbs[name]
+	if !ok {
+		panic(fmt.Sprintf("ghost: no database named %q", name))
+	}
+	return db
+}
+
+// Default returns the connection of the surrealdb block.
+func (reg *DatabaseRegistry) Default() GhostDB {
+	return reg.dbs[DefaultDatabase]
+}
+
+// Names returns the names of the connections, sorted.
+func (reg *DatabaseRegistry) Names() []string {
+	names := make([]string, 0, len(reg.dbs))
+	for name := range reg.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes the connections opened by ConnectDatabases.
+func (reg *DatabaseRegistry) Close() {
+	for _, close := range reg.closers {
+		close()
+	}
+	reg.closers = nil
+}
+
+// Middleware makes the registry available to the handlers through
+// Database.
+func (reg *DatabaseRegistry) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(DatabasesKey, reg)
+		c.Next()
+	}
+}
+
+// Database returns the connection named name of the registry installed
+// by SetupDatabases, nil when there is none.
+//
+// Example:
+//  r.GET("/stats", func(c *gin.Context) {
+//      rows, err := ghostutils.Database(c, "analytics").Query("SELECT count() FROM event GROUP ALL", nil)
+//      ...
+//  })
+func Database(c *gin.Context, name string) GhostDB {
+	value, ok := c.Get(DatabasesKey)
+	if !ok {
+		return nil
+	}
+	db, _ := value.(*DatabaseRegistry).Lookup(name)
+	return db
+}
+
+// ConnectDatabases connects the surrealdb block, as DefaultDatabase,
+// and every entry of the databases map. A connection with a
+// surrealdb-pool size is a SurrealPool. With replicas in the
+// read-routing block, the primary is registered as its ReadRouter.
+//
+// Returns:
+//  *DatabaseRegistry, closed by the caller
+//  error naming the connection that failed, after closing the others
+func (ghostConfig GhostConfig) ConnectDatabases(ctx context.Context) (*DatabaseRegistry, error) {
+	reg := NewDatabaseRegistry()
+	if err := reg.connect(ctx, DefaultDatabase, ghostConfig.SurrealDB); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ghostConfig.Databases))
+	for name := range ghostConfig.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := reg.connect(ctx, name, ghostConfig.Databases[name]); err != nil {
+			reg.Close()
+			return nil, err
+		}
+	}
+	if routing := ghostConfig.ReadRouting; len(routing.Replicas) > 0 {
+		router, err := NewReadRouter(ctx, reg, routing)
+		if err != nil {
+			reg.Close()
+			return nil, err
+		}
+		reg.Add(router.primary.Name, router)
+		// the probes stop before the connections close
+		reg.closers = append([]func(){router.Close}, reg.closers...)
+	}
+	return reg, nil
+}
+
+func (reg *DatabaseRegistry) connect(ctx context.Context, name string, config SurrealDBConfig) error {
+	if config.Pool.Size > 0 {
+		pool, err := config.newPool(ctx)
+		if err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+		reg.Add(name, pool)
+		reg.closers = append(reg.closers, pool.Close)
+		return nil
+	}
+	db, err := config.connect(ctx)
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return fmt.Errorf("database %s: %w", name, err)
+	}
+	reg.Add(name, db)
+	reg.closers = append(reg.closers, db.Close)
+	return nil
+}
+
+// SetupDatabases is BasicSurrealSetup for an app with several
+// connections: r is wired from the config, the migrations, health
+// routes and jobs use the DefaultDatabase, the handlers reach the
+// others with Database, and they all close when the app stops.
+//
+// Example:
+//  databases, err := ghostConfig.SetupDatabases(r)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  ghostutils.RegisterRoutes(r, databases.Default(), users)
+//  ghostutils.RegisterRoutes(r, databases.DB("analytics"), events)
+//
+// Returns:
+//  *DatabaseRegistry
+//  error
+func (ghostConfig GhostConfig) SetupDatabases(r *gin.Engine) (*DatabaseRegistry, error) {
+	return ghostConfig.setupDatabases(context.Background(), r, nil, nil)
+}
+
+// SetupDatabasesContext is SetupDatabases bounded by ctx, see
+// SetupContext.
+//
+// Returns:
+//  *DatabaseRegistry
+//  error, wrapping ctx.Err() when ctx ended the setup
+func (ghostConfig GhostConfig) SetupDatabasesContext(ctx context.Context, r *gin.Engine) (*DatabaseRegistry, error) {
+	return ghostConfig.setupDatabases(ctx, r, nil, nil)
+}
+
+func (ghostConfig GhostConfig) setupDatabases(ctx context.Context, r *gin.Engine, templates, static fs.FS) (*DatabaseRegistry, error) {
+	app, err := ghostConfig.wire(r, templates, static)
+	if err != nil {
+		return nil, err
+	}
+	reg, err := ghostConfig.ConnectDatabases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	app.onStop(func(context.Context) error {
+		reg.Close()
+		return nil
+	})
+	if r != nil {
+		r.Use(reg.Middleware())
+	}
+	db := reg.Default()
+	if router, ok := db.(*ReadRouter); ok {
+		// the migrations must read what they wrote
+		db = router.Primary()
+	}
+	return reg, ghostConfig.start(app, db)
+}
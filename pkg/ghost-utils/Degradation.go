@@ -0,0 +1,197 @@
+package ghostutils
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthDegraded is the status of the health routes while a dependency
+// reported with ReportDown is down. The instance keeps serving, so
+// readiness still answers 200.
+const HealthDegraded = "degraded"
+
+// DependencyState is the availability of a dependency the app can do
+// without, such as the cache, search or the mailer.
+type DependencyState struct {
+	Name string `json:"name"`
+	Down bool   `json:"down"`
+	// Reason is the error the dependency went down with.
+	Reason string `json:"reason,omitempty"`
+	// Since is when the dependency last went down or came back.
+	Since time.Time `json:"since"`
+}
+
+// dependencies holds the state reported for every dependency and the
+// hooks of OnDegrade.
+var dependencies = struct {
+	sync.RWMutex
+	states map[string]DependencyState
+	hooks  map[string][]func(DependencyState)
+}{states: map[string]DependencyState{}, hooks: map[string][]func(DependencyState){}}
+
+// ReportDown marks the dependency name down with err, so Degraded
+// reports it and the health routes list it. The hooks of OnDegrade run
+// when it was up.
+//
+// Example:
+//  if err := search.Index(post); err != nil {
+//      ghostutils.ReportDown("search", err)
+//  }
+func ReportDown(name string, err error) {
+	reason := "unavailable"
+	if err != nil {
+		reason = err.Error()
+	}
+	reportDependency(DependencyState{Name: name, Down: true, Reason: reason})
+}
+
+// ReportUp marks the dependency name available again.
+func ReportUp(name string) {
+	reportDependency(DependencyState{Name: name})
+}
+
+func reportDependency(state DependencyState) {
+	dependencies.Lock()
+	previous, known := dependencies.states[state.Name]
+	if known && previous.Down == state.Down {
+		if state.Down {
+			previous.Reason = state.Reason
+			dependencies.states[state.Name] = previous
+		}
+		dependencies.Unlock()
+		return
+	}
+	state.Since = time.Now()
+	dependencies.states[state.Name] = state
+	hooks := append(append([]func(DependencyState){}, dependencies.hooks[state.Name]...), dependencies.hooks[""]...)
+	dependencies.Unlock()
+	if !known && !state.Down {
+		return
+	}
+	if state.Down {
+		log.Printf("degraded: %s is down: %s", state.Name, state.Reason)
+	} else {
+		log.Printf("degraded: %s is back", state.Name)
+	}
+	for _, hook := range hooks {
+		hook(state)
+	}
+}
+
+// Degraded reports whether the dependency name is down, for handlers
+// and templates to serve less rather than fail.
+//
+// Example:
+//  if ghostutils.Degraded("search") {
+//      posts, err = repo.List(c) // no relevance, but a list
+//  } else {
+//      posts, err = search.Find(c, q)
+//  }
+func Degraded(name string) bool {
+	dependencies.RLock()
+	defer dependencies.RUnlock()
+	return dependencies.states[name].Down
+}
+
+// DependencyStates returns the state of every reported dependency,
+// sorted by name.
+func DependencyStates() []DependencyState {
+	dependencies.RLock()
+	states := make([]DependencyState, 0, len(dependencies.states))
+	for _, state := range dependencies.states {
+		states = append(states, state)
+	}
+	dependencies.RUnlock()
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// OnDegrade runs hook whenever the dependency name goes down or comes
+// back, or every dependency with an empty name.
+//
+// Example:
+//  ghostutils.OnDegrade("mailer", func(state ghostutils.DependencyState) {
+//      if !state.Down {
+//          outbox.Flush(context.Background())
+//      }
+//  })
+func OnDegrade(name string, hook func(DependencyState)) {
+	dependencies.Lock()
+	defer dependencies.Unlock()
+	dependencies.hooks[name] = append(dependencies.hooks[name], hook)
+}
+
+// WatchDependency runs check every interval until ctx ends, reporting
+// the dependency name down while it fails and up once it passes.
+//
+// Example:
+//  go ghostutils.WatchDependency(ctx, "cache", 10*time.Second, func(ctx context.Context) error {
+//      return rdb.Ping(ctx).Err()
+//  })
+func WatchDependency(ctx context.Context, name string, interval time.Duration, check func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		err := check(checkCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ReportDown(name, err)
+		} else {
+			ReportUp(name)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// WithFallback runs fn, or fallback while the dependency name is down.
+// An error of fn reports name down and answers with fallback, a
+// success reports it up. Once down, fn is not tried until name is
+// reported up again, by WatchDependency or ReportUp.
+//
+// Example:
+//  related, _ := ghostutils.WithFallback("search", func() ([]Post, error) {
+//      return search.Related(c, post)
+//  }, func() ([]Post, error) {
+//      return nil, nil
+//  })
+//
+// Returns:
+//  the result of fn, or of fallback
+//  error of fallback
+func WithFallback[V any](name string, fn func() (V, error), fallback func() (V, error)) (V, error) {
+	if Degraded(name) {
+		return fallback()
+	}
+	value, err := fn()
+	if err != nil {
+		ReportDown(name, err)
+		return fallback()
+	}
+	ReportUp(name)
+	return value, nil
+}
+
+// DegradedFuncMap returns degraded, Degraded for templates. Setup adds
+// it to the templates.
+//
+// Example:
+//  {{if degraded "search"}}
+//      <p class="notice">Search is unavailable right now.</p>
+//  {{else}}
+//      <form action="/search">...</form>
+//  {{end}}
+func DegradedFuncMap() template.FuncMap {
+	return template.FuncMap{"degraded": Degraded}
+}
@@ -0,0 +1,576 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// ErrMergeInvalid is returned for merges listing the survivor among
+// the duplicates, or a duplicate twice.
+var ErrMergeInvalid = errors.New("invalid merge")
+
+// MatchKey is a field compared when looking for duplicates. Values
+// are normalized first; equal values score 1, otherwise Fuzzy keys
+// score their Jaro-Winkler similarity and exact keys 0.
+type MatchKey struct {
+	Field     string
+	Weight    float64
+	Normalize func(string) string
+	Fuzzy     bool
+}
+
+// RecordLink is a field of Table holding record ids that must follow
+// a merged record. Array is set for fields holding lists of ids.
+type RecordLink struct {
+	Table string
+	Field string
+	Array bool
+}
+
+// DuplicateMatch is a candidate duplicate and its score in [0, 1].
+type DuplicateMatch struct {
+	ID     string                 `json:"id"`
+	Score  float64                `json:"score"`
+	Record map[string]interface{} `json:"record"`
+}
+
+// DuplicateGroup is a set of records that match each other.
+type DuplicateGroup struct {
+	IDs   []string `json:"ids"`
+	Score float64  `json:"score"`
+}
+
+// Duplicates finds and merges duplicate records of Table.
+//
+// Example:
+//  dupes := &ghostutils.Duplicates{
+//      DB:    db,
+//      Table: "contact",
+//      Keys: []ghostutils.MatchKey{
+//          {Field: "email", Weight: 3, Normalize: ghostutils.NormalizeEmail},
+//          {Field: "phone", Weight: 2, Normalize: ghostutils.NormalizePhone},
+//          {Field: "name", Weight: 1, Normalize: ghostutils.NormalizeName, Fuzzy: true},
+//      },
+//      Edges: []string{"works_at", "attended"},
+//      Links: []ghostutils.RecordLink{{Table: "deal", Field: "contact"}},
+//  }
+//  matches, err := dupes.Find(ctx, "contact:tobie")
+//  err = dupes.Merge(ctx, "contact:tobie", []string{matches[0].ID})
+type Duplicates struct {
+	DB    *surrealdb.DB
+	Table string
+	Keys  []MatchKey
+	// Threshold is the minimum score of a duplicate. Defaults to 0.85.
+	Threshold float64
+	// Edges are graph edge tables whose in and out follow a merge.
+	Edges []string
+	// Links are record link fields that follow a merge.
+	Links []RecordLink
+	// Audit, when set, records every merge.
+	Audit AuditLog
+	// Authorizer, if set, limits finding to the records the caller
+	// may see, through its Scope, and merging to those the caller may
+	// change.
+	Authorizer RecordAuthorizer
+	// BatchSize is the number of records read at once. Defaults to
+	// 1000.
+	BatchSize int
+}
+
+func (d *Duplicates) batchSize() int {
+	if d.BatchSize <= 0 {
+		return 1000
+	}
+	return d.BatchSize
+}
+
+func (d *Duplicates) threshold() float64 {
+	if d.Threshold <= 0 {
+		return 0.85
+	}
+	return d.Threshold
+}
+
+// Score compares two records with the match keys. Keys missing from
+// either record are left out of the score.
+func (d *Duplicates) Score(a, b map[string]interface{}) float64 {
+	var total, weights float64
+	for _, key := range d.Keys {
+		va, vb := normalizedField(a, key), normalizedField(b, key)
+		if va == "" || vb == "" {
+			continue
+		}
+		weight := key.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		weights += weight
+		switch {
+		case va == vb:
+			total += weight
+		case key.Fuzzy:
+			total += weight * JaroWinkler(va, vb)
+		}
+	}
+	if weights == 0 {
+		return 0
+	}
+	return total / weights
+}
+
+func normalizedField(record map[string]interface{}, key MatchKey) string {
+	value, ok := record[key.Field]
+	if !ok || value == nil {
+		return ""
+	}
+	text := strings.TrimSpace(fmt.Sprint(value))
+	if key.Normalize != nil {
+		text = key.Normalize(text)
+	}
+	return text
+}
+
+// pages calls visit with the records of Table the caller may see, in
+// id order and BatchSize at a time, selecting projection.
+func (d *Duplicates) pages(ctx context.Context, projection string, visit func([]map[string]interface{}) error) error {
+	if !identifierPattern.MatchString(d.Table) {
+		return fmt.Errorf("invalid table %q", d.Table)
+	}
+	vars := map[string]interface{}{"tb": d.Table}
+	scope := ""
+	if d.Authorizer != nil {
+		condition, scopeVars, err := d.Authorizer.Scope(ctx)
+		if err != nil {
+			return err
+		}
+		if condition != "" {
+			scope = " AND (" + condition + ")"
+			for name, value := range scopeVars {
+				vars[name] = value
+			}
+		}
+	}
+	batch := d.batchSize()
+	for after := ""; ; {
+		where := "true"
+		if after != "" {
+			where, vars["after"] = "id > type::thing($tb, $after)", after
+		}
+		rows, err := surrealQuery[map[string]interface{}](d.DB, fmt.Sprintf("SELECT %s FROM type::table($tb) WHERE %s%s ORDER BY id LIMIT %d", projection, where, scope, batch), vars)
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+		if err := visit(rows); err != nil {
+			return err
+		}
+		if len(rows) < batch {
+			return nil
+		}
+		_, after = splitRecordID(rows[len(rows)-1]["id"], d.Table)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// record returns a record of Table, checked by check of Authorizer.
+func (d *Duplicates) record(ctx context.Context, id string, write bool) (map[string]interface{}, error) {
+	if !recordIDPattern.MatchString(id) || !strings.HasPrefix(id, d.Table+":") {
+		return nil, fmt.Errorf("invalid record id %q", id)
+	}
+	row, ok, err := surrealFirst[map[string]interface{}](d.DB, "SELECT * FROM "+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", id, surrealdb.ErrNoRow)
+	}
+	if d.Authorizer != nil {
+		check := d.Authorizer.AuthorizeRead
+		if write {
+			check = d.Authorizer.AuthorizeWrite
+		}
+		if err := check(ctx, row); err != nil {
+			return nil, err
+		}
+	}
+	return row, nil
+}
+
+// Find returns the records that look like duplicates of id, best
+// match first. It compares against the whole table, a batch at a
+// time.
+func (d *Duplicates) Find(ctx context.Context, id string) ([]DuplicateMatch, error) {
+	target, err := d.record(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	return d.FindFor(ctx, target)
+}
+
+// FindFor returns the stored records that look like duplicates of
+// record, e.g. before creating it.
+func (d *Duplicates) FindFor(ctx context.Context, record map[string]interface{}) ([]DuplicateMatch, error) {
+	var matches []DuplicateMatch
+	err := d.pages(ctx, "*", func(rows []map[string]interface{}) error {
+		matches = append(matches, d.matches(record, rows)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches, nil
+}
+
+func (d *Duplicates) matches(target map[string]interface{}, records []map[string]interface{}) []DuplicateMatch {
+	var matches []DuplicateMatch
+	for _, record := range records {
+		id, _ := record["id"].(string)
+		if id == "" || id == target["id"] {
+			continue
+		}
+		if score := d.Score(target, record); score >= d.threshold() {
+			matches = append(matches, DuplicateMatch{ID: id, Score: score, Record: record})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches
+}
+
+// Scan groups the whole table into sets of duplicates. Records are
+// only compared within blocks sharing the normalized value of a key,
+// or the first three characters of it for fuzzy keys, which keeps
+// large tables tractable. Only the ids and match keys of the records
+// are read, a batch at a time.
+func (d *Duplicates) Scan(ctx context.Context) ([]DuplicateGroup, error) {
+	projection := []string{"id"}
+	for _, key := range d.Keys {
+		if !identifierPattern.MatchString(key.Field) {
+			return nil, fmt.Errorf("invalid match key %q", key.Field)
+		}
+		projection = append(projection, key.Field)
+	}
+	var records []map[string]interface{}
+	err := d.pages(ctx, strings.Join(projection, ", "), func(rows []map[string]interface{}) error {
+		records = append(records, rows...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	parent := make([]int, len(records))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	best := map[[2]int]float64{}
+	for _, key := range d.Keys {
+		blocks := map[string][]int{}
+		for i, record := range records {
+			value := normalizedField(record, key)
+			if value == "" {
+				continue
+			}
+			if runes := []rune(value); key.Fuzzy && len(runes) > 3 {
+				value = string(runes[:3])
+			}
+			blocks[value] = append(blocks[value], i)
+		}
+		for _, block := range blocks {
+			for x := 0; x < len(block); x++ {
+				for y := x + 1; y < len(block); y++ {
+					pair := [2]int{block[x], block[y]}
+					if _, done := best[pair]; done {
+						continue
+					}
+					score := d.Score(records[pair[0]], records[pair[1]])
+					best[pair] = score
+					if score >= d.threshold() {
+						parent[find(pair[0])] = find(pair[1])
+					}
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	members := map[int][]int{}
+	for i := range records {
+		root := find(i)
+		members[root] = append(members[root], i)
+	}
+	var groups []DuplicateGroup
+	for _, indexes := range members {
+		if len(indexes) < 2 {
+			continue
+		}
+		group := DuplicateGroup{}
+		for _, i := range indexes {
+			id, _ := records[i]["id"].(string)
+			group.IDs = append(group.IDs, id)
+		}
+		sort.Strings(group.IDs)
+		for pair, score := range best {
+			if find(pair[0]) == find(indexes[0]) && score > group.Score {
+				group.Score = score
+			}
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Score > groups[j].Score })
+	return groups, nil
+}
+
+// Merge folds duplicates into survivor in one transaction: fields
+// the survivor lacks are copied from the duplicates, graph edges and
+// record links are re-pointed to the survivor and the duplicates are
+// deleted. Edges are re-pointed by updating in and out, which
+// SurrealDB 1.x permits. Every record must be of Table and, with an
+// Authorizer, changeable by the caller.
+func (d *Duplicates) Merge(ctx context.Context, survivor string, duplicates []string) error {
+	seen := map[string]bool{survivor: true}
+	for _, dup := range duplicates {
+		if seen[dup] {
+			return fmt.Errorf("%s is the survivor or listed twice: %w", dup, ErrMergeInvalid)
+		}
+		seen[dup] = true
+	}
+	for _, table := range d.Edges {
+		if !identifierPattern.MatchString(table) {
+			return fmt.Errorf("invalid edge table %q", table)
+		}
+	}
+	for _, link := range d.Links {
+		if !identifierPattern.MatchString(link.Table) || !identifierPattern.MatchString(link.Field) {
+			return fmt.Errorf("invalid record link %s.%s", link.Table, link.Field)
+		}
+	}
+	survivorRow, err := d.record(ctx, survivor, true)
+	if err != nil {
+		return err
+	}
+	fill := map[string]interface{}{}
+	for _, dup := range duplicates {
+		row, err := d.record(ctx, dup, true)
+		if err != nil {
+			return err
+		}
+		for field, value := range row {
+			if field == "id" || value == nil || value == "" {
+				continue
+			}
+			if existing, has := survivorRow[field]; has && existing != nil && existing != "" {
+				continue
+			}
+			if _, taken := fill[field]; !taken {
+				fill[field] = value
+			}
+		}
+	}
+
+	var sql strings.Builder
+	sql.WriteString("BEGIN TRANSACTION;\n")
+	if len(fill) > 0 {
+		fmt.Fprintf(&sql, "UPDATE %s MERGE $fill;\n", survivor)
+	}
+	for _, dup := range duplicates {
+		for _, edge := range d.Edges {
+			fmt.Fprintf(&sql, "UPDATE %[1]s SET in = %[2]s WHERE in = %[3]s;\n", edge, survivor, dup)
+			fmt.Fprintf(&sql, "UPDATE %[1]s SET out = %[2]s WHERE out = %[3]s;\n", edge, survivor, dup)
+		}
+		for _, link := range d.Links {
+			if link.Array {
+				fmt.Fprintf(&sql, "UPDATE %[1]s SET %[2]s = array::union(array::complement(%[2]s, [%[4]s]), [%[3]s]) WHERE %[2]s CONTAINS %[4]s;\n", link.Table, link.Field, survivor, dup)
+			} else {
+				fmt.Fprintf(&sql, "UPDATE %[1]s SET %[2]s = %[3]s WHERE %[2]s = %[4]s;\n", link.Table, link.Field, survivor, dup)
+			}
+		}
+		fmt.Fprintf(&sql, "DELETE %s;\n", dup)
+	}
+	sql.WriteString("COMMIT TRANSACTION;")
+	statements, err := surrealStatements(d.DB, sql.String(), map[string]interface{}{"fill": fill})
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return fmt.Errorf("merging into %s: %s", survivor, statement.Detail)
+		}
+	}
+	if d.Audit != nil {
+		identity, _ := IdentityFrom(ctx)
+		return d.Audit.Record(ctx, AuditEntry{
+			Action:  "record.merge",
+			Actor:   identity.ID,
+			Subject: survivor,
+			Details: map[string]interface{}{"merged": duplicates},
+		})
+	}
+	return nil
+}
+
+// Mount registers GET /duplicates/:id to list the duplicates of a
+// record and POST /duplicates/merge taking
+// {"survivor": id, "duplicates": [ids]}.
+func (d *Duplicates) Mount(g *gin.RouterGroup) {
+	g.GET("/duplicates/:id", func(c *gin.Context) {
+		matches, err := d.Find(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			FailStatus(c, duplicatesErrorStatus(err, http.StatusInternalServerError), err)
+			return
+		}
+		c.JSON(http.StatusOK, matches)
+	})
+	g.POST("/duplicates/merge", func(c *gin.Context) {
+		var req struct {
+			Survivor   string   `json:"survivor" binding:"required"`
+			Duplicates []string `json:"duplicates" binding:"required,min=1"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			FailStatus(c, http.StatusBadRequest, err)
+			return
+		}
+		if err := d.Merge(c.Request.Context(), req.Survivor, req.Duplicates); err != nil {
+			FailStatus(c, duplicatesErrorStatus(err, http.StatusUnprocessableEntity), err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
+
+func duplicatesErrorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, surrealdb.ErrNoRow):
+		return http.StatusNotFound
+	}
+	return fallback
+}
+
+// NormalizeEmail lowercases an address and drops a +tag from the
+// local part.
+func NormalizeEmail(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	at := strings.LastIndex(s, "@")
+	if at < 0 {
+		return s
+	}
+	local, domain := s[:at], s[at+1:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	return local + "@" + domain
+}
+
+// NormalizePhone keeps the digits of a phone number.
+func NormalizePhone(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// NormalizeName lowercases a name, drops punctuation and collapses
+// whitespace.
+func NormalizeName(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(r)
+		case unicode.IsSpace(r) || r == '-':
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// JaroWinkler returns the Jaro-Winkler similarity of a and b in
+// [0, 1].
+func JaroWinkler(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+	window := len(ra)
+	if len(rb) > window {
+		window = len(rb)
+	}
+	window = window/2 - 1
+	if window < 0 {
+		window = 0
+	}
+	matchedA := make([]bool, len(ra))
+	matchedB := make([]bool, len(rb))
+	matches := 0
+	for i := range ra {
+		lo, hi := i-window, i+window+1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(rb) {
+			hi = len(rb)
+		}
+		for j := lo; j < hi; j++ {
+			if !matchedB[j] && ra[i] == rb[j] {
+				matchedA[i], matchedB[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+	transpositions, j := 0, 0
+	for i := range ra {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if ra[i] != rb[j] {
+			transpositions++
+		}
+		j++
+	}
+	m := float64(matches)
+	jaro := (m/float64(len(ra)) + m/float64(len(rb)) + (m-float64(transpositions)/2)/m) / 3
+	prefix := 0
+	for prefix < 4 && prefix < len(ra) && prefix < len(rb) && ra[prefix] == rb[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
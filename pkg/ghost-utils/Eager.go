@@ -0,0 +1,350 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Link is a record link to a T: the id of the linked record, and the
+// record itself once it is eager loaded with Repository.With. Links
+// are stored as the id, and sent as the record when it is loaded.
+//
+// Example:
+//  type Post struct {
+//      ID       string                      `json:"id,omitempty"`
+//      Title    string                      `json:"title"`
+//      Author   ghostutils.Link[User]       `json:"author"`
+//      Comments []ghostutils.Link[Comment]  `json:"comments"`
+//  }
+//
+//  post, err := posts.With("author", "comments.author").Get(c, id)
+//  name := post.Author.Record.Name
+type Link[T any] struct {
+	ID     string
+	Record *T
+}
+
+// LinkTo returns the link to the record with id.
+func LinkTo[T any](id string) Link[T] {
+	return Link[T]{ID: id}
+}
+
+// Loaded reports whether the linked record was eager loaded.
+func (l Link[T]) Loaded() bool {
+	return l.Record != nil
+}
+
+// linkID implements recordLink.
+func (l Link[T]) linkID() string {
+	return l.ID
+}
+
+// linkRecord implements recordLink.
+func (l Link[T]) linkRecord() interface{} {
+	if l.Record == nil {
+		return nil
+	}
+	return l.Record
+}
+
+func (l Link[T]) MarshalJSON() ([]byte, error) {
+	if l.Record != nil {
+		return json.Marshal(l.Record)
+	}
+	if l.ID == "" {
+		return []byte("null"), nil
+	}
+	return json.Marshal(l.ID)
+}
+
+func (l *Link[T]) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*l = Link[T]{}
+		return nil
+	case len(data) > 0 && data[0] == '"':
+		*l = Link[T]{}
+		return json.Unmarshal(data, &l.ID)
+	}
+	var record T
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	var withID struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(data, &withID)
+	*l = Link[T]{ID: withID.ID, Record: &record}
+	return nil
+}
+
+// recordLink is implemented by Link, whose id is stored on writes and
+// whose loaded record is filtered as the record, see FilterFields.
+type recordLink interface {
+	linkID() string
+	linkRecord() interface{}
+}
+
+// collapseLinks replaces the loaded Links of record in fields, its
+// content, by their ids, so writing a record read With relations
+// keeps its links.
+func collapseLinks(record interface{}, fields map[string]interface{}) {
+	value := reflect.Indirect(reflect.ValueOf(record))
+	if value.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := bindFieldName(field)
+		if _, ok := fields[name]; !ok {
+			continue
+		}
+		switch v := value.Field(i).Interface().(type) {
+		case recordLink:
+			if id := v.linkID(); id != "" {
+				fields[name] = id
+			}
+		default:
+			if value.Field(i).Kind() != reflect.Slice || !value.Field(i).Type().Elem().Implements(reflect.TypeOf((*recordLink)(nil)).Elem()) {
+				continue
+			}
+			ids := make([]string, value.Field(i).Len())
+			for j := range ids {
+				ids[j] = value.Field(i).Index(j).Interface().(recordLink).linkID()
+			}
+			fields[name] = ids
+		}
+	}
+}
+
+// With returns a copy of the repository whose reads eager load the
+// relations, in the same query. A relation is the path of a record
+// link, or of an array of them, such as "author" or nested as
+// "comments.author", or a graph traversal given as its field, like
+// "authors=<-wrote<-user". The fields holding them are Links; fields
+// of graph traversals are computed, so tag them omitempty and leave
+// them empty in writes.
+//
+// Linked records are read as their table allows: each one must pass
+// the authorizer registered for its table with RegisterAuthorizer, or
+// it is sent as null, and the fields of its Link the caller may not
+// view are cleared, see RedactFields. Reads fail for links to tables
+// without a registered authorizer.
+//
+// Example:
+//  ghostutils.RegisterAuthorizer("user", ghostutils.OwnerAuthorizer{OrgField: "org"})
+//  ghostutils.RegisterAuthorizer("tag", nil)   // anyone may read tags
+//  posts, err := repo.With("author", "comments.author", "tags=->tagged->tag").List(c, filter)
+func (r *Repository[T]) With(relations ...string) *Repository[T] {
+	eager := *r
+	eager.fetch = append([]string{}, r.fetch...)
+	eager.graph = append([]string{}, r.graph...)
+	for _, relation := range relations {
+		name, path, graph := strings.Cut(relation, "=")
+		name = strings.TrimSpace(name)
+		if graph {
+			path = strings.TrimSpace(path)
+			if !graphPattern.MatchString(path) || !identifierPattern.MatchString(name) {
+				eager.eagerErr = fmt.Errorf("invalid relation %q", relation)
+				continue
+			}
+			eager.graph = append(eager.graph, path+" AS "+name)
+		} else if !identifierPattern.MatchString(name) {
+			eager.eagerErr = fmt.Errorf("invalid relation %q", relation)
+			continue
+		}
+		// nested links are fetched along with the links holding them
+		parts := strings.Split(name, ".")
+		for i := range parts {
+			if path := strings.Join(parts[:i+1], "."); !containsString(eager.fetch, path) {
+				eager.fetch = append(eager.fetch, path)
+			}
+		}
+	}
+	return &eager
+}
+
+// eagerSQL returns the projections and FETCH clause of the relations
+// of With.
+func (r *Repository[T]) eagerSQL() (projection, fetch string) {
+	projection = "*"
+	if len(r.graph) > 0 {
+		projection += ", " + strings.Join(r.graph, ", ")
+	}
+	if len(r.fetch) > 0 {
+		fetch = " FETCH " + strings.Join(r.fetch, ", ")
+	}
+	return projection, fetch
+}
+
+// fetchAuthorizers are the authorizers of the tables records are
+// fetched from, see RegisterAuthorizer.
+var fetchAuthorizers = struct {
+	sync.RWMutex
+	tables map[string]RecordAuthorizer
+}{tables: map[string]RecordAuthorizer{}}
+
+// RegisterAuthorizer sets the authorizer of the records of table that
+// Repository.With inlines into the records of other tables; a nil
+// authorizer lets anyone read them. Register before serving.
+//
+// Example:
+//  ghostutils.RegisterAuthorizer("user", users.Authorizer)
+func RegisterAuthorizer(table string, authorizer RecordAuthorizer) {
+	fetchAuthorizers.Lock()
+	defer fetchAuthorizers.Unlock()
+	fetchAuthorizers.tables[table] = authorizer
+}
+
+// fetchAuthorizer returns the authorizer of table, the one of the
+// repository for its own table.
+func (r *Repository[T]) fetchAuthorizer(table string) (RecordAuthorizer, error) {
+	fetchAuthorizers.RLock()
+	authorizer, ok := fetchAuthorizers.tables[table]
+	fetchAuthorizers.RUnlock()
+	switch {
+	case ok:
+		return authorizer, nil
+	case table == r.Table:
+		return r.Authorizer, nil
+	}
+	return nil, fmt.Errorf("fetch of %s: no authorizer registered for the table, see RegisterAuthorizer", table)
+}
+
+// fetched returns rows read With relations as records, with the
+// linked records the caller may not see replaced by null and the
+// fields of the others redacted.
+func (r *Repository[T]) fetched(ctx context.Context, rows []map[string]interface{}) ([]T, error) {
+	for _, row := range rows {
+		if err := r.guardFetched(ctx, row); err != nil {
+			return nil, err
+		}
+	}
+	records, err := unmarshalRows[T](rows)
+	if err != nil {
+		return nil, err
+	}
+	identity, _ := IdentityFrom(ctx)
+	for i := range records {
+		redactLinks(reflect.ValueOf(&records[i]).Elem(), identity.Roles)
+	}
+	return records, nil
+}
+
+// unmarshalRows decodes rows read as maps into records.
+func unmarshalRows[T any](rows []map[string]interface{}) ([]T, error) {
+	// Unmarshal only takes slices as []interface{}
+	items := make([]interface{}, len(rows))
+	for i, row := range rows {
+		items[i] = row
+	}
+	var records []T
+	err := surrealdb.Unmarshal(items, &records)
+	return records, err
+}
+
+// guardFetched authorizes the records FETCH inlined in row.
+func (r *Repository[T]) guardFetched(ctx context.Context, row map[string]interface{}) error {
+	for _, path := range r.fetch {
+		// the links holding nested ones are guarded along with them
+		nested := false
+		for _, other := range r.fetch {
+			nested = nested || strings.HasPrefix(other, path+".")
+		}
+		if nested {
+			continue
+		}
+		if err := r.guardPath(ctx, row, strings.Split(path, ".")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository[T]) guardPath(ctx context.Context, value interface{}, path []string) error {
+	if len(path) == 0 {
+		return nil
+	}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, entry := range v {
+			if err := r.guardPath(ctx, entry, path); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		guard := func(linked interface{}) (interface{}, error) {
+			record, ok := linked.(map[string]interface{})
+			if !ok {
+				// an id left unfetched, or null
+				return linked, nil
+			}
+			id, _ := record["id"].(string)
+			table, _, _ := strings.Cut(id, ":")
+			authorizer, err := r.fetchAuthorizer(table)
+			if err != nil {
+				return nil, err
+			}
+			if authorizer != nil {
+				if err := authorizer.AuthorizeRead(ctx, record); err != nil {
+					if errors.Is(err, ErrForbidden) || errors.Is(err, ErrUnauthenticated) {
+						return nil, nil
+					}
+					return nil, err
+				}
+			}
+			return record, r.guardPath(ctx, record, path[1:])
+		}
+		switch linked := v[path[0]].(type) {
+		case []interface{}:
+			for i, entry := range linked {
+				guarded, err := guard(entry)
+				if err != nil {
+					return err
+				}
+				linked[i] = guarded
+			}
+		case map[string]interface{}:
+			guarded, err := guard(linked)
+			if err != nil {
+				return err
+			}
+			v[path[0]] = guarded
+		}
+	}
+	return nil
+}
+
+// redactLinks clears the fields of the loaded Links of v the roles may
+// not view, see RedactFields.
+func redactLinks(v reflect.Value, roles []string) {
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	linkType := reflect.TypeOf((*recordLink)(nil)).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+		switch {
+		case !field.IsExported():
+		case field.Type.Implements(linkType):
+			value.Set(redactValue(value, roles))
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Implements(linkType):
+			value.Set(redactValue(value, roles))
+		case field.Anonymous && field.Type.Kind() == reflect.Struct:
+			redactLinks(value, roles)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmbeddedScheme is the scheme of a surrealdb-url served by a SurrealDB
+// the package runs itself, for development and tests without Docker:
+//
+//  surrealdb:
+//      surrealdb-url: embedded://memory
+//      surrealdb-database: blog
+//      surrealdb-embedded:
+//          data-dir: .ghost/surrealdb
+//
+// The host is the storage engine: memory keeps nothing once the app
+// stops, rocksdb and surrealkv keep the data under data-dir. The
+// server is the surreal CLI, started on the first connection with the
+// credentials of the block, root/root when unset, and stopped when the
+// app stops. Connections to the same engine and data-dir share it.
+const EmbeddedScheme = "embedded"
+
+// EmbeddedConfig is the surrealdb-embedded block of a connection with an
+// embedded:// surrealdb-url.
+type EmbeddedConfig struct {
+	// Binary is the surreal CLI, found on the PATH when empty.
+	Binary string `yaml:"binary"`
+	// DataDir holds the data of rocksdb and surrealkv,
+	// DefaultEmbeddedDataDir by default.
+	DataDir string `yaml:"data-dir"`
+	// Port is the local port of the server, a free one when 0.
+	Port int `yaml:"port"`
+	// Log is the log level of the server, DefaultEmbeddedLog by default.
+	Log string `yaml:"log"`
+	// StartTimeout bounds the wait for the server to listen,
+	// DefaultEmbeddedStartTimeout by default.
+	StartTimeout time.Duration `yaml:"start-timeout"`
+}
+
+// Defaults applied to EmbeddedConfig by Validate.
+const (
+	DefaultEmbeddedDataDir      = ".ghost/surrealdb"
+	DefaultEmbeddedLog          = "warn"
+	DefaultEmbeddedStartTimeout = 15 * time.Second
+)
+
+// embeddedEngines are the storage engines of an embedded:// URL.
+var embeddedEngines = map[string]bool{"memory": true, "rocksdb": true, "surrealkv": true}
+
+// embeddedServer is a surreal process started by the package.
+type embeddedServer struct {
+	url    string
+	cmd    *exec.Cmd
+	output *tailBuffer
+	exited chan struct{}
+	err    error
+}
+
+// embedded holds the servers by engine and data directory.
+var embedded = struct {
+	sync.Mutex
+	servers map[string]*embeddedServer
+	hooked  bool
+}{servers: map[string]*embeddedServer{}}
+
+// endpoint returns the URL to dial for config, starting its embedded
+// server if it uses one.
+func (config SurrealDBConfig) endpoint(ctx context.Context) (string, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Scheme != EmbeddedScheme {
+		return config.URL, nil
+	}
+	return startEmbedded(ctx, u.Host, config)
+}
+
+func startEmbedded(ctx context.Context, engine string, config SurrealDBConfig) (string, error) {
+	if !embeddedEngines[engine] {
+		return "", fmt.Errorf("embedded surrealdb: unknown engine %q, use memory, rocksdb or surrealkv", engine)
+	}
+	embeddedConfig := config.Embedded
+	if embeddedConfig.DataDir == "" {
+		embeddedConfig.DataDir = DefaultEmbeddedDataDir
+	}
+	if embeddedConfig.Log == "" {
+		embeddedConfig.Log = DefaultEmbeddedLog
+	}
+	if embeddedConfig.StartTimeout <= 0 {
+		embeddedConfig.StartTimeout = DefaultEmbeddedStartTimeout
+	}
+	key := engine
+	if engine != "memory" {
+		key += ":" + embeddedConfig.DataDir
+	}
+	embedded.Lock()
+	defer embedded.Unlock()
+	if server, ok := embedded.servers[key]; ok {
+		select {
+		case <-server.exited:
+			// exited since, e.g. killed; started again below
+			delete(embedded.servers, key)
+		default:
+			return server.url, nil
+		}
+	}
+	server, err := runEmbedded(ctx, engine, config, embeddedConfig)
+	if err != nil {
+		return "", err
+	}
+	embedded.servers[key] = server
+	if !embedded.hooked {
+		embedded.hooked = true
+		OnStop(StopEmbedded)
+	}
+	return server.url, nil
+}
+
+func runEmbedded(ctx context.Context, engine string, config SurrealDBConfig, embeddedConfig EmbeddedConfig) (*embeddedServer, error) {
+	binary := embeddedConfig.Binary
+	if binary == "" {
+		found, err := exec.LookPath("surreal")
+		if err != nil {
+			return nil, Remedy(errors.New("embedded surrealdb: no surreal CLI on the PATH"),
+				"install it with curl -sSf https://install.surrealdb.com | sh, or set surrealdb-embedded.binary")
+		}
+		binary = found
+	}
+	port := embeddedConfig.Port
+	if port == 0 {
+		var err error
+		if port, err = freePort(); err != nil {
+			return nil, err
+		}
+	}
+	storage := engine
+	if engine != "memory" {
+		dir, err := filepath.Abs(embeddedConfig.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		storage = engine + "://" + dir
+	}
+	username, password := config.Username, config.Password
+	if username == "" {
+		username, password = "root", "root"
+	}
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	cmd := exec.Command(binary, "start",
+		"--log", embeddedConfig.Log,
+		"--user", username,
+		"--pass", password,
+		"--bind", address,
+		storage,
+	)
+	output := &tailBuffer{max: 4096}
+	cmd.Stdout, cmd.Stderr = output, output
+	stopWithParent(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("embedded surrealdb: %w", err)
+	}
+	server := &embeddedServer{url: "ws://" + address + "/rpc", cmd: cmd, output: output, exited: make(chan struct{})}
+	go func() {
+		server.err = cmd.Wait()
+		close(server.exited)
+	}()
+	log.Printf("embedded surrealdb: %s on %s", storage, address)
+	if err := server.wait(ctx, address, embeddedConfig.StartTimeout); err != nil {
+		server.stop(context.Background())
+		return nil, err
+	}
+	return server, nil
+}
+
+// wait returns once the server listens on address.
+func (server *embeddedServer) wait(ctx context.Context, address string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if conn, err := net.DialTimeout("tcp", address, time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-server.exited:
+			return fmt.Errorf("embedded surrealdb exited: %v: %s", server.err, server.output.String())
+		case <-ctx.Done():
+			return fmt.Errorf("embedded surrealdb did not listen on %s: %w", address, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop interrupts the server, killing it once ctx ends.
+func (server *embeddedServer) stop(ctx context.Context) error {
+	select {
+	case <-server.exited:
+		return nil
+	default:
+	}
+	if err := server.cmd.Process.Signal(os.Interrupt); err != nil {
+		// Windows cannot interrupt a process
+		server.cmd.Process.Kill()
+	}
+	select {
+	case <-server.exited:
+		return nil
+	case <-ctx.Done():
+		server.cmd.Process.Kill()
+		<-server.exited
+		return fmt.Errorf("embedded surrealdb killed: %w", ctx.Err())
+	}
+}
+
+// StopEmbedded stops the embedded servers, letting rocksdb and
+// surrealkv flush their data. Run calls it when the app stops; tests
+// and commands that do not use Run call it themselves.
+//
+// Example:
+//  func TestMain(m *testing.M) {
+//      code := m.Run()
+//      ghostutils.StopEmbedded(context.Background())
+//      os.Exit(code)
+//  }
+func StopEmbedded(ctx context.Context) error {
+	embedded.Lock()
+	servers := embedded.servers
+	embedded.servers = map[string]*embeddedServer{}
+	embedded.Unlock()
+	var problems []string
+	for _, server := range servers {
+		if err := server.stop(ctx); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// freePort returns a local port nothing listens on.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu   sync.Mutex
+	max  int
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) > b.max {
+		b.data = b.data[len(b.data)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.TrimSpace(string(b.data))
+}
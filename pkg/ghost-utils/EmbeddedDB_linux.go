@@ -0,0 +1,12 @@
+package ghostutils
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// stopWithParent makes the kernel stop the embedded server when the app
+// dies without running its OnStop hooks.
+func stopWithParent(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package ghostutils
+
+import "os/exec"
+
+// stopWithParent does nothing outside Linux, whose parent death signal
+// other systems lack; StopEmbedded stops the server.
+func stopWithParent(cmd *exec.Cmd) {}
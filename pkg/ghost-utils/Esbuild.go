@@ -0,0 +1,327 @@
+package ghostutils
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/gin-gonic/gin"
+)
+
+// EsbuildConfig is the `esbuild:` block of ghost.yaml, bundling the
+// JavaScript and TypeScript entrypoints of input into outdir. With
+// watch set Setup rebuilds them on change in gin's debug mode, see
+// Esbuild.
+//
+// Example:
+//  esbuild:
+//    input: [src/js/app.ts, src/js/editor.ts]
+//    outdir: static/js
+//    minify: true
+//    sourcemap: true
+//    hash: true
+//    format: esm
+//    public-path: https://cdn.example.com/js
+//    watch: true
+type EsbuildConfig struct {
+	Input  []string `yaml:"input"`
+	Outdir string   `yaml:"outdir"`
+	Minify bool     `yaml:"minify"`
+	// Sourcemap writes linked source maps in gin's debug mode.
+	Sourcemap bool `yaml:"sourcemap"`
+	// Hash adds the content hash to the file names, so they can be
+	// cached forever; templates link them with the asset helper.
+	Hash bool `yaml:"hash"`
+	// PublicPath is the URL outdir is served on, "/" + outdir by
+	// default, or the URL of a CDN serving it.
+	PublicPath string `yaml:"public-path"`
+	// Format is iife, the default, or esm for module scripts.
+	Format string `yaml:"format"`
+	// Watch makes Setup rebuild the bundles on change in gin's debug
+	// mode.
+	Watch bool `yaml:"watch"`
+}
+
+// AssetManifestFile is the manifest written into outdir by every
+// build, mapping the names of the bundles to their URLs.
+const AssetManifestFile = "manifest.json"
+
+// AssetManifest maps the names of built assets, such as "app.js" or
+// "editor.css", to their entries.
+type AssetManifest map[string]AssetEntry
+
+// AssetEntry is a built asset: its URL and its Subresource Integrity
+// hash, so browsers refuse a copy altered by a CDN.
+type AssetEntry struct {
+	URL       string `json:"url"`
+	Integrity string `json:"integrity"`
+}
+
+// assetHashPattern matches the content hash esbuild adds to names.
+var assetHashPattern = regexp.MustCompile(`-[A-Z0-9]{8}(\.[^./]+)$`)
+
+// Esbuild bundles the scripts of the esbuild block.
+type Esbuild struct {
+	Config EsbuildConfig
+	// Dev writes the source maps when sourcemap is set, gin's debug
+	// mode by default.
+	Dev bool
+
+	mu       sync.Mutex
+	manifest AssetManifest
+	stamp    time.Time
+}
+
+// Esbuild returns the bundler of the esbuild block.
+//
+// Example:
+//  if err := ghostConfig.Esbuild().Build(); err != nil {
+//      log.Fatal(err)
+//  }
+func (ghostConfig GhostConfig) Esbuild() *Esbuild {
+	return &Esbuild{Config: ghostConfig.Scripts, Dev: gin.IsDebugging()}
+}
+
+// Build bundles the entrypoints once and writes the manifest.
+func (e *Esbuild) Build() error {
+	options, err := e.options()
+	if err != nil {
+		return err
+	}
+	// the errors are returned rather than printed
+	options.LogLevel = api.LogLevelSilent
+	return esbuildError(api.Build(options).Errors)
+}
+
+// Watch rebuilds the bundles and the manifest whenever a source
+// changes, until ctx is done. Build errors are printed to stderr.
+//
+// Example:
+//  ctx, cancel := context.WithCancel(context.Background())
+//  defer cancel()
+//  go ghostConfig.Esbuild().Watch(ctx)
+func (e *Esbuild) Watch(ctx context.Context) error {
+	options, err := e.options()
+	if err != nil {
+		return err
+	}
+	build, contextErr := api.Context(options)
+	if contextErr != nil {
+		return contextErr
+	}
+	defer build.Dispose()
+	if err := build.Watch(api.WatchOptions{}); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (e *Esbuild) options() (api.BuildOptions, error) {
+	if len(e.Config.Input) == 0 || e.Config.Outdir == "" {
+		return api.BuildOptions{}, errors.New("esbuild.input and esbuild.outdir are required")
+	}
+	options := api.BuildOptions{
+		EntryPoints:       e.Config.Input,
+		Outdir:            e.Config.Outdir,
+		Bundle:            true,
+		Write:             true,
+		Metafile:          true,
+		MinifyWhitespace:  e.Config.Minify,
+		MinifyIdentifiers: e.Config.Minify,
+		MinifySyntax:      e.Config.Minify,
+		EntryNames:        "[dir]/[name]",
+		LogLevel:          api.LogLevelWarning,
+		Plugins: []api.Plugin{{
+			Name: "ghost-manifest",
+			Setup: func(build api.PluginBuild) {
+				build.OnEnd(func(result *api.BuildResult) (api.OnEndResult, error) {
+					if len(result.Errors) > 0 {
+						return api.OnEndResult{}, nil
+					}
+					return api.OnEndResult{}, e.writeManifest(result.Metafile)
+				})
+			},
+		}},
+	}
+	if e.Config.Hash {
+		options.EntryNames = "[dir]/[name]-[hash]"
+	}
+	if e.Config.Sourcemap && e.Dev {
+		options.Sourcemap = api.SourceMapLinked
+	}
+	if e.Config.Format == "esm" {
+		options.Format = api.FormatESModule
+	}
+	return options, nil
+}
+
+// writeManifest writes the manifest of the outputs in metafile, which
+// are on disk by then.
+func (e *Esbuild) writeManifest(metafile string) error {
+	var meta struct {
+		Outputs map[string]json.RawMessage `json:"outputs"`
+	}
+	if err := json.Unmarshal([]byte(metafile), &meta); err != nil {
+		return err
+	}
+	outdir := filepath.ToSlash(filepath.Clean(e.Config.Outdir)) + "/"
+	manifest := AssetManifest{}
+	for output := range meta.Outputs {
+		if strings.HasSuffix(output, ".map") {
+			continue
+		}
+		contents, err := os.ReadFile(filepath.FromSlash(output))
+		if err != nil {
+			return err
+		}
+		sum := sha512.Sum384(contents)
+		rel := strings.TrimPrefix(output, outdir)
+		manifest[assetHashPattern.ReplaceAllString(rel, "$1")] = AssetEntry{
+			URL:       e.assetURL(rel),
+			Integrity: "sha384-" + base64.StdEncoding.EncodeToString(sum[:]),
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(e.Config.Outdir, AssetManifestFile), data, 0o644)
+}
+
+// assetURL returns the URL of rel under the public path, which may be
+// absolute.
+func (e *Esbuild) assetURL(rel string) string {
+	public := e.Config.PublicPath
+	if public == "" {
+		public = "/" + filepath.ToSlash(filepath.Clean(e.Config.Outdir))
+	}
+	return strings.TrimSuffix(public, "/") + "/" + rel
+}
+
+// Manifest returns the manifest of the last build, read again when the
+// file changes.
+func (e *Esbuild) Manifest() (AssetManifest, error) {
+	file := filepath.Join(e.Config.Outdir, AssetManifestFile)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.manifest != nil && info.ModTime().Equal(e.stamp) {
+		return e.manifest, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var manifest AssetManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	e.manifest, e.stamp = manifest, info.ModTime()
+	return manifest, nil
+}
+
+// Entry returns the manifest entry of the built asset name, such as
+// "app.js", or its URL under the public path, without an integrity
+// hash, before a build.
+func (e *Esbuild) Entry(name string) AssetEntry {
+	if manifest, err := e.Manifest(); err == nil {
+		if entry, ok := manifest[name]; ok {
+			return entry
+		}
+	}
+	return AssetEntry{URL: e.assetURL(path.Clean(name))}
+}
+
+// Asset returns the URL of the built asset name.
+func (e *Esbuild) Asset(name string) string {
+	return e.Entry(name).URL
+}
+
+// Integrity returns the Subresource Integrity hash of the built asset
+// name, empty before a build.
+func (e *Esbuild) Integrity(name string) string {
+	return e.Entry(name).Integrity
+}
+
+// tag returns the HTML element of the asset name with its URL in
+// attr, the integrity hash and the attributes of extra.
+func (e *Esbuild) tag(element, attr, name, extra, end string) template.HTML {
+	entry := e.Entry(name)
+	html := "<" + element + " " + extra + attr + `="` + template.HTMLEscapeString(entry.URL) + `"`
+	if entry.Integrity != "" {
+		html += ` integrity="` + entry.Integrity + `"`
+	}
+	return template.HTML(html + ` crossorigin="anonymous">` + end)
+}
+
+// Script returns the script element of the asset name, a module with
+// format esm.
+func (e *Esbuild) Script(name string) template.HTML {
+	if e.Config.Format == "esm" {
+		return e.tag("script", "src", name, `type="module" `, "</script>")
+	}
+	return e.tag("script", "src", name, "defer ", "</script>")
+}
+
+// Stylesheet returns the stylesheet link of the asset name.
+func (e *Esbuild) Stylesheet(name string) template.HTML {
+	return e.tag("link", "href", name, `rel="stylesheet" `, "")
+}
+
+// Preload returns the preload link of the asset name, fetched as a
+// module for scripts with format esm.
+func (e *Esbuild) Preload(name string) template.HTML {
+	ext := path.Ext(name)
+	if ext == ".js" && e.Config.Format == "esm" {
+		return e.tag("link", "href", name, `rel="modulepreload" `, "")
+	}
+	as := map[string]string{
+		".js": "script", ".css": "style", ".woff2": "font", ".woff": "font",
+		".svg": "image", ".png": "image", ".jpg": "image", ".webp": "image",
+	}[ext]
+	if as == "" {
+		as = "fetch"
+	}
+	return e.tag("link", "href", name, `rel="preload" as="`+as+`" `, "")
+}
+
+// FuncMap returns the asset template helpers, installed by Setup:
+//  <head>
+//    {{assetPreload "app.js"}}
+//    {{assetStylesheet "app.css"}}
+//    {{assetScript "app.js"}}
+//  </head>
+//  <script src="{{asset "editor.js"}}" integrity="{{assetIntegrity "editor.js"}}" async></script>
+func (e *Esbuild) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"asset":           e.Asset,
+		"assetIntegrity":  e.Integrity,
+		"assetScript":     e.Script,
+		"assetStylesheet": e.Stylesheet,
+		"assetPreload":    e.Preload,
+	}
+}
+
+// esbuildError joins the build errors, nil without any.
+func esbuildError(messages []api.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	formatted := api.FormatMessages(messages, api.FormatMessagesOptions{Kind: api.ErrorMessage})
+	return errors.New(strings.TrimSpace(strings.Join(formatted, "")))
+}
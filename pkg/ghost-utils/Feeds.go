@@ -0,0 +1,604 @@
+package ghostutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Defaults of Feeds.
+const (
+	DefaultActivityTable = "activity"
+	DefaultFeedTable     = "feed_item"
+	DefaultFollowEdge    = "follows"
+	DefaultFanOutLimit   = 1000
+	DefaultFeedBackfill  = 20
+)
+
+// ErrActivityInvalid is returned by Record for an activity without
+// actor, verb or object.
+var ErrActivityInvalid = errors.New("activity needs an actor, a verb and an object")
+
+// FeedSchema defines the tables of Feeds with the default tables. Run
+// it once, or ship it as a migration. Users follow actors with follows
+// edges, user->follows->actor, which the app creates, or Follow does.
+const FeedSchema = `
+DEFINE TABLE activity SCHEMALESS;
+DEFINE FIELD created_at ON activity TYPE datetime;
+DEFINE INDEX activity_actor ON activity FIELDS actor, created_at;
+DEFINE TABLE feed_item SCHEMALESS;
+DEFINE FIELD created_at ON feed_item TYPE datetime;
+DEFINE INDEX feed_item_user ON feed_item FIELDS user, created_at;
+DEFINE TABLE follows SCHEMALESS;
+DEFINE INDEX follows_pair ON follows FIELDS in, out UNIQUE;
+DEFINE INDEX follows_out ON follows FIELDS out;
+`
+
+// Activity is one entry of the feeds: Actor did Verb to Object, e.g.
+// user:tobie published post:42.
+type Activity struct {
+	ID     string                 `json:"id,omitempty"`
+	Actor  string                 `json:"actor"`
+	Verb   string                 `json:"verb"`
+	Object string                 `json:"object"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+	// FannedOut is set when the activity was written to the feed of
+	// every follower, and unset when the feeds read it from the actor.
+	FannedOut bool      `json:"fanned_out"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FeedSource turns the changes of a table into activities.
+type FeedSource struct {
+	Table string
+	// Activities returns the activities of change, none to skip it.
+	// Activities without ID get one from their verb and object, so a
+	// record changing again does not repeat them.
+	Activities func(ctx context.Context, change SyncChange) ([]Activity, error)
+}
+
+// RecordActivity returns the Activities of a FeedSource announcing
+// every record of its table once, with verb, by the actor in the
+// actorField of the record and with the record as data.
+//
+// Example:
+//  ghostutils.FeedSource{Table: "post", Activities: ghostutils.RecordActivity("published", "author")}
+func RecordActivity(verb, actorField string) func(ctx context.Context, change SyncChange) ([]Activity, error) {
+	return func(ctx context.Context, change SyncChange) ([]Activity, error) {
+		if change.Op != SyncUpsert {
+			return nil, nil
+		}
+		actor, _ := change.Data[actorField].(string)
+		if actor == "" {
+			return nil, nil
+		}
+		return []Activity{{
+			Actor:  actor,
+			Verb:   verb,
+			Object: change.Table + ":" + change.ID,
+			Data:   change.Data,
+		}}, nil
+	}
+}
+
+// Feeds materializes the feed of every user from the changefeeds of
+// its Sources. The activity of an actor with at most FanOutLimit
+// followers is written to the feed of each follower when it happens
+// (fan-out on write); the activity of more followed actors is stored
+// once and merged into the feeds when they are read (fan-out on read).
+// Feeds include the activities of the user too.
+//
+// Example:
+//  feeds := &ghostutils.Feeds{
+//      DB: db,
+//      Sources: []ghostutils.FeedSource{
+//          {Table: "post", Activities: ghostutils.RecordActivity("published", "author")},
+//      },
+//  }
+//  go feeds.Run(ctx)
+//  feeds.Mount(r.Group("/feed"))
+type Feeds struct {
+	DB      *surrealdb.DB
+	Sources []FeedSource
+	// Cursors keeps the position in the changefeeds, the feed_cursor
+	// table by default.
+	Cursors CursorStore
+	// Interval is the polling interval of the changefeeds, a second
+	// by default.
+	Interval time.Duration
+	// FanOutLimit is the most followers whose feeds are written,
+	// DefaultFanOutLimit by default.
+	FanOutLimit int
+	// Backfill is the number of recent activities Follow copies into
+	// the feed, DefaultFeedBackfill by default.
+	Backfill int
+	// Table, FeedTable and FollowEdge default to DefaultActivityTable,
+	// DefaultFeedTable and DefaultFollowEdge.
+	Table      string
+	FeedTable  string
+	FollowEdge string
+
+	mu          sync.Mutex
+	subscribers map[string]map[*feedSubscriber]struct{}
+}
+
+// feedSubscriber is a client following its feed live.
+type feedSubscriber struct {
+	following map[string]bool
+	events    chan Event
+}
+
+// EnsureSchema runs FeedSchema against the database.
+func (f *Feeds) EnsureSchema() error {
+	schema := FeedSchema
+	for _, rename := range [][2]string{
+		{DefaultFeedTable, f.feedTable()},
+		{DefaultActivityTable, f.table()},
+		{DefaultFollowEdge, f.edge()},
+	} {
+		if rename[0] != rename[1] {
+			schema = strings.ReplaceAll(schema, rename[0], rename[1])
+		}
+	}
+	_, err := f.DB.Query(schema, map[string]interface{}{})
+	return err
+}
+
+func (f *Feeds) table() string {
+	if f.Table == "" {
+		return DefaultActivityTable
+	}
+	return f.Table
+}
+
+func (f *Feeds) feedTable() string {
+	if f.FeedTable == "" {
+		return DefaultFeedTable
+	}
+	return f.FeedTable
+}
+
+func (f *Feeds) edge() string {
+	if f.FollowEdge == "" {
+		return DefaultFollowEdge
+	}
+	return f.FollowEdge
+}
+
+func (f *Feeds) fanOutLimit() int {
+	if f.FanOutLimit <= 0 {
+		return DefaultFanOutLimit
+	}
+	return f.FanOutLimit
+}
+
+func (f *Feeds) cursors() CursorStore {
+	if f.Cursors == nil {
+		return SurrealCursorStore{DB: f.DB, Table: "feed_cursor"}
+	}
+	return f.Cursors
+}
+
+// Run consumes the changefeeds of the Sources, recording their
+// activities, until ctx is done. The tables need a changefeed, see
+// EnableChangefeed.
+func (f *Feeds) Run(ctx context.Context) error {
+	interval := f.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	var wg sync.WaitGroup
+	for _, source := range f.Sources {
+		source := source
+		feed := &Changefeed{DB: f.DB, Table: source.Table, Name: "feed-" + source.Table, Cursors: f.cursors()}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			feed.Run(ctx, interval, func(ctx context.Context, change SyncChange) error {
+				activities, err := source.Activities(ctx, change)
+				if err != nil {
+					return err
+				}
+				for _, activity := range activities {
+					if _, err := f.Record(ctx, activity); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// activityID derives the id of an activity from its verb and object.
+func activityID(activity Activity) string {
+	sum := sha256.Sum256([]byte(activity.Verb + "\x00" + activity.Object))
+	return hex.EncodeToString(sum[:12])
+}
+
+// Record stores activity and fans it out. Recording an activity again
+// is a no-op, so replayed changes are safe.
+//
+// Returns:
+//  Activity as stored
+//  error, ErrActivityInvalid without actor, verb or object
+func (f *Feeds) Record(ctx context.Context, activity Activity) (Activity, error) {
+	actorTable, actorID := splitRecordID(activity.Actor, "")
+	if actorTable == "" || actorID == "" || activity.Verb == "" || activity.Object == "" {
+		return activity, ErrActivityInvalid
+	}
+	_, key := splitRecordID(activity.ID, "")
+	if key == "" {
+		key = activityID(activity)
+	}
+	if activity.CreatedAt.IsZero() {
+		activity.CreatedAt = time.Now().UTC()
+	}
+	if activity.Data == nil {
+		activity.Data = map[string]interface{}{}
+	}
+	followers, _, err := surrealFirst[struct {
+		Total int `json:"total"`
+	}](f.DB, "SELECT count() AS total FROM type::table($edge) WHERE out = type::thing($actor_tb, $actor_id) GROUP ALL", map[string]interface{}{
+		"edge":     f.edge(),
+		"actor_tb": actorTable,
+		"actor_id": actorID,
+	})
+	if err != nil {
+		return activity, err
+	}
+	vars := map[string]interface{}{
+		"tb":         f.table(),
+		"id":         key,
+		"feed":       f.feedTable(),
+		"edge":       f.edge(),
+		"actor":      activity.Actor,
+		"actor_tb":   actorTable,
+		"actor_id":   actorID,
+		"verb":       activity.Verb,
+		"object":     activity.Object,
+		"data":       activity.Data,
+		"fanned_out": followers.Total <= f.fanOutLimit(),
+		"created_at": activity.CreatedAt.Format(time.RFC3339Nano),
+	}
+	sql := []string{
+		"LET $activity = type::thing($tb, $id)",
+		// a replayed activity keeps its time and strategy
+		"UPDATE $activity SET actor = $actor, verb = $verb, object = $object, data = $data, fanned_out = fanned_out ?? $fanned_out, created_at = created_at ?? <datetime>$created_at RETURN AFTER",
+	}
+	if followers.Total <= f.fanOutLimit() {
+		// feed items have the ids [user, activity] so writing one twice
+		// rewrites it
+		sql = append(sql, `FOR $user IN array::union((SELECT VALUE in FROM type::table($edge) WHERE out = type::thing($actor_tb, $actor_id)), [type::thing($actor_tb, $actor_id)]) {
+	UPDATE type::thing($feed, [$user, $id]) SET user = $user, actor = $actor, activity = $activity, created_at = $activity.created_at;
+}`)
+	}
+	statements, err := surrealStatements(f.DB, strings.Join(sql, ";\n"), vars)
+	if err != nil {
+		return activity, err
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return activity, fmt.Errorf("feeds: %s", statement.Detail)
+		}
+	}
+	var stored []Activity
+	if len(statements) > 1 {
+		if err := surrealdb.Unmarshal(statements[1].Result, &stored); err != nil {
+			return activity, err
+		}
+	}
+	if len(stored) == 0 {
+		return activity, fmt.Errorf("feeds: activity %s was not stored", key)
+	}
+	f.publish(stored[0])
+	return stored[0], nil
+}
+
+// feedPosition is the keyset position of a feed page.
+type feedPosition struct {
+	Time string `json:"t"`
+	ID   string `json:"id"`
+}
+
+// Feed returns the perPage activities of the feed of user after
+// cursor, the newest first. The first page has an empty cursor; Total
+// is not counted.
+//
+// Returns:
+//  CursorPage[Activity] with the Next cursor while there are more
+//  error, ErrInvalidCursor for a malformed cursor
+func (f *Feeds) Feed(ctx context.Context, user, cursor string, perPage int) (CursorPage[Activity], error) {
+	page := CursorPage[Activity]{PerPage: perPage}
+	userTable, userID := splitRecordID(user, "")
+	if userTable == "" || userID == "" {
+		return page, ErrActivityInvalid
+	}
+	vars := map[string]interface{}{
+		"tb":      f.table(),
+		"feed":    f.feedTable(),
+		"edge":    f.edge(),
+		"user_tb": userTable,
+		"user_id": userID,
+		"limit":   perPage + 1,
+	}
+	after, before := "", ""
+	if cursor != "" {
+		var position feedPosition
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || json.Unmarshal(raw, &position) != nil || position.ID == "" {
+			return page, ErrInvalidCursor
+		}
+		_, vars["cursor_id"] = splitRecordID(position.ID, "")
+		vars["cursor_time"] = position.Time
+		after = " AND (created_at < <datetime>$cursor_time OR (created_at = <datetime>$cursor_time AND activity < type::thing($tb, $cursor_id)))"
+		before = " AND (created_at < <datetime>$cursor_time OR (created_at = <datetime>$cursor_time AND id < type::thing($tb, $cursor_id)))"
+	}
+	sql := strings.Join([]string{
+		"LET $user = type::thing($user_tb, $user_id)",
+		"SELECT activity, created_at FROM type::table($feed) WHERE user = $user" + after + " ORDER BY created_at DESC, activity DESC LIMIT $limit FETCH activity",
+		// the actors of more followers than the fan-out limit
+		"LET $following = array::union((SELECT VALUE <string>out FROM type::table($edge) WHERE in = $user), [<string>$user])",
+		"SELECT * FROM type::table($tb) WHERE fanned_out = false AND actor INSIDE $following" + before + " ORDER BY created_at DESC, id DESC LIMIT $limit",
+	}, ";\n")
+	statements, err := surrealStatements(f.DB, sql, vars)
+	if err != nil {
+		return page, err
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return page, fmt.Errorf("feeds: %s", statement.Detail)
+		}
+	}
+	var items []struct {
+		Activity Activity `json:"activity"`
+	}
+	var pulled []Activity
+	if len(statements) == 4 {
+		if err := surrealdb.Unmarshal(statements[1].Result, &items); err != nil {
+			return page, err
+		}
+		if err := surrealdb.Unmarshal(statements[3].Result, &pulled); err != nil {
+			return page, err
+		}
+	}
+	seen := map[string]bool{}
+	merged := make([]Activity, 0, len(items)+len(pulled))
+	for _, item := range items {
+		if item.Activity.ID != "" && !seen[item.Activity.ID] {
+			seen[item.Activity.ID] = true
+			merged = append(merged, item.Activity)
+		}
+	}
+	for _, activity := range pulled {
+		if !seen[activity.ID] {
+			seen[activity.ID] = true
+			merged = append(merged, activity)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if !merged[i].CreatedAt.Equal(merged[j].CreatedAt) {
+			return merged[i].CreatedAt.After(merged[j].CreatedAt)
+		}
+		return merged[i].ID > merged[j].ID
+	})
+	if len(merged) > perPage {
+		merged = merged[:perPage]
+		last := merged[len(merged)-1]
+		page.Next = encodeFeedCursor(last)
+	}
+	page.Items = merged
+	return page, nil
+}
+
+func encodeFeedCursor(activity Activity) string {
+	raw, _ := json.Marshal(feedPosition{Time: activity.CreatedAt.UTC().Format(time.RFC3339Nano), ID: activity.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Follow makes user follow actor, copying the recent activities of
+// actor into the feed of user when they were fanned out.
+func (f *Feeds) Follow(ctx context.Context, user, actor string) error {
+	userTable, userID := splitRecordID(user, "")
+	actorTable, actorID := splitRecordID(actor, "")
+	if userTable == "" || userID == "" || actorTable == "" || actorID == "" || user == actor {
+		return ErrActivityInvalid
+	}
+	backfill := f.Backfill
+	if backfill <= 0 {
+		backfill = DefaultFeedBackfill
+	}
+	statements, err := surrealStatements(f.DB, `LET $user = type::thing($user_tb, $user_id);
+LET $actor = type::thing($actor_tb, $actor_id);
+IF (SELECT id FROM type::table($edge) WHERE in = $user AND out = $actor) = [] {
+	RELATE $user->`+f.edge()+`->$actor SET created_at = time::now();
+	FOR $activity IN (SELECT id, created_at FROM type::table($tb) WHERE actor = <string>$actor AND fanned_out = true ORDER BY created_at DESC LIMIT $backfill) {
+		UPDATE type::thing($feed, [$user, meta::id($activity.id)]) SET user = $user, actor = <string>$actor, activity = $activity.id, created_at = $activity.created_at;
+	};
+}`, map[string]interface{}{
+		"user_tb":  userTable,
+		"user_id":  userID,
+		"actor_tb": actorTable,
+		"actor_id": actorID,
+		"edge":     f.edge(),
+		"tb":       f.table(),
+		"feed":     f.feedTable(),
+		"backfill": backfill,
+	})
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return fmt.Errorf("feeds: %s", statement.Detail)
+		}
+	}
+	f.following(user, actor, true)
+	return nil
+}
+
+// Unfollow stops user following actor and removes the activities of
+// actor from the feed of user.
+func (f *Feeds) Unfollow(ctx context.Context, user, actor string) error {
+	userTable, userID := splitRecordID(user, "")
+	actorTable, actorID := splitRecordID(actor, "")
+	if userTable == "" || userID == "" || actorTable == "" || actorID == "" {
+		return ErrActivityInvalid
+	}
+	vars := map[string]interface{}{
+		"user_tb":  userTable,
+		"user_id":  userID,
+		"actor_tb": actorTable,
+		"actor_id": actorID,
+		"actor":    actor,
+		"edge":     f.edge(),
+		"feed":     f.feedTable(),
+	}
+	err := WithTransaction(f.DB, func(tx *Tx) error {
+		tx.Query("DELETE type::table($edge) WHERE in = type::thing($user_tb, $user_id) AND out = type::thing($actor_tb, $actor_id)", vars)
+		tx.Query("DELETE type::table($feed) WHERE user = type::thing($user_tb, $user_id) AND actor = $actor", vars)
+		return nil
+	})
+	if err == nil {
+		f.following(user, actor, false)
+	}
+	return err
+}
+
+// Prune removes the feed items older than before; the activities stay.
+func (f *Feeds) Prune(ctx context.Context, before time.Time) error {
+	_, err := surrealStatements(f.DB, "DELETE type::table($feed) WHERE created_at < <datetime>$before", map[string]interface{}{
+		"feed":   f.feedTable(),
+		"before": before.UTC().Format(time.RFC3339Nano),
+	})
+	return err
+}
+
+// subscribe registers a live client of the feed of user.
+func (f *Feeds) subscribe(ctx context.Context, user string) (*feedSubscriber, error) {
+	userTable, userID := splitRecordID(user, "")
+	following, err := surrealQuery[string](f.DB, "SELECT VALUE <string>out FROM type::table($edge) WHERE in = type::thing($user_tb, $user_id)", map[string]interface{}{
+		"edge":    f.edge(),
+		"user_tb": userTable,
+		"user_id": userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sub := &feedSubscriber{following: map[string]bool{user: true}, events: make(chan Event, 16)}
+	for _, actor := range following {
+		sub.following[actor] = true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subscribers == nil {
+		f.subscribers = map[string]map[*feedSubscriber]struct{}{}
+	}
+	if f.subscribers[user] == nil {
+		f.subscribers[user] = map[*feedSubscriber]struct{}{}
+	}
+	f.subscribers[user][sub] = struct{}{}
+	return sub, nil
+}
+
+func (f *Feeds) unsubscribe(user string, sub *feedSubscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers[user], sub)
+	if len(f.subscribers[user]) == 0 {
+		delete(f.subscribers, user)
+	}
+}
+
+// following updates the actors the live clients of user follow.
+func (f *Feeds) following(user, actor string, follows bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subscribers[user] {
+		if follows {
+			sub.following[actor] = true
+		} else {
+			delete(sub.following, actor)
+		}
+	}
+}
+
+// publish sends activity to the live clients following its actor.
+// Clients not reading are skipped; they catch up on their next read
+// of the feed.
+func (f *Feeds) publish(activity Activity) {
+	event := Event{ID: encodeFeedCursor(activity), Name: "activity", Data: activity}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, subs := range f.subscribers {
+		for sub := range subs {
+			if !sub.following[activity.Actor] {
+				continue
+			}
+			select {
+			case sub.events <- event:
+			default:
+			}
+		}
+	}
+}
+
+// Mount registers the feed of the current identity on g:
+//  GET  /       a page of the feed, ?cursor= and ?size=
+//  GET  /live   the new activities as server sent "activity" events
+// Both require an Identity.
+func (f *Feeds) Mount(g *gin.RouterGroup) {
+	g.GET("", RequireIdentity(), f.page)
+	g.GET("/live", RequireIdentity(), f.live)
+}
+
+func (f *Feeds) page(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	cursor, perPage := CursorParams(c, 20, 100)
+	page, err := f.Feed(c.Request.Context(), identity.ID, cursor, perPage)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	RespondPage(c, page.Envelope(c.Request.URL))
+}
+
+func (f *Feeds) live(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	sub, err := f.subscribe(c.Request.Context(), identity.ID)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	defer f.unsubscribe(identity.ID, sub)
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case event := <-sub.events:
+				select {
+				case events <- event:
+				case <-c.Request.Context().Done():
+					return
+				}
+			}
+		}
+	}()
+	StreamSSE(c, events)
+}
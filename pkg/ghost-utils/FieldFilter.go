@@ -0,0 +1,260 @@
+package ghostutils
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FilterFields converts v to its JSON shape with every field the
+// roles may not view removed. Fields are restricted with the ghost
+// struct tag:
+//
+//  type User struct {
+//      ID    string `json:"id"`
+//      Email string `json:"email" ghost:"view:admin,support"`
+//      Notes string `json:"notes" ghost:"view:admin"`
+//  }
+//
+// Untagged fields are visible to everyone. Structs become maps keyed
+// by their JSON names; slices, maps, pointers and loaded Links are
+// walked. OK, OKWithMeta and Created filter their data with the roles
+// of the request; RedactFields keeps the types, for templates.
+func FilterFields(v interface{}, roles []string) interface{} {
+	return filterValue(reflect.ValueOf(v), roles)
+}
+
+// VisibleFields is FilterFields with the roles of the request's
+// Identity. Anonymous callers only see untagged fields.
+func VisibleFields(c *gin.Context, v interface{}) interface{} {
+	identity, _ := CurrentIdentity(c)
+	return FilterFields(v, identity.Roles)
+}
+
+// JSONFiltered renders v as JSON after removing the fields the
+// caller may not view.
+func JSONFiltered(c *gin.Context, code int, v interface{}) {
+	c.JSON(code, VisibleFields(c, v))
+}
+
+// HTMLFiltered renders the template with data after clearing the
+// fields the caller may not view, see RedactFields, so templates can
+// still call the methods of the data.
+func HTMLFiltered(c *gin.Context, code int, name string, data interface{}) {
+	identity, _ := CurrentIdentity(c)
+	c.HTML(code, name, RedactFields(data, identity.Roles))
+}
+
+// RedactFields returns a copy of v, of the same type, with the fields
+// the roles may not view set to their zero value, see FilterFields.
+// v itself is not changed.
+//
+// Example:
+//  user = ghostutils.RedactFields(user, identity.Roles).(User)
+func RedactFields(v interface{}, roles []string) interface{} {
+	if v == nil {
+		return nil
+	}
+	return redactValue(reflect.ValueOf(v), roles).Interface()
+}
+
+func redactValue(v reflect.Value, roles []string) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(redactValue(v.Elem(), roles))
+		return out
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(redactValue(v.Elem(), roles))
+		return out
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if !fieldVisible(field.Tag.Get("ghost"), roles) {
+				out.Field(i).Set(reflect.Zero(field.Type))
+				continue
+			}
+			out.Field(i).Set(redactValue(v.Field(i), roles))
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8 {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(redactValue(v.Index(i), roles))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(redactValue(v.Index(i), roles))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), redactValue(iter.Value(), roles))
+		}
+		return out
+	}
+	return v
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func filterValue(v reflect.Value, roles []string) interface{} {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	// loaded Links are sent as their record
+	if link, ok := v.Interface().(recordLink); ok {
+		if record := link.linkRecord(); record != nil {
+			return filterValue(reflect.ValueOf(record), roles)
+		}
+	}
+	// values with their own encoding, such as time.Time, are kept
+	if v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return filterValue(v.Elem(), roles)
+	case reflect.Struct:
+		out := map[string]interface{}{}
+		filterStruct(v, roles, out)
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = filterValue(v.Index(i), roles)
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key()
+			name := ""
+			if key.Kind() == reflect.String {
+				name = key.String()
+			} else {
+				name = jsonKey(key)
+			}
+			out[name] = filterValue(iter.Value(), roles)
+		}
+		return out
+	}
+	return v.Interface()
+}
+
+func filterStruct(v reflect.Value, roles []string, out map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		if !fieldVisible(field.Tag.Get("ghost"), roles) {
+			continue
+		}
+		name, opts := parseJSONTag(field)
+		if name == "-" {
+			continue
+		}
+		value := v.Field(i)
+		if field.Anonymous && name == "" {
+			inner := value
+			if inner.Kind() == reflect.Ptr {
+				if inner.IsNil() {
+					continue
+				}
+				inner = inner.Elem()
+			}
+			if inner.Kind() == reflect.Struct {
+				filterStruct(inner, roles, out)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.Contains(opts, "omitempty") && value.IsZero() {
+			continue
+		}
+		out[name] = filterValue(value, roles)
+	}
+}
+
+// fieldVisible parses a `ghost:"view:admin,support"` tag.
+func fieldVisible(tag string, roles []string) bool {
+	for _, part := range strings.Split(tag, ";") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "view:") {
+			continue
+		}
+		for _, allowed := range strings.Split(strings.TrimPrefix(part, "view:"), ",") {
+			for _, role := range roles {
+				if strings.TrimSpace(allowed) == role {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func parseJSONTag(field reflect.StructField) (name string, opts string) {
+	tag := field.Tag.Get("json")
+	if idx := strings.Index(tag, ","); idx >= 0 {
+		return tag[:idx], tag[idx+1:]
+	}
+	return tag, ""
+}
+
+func jsonKey(key reflect.Value) string {
+	data, err := json.Marshal(key.Interface())
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(string(data), `"`)
+}
@@ -0,0 +1,690 @@
+package ghostutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrFormInvalid is returned by BindForm when the submitted form did
+// not convert or validate. The form returned with it holds the errors.
+var ErrFormInvalid = errors.New("form is invalid")
+
+// maxFormListLen bounds the number of items of a list field a form may
+// submit.
+const maxFormListLen = 100
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// FormOption is one choice of a select field.
+type FormOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+// FormField is one field of a Form.
+type FormField struct {
+	// Name is the submitted name, dotted for nested structs and indexed
+	// for lists, e.g. "address.city" or "items[0].sku".
+	Name  string
+	Label string
+	// Type is the input type, "textarea" or "select", or "group" for a
+	// nested struct and "list" for a slice of structs.
+	Type  string
+	Value string
+	// Values holds every value of a field bound to a slice.
+	Values      []string
+	Checked     bool
+	Multiple    bool
+	Required    bool
+	Placeholder string
+	Options     []FormOption
+	Errors      []string
+	// Fields are the fields of a group and the groups of a list.
+	Fields []*FormField
+}
+
+// ID returns the element id of the field, derived from its name.
+func (f *FormField) ID() string {
+	return "field-" + strings.NewReplacer(".", "-", "[", "-", "]", "").Replace(f.Name)
+}
+
+// Form is an HTML form generated from a model struct. Fields come from
+// the exported fields of the model, named by their form tag like gin's
+// form binding, or their json tag, and are tuned with tags:
+//  label:"Email address"     the label, the spaced field name by default
+//  input:"email"             the input type, or textarea, select, hidden
+//  options:"a=Label A,b"     the choices of a select
+//  placeholder:"you@x.com"
+//  binding:"required"        validation, required also marks the input
+//
+// Nested structs become fieldsets of dotted names and slices of structs
+// lists of indexed fieldsets, one per element of the model's slice;
+// append blank elements to offer empty rows. Render it with the form
+// helper of FormFuncMap.
+//
+// Example:
+//  type Signup struct {
+//      Email    string `form:"email" input:"email" binding:"required,email"`
+//      Password string `form:"password" input:"password" binding:"required,min=12"`
+//      Plan     string `form:"plan" options:"free=Free,pro=Pro" binding:"required"`
+//      Address  struct {
+//          City string `form:"city"`
+//      } `form:"address"`
+//  }
+//
+//  r.GET("/signup", func(c *gin.Context) {
+//      ghostutils.HTML(c, http.StatusOK, "signup.html", gin.H{"Form": ghostutils.NewForm(c, &Signup{})})
+//  })
+//  r.POST("/signup", func(c *gin.Context) {
+//      var signup Signup
+//      form, err := ghostutils.BindForm(c, &signup)
+//      if err == nil && emailTaken(signup.Email) {
+//          err = form.AddError("email", "is already registered")
+//      }
+//      if err != nil {
+//          ghostutils.HTML(c, http.StatusUnprocessableEntity, "signup.html", gin.H{"Form": form})
+//          return
+//      }
+//      c.Redirect(http.StatusSeeOther, "/welcome")
+//  })
+//
+//  // signup.html: {{form .Form}}
+type Form struct {
+	Action string
+	Method string
+	Submit string
+	// CSRF is the token of the CSRF middleware, rendered as the _csrf
+	// field.
+	CSRF   string
+	Fields []*FormField
+	// Errors are errors of the form as a whole.
+	Errors []string
+	byName map[string]*FormField
+	// byPath indexes fields by their Go path, as reported by the
+	// validator, e.g. "Items[0].SKU".
+	byPath map[string]*FormField
+	// locale is the language of the validation messages.
+	locale string
+}
+
+// NewForm returns the form for model, a struct or pointer to one,
+// filled with its values. It posts back to the current path.
+func NewForm(c *gin.Context, model interface{}) *Form {
+	return newForm(c, model, nil)
+}
+
+func newForm(c *gin.Context, model interface{}, values url.Values) *Form {
+	v := reflect.Indirect(reflect.ValueOf(model))
+	if v.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("ghostutils: form model must be a struct, got %T", model))
+	}
+	form := &Form{
+		Action: c.Request.URL.Path,
+		Method: http.MethodPost,
+		Submit: "Save",
+		CSRF:   CSRFToken(c),
+		byName: map[string]*FormField{},
+		byPath: map[string]*FormField{},
+		locale: RequestLocale(c),
+	}
+	form.Fields = form.build(v, "", "", values)
+	return form
+}
+
+// BindForm binds the submitted form into model, a pointer to a struct,
+// and validates it with gin's validator. It returns the form to
+// redisplay, holding the submitted values and the error of every field
+// that did not convert or validate.
+//
+// Returns:
+//  *Form
+//  error, ErrFormInvalid if a field is invalid
+func BindForm(c *gin.Context, model interface{}) (*Form, error) {
+	var err error
+	if strings.HasPrefix(c.ContentType(), gin.MIMEMultipartPOSTForm) {
+		_, err = c.MultipartForm()
+	} else {
+		err = c.Request.ParseForm()
+	}
+	values := c.Request.PostForm
+	if c.Request.Method == http.MethodGet {
+		values = c.Request.URL.Query()
+	}
+	if values == nil {
+		values = url.Values{}
+	}
+	v := reflect.ValueOf(model)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("form model must be a pointer to a struct, got %T", model)
+	}
+	conversion := map[string]string{}
+	decodeForm(v.Elem(), "", values, conversion)
+	form := newForm(c, model, values)
+	if err != nil {
+		form.Errors = append(form.Errors, err.Error())
+	}
+	for name, message := range conversion {
+		form.AddError(name, message)
+	}
+	if binding.Validator != nil {
+		if err := binding.Validator.ValidateStruct(model); err != nil {
+			var invalid validator.ValidationErrors
+			if !errors.As(err, &invalid) {
+				return form, err
+			}
+			for _, fieldErr := range invalid {
+				form.validationError(fieldErr)
+			}
+		}
+	}
+	if !form.Valid() {
+		return form, ErrFormInvalid
+	}
+	return form, nil
+}
+
+// Field returns the field with the submitted name, nil if there is
+// none.
+func (f *Form) Field(name string) *FormField {
+	return f.byName[name]
+}
+
+// AddError adds an error found after binding, such as a taken email,
+// to the field with name, or to the form when no field has it.
+//
+// Returns:
+//  ErrFormInvalid, to return or assign
+func (f *Form) AddError(name, message string) error {
+	if field := f.byName[name]; field != nil {
+		field.Errors = append(field.Errors, field.Label+" "+message)
+	} else {
+		f.Errors = append(f.Errors, message)
+	}
+	return ErrFormInvalid
+}
+
+// Valid reports whether neither the form nor any field has an error.
+func (f *Form) Valid() bool {
+	if len(f.Errors) > 0 {
+		return false
+	}
+	for _, field := range f.byName {
+		if len(field.Errors) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Form) validationError(fieldErr validator.FieldError) {
+	// the namespace starts with the name of the model type
+	path := fieldErr.StructNamespace()
+	if i := strings.Index(path, "."); i >= 0 {
+		path = path[i+1:]
+	}
+	field := f.byPath[path]
+	if field == nil {
+		// an element of a slice field, e.g. Tags[2] with dive
+		if i := strings.LastIndex(path, "["); i >= 0 {
+			field = f.byPath[path[:i]]
+		}
+	}
+	message := ValidationMessage(fieldErr, f.locale)
+	switch {
+	case field == nil:
+		f.Errors = append(f.Errors, fieldErr.Field()+" "+message)
+	case len(field.Errors) == 0:
+		// a field that did not convert is not reported twice
+		field.Errors = append(field.Errors, field.Label+" "+message)
+	}
+}
+
+// formFieldName returns the submitted name of a struct field, "-" for
+// fields the form skips.
+func formFieldName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return "-"
+	}
+	for _, tag := range []string{"form", "json"} {
+		if name := strings.Split(field.Tag.Get(tag), ",")[0]; name != "" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// formEmbedded reports whether field is an untagged embedded struct,
+// whose fields are part of the parent like in gin's form binding.
+func formEmbedded(field reflect.StructField) bool {
+	return field.Anonymous && field.Tag.Get("form") == "" && derefType(field.Type).Kind() == reflect.Struct
+}
+
+func joinFormName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// formStruct reports whether t is bound as a nested struct rather than
+// a single value.
+func formStruct(t reflect.Type) bool {
+	t = derefType(t)
+	return t.Kind() == reflect.Struct && t != timeType
+}
+
+// formLabel returns the label tag or the field name spaced, e.g.
+// "FirstName" becomes "First name".
+func formLabel(field reflect.StructField) string {
+	if label := field.Tag.Get("label"); label != "" {
+		return label
+	}
+	var out []rune
+	runes := []rune(field.Name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			out = append(out, ' ', unicode.ToLower(r))
+			continue
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+func formRequired(field reflect.StructField) bool {
+	for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+		if rule == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+func formOptions(tag string) []FormOption {
+	var options []FormOption
+	for _, choice := range splitList(tag) {
+		value, label := choice, choice
+		if i := strings.Index(choice, "="); i >= 0 {
+			value, label = choice[:i], choice[i+1:]
+		}
+		options = append(options, FormOption{Value: value, Label: label})
+	}
+	return options
+}
+
+// build returns the fields of the struct v. With values set, the
+// fields show the submitted values instead of those of v.
+func (f *Form) build(v reflect.Value, name, path string, values url.Values) []*FormField {
+	var fields []*FormField
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		fieldName := formFieldName(structField)
+		if fieldName == "-" {
+			continue
+		}
+		value := reflect.Indirect(v.Field(i))
+		if !value.IsValid() {
+			value = reflect.Zero(derefType(structField.Type))
+		}
+		if formEmbedded(structField) {
+			fields = append(fields, f.build(value, name, joinFormName(path, structField.Name), values)...)
+			continue
+		}
+		field := &FormField{
+			Name:        joinFormName(name, fieldName),
+			Label:       formLabel(structField),
+			Required:    formRequired(structField),
+			Placeholder: structField.Tag.Get("placeholder"),
+		}
+		fieldPath := joinFormName(path, structField.Name)
+		fieldType := derefType(structField.Type)
+		switch {
+		case formStruct(fieldType):
+			field.Type = "group"
+			field.Fields = f.build(value, field.Name, fieldPath, values)
+		case fieldType.Kind() == reflect.Slice && formStruct(fieldType.Elem()):
+			field.Type = "list"
+			for j := 0; j < value.Len(); j++ {
+				item := reflect.Indirect(value.Index(j))
+				if !item.IsValid() {
+					item = reflect.Zero(derefType(fieldType.Elem()))
+				}
+				group := &FormField{
+					Name:  fmt.Sprintf("%s[%d]", field.Name, j),
+					Label: fmt.Sprintf("%s %d", field.Label, j+1),
+					Type:  "group",
+				}
+				group.Fields = f.build(item, group.Name, fmt.Sprintf("%s[%d]", fieldPath, j), values)
+				field.Fields = append(field.Fields, group)
+			}
+		default:
+			formScalarField(field, structField, fieldType, value, values)
+		}
+		f.byName[field.Name] = field
+		f.byPath[fieldPath] = field
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func formScalarField(field *FormField, structField reflect.StructField, fieldType reflect.Type, value reflect.Value, values url.Values) {
+	elem := fieldType
+	if fieldType.Kind() == reflect.Slice {
+		field.Multiple = true
+		elem = derefType(fieldType.Elem())
+	}
+	field.Options = formOptions(structField.Tag.Get("options"))
+	field.Type = structField.Tag.Get("input")
+	if field.Type == "" {
+		switch elem.Kind() {
+		case reflect.Bool:
+			field.Type = "checkbox"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			field.Type = "number"
+		default:
+			field.Type = "text"
+		}
+		switch {
+		case len(field.Options) > 0:
+			field.Type = "select"
+		case elem == timeType:
+			field.Type = "date"
+		}
+	}
+	if values != nil {
+		field.Values = values[field.Name]
+	} else if field.Multiple {
+		for j := 0; j < value.Len(); j++ {
+			field.Values = append(field.Values, formatFormValue(value.Index(j), field.Type))
+		}
+	} else {
+		field.Values = []string{formatFormValue(value, field.Type)}
+	}
+	switch {
+	case field.Type == "password":
+		// passwords are never sent back
+		field.Values = nil
+	case field.Type == "checkbox" && !field.Multiple:
+		field.Checked = len(field.Values) > 0 && formTruthy(field.Values[0])
+	}
+	if len(field.Values) > 0 {
+		field.Value = field.Values[0]
+	}
+	for i := range field.Options {
+		for _, selected := range field.Values {
+			if field.Options[i].Value == selected {
+				field.Options[i].Selected = true
+			}
+		}
+	}
+	if field.Multiple && len(field.Options) == 0 && len(field.Values) == 0 {
+		// one empty input to start the list
+		field.Values = []string{""}
+	}
+}
+
+func formTruthy(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "on", "1", "yes":
+		return true
+	}
+	return false
+}
+
+func formatFormValue(value reflect.Value, inputType string) string {
+	value = reflect.Indirect(value)
+	if !value.IsValid() {
+		return ""
+	}
+	if value.Type() == timeType {
+		at := value.Interface().(time.Time)
+		if at.IsZero() {
+			return ""
+		}
+		switch inputType {
+		case "datetime-local":
+			return at.Format("2006-01-02T15:04")
+		case "time":
+			return at.Format("15:04")
+		}
+		return at.Format("2006-01-02")
+	}
+	if value.Kind() == reflect.Bool {
+		return strconv.FormatBool(value.Bool())
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// decodeForm sets the fields of the struct v from values, recording
+// the fields whose value did not convert in failed.
+func decodeForm(v reflect.Value, name string, values url.Values, failed map[string]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		fieldName := formFieldName(structField)
+		if fieldName == "-" {
+			continue
+		}
+		value := v.Field(i)
+		if formEmbedded(structField) {
+			decodeForm(allocFormValue(value), name, values, failed)
+			continue
+		}
+		fullName := joinFormName(name, fieldName)
+		fieldType := derefType(structField.Type)
+		switch {
+		case formStruct(fieldType):
+			decodeForm(allocFormValue(value), fullName, values, failed)
+		case fieldType.Kind() == reflect.Slice && formStruct(fieldType.Elem()):
+			n := formListLen(values, fullName)
+			items := reflect.MakeSlice(fieldType, n, n)
+			for j := 0; j < n; j++ {
+				decodeForm(allocFormValue(items.Index(j)), fmt.Sprintf("%s[%d]", fullName, j), values, failed)
+			}
+			allocFormValue(value).Set(items)
+		case fieldType.Kind() == reflect.Slice:
+			raw := values[fullName]
+			items := reflect.MakeSlice(fieldType, 0, len(raw))
+			for _, text := range raw {
+				if text == "" {
+					// the blank input of a list
+					continue
+				}
+				item := reflect.New(fieldType.Elem()).Elem()
+				if err := setFormValue(item, text); err != nil {
+					failed[fullName] = err.Error()
+					continue
+				}
+				items = reflect.Append(items, item)
+			}
+			allocFormValue(value).Set(items)
+		case fieldType.Kind() == reflect.Bool:
+			// unchecked checkboxes are not submitted at all
+			allocFormValue(value).SetBool(formTruthy(values.Get(fullName)))
+		default:
+			raw, ok := values[fullName]
+			if !ok {
+				continue
+			}
+			if err := setFormValue(value, raw[0]); err != nil {
+				failed[fullName] = err.Error()
+			}
+		}
+	}
+}
+
+// formListLen returns the number of items of the list name, one more
+// than the highest index submitted.
+func formListLen(values url.Values, name string) int {
+	n := 0
+	for key := range values {
+		rest := strings.TrimPrefix(key, name+"[")
+		if rest == key {
+			continue
+		}
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			continue
+		}
+		index, err := strconv.Atoi(rest[:end])
+		if err == nil && index >= n && index < maxFormListLen {
+			n = index + 1
+		}
+	}
+	return n
+}
+
+// allocFormValue returns the value v points to, allocating nil
+// pointers.
+func allocFormValue(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func setFormValue(v reflect.Value, text string) error {
+	if v.Kind() == reflect.Ptr {
+		if text == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		v = allocFormValue(v)
+	}
+	if v.Type() == timeType {
+		if text == "" {
+			v.Set(reflect.Zero(timeType))
+			return nil
+		}
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", "15:04"} {
+			if at, err := time.Parse(layout, text); err == nil {
+				v.Set(reflect.ValueOf(at))
+				return nil
+			}
+		}
+		return errors.New("must be a valid date")
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+	case reflect.Bool:
+		v.SetBool(formTruthy(text))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if text == "" {
+			v.SetInt(0)
+			return nil
+		}
+		n, err := strconv.ParseInt(text, 10, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if text == "" {
+			v.SetUint(0)
+			return nil
+		}
+		n, err := strconv.ParseUint(text, 10, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be a positive whole number")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if text == "" {
+			v.SetFloat(0)
+			return nil
+		}
+		n, err := strconv.ParseFloat(text, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("cannot be bound to %s", v.Type())
+	}
+	return nil
+}
+
+// FormFuncMap returns the template helpers rendering a Form and, for
+// hand laid out forms, a single FormField. Add it before loading the
+// templates.
+//
+// Example:
+//  r.SetFuncMap(ghostutils.FormFuncMap())
+//
+//  {{form .Form}}
+//  {{formField (.Form.Field "email")}}
+func FormFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"form":      renderForm,
+		"formField": renderFormField,
+	}
+}
+
+func renderForm(form *Form) (template.HTML, error) {
+	var out bytes.Buffer
+	if err := formTemplate.ExecuteTemplate(&out, "form", form); err != nil {
+		return "", err
+	}
+	return template.HTML(out.String()), nil
+}
+
+func renderFormField(field *FormField) (template.HTML, error) {
+	if field == nil {
+		return "", errors.New("no such form field")
+	}
+	var out bytes.Buffer
+	if err := formTemplate.ExecuteTemplate(&out, "field", field); err != nil {
+		return "", err
+	}
+	return template.HTML(out.String()), nil
+}
+
+var formTemplate = template.Must(template.New("form").Parse(`{{define "form"}}<form class="ghost-form" action="{{.Action}}" method="{{.Method}}">
+{{if .CSRF}}<input type="hidden" name="_csrf" value="{{.CSRF}}">
+{{end}}{{range .Errors}}<p class="ghost-form-error" role="alert">{{.}}</p>
+{{end}}{{range .Fields}}{{template "field" .}}{{end}}<button type="submit">{{.Submit}}</button>
+</form>{{end}}
+{{define "attrs"}}{{if .Required}} required{{end}}{{if .Errors}} aria-invalid="true" aria-describedby="{{.ID}}-error"{{end}}{{end}}
+{{define "errors"}}{{if .Errors}}<p class="ghost-form-error" id="{{.ID}}-error">{{range $i, $e := .Errors}}{{if $i}} {{end}}{{$e}}{{end}}</p>
+{{end}}{{end}}
+{{define "field"}}{{if eq .Type "group" "list"}}<fieldset class="ghost-form-{{.Type}}" id="{{.ID}}">
+<legend>{{.Label}}</legend>
+{{template "errors" .}}{{range .Fields}}{{template "field" .}}{{end}}</fieldset>
+{{else if eq .Type "hidden"}}{{$field := .}}{{range .Values}}<input type="hidden" name="{{$field.Name}}" value="{{.}}">
+{{end}}{{else}}<div class="ghost-form-field{{if .Errors}} ghost-form-invalid{{end}}">
+{{if and (eq .Type "checkbox") (not .Multiple)}}<label><input type="checkbox" id="{{.ID}}" name="{{.Name}}" value="true"{{if .Checked}} checked{{end}}{{template "attrs" .}}> {{.Label}}</label>
+{{else}}<label for="{{.ID}}">{{.Label}}</label>
+{{if eq .Type "textarea"}}<textarea id="{{.ID}}" name="{{.Name}}"{{if .Placeholder}} placeholder="{{.Placeholder}}"{{end}}{{template "attrs" .}}>{{.Value}}</textarea>
+{{else if eq .Type "select"}}<select id="{{.ID}}" name="{{.Name}}"{{if .Multiple}} multiple{{end}}{{template "attrs" .}}>{{if not .Multiple}}<option value=""></option>{{end}}{{range .Options}}<option value="{{.Value}}"{{if .Selected}} selected{{end}}>{{.Label}}</option>{{end}}</select>
+{{else if .Multiple}}{{$field := .}}{{range $i, $value := .Values}}<input type="{{$field.Type}}" {{if not $i}}id="{{$field.ID}}" {{end}}name="{{$field.Name}}" value="{{$value}}"{{template "attrs" $field}}>
+{{end}}{{else}}<input type="{{.Type}}" id="{{.ID}}" name="{{.Name}}" value="{{.Value}}"{{if .Placeholder}} placeholder="{{.Placeholder}}"{{end}}{{template "attrs" .}}>
+{{end}}{{end}}{{template "errors" .}}</div>
+{{end}}{{end}}`))
@@ -1,11 +1,15 @@
 package ghostutils
 
 import (
-	"io/ioutil"
+	"context"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/surrealdb/surrealdb.go"
-	"gopkg.in/yaml.v3"
 )
 
 type GhostConfig struct {
@@ -13,17 +17,64 @@ type GhostConfig struct {
 	Version     string `yaml:"version"`
 	Description string `yaml:"description"`
 	Port        int    `yaml:"port"`
-	SurrealDB   struct {
-		URL        string `yaml:"surrealdb-url"`
-		Username   string `yaml:"surrealdb-username"`
-		Password   string `yaml:"surrealdb-password"`
-		Database   string `yaml:"surrealdb-database"`
-		Namespace  string `yaml:"surrealdb-namespace"`
-	} `yaml:"surrealdb"`
-	TailwindCSS struct {
-		Input  string `yaml:"input"`
-		Output string `yaml:"output"`
-	} `yaml:"tailwindcss"`
+	// Mode is ModeAll, ModeWeb or ModeWorker, see ModeAll.
+	Mode        string `yaml:"mode"`
+	// TrustedProxies are the addresses or CIDRs of the reverse proxies
+	// whose X-Forwarded-For names the client, for rate limits and the
+	// login guard. Without any the peer address is the client IP.
+	TrustedProxies []string `yaml:"trusted-proxies"`
+	SurrealDB   SurrealDBConfig `yaml:"surrealdb"`
+	// Databases are the other connections of the app by name, see
+	// ConnectDatabases.
+	Databases     map[string]SurrealDBConfig `yaml:"databases"`
+	// ReadRouting sends the reads of a connection to the nearest of its
+	// replicas, see ReadRouter.
+	ReadRouting   ReadRoutingConfig  `yaml:"read-routing"`
+	TailwindCSS   TailwindConfig     `yaml:"tailwindcss"`
+	Scripts       EsbuildConfig      `yaml:"esbuild"`
+	// Views is the template directory, src/views by default.
+	Views         string             `yaml:"views"`
+	Templates     TemplateConfig     `yaml:"templates"`
+	// Content is the markdown content directory, src/content by
+	// default, see OpenCollection.
+	Content       string             `yaml:"content"`
+	Notifications NotificationConfig `yaml:"notifications"`
+	WebAuthn      WebAuthnConfig     `yaml:"webauthn"`
+	LoginGuard    LoginGuardConfig   `yaml:"login-guard"`
+	Signing       SigningConfig      `yaml:"signing"`
+	Policy        PolicyConfig       `yaml:"policy"`
+	Logging       LoggingConfig      `yaml:"logging"`
+	Health        HealthConfig       `yaml:"health"`
+	SLO           SLOConfig          `yaml:"slo"`
+	Migrations    MigrationsConfig   `yaml:"migrations"`
+	Watchdog      WatchdogConfig     `yaml:"watchdog"`
+	Auth          AuthConfig         `yaml:"auth"`
+	Session       SessionConfig      `yaml:"session"`
+	CSRF          CSRFConfig         `yaml:"csrf"`
+	CORS          CORSConfig         `yaml:"cors"`
+	RateLimit     RateLimitConfig    `yaml:"rate-limit"`
+	Shutdown      ShutdownConfig     `yaml:"shutdown"`
+	Cache         CacheConfig        `yaml:"cache"`
+	TLS           TLSConfig          `yaml:"tls"`
+	Metrics       MetricsConfig      `yaml:"metrics"`
+	Budgets       BudgetConfig       `yaml:"budgets"`
+	Telemetry     TelemetryConfig    `yaml:"telemetry"`
+	PWA           PWAConfig          `yaml:"pwa"`
+	Jobs          JobsConfig         `yaml:"jobs"`
+	Scheduler     SchedulerConfig    `yaml:"scheduler"`
+	PDF           PDFConfig          `yaml:"pdf"`
+	Uploads       UploadsConfig      `yaml:"uploads"`
+	Gateway       APIGatewayConfig   `yaml:"gateway"`
+	Mock          MockConfig         `yaml:"mock"`
+	Doctor        DoctorConfig       `yaml:"doctor"`
+	// Transforms are the transformer chains of the routes tagged with
+	// Transform, by tag.
+	Transforms    map[string][]TransformStep `yaml:"transforms"`
+	// Env is the profile the config was resolved for, empty for the
+	// base block alone.
+	Env string `yaml:"-"`
+	// Path is the file the config was loaded from.
+	Path string `yaml:"-"`
 }
 
 // New returns a new GhostConfig struct 
@@ -40,26 +91,22 @@ type GhostConfig struct {
 //  GhostConfig struct
 //  error
 func Load() (GhostConfig, error) {
-    // load ghost config from the root of the project
-	ghostConfig := GhostConfig{}
-    ghostConfigFile, err := ioutil.ReadFile("./ghost.yaml")
-	if err != nil {
-    
-		return ghostConfig, err
-	}
-	err = yaml.Unmarshal(ghostConfigFile, &ghostConfig)
-	if err != nil {
-		return ghostConfig, err
-	}
-	return ghostConfig, nil
+    // load ghost config from the root of the project, resolving the
+    // GHOST_ENV profile when it is set
+	return loadConfig("./ghost.yaml", os.Getenv(EnvVariable))
 }
 
 
 // Setup is used to setup the ghost project
 // with the surrealdb database and gin router 
-// engine. Template files are loaded from the
-// src/views directory and static files are loaded
-// from the static directory.
+// engine. Each block of the config enabled in
+// ghost.yaml is wired on r as its config type
+// describes, such as CORSConfig or JobsConfig,
+// and some install middleware, so call Setup
+// before registering routes. The connection is
+// closed by the OnStop hooks of Run. To keep
+// the cache, PDF engine and metrics it wired,
+// see SetupApp.
 // 
 // Example: 
 //  ghostConfig, err := ghostutils.New() 
@@ -71,41 +118,358 @@ func Load() (GhostConfig, error) {
 //  if err != nil {
 //      log.Fatal(err)
 //  }
-//  r.Run(fmt.Sprintf(":%d", ghostConfig.Port))
+//  if err := ghostConfig.Run(r); err != nil {
+//      log.Fatal(err)
+//  }
 // 
 // Returns:
 //  *surrealdb.DB for creating Routes using a GhostRoute interface 
 //  error 
 func (ghostConfig GhostConfig) BasicSurrealSetup(r *gin.Engine) (*surrealdb.DB, error) {
-    db, err := ghostConfig.surrealSetup()
+    _, db, err := ghostConfig.setup(context.Background(), r, nil, nil)
+    return db, err
+}
+
+// SetupApp is SetupContext, with the templates
+// and static files of SetupWithFS when either is
+// not nil, returning the App it wired: the
+// connection, the cache store, the PDF engine
+// and the metrics.
+//
+// Example:
+//  app, err := ghostConfig.SetupApp(context.Background(), r, nil, nil)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  slo := ghostutils.NewSLOTracker(ghostConfig.SLO)
+//  if app.Metrics != nil {
+//      app.Metrics.ObserveRequests(slo.ObserveRequest)
+//  }
+//
+// Returns:
+//  *App
+//  error
+func (ghostConfig GhostConfig) SetupApp(ctx context.Context, r *gin.Engine, templates, static fs.FS) (*App, error) {
+    app, _, err := ghostConfig.setup(ctx, r, templates, static)
+    return app, err
+}
+
+// SetupContext is BasicSurrealSetup bounded by
+// ctx: dialing, the retries while the database
+// starts, signing in and using the namespace
+// give up once ctx is canceled or past its
+// deadline, so a deploy does not hang on an
+// unreachable database.
+//
+// Example:
+//  ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//  defer cancel()
+//  db, err := ghostConfig.SetupContext(ctx, r)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  *surrealdb.DB
+//  error, wrapping ctx.Err() when ctx ended the setup
+func (ghostConfig GhostConfig) SetupContext(ctx context.Context, r *gin.Engine) (*surrealdb.DB, error) {
+    _, db, err := ghostConfig.setup(ctx, r, nil, nil)
+    return db, err
+}
+
+// SetupWithFS is BasicSurrealSetup for a single
+// binary: the templates are loaded from
+// templates and /static is served from static,
+// so the app no longer depends on its working
+// directory. Either may be nil. When a
+// filesystem holds the views or static
+// directory, as it does when the directory is
+// embedded with its path, that directory is
+// used.
+//
+// Example:
+//  //go:embed src/views
+//  var views embed.FS
+//
+//  //go:embed static
+//  var static embed.FS
+//
+//  db, err := ghostConfig.SetupWithFS(r, views, static)
+//
+// Returns:
+//  *surrealdb.DB
+//  error
+func (ghostConfig GhostConfig) SetupWithFS(r *gin.Engine, templates, static fs.FS) (*surrealdb.DB, error) {
+    _, db, err := ghostConfig.setup(context.Background(), r, templates, static)
+    return db, err
+}
+
+// SetupWithDB is BasicSurrealSetup for a
+// connection made by the caller, such as one to
+// a test namespace: r is wired from the config
+// the same way, and the migrations, health
+// routes and jobs use db. The caller closes db.
+//
+// Example:
+//  db, err := ghostConfig.Connect()
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  if err := ghostConfig.SetupWithDB(r, db); err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  error
+func (ghostConfig GhostConfig) SetupWithDB(r *gin.Engine, db *surrealdb.DB) error {
+    _, err := ghostConfig.SetupAppWithDB(r, db)
+    return err
+}
+
+// SetupAppWithDB is SetupWithDB returning the
+// App it wired, whose Stop stops the jobs it
+// started, as the test servers of ghosttest do
+// after each test.
+//
+// Example:
+//  app, err := ghostConfig.SetupAppWithDB(r, db)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  defer app.Stop(context.Background())
+//
+// Returns:
+//  *App
+//  error
+func (ghostConfig GhostConfig) SetupAppWithDB(r *gin.Engine, db *surrealdb.DB) (*App, error) {
+    app, err := ghostConfig.wire(r, nil, nil)
     if err != nil {
-        return db, err
+        return nil, err
     }
-    return db, nil
+    return app, ghostConfig.start(app, db)
+}
+
+func (ghostConfig GhostConfig) setup(ctx context.Context, r *gin.Engine, templates, static fs.FS) (*App, *surrealdb.DB, error) {
+    app, err := ghostConfig.wire(r, templates, static)
+    if err != nil {
+        return nil, nil, err
+    }
+    db, err := ghostConfig.surrealSetup(ctx)
+    if err != nil {
+        return nil, db, err
+    }
+    app.onStop(func(context.Context) error {
+        db.Close()
+        return nil
+    })
+    return app, db, ghostConfig.start(app, db)
 }
 
+// templateFuncs returns the helpers Setup gives the templates.
+func (ghostConfig GhostConfig) templateFuncs(static fs.FS) []template.FuncMap {
+    funcs := []template.FuncMap{
+        FormFuncMap(),
+        PaginationFuncMap(),
+        TableFuncMap(),
+        MoneyFuncMap(),
+        TimeFuncMap(),
+        CSRFFuncMap(),
+        DegradedFuncMap(),
+    }
+    if len(ghostConfig.Scripts.Input) > 0 {
+        funcs = append(funcs, ghostConfig.Esbuild().FuncMap())
+    }
+    if ghostConfig.PWA.Enabled {
+        funcs = append(funcs, ghostConfig.NewPWA(static).FuncMap())
+    }
+    return funcs
+}
 
-func (ghostConfig GhostConfig) signinObj() map[string]interface{} {
+// wire installs the middleware, templates and static files of the
+// config on r, returning the App the requests carry.
+func (ghostConfig GhostConfig) wire(r *gin.Engine, templates, static fs.FS) (*App, error) {
+    app := &App{Config: ghostConfig, Engine: r, CacheTTL: ghostConfig.Cache.TTL}
+    cache, err := ghostConfig.NewCacheStore()
+    if err != nil {
+        return nil, err
+    }
+    app.Cache = cache
+    pdf, err := ghostConfig.NewPDFEngine()
+    if err != nil {
+        return nil, err
+    }
+    app.PDF = pdf
+    if r != nil {
+        if err := r.SetTrustedProxies(ghostConfig.TrustedProxies); err != nil {
+            return nil, err
+        }
+        r.Use(app.attach())
+    }
+    if ghostConfig.Telemetry.Enabled && r != nil {
+        if err := ghostConfig.mountTelemetry(app, r); err != nil {
+            return nil, err
+        }
+    }
+    if ghostConfig.Logging.Requests && r != nil {
+        logger, err := NewLogger(ghostConfig.Logging)
+        if err != nil {
+            return nil, err
+        }
+        r.Use(RequestLogger(logger.Slog()))
+    }
+    if ghostConfig.Metrics.Enabled && r != nil {
+        app.Metrics = mountMetrics(r, ghostConfig.Metrics)
+    }
+    if ghostConfig.Budgets.Enabled && r != nil {
+        r.Use(Budgets(ghostConfig.Budgets))
+    }
+    if len(ghostConfig.CORS.AllowedOrigins) > 0 && r != nil {
+        r.Use(CORS(ghostConfig.CORS))
+    }
+    if ghostConfig.RateLimit.Enabled && r != nil {
+        limiter, err := ghostConfig.NewRateLimiter()
+        if err != nil {
+            return nil, err
+        }
+        r.Use(limiter.Middleware())
+    }
+    if err := ghostConfig.installTransforms(); err != nil {
+        return nil, err
+    }
+    if ghostConfig.CSRF.Enabled && r != nil {
+        r.Use(ghostConfig.NewCSRF().Middleware())
+    }
+    if r != nil && r.HTMLRender == nil {
+        funcs := ghostConfig.templateFuncs(static)
+        var engine *TemplateEngine
+        var err error
+        if templates != nil {
+            engine, err = ghostConfig.NewTemplatesFS(templates, funcs...)
+        } else if info, statErr := os.Stat(ghostConfig.Views); statErr == nil && info.IsDir() {
+            engine, err = ghostConfig.NewTemplates(funcs...)
+        }
+        if err != nil {
+            return nil, err
+        }
+        if engine != nil {
+            engine.Install(r)
+        }
+    }
+    if r != nil && static != nil {
+        files, err := subFS(static, "static")
+        if err != nil {
+            return nil, err
+        }
+        r.StaticFS("/static", http.FS(files))
+    }
+    if ghostConfig.PWA.Enabled && r != nil {
+        ghostConfig.NewPWA(static).Mount(r)
+    }
+    if ghostConfig.TailwindCSS.Watch && ghostConfig.TailwindCSS.Input != "" && gin.IsDebugging() {
+        ctx, cancel := context.WithCancel(context.Background())
+        app.onStop(func(context.Context) error {
+            cancel()
+            return nil
+        })
+        go func() {
+            if err := ghostConfig.Tailwind().Watch(ctx); err != nil {
+                log.Printf("tailwindcss: %v", err)
+            }
+        }()
+    }
+    if ghostConfig.Scripts.Watch && len(ghostConfig.Scripts.Input) > 0 && gin.IsDebugging() {
+        ctx, cancel := context.WithCancel(context.Background())
+        app.onStop(func(context.Context) error {
+            cancel()
+            return nil
+        })
+        go func() {
+            if err := ghostConfig.Esbuild().Watch(ctx); err != nil {
+                log.Printf("esbuild: %v", err)
+            }
+        }()
+    }
+    return app, nil
+}
+
+// start runs what needs the database once it is connected.
+func (ghostConfig GhostConfig) start(app *App, db GhostDB) error {
+    app.DB = db
+    r := app.Engine
+    if ghostConfig.Migrations.Auto {
+        if _, err := Migrate(db, ghostConfig.Migrations.Dir); err != nil {
+            return err
+        }
+    }
+    if ghostConfig.Health.Enabled && r != nil {
+        RegisterHealth(r, db, ghostConfig.Health)
+    }
+    if ghostConfig.Jobs.Enabled {
+        queue := ghostConfig.NewJobQueue(db)
+        queue.App = app
+        queue.Start()
+    }
+    return nil
+}
+
+
+
+func (db SurrealDBConfig) signinObj() map[string]interface{} {
     return map[string]interface{} {
-        "user": ghostConfig.SurrealDB.Username,
-        "pass": ghostConfig.SurrealDB.Password,
+        "user": db.Username,
+        "pass": db.Password,
     }
 }
 
-func (ghostConfig GhostConfig) surrealSetup() (*surrealdb.DB, error) {
+// Connect dials the surrealdb block, retrying
+// while the database starts, signs in and uses
+// its namespace and database, as Setup does.
+//
+// Returns:
+//  *surrealdb.DB, closed by the caller
+//  error
+func (ghostConfig GhostConfig) Connect() (*surrealdb.DB, error) {
+    return ghostConfig.surrealSetup(context.Background())
+}
+
+// ConnectContext is Connect bounded by ctx, see
+// SetupContext.
+//
+// Returns:
+//  *surrealdb.DB, closed by the caller
+//  error
+func (ghostConfig GhostConfig) ConnectContext(ctx context.Context) (*surrealdb.DB, error) {
+    return ghostConfig.surrealSetup(ctx)
+}
+
+func (ghostConfig GhostConfig) surrealSetup(ctx context.Context) (*surrealdb.DB, error) {
+    return ghostConfig.SurrealDB.connect(ctx)
+}
+
+func (config SurrealDBConfig) connect(ctx context.Context) (*surrealdb.DB, error) {
     var db *surrealdb.DB
-    db, err := surrealdb.New(ghostConfig.SurrealDB.URL)
+    endpoint, err := config.endpoint(ctx)
+    if err != nil {
+        return nil, err
+    }
+    // the database may still be starting, e.g. under docker compose
+    err = config.Retry.DoContext(ctx, func() error {
+        var err error
+        db, err = config.Connection.DialContext(ctx, endpoint)
+        return err
+    })
     if err != nil {
         return db, err
     }
-    if _, err := db.Signin(
-        ghostConfig.signinObj(),
+    conn := WithContext(ctx, db)
+    if _, err := conn.Signin(
+        config.signinObj(),
     ) ; err != nil {
         return db, err
     }
-    if _, err := db.Use(
-        ghostConfig.SurrealDB.Namespace,
-        ghostConfig.SurrealDB.Database,
+    if _, err := conn.Use(
+        config.Namespace,
+        config.Database,
     ); err != nil {
         return db, err
     }
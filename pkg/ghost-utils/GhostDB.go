@@ -0,0 +1,29 @@
+package ghostutils
+
+import (
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// GhostDB is the database GhostRoute, Repository and the query
+// helpers depend on. *surrealdb.DB implements it; tests of handlers
+// pass a mock instead, such as ghostmock.DB, so they run without a
+// live database.
+//
+// Example:
+//  func listPosts(db ghostutils.GhostDB) gin.HandlerFunc {
+//      posts := ghostutils.NewRepository[Post](db, "post")
+//      return func(c *gin.Context) {
+//          ...
+//      }
+//  }
+type GhostDB interface {
+	Query(sql string, vars interface{}) (interface{}, error)
+	Create(thing string, data interface{}) (interface{}, error)
+	Select(what string) (interface{}, error)
+	Update(what string, data interface{}) (interface{}, error)
+	Delete(what string) (interface{}, error)
+	Signin(vars interface{}) (interface{}, error)
+	Use(ns, database string) (interface{}, error)
+}
+
+var _ GhostDB = (*surrealdb.DB)(nil)
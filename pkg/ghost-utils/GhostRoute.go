@@ -0,0 +1,174 @@
+package ghostutils
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// GhostRoute is a group of handlers under one path that share the
+// database returned by Setup.
+type GhostRoute interface {
+	// Route creates the gin group of the route on r, with its
+	// middleware applied, and registers its handlers on it.
+	Route(r gin.IRouter) *gin.RouterGroup
+	// Middleware is the chain run before every handler of the route,
+	// such as auth, logging or rate limits.
+	Middleware() []gin.HandlerFunc
+	// DB returns the database the handlers use.
+	DB() GhostDB
+}
+
+// ParentRoute is implemented by GhostRoutes with child routes mounted
+// under their path, such as a BasicRoute with Nest.
+type ParentRoute interface {
+	GhostRoute
+	// Children returns the routes mounted on the group of the route,
+	// with paths relative to it.
+	Children() []GhostRoute
+}
+
+// dbBinder is implemented by the routes of this package, to take the
+// database of RegisterRoutes when built without one.
+type dbBinder interface {
+	bindDB(db GhostDB)
+}
+
+// RegisterRoutes mounts routes on r, each with its children, so a
+// whole API tree is declared and mounted in one call. Routes built
+// with a nil database use the one of their parent, and db at the top.
+//
+// Example:
+//  posts := ghostutils.NewBasicRoute(nil, "/:id/posts", func(g *gin.RouterGroup, route ghostutils.GhostRoute) {
+//      g.GET("", listUserPosts(route.DB()))
+//  })
+//  users := ghostutils.NewCRUDRoute[User]("/users", nil)
+//  users.Nest(posts)
+//  api := ghostutils.NewBasicRoute(nil, "/api", nil, ghostutils.RequireIdentity()).Nest(users)
+//  ghostutils.RegisterRoutes(r, db, api)   // /api/users, /api/users/:id/posts
+func RegisterRoutes(r gin.IRouter, db GhostDB, routes ...GhostRoute) {
+	for _, route := range routes {
+		bindRouteDB(route, db)
+		route.Route(r)
+	}
+}
+
+// bindRouteDB gives db to route and the database of route to its
+// children, down the tree.
+func bindRouteDB(route GhostRoute, db GhostDB) {
+	if binder, ok := route.(dbBinder); ok && db != nil {
+		binder.bindDB(db)
+	}
+	if parent, ok := route.(ParentRoute); ok {
+		for _, child := range parent.Children() {
+			bindRouteDB(child, route.DB())
+		}
+	}
+}
+
+// BasicRoute is the GhostRoute for routes built from a path, a
+// middleware chain and a function registering the handlers.
+//
+// Example:
+//  posts := ghostutils.NewBasicRoute(db, "/posts", func(g *gin.RouterGroup, route ghostutils.GhostRoute) {
+//      g.GET("", listPosts(route.DB()))
+//      g.POST("", createPost(route.DB()))
+//  }).Use(ghostutils.RequireIdentity())
+//  posts.Route(r)
+type BasicRoute struct {
+	Path       string
+	Handlers   func(g *gin.RouterGroup, route GhostRoute)
+	// Docs describes the handlers for OpenAPI, see Document.
+	Docs       []Operation
+	middleware []gin.HandlerFunc
+	children   []GhostRoute
+	db         GhostDB
+}
+
+// NewBasicRoute returns a route registering handlers under path.
+func NewBasicRoute(db GhostDB, path string, handlers func(g *gin.RouterGroup, route GhostRoute), middleware ...gin.HandlerFunc) *BasicRoute {
+	return &BasicRoute{Path: path, Handlers: handlers, middleware: middleware, db: db}
+}
+
+// Use appends middleware to the chain of the route. It must be called
+// before Route.
+func (b *BasicRoute) Use(middleware ...gin.HandlerFunc) *BasicRoute {
+	b.middleware = append(b.middleware, middleware...)
+	return b
+}
+
+// Document describes endpoints of the route for OpenAPI, with paths
+// relative to the route.
+//
+// Example:
+//  posts.Document(ghostutils.Operation{Method: "GET", Path: "", Summary: "List posts", Response: []Post{}})
+func (b *BasicRoute) Document(ops ...Operation) *BasicRoute {
+	b.Docs = append(b.Docs, ops...)
+	return b
+}
+
+// Nest adds child routes, mounted on the group of the route after its
+// handlers, so they run its middleware too.
+//
+// Example:
+//  users.Nest(ghostutils.NewBasicRoute(db, "/:id/posts", func(g *gin.RouterGroup, route ghostutils.GhostRoute) {
+//      g.GET("", listUserPosts(route.DB()))
+//  }))
+func (b *BasicRoute) Nest(children ...GhostRoute) *BasicRoute {
+	b.children = append(b.children, children...)
+	return b
+}
+
+// Children implements ParentRoute.
+func (b *BasicRoute) Children() []GhostRoute {
+	return b.children
+}
+
+// Operations implements DocumentedRoute, with the operations of the
+// documented children under the path of the route.
+func (b *BasicRoute) Operations() []Operation {
+	ops := make([]Operation, len(b.Docs))
+	for i, op := range b.Docs {
+		op.Path = joinRoutePath(b.Path, op.Path)
+		ops[i] = op
+	}
+	for _, child := range b.children {
+		documented, ok := child.(DocumentedRoute)
+		if !ok {
+			continue
+		}
+		for _, op := range documented.Operations() {
+			op.Path = joinRoutePath(b.Path, op.Path)
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// Middleware implements GhostRoute.
+func (b *BasicRoute) Middleware() []gin.HandlerFunc {
+	return b.middleware
+}
+
+// DB implements GhostRoute.
+func (b *BasicRoute) DB() GhostDB {
+	return b.db
+}
+
+func (b *BasicRoute) bindDB(db GhostDB) {
+	if b.db == nil {
+		b.db = db
+	}
+}
+
+// Route implements GhostRoute. The middleware is attached to the group
+// before the handlers and the children register, so it runs for all
+// of them.
+func (b *BasicRoute) Route(r gin.IRouter) *gin.RouterGroup {
+	g := r.Group(b.Path, b.middleware...)
+	if b.Handlers != nil {
+		b.Handlers(g, b)
+	}
+	for _, child := range b.children {
+		child.Route(g)
+	}
+	return g
+}
@@ -0,0 +1,232 @@
+package ghostutils
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hxTriggersKey is the gin context key of the events queued for the
+// HX-Trigger headers.
+const hxTriggersKey = "ghost-hx-triggers"
+
+// IsHTMX reports whether the request was made by htmx.
+func IsHTMX(c *gin.Context) bool {
+	return c.GetHeader("HX-Request") == "true"
+}
+
+// IsBoosted reports whether the request comes from an hx-boost link or
+// form, which expects a whole page.
+func IsBoosted(c *gin.Context) bool {
+	return c.GetHeader("HX-Boosted") == "true"
+}
+
+// HXTarget returns the id of the element htmx swaps into, if it has
+// one.
+func HXTarget(c *gin.Context) string {
+	return c.GetHeader("HX-Target")
+}
+
+// HXCurrentURL returns the URL of the page that made the request.
+func HXCurrentURL(c *gin.Context) string {
+	return c.GetHeader("HX-Current-URL")
+}
+
+// Fragment renders the template fragment, usually a {{define}} of
+// page, for htmx requests and the whole page with its layout for all
+// others, including boosted ones and history restores.
+//
+// Example:
+//  // posts.html: {{define "posts.html"}}...{{template "post-list" .}}...{{end}}
+//  //             {{define "post-list"}}<ul id="posts">...</ul>{{end}}
+//  ghostutils.Fragment(c, http.StatusOK, "posts.html", "post-list", gin.H{"Posts": posts})
+func Fragment(c *gin.Context, code int, page, fragment string, data interface{}) {
+	varyHTMX(c)
+	if WantsFragment(c) {
+		c.HTML(code, fragment, withLayout(c, data))
+		return
+	}
+	HTML(c, code, page, data)
+}
+
+// HXRedirect sends the browser to location: with HX-Redirect for htmx
+// requests, which do not follow redirects into the page, and a 303
+// for all others.
+func HXRedirect(c *gin.Context, location string) {
+	if IsHTMX(c) {
+		c.Header("HX-Redirect", location)
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, location)
+}
+
+// OOBSwap is a fragment swapped out of band, into an element other
+// than the target of the request.
+type OOBSwap struct {
+	// Target is the CSS selector of the element, e.g. #cart-count.
+	Target string
+	// Swap is how the fragment is swapped: innerHTML by default,
+	// beforeend, afterbegin and the other hx-swap values, or outerHTML
+	// for templates whose root element has the id and hx-swap-oob
+	// attribute itself.
+	Swap     string
+	Template string
+	Data     interface{}
+}
+
+// HXResponse sets the htmx response headers and renders a response
+// with out of band swaps.
+//
+// Example:
+//  ghostutils.HTMX(c).
+//      Trigger("cart-updated", gin.H{"count": len(cart.Items)}).
+//      OOB("#cart-count", "", "cart-count", cart).
+//      Render(http.StatusOK, "cart-item", item)
+type HXResponse struct {
+	c     *gin.Context
+	swaps []OOBSwap
+}
+
+// HTMX returns the htmx response of c.
+func HTMX(c *gin.Context) *HXResponse {
+	return &HXResponse{c: c}
+}
+
+// Trigger triggers the client event name once the response arrives,
+// with detail, which may be nil, as the event detail.
+func (r *HXResponse) Trigger(name string, detail interface{}) *HXResponse {
+	return r.trigger("HX-Trigger", name, detail)
+}
+
+// TriggerAfterSwap triggers name after the content is swapped.
+func (r *HXResponse) TriggerAfterSwap(name string, detail interface{}) *HXResponse {
+	return r.trigger("HX-Trigger-After-Swap", name, detail)
+}
+
+// TriggerAfterSettle triggers name after the content has settled.
+func (r *HXResponse) TriggerAfterSettle(name string, detail interface{}) *HXResponse {
+	return r.trigger("HX-Trigger-After-Settle", name, detail)
+}
+
+// trigger adds the event to header, keeping the events queued by
+// earlier calls for the request.
+func (r *HXResponse) trigger(header, name string, detail interface{}) *HXResponse {
+	var triggers map[string]map[string]interface{}
+	if value, ok := r.c.Get(hxTriggersKey); ok {
+		triggers = value.(map[string]map[string]interface{})
+	} else {
+		triggers = map[string]map[string]interface{}{}
+		r.c.Set(hxTriggersKey, triggers)
+	}
+	events := triggers[header]
+	if events == nil {
+		events = map[string]interface{}{}
+		triggers[header] = events
+	}
+	events[name] = detail
+	withDetail := false
+	names := make([]string, 0, len(events))
+	for event, value := range events {
+		names = append(names, event)
+		withDetail = withDetail || value != nil
+	}
+	if !withDetail {
+		sort.Strings(names)
+		r.c.Header(header, strings.Join(names, ", "))
+		return r
+	}
+	encoded, err := json.Marshal(events)
+	if err != nil {
+		r.c.Error(err)
+		return r
+	}
+	r.c.Header(header, string(encoded))
+	return r
+}
+
+// PushURL pushes url into the browser history.
+func (r *HXResponse) PushURL(url string) *HXResponse {
+	r.c.Header("HX-Push-Url", url)
+	return r
+}
+
+// ReplaceURL replaces the current URL in the browser history.
+func (r *HXResponse) ReplaceURL(url string) *HXResponse {
+	r.c.Header("HX-Replace-Url", url)
+	return r
+}
+
+// Redirect makes htmx load url as a full page.
+func (r *HXResponse) Redirect(url string) *HXResponse {
+	r.c.Header("HX-Redirect", url)
+	return r
+}
+
+// Location makes htmx load url like a boosted link, without a full
+// page load.
+func (r *HXResponse) Location(url string) *HXResponse {
+	r.c.Header("HX-Location", url)
+	return r
+}
+
+// Refresh makes htmx reload the page.
+func (r *HXResponse) Refresh() *HXResponse {
+	r.c.Header("HX-Refresh", "true")
+	return r
+}
+
+// Reswap overrides the hx-swap of the element making the request.
+func (r *HXResponse) Reswap(swap string) *HXResponse {
+	r.c.Header("HX-Reswap", swap)
+	return r
+}
+
+// Retarget swaps the response into the element matching selector.
+func (r *HXResponse) Retarget(selector string) *HXResponse {
+	r.c.Header("HX-Retarget", selector)
+	return r
+}
+
+// Reselect swaps only the part of the response matching selector.
+func (r *HXResponse) Reselect(selector string) *HXResponse {
+	r.c.Header("HX-Reselect", selector)
+	return r
+}
+
+// OOB adds the template rendered with data as an out of band swap into
+// target, see OOBSwap.
+func (r *HXResponse) OOB(target, swap, template string, data interface{}) *HXResponse {
+	r.swaps = append(r.swaps, OOBSwap{Target: target, Swap: swap, Template: template, Data: data})
+	return r
+}
+
+// Render renders template with data, with the layout data added like
+// HTML, and the out of band swaps after it. An empty template renders
+// the swaps alone.
+func (r *HXResponse) Render(code int, template string, data interface{}) {
+	c := r.c
+	if template != "" {
+		c.HTML(code, template, withLayout(c, data))
+	} else {
+		c.Status(code)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+	}
+	for _, swap := range r.swaps {
+		strategy := swap.Swap
+		if strategy == "" {
+			strategy = "innerHTML"
+		}
+		if strategy == "outerHTML" || strategy == "true" {
+			c.HTML(code, swap.Template, withLayout(c, swap.Data))
+			continue
+		}
+		c.Writer.WriteString(`<div hx-swap-oob="` + html.EscapeString(strategy+":"+swap.Target) + `">`)
+		c.HTML(code, swap.Template, withLayout(c, swap.Data))
+		c.Writer.WriteString("</div>")
+	}
+}
@@ -0,0 +1,112 @@
+package ghostutils
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IsHistoryRestore reports whether htmx is restoring a page the
+// back or forward button returned to that was not in its history
+// cache. It expects the whole page, not the fragment of the request
+// that pushed the URL.
+func IsHistoryRestore(c *gin.Context) bool {
+	return c.GetHeader("HX-History-Restore-Request") == "true"
+}
+
+// WantsFragment reports whether the request swaps a part of the page:
+// an htmx request that is neither boosted nor a history restore.
+func WantsFragment(c *gin.Context) bool {
+	return IsHTMX(c) && !IsBoosted(c) && !IsHistoryRestore(c)
+}
+
+// varyHTMX marks the response as depending on the htmx headers, so the
+// browser and shared caches never answer a page load, or the back
+// button, with a fragment.
+func varyHTMX(c *gin.Context) {
+	header := c.Writer.Header()
+	for _, name := range []string{"HX-Request", "HX-History-Restore-Request"} {
+		found := false
+		for _, value := range header.Values("Vary") {
+			for _, existing := range strings.Split(value, ",") {
+				found = found || strings.EqualFold(strings.TrimSpace(existing), name)
+			}
+		}
+		if !found {
+			header.Add("Vary", name)
+		}
+	}
+}
+
+// SoftNavigation makes the back and forward buttons work with partial
+// updates. It marks every response as varying by the htmx headers and
+// hides the htmx headers of history restores from the handlers, so
+// handlers checking IsHTMX render the whole page for them. Use it on
+// the routes of htmx pages.
+//
+// The convention is that every URL pushed into the history serves its
+// whole page to a plain request: render with Navigate, or Fragment for
+// requests that do not change the URL, and push the URL the fragment
+// shows, never the URL of an endpoint answering fragments only.
+//
+// Example:
+//  r.Use(ghostutils.SoftNavigation())
+//
+//  // <input name="q" hx-get="/posts" hx-target="#posts" hx-trigger="keyup changed delay:300ms">
+//  r.GET("/posts", func(c *gin.Context) {
+//      ghostutils.Navigate(c, http.StatusOK, "posts/index.html", "posts/index.html#list", gin.H{"Posts": posts})
+//  })
+func SoftNavigation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		varyHTMX(c)
+		if IsHistoryRestore(c) {
+			c.Request.Header.Del("HX-Request")
+			c.Request.Header.Del("HX-Target")
+			c.Request.Header.Del("HX-Trigger")
+			c.Request.Header.Del("HX-Trigger-Name")
+		}
+		c.Next()
+	}
+}
+
+// Navigate renders like Fragment and pushes the URL of GET requests
+// answered with the fragment into the history, so going back returns
+// to the state before the swap and reloading shows the same state. A
+// URL pushed by the handler already is kept.
+func Navigate(c *gin.Context, code int, page, fragment string, data interface{}) {
+	if WantsFragment(c) && c.Request.Method == http.MethodGet && c.Writer.Header().Get("HX-Push-Url") == "" {
+		HTMX(c).PushURL(c.Request.URL.RequestURI())
+	}
+	Fragment(c, code, page, fragment, data)
+}
+
+// PushQuery pushes the URL of the request with query instead of its
+// own query, e.g. for a POST changing filters whose state is a GET of
+// the same page. Empty values are left out.
+//
+// Example:
+//  ghostutils.HTMX(c).PushQuery(url.Values{"q": {q}, "page": {"1"}}).Render(http.StatusOK, "posts/index.html#list", data)
+func (r *HXResponse) PushQuery(query url.Values) *HXResponse {
+	clean := url.Values{}
+	for key, values := range query {
+		for _, value := range values {
+			if value != "" {
+				clean.Add(key, value)
+			}
+		}
+	}
+	target := r.c.Request.URL.Path
+	if encoded := clean.Encode(); encoded != "" {
+		target += "?" + encoded
+	}
+	return r.PushURL(target)
+}
+
+// NoPush keeps the URL of the page, even for elements with
+// hx-push-url, e.g. when a form is answered with its errors.
+func (r *HXResponse) NoPush() *HXResponse {
+	r.c.Header("HX-Push-Url", "false")
+	return r
+}
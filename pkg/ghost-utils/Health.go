@@ -0,0 +1,122 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthConfig is the health block of ghost.yaml. When Enabled, Setup
+// registers the liveness and readiness routes.
+//
+//  health:
+//      enabled: true
+//      liveness-path: /healthz
+//      readiness-path: /readyz
+//      timeout: 2s
+type HealthConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	LivenessPath  string        `yaml:"liveness-path"`
+	ReadinessPath string        `yaml:"readiness-path"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+// Defaults applied to HealthConfig by Validate.
+const (
+	DefaultLivenessPath  = "/healthz"
+	DefaultReadinessPath = "/readyz"
+	DefaultHealthTimeout = 2 * time.Second
+)
+
+// HealthStatus is the body of the health routes.
+type HealthStatus struct {
+	Status string                   `json:"status"`
+	Checks map[string]StartupResult `json:"checks,omitempty"`
+	// Degraded are the dependencies reported down, see ReportDown.
+	Degraded []DependencyState `json:"degraded,omitempty"`
+}
+
+// RegisterHealth registers the routes of config on r. Liveness always
+// answers 200 while the process serves requests. Readiness runs INFO
+// FOR DB against db and every check, each bounded by config.Timeout,
+// and answers 503 when one fails. Checks take the same form as the
+// startup report's. The dependencies reported down with ReportDown
+// make the status degraded without failing readiness.
+//
+// Example:
+//  ghostutils.RegisterHealth(r, db, ghostConfig.Health, ghostutils.StartupCheck{
+//      Name: "redis",
+//      Run: func(ctx context.Context) (string, error) {
+//          return "", rdb.Ping(ctx).Err()
+//      },
+//  })
+func RegisterHealth(r gin.IRoutes, db GhostDB, config HealthConfig, checks ...StartupCheck) {
+	if config.LivenessPath == "" {
+		config.LivenessPath = DefaultLivenessPath
+	}
+	if config.ReadinessPath == "" {
+		config.ReadinessPath = DefaultReadinessPath
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultHealthTimeout
+	}
+	r.GET(config.LivenessPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, HealthStatus{Status: StartupOK})
+	})
+	all := append([]StartupCheck{{Name: "surrealdb", Run: func(ctx context.Context) (string, error) {
+		if db == nil {
+			return "", errors.New("not connected")
+		}
+		start := time.Now()
+		if _, err := db.Query("INFO FOR DB", map[string]interface{}{}); err != nil {
+			return "", err
+		}
+		return "latency " + time.Since(start).Round(time.Microsecond).String(), nil
+	}}}, checks...)
+	r.GET(config.ReadinessPath, func(c *gin.Context) {
+		if ShuttingDown() {
+			c.JSON(http.StatusServiceUnavailable, HealthStatus{Status: StartupFailed})
+			return
+		}
+		status := HealthStatus{Status: StartupOK, Checks: map[string]StartupResult{}}
+		for _, check := range all {
+			result := runHealthCheck(c.Request.Context(), check, config.Timeout)
+			if result.Status == StartupFailed {
+				status.Status = StartupFailed
+			}
+			status.Checks[check.Name] = result
+		}
+		for _, state := range DependencyStates() {
+			if state.Down {
+				status.Degraded = append(status.Degraded, state)
+			}
+		}
+		if status.Status == StartupOK && len(status.Degraded) > 0 {
+			status.Status = HealthDegraded
+		}
+		code := http.StatusOK
+		if status.Status == StartupFailed {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, status)
+	})
+}
+
+// runHealthCheck runs check, failing it when it outlives timeout. The
+// surrealdb client takes no context, so a hung query is abandoned
+// rather than cancelled.
+func runHealthCheck(ctx context.Context, check StartupCheck, timeout time.Duration) StartupResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan StartupResult, 1)
+	go func() { done <- runStartupCheck(ctx, check) }()
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+		return StartupResult{Name: check.Name, Status: StartupFailed, Detail: "timed out", Duration: timeout.String()}
+	}
+}
@@ -0,0 +1,331 @@
+package ghostutils
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hypermedia media types.
+const (
+	MIMEJSONAPI = "application/vnd.api+json"
+	MIMEHAL     = "application/hal+json"
+)
+
+// HypermediaFormatKey is the gin context key used by
+// HypermediaFormat to force a serialization for a route.
+const HypermediaFormatKey = "ghost-hypermedia-format"
+
+// HypermediaOptions describes how records map to resources.
+//
+// Relationship fields are marked with the ghost tag. A relationship
+// holding record ids becomes a resource identifier, one holding
+// nested records is also added to the included resources:
+//
+//  type Post struct {
+//      ID       string    `json:"id"`
+//      Title    string    `json:"title"`
+//      Author   *User     `json:"author" ghost:"rel"`
+//      Comments []string  `json:"comments" ghost:"rel"`
+//  }
+type HypermediaOptions struct {
+	// BasePath is prefixed to resource links, e.g. "/api".
+	BasePath string
+	// Type overrides the resource type. By default it is the table
+	// part of the SurrealDB record id.
+	Type string
+}
+
+// HypermediaFormat forces a route to render with format, one of
+// MIMEJSONAPI, MIMEHAL or gin.MIMEJSON, regardless of Accept.
+func HypermediaFormat(format string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(HypermediaFormatKey, format)
+		c.Next()
+	}
+}
+
+// RenderHypermedia renders data, a record or slice of records, as
+// JSON:API, HAL or plain JSON depending on HypermediaFormat or the
+// Accept header. Fields the caller may not view are removed first.
+//
+// Example:
+//  posts, err := repo.List(c)
+//  ghostutils.RenderHypermedia(c, http.StatusOK, posts, ghostutils.HypermediaOptions{BasePath: "/api"})
+func RenderHypermedia(c *gin.Context, code int, data interface{}, opts HypermediaOptions) {
+	format := c.GetString(HypermediaFormatKey)
+	if format == "" {
+		format = c.NegotiateFormat(gin.MIMEJSON, MIMEJSONAPI, MIMEHAL)
+	}
+	identity, _ := CurrentIdentity(c)
+	switch format {
+	case MIMEJSONAPI:
+		c.Render(code, hypermediaJSON{contentType: MIMEJSONAPI, data: ToJSONAPI(data, identity.Roles, opts)})
+	case MIMEHAL:
+		c.Render(code, hypermediaJSON{contentType: MIMEHAL, data: ToHAL(data, identity.Roles, opts)})
+	default:
+		c.JSON(code, FilterFields(data, identity.Roles))
+	}
+}
+
+// ToJSONAPI builds a JSON:API document from data for a caller with
+// roles.
+func ToJSONAPI(data interface{}, roles []string, opts HypermediaOptions) map[string]interface{} {
+	rels := relationFieldsOf(data)
+	included := map[string]map[string]interface{}{}
+	var primary interface{}
+	if list, ok := FilterFields(data, roles).([]interface{}); ok {
+		resources := make([]interface{}, 0, len(list))
+		for _, item := range list {
+			resources = append(resources, jsonAPIResource(item, rels, opts, included))
+		}
+		primary = resources
+	} else {
+		primary = jsonAPIResource(FilterFields(data, roles), rels, opts, included)
+	}
+	doc := map[string]interface{}{"data": primary, "jsonapi": map[string]string{"version": "1.0"}}
+	if len(included) > 0 {
+		resources := make([]map[string]interface{}, 0, len(included))
+		for _, resource := range included {
+			resources = append(resources, resource)
+		}
+		// by type and id, so the same data gives the same document
+		sort.Slice(resources, func(i, j int) bool {
+			ti, tj := resources[i]["type"].(string), resources[j]["type"].(string)
+			if ti != tj {
+				return ti < tj
+			}
+			return resources[i]["id"].(string) < resources[j]["id"].(string)
+		})
+		out := make([]interface{}, len(resources))
+		for i, resource := range resources {
+			out[i] = resource
+		}
+		doc["included"] = out
+	}
+	return doc
+}
+
+func jsonAPIResource(item interface{}, rels []string, opts HypermediaOptions, included map[string]map[string]interface{}) interface{} {
+	fields, ok := item.(map[string]interface{})
+	if !ok {
+		return item
+	}
+	typ, id := splitRecordID(fields["id"], opts.Type)
+	attributes := map[string]interface{}{}
+	relationships := map[string]interface{}{}
+	for name, value := range fields {
+		if name == "id" {
+			continue
+		}
+		if containsString(rels, name) {
+			relationships[name] = map[string]interface{}{"data": jsonAPIIdentifiers(value, included, opts)}
+			continue
+		}
+		attributes[name] = value
+	}
+	resource := map[string]interface{}{
+		"type":       typ,
+		"id":         id,
+		"attributes": attributes,
+		"links":      map[string]string{"self": resourceLink(opts.BasePath, typ, id)},
+	}
+	if len(relationships) > 0 {
+		resource["relationships"] = relationships
+	}
+	return resource
+}
+
+func jsonAPIIdentifiers(value interface{}, included map[string]map[string]interface{}, opts HypermediaOptions) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			out = append(out, jsonAPIIdentifiers(item, included, opts))
+		}
+		return out
+	case string:
+		typ, id := splitRecordID(v, "")
+		return map[string]string{"type": typ, "id": id}
+	case map[string]interface{}:
+		typ, id := splitRecordID(v["id"], "")
+		attributes := map[string]interface{}{}
+		for name, field := range v {
+			if name != "id" {
+				attributes[name] = field
+			}
+		}
+		included[typ+":"+id] = map[string]interface{}{
+			"type":       typ,
+			"id":         id,
+			"attributes": attributes,
+			"links":      map[string]string{"self": resourceLink(opts.BasePath, typ, id)},
+		}
+		return map[string]string{"type": typ, "id": id}
+	}
+	return value
+}
+
+// ToHAL builds a HAL document from data for a caller with roles.
+// Lists are wrapped in an _embedded collection named after the
+// resource type.
+func ToHAL(data interface{}, roles []string, opts HypermediaOptions) map[string]interface{} {
+	rels := relationFieldsOf(data)
+	filtered := FilterFields(data, roles)
+	list, ok := filtered.([]interface{})
+	if !ok {
+		resource, _ := halResource(filtered, rels, opts).(map[string]interface{})
+		return resource
+	}
+	typ := opts.Type
+	items := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		items = append(items, halResource(item, rels, opts))
+		if typ == "" {
+			if fields, ok := item.(map[string]interface{}); ok {
+				typ, _ = splitRecordID(fields["id"], "")
+			}
+		}
+	}
+	if typ == "" {
+		typ = "items"
+	}
+	return map[string]interface{}{
+		"_links":    map[string]interface{}{"self": map[string]string{"href": strings.TrimRight(opts.BasePath, "/") + "/" + typ}},
+		"_embedded": map[string]interface{}{typ: items},
+		"count":     len(items),
+	}
+}
+
+func halResource(item interface{}, rels []string, opts HypermediaOptions) interface{} {
+	fields, ok := item.(map[string]interface{})
+	if !ok {
+		return item
+	}
+	typ, id := splitRecordID(fields["id"], opts.Type)
+	links := map[string]interface{}{"self": map[string]string{"href": resourceLink(opts.BasePath, typ, id)}}
+	embedded := map[string]interface{}{}
+	out := map[string]interface{}{}
+	for name, value := range fields {
+		if !containsString(rels, name) {
+			out[name] = value
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			relType, relID := splitRecordID(v, "")
+			links[name] = map[string]string{"href": resourceLink(opts.BasePath, relType, relID)}
+		case []interface{}:
+			var hrefs []interface{}
+			var nested []interface{}
+			for _, entry := range v {
+				if s, ok := entry.(string); ok {
+					relType, relID := splitRecordID(s, "")
+					hrefs = append(hrefs, map[string]string{"href": resourceLink(opts.BasePath, relType, relID)})
+				} else {
+					nested = append(nested, halResource(entry, nil, HypermediaOptions{BasePath: opts.BasePath}))
+				}
+			}
+			if len(hrefs) > 0 {
+				links[name] = hrefs
+			}
+			if len(nested) > 0 {
+				embedded[name] = nested
+			}
+		case map[string]interface{}:
+			embedded[name] = halResource(v, nil, HypermediaOptions{BasePath: opts.BasePath})
+		}
+	}
+	out["_links"] = links
+	if len(embedded) > 0 {
+		out["_embedded"] = embedded
+	}
+	return out
+}
+
+// splitRecordID splits "user:abc" into ("user", "abc").
+func splitRecordID(value interface{}, typ string) (string, string) {
+	id, _ := value.(string)
+	if idx := strings.Index(id, ":"); idx > 0 {
+		if typ == "" {
+			typ = id[:idx]
+		}
+		id = strings.Trim(id[idx+1:], "⟨⟩`")
+	}
+	return typ, id
+}
+
+func resourceLink(base, typ, id string) string {
+	return strings.TrimRight(base, "/") + "/" + typ + "/" + id
+}
+
+// relationFieldsOf returns the JSON names of fields tagged
+// ghost:"rel" in the element type of data.
+func relationFieldsOf(data interface{}) []string {
+	t := reflect.TypeOf(data)
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	var rels []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !ghostTagHas(field.Tag.Get("ghost"), "rel") {
+			continue
+		}
+		name, _ := parseJSONTag(field)
+		if name == "" {
+			name = field.Name
+		}
+		rels = append(rels, name)
+	}
+	return rels
+}
+
+// ghostTagHas reports whether the ";" separated ghost tag contains
+// the flag option.
+func ghostTagHas(tag, option string) bool {
+	for _, part := range strings.Split(tag, ";") {
+		if strings.TrimSpace(part) == option {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hypermediaJSON renders JSON with a hypermedia content type.
+type hypermediaJSON struct {
+	contentType string
+	data        interface{}
+}
+
+func (r hypermediaJSON) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	body, err := json.Marshal(r.data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func (r hypermediaJSON) WriteContentType(w http.ResponseWriter) {
+	w.Header()["Content-Type"] = []string{r.contentType}
+}
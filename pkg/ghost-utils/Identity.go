@@ -0,0 +1,104 @@
+package ghostutils
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IdentityKey is the gin context key holding the Identity of the
+// authenticated caller.
+const IdentityKey = "ghost-identity"
+
+// AdminRole is the role required for administrative features such
+// as impersonation.
+const AdminRole = "admin"
+
+// Identity is the authenticated principal of a request. Auth and
+// session middleware store it with SetIdentity, features that need
+// to know who is calling read it with CurrentIdentity.
+type Identity struct {
+	// ID is the SurrealDB record id, e.g. "user:tobie".
+	ID           string   `json:"id"`
+	Roles        []string `json:"roles,omitempty"`
+	Organization string   `json:"organization,omitempty"`
+	// ImpersonatedBy is the id of the admin acting as this identity.
+	ImpersonatedBy string `json:"impersonated_by,omitempty"`
+}
+
+// HasRole reports whether the identity has any of roles.
+func (i Identity) HasRole(roles ...string) bool {
+	for _, have := range i.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type identityContextKey struct{}
+
+// SetIdentity stores the identity on the gin context and on the
+// request context, so code that only receives c.Request.Context()
+// can still find it with IdentityFrom.
+func SetIdentity(c *gin.Context, identity Identity) {
+	c.Set(IdentityKey, identity)
+	c.Request = c.Request.WithContext(WithIdentity(c.Request.Context(), identity))
+}
+
+// WithIdentity returns a copy of ctx carrying identity.
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFrom returns the identity carried by ctx. Both request
+// contexts and *gin.Context values are understood.
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	if identity, ok := ctx.Value(identityContextKey{}).(Identity); ok && identity.ID != "" {
+		return identity, true
+	}
+	identity, ok := ctx.Value(IdentityKey).(Identity)
+	return identity, ok && identity.ID != ""
+}
+
+// CurrentIdentity returns the identity stored by SetIdentity.
+// ok is false for anonymous requests.
+func CurrentIdentity(c *gin.Context) (identity Identity, ok bool) {
+	value, exists := c.Get(IdentityKey)
+	if !exists {
+		return identity, false
+	}
+	identity, ok = value.(Identity)
+	return identity, ok && identity.ID != ""
+}
+
+// RequireIdentity aborts anonymous requests with 401.
+func RequireIdentity() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := CurrentIdentity(c); !ok {
+			Fail(c, NewGhostError(http.StatusUnauthorized, "unauthenticated", "authentication required"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireRole aborts requests whose identity has none of roles, with
+// 401 for anonymous callers and 403 otherwise.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, ok := CurrentIdentity(c)
+		if !ok {
+			Fail(c, NewGhostError(http.StatusUnauthorized, "unauthenticated", "authentication required"))
+			return
+		}
+		if !identity.HasRole(roles...) {
+			Fail(c, NewGhostError(http.StatusForbidden, "forbidden", "forbidden"))
+			return
+		}
+		c.Next()
+	}
+}
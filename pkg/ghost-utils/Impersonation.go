@@ -0,0 +1,214 @@
+package ghostutils
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ImpersonationCookie holds the signed impersonation grant.
+const ImpersonationCookie = "ghost_impersonate"
+
+// ImpersonatingKey is the gin context key set to true while the
+// request is made by an admin impersonating another user.
+const ImpersonatingKey = "ghost-impersonating"
+
+// Impersonation lets admins act as another user. The grant is kept in
+// a signed cookie and only honoured while the original admin is the
+// authenticated identity, so it cannot be replayed by anyone else.
+type Impersonation struct {
+	Signer *Signer
+	Audit  AuditLog
+	// LoadIdentity returns the identity to act as for a user id.
+	LoadIdentity func(ctx context.Context, id string) (Identity, error)
+	// MaxDuration limits how long a grant is valid. Defaults to 1h.
+	MaxDuration time.Duration
+	Secure      bool
+}
+
+// impersonationTokenPurpose is what the grants are signed for.
+const impersonationTokenPurpose = "impersonation"
+
+type impersonationGrant struct {
+	Admin   string    `json:"admin"`
+	Target  string    `json:"target"`
+	Started time.Time `json:"started"`
+}
+
+// Mount registers the start and stop endpoints on g:
+//  POST /impersonate/:id  start impersonating the user with id
+//  POST /impersonate/stop stop impersonating
+// Starting requires AdminRole, and other admins cannot be
+// impersonated.
+func (imp *Impersonation) Mount(g *gin.RouterGroup) {
+	g.POST("/impersonate/stop", imp.stop)
+	g.POST("/impersonate/:id", RequireRole(AdminRole), imp.start)
+}
+
+// Middleware swaps the authenticated admin identity for the
+// impersonated identity. It must run after the middleware that calls
+// SetIdentity. Every request made while impersonating is audited, and
+// refused when the audit entry cannot be written. The impersonated
+// identity never carries AdminRole, even if the target has gained it
+// since the grant.
+func (imp *Impersonation) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := c.Cookie(ImpersonationCookie)
+		if err != nil || token == "" {
+			c.Next()
+			return
+		}
+		var grant impersonationGrant
+		admin, ok := CurrentIdentity(c)
+		if !ok || imp.Signer.VerifyToken(impersonationTokenPurpose, token, &grant) != nil ||
+			grant.Admin != admin.ID || !admin.HasRole(AdminRole) {
+			imp.clearCookie(c)
+			c.Next()
+			return
+		}
+		target, err := imp.LoadIdentity(c.Request.Context(), grant.Target)
+		if err != nil {
+			imp.clearCookie(c)
+			Fail(c, err)
+			return
+		}
+		target.ImpersonatedBy = admin.ID
+		target.Roles = withoutRole(target.Roles, AdminRole)
+		err = imp.record(c, "impersonation.request", admin.ID, target.ID, map[string]interface{}{
+			"method": c.Request.Method,
+			"path":   c.Request.URL.Path,
+		})
+		if err != nil {
+			Fail(c, NewGhostError(http.StatusServiceUnavailable, "unavailable", "impersonated requests cannot be audited"))
+			return
+		}
+		SetIdentity(c, target)
+		c.Set(ImpersonatingKey, true)
+		c.Next()
+	}
+}
+
+// Impersonating reports whether the request is being made by an
+// impersonating admin.
+func Impersonating(c *gin.Context) bool {
+	return c.GetBool(ImpersonatingKey)
+}
+
+// ImpersonationData returns the values a layout template needs to
+// show the impersonation banner.
+//
+// Example:
+//  c.HTML(http.StatusOK, "page.html", gin.H{
+//      "Impersonation": ghostutils.ImpersonationData(c),
+//  })
+//
+//  {{ if .Impersonation.Active }}
+//    <div class="banner">Viewing as {{ .Impersonation.User }}</div>
+//  {{ end }}
+func ImpersonationData(c *gin.Context) gin.H {
+	identity, _ := CurrentIdentity(c)
+	return gin.H{
+		"Active": Impersonating(c),
+		"User":   identity.ID,
+		"Admin":  identity.ImpersonatedBy,
+	}
+}
+
+// DenyWhileImpersonating rejects the request with 403 while an admin
+// is impersonating. Use it on sensitive routes such as password,
+// payment and account deletion endpoints.
+func DenyWhileImpersonating() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if Impersonating(c) {
+			Fail(c, NewGhostError(http.StatusForbidden, "forbidden", "not allowed while impersonating"))
+			return
+		}
+		c.Next()
+	}
+}
+
+func (imp *Impersonation) start(c *gin.Context) {
+	if Impersonating(c) {
+		Fail(c, NewGhostError(http.StatusConflict, "conflict", "already impersonating"))
+		return
+	}
+	admin, _ := CurrentIdentity(c)
+	target := c.Param("id")
+	identity, err := imp.LoadIdentity(c.Request.Context(), target)
+	if err != nil {
+		FailStatus(c, http.StatusNotFound, err)
+		return
+	}
+	if identity.HasRole(AdminRole) {
+		Fail(c, NewGhostError(http.StatusForbidden, "forbidden", "admins cannot be impersonated"))
+		return
+	}
+	duration := imp.MaxDuration
+	if duration == 0 {
+		duration = time.Hour
+	}
+	token, err := imp.Signer.SignToken(impersonationTokenPurpose, impersonationGrant{
+		Admin:   admin.ID,
+		Target:  target,
+		Started: time.Now().UTC(),
+	}, duration)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	if err := imp.record(c, "impersonation.start", admin.ID, target, nil); err != nil {
+		Fail(c, NewGhostError(http.StatusServiceUnavailable, "unavailable", "impersonation cannot be audited"))
+		return
+	}
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(ImpersonationCookie, token, int(duration.Seconds()), "/", "", imp.Secure, true)
+	c.JSON(http.StatusOK, gin.H{"impersonating": target})
+}
+
+func (imp *Impersonation) stop(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	if Impersonating(c) {
+		// stopping only drops privileges, so it goes ahead unaudited
+		if err := imp.record(c, "impersonation.stop", identity.ImpersonatedBy, identity.ID, nil); err != nil {
+			c.Error(err)
+		}
+	}
+	imp.clearCookie(c)
+	c.Status(http.StatusNoContent)
+}
+
+func (imp *Impersonation) clearCookie(c *gin.Context) {
+	c.SetCookie(ImpersonationCookie, "", -1, "/", "", imp.Secure, true)
+}
+
+func (imp *Impersonation) record(c *gin.Context, action, actor, subject string, details map[string]interface{}) error {
+	audit := imp.Audit
+	if audit == nil {
+		audit = LogAuditLog{}
+	}
+	err := audit.Record(c.Request.Context(), AuditEntry{
+		Action:  action,
+		Actor:   actor,
+		Subject: subject,
+		IP:      c.ClientIP(),
+		Details: details,
+		At:      time.Now().UTC(),
+	})
+	if err != nil {
+		c.Error(err)
+	}
+	return err
+}
+
+// withoutRole returns roles without role.
+func withoutRole(roles []string, role string) []string {
+	kept := make([]string, 0, len(roles))
+	for _, r := range roles {
+		if r != role {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
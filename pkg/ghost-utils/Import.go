@@ -0,0 +1,540 @@
+package ghostutils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Import column types.
+const (
+	ImportString   = "string"
+	ImportInt      = "int"
+	ImportFloat    = "float"
+	ImportBool     = "bool"
+	ImportDatetime = "datetime"
+)
+
+// ImportColumn maps a source column to a record field.
+type ImportColumn struct {
+	// Field is the record field, the column name when empty.
+	Field    string
+	Type     string
+	Required bool
+	// Transform runs on the trimmed raw value before conversion.
+	Transform func(string) string
+}
+
+// ImportMapping describes how source rows become records. Columns
+// not listed are ignored. Validate, when set, checks the converted
+// record.
+type ImportMapping struct {
+	Columns  map[string]ImportColumn
+	Validate func(record map[string]interface{}) error
+}
+
+// ImportError is a problem with one row. Row counts from 1, not
+// including a CSV header.
+type ImportError struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportProgress is reported after every chunk.
+type ImportProgress struct {
+	Processed int `json:"processed"`
+	Imported  int `json:"imported"`
+	Failed    int `json:"failed"`
+}
+
+// ImportReport is the outcome of an import.
+type ImportReport struct {
+	DryRun   bool          `json:"dry_run"`
+	Rows     int           `json:"rows"`
+	Valid    int           `json:"valid"`
+	Imported int           `json:"imported"`
+	Errors   []ImportError `json:"errors,omitempty"`
+}
+
+// Importer loads CSV or JSON data into a table. Valid rows are
+// stamped and authorized as Repository.Create does and written in
+// chunks, each in one transaction; the rows of a failed chunk are
+// retried one at a time, so only those at fault are reported. Invalid
+// rows are reported without stopping the import.
+//
+// With a Queue, ImportHandler stores the upload in Uploads and
+// imports it in a job, reporting its ImportReport as the job's
+// progress; a retried job resumes after the last chunk written.
+// Register the job in the workers, and keep jobs.timeout above the
+// longest import.
+//
+// Example:
+//  importer := ghostutils.Importer{
+//      DB:    db,
+//      Table: "contact",
+//      Mapping: ghostutils.ImportMapping{Columns: map[string]ghostutils.ImportColumn{
+//          "Email":     {Field: "email", Required: true, Transform: strings.ToLower},
+//          "Full Name": {Field: "name"},
+//          "Signed Up": {Field: "created_at", Type: ghostutils.ImportDatetime},
+//      }},
+//  }
+//  report, err := importer.ImportCSV(ctx, file, dryRun)
+type Importer struct {
+	DB      *surrealdb.DB
+	Table   string
+	Mapping ImportMapping
+	// Authorizer stamps and checks every record, see Repository.
+	Authorizer RecordAuthorizer
+	// ChunkSize is the number of rows per insert. Defaults to 500.
+	ChunkSize int
+	// Progress is called after every chunk.
+	Progress func(ImportProgress)
+	// Queue and Uploads run the imports of ImportHandler as jobs of
+	// JobType, "import:<table>" by default.
+	Queue   *JobQueue
+	Uploads Storage
+	JobType string
+}
+
+// importFileError is a problem with the file as a whole, which
+// retrying does not solve.
+type importFileError struct {
+	err error
+}
+
+func (e *importFileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *importFileError) Unwrap() error {
+	return e.err
+}
+
+// importJob is the payload of an import job.
+type importJob struct {
+	Key      string   `json:"key"`
+	JSON     bool     `json:"json"`
+	DryRun   bool     `json:"dry_run"`
+	Identity Identity `json:"identity"`
+}
+
+func (im *Importer) jobType() string {
+	if im.JobType == "" {
+		return "import:" + im.Table
+	}
+	return im.JobType
+}
+
+// Register registers the job running the imports enqueued by
+// ImportHandler. Call it wherever the queue's workers run.
+func (im *Importer) Register() {
+	RegisterJob(im.jobType(), func(ctx context.Context, job importJob) error {
+		r, err := im.Uploads.Open(ctx, job.Key)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		report := ImportReport{DryRun: job.DryRun}
+		if current, ok := CurrentJob(ctx); ok && current.Progress != nil {
+			// resume after the rows a failed attempt wrote
+			if raw, err := json.Marshal(current.Progress); err == nil {
+				_ = json.Unmarshal(raw, &report)
+			}
+		}
+		if job.Identity.ID != "" {
+			ctx = WithIdentity(ctx, job.Identity)
+		}
+		if job.JSON {
+			report, err = im.importJSON(ctx, r, report)
+		} else {
+			report, err = im.importCSV(ctx, r, report)
+		}
+		var fileErr *importFileError
+		if errors.As(err, &fileErr) {
+			report.Errors = append(report.Errors, ImportError{Row: report.Rows, Message: err.Error()})
+			err = ReportJobProgress(ctx, report)
+		}
+		if err != nil {
+			return err
+		}
+		if err := im.Uploads.Delete(ctx, job.Key); err != nil {
+			log.Printf("import %s: removing %s: %v", im.Table, job.Key, err)
+		}
+		return nil
+	})
+}
+
+// enqueue stores the upload and enqueues its import.
+func (im *Importer) enqueue(ctx context.Context, body io.Reader, contentType string, isJSON, dryRun bool) (Job, error) {
+	key := fmt.Sprintf("imports/%s/%s", im.Table, randomID(16))
+	if err := im.Uploads.Put(ctx, key, body, contentType); err != nil {
+		return Job{}, err
+	}
+	identity, _ := IdentityFrom(ctx)
+	return im.Queue.Enqueue(ctx, im.jobType(), importJob{Key: key, JSON: isJSON, DryRun: dryRun, Identity: identity})
+}
+
+// ImportCSV imports a CSV document whose first row is the header.
+func (im *Importer) ImportCSV(ctx context.Context, r io.Reader, dryRun bool) (ImportReport, error) {
+	return im.importCSV(ctx, r, ImportReport{DryRun: dryRun})
+}
+
+// importCSV imports a CSV document after the rows report has read.
+func (im *Importer) importCSV(ctx context.Context, r io.Reader, report ImportReport) (ImportReport, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return report, &importFileError{fmt.Errorf("reading csv header: %w", err)}
+	}
+	return im.run(ctx, report, func() (map[string]interface{}, error) {
+		fields, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			if i < len(fields) {
+				row[strings.TrimSpace(name)] = fields[i]
+			}
+		}
+		return row, nil
+	})
+}
+
+// ImportJSON imports a JSON array of objects or newline delimited
+// JSON objects.
+func (im *Importer) ImportJSON(ctx context.Context, r io.Reader, dryRun bool) (ImportReport, error) {
+	return im.importJSON(ctx, r, ImportReport{DryRun: dryRun})
+}
+
+// importJSON imports JSON objects after the rows report has read.
+func (im *Importer) importJSON(ctx context.Context, r io.Reader, report ImportReport) (ImportReport, error) {
+	buffered := bufio.NewReader(r)
+	first, err := firstNonSpace(buffered)
+	if err != nil {
+		return report, &importFileError{err}
+	}
+	dec := json.NewDecoder(buffered)
+	if first == '[' {
+		if _, err := dec.Token(); err != nil {
+			return report, &importFileError{err}
+		}
+	}
+	return im.run(ctx, report, func() (map[string]interface{}, error) {
+		if first == '[' && !dec.More() {
+			return nil, io.EOF
+		}
+		var row map[string]interface{}
+		if err := dec.Decode(&row); err != nil {
+			return nil, err
+		}
+		return row, nil
+	})
+}
+
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, r.UnreadByte()
+		}
+	}
+}
+
+// run imports the rows of next, skipping those report has already
+// read.
+func (im *Importer) run(ctx context.Context, report ImportReport, next func() (map[string]interface{}, error)) (ImportReport, error) {
+	chunkSize := im.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 500
+	}
+	repo := &Repository[map[string]interface{}]{DB: im.DB, Table: im.Table, Authorizer: im.Authorizer}
+	var (
+		chunk []map[string]interface{}
+		rows  []int
+		// valid rows whose write failed
+		refused int
+	)
+	flush := func() error {
+		if len(chunk) > 0 && !report.DryRun {
+			imported, problems, err := im.write(ctx, repo, chunk, rows)
+			if err != nil {
+				return err
+			}
+			report.Imported += imported
+			report.Errors = append(report.Errors, problems...)
+			refused += len(chunk) - imported
+		}
+		chunk, rows = chunk[:0], rows[:0]
+		if im.Progress != nil {
+			im.Progress(ImportProgress{Processed: report.Rows, Imported: report.Imported, Failed: report.Rows - report.Valid + refused})
+		}
+		if err := ReportJobProgress(ctx, report); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+	skip := report.Rows
+	for read := 1; ; read++ {
+		raw, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var syntax *json.SyntaxError
+		if read <= skip {
+			if errors.As(err, &syntax) {
+				return report, &importFileError{err}
+			}
+			continue
+		}
+		report.Rows = read
+		if err != nil {
+			report.Errors = append(report.Errors, ImportError{Row: report.Rows, Message: err.Error()})
+			if errors.As(err, &syntax) {
+				// the stream cannot be resynchronised
+				return report, &importFileError{err}
+			}
+			continue
+		}
+		record, problems := im.convert(report.Rows, raw)
+		if len(problems) > 0 {
+			report.Errors = append(report.Errors, problems...)
+			continue
+		}
+		report.Valid++
+		chunk = append(chunk, record)
+		rows = append(rows, report.Rows)
+		if len(chunk) >= chunkSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, flush()
+}
+
+// write creates the records of a chunk in one transaction. When it
+// fails the records are created one at a time, so only the rows at
+// fault are reported.
+func (im *Importer) write(ctx context.Context, repo *Repository[map[string]interface{}], chunk []map[string]interface{}, rows []int) (int, []ImportError, error) {
+	var (
+		problems []ImportError
+		contents []map[string]interface{}
+		kept     []int
+	)
+	for i, record := range chunk {
+		content, err := repo.createContent(ctx, record)
+		if err != nil {
+			problems = append(problems, ImportError{Row: rows[i], Message: err.Error()})
+			continue
+		}
+		contents, kept = append(contents, content), append(kept, rows[i])
+	}
+	if len(contents) == 0 {
+		return 0, problems, nil
+	}
+	defer repo.invalidateWrite(ctx)
+	err := WithTransaction(repo.db(ctx), func(tx *Tx) error {
+		for _, content := range contents {
+			tx.Create(im.Table, content)
+		}
+		return nil
+	})
+	if err == nil {
+		return len(contents), problems, nil
+	}
+	imported := 0
+	for i, content := range contents {
+		if _, err := surrealCreate[map[string]interface{}](repo.db(ctx), im.Table, content); err != nil {
+			problems = append(problems, ImportError{Row: kept[i], Message: err.Error()})
+			continue
+		}
+		imported++
+	}
+	if imported == 0 && ctx.Err() != nil {
+		return 0, problems, ctx.Err()
+	}
+	return imported, problems, nil
+}
+
+// convert maps and validates one raw row.
+func (im *Importer) convert(row int, raw map[string]interface{}) (map[string]interface{}, []ImportError) {
+	record := map[string]interface{}{}
+	var problems []ImportError
+	for column, spec := range im.Mapping.Columns {
+		field := spec.Field
+		if field == "" {
+			field = column
+		}
+		value, present := raw[column]
+		text, isText := value.(string)
+		if isText {
+			text = strings.TrimSpace(text)
+			if spec.Transform != nil {
+				text = spec.Transform(text)
+			}
+		}
+		if !present || value == nil || (isText && text == "") {
+			if spec.Required {
+				problems = append(problems, ImportError{Row: row, Column: column, Message: "is required"})
+			}
+			continue
+		}
+		if f, ok := value.(float64); ok {
+			// JSON numbers, formatted without an exponent
+			text = strconv.FormatFloat(f, 'f', -1, 64)
+		} else if !isText {
+			text = fmt.Sprint(value)
+		}
+		converted, err := convertImportValue(text, spec.Type)
+		if err != nil {
+			problems = append(problems, ImportError{Row: row, Column: column, Message: err.Error()})
+			continue
+		}
+		record[field] = converted
+	}
+	if len(problems) == 0 && im.Mapping.Validate != nil {
+		if err := im.Mapping.Validate(record); err != nil {
+			problems = append(problems, ImportError{Row: row, Message: err.Error()})
+		}
+	}
+	return record, problems
+}
+
+func convertImportValue(text, typ string) (interface{}, error) {
+	switch typ {
+	case ImportInt:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", text)
+		}
+		return n, nil
+	case ImportFloat:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", text)
+		}
+		return f, nil
+	case ImportBool:
+		b, err := strconv.ParseBool(strings.ToLower(text))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", text)
+		}
+		return b, nil
+	case ImportDatetime:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, text); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a date", text)
+	}
+	return text, nil
+}
+
+// ImportHandler serves an upload endpoint for im. The file is read
+// from the "file" form field, or the body, as CSV or JSON by its
+// content type. ?dry_run=true only validates. With a Queue it answers
+// 202 with the id of the import job, see ImportStatusHandler.
+//
+// Example:
+//  r.POST("/admin/contacts/import", ghostutils.RequireRole(ghostutils.AdminRole), ghostutils.ImportHandler(&importer))
+func ImportHandler(im *Importer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+		var (
+			body        io.Reader = c.Request.Body
+			contentType           = c.ContentType()
+			name        string
+		)
+		if file, header, err := c.Request.FormFile("file"); err == nil {
+			defer file.Close()
+			body, contentType, name = file, header.Header.Get("Content-Type"), header.Filename
+		}
+		var (
+			report ImportReport
+			err    error
+		)
+		isJSON := strings.Contains(contentType, "json") || strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".ndjson")
+		if im.Queue != nil {
+			job, err := im.enqueue(c.Request.Context(), body, contentType, isJSON, dryRun)
+			if err != nil {
+				Fail(c, err)
+				return
+			}
+			c.JSON(http.StatusAccepted, gin.H{"job": job.ID})
+			return
+		}
+		if isJSON {
+			report, err = im.ImportJSON(c.Request.Context(), body, dryRun)
+		} else {
+			report, err = im.ImportCSV(c.Request.Context(), body, dryRun)
+		}
+		if err != nil {
+			Fail(c, NewGhostError(http.StatusBadRequest, "import_failed", err.Error()).Wrap(err).WithDetails(gin.H{"report": report}))
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// ImportStatusHandler returns the state of the import job :job,
+// started by the caller, and its report so far. Admins see every
+// import.
+//
+// Example:
+//  r.GET("/admin/contacts/import/:job", ghostutils.ImportStatusHandler(&importer))
+func ImportStatusHandler(im *Importer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if im.Queue == nil {
+			Fail(c, NewGhostError(http.StatusNotFound, "not_found", "import not found"))
+			return
+		}
+		job, ok, err := im.Queue.Job(c.Request.Context(), c.Param("job"))
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		var payload importJob
+		if raw, err := json.Marshal(job.Payload); err == nil {
+			_ = json.Unmarshal(raw, &payload)
+		}
+		identity, _ := CurrentIdentity(c)
+		if !ok || job.Type != im.jobType() || (payload.Identity.ID != identity.ID && !identity.HasRole(AdminRole)) {
+			Fail(c, NewGhostError(http.StatusNotFound, "not_found", "import not found"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": job.Status, "report": job.Progress, "error": job.Error})
+	}
+}
+
+// ImportReportCSV writes the errors of report as CSV, for handing
+// back to whoever prepared the file.
+func ImportReportCSV(report ImportReport) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"row", "column", "message"})
+	for _, e := range report.Errors {
+		_ = w.Write([]string{strconv.Itoa(e.Row), e.Column, e.Message})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
@@ -0,0 +1,727 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// InboundMail is the normalized form of an email received through
+// an inbound webhook, regardless of which provider delivered it.
+type InboundMail struct {
+	MessageID   string              `json:"message_id"`
+	InReplyTo   string              `json:"in_reply_to,omitempty"`
+	References  []string            `json:"references,omitempty"`
+	From        string              `json:"from"`
+	To          []string            `json:"to"`
+	Cc          []string            `json:"cc,omitempty"`
+	Subject     string              `json:"subject"`
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Headers     map[string][]string `json:"headers,omitempty"`
+	Attachments []InboundAttachment `json:"attachments,omitempty"`
+	ReceivedAt  time.Time           `json:"received_at"`
+}
+
+// InboundAttachment describes an attachment that has been written
+// to the configured Storage. Key is the storage key of the content.
+type InboundAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Key         string `json:"key"`
+}
+
+// InboundMailOptions configures how inbound mail is parsed.
+type InboundMailOptions struct {
+	// Store receives attachment contents. Attachments are dropped
+	// when Store is nil.
+	Store Storage
+	// Prefix is prepended to every attachment key.
+	// Defaults to "inbound".
+	Prefix string
+	// MaxBytes limits the size of the request body.
+	// Defaults to 25MB.
+	MaxBytes int64
+	// ConfirmSubscriptions makes the handler confirm SES/SNS
+	// subscription requests automatically, once their signature is
+	// verified.
+	ConfirmSubscriptions bool
+	// SNSTopics are the ARNs of the topics SES notifications may come
+	// from. SNS messages are always checked against their AWS
+	// signature; with SNSTopics set the topic must also be listed.
+	SNSTopics []string
+	// SendGridPublicKey is the base64 verification key of SendGrid's
+	// signed Inbound Parse, required for multipart requests.
+	SendGridPublicKey string
+	// InsecureSkipVerify accepts SES and SendGrid requests without
+	// checking their signatures, for local testing only.
+	InsecureSkipVerify bool
+}
+
+// SNSConfirmationError is returned by ParseSESInbound when the
+// payload is an SNS subscription confirmation rather than a mail.
+type SNSConfirmationError struct {
+	SubscribeURL string
+}
+
+func (e *SNSConfirmationError) Error() string {
+	return "sns subscription confirmation: " + e.SubscribeURL
+}
+
+// ErrUnsupportedInbound is returned when a webhook payload is in a
+// format none of the parsers understand.
+var ErrUnsupportedInbound = errors.New("unsupported inbound mail payload")
+
+// ErrInboundSignature is returned when an SES or SendGrid request is
+// unsigned or its signature does not verify.
+var ErrInboundSignature = errors.New("inbound mail signature is invalid")
+
+func (opts InboundMailOptions) withDefaults() InboundMailOptions {
+	if opts.Prefix == "" {
+		opts.Prefix = "inbound"
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = 25 << 20
+	}
+	return opts
+}
+
+// ParseMIMEMail parses a raw RFC 5322 message, storing any
+// attachments through opts.Store.
+//
+// Example:
+//  inbound, err := ghostutils.ParseMIMEMail(ctx, r, opts)
+//  if err != nil {
+//      return err
+//  }
+//  fmt.Println(inbound.Subject)
+func ParseMIMEMail(ctx context.Context, r io.Reader, opts InboundMailOptions) (InboundMail, error) {
+	opts = opts.withDefaults()
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return InboundMail{}, err
+	}
+	inbound := InboundMail{
+		MessageID:  strings.Trim(msg.Header.Get("Message-Id"), "<>"),
+		InReplyTo:  strings.Trim(msg.Header.Get("In-Reply-To"), "<>"),
+		References: splitReferences(msg.Header.Get("References")),
+		From:       decodeHeader(msg.Header.Get("From")),
+		To:         addressList(msg.Header, "To"),
+		Cc:         addressList(msg.Header, "Cc"),
+		Subject:    decodeHeader(msg.Header.Get("Subject")),
+		Headers:    map[string][]string(msg.Header),
+		ReceivedAt: time.Now().UTC(),
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		inbound.ReceivedAt = date.UTC()
+	}
+	err = inbound.readPart(ctx, opts,
+		msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"),
+		"", msg.Body)
+	return inbound, err
+}
+
+// ParseSESInbound parses an SES receipt notification delivered
+// through SNS. The SES action must include the raw message content.
+// The SNS signature is verified, see VerifySNSMessage, and the topic
+// checked against opts.SNSTopics.
+func ParseSESInbound(ctx context.Context, body []byte, opts InboundMailOptions) (InboundMail, error) {
+	var envelope snsMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return InboundMail{}, err
+	}
+	if !opts.InsecureSkipVerify {
+		if envelope.Type == "" {
+			return InboundMail{}, fmt.Errorf("%w: not an SNS message", ErrInboundSignature)
+		}
+		if err := envelope.verify(ctx); err != nil {
+			return InboundMail{}, err
+		}
+		if len(opts.SNSTopics) > 0 && !containsString(opts.SNSTopics, envelope.TopicArn) {
+			return InboundMail{}, fmt.Errorf("%w: topic %s is not allowed", ErrInboundSignature, envelope.TopicArn)
+		}
+	}
+	if envelope.Type == "SubscriptionConfirmation" {
+		return InboundMail{}, &SNSConfirmationError{SubscribeURL: envelope.SubscribeURL}
+	}
+	notification := []byte(envelope.Message)
+	if envelope.Type == "" {
+		notification = body
+	}
+	var ses struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(notification, &ses); err != nil {
+		return InboundMail{}, err
+	}
+	if ses.Content == "" {
+		return InboundMail{}, fmt.Errorf("ses notification has no content: %w", ErrUnsupportedInbound)
+	}
+	raw, err := base64.StdEncoding.DecodeString(ses.Content)
+	if err != nil {
+		// SES sends UTF-8 content when the action encoding is not BASE64
+		raw = []byte(ses.Content)
+	}
+	return ParseMIMEMail(ctx, bytes.NewReader(raw), opts)
+}
+
+// ParseSendGridInbound parses a SendGrid Inbound Parse request, which
+// is multipart/form-data. Both the parsed and the "send raw" modes
+// are supported. The request must be signed with opts.SendGridPublicKey,
+// see VerifySendGridRequest.
+func ParseSendGridInbound(ctx context.Context, req *http.Request, opts InboundMailOptions) (InboundMail, error) {
+	opts = opts.withDefaults()
+	req.Body = http.MaxBytesReader(nil, req.Body, opts.MaxBytes)
+	if !opts.InsecureSkipVerify {
+		if err := VerifySendGridRequest(req, opts.SendGridPublicKey); err != nil {
+			return InboundMail{}, err
+		}
+	}
+	if err := req.ParseMultipartForm(opts.MaxBytes); err != nil {
+		return InboundMail{}, err
+	}
+	form := req.MultipartForm
+	if raw := formValue(form, "email"); raw != "" {
+		return ParseMIMEMail(ctx, strings.NewReader(raw), opts)
+	}
+	// the parsed mode gives the charset of each text field
+	var charsets map[string]string
+	json.Unmarshal([]byte(formValue(form, "charsets")), &charsets)
+	field := func(key string) string {
+		return decodeCharset(charsets[key], []byte(formValue(form, key)))
+	}
+	inbound := InboundMail{
+		From:       decodeHeader(field("from")),
+		To:         splitAddresses(field("to")),
+		Cc:         splitAddresses(field("cc")),
+		Subject:    field("subject"),
+		Text:       field("text"),
+		HTML:       field("html"),
+		ReceivedAt: time.Now().UTC(),
+	}
+	if headers := formValue(form, "headers"); headers != "" {
+		if msg, err := mail.ReadMessage(strings.NewReader(headers + "\r\n")); err == nil {
+			inbound.Headers = map[string][]string(msg.Header)
+			inbound.MessageID = strings.Trim(msg.Header.Get("Message-Id"), "<>")
+			inbound.InReplyTo = strings.Trim(msg.Header.Get("In-Reply-To"), "<>")
+			inbound.References = splitReferences(msg.Header.Get("References"))
+		}
+	}
+	for _, files := range form.File {
+		for _, fh := range files {
+			f, err := fh.Open()
+			if err != nil {
+				return inbound, err
+			}
+			err = inbound.storeAttachment(ctx, opts, fh.Filename, fh.Header.Get("Content-Type"), f)
+			f.Close()
+			if err != nil {
+				return inbound, err
+			}
+		}
+	}
+	return inbound, nil
+}
+
+// ParseInbound detects the provider from the request content type
+// and dispatches to the matching parser. Bodies over opts.MaxBytes
+// fail with an *http.MaxBytesError rather than being cut short.
+func ParseInbound(req *http.Request, opts InboundMailOptions) (InboundMail, error) {
+	opts = opts.withDefaults()
+	ctx := req.Context()
+	req.Body = http.MaxBytesReader(nil, req.Body, opts.MaxBytes)
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "multipart/form-data":
+		return ParseSendGridInbound(ctx, req, opts)
+	case mediaType == "application/json" || (mediaType == "text/plain" && req.Header.Get("X-Amz-Sns-Message-Type") != ""):
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return InboundMail{}, err
+		}
+		return ParseSESInbound(ctx, body, opts)
+	case mediaType == "message/rfc822" || mediaType == "text/plain":
+		return ParseMIMEMail(ctx, req.Body, opts)
+	}
+	return InboundMail{}, ErrUnsupportedInbound
+}
+
+// InboundMailHandler returns a handler that parses the inbound
+// webhook and passes the normalized mail to handle. SES and SendGrid
+// requests are verified by their provider signatures and answered 401
+// when they do not verify; raw message/rfc822 posts carry none, so
+// combine the handler with VerifyWebhook for them.
+//
+// Example:
+//  opts := ghostutils.InboundMailOptions{
+//      SNSTopics:         []string{"arn:aws:sns:eu-west-1:123456789012:inbound"},
+//      SendGridPublicKey: os.Getenv("SENDGRID_INBOUND_KEY"),
+//  }
+//  r.POST("/webhooks/mail", ghostutils.InboundMailHandler(opts, func(c *gin.Context, m ghostutils.InboundMail) error {
+//      return replies.Handle(m)
+//  }))
+func InboundMailHandler(opts InboundMailOptions, handle func(*gin.Context, InboundMail) error) gin.HandlerFunc {
+	opts = opts.withDefaults()
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, opts.MaxBytes)
+		inbound, err := ParseInbound(c.Request, opts)
+		var confirm *SNSConfirmationError
+		if errors.As(err, &confirm) {
+			if opts.ConfirmSubscriptions && snsURL(confirm.SubscribeURL) {
+				if err := confirmSNS(c.Request.Context(), confirm.SubscribeURL); err != nil {
+					FailStatus(c, http.StatusBadGateway, err)
+					return
+				}
+			}
+			c.Status(http.StatusOK)
+			return
+		}
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.Is(err, ErrInboundSignature):
+			FailStatus(c, http.StatusUnauthorized, err)
+			return
+		case errors.As(err, &tooLarge):
+			FailStatus(c, http.StatusRequestEntityTooLarge, err)
+			return
+		case err != nil:
+			FailStatus(c, http.StatusBadRequest, err)
+			return
+		}
+		if err := handle(c, inbound); err != nil {
+			Fail(c, err)
+			return
+		}
+		if !c.Writer.Written() {
+			c.Status(http.StatusOK)
+		}
+	}
+}
+
+func (m *InboundMail) readPart(ctx context.Context, opts InboundMailOptions, contentType, encoding, disposition string, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = m.readPart(ctx, opts,
+				part.Header.Get("Content-Type"),
+				part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"),
+				part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	dispType, dispParams, _ := mime.ParseMediaType(disposition)
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if dispType == "attachment" || filename != "" {
+		return m.storeAttachment(ctx, opts, decodeHeader(filename), mediaType, body)
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	switch mediaType {
+	case "text/html":
+		if m.HTML == "" {
+			m.HTML = decodeCharset(params["charset"], content)
+		}
+	case "text/plain":
+		if m.Text == "" {
+			m.Text = decodeCharset(params["charset"], content)
+		}
+	default:
+		return m.storeAttachment(ctx, opts, "", mediaType, bytes.NewReader(content))
+	}
+	return nil
+}
+
+func (m *InboundMail) storeAttachment(ctx context.Context, opts InboundMailOptions, filename, contentType string, r io.Reader) error {
+	if opts.Store == nil {
+		return nil
+	}
+	if filename == "" {
+		filename = "attachment"
+	}
+	key := path.Join(opts.Prefix, randomID(8), path.Base("/"+filename))
+	counter := &countingReader{r: r}
+	if err := opts.Store.Put(ctx, key, counter, contentType); err != nil {
+		return err
+	}
+	m.Attachments = append(m.Attachments, InboundAttachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        counter.n,
+		Key:         key,
+	})
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newlineStripper drops CR and LF bytes so base64 bodies wrapped at
+// 76 columns can be decoded.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	out := p[:0]
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			out = append(out, b)
+		}
+	}
+	return len(out), err
+}
+
+var headerDecoder = mime.WordDecoder{CharsetReader: charsetReader}
+
+// charsetReader decodes input from charset to UTF-8, for encoded
+// words in charsets other than UTF-8 and ISO-8859-1.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// decodeCharset returns content decoded from charset, or as is when
+// the charset is UTF-8, empty or unknown.
+func decodeCharset(charset string, content []byte) string {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return string(content)
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(content)
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return string(content)
+	}
+	return string(decoded)
+}
+
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func addressList(header mail.Header, key string) []string {
+	list, err := header.AddressList(key)
+	if err != nil {
+		return splitAddresses(header.Get(key))
+	}
+	out := make([]string, 0, len(list))
+	for _, addr := range list {
+		out = append(out, addr.Address)
+	}
+	return out
+}
+
+func splitAddresses(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	if list, err := mail.ParseAddressList(value); err == nil {
+		out := make([]string, 0, len(list))
+		for _, addr := range list {
+			out = append(out, addr.Address)
+		}
+		return out
+	}
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func splitReferences(value string) []string {
+	var out []string
+	for _, ref := range strings.Fields(value) {
+		out = append(out, strings.Trim(ref, "<>"))
+	}
+	return out
+}
+
+func formValue(form *multipart.Form, key string) string {
+	if values := form.Value[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// snsMessage is an SNS HTTP(S) delivery, with the fields its
+// signature covers.
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	SubscribeURL     string `json:"SubscribeURL"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+}
+
+// snsHost matches the hosts SNS signs and confirms from.
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// snsMaxAge bounds how old a signed SNS message may be, against
+// replays.
+const snsMaxAge = time.Hour
+
+var (
+	snsClient       = &http.Client{Timeout: 10 * time.Second}
+	snsCertificates sync.Map
+)
+
+// snsURL reports whether raw is an https URL of an SNS endpoint.
+func snsURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "https" && u.Port() == "" && snsHost.MatchString(u.Hostname())
+}
+
+// VerifySNSMessage checks the signature of an SNS message against the
+// certificate it names, which must be served by an
+// sns.<region>.amazonaws.com host. Messages older than an hour are
+// refused as replays.
+//
+// Returns:
+//  error wrapping ErrInboundSignature when the message does not verify
+func VerifySNSMessage(ctx context.Context, body []byte) error {
+	var msg snsMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return err
+	}
+	return msg.verify(ctx)
+}
+
+func (msg snsMessage) verify(ctx context.Context) error {
+	hash := crypto.SHA1
+	switch msg.SignatureVersion {
+	case "1":
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("%w: unknown SNS signature version %q", ErrInboundSignature, msg.SignatureVersion)
+	}
+	if !snsURL(msg.SigningCertURL) || !strings.HasSuffix(msg.SigningCertURL, ".pem") {
+		return fmt.Errorf("%w: signing certificate %q is not on an SNS host", ErrInboundSignature, msg.SigningCertURL)
+	}
+	if msg.SubscribeURL != "" && !snsURL(msg.SubscribeURL) {
+		return fmt.Errorf("%w: subscribe URL %q is not on an SNS host", ErrInboundSignature, msg.SubscribeURL)
+	}
+	sent, err := time.Parse(time.RFC3339, msg.Timestamp)
+	if err != nil || time.Since(sent) > snsMaxAge {
+		return fmt.Errorf("%w: message timestamp %q is too old", ErrInboundSignature, msg.Timestamp)
+	}
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInboundSignature, err)
+	}
+	key, err := snsCertificate(ctx, msg.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(msg.signed())
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInboundSignature, err)
+	}
+	return nil
+}
+
+// signed returns the string SNS signs, the name and value of each
+// signed field of the message type on their own lines.
+func (msg snsMessage) signed() []byte {
+	var b bytes.Buffer
+	add := func(name, value string) {
+		b.WriteString(name + "\n" + value + "\n")
+	}
+	add("Message", msg.Message)
+	add("MessageId", msg.MessageID)
+	if msg.Type == "Notification" {
+		if msg.Subject != "" {
+			add("Subject", msg.Subject)
+		}
+		add("Timestamp", msg.Timestamp)
+	} else {
+		add("SubscribeURL", msg.SubscribeURL)
+		add("Timestamp", msg.Timestamp)
+		add("Token", msg.Token)
+	}
+	add("TopicArn", msg.TopicArn)
+	add("Type", msg.Type)
+	return b.Bytes()
+}
+
+// snsCertificate returns the public key of the certificate at raw,
+// fetched once per process.
+func snsCertificate(ctx context.Context, raw string) (*rsa.PublicKey, error) {
+	if key, ok := snsCertificates.Load(raw); ok {
+		return key.(*rsa.PublicKey), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := snsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching SNS certificate: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: SNS certificate is not PEM", ErrInboundSignature)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInboundSignature, err)
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("%w: SNS certificate is expired or not RSA", ErrInboundSignature)
+	}
+	snsCertificates.Store(raw, key)
+	return key, nil
+}
+
+// confirmSNS visits the subscribe URL of a verified confirmation.
+func confirmSNS(ctx context.Context, subscribeURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, subscribeURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := snsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("confirming SNS subscription: %s", resp.Status)
+	}
+	return nil
+}
+
+// SendGrid signature headers of signed webhooks.
+const (
+	SendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	SendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+// VerifySendGridRequest checks the ECDSA signature SendGrid puts on
+// signed webhooks: the SHA-256 of the timestamp header followed by the
+// body, under publicKey, the base64 key of the SendGrid settings. The
+// body is restored for the parser.
+//
+// Returns:
+//  error wrapping ErrInboundSignature when the request does not verify
+func VerifySendGridRequest(req *http.Request, publicKey string) error {
+	if publicKey == "" {
+		return fmt.Errorf("%w: no SendGrid public key is configured", ErrInboundSignature)
+	}
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return err
+	}
+	key, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("sendgrid public key is not ECDSA")
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	signature, err := base64.StdEncoding.DecodeString(req.Header.Get(SendGridSignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("%w: missing SendGrid signature", ErrInboundSignature)
+	}
+	digest := sha256.Sum256(append([]byte(req.Header.Get(SendGridTimestampHeader)), body...))
+	if !ecdsa.VerifyASN1(key, digest[:], signature) {
+		return ErrInboundSignature
+	}
+	return nil
+}
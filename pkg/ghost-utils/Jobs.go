@@ -0,0 +1,612 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// JobsConfig is the `jobs:` block of ghost.yaml. Jobs are stored in
+// Table and run by a pool of Concurrency workers, started by Setup
+// when Enabled or by Worker in a process of their own. A failed job
+// is retried after the delays of Retry, and once it has failed
+// Retry.MaxAttempts times, or with ErrJobPermanent, it is left in the
+// table as dead.
+//
+// Example:
+//  jobs:
+//    enabled: true
+//    concurrency: 8
+//    timeout: 2m
+//    retry:
+//      max-attempts: 5
+//      initial-delay: 10s
+//      max-delay: 1h
+type JobsConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Table       string `yaml:"table"`
+	Concurrency int    `yaml:"concurrency"`
+	// PollInterval is how often the workers look for due jobs.
+	PollInterval time.Duration `yaml:"poll-interval"`
+	// Timeout bounds each run of a job. A job running past it, whose
+	// worker likely crashed, is taken by another worker.
+	Timeout time.Duration `yaml:"timeout"`
+	Retry   RetryConfig   `yaml:"retry"`
+}
+
+// Defaults applied to JobsConfig by Validate.
+const (
+	DefaultJobsTable        = "job"
+	DefaultJobsConcurrency  = 4
+	DefaultJobsPollInterval = time.Second
+	DefaultJobsTimeout      = 5 * time.Minute
+	DefaultJobsAttempts     = 5
+	DefaultJobsInitialDelay = 10 * time.Second
+	DefaultJobsMaxDelay     = time.Hour
+)
+
+// Job states.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDead    = "dead"
+	// JobDone is a succeeded job that reported progress, kept for a
+	// day so its final progress can be read.
+	JobDone = "done"
+)
+
+// ErrJobPermanent, wrapped by the error of a job handler, marks a
+// failure that running the job again cannot fix, such as a request
+// the remote end rejected. The job is dead at once.
+//
+// Example:
+//  if resp.StatusCode == http.StatusBadRequest {
+//      return fmt.Errorf("%w: %s", ghostutils.ErrJobPermanent, resp.Status)
+//  }
+var ErrJobPermanent = errors.New("permanent job failure")
+
+// ErrJobLost is returned by ReportJobProgress once the job ran past
+// its timeout and another worker took it.
+var ErrJobLost = errors.New("job was taken by another worker")
+
+// jobsDoneRetention is how long done jobs are kept.
+const jobsDoneRetention = 24 * time.Hour
+
+// Job is a stored job. Jobs that succeed are deleted, unless they
+// reported progress, see ReportJobProgress.
+type Job struct {
+	ID          string      `json:"id,omitempty"`
+	Type        string      `json:"type"`
+	Payload     interface{} `json:"payload,omitempty"`
+	Status      string      `json:"status"`
+	Attempts    int         `json:"attempts"`
+	MaxAttempts int         `json:"max_attempts"`
+	Error       string      `json:"error,omitempty"`
+	Progress    interface{} `json:"progress,omitempty"`
+	RunAt       time.Time   `json:"run_at"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	// Holder identifies the claim of the worker running the job; only
+	// it may record the outcome.
+	Holder string `json:"holder,omitempty"`
+}
+
+// JobHandler runs a job of one type with its raw payload.
+type JobHandler func(ctx context.Context, payload json.RawMessage) error
+
+var (
+	jobHandlersMu sync.RWMutex
+	jobHandlers   = map[string]JobHandler{}
+)
+
+// RegisterJob registers fn to run the jobs of jobType, decoding their
+// payload into T. Workers only take the jobs of registered types, so
+// a worker deployed before a new type leaves its jobs to the others.
+//
+// Example:
+//  type WelcomeEmail struct {
+//      UserID string `json:"user_id"`
+//  }
+//
+//  ghostutils.RegisterJob("welcome-email", func(ctx context.Context, job WelcomeEmail) error {
+//      return mailer.SendWelcome(ctx, job.UserID)
+//  })
+func RegisterJob[T any](jobType string, fn func(ctx context.Context, payload T) error) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobHandlers[jobType] = func(ctx context.Context, raw json.RawMessage) error {
+		var payload T
+		if len(raw) > 0 && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &payload); err != nil {
+				return fmt.Errorf("decoding payload: %w", err)
+			}
+		}
+		return fn(ctx, payload)
+	}
+}
+
+// jobTypes returns the registered job types, sorted.
+func jobTypes() []string {
+	jobHandlersMu.RLock()
+	defer jobHandlersMu.RUnlock()
+	types := make([]string, 0, len(jobHandlers))
+	for jobType := range jobHandlers {
+		types = append(types, jobType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func jobHandler(jobType string) (JobHandler, bool) {
+	jobHandlersMu.RLock()
+	defer jobHandlersMu.RUnlock()
+	handler, ok := jobHandlers[jobType]
+	return handler, ok
+}
+
+// JobQueue enqueues and runs the jobs of the jobs block.
+type JobQueue struct {
+	DB     GhostDB
+	Config JobsConfig
+	// OnDead, if set, is called when a job has failed its last
+	// attempt, e.g. to alert.
+	OnDead func(job Job, err error)
+	// App, set by Setup, is carried by the contexts of the handlers,
+	// see AppFrom.
+	App *App
+
+	wake chan struct{}
+	// web is set in ModeWeb, where Start leaves the jobs to the workers.
+	web bool
+}
+
+// NewJobQueue returns the queue of the jobs block on db.
+//
+// Example:
+//  jobs := ghostConfig.NewJobQueue(db)
+//  _, err := jobs.Enqueue(c, "welcome-email", WelcomeEmail{UserID: user.ID})
+func (ghostConfig GhostConfig) NewJobQueue(db GhostDB) *JobQueue {
+	return &JobQueue{DB: db, Config: ghostConfig.Jobs, wake: make(chan struct{}, 1), web: !ghostConfig.RunsWorkers()}
+}
+
+func (q *JobQueue) table() string {
+	if q.Config.Table == "" {
+		return DefaultJobsTable
+	}
+	return q.Config.Table
+}
+
+func (q *JobQueue) timeout() time.Duration {
+	if q.Config.Timeout <= 0 {
+		return DefaultJobsTimeout
+	}
+	return q.Config.Timeout
+}
+
+func (q *JobQueue) retry() RetryConfig {
+	retry := q.Config.Retry
+	if retry.MaxAttempts == 0 {
+		retry.MaxAttempts = DefaultJobsAttempts
+	}
+	if retry.InitialDelay == 0 {
+		retry.InitialDelay = DefaultJobsInitialDelay
+	}
+	if retry.MaxDelay == 0 {
+		retry.MaxDelay = DefaultJobsMaxDelay
+	}
+	return retry
+}
+
+// Enqueue stores a job of jobType with payload, encoded as JSON, to
+// run as soon as a worker is free.
+//
+// Returns:
+//  Job as stored
+//  error if it could not be stored
+func (q *JobQueue) Enqueue(ctx context.Context, jobType string, payload interface{}) (Job, error) {
+	return q.EnqueueAt(ctx, jobType, payload, time.Now())
+}
+
+// EnqueueAt stores a job of jobType with payload to run at runAt.
+func (q *JobQueue) EnqueueAt(ctx context.Context, jobType string, payload interface{}, runAt time.Time) (Job, error) {
+	id := randomID(16)
+	job, _, err := surrealFirst[Job](q.DB, `CREATE type::thing($tb, $id) CONTENT {
+		type: $type, payload: $payload, status: $status, attempts: 0, max_attempts: $max,
+		run_at: <datetime>$run_at, created_at: time::now(), updated_at: time::now()
+	}`, map[string]interface{}{
+		"tb":      q.table(),
+		"id":      id,
+		"type":    jobType,
+		"payload": payload,
+		"status":  JobPending,
+		"max":     q.retry().MaxAttempts,
+		"run_at":  runAt.UTC(),
+	})
+	if err != nil {
+		return job, err
+	}
+	job.ID = id
+	if !runAt.After(time.Now()) {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return job, nil
+}
+
+// claim takes up to limit due jobs of the registered types: pending
+// ones, and running ones whose worker stopped. The update only applies
+// while the job is still free, so of two workers only one takes it.
+func (q *JobQueue) claim(limit int) ([]Job, error) {
+	types := jobTypes()
+	if len(types) == 0 {
+		return nil, nil
+	}
+	due, err := surrealQuery[Job](q.DB, `SELECT id, run_at FROM type::table($tb)
+		WHERE type INSIDE $types AND ((status = $pending AND run_at <= time::now()) OR (status = $running AND locked_until < time::now()))
+		ORDER BY run_at LIMIT $limit`, map[string]interface{}{
+		"tb":      q.table(),
+		"types":   types,
+		"pending": JobPending,
+		"running": JobRunning,
+		"limit":   limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var claimed []Job
+	for _, candidate := range due {
+		_, id := splitRecordID(candidate.ID, q.table())
+		job, ok, err := surrealFirst[Job](q.DB, `UPDATE type::thing($tb, $id)
+			SET status = $running, attempts += 1, holder = $holder, locked_until = <datetime>$until, updated_at = time::now()
+			WHERE (status = $pending AND run_at <= time::now()) OR (status = $running AND locked_until < time::now())
+			RETURN AFTER`, map[string]interface{}{
+			"tb":      q.table(),
+			"id":      id,
+			"holder":  randomID(8),
+			"pending": JobPending,
+			"running": JobRunning,
+			"until":   time.Now().Add(q.timeout()).UTC(),
+		})
+		if err != nil {
+			return claimed, err
+		}
+		if ok {
+			job.ID = id
+			claimed = append(claimed, job)
+		}
+	}
+	return claimed, nil
+}
+
+// runningJob is the job a handler runs, carried by its context.
+type runningJob struct {
+	queue    *JobQueue
+	job      Job
+	reported atomic.Bool
+}
+
+type runningJobKey struct{}
+
+// CurrentJob returns the job whose handler ctx belongs to, with the
+// progress it last reported, e.g. to resume where a failed attempt
+// stopped.
+func CurrentJob(ctx context.Context) (Job, bool) {
+	run, ok := ctx.Value(runningJobKey{}).(*runningJob)
+	if !ok {
+		return Job{}, false
+	}
+	return run.job, true
+}
+
+// ReportJobProgress stores progress, encoded as JSON, on the job
+// whose handler ctx belongs to, for JobQueue.Job to read. Outside a
+// job handler it does nothing.
+//
+// Example:
+//  ghostutils.RegisterJob("export", func(ctx context.Context, job Export) error {
+//      for i, page := range pages {
+//          ...
+//          if err := ghostutils.ReportJobProgress(ctx, map[string]int{"done": i + 1, "of": len(pages)}); err != nil {
+//              return err
+//          }
+//      }
+//      return nil
+//  })
+func ReportJobProgress(ctx context.Context, progress interface{}) error {
+	run, ok := ctx.Value(runningJobKey{}).(*runningJob)
+	if !ok {
+		return nil
+	}
+	_, ok, err := surrealFirst[Job](run.queue.DB, `UPDATE type::thing($tb, $id)
+		SET progress = $progress, updated_at = time::now() WHERE status = $running AND holder = $holder RETURN AFTER`, map[string]interface{}{
+		"tb":       run.queue.table(),
+		"id":       run.job.ID,
+		"progress": progress,
+		"running":  JobRunning,
+		"holder":   run.job.Holder,
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrJobLost
+	}
+	run.job.Progress = progress
+	run.reported.Store(true)
+	return nil
+}
+
+// Job returns the job id, e.g. to show its progress.
+//
+// Returns:
+//  Job as stored
+//  bool false once a job without progress has succeeded, or a done
+//  one has expired
+//  error of the query
+func (q *JobQueue) Job(ctx context.Context, id string) (Job, bool, error) {
+	job, ok, err := surrealFirst[Job](q.DB, "SELECT * FROM type::thing($tb, $id)", map[string]interface{}{
+		"tb": q.table(),
+		"id": id,
+	})
+	_, job.ID = splitRecordID(job.ID, q.table())
+	return job, ok, err
+}
+
+// purgeDone deletes the done jobs past their retention.
+func (q *JobQueue) purgeDone() error {
+	_, err := surrealQuery[Job](q.DB, "DELETE type::table($tb) WHERE status = $done AND updated_at < <datetime>$before", map[string]interface{}{
+		"tb":     q.table(),
+		"done":   JobDone,
+		"before": time.Now().Add(-jobsDoneRetention).UTC(),
+	})
+	return err
+}
+
+// execute runs job and records its outcome.
+func (q *JobQueue) execute(job Job) {
+	run := &runningJob{queue: q, job: job}
+	err := q.runJob(run)
+	// the outcome is only recorded while the job is still ours, not
+	// once it ran past its timeout and another worker took it
+	vars := map[string]interface{}{"tb": q.table(), "id": job.ID, "holder": job.Holder}
+	if err == nil && run.reported.Load() {
+		vars["done"] = JobDone
+		_, ok, err := surrealFirst[Job](q.DB, "UPDATE type::thing($tb, $id) SET status = $done, holder = NONE, locked_until = NONE, updated_at = time::now() WHERE holder = $holder RETURN AFTER", vars)
+		switch {
+		case err != nil:
+			log.Printf("jobs: %s %s succeeded but could not be marked done: %v", job.Type, job.ID, err)
+		case !ok:
+			log.Printf("jobs: %s %s succeeded after another worker took it", job.Type, job.ID)
+		}
+		return
+	}
+	if err == nil {
+		_, ok, err := surrealFirst[Job](q.DB, "DELETE type::thing($tb, $id) WHERE holder = $holder RETURN BEFORE", vars)
+		switch {
+		case err != nil:
+			log.Printf("jobs: %s %s succeeded but could not be deleted: %v", job.Type, job.ID, err)
+		case !ok:
+			log.Printf("jobs: %s %s succeeded after another worker took it", job.Type, job.ID)
+		}
+		return
+	}
+	vars["error"] = err.Error()
+	if job.Attempts < job.MaxAttempts && !errors.Is(err, ErrJobPermanent) {
+		delay := q.retry().Delay(job.Attempts)
+		vars["status"], vars["run_at"] = JobPending, time.Now().Add(delay).UTC()
+		log.Printf("jobs: %s %s failed, attempt %d/%d, retrying in %s: %v", job.Type, job.ID, job.Attempts, job.MaxAttempts, delay.Round(time.Second), err)
+	} else {
+		vars["status"], vars["run_at"] = JobDead, job.RunAt.UTC()
+		log.Printf("jobs: %s %s is dead after %d attempt(s): %v", job.Type, job.ID, job.Attempts, err)
+	}
+	_, recorded, updateErr := surrealFirst[Job](q.DB, `UPDATE type::thing($tb, $id)
+		SET status = $status, error = $error, run_at = <datetime>$run_at, holder = NONE, locked_until = NONE, updated_at = time::now()
+		WHERE holder = $holder RETURN AFTER`, vars)
+	switch {
+	case updateErr != nil:
+		log.Printf("jobs: recording the failure of %s %s: %v", job.Type, job.ID, updateErr)
+	case !recorded:
+		log.Printf("jobs: %s %s failed after another worker took it", job.Type, job.ID)
+		return
+	}
+	if vars["status"] == JobDead && q.OnDead != nil {
+		job.Status, job.Error = JobDead, err.Error()
+		q.OnDead(job, err)
+	}
+}
+
+// runJob calls the handler of the job within the timeout, turning a
+// panic into an error.
+func (q *JobQueue) runJob(run *runningJob) (err error) {
+	job := run.job
+	handler, ok := jobHandler(job.Type)
+	if !ok {
+		return fmt.Errorf("no handler for job type %q", job.Type)
+	}
+	payload, err := json.Marshal(job.Payload)
+	if err != nil {
+		return err
+	}
+	base := context.Background()
+	if q.App != nil {
+		base = WithApp(base, q.App)
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(base, runningJobKey{}, run), q.timeout())
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, payload)
+}
+
+// Run works the queue with Concurrency workers until ctx is done, then
+// waits for the running jobs to finish.
+//
+// Returns:
+//  nil once ctx is done
+func (q *JobQueue) Run(ctx context.Context) error {
+	concurrency := q.Config.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultJobsConcurrency
+	}
+	interval := q.Config.PollInterval
+	if interval <= 0 {
+		interval = DefaultJobsPollInterval
+	}
+	if q.wake == nil {
+		q.wake = make(chan struct{}, 1)
+	}
+	slots := make(chan struct{}, concurrency)
+	done := make(chan struct{}, concurrency)
+	var running sync.WaitGroup
+	defer running.Wait()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var purged time.Time
+	for {
+		if time.Since(purged) > time.Hour {
+			if err := q.purgeDone(); err != nil {
+				log.Printf("jobs: purging done jobs: %v", err)
+			}
+			purged = time.Now()
+		}
+		if free := concurrency - len(slots); free > 0 {
+			jobs, err := q.claim(free)
+			if err != nil {
+				log.Printf("jobs: %v", err)
+			}
+			for _, job := range jobs {
+				slots <- struct{}{}
+				running.Add(1)
+				go func(job Job) {
+					defer running.Done()
+					defer func() {
+						<-slots
+						select {
+						case done <- struct{}{}:
+						default:
+						}
+					}()
+					q.execute(job)
+				}(job)
+			}
+			if err == nil && len(jobs) == free {
+				// there may be more due jobs
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-q.wake:
+		case <-done:
+		}
+	}
+}
+
+// Start runs the queue in the background until Run stops the server,
+// whose OnStop hooks wait for the running jobs, or App.Stop stops the
+// App of the queue. Setup starts the queue of the jobs block when
+// jobs.enabled is set. In ModeWeb the
+// queue only enqueues, and Start does nothing.
+func (q *JobQueue) Start() {
+	if q.web {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		_ = q.Run(ctx)
+	}()
+	stop := func(stopCtx context.Context) error {
+		cancel()
+		select {
+		case <-stopped:
+			return nil
+		case <-stopCtx.Done():
+			return errors.New("jobs: running jobs did not finish in time")
+		}
+	}
+	if q.App != nil {
+		q.App.onStop(stop)
+		return
+	}
+	OnStop(stop)
+}
+
+// Dead returns up to limit dead jobs, most recently failed first.
+func (q *JobQueue) Dead(ctx context.Context, limit int) ([]Job, error) {
+	jobs, err := surrealQuery[Job](q.DB, "SELECT * FROM type::table($tb) WHERE status = $dead ORDER BY updated_at DESC LIMIT $limit", map[string]interface{}{
+		"tb":    q.table(),
+		"dead":  JobDead,
+		"limit": limit,
+	})
+	for i := range jobs {
+		_, jobs[i].ID = splitRecordID(jobs[i].ID, q.table())
+	}
+	return jobs, err
+}
+
+// Requeue gives the dead job id a new round of attempts, e.g. once
+// the bug failing it is fixed.
+func (q *JobQueue) Requeue(ctx context.Context, id string) error {
+	_, ok, err := surrealFirst[Job](q.DB, `UPDATE type::thing($tb, $id)
+		SET status = $pending, attempts = 0, error = NONE, run_at = time::now(), updated_at = time::now()
+		WHERE status = $dead RETURN AFTER`, map[string]interface{}{
+		"tb":      q.table(),
+		"id":      id,
+		"pending": JobPending,
+		"dead":    JobDead,
+	})
+	if err == nil && !ok {
+		return fmt.Errorf("jobs: no dead job %q", id)
+	}
+	return err
+}
+
+// Worker connects to SurrealDB and works the queue of the jobs block
+// until SIGINT or SIGTERM, for a process running jobs apart from the
+// web server. Register the job types first. To run the web server and
+// the workers from the same setup, see ModeWorker instead.
+//
+// Example:
+//  func main() {
+//      ghostConfig, err := ghostutils.Load()
+//      if err != nil {
+//          log.Fatal(err)
+//      }
+//      ghostutils.RegisterJob("welcome-email", sendWelcome)
+//      if err := ghostConfig.Worker(); err != nil {
+//          log.Fatal(err)
+//      }
+//  }
+//
+// Returns:
+//  error if the connection failed
+func (ghostConfig GhostConfig) Worker() error {
+	db, err := ghostConfig.surrealSetup(context.Background())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	queue := ghostConfig.NewJobQueue(db)
+	log.Printf("jobs: working %s for %v", queue.table(), jobTypes())
+	return queue.Run(ctx)
+}
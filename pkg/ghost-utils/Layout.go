@@ -0,0 +1,185 @@
+package ghostutils
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LayoutKey is the gin context key holding the Layout of a request.
+const LayoutKey = "ghost-layout"
+
+// layoutValuesKey holds the values set with SetLayoutValue.
+const layoutValuesKey = "ghost-layout-values"
+
+// LayoutData is the data shared by every page, available to
+// templates as .Layout.
+type LayoutData map[string]interface{}
+
+// ViewModel is embedded in typed page data to receive the layout
+// data, the way gin.H pages get a "Layout" key.
+//
+// Example:
+//  type PostPage struct {
+//      ghostutils.ViewModel
+//      Post Post
+//  }
+//
+//  // post.html: {{with .Layout.User}}Signed in as {{.ID}}{{end}}
+type ViewModel struct {
+	Layout LayoutData
+}
+
+// LayoutProvider returns the value of one layout key for a request.
+type LayoutProvider func(c *gin.Context) (interface{}, error)
+
+type layoutProvider struct {
+	key     string
+	provide LayoutProvider
+}
+
+// Layout holds the providers of the data every render needs, such as
+// the current user, flash messages or feature flags, so handlers
+// only pass what is specific to their page.
+//
+// Example:
+//  layout := ghostutils.NewLayout().
+//      Provide("User", ghostutils.IdentityLayout).
+//      Provide("Flags", func(c *gin.Context) (interface{}, error) { return flags.For(c) })
+//  r.Use(layout.Middleware())
+//
+//  ghostutils.HTML(c, http.StatusOK, "post.html", gin.H{"Post": post})
+type Layout struct {
+	providers []layoutProvider
+}
+
+// NewLayout returns a Layout without providers.
+func NewLayout() *Layout {
+	return &Layout{}
+}
+
+// Provide registers provider for key. Providers run in order, each
+// only once per render; a provider error is logged and leaves its key
+// unset so the page still renders.
+func (l *Layout) Provide(key string, provider LayoutProvider) *Layout {
+	l.providers = append(l.providers, layoutProvider{key: key, provide: provider})
+	return l
+}
+
+// Middleware makes the layout available to HTML and TypedTemplate.
+func (l *Layout) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(LayoutKey, l)
+		c.Next()
+	}
+}
+
+// Data returns the layout data for the request, including the values
+// set with SetLayoutValue.
+func (l *Layout) Data(c *gin.Context) LayoutData {
+	data := LayoutData{}
+	if l != nil {
+		for _, provider := range l.providers {
+			value, err := provider.provide(c)
+			if err != nil {
+				log.Printf("layout %s: %v", provider.key, err)
+				continue
+			}
+			data[provider.key] = value
+		}
+	}
+	if values, ok := c.Get(layoutValuesKey); ok {
+		for key, value := range values.(LayoutData) {
+			data[key] = value
+		}
+	}
+	return data
+}
+
+// SetLayoutValue sets a layout key for the rest of the request, such
+// as the active navigation item, overriding any provider.
+//
+// Example:
+//  ghostutils.SetLayoutValue(c, "Nav", "posts")
+func SetLayoutValue(c *gin.Context, key string, value interface{}) {
+	values, ok := c.Get(layoutValuesKey)
+	if !ok {
+		values = LayoutData{}
+		c.Set(layoutValuesKey, values)
+	}
+	values.(LayoutData)[key] = value
+}
+
+// IdentityLayout provides the Identity of the caller, nil for
+// anonymous requests.
+func IdentityLayout(c *gin.Context) (interface{}, error) {
+	if identity, ok := CurrentIdentity(c); ok {
+		return identity, nil
+	}
+	return nil, nil
+}
+
+// HTML renders the template name like c.HTML with the layout data
+// added: as the "Layout" key of gin.H data, or in the Layout field of
+// data embedding ViewModel. Keys and fields the handler already set
+// are left alone.
+//
+// Example:
+//  ghostutils.HTML(c, http.StatusOK, "post.html", gin.H{"Post": post})
+func HTML(c *gin.Context, code int, name string, data interface{}) {
+	c.HTML(code, name, withLayout(c, data))
+}
+
+func withLayout(c *gin.Context, data interface{}) interface{} {
+	var layout *Layout
+	if value, ok := c.Get(LayoutKey); ok {
+		layout, _ = value.(*Layout)
+	}
+	switch page := data.(type) {
+	case nil:
+		return gin.H{"Layout": layout.Data(c)}
+	case gin.H:
+		return mergeLayout(page, layout, c)
+	case map[string]interface{}:
+		return mergeLayout(page, layout, c)
+	}
+	// copy structs so the handler's value is not modified
+	v := reflect.ValueOf(data)
+	pointer := v.Kind() == reflect.Ptr
+	if pointer {
+		if v.IsNil() {
+			return data
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return data
+	}
+	field, ok := v.Type().FieldByName("Layout")
+	if !ok || field.Type != reflect.TypeOf(LayoutData(nil)) {
+		return data
+	}
+	// FieldByIndexErr fails on a nil embedded *ViewModel
+	if current, err := v.FieldByIndexErr(field.Index); err != nil || !current.IsNil() {
+		return data
+	}
+	page := reflect.New(v.Type())
+	page.Elem().Set(v)
+	page.Elem().FieldByIndex(field.Index).Set(reflect.ValueOf(layout.Data(c)))
+	if pointer {
+		return page.Interface()
+	}
+	return page.Elem().Interface()
+}
+
+func mergeLayout(page map[string]interface{}, layout *Layout, c *gin.Context) gin.H {
+	merged := make(gin.H, len(page)+1)
+	for key, value := range page {
+		merged[key] = value
+	}
+	if _, ok := merged["Layout"]; !ok {
+		merged["Layout"] = layout.Data(c)
+	}
+	return merged
+}
@@ -0,0 +1,319 @@
+package ghostutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults of a LegacyAPI.
+const (
+	DefaultLegacyUsageTable = "legacy_usage"
+	DefaultLegacyFlush      = time.Minute
+	DefaultLegacyMaxClients = 10000
+	legacyOtherClients      = "other"
+)
+
+// LegacyRoute serves a legacy endpoint with the current route of
+// Target: the request is dispatched to Target through the engine, with
+// its middleware, and the JSON bodies go through Transforms in both
+// directions, see Transformer.
+type LegacyRoute struct {
+	Method string
+	// Path is the legacy pattern, e.g. /v0/posts/:id.
+	Path string
+	// Target is the current path, the params of Path filled in, e.g.
+	// /api/v2/posts/:id.
+	Target     string
+	Transforms []Transformer
+	// Sunset overrides the one of the LegacyAPI.
+	Sunset time.Time
+}
+
+// LegacyUsage is how often a client called a legacy route.
+type LegacyUsage struct {
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Client    string    `json:"client"`
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// LegacyAPI keeps a retired API answering on top of the current one,
+// and finds out who still calls it: every response carries the
+// Deprecation, Sunset and Link headers, and the calls are counted per
+// route and client, in memory and, with a DB, in Table every
+// FlushInterval.
+//
+// Example:
+//  legacy := &ghostutils.LegacyAPI{
+//      DB:     db,
+//      Sunset: time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC),
+//      Docs:   "https://example.com/docs/migrating-from-v0",
+//      Routes: []ghostutils.LegacyRoute{
+//          {Method: "GET", Path: "/v0/posts/:id", Target: "/api/v2/posts/:id", Transforms: []ghostutils.Transformer{rename}},
+//          {Method: "POST", Path: "/v0/post/new", Target: "/api/v2/posts", Transforms: []ghostutils.Transformer{rename}},
+//      },
+//  }
+//  if err := legacy.Register(r); err != nil {
+//      log.Fatal(err)
+//  }
+//  r.GET("/admin/legacy", ghostutils.RequireRole(ghostutils.AdminRole), legacy.UsageHandler())
+type LegacyAPI struct {
+	Routes []LegacyRoute
+	Sunset time.Time
+	// Docs is the migration guide, linked as rel="deprecation".
+	Docs string
+	// Client names the caller, by default its identity, else the
+	// X-Client-ID header, else its IP and user agent.
+	Client func(c *gin.Context) string
+	DB     GhostDB
+	// Table is DefaultLegacyUsageTable and FlushInterval
+	// DefaultLegacyFlush when unset.
+	Table         string
+	FlushInterval time.Duration
+	// MaxClients bounds the clients counted in memory, beyond which new
+	// ones are counted as "other", DefaultLegacyMaxClients when 0.
+	MaxClients int
+
+	mu      sync.Mutex
+	usage   map[string]*LegacyUsage
+	pending map[string]*LegacyUsage
+}
+
+// Register mounts the legacy routes on r and, with a DB, starts
+// flushing the usage until the app stops.
+//
+// Returns:
+//  error for a route without a method, path or target, a target that
+//  is its own path or uses a param the path does not have
+func (api *LegacyAPI) Register(r *gin.Engine) error {
+	for _, route := range api.Routes {
+		if route.Method == "" || route.Path == "" || route.Target == "" {
+			return fmt.Errorf("legacy route %s %s: method, path and target are required", route.Method, route.Path)
+		}
+		if route.Target == route.Path {
+			return fmt.Errorf("legacy route %s %s: target is the route itself", route.Method, route.Path)
+		}
+		params := routeParams(route.Path)
+		for param := range routeParams(route.Target) {
+			if !params[param] {
+				return fmt.Errorf("legacy route %s %s: target param %q is not in the path", route.Method, route.Path, param)
+			}
+		}
+	}
+	api.mu.Lock()
+	api.usage = map[string]*LegacyUsage{}
+	api.pending = map[string]*LegacyUsage{}
+	api.mu.Unlock()
+	for _, route := range api.Routes {
+		route := route
+		r.Handle(route.Method, route.Path, api.headers(route), func(c *gin.Context) {
+			runTransforms(c, route.Transforms)
+		}, api.dispatch(r, route))
+	}
+	if api.DB != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			api.flushEvery(ctx)
+		}()
+		OnStop(func(ctx context.Context) error {
+			cancel()
+			<-done
+			return api.Flush(ctx)
+		})
+	}
+	return nil
+}
+
+// routeParams returns the :name and *name params of a pattern.
+func routeParams(pattern string) map[string]bool {
+	params := map[string]bool{}
+	for _, segment := range strings.Split(pattern, "/") {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			params[segment[1:]] = true
+		}
+	}
+	return params
+}
+
+func fillRoute(pattern string, c *gin.Context) string {
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = strings.TrimPrefix(c.Param(segment[1:]), "/")
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// headers sets the deprecation headers and counts the call.
+func (api *LegacyAPI) headers(route LegacyRoute) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		sunset := route.Sunset
+		if sunset.IsZero() {
+			sunset = api.Sunset
+		}
+		if !sunset.IsZero() {
+			c.Header("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+		links := []string{fmt.Sprintf(`<%s>; rel="successor-version"`, fillRoute(route.Target, c))}
+		if api.Docs != "" {
+			links = append(links, fmt.Sprintf(`<%s>; rel="deprecation"`, api.Docs))
+		}
+		c.Header("Link", strings.Join(links, ", "))
+		api.record(route, api.client(c))
+		c.Next()
+	}
+}
+
+func (api *LegacyAPI) client(c *gin.Context) string {
+	if api.Client != nil {
+		return api.Client(c)
+	}
+	if identity, ok := CurrentIdentity(c); ok {
+		return "identity:" + identity.ID
+	}
+	if id := c.GetHeader("X-Client-ID"); id != "" {
+		return "client:" + id
+	}
+	return "ip:" + c.ClientIP() + " " + c.Request.UserAgent()
+}
+
+// dispatch serves the request with the route of Target.
+func (api *LegacyAPI) dispatch(r *gin.Engine, route LegacyRoute) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := c.Request.Clone(c.Request.Context())
+		req.URL.Path = fillRoute(route.Target, c)
+		req.URL.RawPath = ""
+		req.RequestURI = req.URL.RequestURI()
+		r.ServeHTTP(c.Writer, req)
+	}
+}
+
+func usageKey(method, path, client string) string {
+	sum := sha256.Sum256([]byte(method + " " + path + " " + client))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (api *LegacyAPI) record(route LegacyRoute, client string) {
+	now := time.Now().UTC()
+	max := api.MaxClients
+	if max <= 0 {
+		max = DefaultLegacyMaxClients
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	key := usageKey(route.Method, route.Path, client)
+	if _, ok := api.usage[key]; !ok && len(api.usage) >= max {
+		client = legacyOtherClients
+		key = usageKey(route.Method, route.Path, client)
+	}
+	for _, usage := range []map[string]*LegacyUsage{api.usage, api.pending} {
+		entry, ok := usage[key]
+		if !ok {
+			entry = &LegacyUsage{Method: route.Method, Path: route.Path, Client: client, FirstSeen: now}
+			usage[key] = entry
+		}
+		entry.Count++
+		entry.LastSeen = now
+	}
+}
+
+// Usage returns the calls counted since Register, the most recent
+// first.
+func (api *LegacyAPI) Usage() []LegacyUsage {
+	api.mu.Lock()
+	usage := make([]LegacyUsage, 0, len(api.usage))
+	for _, entry := range api.usage {
+		usage = append(usage, *entry)
+	}
+	api.mu.Unlock()
+	sort.Slice(usage, func(i, j int) bool { return usage[i].LastSeen.After(usage[j].LastSeen) })
+	return usage
+}
+
+// UsageHandler serves Usage as JSON, for an admin route.
+func (api *LegacyAPI) UsageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.Usage())
+	}
+}
+
+func (api *LegacyAPI) flushEvery(ctx context.Context) {
+	interval := api.FlushInterval
+	if interval <= 0 {
+		interval = DefaultLegacyFlush
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := api.Flush(ctx); err != nil {
+				log.Printf("legacy: %v", err)
+			}
+		}
+	}
+}
+
+// Flush adds the calls counted since the last flush to Table, one
+// record per route and client, so the usage of every instance adds
+// up. Counts that fail to be written are kept for the next flush.
+func (api *LegacyAPI) Flush(ctx context.Context) error {
+	if api.DB == nil {
+		return nil
+	}
+	table := api.Table
+	if table == "" {
+		table = DefaultLegacyUsageTable
+	}
+	api.mu.Lock()
+	pending := api.pending
+	api.pending = map[string]*LegacyUsage{}
+	api.mu.Unlock()
+	db := WithContext(ctx, api.DB)
+	for key, entry := range pending {
+		_, err := surrealQuery[interface{}](db, "UPDATE type::thing($tb, $id) SET method = $method, path = $path, client = $client, count = (count ?? 0) + $count, first_seen = first_seen ?? $first_seen, last_seen = $last_seen",
+			map[string]interface{}{
+				"tb": table, "id": key,
+				"method": entry.Method, "path": entry.Path, "client": entry.Client,
+				"count": entry.Count, "first_seen": entry.FirstSeen, "last_seen": entry.LastSeen,
+			})
+		if err != nil {
+			api.keep(pending)
+			return err
+		}
+		delete(pending, key)
+	}
+	return nil
+}
+
+// keep puts back the counts a flush did not write.
+func (api *LegacyAPI) keep(unwritten map[string]*LegacyUsage) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for key, entry := range unwritten {
+		if current, ok := api.pending[key]; ok {
+			current.Count += entry.Count
+			current.FirstSeen = entry.FirstSeen
+		} else {
+			api.pending[key] = entry
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShutdownConfig is the `shutdown:` block of ghost.yaml.
+//
+// Example:
+//  shutdown:
+//    timeout: 30s
+//    delay: 5s
+type ShutdownConfig struct {
+	// Timeout bounds draining the in-flight requests and running the
+	// OnStop hooks.
+	Timeout time.Duration `yaml:"timeout"`
+	// Delay keeps serving, with the readiness route failing, before
+	// the listener closes, so load balancers stop sending requests
+	// first.
+	Delay time.Duration `yaml:"delay"`
+}
+
+// DefaultShutdownTimeout is the shutdown.timeout applied by Validate.
+const DefaultShutdownTimeout = 15 * time.Second
+
+// LifecycleHook runs when the server starts or stops, with a context
+// bounded by shutdown.timeout when stopping.
+type LifecycleHook func(ctx context.Context) error
+
+var (
+	lifecycleMu sync.Mutex
+	startHooks  []*LifecycleHook
+	stopHooks   []*LifecycleHook
+	// draining is set once shutdown began, failing the readiness route.
+	draining int32
+)
+
+// OnStart registers hook to run by Run before the server listens. A
+// failing hook stops Run.
+//
+// Example:
+//  ghostutils.OnStart(func(ctx context.Context) error {
+//      return cache.Warm(ctx)
+//  })
+//
+// Returns:
+//  func removing the hook, for what stops before Run does
+func OnStart(hook LifecycleHook) func() {
+	return register(&startHooks, hook)
+}
+
+// OnStop registers hook to run by Run after the in-flight requests
+// are drained. Hooks run in the reverse order of registration, so
+// what started last stops first. Setup registers the closing of the
+// SurrealDB connection, see App.Stop.
+//
+// Example:
+//  ghostutils.OnStop(func(ctx context.Context) error {
+//      return queue.Flush(ctx)
+//  })
+//
+// Returns:
+//  func removing the hook, for what stops before Run does
+func OnStop(hook LifecycleHook) func() {
+	return register(&stopHooks, hook)
+}
+
+// register appends hook to hooks and returns the func removing it.
+func register(hooks *[]*LifecycleHook, hook LifecycleHook) func() {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	entry := &hook
+	*hooks = append(*hooks, entry)
+	return func() {
+		lifecycleMu.Lock()
+		defer lifecycleMu.Unlock()
+		for i, registered := range *hooks {
+			if registered == entry {
+				*hooks = append((*hooks)[:i:i], (*hooks)[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// registered returns a copy of hooks, to run without the lock.
+func registered(hooks *[]*LifecycleHook) []LifecycleHook {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	copied := make([]LifecycleHook, len(*hooks))
+	for i, hook := range *hooks {
+		copied[i] = *hook
+	}
+	return copied
+}
+
+// ShuttingDown reports whether Run is draining the server.
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// Run serves r on the configured port, over HTTPS with the tls block,
+// until SIGINT or SIGTERM, then shuts down gracefully: the readiness
+// route fails for shutdown.delay, the listeners close, in-flight
+// requests are drained and the OnStop hooks run, all within
+// shutdown.timeout. Use it instead of r.Run so deploys do not drop
+// connections. In ModeWorker it serves the health and metrics routes
+// only, until the signal stops the jobs.
+//
+// Example:
+//  db, err := ghostConfig.BasicSurrealSetup(r)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  // ... mount routes
+//  if err := ghostConfig.Run(r); err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  error of the listener, the OnStart hooks or the shutdown, nil after
+//  a clean shutdown
+func (ghostConfig GhostConfig) Run(r *gin.Engine) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return ghostConfig.serve(ctx, r)
+}
+
+// serve runs the server until ctx is done.
+func (ghostConfig GhostConfig) serve(ctx context.Context, r *gin.Engine) error {
+	for _, hook := range registered(&startHooks) {
+		if err := hook(ctx); err != nil {
+			return fmt.Errorf("start hook: %w", err)
+		}
+	}
+	if ghostConfig.Mock.Enabled {
+		if err := ghostConfig.MockMode(r); err != nil {
+			return fmt.Errorf("mock: %w", err)
+		}
+	}
+	port := ghostConfig.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	var handler http.Handler = r
+	if !ghostConfig.RunsWeb() {
+		handler = ghostConfig.workerHandler(r)
+		log.Printf("running in %s mode, serving the health and metrics routes only", ghostConfig.Mode)
+	}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: handler}
+	servers := []*http.Server{server}
+	listen := server.ListenAndServe
+	if ghostConfig.TLS.Enabled() {
+		var plain *http.Server
+		listen, plain = ghostConfig.TLS.configure(server)
+		if plain != nil {
+			servers = append(servers, plain)
+		}
+	}
+	served := make(chan error, len(servers))
+	go func() {
+		served <- listen()
+	}()
+	for _, plain := range servers[1:] {
+		go func(plain *http.Server) {
+			served <- plain.ListenAndServe()
+		}(plain)
+	}
+	pending := len(servers)
+	select {
+	case err := <-served:
+		// a listener failed before any signal, e.g. the port is taken
+		for _, s := range servers {
+			s.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+	atomic.StoreInt32(&draining, 1)
+	defer atomic.StoreInt32(&draining, 0)
+	config := ghostConfig.Shutdown
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultShutdownTimeout
+	}
+	log.Printf("shutting down, draining requests for up to %s", config.Timeout)
+	time.Sleep(config.Delay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+	var problems []string
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			problems = append(problems, "drain: "+err.Error())
+		}
+	}
+	for ; pending > 0; pending-- {
+		if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			problems = append(problems, err.Error())
+		}
+	}
+	stopping := registered(&stopHooks)
+	for i := len(stopping) - 1; i >= 0; i-- {
+		if err := stopping[i](shutdownCtx); err != nil {
+			problems = append(problems, "stop hook: "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("shutdown: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package ghostutils
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Filter operators accepted in filter[field][op]=value.
+const (
+	FilterEq       = "eq"
+	FilterNe       = "ne"
+	FilterGt       = "gt"
+	FilterGte      = "gte"
+	FilterLt       = "lt"
+	FilterLte      = "lte"
+	FilterIn       = "in"
+	FilterContains = "contains"
+	// FilterTagged matches records tagged with every slug of the comma
+	// separated value, see Tags.FilterField.
+	FilterTagged = "tagged"
+)
+
+var filterOperators = map[string]string{
+	FilterEq:       "=",
+	FilterNe:       "!=",
+	FilterGt:       ">",
+	FilterGte:      ">=",
+	FilterLt:       "<",
+	FilterLte:      "<=",
+	FilterIn:       "INSIDE",
+	FilterContains: "CONTAINS",
+	FilterTagged:   "CONTAINSALL",
+}
+
+// Value types for FilterField.
+const (
+	FilterString   = "string"
+	FilterNumber   = "number"
+	FilterBool     = "bool"
+	FilterDatetime = "datetime"
+)
+
+var (
+	filterParamPattern = regexp.MustCompile(`^filter\[([^\]]+)\](?:\[([a-z]+)\])?$`)
+	identifierPattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+)
+
+// FilterField allows a field to be filtered with Ops, FilterEq when
+// empty. Type controls how values are converted, FilterString when
+// empty; FilterDatetime values must be RFC 3339. Path, a trusted
+// expression such as a graph path, is compared instead of the field;
+// FilterTagged compares DefaultTagPath without it.
+type FilterField struct {
+	Ops  []string
+	Type string
+	Path string
+}
+
+// FilterRules is the allowlist of a list endpoint.
+//
+// Example:
+//  rules := ghostutils.FilterRules{
+//      Fields: map[string]ghostutils.FilterField{
+//          "status":     {Ops: []string{ghostutils.FilterEq, ghostutils.FilterIn}},
+//          "created_at": {Ops: []string{ghostutils.FilterGte, ghostutils.FilterLt}, Type: ghostutils.FilterDatetime},
+//      },
+//      Sort:        []string{"created_at", "name"},
+//      DefaultSort: "-created_at",
+//  }
+type FilterRules struct {
+	Fields      map[string]FilterField
+	Sort        []string
+	DefaultSort string
+}
+
+// FilterCondition is one parsed filter.
+type FilterCondition struct {
+	Field string
+	Op    string
+	Value interface{}
+	Type  string
+}
+
+// SortField is one parsed sort key.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// ListFilter is a parsed ?filter[...]=...&sort=... query.
+type ListFilter struct {
+	Conditions []FilterCondition
+	Sort       []SortField
+}
+
+// FilterError reports an invalid or disallowed query parameter.
+type FilterError struct {
+	Param  string
+	Reason string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Param, e.Reason)
+}
+
+// ParseListFilter parses filter and sort parameters from query,
+// rejecting anything not allowed by rules.
+//
+// Example:
+//  filter, err := ghostutils.ParseListFilter(c.Request.URL.Query(), rules)
+//  if err != nil {
+//      ghostutils.FailStatus(c, http.StatusBadRequest, err)
+//      return
+//  }
+//  sql, vars := filter.Statement("post")
+//
+// Returns:
+//  ListFilter, or a *FilterError
+func ParseListFilter(query url.Values, rules FilterRules) (ListFilter, error) {
+	var filter ListFilter
+	params := make([]string, 0, len(query))
+	for param := range query {
+		params = append(params, param)
+	}
+	// sorted so the generated statement is stable
+	sort.Strings(params)
+	for _, param := range params {
+		match := filterParamPattern.FindStringSubmatch(param)
+		if match == nil {
+			continue
+		}
+		field, op := match[1], match[2]
+		if op == "" {
+			op = FilterEq
+		}
+		allowed, ok := rules.Fields[field]
+		if !ok || !identifierPattern.MatchString(field) {
+			return filter, &FilterError{Param: param, Reason: "field cannot be filtered"}
+		}
+		ops := allowed.Ops
+		if len(ops) == 0 {
+			ops = []string{FilterEq}
+		}
+		if _, known := filterOperators[op]; !known || !containsString(ops, op) {
+			return filter, &FilterError{Param: param, Reason: fmt.Sprintf("operator %q is not allowed", op)}
+		}
+		compared := field
+		if allowed.Path != "" {
+			compared = allowed.Path
+		} else if op == FilterTagged {
+			compared = DefaultTagPath
+		}
+		for _, raw := range query[param] {
+			value, err := filterValueOf(raw, op, allowed.Type)
+			if err != nil {
+				return filter, &FilterError{Param: param, Reason: err.Error()}
+			}
+			filter.Conditions = append(filter.Conditions, FilterCondition{Field: compared, Op: op, Value: value, Type: allowed.Type})
+		}
+	}
+	sortParam, requested := query.Get("sort"), true
+	if sortParam == "" {
+		// the default sort is trusted and need not be in rules.Sort
+		sortParam, requested = rules.DefaultSort, false
+	}
+	for _, key := range splitList(sortParam) {
+		field := SortField{Field: strings.TrimPrefix(key, "-"), Desc: strings.HasPrefix(key, "-")}
+		if !identifierPattern.MatchString(field.Field) || (requested && !containsString(rules.Sort, field.Field)) {
+			return filter, &FilterError{Param: "sort", Reason: fmt.Sprintf("cannot sort by %q", field.Field)}
+		}
+		filter.Sort = append(filter.Sort, field)
+	}
+	return filter, nil
+}
+
+// ListFilterFrom parses the request's query with rules.
+func ListFilterFrom(c *gin.Context, rules FilterRules) (ListFilter, error) {
+	return ParseListFilter(c.Request.URL.Query(), rules)
+}
+
+func filterValueOf(raw, op, typ string) (interface{}, error) {
+	if op == FilterTagged {
+		parts := splitList(raw)
+		values := make([]interface{}, 0, len(parts))
+		for _, part := range parts {
+			if slug := Sluggify(part); slug != "" {
+				values = append(values, slug)
+			}
+		}
+		return values, nil
+	}
+	if op == FilterIn {
+		parts := splitList(raw)
+		values := make([]interface{}, 0, len(parts))
+		for _, part := range parts {
+			value, err := convertFilterValue(part, typ)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	return convertFilterValue(raw, typ)
+}
+
+func convertFilterValue(raw, typ string) (interface{}, error) {
+	switch typ {
+	case FilterNumber:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", raw)
+		}
+		return n, nil
+	case FilterBool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", raw)
+		}
+		return b, nil
+	case FilterDatetime:
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an RFC 3339 datetime", raw)
+		}
+		return t.UTC().Format(time.RFC3339Nano), nil
+	}
+	return raw, nil
+}
+
+// Where compiles the conditions to a parameterized SurrealQL
+// condition, without the WHERE keyword. Values are bound as
+// $filter_0, $filter_1... so they are never part of the query text.
+func (f ListFilter) Where() (string, map[string]interface{}) {
+	return f.where("filter")
+}
+
+// where is Where with the variables named prefix_0, prefix_1...
+func (f ListFilter) where(prefix string) (string, map[string]interface{}) {
+	vars := map[string]interface{}{}
+	clauses := make([]string, 0, len(f.Conditions))
+	for i, cond := range f.Conditions {
+		name := fmt.Sprintf("%s_%d", prefix, i)
+		param := "$" + name
+		list, isList := cond.Value.([]interface{})
+		switch {
+		case cond.Type == FilterDatetime && isList:
+			// each element is bound and cast on its own
+			casts := make([]string, len(list))
+			for j, value := range list {
+				elem := fmt.Sprintf("%s_%d", name, j)
+				vars[elem] = value
+				casts[j] = "<datetime>$" + elem
+			}
+			param = "[" + strings.Join(casts, ", ") + "]"
+		case cond.Type == FilterDatetime:
+			vars[name] = cond.Value
+			param = "<datetime>" + param
+		default:
+			vars[name] = cond.Value
+		}
+		clauses = append(clauses, fmt.Sprintf("%s %s %s", cond.Field, filterOperators[cond.Op], param))
+	}
+	return strings.Join(clauses, " AND "), vars
+}
+
+// OrderBy compiles the sort keys, without the ORDER BY keyword.
+func (f ListFilter) OrderBy() string {
+	keys := make([]string, 0, len(f.Sort))
+	for _, s := range f.Sort {
+		if s.Desc {
+			keys = append(keys, s.Field+" DESC")
+		} else {
+			keys = append(keys, s.Field+" ASC")
+		}
+	}
+	return strings.Join(keys, ", ")
+}
+
+// Statement builds a SELECT over table with the filter applied.
+// table must be a trusted identifier.
+func (f ListFilter) Statement(table string) (string, map[string]interface{}) {
+	sql := "SELECT * FROM " + table
+	where, vars := f.Where()
+	if where != "" {
+		sql += " WHERE " + where
+	}
+	if order := f.OrderBy(); order != "" {
+		sql += " ORDER BY " + order
+	}
+	return sql, vars
+}
@@ -0,0 +1,407 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// ErrLiveClientTooSlow closes a live stream whose client stopped
+// reading.
+var ErrLiveClientTooSlow = errors.New("live client is not reading its events")
+
+// LiveSource feeds table changes into a LiveHub. Watch calls emit for
+// every change of table until ctx is done.
+type LiveSource interface {
+	Watch(ctx context.Context, table string, emit func(SyncChange)) error
+}
+
+// ChangefeedLiveSource watches tables through their changefeed, see
+// EnableChangefeed. surrealdb.go does not deliver LIVE SELECT
+// notifications yet, so changes are polled every Interval, a second
+// by default, starting from the end of the feed.
+type ChangefeedLiveSource struct {
+	DB       *surrealdb.DB
+	Interval time.Duration
+}
+
+// Watch implements LiveSource.
+func (s ChangefeedLiveSource) Watch(ctx context.Context, table string, emit func(SyncChange)) error {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	cursor := ""
+	for {
+		_, last, err := showChanges(s.DB, table, cursor, 1000)
+		if err != nil {
+			return err
+		}
+		if last == cursor {
+			break
+		}
+		cursor = last
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		for {
+			changes, last, err := showChanges(s.DB, table, cursor, 100)
+			if err != nil {
+				log.Printf("live %s: %v", table, err)
+				break
+			}
+			for _, change := range changes {
+				if change.Op != SyncSchema {
+					emit(change)
+				}
+			}
+			if last == cursor {
+				break
+			}
+			cursor = last
+		}
+	}
+}
+
+// LiveHub fans table changes out to connected clients over server
+// sent events or WebSockets. A table is watched through Source while
+// at least one client is subscribed to it; changes made by the app
+// itself can be sent straight away with Publish.
+//
+// Example:
+//  hub := ghostutils.NewLiveHub(ghostutils.ChangefeedLiveSource{DB: db})
+//  hub.Authorizer = ghostutils.OwnerAuthorizer{}
+//  hub.Mount(r.Group("/api"), "note", "comment")
+//
+//  // browser: new EventSource("/api/live/note").addEventListener("change", e => render(JSON.parse(e.data)))
+type LiveHub struct {
+	Source LiveSource
+	// Retry paces restarting Source after Watch fails. Defaults to
+	// delays doubling from a second up to a minute.
+	Retry RetryConfig
+	// Authorizer, if set, filters changes by what each client may
+	// read. Deletes are checked against the last record published
+	// for the id while the table is watched, or the delete's own
+	// data; a delete of a record the hub has not seen is only sent
+	// when there is no Authorizer.
+	Authorizer RecordAuthorizer
+	// Buffer is the number of events queued per client before it is
+	// disconnected. Defaults to 64.
+	Buffer int
+	// KeepAlive is the interval of keep-alive messages. Defaults to
+	// 25 seconds.
+	KeepAlive time.Duration
+	// Upgrader upgrades WebSocket requests. The zero value only
+	// accepts same-origin requests.
+	Upgrader websocket.Upgrader
+
+	mu     sync.Mutex
+	tables map[string]*liveTable
+}
+
+type liveTable struct {
+	cancel  context.CancelFunc
+	clients map[*LiveSubscription]struct{}
+	// known is the last published record of each id, to authorize
+	// its delete
+	known map[string]map[string]interface{}
+}
+
+// LiveSubscription is one client's stream of changes.
+type LiveSubscription struct {
+	hub    *LiveHub
+	table  string
+	ctx    context.Context
+	ids    map[string]bool
+	events chan SyncChange
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+// NewLiveHub returns a hub watching tables through source, which may
+// be nil if all changes are published by the app.
+func NewLiveHub(source LiveSource) *LiveHub {
+	return &LiveHub{Source: source, tables: map[string]*liveTable{}}
+}
+
+// Subscribe streams the changes of table visible to the caller in ctx,
+// limited to the record ids given, if any, until ctx is done or Close
+// is called.
+func (h *LiveHub) Subscribe(ctx context.Context, table string, ids ...string) *LiveSubscription {
+	buffer := h.Buffer
+	if buffer <= 0 {
+		buffer = 64
+	}
+	sub := &LiveSubscription{hub: h, table: table, ctx: ctx, events: make(chan SyncChange, buffer), done: make(chan struct{})}
+	if len(ids) > 0 {
+		sub.ids = map[string]bool{}
+		for _, id := range ids {
+			_, id = splitRecordID(id, table)
+			sub.ids[id] = true
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tables == nil {
+		h.tables = map[string]*liveTable{}
+	}
+	watched, ok := h.tables[table]
+	if !ok {
+		watched = &liveTable{clients: map[*LiveSubscription]struct{}{}, known: map[string]map[string]interface{}{}}
+		h.tables[table] = watched
+		if h.Source != nil {
+			var watchCtx context.Context
+			watchCtx, watched.cancel = context.WithCancel(context.Background())
+			go h.watch(watchCtx, table)
+		}
+	}
+	watched.clients[sub] = struct{}{}
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.close(nil)
+		case <-sub.done:
+		}
+	}()
+	return sub
+}
+
+// watch runs Source for table until ctx is done, restarting it after
+// it fails.
+func (h *LiveHub) watch(ctx context.Context, table string) {
+	retry := h.Retry
+	if retry.InitialDelay <= 0 {
+		retry.InitialDelay, retry.MaxDelay, retry.Jitter = time.Second, time.Minute, DefaultRetryJitter
+	}
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		err := h.Source.Watch(ctx, table, h.Publish)
+		if ctx.Err() != nil {
+			return
+		}
+		if retry.MaxDelay > 0 && time.Since(started) > retry.MaxDelay {
+			// it ran fine for a while, start the backoff over
+			attempt = 1
+		}
+		log.Printf("live %s: watch stopped, restarting: %v", table, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry.Delay(attempt)):
+		}
+	}
+}
+
+// Publish sends change to the subscribers of its table.
+func (h *LiveHub) Publish(change SyncChange) {
+	h.mu.Lock()
+	var (
+		clients []*LiveSubscription
+		record  = change.Data
+	)
+	if watched, ok := h.tables[change.Table]; ok {
+		for sub := range watched.clients {
+			clients = append(clients, sub)
+		}
+		if h.Authorizer != nil {
+			if change.Op == SyncDelete {
+				if record == nil {
+					record = watched.known[change.ID]
+				}
+				delete(watched.known, change.ID)
+			} else if change.Data != nil {
+				watched.known[change.ID] = change.Data
+			}
+		}
+	}
+	h.mu.Unlock()
+	for _, sub := range clients {
+		if sub.ids != nil && !sub.ids[change.ID] {
+			continue
+		}
+		if h.Authorizer != nil {
+			// a delete nobody can be authorized for is not sent
+			if record == nil {
+				continue
+			}
+			if err := h.Authorizer.AuthorizeRead(sub.ctx, record); err != nil {
+				continue
+			}
+		}
+		sub.send(change)
+	}
+}
+
+func (s *LiveSubscription) send(change SyncChange) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	select {
+	case s.events <- change:
+		s.mu.Unlock()
+	default:
+		s.mu.Unlock()
+		s.close(ErrLiveClientTooSlow)
+	}
+}
+
+// Events returns the channel of changes, closed when the subscription
+// ends.
+func (s *LiveSubscription) Events() <-chan SyncChange {
+	return s.events
+}
+
+// Err returns why the subscription ended, nil if it was closed or its
+// context is done.
+func (s *LiveSubscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *LiveSubscription) Close() {
+	s.close(nil)
+}
+
+func (s *LiveSubscription) close(err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed, s.err = true, err
+	close(s.events)
+	close(s.done)
+	s.mu.Unlock()
+
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if watched, ok := s.hub.tables[s.table]; ok {
+		delete(watched.clients, s)
+		if len(watched.clients) == 0 {
+			if watched.cancel != nil {
+				watched.cancel()
+			}
+			delete(s.hub.tables, s.table)
+		}
+	}
+}
+
+func (h *LiveHub) keepAlive() time.Duration {
+	if h.KeepAlive <= 0 {
+		return 25 * time.Second
+	}
+	return h.KeepAlive
+}
+
+// SSE streams the changes of table as server sent "change" events.
+// Clients may pass ?ids=a,b to follow single records.
+//
+// Example:
+//  r.GET("/notes/live", hub.SSE("note"))
+func (h *LiveHub) SSE(table string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sub := h.Subscribe(c.Request.Context(), table, splitList(c.Query("ids"))...)
+		defer sub.Close()
+		ticker := time.NewTicker(h.keepAlive())
+		defer ticker.Stop()
+		c.Header("Cache-Control", "no-store")
+		c.Header("X-Accel-Buffering", "no")
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case change, ok := <-sub.Events():
+				if !ok {
+					return false
+				}
+				c.SSEvent("change", change)
+				return true
+			case <-ticker.C:
+				_, err := io.WriteString(w, ": keep-alive\n\n")
+				return err == nil
+			}
+		})
+	}
+}
+
+// WebSocket streams the changes of table as JSON messages over a
+// WebSocket. Clients may pass ?ids=a,b to follow single records;
+// messages sent by the client are ignored.
+//
+// Example:
+//  r.GET("/notes/live/ws", hub.WebSocket("note"))
+func (h *LiveHub) WebSocket(table string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		conn, err := h.Upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// the upgrader has written the error response
+			c.Abort()
+			return
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		sub := h.Subscribe(ctx, table, splitList(c.Query("ids"))...)
+		defer sub.Close()
+		go func() {
+			// reading handles pings and notices the client leaving
+			defer cancel()
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		ticker := time.NewTicker(h.keepAlive())
+		defer ticker.Stop()
+		for {
+			select {
+			case change, ok := <-sub.Events():
+				if !ok {
+					if sub.Err() != nil {
+						_ = conn.WriteControl(websocket.CloseMessage,
+							websocket.FormatCloseMessage(websocket.CloseTryAgainLater, sub.Err().Error()),
+							time.Now().Add(time.Second))
+					}
+					return
+				}
+				_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if err := conn.WriteJSON(change); err != nil {
+					return
+				}
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Mount registers GET /live/<table> as a server sent event stream and
+// GET /live/<table>/ws as a WebSocket for each of tables. Put any
+// authentication middleware on g.
+func (h *LiveHub) Mount(g *gin.RouterGroup, tables ...string) {
+	for _, table := range tables {
+		g.GET("/live/"+table, h.SSE(table))
+		g.GET("/live/"+table+"/ws", h.WebSocket(table))
+	}
+}
@@ -0,0 +1,308 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// loaderKeyPrefix prefixes the gin context keys of the request
+// loaders, one per table.
+const loaderKeyPrefix = "ghost-loader:"
+
+// GetMany returns the records with ids in one query, by id without
+// the table prefix. Missing records, and records the caller may not
+// see, are left out.
+//
+// Example:
+//  authors, err := users.GetMany(c, []string{"u1", "u2"})
+//  name := authors["u1"].Name
+func (r *Repository[T]) GetMany(ctx context.Context, ids []string) (_ map[string]T, err error) {
+	span := startDBSpan(ctx, "get_many", r.Table)
+	defer func() { endSpan(span, err) }()
+	return cachedRead(ctx, r, "many", ids, func() (map[string]T, error) {
+		return r.getMany(ctx, ids)
+	})
+}
+
+func (r *Repository[T]) getMany(ctx context.Context, ids []string) (map[string]T, error) {
+	found := make(map[string]T, len(ids))
+	if len(ids) == 0 {
+		return found, nil
+	}
+	if r.eagerErr != nil {
+		return nil, r.eagerErr
+	}
+	// select the records by id, rather than scanning the table
+	vars := map[string]interface{}{"tb": r.Table}
+	things := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		key := strings.TrimPrefix(id, r.Table+":")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		name := fmt.Sprintf("id%d", len(things))
+		vars[name] = key
+		things = append(things, "type::thing($tb, $"+name+")")
+	}
+	projection, fetch := r.eagerSQL()
+	rows, err := surrealQuery[map[string]interface{}](r.db(ctx), "SELECT "+projection+" FROM "+strings.Join(things, ", ")+fetch, vars)
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range rows {
+		if r.Authorizer != nil {
+			if err := r.Authorizer.AuthorizeRead(ctx, fields); err != nil {
+				if errors.Is(err, ErrForbidden) {
+					continue
+				}
+				return nil, err
+			}
+		}
+		id, _ := fields["id"].(string)
+		if len(r.fetch) > 0 {
+			records, err := r.fetched(ctx, []map[string]interface{}{fields})
+			if err != nil {
+				return nil, err
+			}
+			found[loaderKey(r.Table, id)] = records[0]
+			continue
+		}
+		var row T
+		if err := surrealdb.Unmarshal(fields, &row); err != nil {
+			return nil, err
+		}
+		found[loaderKey(r.Table, id)] = row
+	}
+	return found, nil
+}
+
+// loaderKey returns id without the table prefix and the brackets of
+// escaped ids.
+func loaderKey(table, id string) string {
+	id = strings.TrimPrefix(id, table+":")
+	if strings.HasPrefix(id, "⟨") && strings.HasSuffix(id, "⟩") {
+		id = strings.TrimSuffix(strings.TrimPrefix(id, "⟨"), "⟩")
+	}
+	return id
+}
+
+// Loader batches and caches the lookups by id of one request, so a
+// page showing 50 posts with 3 authors loads each author once. Ids
+// passed to Queue are fetched together, in one query, by the next
+// Load; Loads of ids already fetched return the cached record. Writes
+// through the Repository clear the record from the loader of the
+// request.
+//
+// Example:
+//  authors := ghostutils.RequestLoader(c, users)
+//  for _, post := range posts {
+//      authors.Queue(post.Author)
+//  }
+//  ghostutils.HTML(c, http.StatusOK, "posts/index.html", gin.H{
+//      "Posts":  posts,
+//      "Author": authors.Func(),
+//  })
+//
+//  {{range .Posts}}{{(call $.Author .Author).Name}}{{end}}
+type Loader[T any] struct {
+	Repo *Repository[T]
+
+	ctx     context.Context
+	mu      sync.Mutex
+	entries map[string]*loaderEntry[T]
+	queued  []string
+}
+
+// loaderEntry is the lookup of one id, done once it is closed.
+type loaderEntry[T any] struct {
+	done    chan struct{}
+	started bool
+	row     T
+	err     error
+}
+
+func (e *loaderEntry[T]) isDone() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewLoader returns a loader of repo reading with the caller of ctx.
+// Handlers use RequestLoader, which shares one loader per request.
+func NewLoader[T any](ctx context.Context, repo *Repository[T]) *Loader[T] {
+	return &Loader[T]{Repo: repo, ctx: ctx, entries: map[string]*loaderEntry[T]{}}
+}
+
+// RequestLoader returns the loader of repo for the request, created on
+// first use.
+func RequestLoader[T any](c *gin.Context, repo *Repository[T]) *Loader[T] {
+	key := loaderKeyPrefix + repo.Table
+	if value, ok := c.Get(key); ok {
+		if loader, ok := value.(*Loader[T]); ok {
+			return loader
+		}
+	}
+	loader := NewLoader(context.Context(c), repo)
+	c.Set(key, loader)
+	return loader
+}
+
+// entry returns the entry of key, queueing new ones. Callers hold mu.
+func (l *Loader[T]) entry(key string) *loaderEntry[T] {
+	e, ok := l.entries[key]
+	if !ok {
+		e = &loaderEntry[T]{done: make(chan struct{})}
+		l.entries[key] = e
+		l.queued = append(l.queued, key)
+	}
+	return e
+}
+
+// Queue adds ids to the next batch, without waiting for them.
+func (l *Loader[T]) Queue(ids ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		if id != "" {
+			l.entry(loaderKey(l.Repo.Table, id))
+		}
+	}
+}
+
+// Load returns the record with id, fetching it with the queued ids
+// unless it was fetched before.
+//
+// Returns:
+//  T
+//  error, surrealdb.ErrNoRow if it does not exist or the caller may
+//  not see it
+func (l *Loader[T]) Load(id string) (T, error) {
+	key := loaderKey(l.Repo.Table, id)
+	l.mu.Lock()
+	e := l.entry(key)
+	var batch map[string]*loaderEntry[T]
+	if !e.started {
+		// e is queued: fetch it along with everything queued before it
+		batch = make(map[string]*loaderEntry[T], len(l.queued))
+		for _, queued := range l.queued {
+			batch[queued] = l.entries[queued]
+			batch[queued].started = true
+		}
+		l.queued = nil
+	}
+	l.mu.Unlock()
+	if batch != nil {
+		l.fetch(batch)
+	}
+	<-e.done
+	return e.row, e.err
+}
+
+// LoadMany returns the records with ids in their order, fetched in one
+// batch.
+func (l *Loader[T]) LoadMany(ids []string) ([]T, error) {
+	l.Queue(ids...)
+	rows := make([]T, len(ids))
+	for i, id := range ids {
+		row, err := l.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// fetch looks up the entries of batch by key and marks them done.
+func (l *Loader[T]) fetch(batch map[string]*loaderEntry[T]) {
+	keys := make([]string, 0, len(batch))
+	for key := range batch {
+		keys = append(keys, key)
+	}
+	rows, err := l.Repo.GetMany(l.ctx, keys)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, e := range batch {
+		switch row, ok := rows[key]; {
+		case err != nil:
+			e.err = err
+		case ok:
+			e.row = row
+		default:
+			e.err = surrealdb.ErrNoRow
+		}
+		close(e.done)
+	}
+}
+
+// Prime caches record as the one with id, e.g. for records listed
+// already.
+func (l *Loader[T]) Prime(id string, record T) {
+	key := loaderKey(l.Repo.Table, id)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		if !e.started {
+			l.unqueue(key)
+		} else if !e.isDone() {
+			// being fetched, whoever waits gets the stored record
+			return
+		}
+	}
+	e := &loaderEntry[T]{done: make(chan struct{}), started: true, row: record}
+	close(e.done)
+	l.entries[key] = e
+}
+
+// Clear drops the record with id from the cache, so the next Load
+// fetches it again.
+func (l *Loader[T]) Clear(id string) {
+	key := loaderKey(l.Repo.Table, id)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok && !e.started {
+		// still queued, it will be fetched fresh
+		return
+	}
+	delete(l.entries, key)
+}
+
+func (l *Loader[T]) unqueue(key string) {
+	for i, queued := range l.queued {
+		if queued == key {
+			l.queued = append(l.queued[:i], l.queued[i+1:]...)
+			return
+		}
+	}
+}
+
+// Func returns Load as a function for templates, which call it with
+// {{call .Author .AuthorID}}.
+func (l *Loader[T]) Func() func(id string) (T, error) {
+	return l.Load
+}
+
+// forgetLoaded clears id from the loader of table for the request of
+// ctx, after a write.
+func forgetLoaded(ctx context.Context, table, id string) {
+	c, ok := ctx.(*gin.Context)
+	if !ok {
+		return
+	}
+	if value, ok := c.Get(loaderKeyPrefix + table); ok {
+		if loader, ok := value.(interface{ Clear(id string) }); ok {
+			loader.Clear(id)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LogLevel orders log messages by severity.
+type LogLevel int32
+
+// Log levels.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	if level < LevelDebug || level > LevelError {
+		return fmt.Sprintf("level(%d)", int32(level))
+	}
+	return logLevelNames[level]
+}
+
+// ParseLogLevel parses debug, info, warn or error. An empty string is
+// info.
+func ParseLogLevel(s string) (LogLevel, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) || (name == "warn" && strings.EqualFold(s, "warning")) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// LogSampling limits repeated debug and info messages. Within every
+// Tick, the first Initial messages with the same format are written,
+// then one in every Thereafter. Warnings and errors are never sampled.
+// A zero Initial disables sampling.
+type LogSampling struct {
+	Initial    int           `yaml:"initial"`
+	Thereafter int           `yaml:"thereafter"`
+	Tick       time.Duration `yaml:"tick"`
+}
+
+// LoggingConfig is the logging block of ghost.yaml. With a format
+// the messages are structured, text or json, as are the requests
+// logged when requests is set; output is stderr, stdout or a file
+// appended to. Setup installs RequestLogger before its other
+// middleware then, so build the router with gin.New, without gin's
+// logger.
+//
+//  logging:
+//      level: info
+//      format: json
+//      output: /var/log/blog.log
+//      requests: true
+//      sampling:
+//          initial: 100
+//          thereafter: 100
+//          tick: 1s
+type LoggingConfig struct {
+	Level    string      `yaml:"level"`
+	Format   string      `yaml:"format"`
+	Output   string      `yaml:"output"`
+	Requests bool        `yaml:"requests"`
+	Sampling LogSampling `yaml:"sampling"`
+}
+
+// output opens the output of the config.
+func (config LoggingConfig) output() (io.Writer, error) {
+	switch config.Output {
+	case "", "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	}
+	return os.OpenFile(config.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+}
+
+// handler returns the slog handler of the format writing to w.
+func (config LoggingConfig) handler(w io.Writer, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if config.Format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// Logger is a leveled logger whose level and sampling can change at
+// runtime, from LevelHandler, signals or a config reload.
+//
+// Example:
+//  logger, err := ghostutils.NewLogger(ghostConfig.Logging)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  logger.Debugf("cache miss for %s", key)
+type Logger struct {
+	out        *log.Logger
+	structured *slog.Logger
+	format     string
+	level      int32
+	configured int32
+
+	mu       sync.Mutex
+	sampling LogSampling
+	counts   map[string]int
+	window   time.Time
+	revert   *time.Timer
+}
+
+// NewLogger returns a Logger writing to the output of config, with the
+// standard log flags unless it has a format.
+func NewLogger(config LoggingConfig) (*Logger, error) {
+	output, err := config.output()
+	if err != nil {
+		return nil, err
+	}
+	logger := &Logger{out: log.New(output, "", log.LstdFlags), format: config.Format}
+	logger.structured = slog.New(config.handler(output, slogLeveler{logger}))
+	return logger, logger.Apply(config)
+}
+
+// Apply sets the level and sampling from config, for use from a
+// GhostConfig.Watch callback. A level set at runtime is replaced; the
+// format and output stay those the logger was created with.
+func (logger *Logger) Apply(config LoggingConfig) error {
+	level, err := ParseLogLevel(config.Level)
+	if err != nil {
+		return err
+	}
+	logger.mu.Lock()
+	logger.sampling = config.Sampling
+	logger.counts = map[string]int{}
+	if logger.revert != nil {
+		logger.revert.Stop()
+		logger.revert = nil
+	}
+	logger.mu.Unlock()
+	atomic.StoreInt32(&logger.configured, int32(level))
+	atomic.StoreInt32(&logger.level, int32(level))
+	return nil
+}
+
+// Level returns the current level.
+func (logger *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&logger.level))
+}
+
+// SetLevel changes the level. A positive duration reverts to the
+// configured level after it elapses, so debug logging switched on
+// during an incident does not stay on.
+func (logger *Logger) SetLevel(level LogLevel, duration time.Duration) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if logger.revert != nil {
+		logger.revert.Stop()
+		logger.revert = nil
+	}
+	atomic.StoreInt32(&logger.level, int32(level))
+	if duration > 0 {
+		logger.revert = time.AfterFunc(duration, logger.Reset)
+	}
+}
+
+// Reset restores the configured level.
+func (logger *Logger) Reset() {
+	atomic.StoreInt32(&logger.level, atomic.LoadInt32(&logger.configured))
+}
+
+// Slog returns the structured logger, in the format of the config,
+// following the level of logger. Its messages are not sampled.
+//
+// Example:
+//  logger.Slog().Info("imported posts", "count", len(posts))
+func (logger *Logger) Slog() *slog.Logger {
+	return logger.structured
+}
+
+// slogLevel returns the slog level of level.
+func slogLevel(level LogLevel) slog.Level {
+	return slog.Level(4 * (int(level) - int(LevelInfo)))
+}
+
+// slogLeveler is the level of a Logger as a slog.Leveler.
+type slogLeveler struct {
+	logger *Logger
+}
+
+func (l slogLeveler) Level() slog.Level {
+	return slogLevel(l.logger.Level())
+}
+
+// Enabled reports whether messages at level are written.
+func (logger *Logger) Enabled(level LogLevel) bool {
+	return level >= logger.Level()
+}
+
+// Debugf logs at debug level.
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.logf(LevelDebug, format, args...)
+}
+
+// Infof logs at info level.
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs at warn level.
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs at error level.
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.logf(LevelError, format, args...)
+}
+
+func (logger *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if !logger.Enabled(level) {
+		return
+	}
+	if level < LevelWarn && !logger.sample(format) {
+		return
+	}
+	if logger.format != "" {
+		logger.structured.Log(context.Background(), slogLevel(level), fmt.Sprintf(format, args...))
+		return
+	}
+	logger.out.Output(3, strings.ToUpper(level.String())+" "+fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) sample(key string) bool {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	s := logger.sampling
+	if s.Initial <= 0 {
+		return true
+	}
+	tick := s.Tick
+	if tick <= 0 {
+		tick = time.Second
+	}
+	if now := time.Now(); now.Sub(logger.window) >= tick {
+		logger.window = now
+		logger.counts = map[string]int{}
+	}
+	logger.counts[key]++
+	n := logger.counts[key]
+	if n <= s.Initial {
+		return true
+	}
+	return s.Thereafter > 0 && (n-s.Initial)%s.Thereafter == 0
+}
+
+// LevelHandler serves the log level. GET returns it; PUT with
+// {"level": "debug", "duration": "15m"} changes it, reverting after
+// duration when one is given; DELETE restores the configured level.
+//
+// Example:
+//  admin := r.Group("/ghost", ghostutils.RequireRole(ghostutils.AdminRole))
+//  admin.Any("/log-level", logger.LevelHandler())
+func (logger *Logger) LevelHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var body struct {
+				Level    string `json:"level"`
+				Duration string `json:"duration"`
+			}
+			if err := c.ShouldBindJSON(&body); err != nil {
+				FailStatus(c, http.StatusBadRequest, err)
+				return
+			}
+			level, err := ParseLogLevel(body.Level)
+			if err != nil {
+				FailStatus(c, http.StatusBadRequest, err)
+				return
+			}
+			var duration time.Duration
+			if body.Duration != "" {
+				if duration, err = time.ParseDuration(body.Duration); err != nil {
+					FailStatus(c, http.StatusBadRequest, err)
+					return
+				}
+			}
+			logger.SetLevel(level, duration)
+			logger.Warnf("log level set to %s by %s", level, c.ClientIP())
+		case http.MethodDelete:
+			logger.Reset()
+		default:
+			c.AbortWithStatus(http.StatusMethodNotAllowed)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"level":      logger.Level().String(),
+			"configured": LogLevel(atomic.LoadInt32(&logger.configured)).String(),
+		})
+	}
+}
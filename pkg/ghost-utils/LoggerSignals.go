@@ -0,0 +1,35 @@
+//go:build !windows
+
+package ghostutils
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals switches logger to debug on SIGUSR1 and back to the
+// configured level on SIGUSR2 until ctx is done.
+//
+// Example:
+//  go logger.HandleSignals(ctx)
+//  // kill -USR1 <pid> to turn debug logging on
+func (logger *Logger) HandleSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGUSR1 {
+				logger.SetLevel(LevelDebug, 0)
+			} else {
+				logger.Reset()
+			}
+			logger.Warnf("log level set to %s by %s", logger.Level(), sig)
+		}
+	}
+}
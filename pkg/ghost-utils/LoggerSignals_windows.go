@@ -0,0 +1,9 @@
+package ghostutils
+
+import "context"
+
+// HandleSignals waits for ctx; Windows has no SIGUSR1 or SIGUSR2, so
+// use LevelHandler instead.
+func (logger *Logger) HandleSignals(ctx context.Context) {
+	<-ctx.Done()
+}
@@ -0,0 +1,478 @@
+package ghostutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// LoginGuardConfig is the `login-guard:` block of ghost.yaml.
+//
+// Example:
+//  login-guard:
+//    max-attempts: 5
+//    base-lockout: 1m
+//    max-lockout: 24h
+//    window: 1h
+//    store: redis
+//    redis-url: redis://localhost:6379/0
+type LoginGuardConfig struct {
+	MaxAttempts int           `yaml:"max-attempts"`
+	BaseLockout time.Duration `yaml:"base-lockout"`
+	MaxLockout  time.Duration `yaml:"max-lockout"`
+	Window      time.Duration `yaml:"window"`
+	Store       string        `yaml:"store"`
+	RedisURL    string        `yaml:"redis-url"`
+}
+
+// LockedError is returned by LoginGuard.Check while a key is locked.
+type LockedError struct {
+	Key   string
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("login locked until %s", e.Until.Format(time.RFC3339))
+}
+
+// Login anomaly kinds reported to LoginGuard.OnAnomaly.
+const (
+	AnomalyNewDevice  = "new-device"
+	AnomalyNewNetwork = "new-network"
+)
+
+// LoginAnomaly describes a successful login from a device or
+// network the account has not used before.
+type LoginAnomaly struct {
+	Kind      string
+	Account   string
+	IP        string
+	UserAgent string
+	At        time.Time
+}
+
+// LoginGuardStore persists failure counters, lockouts and the
+// devices seen for each account.
+type LoginGuardStore interface {
+	// Increment adds a failure to key and returns the new count.
+	// Counters expire window after the last failure.
+	Increment(ctx context.Context, key string, window time.Duration) (int, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	LockedUntil(ctx context.Context, key string) (time.Time, error)
+	Reset(ctx context.Context, key string) error
+	// Seen records value in the named set for account and reports
+	// whether it was already present and whether the set was empty.
+	Seen(ctx context.Context, account, set, value string) (seen bool, first bool, err error)
+}
+
+// LoginGuard protects login handlers from brute force attacks with
+// per-account and per-IP failure counters and exponential lockouts.
+type LoginGuard struct {
+	Store       LoginGuardStore
+	MaxAttempts int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	Window      time.Duration
+	// OnLockout is called every time a key becomes locked.
+	OnLockout func(ctx context.Context, key string, until time.Time)
+	// OnAnomaly is called for logins from unknown devices or networks.
+	OnAnomaly func(ctx context.Context, anomaly LoginAnomaly)
+}
+
+// NewLoginGuard builds a LoginGuard from the login-guard block of the
+// config. db is only used when the store is "surrealdb".
+//
+// Example:
+//  guard, err := ghostConfig.NewLoginGuard(db)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  guard.OnLockout = alertSecurity
+//  r.POST("/login", guard.Middleware(func(c *gin.Context) string {
+//      return c.PostForm("email")
+//  }), loginHandler)
+//
+// Returns:
+//  *LoginGuard
+//  error
+func (ghostConfig GhostConfig) NewLoginGuard(db *surrealdb.DB) (*LoginGuard, error) {
+	cfg := ghostConfig.LoginGuard
+	guard := &LoginGuard{
+		MaxAttempts: cfg.MaxAttempts,
+		BaseLockout: cfg.BaseLockout,
+		MaxLockout:  cfg.MaxLockout,
+		Window:      cfg.Window,
+	}
+	switch cfg.Store {
+	case "", "memory":
+		guard.Store = NewMemoryLoginGuardStore()
+	case "surrealdb":
+		guard.Store = SurrealLoginGuardStore{DB: db}
+	case "redis":
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		guard.Store = RedisLoginGuardStore{Client: redis.NewClient(opts)}
+	default:
+		return nil, fmt.Errorf("unknown login-guard store %q", cfg.Store)
+	}
+	return guard, nil
+}
+
+func (g *LoginGuard) defaults() (attempts int, base, max, window time.Duration) {
+	attempts, base, max, window = g.MaxAttempts, g.BaseLockout, g.MaxLockout, g.Window
+	if attempts == 0 {
+		attempts = 5
+	}
+	if base == 0 {
+		base = time.Minute
+	}
+	if max == 0 {
+		max = 24 * time.Hour
+	}
+	if window == 0 {
+		window = time.Hour
+	}
+	return
+}
+
+// Check returns a *LockedError if any of keys is currently locked.
+func (g *LoginGuard) Check(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		until, err := g.Store.LockedUntil(ctx, key)
+		if err != nil {
+			return err
+		}
+		if time.Now().Before(until) {
+			return &LockedError{Key: key, Until: until}
+		}
+	}
+	return nil
+}
+
+// Fail records a failed attempt against each key, locking keys that
+// reach the attempt limit. Each further failure doubles the lockout.
+func (g *LoginGuard) Fail(ctx context.Context, keys ...string) error {
+	attempts, base, max, window := g.defaults()
+	for _, key := range keys {
+		count, err := g.Store.Increment(ctx, key, window+max)
+		if err != nil {
+			return err
+		}
+		if count < attempts {
+			continue
+		}
+		lockout := base << uint(count-attempts)
+		if lockout > max || lockout <= 0 {
+			lockout = max
+		}
+		until := time.Now().Add(lockout)
+		if err := g.Store.Lock(ctx, key, until); err != nil {
+			return err
+		}
+		if g.OnLockout != nil {
+			g.OnLockout(ctx, key, until)
+		}
+	}
+	return nil
+}
+
+// Succeed clears the failure counters for keys and checks the login
+// device against the devices previously seen for account. Pass only
+// the account keys: a login succeeding from an IP must not clear the
+// failures other accounts were guessed with from it.
+func (g *LoginGuard) Succeed(ctx context.Context, account, ip, userAgent string, keys ...string) error {
+	for _, key := range keys {
+		if err := g.Store.Reset(ctx, key); err != nil {
+			return err
+		}
+	}
+	if account == "" {
+		return nil
+	}
+	checks := []struct{ set, value, kind string }{
+		{"device", fingerprint(userAgent), AnomalyNewDevice},
+		{"network", ipNetwork(ip), AnomalyNewNetwork},
+	}
+	for _, check := range checks {
+		seen, first, err := g.Store.Seen(ctx, account, check.set, check.value)
+		if err != nil {
+			return err
+		}
+		if !seen && !first && g.OnAnomaly != nil {
+			g.OnAnomaly(ctx, LoginAnomaly{
+				Kind:      check.kind,
+				Account:   account,
+				IP:        ip,
+				UserAgent: userAgent,
+				At:        time.Now(),
+			})
+		}
+	}
+	return nil
+}
+
+// Middleware guards the login handler that follows it. account
+// extracts the account name from the request. Responses with status
+// 401 or 403 count as failures against the account and the client IP,
+// and 2xx responses clear those of the account. The client IP honours
+// only the trusted-proxies of the config, so X-Forwarded-For cannot
+// spread the attempts of one client over many keys.
+func (g *LoginGuard) Middleware(account func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := account(c)
+		keys := []string{"ip:" + c.ClientIP()}
+		var accountKeys []string
+		if name != "" {
+			accountKeys = []string{"account:" + name}
+			keys = append(keys, accountKeys...)
+		}
+		ctx := c.Request.Context()
+		var locked *LockedError
+		if err := g.Check(ctx, keys...); errors.As(err, &locked) {
+			c.Header("Retry-After", strconv.Itoa(int(time.Until(locked.Until).Seconds())+1))
+			FailStatus(c, http.StatusTooManyRequests, locked)
+			return
+		} else if err != nil {
+			Fail(c, err)
+			return
+		}
+		c.Next()
+		var err error
+		switch status := c.Writer.Status(); {
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			err = g.Fail(ctx, keys...)
+		case status >= 200 && status < 300:
+			err = g.Succeed(ctx, name, c.ClientIP(), c.Request.UserAgent(), accountKeys...)
+		}
+		if err != nil {
+			c.Error(err)
+		}
+	}
+}
+
+func fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ipNetwork reduces an address to its /24 (IPv4) or /48 (IPv6)
+// network so routine address changes are not flagged.
+func ipNetwork(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// MemoryLoginGuardStore keeps login guard state in process memory.
+// It is suitable for a single instance or for development.
+type MemoryLoginGuardStore struct {
+	mu       sync.Mutex
+	counters map[string]memoryCounter
+	locks    map[string]time.Time
+	sets     map[string]map[string]struct{}
+}
+
+type memoryCounter struct {
+	count   int
+	expires time.Time
+}
+
+// NewMemoryLoginGuardStore returns an empty in-memory store.
+func NewMemoryLoginGuardStore() *MemoryLoginGuardStore {
+	return &MemoryLoginGuardStore{
+		counters: map[string]memoryCounter{},
+		locks:    map[string]time.Time{},
+		sets:     map[string]map[string]struct{}{},
+	}
+}
+
+func (s *MemoryLoginGuardStore) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counter := s.counters[key]
+	if time.Now().After(counter.expires) {
+		counter.count = 0
+	}
+	counter.count++
+	counter.expires = time.Now().Add(window)
+	s.counters[key] = counter
+	return counter.count, nil
+}
+
+func (s *MemoryLoginGuardStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locks[key] = until
+	return nil
+}
+
+func (s *MemoryLoginGuardStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.locks[key], nil
+}
+
+func (s *MemoryLoginGuardStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.counters, key)
+	delete(s.locks, key)
+	return nil
+}
+
+func (s *MemoryLoginGuardStore) Seen(ctx context.Context, account, set, value string) (bool, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := account + "/" + set
+	values, ok := s.sets[name]
+	if !ok {
+		values = map[string]struct{}{}
+		s.sets[name] = values
+	}
+	_, seen := values[value]
+	values[value] = struct{}{}
+	return seen, len(values) == 1 && !seen, nil
+}
+
+// RedisLoginGuardStore keeps login guard state in Redis so it is
+// shared between instances.
+type RedisLoginGuardStore struct {
+	Client *redis.Client
+	// Prefix defaults to "ghost:login:".
+	Prefix string
+}
+
+func (s RedisLoginGuardStore) key(parts ...string) string {
+	key := s.Prefix
+	if key == "" {
+		key = "ghost:login:"
+	}
+	for i, part := range parts {
+		if i > 0 {
+			key += ":"
+		}
+		key += part
+	}
+	return key
+}
+
+func (s RedisLoginGuardStore) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	k := s.key("count", key)
+	pipe := s.Client.TxPipeline()
+	incr := pipe.Incr(ctx, k)
+	pipe.Expire(ctx, k, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+func (s RedisLoginGuardStore) Lock(ctx context.Context, key string, until time.Time) error {
+	return s.Client.Set(ctx, s.key("lock", key), until.Unix(), time.Until(until)).Err()
+}
+
+func (s RedisLoginGuardStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	unix, err := s.Client.Get(ctx, s.key("lock", key)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, 0), nil
+}
+
+func (s RedisLoginGuardStore) Reset(ctx context.Context, key string) error {
+	return s.Client.Del(ctx, s.key("count", key), s.key("lock", key)).Err()
+}
+
+func (s RedisLoginGuardStore) Seen(ctx context.Context, account, set, value string) (bool, bool, error) {
+	k := s.key("seen", set, account)
+	pipe := s.Client.TxPipeline()
+	added := pipe.SAdd(ctx, k, value)
+	size := pipe.SCard(ctx, k)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, false, err
+	}
+	return added.Val() == 0, size.Val() == 1 && added.Val() == 1, nil
+}
+
+// SurrealLoginGuardStore keeps login guard state in the
+// login_guard and login_device tables.
+type SurrealLoginGuardStore struct {
+	DB *surrealdb.DB
+}
+
+type loginGuardRecord struct {
+	Count       int       `json:"count"`
+	Expires     time.Time `json:"expires"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+func (s SurrealLoginGuardStore) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	row, _, err := surrealFirst[loginGuardRecord](s.DB, `
+		UPDATE type::thing("login_guard", $key) SET
+			count = IF expires > time::now() THEN (count OR 0) + 1 ELSE 1 END,
+			expires = <datetime>$expires
+		RETURN AFTER`,
+		map[string]interface{}{"key": key, "expires": time.Now().Add(window)})
+	return row.Count, err
+}
+
+func (s SurrealLoginGuardStore) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := s.DB.Query(`UPDATE type::thing("login_guard", $key) SET locked_until = <datetime>$until`,
+		map[string]interface{}{"key": key, "until": until})
+	return err
+}
+
+func (s SurrealLoginGuardStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	row, _, err := surrealFirst[loginGuardRecord](s.DB, `SELECT * FROM type::thing("login_guard", $key)`,
+		map[string]interface{}{"key": key})
+	return row.LockedUntil, err
+}
+
+func (s SurrealLoginGuardStore) Reset(ctx context.Context, key string) error {
+	_, err := s.DB.Query(`DELETE type::thing("login_guard", $key)`, map[string]interface{}{"key": key})
+	return err
+}
+
+func (s SurrealLoginGuardStore) Seen(ctx context.Context, account, set, value string) (bool, bool, error) {
+	vars := map[string]interface{}{"account": account, "set": set, "value": value}
+	type row struct {
+		Value string `json:"value"`
+	}
+	rows, err := surrealQuery[row](s.DB,
+		`SELECT value FROM login_device WHERE account = $account AND set = $set`, vars)
+	if err != nil {
+		return false, false, err
+	}
+	for _, r := range rows {
+		if r.Value == value {
+			return true, false, nil
+		}
+	}
+	if _, err := s.DB.Query(
+		`CREATE login_device SET account = $account, set = $set, value = $value, created_at = time::now()`,
+		vars); err != nil {
+		return false, false, err
+	}
+	return false, len(rows) == 0, nil
+}
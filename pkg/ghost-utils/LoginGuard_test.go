@@ -0,0 +1,85 @@
+package ghostutils_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+	"github.com/adamkali/ghost_utils/pkg/ghosttest"
+	"github.com/gin-gonic/gin"
+)
+
+func loginGuardStores(t *testing.T, test func(t *testing.T, store ghostutils.LoginGuardStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, ghostutils.NewMemoryLoginGuardStore())
+	})
+	t.Run("surrealdb", func(t *testing.T) {
+		test(t, ghostutils.SurrealLoginGuardStore{DB: ghosttest.DB(t)})
+	})
+}
+
+func TestLoginGuardLocksAfterMaxAttempts(t *testing.T) {
+	loginGuardStores(t, func(t *testing.T, store ghostutils.LoginGuardStore) {
+		ctx := context.Background()
+		lockouts := 0
+		guard := &ghostutils.LoginGuard{
+			Store:       store,
+			MaxAttempts: 3,
+			BaseLockout: time.Minute,
+			OnLockout:   func(context.Context, string, time.Time) { lockouts++ },
+		}
+		for i := 1; i < 3; i++ {
+			if err := guard.Fail(ctx, "account:ada"); err != nil {
+				t.Fatal(err)
+			}
+			if err := guard.Check(ctx, "account:ada"); err != nil {
+				t.Fatalf("locked after %d failures: %v", i, err)
+			}
+		}
+		if err := guard.Fail(ctx, "account:ada"); err != nil {
+			t.Fatal(err)
+		}
+		var locked *ghostutils.LockedError
+		if err := guard.Check(ctx, "account:ada"); !errors.As(err, &locked) {
+			t.Fatalf("not locked after 3 failures: %v", err)
+		}
+		if until := time.Until(locked.Until); until < 50*time.Second || until > time.Minute+time.Second {
+			t.Errorf("locked for %s, want a minute", until)
+		}
+		if lockouts != 1 {
+			t.Errorf("OnLockout called %d times, want 1", lockouts)
+		}
+		if err := guard.Check(ctx, "account:grace"); err != nil {
+			t.Errorf("other account locked: %v", err)
+		}
+
+		if err := guard.Succeed(ctx, "", "", "", "account:ada"); err != nil {
+			t.Fatal(err)
+		}
+		if err := guard.Check(ctx, "account:ada"); err != nil {
+			t.Errorf("locked after Succeed: %v", err)
+		}
+	})
+}
+
+func TestLoginGuardMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	guard := &ghostutils.LoginGuard{Store: ghostutils.NewMemoryLoginGuardStore(), MaxAttempts: 3}
+	r := gin.New()
+	r.POST("/login", guard.Middleware(func(c *gin.Context) string {
+		return c.Query("email")
+	}), func(c *gin.Context) {
+		c.Status(http.StatusUnauthorized)
+	})
+	for i, want := range []int{401, 401, 401, 429} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login?email=ada@example.com", nil))
+		if w.Code != want {
+			t.Fatalf("attempt %d: status %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
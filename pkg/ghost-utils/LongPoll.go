@@ -0,0 +1,221 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Changes hands out change tokens per topic and wakes long-poll
+// waiters when a topic changes. Feed it the changes of the tables
+// behind the topics with HandleChange or Watch, or call Notify
+// wherever the underlying data is written.
+//
+// Tokens start with a per-process epoch, so a token from before a
+// restart always reads as changed. Only topics with waiters are kept;
+// the token of any other topic is the count of all changes so far, so
+// a token from before a topic was dropped reads as changed once
+// anything changed.
+//
+// Example:
+//  changes := ghostutils.NewChanges()
+//  changes.Topics = func(change ghostutils.SyncChange) []string {
+//      owner, _ := change.Data["owner"].(string)
+//      return []string{"inbox:" + owner}
+//  }
+//  go feed.Run(ctx, time.Second, changes.HandleChange)
+type Changes struct {
+	// Topics returns the topics a table change notifies besides the
+	// table and the record, e.g. "order" and "order:o1", such as the
+	// inbox of the record's owner.
+	Topics func(change SyncChange) []string
+
+	mu     sync.Mutex
+	epoch  string
+	seq    uint64
+	topics map[string]*changeWaiters
+}
+
+// changeWaiters is the version and waiters of a topic being waited on.
+type changeWaiters struct {
+	version uint64
+	wake    chan struct{}
+	waiters int
+}
+
+// ChangeTopic is one topic of a Changes.
+type ChangeTopic struct {
+	changes *Changes
+	name    string
+}
+
+// NewChanges returns an empty Changes.
+func NewChanges() *Changes {
+	return &Changes{epoch: randomID(4), topics: map[string]*changeWaiters{}}
+}
+
+// Topic returns the named topic. Topics are usually per record or
+// per owner, e.g. "inbox:user:tobie".
+func (h *Changes) Topic(name string) *ChangeTopic {
+	return &ChangeTopic{changes: h, name: name}
+}
+
+// Notify marks topic as changed.
+func (h *Changes) Notify(name string) {
+	h.Topic(name).Notify()
+}
+
+// HandleChange notifies the topics of change: its table, its record
+// and those of Topics. It is the handler of a Changefeed.
+//
+// Example:
+//  go feed.Run(ctx, time.Second, changes.HandleChange)
+func (h *Changes) HandleChange(ctx context.Context, change SyncChange) error {
+	if change.Op == SyncSchema {
+		return nil
+	}
+	names := []string{change.Table}
+	if change.ID != "" {
+		names = append(names, change.Table+":"+change.ID)
+	}
+	if h.Topics != nil {
+		names = append(names, h.Topics(change)...)
+	}
+	h.notify(names...)
+	return nil
+}
+
+// Watch notifies the topics of the changes of table from source,
+// like ChangefeedLiveSource, until ctx is done or source fails.
+//
+// Example:
+//  go changes.Watch(ctx, ghostutils.ChangefeedLiveSource{DB: db}, "message")
+func (h *Changes) Watch(ctx context.Context, source LiveSource, table string) error {
+	return source.Watch(ctx, table, func(change SyncChange) {
+		h.HandleChange(ctx, change)
+	})
+}
+
+// notify marks the topics as changed at once, so they share a
+// version, and wakes their waiters.
+func (h *Changes) notify(names ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	for _, name := range names {
+		if waiting, ok := h.topics[name]; ok {
+			waiting.version = h.seq
+			close(waiting.wake)
+			waiting.wake = make(chan struct{})
+		}
+	}
+}
+
+// Notify marks the topic as changed and wakes its waiters.
+func (t *ChangeTopic) Notify() {
+	t.changes.notify(t.name)
+}
+
+// Token returns the current change token of the topic.
+func (t *ChangeTopic) Token() string {
+	t.changes.mu.Lock()
+	defer t.changes.mu.Unlock()
+	return t.token()
+}
+
+func (t *ChangeTopic) token() string {
+	version := t.changes.seq
+	if waiting, ok := t.changes.topics[t.name]; ok {
+		version = waiting.version
+	}
+	return fmt.Sprintf("%s-%d", t.changes.epoch, version)
+}
+
+// WaitForChange blocks until the topic no longer matches token, the
+// timeout passes or ctx is done. It returns the current token and
+// whether it changed. An empty or stale token returns immediately.
+//
+// Example:
+//  token, changed, err := changes.Topic("inbox:"+userID).WaitForChange(c.Request.Context(), c.Query("token"), 25*time.Second)
+//
+// Returns:
+//  the current token, true if it differs from token, ctx.Err() if
+//  the request went away
+func (t *ChangeTopic) WaitForChange(ctx context.Context, token string, timeout time.Duration) (string, bool, error) {
+	h := t.changes
+	h.mu.Lock()
+	current := t.token()
+	if token != current {
+		h.mu.Unlock()
+		return current, true, nil
+	}
+	waiting, ok := h.topics[t.name]
+	if !ok {
+		waiting = &changeWaiters{version: h.seq, wake: make(chan struct{})}
+		h.topics[t.name] = waiting
+	}
+	waiting.waiters++
+	wake := waiting.wake
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		// the last waiter drops the topic
+		if waiting.waiters--; waiting.waiters == 0 {
+			delete(h.topics, t.name)
+		}
+		h.mu.Unlock()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-wake:
+		return t.Token(), true, nil
+	case <-timer.C:
+		return current, false, nil
+	case <-ctx.Done():
+		return current, false, ctx.Err()
+	}
+}
+
+// LongPoll serves a long-poll endpoint. topic picks the topic for
+// the request (after any auth checks), load returns the data to send
+// when it changed. Clients pass the last token as ?token= and get
+// {"token": ..., "changed": bool, "data": ...} back.
+//
+// Example:
+//  r.GET("/api/inbox/poll", ghostutils.LongPoll(changes, 25*time.Second,
+//      func(c *gin.Context) (string, error) {
+//          identity, _ := ghostutils.CurrentIdentity(c)
+//          return "inbox:" + identity.ID, nil
+//      },
+//      func(c *gin.Context) (interface{}, error) { return inbox.List(c) },
+//  ))
+func LongPoll(changes *Changes, timeout time.Duration, topic func(c *gin.Context) (string, error), load func(c *gin.Context) (interface{}, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name, err := topic(c)
+		if err != nil {
+			FailStatus(c, http.StatusForbidden, err)
+			return
+		}
+		token, changed, err := changes.Topic(name).WaitForChange(c.Request.Context(), c.Query("token"), timeout)
+		if err != nil {
+			c.Abort()
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		if !changed {
+			c.JSON(http.StatusOK, gin.H{"token": token, "changed": false})
+			return
+		}
+		data, err := load(c)
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"token": token, "changed": true, "data": data})
+	}
+}
@@ -0,0 +1,249 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// MaterializedView is a derived table kept up to date from its
+// source table.
+//
+// Rebuild recomputes the whole view and runs inside a transaction
+// after the view table is emptied. Apply, when set, updates the view
+// for one change of Source read from its changefeed (see
+// EnableChangefeed). Changes made while a rebuild runs may be applied
+// twice, so Apply should recompute the affected rows rather than
+// increment them. Interval, when set, rebuilds on a schedule.
+//
+// Example:
+//  views.Register(ghostutils.MaterializedView{
+//      Name:    "user_post_count",
+//      Source:  "post",
+//      Rebuild: "INSERT INTO user_post_count (SELECT author AS id, count() AS posts FROM post GROUP BY author)",
+//      Apply: func(ctx context.Context, db *surrealdb.DB, change ghostutils.SyncChange) error {
+//          _, err := db.Query("UPDATE type::thing('user_post_count', $author) SET posts = (SELECT count() FROM post WHERE author = $author GROUP ALL)[0].count", map[string]interface{}{
+//              "author": change.Data["author"],
+//          })
+//          return err
+//      },
+//  })
+type MaterializedView struct {
+	Name     string
+	Source   string
+	Rebuild  string
+	Apply    func(ctx context.Context, db *surrealdb.DB, change SyncChange) error
+	Interval time.Duration
+}
+
+// ViewStatus is the state of a registered view.
+type ViewStatus struct {
+	Name        string    `json:"name"`
+	Source      string    `json:"source"`
+	Incremental bool      `json:"incremental"`
+	Interval    string    `json:"interval,omitempty"`
+	RebuiltAt   time.Time `json:"rebuilt_at,omitempty"`
+	Rebuilding  bool      `json:"rebuilding"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Views maintains registered materialized views.
+type Views struct {
+	DB *surrealdb.DB
+	// Cursors persists the changefeed position of incremental views.
+	Cursors CursorStore
+	// PollInterval is how often changefeeds are read. Defaults to one
+	// second.
+	PollInterval time.Duration
+
+	mu     sync.Mutex
+	views  map[string]MaterializedView
+	status map[string]*ViewStatus
+}
+
+// Register adds a view. It must be called before Run.
+func (v *Views) Register(view MaterializedView) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.views == nil {
+		v.views, v.status = map[string]MaterializedView{}, map[string]*ViewStatus{}
+	}
+	v.views[view.Name] = view
+	status := &ViewStatus{Name: view.Name, Source: view.Source, Incremental: view.Apply != nil}
+	if view.Interval > 0 {
+		status.Interval = view.Interval.String()
+	}
+	v.status[view.Name] = status
+}
+
+// Rebuild recomputes the named view from scratch and moves its
+// changefeed cursor to the head of the source feed.
+func (v *Views) Rebuild(ctx context.Context, name string) error {
+	v.mu.Lock()
+	view, ok := v.views[name]
+	status := v.status[name]
+	if ok && status.Rebuilding {
+		v.mu.Unlock()
+		return fmt.Errorf("view %q is already rebuilding", name)
+	}
+	if ok {
+		status.Rebuilding = true
+	}
+	v.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown view %q", name)
+	}
+	err := v.rebuild(ctx, view)
+	v.mu.Lock()
+	status.Rebuilding = false
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.LastError, status.RebuiltAt = "", time.Now().UTC()
+	}
+	v.mu.Unlock()
+	return err
+}
+
+func (v *Views) rebuild(ctx context.Context, view MaterializedView) error {
+	if !identifierPattern.MatchString(view.Name) {
+		return fmt.Errorf("invalid view name %q", view.Name)
+	}
+	var head string
+	if view.Apply != nil && v.Cursors != nil {
+		var err error
+		if head, err = changefeedHead(v.DB, view.Source); err != nil {
+			return err
+		}
+	}
+	sql := fmt.Sprintf("BEGIN TRANSACTION;\nDELETE %s;\n%s;\nCOMMIT TRANSACTION;", view.Name, view.Rebuild)
+	statements, err := surrealStatements(v.DB, sql, nil)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return fmt.Errorf("rebuilding %s: %s", view.Name, statement.Detail)
+		}
+	}
+	if view.Apply != nil && v.Cursors != nil {
+		return v.Cursors.SaveCursor(ctx, v.feedName(view), head)
+	}
+	return nil
+}
+
+func (v *Views) feedName(view MaterializedView) string {
+	return "view:" + view.Name
+}
+
+// changefeedHead returns the cursor of the last change of table.
+func changefeedHead(db *surrealdb.DB, table string) (string, error) {
+	cursor := ""
+	for {
+		_, last, err := showChanges(db, table, cursor, 1000)
+		if err != nil || last == cursor {
+			return cursor, err
+		}
+		cursor = last
+	}
+}
+
+// Run keeps every view up to date until ctx is done: incremental
+// views follow their source changefeed and scheduled views are
+// rebuilt every Interval.
+func (v *Views) Run(ctx context.Context) {
+	poll := v.PollInterval
+	if poll <= 0 {
+		poll = time.Second
+	}
+	v.mu.Lock()
+	views := make([]MaterializedView, 0, len(v.views))
+	for _, view := range v.views {
+		views = append(views, view)
+	}
+	v.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, view := range views {
+		view := view
+		if view.Apply != nil && v.Cursors != nil {
+			feed := &Changefeed{DB: v.DB, Table: view.Source, Name: v.feedName(view), Cursors: v.Cursors}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = feed.Run(ctx, poll, func(ctx context.Context, change SyncChange) error {
+					err := view.Apply(ctx, v.DB, change)
+					if err != nil {
+						log.Printf("view %s: %v", view.Name, err)
+						v.setError(view.Name, err)
+					}
+					return err
+				})
+			}()
+		}
+		if view.Interval > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ticker := time.NewTicker(view.Interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						if err := v.Rebuild(ctx, view.Name); err != nil {
+							log.Printf("view %s: %v", view.Name, err)
+						}
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func (v *Views) setError(name string, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if status, ok := v.status[name]; ok {
+		status.LastError = err.Error()
+	}
+}
+
+// Status returns the state of every view, sorted by name.
+func (v *Views) Status() []ViewStatus {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	out := make([]ViewStatus, 0, len(v.status))
+	for _, status := range v.status {
+		out = append(out, *status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Mount registers GET /views for the status of the views and
+// POST /views/:name/rebuild to rebuild one. Protect the group, they
+// are meant for operators.
+//
+// Example:
+//  views.Mount(r.Group("/admin", ghostutils.RequireRole(ghostutils.AdminRole)))
+func (v *Views) Mount(g *gin.RouterGroup) {
+	g.GET("/views", func(c *gin.Context) {
+		c.JSON(http.StatusOK, v.Status())
+	})
+	g.POST("/views/:name/rebuild", func(c *gin.Context) {
+		if err := v.Rebuild(c.Request.Context(), c.Param("name")); err != nil {
+			Fail(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,266 @@
+package ghostutils
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsConfig is the metrics block of ghost.yaml. When Enabled,
+// Setup records the requests and SurrealDB queries and serves them,
+// with the Go runtime metrics, in the Prometheus format on Path, and
+// keeps them as the Metrics of its App.
+//
+//  metrics:
+//      enabled: true
+//      path: /metrics
+//      namespace: blog
+//      buckets: [0.005, 0.01, 0.05, 0.1, 0.5, 1, 5]
+//      explain:
+//          threshold: 200ms
+type MetricsConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Path      string `yaml:"path"`
+	Namespace string `yaml:"namespace"`
+	// Buckets are the upper bounds of the duration histograms, in
+	// seconds, prometheus.DefBuckets by default.
+	Buckets []float64 `yaml:"buckets"`
+	// Explain samples the plans of slow queries, see
+	// NewQueryPlanSampler.
+	Explain ExplainConfig `yaml:"explain"`
+}
+
+// Defaults applied to MetricsConfig by Validate.
+const (
+	DefaultMetricsPath      = "/metrics"
+	DefaultMetricsNamespace = "ghost"
+)
+
+// Metrics records the requests and queries of the app in a Prometheus
+// registry. Register the metrics of the app on Registry to serve them
+// along.
+//
+// Example:
+//  metrics := ghostutils.NewMetrics(ghostConfig.Metrics)
+//  r.Use(metrics.Middleware())
+//  r.GET("/metrics", metrics.Handler())
+//  ghostutils.ObserveQueries(metrics.ObserveQuery)
+//
+//  published := prometheus.NewCounter(prometheus.CounterOpts{Name: "posts_published_total"})
+//  metrics.Registry.MustRegister(published)
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	queries  *prometheus.HistogramVec
+
+	observersMu sync.RWMutex
+	observers   []RequestObserver
+}
+
+// NewMetrics returns the metrics of config, in a new registry holding
+// the Go runtime and process collectors.
+func NewMetrics(config MetricsConfig) *Metrics {
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = DefaultMetricsNamespace
+	}
+	buckets := config.Buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by method and route.",
+			Buckets:   buckets,
+		}, []string{"method", "route"}),
+		queries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "surrealdb_query_duration_seconds",
+			Help:      "SurrealDB query latency by statement and outcome.",
+			Buckets:   buckets,
+		}, []string{"statement", "outcome"}),
+	}
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.duration,
+		m.queries,
+	)
+	return m
+}
+
+// Middleware records the count and latency of every request by its
+// route pattern, so /posts/1 and /posts/2 share a series. Requests
+// matching no route are recorded as "unmatched". Each request is then
+// passed to the RequestObservers.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		request := RequestEvent{
+			Context: c,
+			Method:  c.Request.Method,
+			Route:   c.FullPath(),
+			Status:  c.Writer.Status(),
+			Took:    time.Since(start),
+		}
+		if request.Route == "" {
+			request.Route = "unmatched"
+		}
+		m.requests.WithLabelValues(request.Method, request.Route, strconv.Itoa(request.Status)).Inc()
+		m.duration.WithLabelValues(request.Method, request.Route).Observe(request.Took.Seconds())
+		m.observersMu.RLock()
+		observers := m.observers
+		m.observersMu.RUnlock()
+		for _, observer := range observers {
+			observer(request)
+		}
+	}
+}
+
+// RequestEvent is a request recorded by Metrics.Middleware, as passed
+// to the RequestObservers.
+type RequestEvent struct {
+	Context *gin.Context
+	Method  string
+	// Route is the route pattern, or "unmatched".
+	Route  string
+	Status int
+	Took   time.Duration
+}
+
+// RequestObserver is called after each request recorded by the
+// metrics.
+type RequestObserver func(request RequestEvent)
+
+// ObserveRequests registers observer for the requests recorded by
+// Middleware, so what derives from the requests, such as SLOTracker,
+// reads the same durations as the histograms. Observers run on the
+// request goroutine, so keep them fast.
+//
+// Example:
+//  slo := ghostutils.NewSLOTracker(ghostConfig.SLO)
+//  metrics.ObserveRequests(slo.ObserveRequest)
+func (m *Metrics) ObserveRequests(observer RequestObserver) {
+	m.observersMu.Lock()
+	defer m.observersMu.Unlock()
+	m.observers = append(m.observers, observer)
+}
+
+// Handler serves the registry in the Prometheus format.
+func (m *Metrics) Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+}
+
+// ObserveQuery records a query, as a QueryObserver.
+func (m *Metrics) ObserveQuery(query QueryEvent) {
+	outcome := "ok"
+	if query.Err != nil {
+		outcome = "error"
+	}
+	m.queries.WithLabelValues(query.Statement(), outcome).Observe(query.Took.Seconds())
+}
+
+// QueryEvent is a query run through the package, as passed to the
+// QueryObservers.
+type QueryEvent struct {
+	DB   GhostDB
+	SQL  string
+	Vars map[string]interface{}
+	Took time.Duration
+	Err  error
+}
+
+// Statement returns the kind of the first statement of the query, in
+// lower case, such as "select" or "create", or "other".
+func (query QueryEvent) Statement() string {
+	sql := strings.TrimSpace(query.SQL)
+	end := strings.IndexFunc(sql, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == ';' || r == '('
+	})
+	if end >= 0 {
+		sql = sql[:end]
+	}
+	keyword := strings.ToLower(sql)
+	for _, known := range surrealStatementKinds {
+		if keyword == known {
+			return keyword
+		}
+	}
+	return "other"
+}
+
+var surrealStatementKinds = []string{
+	"select", "create", "update", "upsert", "delete", "relate", "insert",
+	"define", "remove", "info", "let", "begin", "return", "live", "kill",
+	"if", "throw", "use", "show",
+}
+
+// QueryObserver is called after each query run by the package.
+type QueryObserver func(query QueryEvent)
+
+var (
+	queryObserversMu sync.RWMutex
+	queryObservers   []QueryObserver
+)
+
+// ObserveQueries registers observer for the queries run by the
+// package, such as those of Repository. Setup registers the metrics
+// when metrics.enabled is set. Observers run on the querying
+// goroutine, so keep them fast.
+//
+// Example:
+//  ghostutils.ObserveQueries(func(query ghostutils.QueryEvent) {
+//      if query.Took > time.Second {
+//          log.Printf("slow %s query: %s", query.Statement(), query.Took)
+//      }
+//  })
+func ObserveQueries(observer QueryObserver) {
+	queryObserversMu.Lock()
+	defer queryObserversMu.Unlock()
+	queryObservers = append(queryObservers, observer)
+}
+
+// observeQuery passes a query to the observers.
+func observeQuery(db GhostDB, sql string, vars map[string]interface{}, start time.Time, err error) {
+	queryObserversMu.RLock()
+	observers := queryObservers
+	queryObserversMu.RUnlock()
+	if len(observers) == 0 {
+		return
+	}
+	query := QueryEvent{DB: db, SQL: sql, Vars: vars, Took: time.Since(start), Err: err}
+	for _, observer := range observers {
+		observer(query)
+	}
+}
+
+// mountMetrics installs the metrics of config on r for Setup.
+func mountMetrics(r *gin.Engine, config MetricsConfig) *Metrics {
+	path := config.Path
+	if path == "" {
+		path = DefaultMetricsPath
+	}
+	metrics := NewMetrics(config)
+	r.Use(metrics.Middleware())
+	r.GET(path, metrics.Handler())
+	ObserveQueries(metrics.ObserveQuery)
+	return metrics
+}
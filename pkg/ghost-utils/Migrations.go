@@ -0,0 +1,374 @@
+package ghostutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MigrationsConfig is the migrations block of ghost.yaml. With auto
+// set, Setup applies pending migrations after connecting.
+//
+//  migrations:
+//      dir: migrations
+//      auto: true
+type MigrationsConfig struct {
+	Dir  string `yaml:"dir"`
+	Auto bool   `yaml:"auto"`
+}
+
+// DefaultMigrationsDir is the migrations directory applied by
+// Validate.
+const DefaultMigrationsDir = "migrations"
+
+// DefaultMigrationsTable records the applied migrations.
+const DefaultMigrationsTable = "_migrations"
+
+// Migration is one numbered schema change. Files are named
+// <version>_<name>.up.surql and <version>_<name>.down.surql; a plain
+// <version>_<name>.surql is an up migration without a down.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum identifies the up script, so edits to an applied migration
+// are noticed.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationStatus is a migration and whether it has been applied.
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	// Modified is set when the up script changed after it was applied.
+	Modified bool `json:"modified,omitempty"`
+}
+
+type migrationRecord struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Checksum  string    `json:"checksum"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_([A-Za-z0-9_\-]+?)(\.(up|down))?\.surql$`)
+
+// LoadMigrations reads the migrations in the root of fsys, ordered by
+// version. Use os.DirFS for a directory or an embed.FS to ship them in
+// the binary.
+//
+// Returns:
+//  []Migration
+//  error if a file cannot be read or two migrations share a version
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		m := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", migration.Name, m[2], version)
+		}
+		if m[4] == "down" {
+			migration.Down = string(data)
+		} else {
+			if migration.Up != "" {
+				return nil, fmt.Errorf("migration %d has more than one up script", version)
+			}
+			migration.Up = string(data)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if strings.TrimSpace(migration.Up) == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies and reverts migrations against a database.
+//
+// Example:
+//  //go:embed migrations/*.surql
+//  var files embed.FS
+//
+//  sub, _ := fs.Sub(files, "migrations")
+//  migrator, err := ghostutils.NewMigrator(db, sub)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  applied, err := migrator.Up(ctx)
+type Migrator struct {
+	DB         GhostDB
+	Migrations []Migration
+	// Table defaults to _migrations.
+	Table string
+}
+
+// NewMigrator loads the migrations in fsys, together with those of
+// RegisterMigrations.
+func NewMigrator(db GhostDB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	migrator := &Migrator{DB: db, Migrations: migrations}
+	registeredMigrations.Lock()
+	defer registeredMigrations.Unlock()
+	if err := migrator.Add(registeredMigrations.list...); err != nil {
+		return nil, err
+	}
+	return migrator, nil
+}
+
+// registeredMigrations are the migrations of RegisterMigrations.
+var registeredMigrations struct {
+	sync.Mutex
+	list []Migration
+}
+
+// RegisterMigrations adds migrations defined in code, such as
+// OrganizationMigration, to every Migrator made by NewMigrator, and so
+// to Migrate and the auto migrations of Setup. Register before Setup.
+//
+// Example:
+//  func init() {
+//      ghostutils.RegisterMigrations(ghostutils.OrganizationMigration(9000))
+//  }
+func RegisterMigrations(migrations ...Migration) {
+	registeredMigrations.Lock()
+	defer registeredMigrations.Unlock()
+	registeredMigrations.list = append(registeredMigrations.list, migrations...)
+}
+
+// Add merges migrations into the Migrations of m in version order.
+//
+// Returns:
+//  error when a version is already taken
+func (m *Migrator) Add(migrations ...Migration) error {
+	taken := make(map[int]string, len(m.Migrations))
+	for _, migration := range m.Migrations {
+		taken[migration.Version] = migration.Name
+	}
+	for _, migration := range migrations {
+		if name, ok := taken[migration.Version]; ok {
+			return fmt.Errorf("migrations %s and %s share version %d", name, migration.Name, migration.Version)
+		}
+		taken[migration.Version] = migration.Name
+		m.Migrations = append(m.Migrations, migration)
+	}
+	sort.Slice(m.Migrations, func(i, j int) bool { return m.Migrations[i].Version < m.Migrations[j].Version })
+	return nil
+}
+
+// Migrate applies every pending migration in dir.
+//
+// Example:
+//  if _, err := ghostutils.Migrate(db, "migrations"); err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  []Migration applied, in order
+//  error from the first migration that failed; it was rolled back
+func Migrate(db GhostDB, dir string) ([]Migration, error) {
+	migrator, err := NewMigrator(db, os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+	return migrator.Up(context.Background())
+}
+
+func (m *Migrator) table() string {
+	if m.Table == "" {
+		return DefaultMigrationsTable
+	}
+	return m.Table
+}
+
+func (m *Migrator) applied() (map[int]migrationRecord, error) {
+	if !identifierPattern.MatchString(m.table()) {
+		return nil, fmt.Errorf("invalid migrations table %q", m.table())
+	}
+	rows, err := surrealQuery[migrationRecord](m.DB, "SELECT * FROM "+m.table(), nil)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]migrationRecord, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// Status lists every known migration and whether it is applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.Migrations))
+	for _, migration := range m.Migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			at := record.AppliedAt
+			status.Applied, status.AppliedAt = true, &at
+			status.Modified = record.Checksum != migration.Checksum()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, ctx.Err()
+}
+
+// Up applies the pending migrations in version order.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.UpTo(ctx, -1)
+}
+
+// UpTo applies the pending migrations up to and including version,
+// or all of them when version is negative. Each migration runs in its
+// own transaction together with its _migrations record.
+func (m *Migrator) UpTo(ctx context.Context, version int) ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, migration := range m.Migrations {
+		if version >= 0 && migration.Version > version {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return done, err
+		}
+		record := migrationRecord{Version: migration.Version, Name: migration.Name, Checksum: migration.Checksum(), AppliedAt: time.Now().UTC()}
+		bookkeeping := fmt.Sprintf("CREATE %s CONTENT $migration;", recordID(m.table(), strconv.Itoa(migration.Version)))
+		if err := m.run(migration, migration.Up, bookkeeping, map[string]interface{}{"migration": record}); err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations, newest first.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(m.Migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := m.Migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return done, err
+		}
+		if strings.TrimSpace(migration.Down) == "" {
+			return done, fmt.Errorf("migration %d_%s has no down script", migration.Version, migration.Name)
+		}
+		bookkeeping := fmt.Sprintf("DELETE %s;", recordID(m.table(), strconv.Itoa(migration.Version)))
+		if err := m.run(migration, migration.Down, bookkeeping, nil); err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+func (m *Migrator) run(migration Migration, script, bookkeeping string, vars map[string]interface{}) error {
+	script = strings.TrimSpace(script)
+	if !strings.HasSuffix(script, ";") {
+		script += ";"
+	}
+	sql := "BEGIN TRANSACTION;\n" + script + "\n" + bookkeeping + "\nCOMMIT TRANSACTION;"
+	statements, err := surrealStatements(m.DB, sql, vars)
+	if err != nil {
+		return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+	}
+	var failure string
+	for _, statement := range statements {
+		if statement.Status == "OK" {
+			continue
+		}
+		// every statement of a failed transaction reports it; keep the cause
+		if failure == "" || strings.Contains(failure, "not executed") {
+			failure = statement.Detail
+		}
+	}
+	if failure != "" {
+		return fmt.Errorf("migration %d_%s: %s", migration.Version, migration.Name, failure)
+	}
+	return nil
+}
+
+// StartupCheck reports the migration status in the startup report,
+// failing when migrations are pending or were modified after being
+// applied.
+func (m *Migrator) StartupCheck() StartupCheck {
+	return StartupCheck{Name: "migrations", Run: func(ctx context.Context) (string, error) {
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return "", err
+		}
+		var pending, modified []string
+		latest := 0
+		for _, status := range statuses {
+			name := fmt.Sprintf("%d_%s", status.Version, status.Name)
+			switch {
+			case !status.Applied:
+				pending = append(pending, name)
+			case status.Modified:
+				modified = append(modified, name)
+			}
+			if status.Applied {
+				latest = status.Version
+			}
+		}
+		if len(pending) > 0 {
+			return "", fmt.Errorf("pending: %s", strings.Join(pending, ", "))
+		}
+		if len(modified) > 0 {
+			return "", fmt.Errorf("modified after being applied: %s", strings.Join(modified, ", "))
+		}
+		return fmt.Sprintf("at version %d", latest), nil
+	}}
+}
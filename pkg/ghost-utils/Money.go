@@ -0,0 +1,295 @@
+package ghostutils
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// ErrCurrencyMismatch is returned by arithmetic on amounts of
+// different currencies.
+var ErrCurrencyMismatch = errors.New("currency mismatch")
+
+// Money is an amount in the minor units of its currency, cents for
+// USD and yen for JPY, so sums are exact. It encodes to JSON, and so
+// to SurrealDB, as {"amount": 1234, "currency": "USD"}.
+//
+// Example:
+//  price, err := ghostutils.ParseMoney("19.99", "USD")
+//  total, err := price.Multiply(3).Add(shipping)
+//
+//  {{money .Order.Total .Layout.Preferences.Locale}}  // $59.97, or 59,97 $ for de
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// NewMoney returns amount minor units of currency, an ISO 4217 code.
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+// ParseMoney parses a decimal amount like "-12.30" in the major units
+// of currency, without going through a float.
+//
+// Returns:
+//  Money
+//  error for an unknown currency, a malformed amount or more decimals
+//  than the currency has
+func ParseMoney(amount, code string) (Money, error) {
+	scale, err := currencyScale(code)
+	if err != nil {
+		return Money{}, err
+	}
+	value := strings.TrimSpace(amount)
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "-"), "+")
+	whole, fraction := value, ""
+	if i := strings.Index(value, "."); i >= 0 {
+		whole, fraction = value[:i], value[i+1:]
+	}
+	if whole == "" && fraction == "" || len(fraction) > scale || strings.ContainsAny(whole+fraction, "+-") {
+		return Money{}, fmt.Errorf("invalid %s amount %q", strings.ToUpper(code), amount)
+	}
+	digits := whole + fraction + strings.Repeat("0", scale-len(fraction))
+	minor, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid %s amount %q", strings.ToUpper(code), amount)
+	}
+	if negative {
+		minor = -minor
+	}
+	return NewMoney(minor, code), nil
+}
+
+// currencyScale returns the number of minor unit digits of code.
+func currencyScale(code string) (int, error) {
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return 0, fmt.Errorf("unknown currency %q", code)
+	}
+	scale, _ := currency.Standard.Rounding(unit)
+	return scale, nil
+}
+
+// IsZero reports whether the amount is zero.
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// IsNegative reports whether the amount is below zero.
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// Add returns m plus other.
+func (m Money) Add(other Money) (Money, error) {
+	if !m.sameCurrency(other) {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.currency(other)}, nil
+}
+
+// Sub returns m minus other.
+func (m Money) Sub(other Money) (Money, error) {
+	return m.Add(other.Negate())
+}
+
+// Negate returns the amount with the opposite sign.
+func (m Money) Negate() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Multiply returns m times n, e.g. a unit price times a quantity.
+func (m Money) Multiply(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Percent returns percent percent of m, e.g. 19 for VAT, rounded half
+// away from zero to the minor unit.
+func (m Money) Percent(percent int64) Money {
+	scaled := m.Amount * percent
+	rounded := scaled / 100
+	if remainder := scaled % 100; remainder >= 50 {
+		rounded++
+	} else if remainder <= -50 {
+		rounded--
+	}
+	return Money{Amount: rounded, Currency: m.Currency}
+}
+
+// Allocate splits m by ratios without losing a minor unit, the
+// remainder going to the first parts. Splitting 10.00 in three gives
+// 3.34, 3.33 and 3.33.
+func (m Money) Allocate(ratios ...int64) []Money {
+	var total int64
+	for _, ratio := range ratios {
+		total += ratio
+	}
+	parts := make([]Money, len(ratios))
+	if total <= 0 {
+		for i := range parts {
+			parts[i] = Money{Currency: m.Currency}
+		}
+		return parts
+	}
+	remainder := m.Amount
+	for i, ratio := range ratios {
+		parts[i] = Money{Amount: m.Amount * ratio / total, Currency: m.Currency}
+		remainder -= parts[i].Amount
+	}
+	step := int64(1)
+	if remainder < 0 {
+		step = -1
+	}
+	for i := 0; remainder != 0; i = (i + 1) % len(parts) {
+		if ratios[i] > 0 {
+			parts[i].Amount += step
+			remainder -= step
+		}
+	}
+	return parts
+}
+
+// Cmp compares m to other, -1, 0 or +1.
+func (m Money) Cmp(other Money) (int, error) {
+	if !m.sameCurrency(other) {
+		return 0, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	switch {
+	case m.Amount < other.Amount:
+		return -1, nil
+	case m.Amount > other.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// sameCurrency reports whether m and other can be combined; zero
+// values without a currency combine with any.
+func (m Money) sameCurrency(other Money) bool {
+	return m.Currency == "" || other.Currency == "" || strings.EqualFold(m.Currency, other.Currency)
+}
+
+func (m Money) currency(other Money) string {
+	if m.Currency == "" {
+		return other.Currency
+	}
+	return m.Currency
+}
+
+// SumMoney adds amounts, all of one currency.
+func SumMoney(amounts ...Money) (Money, error) {
+	var sum Money
+	for _, amount := range amounts {
+		var err error
+		if sum, err = sum.Add(amount); err != nil {
+			return Money{}, err
+		}
+	}
+	return sum, nil
+}
+
+// Decimal returns the amount in major units, like "-12.30".
+func (m Money) Decimal() string {
+	scale, err := currencyScale(m.Currency)
+	if err != nil {
+		scale = 2
+	}
+	whole, fraction := m.split(scale)
+	sign := ""
+	if m.Amount < 0 {
+		sign = "-"
+	}
+	if scale == 0 {
+		return sign + strconv.FormatUint(whole, 10)
+	}
+	return sign + strconv.FormatUint(whole, 10) + "." + fraction
+}
+
+// split returns the major units and the zero padded minor digits of
+// the absolute amount.
+func (m Money) split(scale int) (uint64, string) {
+	abs := uint64(m.Amount)
+	if m.Amount < 0 {
+		abs = uint64(-m.Amount)
+	}
+	if scale == 0 {
+		return abs, ""
+	}
+	divisor := uint64(1)
+	for i := 0; i < scale; i++ {
+		divisor *= 10
+	}
+	fraction := strconv.FormatUint(abs%divisor, 10)
+	return abs / divisor, strings.Repeat("0", scale-len(fraction)) + fraction
+}
+
+// String returns the amount and its currency, like "12.30 USD".
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// moneySymbolAfter are the languages writing the currency symbol
+// after the amount.
+var moneySymbolAfter = map[string]bool{
+	"cs": true, "da": true, "de": true, "es": true, "fi": true, "fr": true,
+	"hu": true, "it": true, "nb": true, "pl": true, "pt": true, "ru": true,
+	"sk": true, "sv": true, "uk": true, "vi": true,
+}
+
+// Format formats the amount for locale, a BCP 47 tag like "de-DE",
+// with its digit grouping, decimal separator and currency symbol.
+// Unknown locales format like English.
+func (m Money) Format(locale string) string {
+	tag := language.Make(locale)
+	printer := message.NewPrinter(tag)
+	scale, err := currencyScale(m.Currency)
+	if err != nil {
+		return m.String()
+	}
+	unit, _ := currency.ParseISO(m.Currency)
+	symbol := printer.Sprint(currency.Symbol(unit))
+	whole, fraction := m.split(scale)
+	formatted := printer.Sprint(number.Decimal(whole))
+	if scale > 0 {
+		// the separator the locale puts in 1.5
+		separator := strings.Trim(printer.Sprint(number.Decimal(1.5, number.Scale(1))), "15")
+		formatted += separator + fraction
+	}
+	sign := ""
+	if m.Amount < 0 {
+		sign = "-"
+	}
+	base, _ := tag.Base()
+	if moneySymbolAfter[base.String()] {
+		return sign + formatted + " " + symbol
+	}
+	return sign + symbol + formatted
+}
+
+// MoneyFuncMap returns the template helper formatting Money, in the
+// given locale or English.
+//
+// Example:
+//  r.SetFuncMap(ghostutils.MoneyFuncMap())
+//
+//  {{money .Total}}
+//  {{money .Total .Layout.Preferences.Locale}}
+func MoneyFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"money": func(m Money, locale ...string) string {
+			if len(locale) > 0 && locale[0] != "" {
+				return m.Format(locale[0])
+			}
+			return m.Format("en")
+		},
+	}
+}
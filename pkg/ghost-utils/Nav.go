@@ -0,0 +1,231 @@
+package ghostutils
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NavItem is the place of a route in the navigation tree.
+type NavItem struct {
+	// Name identifies the item, Parent names the item it sits under.
+	Name   string
+	Parent string
+	Title  string
+	// TitleFunc, if set, titles the item for a request, e.g. with the
+	// name of the record a route shows.
+	TitleFunc func(c *gin.Context) string
+	// Path is the route pattern, e.g. "/posts/:id".
+	Path string
+	// Hidden items only appear in breadcrumbs.
+	Hidden bool
+}
+
+// NavNode is a NavItem resolved for a request.
+type NavNode struct {
+	Name  string
+	Title string
+	URL   string
+	// Current is set on the item of the requested route, Active on it
+	// and its ancestors.
+	Current  bool
+	Active   bool
+	Children []NavNode
+}
+
+// Nav is a registry of routes and their place in the navigation, from
+// which every page gets its menu and breadcrumbs. Routes declare their
+// item where they are registered, so the navigation follows them when
+// they move.
+//
+// Example:
+//  nav := ghostutils.NewNav()
+//  posts := r.Group("/posts")
+//  nav.GET(posts, "", ghostutils.NavItem{Name: "posts", Title: "Posts"}, listPosts)
+//  nav.GET(posts, "/:id", ghostutils.NavItem{Name: "post", Parent: "posts", Hidden: true,
+//      TitleFunc: func(c *gin.Context) string { return postTitle(c) }}, showPost)
+//  nav.Provide(layout)
+//
+//  // layout.html: {{range .Layout.Nav}}<a href="{{.URL}}"{{if .Active}} class="active"{{end}}>{{.Title}}</a>{{end}}
+type Nav struct {
+	mu    sync.RWMutex
+	items []NavItem
+}
+
+// NewNav returns an empty Nav.
+func NewNav() *Nav {
+	return &Nav{}
+}
+
+// Add registers item. Items may be added before their parent.
+func (n *Nav) Add(item NavItem) *Nav {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.items = append(n.items, item)
+	return n
+}
+
+// GET registers a GET route on g and its nav item, whose Path is set
+// to the full route path.
+func (n *Nav) GET(g *gin.RouterGroup, relativePath string, item NavItem, handlers ...gin.HandlerFunc) gin.IRoutes {
+	item.Path = joinRoutePath(g.BasePath(), relativePath)
+	n.Add(item)
+	return g.GET(relativePath, handlers...)
+}
+
+func joinRoutePath(base, relative string) string {
+	if relative == "" {
+		return base
+	}
+	joined := path.Join(base, relative)
+	if strings.HasSuffix(relative, "/") && !strings.HasSuffix(joined, "/") {
+		joined += "/"
+	}
+	return joined
+}
+
+// Provide adds the "Nav" tree and the "Breadcrumbs" of the request to
+// the layout data.
+func (n *Nav) Provide(layout *Layout) *Layout {
+	return layout.
+		Provide("Nav", func(c *gin.Context) (interface{}, error) { return n.Tree(c), nil }).
+		Provide("Breadcrumbs", func(c *gin.Context) (interface{}, error) { return n.Breadcrumbs(c), nil })
+}
+
+// current returns the name of the item of the requested route and the
+// names of its ancestors.
+func (n *Nav) current(c *gin.Context) (string, map[string]bool) {
+	route := c.FullPath()
+	current := ""
+	for _, item := range n.items {
+		if item.Path != "" && item.Path == route {
+			current = item.Name
+			break
+		}
+	}
+	byName := n.byName()
+	active := map[string]bool{}
+	for name := current; name != "" && !active[name]; name = byName[name].Parent {
+		active[name] = true
+	}
+	return current, active
+}
+
+func (n *Nav) byName() map[string]NavItem {
+	byName := make(map[string]NavItem, len(n.items))
+	for _, item := range n.items {
+		byName[item.Name] = item
+	}
+	return byName
+}
+
+func (n *Nav) node(c *gin.Context, item NavItem, current string, active map[string]bool) (NavNode, bool) {
+	url, ok := navURL(item.Path, c.Params)
+	title := item.Title
+	if item.TitleFunc != nil {
+		title = item.TitleFunc(c)
+	}
+	return NavNode{Name: item.Name, Title: title, URL: url, Current: item.Name == current, Active: active[item.Name]}, ok
+}
+
+// navURL fills the parameters of pattern from params. ok is false if
+// one of them is missing.
+func navURL(pattern string, params gin.Params) (string, bool) {
+	if pattern == "" {
+		return "", true
+	}
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if segment == "" || (segment[0] != ':' && segment[0] != '*') {
+			continue
+		}
+		value, ok := params.Get(segment[1:])
+		if !ok {
+			return "", false
+		}
+		segments[i] = strings.TrimPrefix(value, "/")
+	}
+	return strings.Join(segments, "/"), true
+}
+
+// Tree returns the visible items for the request, nested under their
+// parents. Items whose URL needs a parameter the request does not
+// have are left out.
+func (n *Nav) Tree(c *gin.Context) []NavNode {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	current, active := n.current(c)
+	byName := n.byName()
+	children := map[string][]NavItem{}
+	for _, item := range n.items {
+		parent := item.Parent
+		if _, ok := byName[parent]; !ok {
+			parent = ""
+		}
+		children[parent] = append(children[parent], item)
+	}
+	var build func(parent string, depth int) []NavNode
+	build = func(parent string, depth int) []NavNode {
+		if depth > len(n.items) {
+			// a cycle in the parents
+			return nil
+		}
+		var nodes []NavNode
+		for _, item := range children[parent] {
+			if item.Hidden {
+				continue
+			}
+			node, ok := n.node(c, item, current, active)
+			if !ok {
+				continue
+			}
+			node.Children = build(item.Name, depth+1)
+			nodes = append(nodes, node)
+		}
+		return nodes
+	}
+	return build("", 0)
+}
+
+// Breadcrumbs returns the item of the requested route and its
+// ancestors, outermost first, empty if the route has no item.
+func (n *Nav) Breadcrumbs(c *gin.Context) []NavNode {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	current, active := n.current(c)
+	byName := n.byName()
+	var crumbs []NavNode
+	seen := map[string]bool{}
+	for name := current; name != "" && !seen[name]; name = byName[name].Parent {
+		seen[name] = true
+		item, ok := byName[name]
+		if !ok {
+			break
+		}
+		node, _ := n.node(c, item, current, active)
+		crumbs = append([]NavNode{node}, crumbs...)
+	}
+	return crumbs
+}
+
+// URL returns the URL of the item name with params filled in, for
+// links built outside the tree.
+//
+// Example:
+//  url, err := nav.URL("post", gin.Params{{Key: "id", Value: post.ID}})
+func (n *Nav) URL(name string, params gin.Params) (string, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	item, ok := n.byName()[name]
+	if !ok {
+		return "", fmt.Errorf("nav item %q is not registered", name)
+	}
+	url, ok := navURL(item.Path, params)
+	if !ok {
+		return "", fmt.Errorf("nav item %q needs parameters of %s", name, item.Path)
+	}
+	return url, nil
+}
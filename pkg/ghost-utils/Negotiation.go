@@ -0,0 +1,108 @@
+package ghostutils
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gin-gonic/gin/render"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Media types understood by Negotiate and BindBody.
+const (
+	MIMEProtobuf = binding.MIMEPROTOBUF
+	MIMEMsgPack  = binding.MIMEMSGPACK2
+	MIMECBOR     = "application/cbor"
+)
+
+var cborHandle = &codec.CborHandle{}
+
+// ErrNotProtoMessage is returned when a protobuf body is bound to, or
+// requested for, a value that is not a proto.Message.
+var ErrNotProtoMessage = errors.New("value is not a proto.Message")
+
+// Negotiate renders data in the format requested by the Accept
+// header: JSON, MessagePack or CBOR. Protobuf is also offered when
+// data is a proto.Message, and such messages are rendered with
+// protojson when JSON is chosen.
+//
+// Example:
+//  r.GET("/users/:id", func(c *gin.Context) {
+//      user := &pb.User{Id: c.Param("id")}
+//      ghostutils.Negotiate(c, http.StatusOK, user)
+//  })
+func Negotiate(c *gin.Context, code int, data interface{}) {
+	msg, isProto := data.(proto.Message)
+	offered := []string{gin.MIMEJSON, MIMEMsgPack, binding.MIMEMSGPACK, MIMECBOR}
+	if isProto {
+		offered = append(offered, MIMEProtobuf)
+	}
+	switch c.NegotiateFormat(offered...) {
+	case MIMEProtobuf:
+		c.ProtoBuf(code, msg)
+	case MIMEMsgPack, binding.MIMEMSGPACK:
+		c.Render(code, render.MsgPack{Data: data})
+	case MIMECBOR:
+		c.Render(code, cborRender{data: data})
+	default:
+		if isProto {
+			body, err := protojson.Marshal(msg)
+			if err != nil {
+				Fail(c, err)
+				return
+			}
+			c.Data(code, gin.MIMEJSON, body)
+			return
+		}
+		c.JSON(code, data)
+	}
+}
+
+// BindBody binds the request body into obj according to its
+// Content-Type. Protobuf bodies require obj to be a proto.Message;
+// JSON bodies bound into a proto.Message use protojson. MessagePack
+// and CBOR bodies are decoded and validated like JSON.
+func BindBody(c *gin.Context, obj interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	msg, isProto := obj.(proto.Message)
+	switch {
+	case mediaType == MIMEProtobuf:
+		if !isProto {
+			return ErrNotProtoMessage
+		}
+		return c.ShouldBindWith(obj, binding.ProtoBuf)
+	case isProto && (mediaType == gin.MIMEJSON || mediaType == ""):
+		body, err := c.GetRawData()
+		if err != nil {
+			return err
+		}
+		return protojson.Unmarshal(body, msg)
+	case mediaType == MIMEMsgPack || mediaType == binding.MIMEMSGPACK:
+		return c.ShouldBindWith(obj, binding.MsgPack)
+	case mediaType == MIMECBOR:
+		if err := codec.NewDecoder(c.Request.Body, cborHandle).Decode(obj); err != nil {
+			return err
+		}
+		return binding.Validator.ValidateStruct(obj)
+	}
+	return c.ShouldBind(obj)
+}
+
+// cborRender renders data as CBOR.
+type cborRender struct {
+	data interface{}
+}
+
+func (r cborRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	return codec.NewEncoder(w, cborHandle).Encode(r.data)
+}
+
+func (r cborRender) WriteContentType(w http.ResponseWriter) {
+	w.Header()["Content-Type"] = []string{MIMECBOR}
+}
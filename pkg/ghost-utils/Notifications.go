@@ -0,0 +1,489 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// Notification channels understood by the Notifier.
+const (
+	ChannelSMS  = "sms"
+	ChannelPush = "push"
+)
+
+// NotificationJob is the job type of the notifications a Notifier
+// sends through a JobQueue.
+const NotificationJob = "notification"
+
+var (
+	// ErrNoProvider is returned when a notification is sent on a
+	// channel that has no configured provider.
+	ErrNoProvider = errors.New("no notification provider configured")
+	// ErrNotificationRejected is wrapped by the errors of providers
+	// answering a 4xx other than 408 and 429: sending the
+	// notification again fails the same way, so it is not retried.
+	ErrNotificationRejected = errors.New("notification rejected")
+	// ErrPushGone is wrapped by the error of a push to a subscription
+	// that expired or was revoked, answered 404 or 410. The Notifier
+	// deletes it from its Subscriptions.
+	ErrPushGone = fmt.Errorf("push subscription is gone: %w", ErrNotificationRejected)
+)
+
+// NotificationConfig is the `notifications:` block of ghost.yaml.
+//
+// Example:
+//  notifications:
+//    retries: 3
+//    templates:
+//      otp: "Your {{.App}} code is {{.Code}}"
+//    sms:
+//      provider: twilio
+//      from: "+15550000000"
+//      account-sid: AC123
+//      auth-token: secret
+//    push:
+//      provider: webpush
+//      subscriber: mailto:ops@example.com
+//      vapid-public-key: BP...
+//      vapid-private-key: 3K...
+type NotificationConfig struct {
+	Retries    int               `yaml:"retries"`
+	RetryDelay time.Duration     `yaml:"retry-delay"`
+	Templates  map[string]string `yaml:"templates"`
+	SMS        struct {
+		Provider   string `yaml:"provider"`
+		From       string `yaml:"from"`
+		AccountSID string `yaml:"account-sid"`
+		AuthToken  string `yaml:"auth-token"`
+		BaseURL    string `yaml:"base-url"`
+	} `yaml:"sms"`
+	Push struct {
+		Provider        string `yaml:"provider"`
+		Subscriber      string `yaml:"subscriber"`
+		VAPIDPublicKey  string `yaml:"vapid-public-key"`
+		VAPIDPrivateKey string `yaml:"vapid-private-key"`
+		TTL             int    `yaml:"ttl"`
+	} `yaml:"push"`
+}
+
+// PushSubscription is the subscription object produced by the
+// browser's PushManager.subscribe().
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		Auth   string `json:"auth"`
+		P256dh string `json:"p256dh"`
+	} `json:"keys"`
+}
+
+// Notification is a single message to deliver. Body is used as is
+// when Template is empty, otherwise the named template is executed
+// with Data.
+type Notification struct {
+	Channel      string            `json:"channel"`
+	To           string            `json:"to,omitempty"`
+	Subscription *PushSubscription `json:"subscription,omitempty"`
+	Title        string            `json:"title,omitempty"`
+	Template     string            `json:"template,omitempty"`
+	Body         string            `json:"body,omitempty"`
+	Data         interface{}       `json:"data,omitempty"`
+}
+
+// SMSProvider delivers text messages.
+type SMSProvider interface {
+	SendSMS(ctx context.Context, to string, body string) error
+}
+
+// PushProvider delivers push messages to a browser subscription.
+type PushProvider interface {
+	SendPush(ctx context.Context, sub PushSubscription, payload []byte) error
+}
+
+// NotificationQueue hands notifications to a background queue.
+// When a Notifier has a Queue, Send enqueues and the queue worker
+// is expected to call Deliver. A JobQueue is one, running the
+// NotificationJob of the Notifier's Register.
+type NotificationQueue interface {
+	EnqueueNotification(ctx context.Context, n Notification) error
+}
+
+// EnqueueNotification implements NotificationQueue, enqueueing n as
+// a NotificationJob.
+func (q *JobQueue) EnqueueNotification(ctx context.Context, n Notification) error {
+	_, err := q.Enqueue(ctx, NotificationJob, n)
+	return err
+}
+
+// PushSubscriptionStore holds the push subscriptions a Notifier
+// deletes once their push service answers they are gone.
+type PushSubscriptionStore interface {
+	DeletePushSubscription(ctx context.Context, endpoint string) error
+}
+
+// Notifier renders and delivers notifications through the
+// configured providers.
+//
+// Example:
+//  notifier.Queue = jobs
+//  notifier.Subscriptions = ghostutils.SurrealPushSubscriptions{DB: db}
+//  notifier.Register()
+type Notifier struct {
+	SMS  SMSProvider
+	Push PushProvider
+	// Queue, if set, takes the notifications of Send, which are
+	// then retried by the queue rather than by Retries.
+	Queue NotificationQueue
+	// Subscriptions, if set, loses the push subscriptions that are
+	// gone, see ErrPushGone.
+	Subscriptions PushSubscriptionStore
+	Retries       int
+	RetryDelay    time.Duration
+	templates     *template.Template
+}
+
+// Notifier builds a Notifier from the notifications block of the
+// config, selecting providers by name.
+//
+// Example:
+//  notifier, err := ghostConfig.Notifier()
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  err = notifier.Send(ctx, ghostutils.Notification{
+//      Channel:  ghostutils.ChannelSMS,
+//      To:       user.Phone,
+//      Template: "otp",
+//      Data:     gin.H{"Code": code},
+//  })
+//
+// Returns:
+//  *Notifier
+//  error if a provider or template is invalid
+func (ghostConfig GhostConfig) Notifier() (*Notifier, error) {
+	cfg := ghostConfig.Notifications
+	n := &Notifier{Retries: cfg.Retries, RetryDelay: cfg.RetryDelay}
+	for name, text := range cfg.Templates {
+		if err := n.AddTemplate(name, text); err != nil {
+			return nil, err
+		}
+	}
+	switch cfg.SMS.Provider {
+	case "":
+	case "twilio":
+		n.SMS = TwilioSMS{
+			AccountSID: cfg.SMS.AccountSID,
+			AuthToken:  cfg.SMS.AuthToken,
+			From:       cfg.SMS.From,
+			BaseURL:    cfg.SMS.BaseURL,
+		}
+	default:
+		return nil, fmt.Errorf("unknown sms provider %q", cfg.SMS.Provider)
+	}
+	switch cfg.Push.Provider {
+	case "":
+	case "webpush":
+		n.Push = WebPush{
+			Subscriber:      cfg.Push.Subscriber,
+			VAPIDPublicKey:  cfg.Push.VAPIDPublicKey,
+			VAPIDPrivateKey: cfg.Push.VAPIDPrivateKey,
+			TTL:             cfg.Push.TTL,
+		}
+	default:
+		return nil, fmt.Errorf("unknown push provider %q", cfg.Push.Provider)
+	}
+	return n, nil
+}
+
+// AddTemplate registers a named message template.
+func (n *Notifier) AddTemplate(name, text string) error {
+	if n.templates == nil {
+		n.templates = template.New("notifications")
+	}
+	_, err := n.templates.New(name).Parse(text)
+	return err
+}
+
+// Send delivers n, or enqueues it when the Notifier has a Queue.
+func (n *Notifier) Send(ctx context.Context, notification Notification) error {
+	if n.Queue != nil {
+		return n.Queue.EnqueueNotification(ctx, notification)
+	}
+	return n.Deliver(ctx, notification)
+}
+
+// Register registers the NotificationJob delivering the
+// notifications a JobQueue Queue took. Each run sends once, leaving
+// the retries to the queue; notifications that cannot be sent, such
+// as those rejected by their provider, are dead at once.
+func (n *Notifier) Register() {
+	RegisterJob(NotificationJob, func(ctx context.Context, notification Notification) error {
+		send, err := n.prepare(notification)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrJobPermanent, err)
+		}
+		if err := n.send(ctx, notification, send); err != nil {
+			if errors.Is(err, ErrNotificationRejected) {
+				return fmt.Errorf("%w: %w", ErrJobPermanent, err)
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// Deliver renders the notification and sends it immediately,
+// retrying with exponential backoff on failure. Notifications their
+// provider rejected are not retried.
+func (n *Notifier) Deliver(ctx context.Context, notification Notification) error {
+	send, err := n.prepare(notification)
+	if err != nil {
+		return err
+	}
+	delay := n.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		err = n.send(ctx, notification, send)
+		if err == nil || attempt >= n.Retries || errors.Is(err, ErrNotificationRejected) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay << attempt):
+		}
+	}
+}
+
+// prepare renders notification and returns its sender.
+func (n *Notifier) prepare(notification Notification) (func(context.Context) error, error) {
+	body, err := n.render(notification)
+	if err != nil {
+		return nil, err
+	}
+	return n.sender(notification, body)
+}
+
+// send sends notification once, deleting its push subscription when
+// it is gone.
+func (n *Notifier) send(ctx context.Context, notification Notification, send func(context.Context) error) error {
+	err := send(ctx)
+	if errors.Is(err, ErrPushGone) && n.Subscriptions != nil && notification.Subscription != nil {
+		if deleteErr := n.Subscriptions.DeletePushSubscription(ctx, notification.Subscription.Endpoint); deleteErr != nil {
+			return fmt.Errorf("%w (deleting the subscription: %v)", err, deleteErr)
+		}
+	}
+	return err
+}
+
+func (n *Notifier) render(notification Notification) (string, error) {
+	if notification.Template == "" {
+		return notification.Body, nil
+	}
+	if n.templates == nil || n.templates.Lookup(notification.Template) == nil {
+		return "", fmt.Errorf("notification template %q not found", notification.Template)
+	}
+	var buf bytes.Buffer
+	if err := n.templates.ExecuteTemplate(&buf, notification.Template, notification.Data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (n *Notifier) sender(notification Notification, body string) (func(context.Context) error, error) {
+	switch notification.Channel {
+	case ChannelSMS:
+		if n.SMS == nil {
+			return nil, ErrNoProvider
+		}
+		return func(ctx context.Context) error {
+			return n.SMS.SendSMS(ctx, notification.To, body)
+		}, nil
+	case ChannelPush:
+		if n.Push == nil {
+			return nil, ErrNoProvider
+		}
+		if notification.Subscription == nil {
+			return nil, errors.New("push notification has no subscription")
+		}
+		payload, err := json.Marshal(map[string]interface{}{
+			"title": notification.Title,
+			"body":  body,
+			"data":  notification.Data,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			return n.Push.SendPush(ctx, *notification.Subscription, payload)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown notification channel %q", notification.Channel)
+}
+
+// TwilioSMS sends text messages through the Twilio Messages API,
+// or any API compatible with it when BaseURL is set.
+type TwilioSMS struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+	BaseURL    string
+	Client     *http.Client
+}
+
+// SendSMS implements SMSProvider.
+func (t TwilioSMS) SendSMS(ctx context.Context, to string, body string) error {
+	base := t.BaseURL
+	if base == "" {
+		base = "https://api.twilio.com"
+	}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", strings.TrimRight(base, "/"), t.AccountSID)
+	form := url.Values{"To": {to}, "From": {t.From}, "Body": {body}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if notificationRejected(resp.StatusCode) {
+			return fmt.Errorf("twilio: %s: %s: %w", resp.Status, msg, ErrNotificationRejected)
+		}
+		return fmt.Errorf("twilio: %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// notificationRejected reports whether a provider answering status
+// refused the notification for good.
+func notificationRejected(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// WebPush sends encrypted Web Push messages signed with VAPID keys.
+type WebPush struct {
+	Subscriber      string
+	VAPIDPublicKey  string
+	VAPIDPrivateKey string
+	TTL             int
+}
+
+// SendPush implements PushProvider.
+func (w WebPush) SendPush(ctx context.Context, sub PushSubscription, payload []byte) error {
+	ttl := w.TTL
+	if ttl == 0 {
+		ttl = 60 * 60 * 24
+	}
+	resp, err := webpush.SendNotificationWithContext(ctx, payload, &webpush.Subscription{
+		Endpoint: sub.Endpoint,
+		Keys:     webpush.Keys{Auth: sub.Keys.Auth, P256dh: sub.Keys.P256dh},
+	}, &webpush.Options{
+		Subscriber:      w.Subscriber,
+		VAPIDPublicKey:  w.VAPIDPublicKey,
+		VAPIDPrivateKey: w.VAPIDPrivateKey,
+		TTL:             ttl,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("webpush: %s: %w", resp.Status, ErrPushGone)
+	case notificationRejected(resp.StatusCode):
+		return fmt.Errorf("webpush: %s: %w", resp.Status, ErrNotificationRejected)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("webpush: %s", resp.Status)
+	}
+	return nil
+}
+
+// SurrealPushSubscriptions keeps push subscriptions in a SurrealDB
+// table, "push_subscription" by default, one record per endpoint.
+//
+// Example:
+//  subscriptions := ghostutils.SurrealPushSubscriptions{DB: db}
+//  err := subscriptions.SavePushSubscription(c, identity.ID, sub)
+type SurrealPushSubscriptions struct {
+	DB    GhostDB
+	Table string
+}
+
+type pushSubscriptionRecord struct {
+	Owner string `json:"owner"`
+	PushSubscription
+}
+
+func (s SurrealPushSubscriptions) table() string {
+	if s.Table == "" {
+		return "push_subscription"
+	}
+	return s.Table
+}
+
+// pushSubscriptionID is the record id of the subscription of
+// endpoint.
+func pushSubscriptionID(endpoint string) string {
+	sum := sha256.Sum256([]byte(endpoint))
+	return hex.EncodeToString(sum[:16])
+}
+
+// SavePushSubscription stores sub for owner, replacing the
+// subscription of the same endpoint.
+func (s SurrealPushSubscriptions) SavePushSubscription(ctx context.Context, owner string, sub PushSubscription) error {
+	_, err := surrealQuery[pushSubscriptionRecord](WithContext(ctx, s.DB), "UPDATE type::thing($tb, $id) CONTENT $data", map[string]interface{}{
+		"tb":   s.table(),
+		"id":   pushSubscriptionID(sub.Endpoint),
+		"data": pushSubscriptionRecord{Owner: owner, PushSubscription: sub},
+	})
+	return err
+}
+
+// PushSubscriptions returns the subscriptions of owner.
+func (s SurrealPushSubscriptions) PushSubscriptions(ctx context.Context, owner string) ([]PushSubscription, error) {
+	records, err := surrealQuery[pushSubscriptionRecord](WithContext(ctx, s.DB), "SELECT * FROM type::table($tb) WHERE owner = $owner", map[string]interface{}{
+		"tb":    s.table(),
+		"owner": owner,
+	})
+	if err != nil {
+		return nil, err
+	}
+	subs := make([]PushSubscription, len(records))
+	for i, record := range records {
+		subs[i] = record.PushSubscription
+	}
+	return subs, nil
+}
+
+// DeletePushSubscription implements PushSubscriptionStore.
+func (s SurrealPushSubscriptions) DeletePushSubscription(ctx context.Context, endpoint string) error {
+	_, err := surrealQuery[pushSubscriptionRecord](WithContext(ctx, s.DB), "DELETE type::thing($tb, $id)", map[string]interface{}{
+		"tb": s.table(),
+		"id": pushSubscriptionID(endpoint),
+	})
+	return err
+}
@@ -0,0 +1,426 @@
+package ghostutils
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Operation describes one endpoint of a route for the OpenAPI
+// document. Request and Response are values of the body types, such
+// as User{} or []User{}; nil for none.
+type Operation struct {
+	Method string
+	// Path is relative to the route, in gin syntax like /:id.
+	Path        string
+	Summary     string
+	Description string
+	Tags        []string
+	Params      []OperationParam
+	Request     interface{}
+	Response    interface{}
+	// Status is the status of a successful response, 200 by default.
+	Status int
+	// Example is an example Response, served by the mock of the
+	// document; see OpenAPI.Mock.
+	Example interface{}
+	// Deprecated marks the endpoint deprecated.
+	Deprecated bool
+	// ID is the operationId, and the method name of the generated
+	// clients; see OpenAPI.GoClient. It is derived from the method and
+	// path when empty.
+	ID string
+	// Envelope marks a Response sent through OK or Created, as the data
+	// of an Envelope.
+	Envelope bool
+}
+
+// OperationParam is a query or header parameter of an Operation. Path
+// parameters are found in the path.
+type OperationParam struct {
+	Name string
+	// In is query or header.
+	In          string
+	Description string
+	// Type is string, integer, number or boolean.
+	Type     string
+	Required bool
+}
+
+// DocumentedRoute is implemented by GhostRoutes that describe their
+// endpoints, such as BasicRoute with Document and CRUDRoute.
+type DocumentedRoute interface {
+	GhostRoute
+	// Operations returns the endpoints with paths that include the
+	// path of the route.
+	Operations() []Operation
+}
+
+// OpenAPI builds an OpenAPI 3 document from DocumentedRoutes.
+//
+// Example:
+//  api := ghostutils.NewOpenAPI("Blog API", "1.0.0")
+//  api.Add("/api", users, posts)
+//  api.Mount(r.Group("/"))   // GET /openapi.json and the /docs page
+type OpenAPI struct {
+	Title       string
+	Version     string
+	Description string
+	// Bearer documents a bearer token on every operation.
+	Bearer bool
+	// APIKeyHeader documents an API key sent in this header on every
+	// operation, see APIGateway.
+	APIKeyHeader string
+	operations   []Operation
+	schemas      map[string]interface{}
+	names        map[reflect.Type]string
+}
+
+// NewOpenAPI returns an empty document.
+func NewOpenAPI(title, version string) *OpenAPI {
+	return &OpenAPI{Title: title, Version: version}
+}
+
+// Add documents routes mounted under prefix. Routes that do not
+// describe their endpoints are skipped.
+func (api *OpenAPI) Add(prefix string, routes ...GhostRoute) *OpenAPI {
+	for _, route := range routes {
+		documented, ok := route.(DocumentedRoute)
+		if !ok {
+			continue
+		}
+		for _, op := range documented.Operations() {
+			op.Path = joinRoutePath(prefix, op.Path)
+			api.operations = append(api.operations, op)
+		}
+	}
+	return api
+}
+
+// AddOperations documents endpoints registered outside of a
+// GhostRoute, with full paths.
+func (api *OpenAPI) AddOperations(ops ...Operation) *OpenAPI {
+	api.operations = append(api.operations, ops...)
+	return api
+}
+
+var ginParamPattern = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+
+// Document returns the OpenAPI document.
+func (api *OpenAPI) Document() map[string]interface{} {
+	api.schemas = map[string]interface{}{}
+	api.names = map[reflect.Type]string{}
+	paths := map[string]map[string]interface{}{}
+	for _, op := range api.operations {
+		path := ginParamPattern.ReplaceAllString(op.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(op.Method)] = api.operation(op)
+	}
+	info := map[string]interface{}{"title": api.Title, "version": api.Version}
+	if api.Description != "" {
+		info["description"] = api.Description
+	}
+	components := map[string]interface{}{"schemas": api.schemas}
+	doc := map[string]interface{}{
+		"openapi":    "3.0.3",
+		"info":       info,
+		"paths":      paths,
+		"components": components,
+	}
+	schemes := map[string]interface{}{}
+	var security []interface{}
+	if api.Bearer {
+		schemes["bearerAuth"] = map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+		security = append(security, map[string]interface{}{"bearerAuth": []string{}})
+	}
+	if api.APIKeyHeader != "" {
+		schemes["apiKey"] = map[string]interface{}{"type": "apiKey", "in": "header", "name": api.APIKeyHeader}
+		security = append(security, map[string]interface{}{"apiKey": []string{}})
+	}
+	if len(schemes) > 0 {
+		components["securitySchemes"] = schemes
+		doc["security"] = security
+	}
+	return doc
+}
+
+func (api *OpenAPI) operation(op Operation) map[string]interface{} {
+	out := map[string]interface{}{}
+	if op.ID != "" {
+		out["operationId"] = op.ID
+	}
+	if op.Summary != "" {
+		out["summary"] = op.Summary
+	}
+	if op.Description != "" {
+		out["description"] = op.Description
+	}
+	if len(op.Tags) > 0 {
+		out["tags"] = op.Tags
+	}
+	if op.Deprecated {
+		out["deprecated"] = true
+	}
+	var params []interface{}
+	for _, match := range ginParamPattern.FindAllStringSubmatch(op.Path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, param := range op.Params {
+		typ := param.Type
+		if typ == "" {
+			typ = "string"
+		}
+		in := param.In
+		if in == "" {
+			in = "query"
+		}
+		p := map[string]interface{}{"name": param.Name, "in": in, "schema": map[string]interface{}{"type": typ}}
+		if param.Description != "" {
+			p["description"] = param.Description
+		}
+		if param.Required {
+			p["required"] = true
+		}
+		params = append(params, p)
+	}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+	if op.Request != nil {
+		out["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{gin.MIMEJSON: map[string]interface{}{"schema": api.schema(reflect.TypeOf(op.Request))}},
+		}
+	}
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := map[string]interface{}{"description": http.StatusText(status)}
+	if op.Response != nil {
+		schema, example := api.schema(reflect.TypeOf(op.Response)), op.Example
+		if op.Envelope {
+			schema = map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"data": schema, "meta": map[string]interface{}{}},
+				"required":   []string{"data"},
+			}
+			if example != nil {
+				example = Envelope{Data: example}
+			}
+		}
+		media := map[string]interface{}{"schema": schema}
+		if example != nil {
+			media["example"] = example
+		}
+		response["content"] = map[string]interface{}{gin.MIMEJSON: media}
+	}
+	out["responses"] = map[string]interface{}{strconv.Itoa(status): response}
+	return out
+}
+
+// schema returns the schema of t, a reference for named structs which
+// are added to the components once.
+func (api *OpenAPI) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name, ok := api.names[t]
+		if !ok {
+			name = schemaName(t)
+			api.names[t] = name
+			// reserved before building so recursive types terminate
+			api.schemas[name] = nil
+			api.schemas[name] = api.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": api.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": api.schema(t.Elem())}
+	case reflect.Struct:
+		return api.structSchema(t)
+	}
+	return map[string]interface{}{}
+}
+
+func (api *OpenAPI) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	api.structFields(t, properties, &required)
+	out := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		out["required"] = required
+	}
+	return out
+}
+
+func (api *OpenAPI) structFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				api.structFields(embedded, properties, required)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema := api.schema(field.Type)
+		rules := strings.Split(field.Tag.Get("binding"), ",")
+		if _, isRef := schema["$ref"]; !isRef {
+			applyBindingRules(schema, field.Type, rules)
+		}
+		if containsString(rules, "required") {
+			*required = append(*required, name)
+		}
+		properties[name] = schema
+	}
+}
+
+// applyBindingRules documents the validation tags OpenAPI can express.
+func applyBindingRules(schema map[string]interface{}, t reflect.Type, rules []string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for _, rule := range rules {
+		key, param := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			key, param = rule[:i], rule[i+1:]
+		}
+		switch key {
+		case "email":
+			schema["format"] = "email"
+		case "url":
+			schema["format"] = "uri"
+		case "uuid":
+			schema["format"] = "uuid"
+		case "oneof":
+			schema["enum"] = strings.Fields(param)
+		case "min", "max", "gte", "lte", "len":
+			n, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				continue
+			}
+			bound := "minimum"
+			switch t.Kind() {
+			case reflect.String:
+				bound = "minLength"
+			case reflect.Slice, reflect.Array:
+				bound = "minItems"
+			case reflect.Map:
+				bound = "minProperties"
+			}
+			lower := key == "min" || key == "gte" || key == "len"
+			upper := key == "max" || key == "lte" || key == "len"
+			if lower {
+				schema[bound] = n
+			}
+			if upper {
+				schema[strings.Replace(strings.Replace(bound, "minimum", "maximum", 1), "min", "max", 1)] = n
+			}
+		}
+	}
+}
+
+var schemaNamePattern = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// schemaName returns the component name of t, with the package paths
+// of generic arguments dropped: Page[…/models.User] is PageUser.
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if i := strings.Index(name, "["); i >= 0 {
+		args := strings.Split(strings.TrimSuffix(name[i+1:], "]"), ",")
+		name = name[:i]
+		for _, arg := range args {
+			if j := strings.LastIndexAny(arg, "./"); j >= 0 {
+				arg = arg[j+1:]
+			}
+			name += arg
+		}
+	}
+	return schemaNamePattern.ReplaceAllString(name, "")
+}
+
+// Mount registers on g:
+//  GET /openapi.json  the document
+//  GET /docs          Swagger UI for it
+func (api *OpenAPI) Mount(g *gin.RouterGroup) {
+	// routes are all added before the first request
+	var once sync.Once
+	var body []byte
+	var err error
+	g.GET("/openapi.json", func(c *gin.Context) {
+		once.Do(func() {
+			body, err = json.Marshal(api.Document())
+		})
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		c.Data(http.StatusOK, gin.MIMEJSON, body)
+	})
+	spec := strings.TrimRight(g.BasePath(), "/") + "/openapi.json"
+	g.GET("/docs", func(c *gin.Context) {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		swaggerTemplate.Execute(c.Writer, map[string]string{"Title": api.Title, "Spec": spec})
+	})
+}
+
+var swaggerTemplate = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: {{.Spec}}, dom_id: "#swagger-ui"})</script>
+</body>
+</html>`))
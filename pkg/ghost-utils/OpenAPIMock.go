@@ -0,0 +1,415 @@
+package ghostutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// MockHeader is set on the responses of an OpenAPIMock.
+const MockHeader = "X-Ghost-Mock"
+
+// MockConfig is the mock block of ghost.yaml. With enabled set Run
+// serves example responses for the operations of spec that no handler
+// of the app serves yet, see MockMode, so a frontend can be built
+// against the API before its handlers exist.
+//
+//  mock:
+//      enabled: true
+//      spec: api/openapi.yaml
+//      latency: 150ms
+type MockConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Spec is an OpenAPI 3 document, JSON or YAML.
+	Spec string `yaml:"spec"`
+	// Latency delays every mock response, to show loading states.
+	Latency time.Duration `yaml:"latency"`
+}
+
+// OpenAPIMock answers the operations of an OpenAPI document with
+// examples: the example of the response when the document has one,
+// else a value generated from its schema. A request may ask for
+// another documented response with Prefer: code=404.
+type OpenAPIMock struct {
+	Document map[string]interface{}
+	Latency  time.Duration
+}
+
+// Mock returns the mock of the document of api, with example values
+// set by Operation.Example.
+//
+// Example:
+//  api := ghostutils.NewOpenAPI("Blog API", "1.0.0").Add("/api", posts, comments)
+//  posts.Route(r.Group("/api"))   // comments has no handlers yet
+//  api.Mock().Mount(r)
+func (api *OpenAPI) Mock() *OpenAPIMock {
+	// decoded as a loaded document would be
+	var doc map[string]interface{}
+	data, _ := json.Marshal(api.Document())
+	json.Unmarshal(data, &doc)
+	return &OpenAPIMock{Document: doc}
+}
+
+// LoadOpenAPIMock reads the OpenAPI document at path, JSON, or YAML
+// for the .yaml and .yml extensions, for a mock.
+//
+// Returns:
+//  *OpenAPIMock
+//  error if the file cannot be read or parsed
+func LoadOpenAPIMock(path string) (*OpenAPIMock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	default:
+		err = json.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, ok := doc["paths"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%s: not an OpenAPI document, it has no paths", path)
+	}
+	return &OpenAPIMock{Document: doc}, nil
+}
+
+// MockMode serves the mocks of the spec of the mock block and of docs
+// on r, for the operations r does not serve yet. Run calls it when
+// mock.enabled is set; call it after registering the routes.
+//
+// Example:
+//  api := ghostutils.NewOpenAPI("Blog API", "1.0.0").Add("/api", routes...)
+//  if err := ghostConfig.MockMode(r, api); err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  error if the spec cannot be loaded
+func (ghostConfig GhostConfig) MockMode(r *gin.Engine, docs ...*OpenAPI) error {
+	var mocks []*OpenAPIMock
+	if ghostConfig.Mock.Spec != "" {
+		mock, err := LoadOpenAPIMock(ghostConfig.Mock.Spec)
+		if err != nil {
+			return err
+		}
+		mocks = append(mocks, mock)
+	}
+	for _, api := range docs {
+		mocks = append(mocks, api.Mock())
+	}
+	for _, mock := range mocks {
+		mock.Latency = ghostConfig.Mock.Latency
+		for _, route := range mock.Mount(r) {
+			log.Printf("mock: %s", route)
+		}
+	}
+	return nil
+}
+
+var openAPIParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// routeShape returns a gin path with its parameter names dropped, so
+// paths that only differ in them compare equal.
+func routeShape(path string) string {
+	return ginParamPattern.ReplaceAllStringFunc(path, func(param string) string { return param[:1] })
+}
+
+// Mount registers the operations of the document that r does not
+// serve, skipping those gin cannot register next to the routes of r.
+//
+// Returns:
+//  []string the operations mocked, like "GET /api/comments"
+func (m *OpenAPIMock) Mount(r *gin.Engine) []string {
+	served := map[string]bool{}
+	for _, route := range r.Routes() {
+		served[route.Method+" "+routeShape(route.Path)] = true
+	}
+	paths, _ := m.Document["paths"].(map[string]interface{})
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var mocked []string
+	for _, name := range names {
+		operations, _ := paths[name].(map[string]interface{})
+		path := openAPIParamPattern.ReplaceAllString(name, ":$1")
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			operation, ok := operations[strings.ToLower(method)].(map[string]interface{})
+			if !ok || served[method+" "+routeShape(path)] {
+				continue
+			}
+			if m.register(r, method, path, operation) {
+				served[method+" "+routeShape(path)] = true
+				mocked = append(mocked, method+" "+path)
+			}
+		}
+	}
+	return mocked
+}
+
+// register adds the mock of operation, reporting whether gin took it.
+func (m *OpenAPIMock) register(r *gin.Engine, method, path string, operation map[string]interface{}) (ok bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("mock: skipping %s %s: %v", method, path, recovered)
+			ok = false
+		}
+	}()
+	r.Handle(method, path, m.handler(operation))
+	return true
+}
+
+func (m *OpenAPIMock) handler(operation map[string]interface{}) gin.HandlerFunc {
+	responses, _ := operation["responses"].(map[string]interface{})
+	body, _ := operation["requestBody"].(map[string]interface{})
+	return func(c *gin.Context) {
+		if m.Latency > 0 {
+			select {
+			case <-time.After(m.Latency):
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+		c.Header(MockHeader, "true")
+		if body != nil && c.Request.Body != nil && strings.Contains(c.ContentType(), "json") {
+			raw, _ := io.ReadAll(c.Request.Body)
+			if len(raw) > 0 && !json.Valid(raw) {
+				Fail(c, NewGhostError(http.StatusBadRequest, "invalid_body", "the request body is not JSON"))
+				return
+			}
+		}
+		code, response := pickMockResponse(responses, c.GetHeader("Prefer"))
+		content, _ := response["content"].(map[string]interface{})
+		media, ok := content[gin.MIMEJSON].(map[string]interface{})
+		if !ok {
+			for _, value := range content {
+				media, _ = value.(map[string]interface{})
+				break
+			}
+		}
+		if media == nil {
+			c.Status(code)
+			return
+		}
+		example := m.mediaExample(media)
+		if object, ok := example.(map[string]interface{}); ok {
+			// answer with the record asked for
+			if id := c.Param("id"); id != "" {
+				if _, has := object["id"]; has {
+					copied := make(map[string]interface{}, len(object))
+					for k, v := range object {
+						copied[k] = v
+					}
+					copied["id"] = id
+					example = copied
+				}
+			}
+		}
+		c.JSON(code, example)
+	}
+}
+
+// pickMockResponse returns the response asked for with Prefer:
+// code=N when documented, else the first success, else the first.
+func pickMockResponse(responses map[string]interface{}, prefer string) (int, map[string]interface{}) {
+	for _, part := range strings.Split(prefer, ",") {
+		if code, ok := strings.CutPrefix(strings.TrimSpace(part), "code="); ok {
+			if response, ok := responses[code].(map[string]interface{}); ok {
+				status, _ := strconv.Atoi(code)
+				return status, response
+			}
+		}
+	}
+	codes := make([]string, 0, len(responses))
+	for code := range responses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if strings.HasPrefix(code, "2") {
+			status, _ := strconv.Atoi(code)
+			response, _ := responses[code].(map[string]interface{})
+			return status, response
+		}
+	}
+	if len(codes) == 0 {
+		return http.StatusOK, nil
+	}
+	status, err := strconv.Atoi(codes[0])
+	if err != nil {
+		// the default response
+		status = http.StatusOK
+	}
+	response, _ := responses[codes[0]].(map[string]interface{})
+	return status, response
+}
+
+func (m *OpenAPIMock) mediaExample(media map[string]interface{}) interface{} {
+	if example, ok := media["example"]; ok {
+		return example
+	}
+	if examples, ok := media["examples"].(map[string]interface{}); ok && len(examples) > 0 {
+		names := make([]string, 0, len(examples))
+		for name := range examples {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if example, ok := examples[names[0]].(map[string]interface{}); ok {
+			return example["value"]
+		}
+	}
+	schema, _ := media["schema"].(map[string]interface{})
+	return m.example(schema, "", 0)
+}
+
+// mockTime is the time of generated examples, fixed so responses do
+// not change between requests.
+var mockTime = time.Date(2024, time.January, 2, 15, 4, 5, 0, time.UTC)
+
+// example generates a value of schema, named name in its object.
+func (m *OpenAPIMock) example(schema map[string]interface{}, name string, depth int) interface{} {
+	if schema == nil || depth > 8 {
+		return nil
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		return m.example(m.resolve(ref), name, depth+1)
+	}
+	if example, ok := schema["example"]; ok {
+		return example
+	}
+	if value, ok := schema["default"]; ok {
+		return value
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+		return enum[0]
+	}
+	for _, key := range []string{"allOf", "oneOf", "anyOf"} {
+		parts, ok := schema[key].([]interface{})
+		if !ok || len(parts) == 0 {
+			continue
+		}
+		if key != "allOf" {
+			part, _ := parts[0].(map[string]interface{})
+			return m.example(part, name, depth+1)
+		}
+		merged := map[string]interface{}{}
+		for _, part := range parts {
+			part, _ := part.(map[string]interface{})
+			if object, ok := m.example(part, name, depth+1).(map[string]interface{}); ok {
+				for k, v := range object {
+					merged[k] = v
+				}
+			}
+		}
+		return merged
+	}
+	typ, _ := schema["type"].(string)
+	if typ == "" {
+		if _, ok := schema["properties"]; ok {
+			typ = "object"
+		}
+	}
+	switch typ {
+	case "object":
+		object := map[string]interface{}{}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for key, property := range properties {
+			property, _ := property.(map[string]interface{})
+			object[key] = m.example(property, key, depth+1)
+		}
+		return object
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		count := 1
+		if min, ok := schema["minItems"].(float64); ok && int(min) > count {
+			count = int(min)
+		}
+		list := make([]interface{}, count)
+		for i := range list {
+			list[i] = m.example(items, name, depth+1)
+		}
+		return list
+	case "integer", "number":
+		n := 1.0
+		if min, ok := schema["minimum"].(float64); ok {
+			n = min
+		} else if max, ok := schema["maximum"].(float64); ok && max < n {
+			n = max
+		}
+		if typ == "integer" {
+			return int(n)
+		}
+		return n
+	case "boolean":
+		return true
+	case "string":
+		return mockString(schema, name)
+	}
+	return nil
+}
+
+// mockString returns a string of the format of schema, or one named
+// after its property.
+func mockString(schema map[string]interface{}, name string) string {
+	format, _ := schema["format"].(string)
+	switch format {
+	case "date-time":
+		return mockTime.Format(time.RFC3339)
+	case "date":
+		return mockTime.Format("2006-01-02")
+	case "email":
+		return "user@example.com"
+	case "uri", "url":
+		return "https://example.com"
+	case "uuid":
+		return "123e4567-e89b-12d3-a456-426614174000"
+	case "byte":
+		return "ZXhhbXBsZQ=="
+	}
+	value := "string"
+	switch {
+	case name == "id":
+		value = "record:1"
+	case name != "":
+		value = name
+	}
+	if min, ok := schema["minLength"].(float64); ok && len(value) < int(min) {
+		value += strings.Repeat("x", int(min)-len(value))
+	}
+	if max, ok := schema["maxLength"].(float64); ok && len(value) > int(max) {
+		value = value[:int(max)]
+	}
+	return value
+}
+
+// resolve returns the schema of a local reference, like
+// #/components/schemas/Post.
+func (m *OpenAPIMock) resolve(ref string) map[string]interface{} {
+	var node interface{} = m.Document
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = object[strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")]
+	}
+	schema, _ := node.(map[string]interface{})
+	return schema
+}
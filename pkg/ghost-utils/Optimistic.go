@@ -0,0 +1,84 @@
+package ghostutils
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The events of optimistic updates, triggered on the element that made
+// the request. Their detail is an OptimisticEvent.
+const (
+	// EventConfirm confirms the update the page already shows.
+	EventConfirm = "ghost:confirm"
+	// EventRollback undoes it: the server refused the change.
+	EventRollback = "ghost:rollback"
+	// EventRetry undoes it for now: the change may succeed when it is
+	// sent again, after RetryAfter seconds when it is set.
+	EventRetry = "ghost:retry"
+)
+
+// OptimisticHeader is the request header carrying the id of the
+// optimistic update, echoed in the events so the page knows which of
+// its pending updates the response is about.
+const OptimisticHeader = "Ghost-Optimistic-Id"
+
+// OptimisticEvent is the detail of the optimistic update events.
+type OptimisticEvent struct {
+	// ID is the value of the OptimisticHeader, empty without it.
+	ID string `json:"id,omitempty"`
+	// Action names the update, e.g. "todo.toggle".
+	Action string `json:"action"`
+	// Data is the record as the server stored it, on confirm.
+	Data  interface{} `json:"data,omitempty"`
+	Error *GhostError `json:"error,omitempty"`
+	// RetryAfter is the number of seconds to wait before a retry.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// Confirm triggers EventConfirm for action with the stored record.
+// Render or send the response after it, as the headers go first.
+//
+// Example:
+//  // <input type="checkbox" hx-patch="/todos/1/toggle" hx-swap="none"
+//  //        hx-headers='{"Ghost-Optimistic-Id": "t1"}'
+//  //        hx-on::before-request="this.closest('li').classList.toggle('done')"
+//  //        hx-on:ghost:rollback="this.closest('li').classList.toggle('done')">
+//  todo, err := todos.Patch(c, c.Param("id"), map[string]interface{}{"done": !done})
+//  if err != nil {
+//      ghostutils.Rollback(c, "todo.toggle", err)
+//      return
+//  }
+//  ghostutils.Confirm(c, "todo.toggle", todo)
+//  ghostutils.OK(c, todo)
+func Confirm(c *gin.Context, action string, data interface{}) {
+	HTMX(c).Trigger(EventConfirm, OptimisticEvent{ID: c.GetHeader(OptimisticHeader), Action: action, Data: data})
+}
+
+// Rollback undoes the optimistic update action because of err and
+// answers the error like Fail. Errors that may pass when sent again,
+// 408, 429 and 5xx, trigger EventRetry, with the Retry-After header
+// of the response when one is set; all others trigger EventRollback.
+func Rollback(c *gin.Context, action string, err error) {
+	ghostErr := AsGhostError(err)
+	event := OptimisticEvent{ID: c.GetHeader(OptimisticHeader), Action: action, Error: ghostErr}
+	name := EventRollback
+	if retryable(ghostErr.Status) {
+		name = EventRetry
+		event.RetryAfter, _ = strconv.Atoi(c.Writer.Header().Get("Retry-After"))
+	}
+	HTMX(c).Trigger(name, event)
+	Fail(c, ghostErr)
+}
+
+func retryable(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// OptimisticScript triggers EventRetry on the element of a request
+// that got no response, because the network or the server was down,
+// so pages handle every failure with the same events. Put it in the
+// head of the layout after htmx.
+const OptimisticScript template.HTML = `<script>document.addEventListener("htmx:sendError",function(e){var h=e.detail.requestConfig&&e.detail.requestConfig.headers||{};htmx.trigger(e.detail.elt,"ghost:retry",{id:h["Ghost-Optimistic-Id"],action:"",error:{code:"network_error",message:"the request could not be sent"}})});document.addEventListener("htmx:timeout",function(e){htmx.trigger(e.detail.elt,"ghost:retry",{action:"",error:{code:"timeout",message:"the request timed out"}})})</script>`
@@ -0,0 +1,464 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Organization membership roles, from most to least privileged.
+const (
+	OrgOwner  = "owner"
+	OrgAdmin  = "admin"
+	OrgMember = "member"
+)
+
+// OrganizationKey is the gin context key holding the active
+// organization Membership.
+const OrganizationKey = "ghost-organization"
+
+// OrganizationHeader selects the active organization for API calls.
+const OrganizationHeader = "X-Organization"
+
+// ErrNotMember is returned when a user has no membership in the
+// requested organization.
+var ErrNotMember = errors.New("not a member of this organization")
+
+// ErrLastOwner is returned when removing or demoting the only owner
+// of an organization.
+var ErrLastOwner = errors.New("an organization needs at least one owner")
+
+// ErrInviteEmail is returned when an invitation is accepted by a user
+// other than the one it was sent to.
+var ErrInviteEmail = errors.New("the invitation was sent to another email address")
+
+// OrganizationSchema defines the tables used by Orgs, applied by
+// OrganizationMigration.
+const OrganizationSchema = `
+DEFINE TABLE organization SCHEMALESS;
+DEFINE FIELD name ON organization TYPE string;
+DEFINE FIELD created_at ON organization TYPE datetime;
+DEFINE TABLE membership SCHEMALESS;
+DEFINE FIELD org ON membership TYPE string;
+DEFINE FIELD user ON membership TYPE string;
+DEFINE FIELD role ON membership TYPE string ASSERT $value INSIDE ["owner", "admin", "member"];
+DEFINE INDEX membership_org_user ON membership FIELDS org, user UNIQUE;
+DEFINE TABLE invitation SCHEMALESS;
+DEFINE INDEX invitation_org_email ON invitation FIELDS org, email;
+`
+
+// Organization is a team of users.
+type Organization struct {
+	ID        string    `json:"id,omitempty"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Membership links a user to an organization with a role.
+type Membership struct {
+	ID        string    `json:"id,omitempty"`
+	Org       string    `json:"org"`
+	User      string    `json:"user"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Invitation is a pending invite to join an organization.
+type Invitation struct {
+	ID        string     `json:"id,omitempty"`
+	Org       string     `json:"org"`
+	Email     string     `json:"email"`
+	Role      string     `json:"role"`
+	InvitedBy string     `json:"invited_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	Accepted  *time.Time `json:"accepted_at,omitempty"`
+}
+
+// invitationTokenPurpose keeps invitation codes apart from the other
+// signed tokens.
+const invitationTokenPurpose = "invitation"
+
+type invitationClaims struct {
+	Invitation string `json:"i"`
+}
+
+// OrganizationMigration returns the migration creating the tables of
+// Orgs at version, for RegisterMigrations or Migrator.Add.
+func OrganizationMigration(version int) Migration {
+	return Migration{
+		Version: version,
+		Name:    "organizations",
+		Up:      OrganizationSchema,
+		Down:    "REMOVE TABLE invitation;\nREMOVE TABLE membership;\nREMOVE TABLE organization;\n",
+	}
+}
+
+// Orgs manages organizations, memberships and invitations. Its tables
+// are created by OrganizationMigration.
+type Orgs struct {
+	DB     *surrealdb.DB
+	Signer *Signer
+	// UserEmail returns the email address of a user, which must match
+	// the invitation the user accepts.
+	UserEmail func(ctx context.Context, user string) (string, error)
+	// AcceptURL is the absolute URL invitation links point to, e.g.
+	// https://example.com/orgs/invitations/accept
+	AcceptURL string
+	InviteTTL time.Duration
+	// SendInvite delivers the invitation link, usually by email.
+	SendInvite func(ctx context.Context, inv Invitation, link string) error
+}
+
+// Create makes a new organization owned by owner.
+func (o *Orgs) Create(ctx context.Context, name, owner string) (Organization, error) {
+	org, _, err := surrealFirst[Organization](o.DB,
+		"CREATE organization SET name = $name, created_at = time::now()",
+		map[string]interface{}{"name": name})
+	if err != nil {
+		return org, err
+	}
+	_, err = o.AddMember(ctx, org.ID, owner, OrgOwner)
+	return org, err
+}
+
+// ownersLeft is the SurrealQL condition that org keeps an owner when
+// the membership in question stops being one.
+const ownersLeft = `(role != "owner" OR count((SELECT id FROM membership WHERE org = $org AND role = "owner")) > 1)`
+
+// AddMember adds user to org with role, or changes the role of an
+// existing member.
+//
+// Returns:
+//  Membership
+//  error, ErrLastOwner when demoting the only owner
+func (o *Orgs) AddMember(ctx context.Context, org, user, role string) (Membership, error) {
+	vars := map[string]interface{}{"org": org, "user": user, "role": role}
+	existing, err := o.Membership(ctx, org, user)
+	if errors.Is(err, ErrNotMember) {
+		m, _, err := surrealFirst[Membership](o.DB,
+			"CREATE membership SET org = $org, user = $user, role = $role, created_at = time::now()", vars)
+		return m, err
+	}
+	if err != nil {
+		return Membership{}, err
+	}
+	vars["id"] = strings.TrimPrefix(existing.ID, "membership:")
+	m, ok, err := surrealFirst[Membership](o.DB,
+		`UPDATE type::thing("membership", $id) SET role = $role WHERE $role = "owner" OR `+ownersLeft+` RETURN AFTER`, vars)
+	if err == nil && !ok {
+		err = ErrLastOwner
+	}
+	return m, err
+}
+
+// RemoveMember deletes the membership of user in org.
+//
+// Returns:
+//  error, ErrNotMember for a user outside org, ErrLastOwner for its
+//  only owner
+func (o *Orgs) RemoveMember(ctx context.Context, org, user string) error {
+	if _, err := o.Membership(ctx, org, user); err != nil {
+		return err
+	}
+	_, ok, err := surrealFirst[Membership](o.DB,
+		"DELETE membership WHERE org = $org AND user = $user AND "+ownersLeft+" RETURN BEFORE",
+		map[string]interface{}{"org": org, "user": user})
+	if err == nil && !ok {
+		err = ErrLastOwner
+	}
+	return err
+}
+
+// Membership returns the membership of user in org, or ErrNotMember.
+func (o *Orgs) Membership(ctx context.Context, org, user string) (Membership, error) {
+	m, ok, err := surrealFirst[Membership](o.DB,
+		"SELECT * FROM membership WHERE org = $org AND user = $user LIMIT 1",
+		map[string]interface{}{"org": org, "user": user})
+	if err == nil && !ok {
+		err = ErrNotMember
+	}
+	return m, err
+}
+
+// Memberships returns every membership of user.
+func (o *Orgs) Memberships(ctx context.Context, user string) ([]Membership, error) {
+	return surrealQuery[Membership](o.DB,
+		"SELECT * FROM membership WHERE user = $user ORDER BY created_at",
+		map[string]interface{}{"user": user})
+}
+
+// Members returns every membership of org.
+func (o *Orgs) Members(ctx context.Context, org string) ([]Membership, error) {
+	return surrealQuery[Membership](o.DB,
+		"SELECT * FROM membership WHERE org = $org ORDER BY created_at",
+		map[string]interface{}{"org": org})
+}
+
+// Invite records an invitation and sends a signed link to email.
+func (o *Orgs) Invite(ctx context.Context, org, email, role, invitedBy string) (Invitation, error) {
+	inv, _, err := surrealFirst[Invitation](o.DB,
+		"CREATE invitation SET org = $org, email = $email, role = $role, invited_by = $invited_by, created_at = time::now()",
+		map[string]interface{}{
+			"org":        org,
+			"email":      normalizeEmail(email),
+			"role":       role,
+			"invited_by": invitedBy,
+		})
+	if err != nil {
+		return inv, err
+	}
+	ttl := o.InviteTTL
+	if ttl == 0 {
+		ttl = 7 * 24 * time.Hour
+	}
+	token, err := o.Signer.SignToken(invitationTokenPurpose, invitationClaims{Invitation: inv.ID}, ttl)
+	if err != nil {
+		return inv, err
+	}
+	link := o.AcceptURL + "?token=" + url.QueryEscape(token)
+	if o.SendInvite != nil {
+		err = o.SendInvite(ctx, inv, link)
+	}
+	return inv, err
+}
+
+// AcceptInvite verifies token and makes user a member of the
+// invited organization. The invitation must have been sent to the
+// email of user, see UserEmail, and can be accepted once.
+//
+// Returns:
+//  Membership
+//  error, ErrInviteEmail for another user's invitation,
+//  ErrSignatureExpired for one already accepted
+func (o *Orgs) AcceptInvite(ctx context.Context, token, user string) (Membership, error) {
+	var claims invitationClaims
+	if err := o.Signer.VerifyToken(invitationTokenPurpose, token, &claims); err != nil {
+		return Membership{}, err
+	}
+	inv, err := surrealdb.SmartUnmarshal[Invitation](o.DB.Select(claims.Invitation))
+	if err != nil {
+		return Membership{}, err
+	}
+	if inv.Accepted != nil {
+		return Membership{}, ErrSignatureExpired
+	}
+	if o.UserEmail == nil {
+		return Membership{}, errors.New("orgs: UserEmail is required to accept invitations")
+	}
+	email, err := o.UserEmail(ctx, user)
+	if err != nil {
+		return Membership{}, err
+	}
+	if normalizeEmail(email) != inv.Email {
+		return Membership{}, ErrInviteEmail
+	}
+	// claim the invitation first, so it cannot be accepted twice
+	_, ok, err := surrealFirst[Invitation](o.DB,
+		`UPDATE type::thing("invitation", $id) SET accepted_at = time::now(), accepted_by = $user WHERE accepted_at = NONE RETURN AFTER`,
+		map[string]interface{}{"id": strings.TrimPrefix(inv.ID, "invitation:"), "user": user})
+	if err != nil {
+		return Membership{}, err
+	}
+	if !ok {
+		return Membership{}, ErrSignatureExpired
+	}
+	return o.AddMember(ctx, inv.Org, user, inv.Role)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Middleware resolves the active organization from the
+// X-Organization header, the "org" query parameter or the user's
+// first membership, and stores it under OrganizationKey. The
+// organization is also set on the request Identity.
+func (o *Orgs) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, ok := CurrentIdentity(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		ctx := c.Request.Context()
+		requested := c.GetHeader(OrganizationHeader)
+		if requested == "" {
+			requested = c.Query("org")
+		}
+		var m Membership
+		var err error
+		if requested != "" {
+			m, err = o.Membership(ctx, requested, identity.ID)
+		} else {
+			var all []Membership
+			if all, err = o.Memberships(ctx, identity.ID); err == nil && len(all) > 0 {
+				m = all[0]
+			}
+		}
+		if errors.Is(err, ErrNotMember) {
+			FailStatus(c, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		if m.Org != "" {
+			identity.Organization = m.Org
+			SetIdentity(c, identity)
+			c.Set(OrganizationKey, m)
+		}
+		c.Next()
+	}
+}
+
+// ActiveMembership returns the membership resolved by Middleware.
+func ActiveMembership(c *gin.Context) (Membership, bool) {
+	value, ok := c.Get(OrganizationKey)
+	m, _ := value.(Membership)
+	return m, ok
+}
+
+// RequireOrgRole aborts with 403 unless the active membership has
+// one of roles.
+func RequireOrgRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m, ok := ActiveMembership(c)
+		if ok {
+			for _, role := range roles {
+				if m.Role == role {
+					c.Next()
+					return
+				}
+			}
+		}
+		Fail(c, NewGhostError(http.StatusForbidden, "forbidden", "insufficient organization role"))
+	}
+}
+
+// Mount registers the organization endpoints on g:
+//  GET    /orgs                        list the caller's memberships
+//  POST   /orgs                        create an organization
+//  GET    /orgs/invitations/accept     accept an invitation link
+//  GET    /orgs/current/members        list members of the active org
+//  POST   /orgs/current/invitations    invite to the active org
+//  DELETE /orgs/current/members/:user  remove a member
+// GET /orgs/invitations/accept must be reachable at AcceptURL.
+func (o *Orgs) Mount(g *gin.RouterGroup) {
+	orgs := g.Group("/orgs", RequireIdentity())
+	orgs.GET("", o.listMine)
+	orgs.POST("", o.create)
+	orgs.GET("/invitations/accept", o.accept)
+	current := orgs.Group("/current", o.Middleware())
+	current.GET("/members", RequireOrgRole(OrgOwner, OrgAdmin, OrgMember), o.members)
+	current.POST("/invitations", RequireOrgRole(OrgOwner, OrgAdmin), o.invite)
+	current.DELETE("/members/:user", RequireOrgRole(OrgOwner, OrgAdmin), o.removeMember)
+}
+
+func (o *Orgs) listMine(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	memberships, err := o.Memberships(c.Request.Context(), identity.ID)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, memberships)
+}
+
+func (o *Orgs) create(c *gin.Context) {
+	var body struct {
+		Name string `json:"name" form:"name" binding:"required"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		FailStatus(c, http.StatusBadRequest, err)
+		return
+	}
+	identity, _ := CurrentIdentity(c)
+	org, err := o.Create(c.Request.Context(), body.Name, identity.ID)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, org)
+}
+
+func (o *Orgs) members(c *gin.Context) {
+	m, _ := ActiveMembership(c)
+	members, err := o.Members(c.Request.Context(), m.Org)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, members)
+}
+
+func (o *Orgs) invite(c *gin.Context) {
+	var body struct {
+		Email string `json:"email" form:"email" binding:"required,email"`
+		Role  string `json:"role" form:"role"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		FailStatus(c, http.StatusBadRequest, err)
+		return
+	}
+	if body.Role == "" {
+		body.Role = OrgMember
+	}
+	m, _ := ActiveMembership(c)
+	if body.Role == OrgOwner && m.Role != OrgOwner {
+		Fail(c, NewGhostError(http.StatusForbidden, "forbidden", "only owners can invite owners"))
+		return
+	}
+	inv, err := o.Invite(c.Request.Context(), m.Org, body.Email, body.Role, m.User)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, inv)
+}
+
+func (o *Orgs) accept(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	m, err := o.AcceptInvite(c.Request.Context(), c.Query("token"), identity.ID)
+	if errors.Is(err, ErrSignatureInvalid) || errors.Is(err, ErrSignatureExpired) {
+		Fail(c, NewGhostError(http.StatusGone, "expired", "invitation invalid or expired"))
+		return
+	}
+	if errors.Is(err, ErrInviteEmail) {
+		FailStatus(c, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+func (o *Orgs) removeMember(c *gin.Context) {
+	m, _ := ActiveMembership(c)
+	user := c.Param("user")
+	target, err := o.Membership(c.Request.Context(), m.Org, user)
+	if err != nil {
+		FailStatus(c, http.StatusNotFound, err)
+		return
+	}
+	if target.Role == OrgOwner && m.Role != OrgOwner {
+		Fail(c, NewGhostError(http.StatusForbidden, "forbidden", "only owners can remove owners"))
+		return
+	}
+	if err := o.RemoveMember(c.Request.Context(), m.Org, user); errors.Is(err, ErrLastOwner) {
+		FailStatus(c, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
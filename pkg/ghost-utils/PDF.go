@@ -0,0 +1,288 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PDFConfig is the `pdf:` block of ghost.yaml, selecting the engine
+// converting rendered templates to PDF. Setup keeps it as the PDF of
+// its App, see RenderPDF.
+//
+// Example:
+//  pdf:
+//    engine: command
+//    command: [weasyprint, "-", "-"]
+//    timeout: 1m
+type PDFConfig struct {
+	// Engine is chromium, the default, or command.
+	Engine string `yaml:"engine"`
+	// Chromium is the browser binary, looked up on PATH by default.
+	Chromium string `yaml:"chromium"`
+	// NoSandbox runs Chromium without its sandbox, which containers
+	// running as root need.
+	NoSandbox bool `yaml:"no-sandbox"`
+	// Command reads HTML on stdin and writes PDF on stdout, such as
+	// weasyprint or wkhtmltopdf with "-" "-".
+	Command []string `yaml:"command"`
+	// Timeout bounds a conversion, 30 seconds by default.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// DefaultPDFTimeout is the pdf.timeout applied by Validate.
+const DefaultPDFTimeout = 30 * time.Second
+
+// PDFEngine converts an HTML document to PDF. Page size and margins
+// come from the CSS of the document, e.g. @page { size: A4; margin:
+// 2cm }. Implement it to plug in another converter, such as a pure Go
+// one for documents without complex CSS.
+type PDFEngine interface {
+	PDF(ctx context.Context, html []byte) ([]byte, error)
+}
+
+// DefaultPDFEngine converts the documents of RenderPDF and the PDF
+// jobs outside an App, whose PDF is the engine of the pdf block.
+var DefaultPDFEngine PDFEngine = ChromiumPDF{}
+
+// contextPDFEngine returns the PDF engine of the app of ctx,
+// DefaultPDFEngine outside one.
+func contextPDFEngine(ctx context.Context) PDFEngine {
+	if app := AppFrom(ctx); app != nil && app.PDF != nil {
+		return app.PDF
+	}
+	return DefaultPDFEngine
+}
+
+// NewPDFEngine returns the engine of the pdf block.
+//
+// Returns:
+//  PDFEngine
+//  error for an unknown engine or a command engine without command
+func (ghostConfig GhostConfig) NewPDFEngine() (PDFEngine, error) {
+	config := ghostConfig.PDF
+	switch config.Engine {
+	case "", "chromium":
+		return ChromiumPDF{Path: config.Chromium, NoSandbox: config.NoSandbox, Timeout: config.Timeout}, nil
+	case "command":
+		if len(config.Command) == 0 {
+			return nil, errors.New("pdf.command is required for the command engine")
+		}
+		return CommandPDF{Command: config.Command, Timeout: config.Timeout}, nil
+	default:
+		return nil, fmt.Errorf("unknown pdf engine %q", config.Engine)
+	}
+}
+
+// pdfTimeout bounds ctx by timeout, DefaultPDFTimeout when unset.
+func pdfTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultPDFTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// ChromiumPDF prints documents with headless Chromium or Chrome.
+type ChromiumPDF struct {
+	// Path is the browser binary, the first of chromium,
+	// chromium-browser, google-chrome and chrome found on PATH by
+	// default.
+	Path      string
+	NoSandbox bool
+	Timeout   time.Duration
+}
+
+func (e ChromiumPDF) binary() (string, error) {
+	if e.Path != "" {
+		return e.Path, nil
+	}
+	for _, name := range []string{"chromium", "chromium-browser", "google-chrome", "chrome"} {
+		if found, err := exec.LookPath(name); err == nil {
+			return found, nil
+		}
+	}
+	return "", errors.New("pdf: no chromium binary found on PATH, set pdf.chromium")
+}
+
+// PDF implements PDFEngine.
+func (e ChromiumPDF) PDF(ctx context.Context, html []byte) ([]byte, error) {
+	binary, err := e.binary()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "ghost-pdf-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "document.html")
+	output := filepath.Join(dir, "document.pdf")
+	if err := os.WriteFile(input, html, 0o600); err != nil {
+		return nil, err
+	}
+	ctx, cancel := pdfTimeout(ctx, e.Timeout)
+	defer cancel()
+	args := []string{"--headless", "--disable-gpu", "--no-pdf-header-footer", "--print-to-pdf=" + output}
+	if e.NoSandbox {
+		args = append(args, "--no-sandbox")
+	}
+	args = append(args, "file://"+filepath.ToSlash(input))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pdf: chromium: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.ReadFile(output)
+}
+
+// CommandPDF pipes documents through a converter command.
+type CommandPDF struct {
+	Command []string
+	Timeout time.Duration
+}
+
+// PDF implements PDFEngine.
+func (e CommandPDF) PDF(ctx context.Context, html []byte) ([]byte, error) {
+	if len(e.Command) == 0 {
+		return nil, errors.New("pdf: no command")
+	}
+	ctx, cancel := pdfTimeout(ctx, e.Timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(html)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pdf: %s: %w: %s", e.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// captureWriter keeps the body written to it, for rendering templates
+// into a buffer through the HTML renderer of the engine.
+type captureWriter struct {
+	gin.ResponseWriter
+	body   bytes.Buffer
+	status int
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *captureWriter) WriteHeaderNow() {}
+
+func (w *captureWriter) Status() int {
+	return w.status
+}
+
+func (w *captureWriter) Written() bool {
+	return false
+}
+
+// RenderTemplate renders the template name with data and the layout
+// data, as HTML does, into a buffer instead of the response.
+//
+// Returns:
+//  the rendered document
+//  error of the template
+func RenderTemplate(c *gin.Context, name string, data interface{}) ([]byte, error) {
+	original := c.Writer
+	capture := &captureWriter{ResponseWriter: original}
+	errs := len(c.Errors)
+	c.Writer = capture
+	c.HTML(http.StatusOK, name, withLayout(c, data))
+	c.Writer = original
+	// the HTML content type was set on the shared header
+	original.Header().Del("Content-Type")
+	if len(c.Errors) > errs {
+		return nil, c.Errors.Last().Err
+	}
+	return capture.body.Bytes(), nil
+}
+
+// RenderPDF renders the template name with data and answers with the
+// document converted to PDF by the engine of the app, see AppFrom,
+// named after the template. Failures answer 500 through Fail.
+//
+// Example:
+//  r.GET("/invoices/:id.pdf", func(c *gin.Context) {
+//      invoice, err := invoices.Get(c, c.Param("id"))
+//      if err != nil {
+//          ghostutils.Fail(c, err)
+//          return
+//      }
+//      ghostutils.RenderPDF(c, "invoice.html", gin.H{"Invoice": invoice})
+//  })
+func RenderPDF(c *gin.Context, name string, data interface{}) {
+	html, err := RenderTemplate(c, name, data)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	pdf, err := contextPDFEngine(c).PDF(c.Request.Context(), html)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	file := strings.TrimSuffix(path.Base(name), path.Ext(name)) + ".pdf"
+	c.Header("Content-Disposition", `inline; filename="`+file+`"`)
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
+
+// PDFJobType is the job type of the PDF jobs, see RegisterPDFJob.
+const PDFJobType = "ghost-pdf"
+
+// PDFJob renders Template with Data, which went through JSON, so the
+// template reads maps, and stores the PDF under Key.
+type PDFJob struct {
+	Template string      `json:"template"`
+	Data     interface{} `json:"data"`
+	Key      string      `json:"key"`
+}
+
+// RegisterPDFJob registers the PDF jobs, rendering with templates and
+// storing the documents in storage, for documents too heavy to render
+// in a request. Enqueue them with JobQueue.EnqueuePDF.
+//
+// Example:
+//  ghostutils.RegisterPDFJob(engine, ghostutils.LocalStorage{Root: "./storage"})
+//  _, err := jobs.EnqueuePDF(c, "reports/yearly.html", gin.H{"Year": 2024}, "reports/2024.pdf")
+func RegisterPDFJob(templates *TemplateEngine, storage Storage) {
+	RegisterJob(PDFJobType, func(ctx context.Context, job PDFJob) error {
+		var html bytes.Buffer
+		if err := templates.Execute(&html, job.Template, job.Data); err != nil {
+			return err
+		}
+		pdf, err := contextPDFEngine(ctx).PDF(ctx, html.Bytes())
+		if err != nil {
+			return err
+		}
+		return storage.Put(ctx, job.Key, bytes.NewReader(pdf), "application/pdf")
+	})
+}
+
+// EnqueuePDF enqueues the rendering of the template name with data
+// into the PDF stored under key.
+func (q *JobQueue) EnqueuePDF(ctx context.Context, name string, data interface{}, key string) (Job, error) {
+	return q.Enqueue(ctx, PDFJobType, PDFJob{Template: name, Data: data, Key: key})
+}
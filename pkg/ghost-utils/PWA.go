@@ -0,0 +1,344 @@
+package ghostutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PWAConfig is the `pwa:` block of ghost.yaml. When Enabled, Setup
+// serves the favicons, the web app manifest, a service worker and an
+// offline page from the root of the site, so browsers offer to install
+// the app. The manifest takes the name and description of the config.
+//
+// Example:
+//  pwa:
+//    enabled: true
+//    short-name: Blog
+//    theme-color: "#1e293b"
+//    background-color: "#ffffff"
+//    icons: static/icons
+//    offline: src/views/offline.html
+type PWAConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ShortName is the name shown under the icon, the name by default.
+	ShortName       string `yaml:"short-name"`
+	ThemeColor      string `yaml:"theme-color"`
+	BackgroundColor string `yaml:"background-color"`
+	// Display is standalone, the default, fullscreen, minimal-ui or
+	// browser.
+	Display string `yaml:"display"`
+	// StartURL is the page opened by the installed app, "/" by
+	// default.
+	StartURL string `yaml:"start-url"`
+	// Icons is the directory of the favicon variants, each served
+	// when present: favicon.ico, favicon.svg, apple-touch-icon.png,
+	// icon-192.png, icon-512.png and icon-maskable-512.png.
+	Icons string `yaml:"icons"`
+	// ServiceWorker is the script served as /service-worker.js. By
+	// default one is generated that serves the offline page to
+	// navigations failing for want of a network.
+	ServiceWorker string `yaml:"service-worker"`
+	// Offline is the HTML file served as /offline.html, a plain page
+	// with the name by default.
+	Offline string `yaml:"offline"`
+	// Precache lists further URLs the generated service worker stores
+	// when installed, such as the stylesheet of the offline page.
+	Precache []string `yaml:"precache"`
+}
+
+// Defaults applied to PWAConfig by Validate.
+const (
+	DefaultPWADisplay  = "standalone"
+	DefaultPWAStartURL = "/"
+)
+
+// PWA paths, served from the root of the site.
+const (
+	PWAManifestPath      = "/site.webmanifest"
+	PWAServiceWorkerPath = "/service-worker.js"
+	PWAOfflinePath       = "/offline.html"
+)
+
+// pwaIcons are the favicon variants looked up in the icons directory.
+var pwaIcons = []struct {
+	File     string
+	Type     string
+	Sizes    string
+	Purpose  string
+	Manifest bool
+}{
+	{"favicon.ico", "image/x-icon", "48x48", "", false},
+	{"favicon.svg", "image/svg+xml", "any", "", true},
+	{"apple-touch-icon.png", "image/png", "180x180", "", false},
+	{"icon-192.png", "image/png", "192x192", "", true},
+	{"icon-512.png", "image/png", "512x512", "", true},
+	{"icon-maskable-512.png", "image/png", "512x512", "maskable", true},
+}
+
+// PWA serves the assets making the app installable.
+type PWA struct {
+	Config      PWAConfig
+	Name        string
+	Description string
+	Version     string
+	// Files holds the icons, service worker and offline page, the
+	// working directory by default.
+	Files fs.FS
+}
+
+// WebManifest is the web app manifest served as /site.webmanifest.
+type WebManifest struct {
+	Name            string            `json:"name"`
+	ShortName       string            `json:"short_name"`
+	Description     string            `json:"description,omitempty"`
+	StartURL        string            `json:"start_url"`
+	Scope           string            `json:"scope"`
+	Display         string            `json:"display"`
+	ThemeColor      string            `json:"theme_color,omitempty"`
+	BackgroundColor string            `json:"background_color,omitempty"`
+	Icons           []WebManifestIcon `json:"icons,omitempty"`
+}
+
+// WebManifestIcon is an icon of a WebManifest.
+type WebManifestIcon struct {
+	Src     string `json:"src"`
+	Sizes   string `json:"sizes"`
+	Type    string `json:"type"`
+	Purpose string `json:"purpose,omitempty"`
+}
+
+// NewPWA returns the PWA of the pwa block, reading its files from
+// files, or from the working directory when nil.
+//
+// Example:
+//  pwa := ghostConfig.NewPWA(nil)
+//  pwa.Mount(r)
+func (ghostConfig GhostConfig) NewPWA(files fs.FS) *PWA {
+	if files == nil {
+		files = os.DirFS(".")
+	}
+	return &PWA{
+		Config:      ghostConfig.PWA,
+		Name:        ghostConfig.Name,
+		Description: ghostConfig.Description,
+		Version:     ghostConfig.Version,
+		Files:       files,
+	}
+}
+
+// shortName is the short name of the manifest.
+func (p *PWA) shortName() string {
+	if p.Config.ShortName != "" {
+		return p.Config.ShortName
+	}
+	return p.Name
+}
+
+// icon returns the path of the icon file in Files, if present.
+func (p *PWA) icon(file string) (string, bool) {
+	if p.Config.Icons == "" {
+		return "", false
+	}
+	name := path.Join(strings.TrimPrefix(path.Clean("/"+p.Config.Icons), "/"), file)
+	info, err := fs.Stat(p.Files, name)
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+	return name, true
+}
+
+// Manifest returns the web app manifest, listing the icons present.
+func (p *PWA) Manifest() WebManifest {
+	display := p.Config.Display
+	if display == "" {
+		display = DefaultPWADisplay
+	}
+	start := p.Config.StartURL
+	if start == "" {
+		start = DefaultPWAStartURL
+	}
+	manifest := WebManifest{
+		Name:            p.Name,
+		ShortName:       p.shortName(),
+		Description:     p.Description,
+		StartURL:        start,
+		Scope:           "/",
+		Display:         display,
+		ThemeColor:      p.Config.ThemeColor,
+		BackgroundColor: p.Config.BackgroundColor,
+	}
+	for _, icon := range pwaIcons {
+		if _, ok := p.icon(icon.File); ok && icon.Manifest {
+			manifest.Icons = append(manifest.Icons, WebManifestIcon{Src: "/" + icon.File, Sizes: icon.Sizes, Type: icon.Type, Purpose: icon.Purpose})
+		}
+	}
+	return manifest
+}
+
+// Mount registers the icons present, /site.webmanifest,
+// /service-worker.js and /offline.html on r, which should be the
+// engine: the service worker only controls the pages under its path.
+func (p *PWA) Mount(r gin.IRoutes) {
+	for _, icon := range pwaIcons {
+		name, ok := p.icon(icon.File)
+		if !ok {
+			continue
+		}
+		contentType := icon.Type
+		r.GET("/"+icon.File, func(c *gin.Context) {
+			data, err := fs.ReadFile(p.Files, name)
+			if err != nil {
+				c.AbortWithStatus(http.StatusNotFound)
+				return
+			}
+			c.Header("Cache-Control", "public, max-age=86400")
+			c.Data(http.StatusOK, contentType, data)
+		})
+	}
+	r.GET(PWAManifestPath, func(c *gin.Context) {
+		data, err := json.Marshal(p.Manifest())
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.Data(http.StatusOK, "application/manifest+json", data)
+	})
+	r.GET(PWAServiceWorkerPath, func(c *gin.Context) {
+		script, err := p.serviceWorker()
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		// browsers check for a new worker on every navigation
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Service-Worker-Allowed", "/")
+		c.Data(http.StatusOK, "text/javascript; charset=utf-8", script)
+	})
+	r.GET(PWAOfflinePath, func(c *gin.Context) {
+		page, err := p.offlinePage()
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+	})
+}
+
+// serviceWorker returns the script of the service-worker file, or the
+// generated one, caching the offline page, the icons and the precache
+// URLs under a cache named after the version, so a release replaces
+// them.
+func (p *PWA) serviceWorker() ([]byte, error) {
+	if p.Config.ServiceWorker != "" {
+		return fs.ReadFile(p.Files, strings.TrimPrefix(path.Clean("/"+p.Config.ServiceWorker), "/"))
+	}
+	precache := []string{PWAOfflinePath}
+	for _, icon := range pwaIcons {
+		if _, ok := p.icon(icon.File); ok {
+			precache = append(precache, "/"+icon.File)
+		}
+	}
+	precache = append(precache, p.Config.Precache...)
+	urls, err := json.Marshal(precache)
+	if err != nil {
+		return nil, err
+	}
+	cache, _ := json.Marshal("ghost-" + p.Name + "-" + p.Version)
+	offline, _ := json.Marshal(PWAOfflinePath)
+	return []byte(fmt.Sprintf(pwaServiceWorker, cache, offline, urls)), nil
+}
+
+const pwaServiceWorker = `const CACHE = %s;
+const OFFLINE = %s;
+const PRECACHE = %s;
+
+self.addEventListener("install", (event) => {
+  event.waitUntil(caches.open(CACHE).then((cache) => cache.addAll(PRECACHE)).then(() => self.skipWaiting()));
+});
+
+self.addEventListener("activate", (event) => {
+  event.waitUntil(caches.keys()
+    .then((keys) => Promise.all(keys.filter((key) => key.startsWith("ghost-") && key !== CACHE).map((key) => caches.delete(key))))
+    .then(() => self.clients.claim()));
+});
+
+self.addEventListener("fetch", (event) => {
+  if (event.request.method !== "GET") {
+    return;
+  }
+  if (event.request.mode === "navigate") {
+    event.respondWith(fetch(event.request).catch(() => caches.match(OFFLINE)));
+    return;
+  }
+  const url = new URL(event.request.url);
+  if (url.origin === self.location.origin && PRECACHE.includes(url.pathname)) {
+    event.respondWith(caches.match(event.request).then((cached) => cached || fetch(event.request)));
+  }
+});
+`
+
+// offlinePage returns the offline file, or a plain page with the name
+// and theme color.
+func (p *PWA) offlinePage() ([]byte, error) {
+	if p.Config.Offline != "" {
+		return fs.ReadFile(p.Files, strings.TrimPrefix(path.Clean("/"+p.Config.Offline), "/"))
+	}
+	name := template.HTMLEscapeString(p.Name)
+	color := template.HTMLEscapeString(p.Config.ThemeColor)
+	if color == "" {
+		color = "inherit"
+	}
+	return []byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>` + name + ` is offline</title>
+</head>
+<body style="font-family: system-ui, sans-serif; text-align: center; padding: 4rem 1rem">
+<h1 style="color: ` + color + `">` + name + `</h1>
+<p>You are offline. This page will work again once you are back online.</p>
+<button onclick="location.reload()">Retry</button>
+</body>
+</html>
+`), nil
+}
+
+// Head returns the tags linking the manifest and icons and registering
+// the service worker, for the head of the layout:
+//  <head>
+//    {{pwaHead}}
+//  </head>
+func (p *PWA) Head() template.HTML {
+	var b strings.Builder
+	b.WriteString(`<link rel="manifest" href="` + PWAManifestPath + `">`)
+	if p.Config.ThemeColor != "" {
+		b.WriteString(`<meta name="theme-color" content="` + template.HTMLEscapeString(p.Config.ThemeColor) + `">`)
+	}
+	if _, ok := p.icon("favicon.ico"); ok {
+		b.WriteString(`<link rel="icon" href="/favicon.ico" sizes="48x48">`)
+	}
+	if _, ok := p.icon("favicon.svg"); ok {
+		b.WriteString(`<link rel="icon" href="/favicon.svg" type="image/svg+xml">`)
+	}
+	if _, ok := p.icon("apple-touch-icon.png"); ok {
+		b.WriteString(`<link rel="apple-touch-icon" href="/apple-touch-icon.png">`)
+	}
+	b.WriteString(`<script>if ("serviceWorker" in navigator) navigator.serviceWorker.register("` + PWAServiceWorkerPath + `")</script>`)
+	return template.HTML(b.String())
+}
+
+// FuncMap returns the pwaHead template helper, installed by Setup.
+func (p *PWA) FuncMap() template.FuncMap {
+	return template.FuncMap{"pwaHead": p.Head}
+}
@@ -0,0 +1,473 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page is one page of a list, numbered from 1.
+type Page[T any] struct {
+	Items   []T `json:"items"`
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+}
+
+// Pages returns the number of pages, 0 for an empty list.
+func (p Page[T]) Pages() int {
+	if p.PerPage <= 0 {
+		return 0
+	}
+	return (p.Total + p.PerPage - 1) / p.PerPage
+}
+
+// Pagination returns the links to the other pages, built from u by
+// replacing its page query parameter.
+func (p Page[T]) Pagination(u *url.URL) Pagination {
+	return newPagination(u, p.Page, p.Pages(), p.Total)
+}
+
+// PageParams reads ?page= and ?per_page=, or ?size=, from the
+// request. page is at least 1 and perPage between 1 and maxPerPage,
+// defaultPerPage when not given.
+func PageParams(c *gin.Context, defaultPerPage, maxPerPage int) (page, perPage int) {
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return page, perPageParam(c, defaultPerPage, maxPerPage)
+}
+
+// CursorParams reads ?cursor= and ?per_page=, or ?size=, from the
+// request, see PageParams.
+func CursorParams(c *gin.Context, defaultPerPage, maxPerPage int) (cursor string, perPage int) {
+	return c.Query("cursor"), perPageParam(c, defaultPerPage, maxPerPage)
+}
+
+func perPageParam(c *gin.Context, defaultPerPage, maxPerPage int) int {
+	value := c.Query("per_page")
+	if value == "" {
+		value = c.Query("size")
+	}
+	perPage, err := strconv.Atoi(value)
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if maxPerPage > 0 && perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	return perPage
+}
+
+// Paginate runs q for page, counting the rows q matches without its
+// limit. The page is applied to a copy, q is left as given.
+//
+// Example:
+//  page, perPage := ghostutils.PageParams(c, 20, 100)
+//  posts, err := ghostutils.Paginate[Post](db, ghostutils.Select().From("post").OrderByDesc("created_at"), page, perPage)
+//
+// Returns:
+//  Page[T] with the rows and the total
+//  error if a query fails
+func Paginate[T any](db GhostDB, q *SelectQuery, page, perPage int) (Page[T], error) {
+	if page < 1 {
+		page = 1
+	}
+	result := Page[T]{Page: page, PerPage: perPage}
+	var err error
+	if result.Total, err = countRows(db, q); err != nil {
+		return result, err
+	}
+	if result.Items, err = QueryAll[T](db, q.Clone().Limit(perPage).Start((page-1)*perPage)); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// PaginateContext is Paginate ended with ctx, see WithContext.
+func PaginateContext[T any](ctx context.Context, db GhostDB, q *SelectQuery, page, perPage int) (Page[T], error) {
+	return Paginate[T](WithContext(ctx, db), q, page, perPage)
+}
+
+// countRows counts the rows q matches without its order and limit.
+func countRows(db GhostDB, q *SelectQuery) (int, error) {
+	counting := *q
+	counting.orderBy, counting.fetch, counting.graph, counting.limit, counting.start = nil, nil, nil, 0, 0
+	sql, vars, err := counting.Build()
+	if err != nil {
+		return 0, err
+	}
+	total, _, err := surrealFirst[struct {
+		Total int `json:"total"`
+	}](db, "SELECT count() AS total FROM ("+sql+") GROUP ALL", vars)
+	return total.Total, err
+}
+
+// CursorPage is a page of a list walked by cursors, which unlike page
+// numbers stay stable while rows are inserted. Next and Prev are the
+// cursors of the neighbouring pages, empty at the ends.
+type CursorPage[T any] struct {
+	Items   []T    `json:"items"`
+	PerPage int    `json:"per_page"`
+	Total   int    `json:"total"`
+	Next    string `json:"next_cursor,omitempty"`
+	Prev    string `json:"prev_cursor,omitempty"`
+}
+
+// pageCursor is the position a cursor encodes: the sort field and id
+// of a row, and whether the page is the one before it.
+type pageCursor struct {
+	Value  interface{} `json:"v"`
+	ID     string      `json:"id"`
+	Before bool        `json:"b,omitempty"`
+}
+
+// ErrInvalidCursor is returned by PaginateCursor for a cursor it did
+// not make.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(cursor pageCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// PaginateCursor runs q for the perPage rows after cursor, or before
+// it for a Prev cursor, ordered by field then id, descending with
+// desc. The first page has an empty cursor. Rows must have an id, and
+// field must be part of them; q's order and limit are replaced.
+// Datetime fields are compared as datetimes.
+//
+// Example:
+//  cursor, perPage := ghostutils.CursorParams(c, 20, 100)
+//  posts, err := ghostutils.PaginateCursor[Post](db, ghostutils.Select().From("post"), "created_at", true, cursor, perPage)
+//  if err != nil {
+//      ghostutils.Fail(c, err)
+//      return
+//  }
+//  ghostutils.RespondPage(c, posts.Envelope(c.Request.URL))
+//
+// Returns:
+//  CursorPage[T] with the rows, the total and the cursors
+//  error if a query fails, ErrInvalidCursor for a malformed cursor
+func PaginateCursor[T any](db GhostDB, q *SelectQuery, field string, desc bool, cursor string, perPage int) (CursorPage[T], error) {
+	return paginateCursor[T](db, q, field, desc, cursor, perPage, -1)
+}
+
+// paginateCursor is PaginateCursor with the total of the list, counted
+// when negative.
+func paginateCursor[T any](db GhostDB, q *SelectQuery, field string, desc bool, cursor string, perPage, total int) (CursorPage[T], error) {
+	result := CursorPage[T]{PerPage: perPage, Total: total}
+	var position pageCursor
+	if cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || json.Unmarshal(raw, &position) != nil || position.ID == "" {
+			return result, ErrInvalidCursor
+		}
+	}
+	paged := q.Clone()
+	paged.orderBy = nil
+	// walking back reverses the order, the rows are reversed after
+	descending := desc != position.Before
+	if descending {
+		paged.OrderByDesc(field)
+	} else {
+		paged.OrderBy(field)
+	}
+	if field != "id" {
+		if descending {
+			paged.OrderByDesc("id")
+		} else {
+			paged.OrderBy("id")
+		}
+	}
+	if cursor != "" {
+		op := ">"
+		if descending {
+			op = "<"
+		}
+		value := "$cursor_value"
+		if text, ok := position.Value.(string); ok {
+			if _, err := time.Parse(time.RFC3339Nano, text); err == nil {
+				value = "<datetime>$cursor_value"
+			}
+		}
+		if field == "id" {
+			paged.Where("id "+op+" type::thing($cursor_id)").Bind("cursor_id", position.ID)
+		} else {
+			paged.Where(fmt.Sprintf("(%s %s %s OR (%s = %s AND id %s type::thing($cursor_id)))", field, op, value, field, value, op)).
+				Bind("cursor_value", position.Value).
+				Bind("cursor_id", position.ID)
+		}
+	}
+	var err error
+	if total < 0 {
+		if result.Total, err = countRows(db, q); err != nil {
+			return result, err
+		}
+	}
+	rows, err := QueryAll[T](db, paged.Limit(perPage+1).Start(0))
+	if err != nil {
+		return result, err
+	}
+	more := len(rows) > perPage
+	if more {
+		rows = rows[:perPage]
+	}
+	if position.Before {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	result.Items = rows
+	if len(rows) == 0 {
+		return result, nil
+	}
+	at := func(row T, before bool) (string, error) {
+		raw, err := json.Marshal(row)
+		if err != nil {
+			return "", err
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return "", err
+		}
+		id, _ := fields["id"].(string)
+		if id == "" {
+			return "", errors.New("cursor pagination needs rows with an id")
+		}
+		return encodeCursor(pageCursor{Value: fields[field], ID: id, Before: before}), nil
+	}
+	if more || position.Before {
+		if result.Next, err = at(rows[len(rows)-1], false); err != nil {
+			return result, err
+		}
+	}
+	if cursor != "" && (more || !position.Before) {
+		if result.Prev, err = at(rows[0], true); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// PaginateCursorContext is PaginateCursor ended with ctx.
+func PaginateCursorContext[T any](ctx context.Context, db GhostDB, q *SelectQuery, field string, desc bool, cursor string, perPage int) (CursorPage[T], error) {
+	return PaginateCursor[T](WithContext(ctx, db), q, field, desc, cursor, perPage)
+}
+
+// PageEnvelope is the body of a paginated API response, with the
+// links to the neighbouring pages.
+type PageEnvelope[T any] struct {
+	Items   []T `json:"items"`
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	// Page and Pages are set for numbered pages.
+	Page  int           `json:"page,omitempty"`
+	Pages int           `json:"pages,omitempty"`
+	Links EnvelopeLinks `json:"links"`
+}
+
+// EnvelopeLinks are the links of a PageEnvelope, empty when there is
+// no such page.
+type EnvelopeLinks struct {
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
+// Envelope returns the page with its links, built from u.
+func (p Page[T]) Envelope(u *url.URL) PageEnvelope[T] {
+	links := p.Pagination(u)
+	return PageEnvelope[T]{
+		Items:   nonNilItems(p.Items),
+		Total:   p.Total,
+		PerPage: p.PerPage,
+		Page:    p.Page,
+		Pages:   links.Pages,
+		Links:   EnvelopeLinks{First: links.First, Prev: links.Prev, Next: links.Next, Last: links.Last},
+	}
+}
+
+// Envelope returns the page with its links, built from u by replacing
+// its cursor query parameter.
+func (p CursorPage[T]) Envelope(u *url.URL) PageEnvelope[T] {
+	link := func(cursor string) string {
+		query := u.Query()
+		query.Del("page")
+		query.Del("cursor")
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		target := *u
+		target.RawQuery = query.Encode()
+		return target.String()
+	}
+	envelope := PageEnvelope[T]{Items: nonNilItems(p.Items), Total: p.Total, PerPage: p.PerPage}
+	envelope.Links.First = link("")
+	if p.Prev != "" {
+		envelope.Links.Prev = link(p.Prev)
+	}
+	if p.Next != "" {
+		envelope.Links.Next = link(p.Next)
+	}
+	return envelope
+}
+
+func nonNilItems[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
+
+// RespondPage answers 200 with envelope, setting the Link and
+// X-Total-Count headers as SetPageLinks does.
+//
+// Example:
+//  page, perPage := ghostutils.PageParams(c, 20, 100)
+//  posts, err := repo.Page(c, page, perPage)
+//  if err != nil {
+//      ghostutils.Fail(c, err)
+//      return
+//  }
+//  ghostutils.RespondPage(c, posts.Envelope(c.Request.URL))
+func RespondPage[T any](c *gin.Context, envelope PageEnvelope[T]) {
+	SetPageLinks(c, Pagination{
+		Total: envelope.Total,
+		First: envelope.Links.First,
+		Prev:  envelope.Links.Prev,
+		Next:  envelope.Links.Next,
+		Last:  envelope.Links.Last,
+	})
+	c.JSON(http.StatusOK, envelope)
+}
+
+// Pagination holds the links of a paginated list, for templates and
+// Link headers. Empty URLs mean there is no such page.
+type Pagination struct {
+	Page  int
+	Pages int
+	Total int
+	First string
+	Prev  string
+	Next  string
+	Last  string
+	// Links are the numbered links around the current page; a Gap
+	// stands for the pages left out.
+	Links []PageLink
+}
+
+// PageLink is a numbered link of a Pagination.
+type PageLink struct {
+	Number  int
+	URL     string
+	Current bool
+	Gap     bool
+}
+
+// paginationWindow is the number of pages linked on each side of the
+// current one.
+const paginationWindow = 2
+
+func newPagination(u *url.URL, page, pages, total int) Pagination {
+	p := Pagination{Page: page, Pages: pages, Total: total}
+	if pages == 0 {
+		return p
+	}
+	link := func(n int) string {
+		query := u.Query()
+		query.Set("page", strconv.Itoa(n))
+		target := *u
+		target.RawQuery = query.Encode()
+		return target.String()
+	}
+	p.First, p.Last = link(1), link(pages)
+	if page > 1 {
+		p.Prev = link(page - 1)
+		if page > pages {
+			p.Prev = link(pages)
+		}
+	}
+	if page < pages {
+		p.Next = link(page + 1)
+	}
+	for n := 1; n <= pages; n++ {
+		edge := n == 1 || n == pages
+		near := n >= page-paginationWindow && n <= page+paginationWindow
+		// a gap would hide a single page, link it instead
+		single := (n == 2 && page-paginationWindow == 3) || (n == pages-1 && page+paginationWindow == pages-2)
+		if edge || near || single {
+			p.Links = append(p.Links, PageLink{Number: n, URL: link(n), Current: n == page})
+		} else if len(p.Links) > 0 && !p.Links[len(p.Links)-1].Gap {
+			p.Links = append(p.Links, PageLink{Gap: true})
+		}
+	}
+	return p
+}
+
+// SetPageLinks sets the Link header of an API response to the first,
+// previous, next and last pages, and X-Total-Count to the total.
+//
+// Example:
+//  ghostutils.SetPageLinks(c, posts.Pagination(c.Request.URL))
+//  c.JSON(http.StatusOK, posts)
+func SetPageLinks(c *gin.Context, p Pagination) {
+	var links []string
+	for _, rel := range []struct{ name, url string }{
+		{"first", p.First}, {"prev", p.Prev}, {"next", p.Next}, {"last", p.Last},
+	} {
+		if rel.url != "" {
+			links = append(links, fmt.Sprintf("<%s>; rel=%q", rel.url, rel.name))
+		}
+	}
+	if len(links) > 0 {
+		c.Header("Link", strings.Join(links, ", "))
+	}
+	c.Header("X-Total-Count", strconv.Itoa(p.Total))
+}
+
+// PaginationFuncMap returns the template helper rendering pagination
+// controls. Add it before loading the templates.
+//
+// Example:
+//  r.SetFuncMap(ghostutils.PaginationFuncMap())
+//  r.LoadHTMLGlob(ghostConfig.Views + "/**/*")
+//
+//  // posts.html: {{pagination .Pagination}}
+func PaginationFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"pagination": func(p Pagination) (template.HTML, error) {
+			if p.Pages <= 1 {
+				return "", nil
+			}
+			var out bytes.Buffer
+			if err := paginationTemplate.Execute(&out, p); err != nil {
+				return "", err
+			}
+			return template.HTML(out.String()), nil
+		},
+	}
+}
+
+var paginationTemplate = template.Must(template.New("pagination").Parse(`<nav class="pagination" aria-label="Pagination">
+{{if .Prev}}<a class="pagination-prev" href="{{.Prev}}" rel="prev">Previous</a>{{else}}<span class="pagination-prev disabled">Previous</span>{{end}}
+<ul>
+{{range .Links}}{{if .Gap}}<li><span class="pagination-gap">&hellip;</span></li>
+{{else if .Current}}<li><span class="pagination-current" aria-current="page">{{.Number}}</span></li>
+{{else}}<li><a href="{{.URL}}">{{.Number}}</a></li>
+{{end}}{{end}}</ul>
+{{if .Next}}<a class="pagination-next" href="{{.Next}}" rel="next">Next</a>{{else}}<span class="pagination-next disabled">Next</span>{{end}}
+</nav>`))
@@ -0,0 +1,319 @@
+package ghostutils
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// PasskeyChallengeCookie holds the id of the pending ceremony.
+const PasskeyChallengeCookie = "ghost_webauthn"
+
+// ErrPasskeyChallenge is returned when a ceremony is finished without
+// a matching, unexpired challenge.
+var ErrPasskeyChallenge = errors.New("passkey challenge missing or expired")
+
+// WebAuthnConfig is the `webauthn:` block of ghost.yaml.
+//
+// Example:
+//  webauthn:
+//    rp-id: example.com
+//    rp-display-name: Example
+//    rp-origins: ["https://example.com"]
+//    attestation: none
+//    resident-key: required
+//    user-verification: preferred
+//    timeout: 5m
+type WebAuthnConfig struct {
+	RPID             string        `yaml:"rp-id"`
+	RPDisplayName    string        `yaml:"rp-display-name"`
+	RPOrigins        []string      `yaml:"rp-origins"`
+	Attestation      string        `yaml:"attestation"`
+	Attachment       string        `yaml:"authenticator-attachment"`
+	ResidentKey      string        `yaml:"resident-key"`
+	UserVerification string        `yaml:"user-verification"`
+	Timeout          time.Duration `yaml:"timeout"`
+}
+
+// PasskeyUser is the account a passkey is registered to. ID is the
+// SurrealDB record id of the user, e.g. "user:tobie".
+type PasskeyUser struct {
+	ID          string
+	Name        string
+	DisplayName string
+	Credentials []webauthn.Credential
+}
+
+func (u PasskeyUser) WebAuthnID() []byte                         { return []byte(u.ID) }
+func (u PasskeyUser) WebAuthnName() string                       { return u.Name }
+func (u PasskeyUser) WebAuthnDisplayName() string                { return u.DisplayName }
+func (u PasskeyUser) WebAuthnIcon() string                       { return "" }
+func (u PasskeyUser) WebAuthnCredentials() []webauthn.Credential { return u.Credentials }
+
+// Passkeys serves the WebAuthn registration and login ceremonies.
+// Challenges and credentials are stored in SurrealDB.
+type Passkeys struct {
+	WebAuthn *webauthn.WebAuthn
+	DB       *surrealdb.DB
+	// CurrentUser returns the signed in user a new passkey is
+	// registered for.
+	CurrentUser func(c *gin.Context) (PasskeyUser, error)
+	// OnLogin is called with the user record id after a successful
+	// login, and is expected to establish the session.
+	OnLogin func(c *gin.Context, userID string) error
+	// CredentialTable and ChallengeTable default to
+	// "webauthn_credential" and "webauthn_challenge".
+	CredentialTable string
+	ChallengeTable  string
+	Timeout         time.Duration
+	Secure          bool
+}
+
+type passkeyCredential struct {
+	ID           string              `json:"id,omitempty"`
+	User         string              `json:"user"`
+	CredentialID string              `json:"credential_id"`
+	Credential   webauthn.Credential `json:"credential"`
+	CreatedAt    time.Time           `json:"created_at"`
+	LastUsedAt   time.Time           `json:"last_used_at"`
+}
+
+type passkeyChallenge struct {
+	ID      string               `json:"id,omitempty"`
+	Session webauthn.SessionData `json:"session"`
+}
+
+// Passkeys builds the WebAuthn ceremonies from the webauthn block
+// of the config.
+//
+// Example:
+//  passkeys, err := ghostConfig.Passkeys(db)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  passkeys.CurrentUser = currentUser
+//  passkeys.OnLogin = startSession
+//  passkeys.Mount(r.Group("/auth/passkeys"))
+//
+// Returns:
+//  *Passkeys
+//  error if the relying party configuration is invalid
+func (ghostConfig GhostConfig) Passkeys(db *surrealdb.DB) (*Passkeys, error) {
+	cfg := ghostConfig.WebAuthn
+	displayName := cfg.RPDisplayName
+	if displayName == "" {
+		displayName = ghostConfig.Name
+	}
+	var requireResident *bool
+	if cfg.ResidentKey == string(protocol.ResidentKeyRequirementRequired) {
+		required := true
+		requireResident = &required
+	}
+	selection := webauthn.SelectAuthenticator(cfg.Attachment, requireResident, cfg.UserVerification)
+	selection.ResidentKey = protocol.ResidentKeyRequirement(cfg.ResidentKey)
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:                   cfg.RPID,
+		RPDisplayName:          displayName,
+		RPOrigins:              cfg.RPOrigins,
+		AttestationPreference:  protocol.ConveyancePreference(cfg.Attestation),
+		AuthenticatorSelection: selection,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Passkeys{WebAuthn: w, DB: db, Timeout: cfg.Timeout}, nil
+}
+
+// Mount registers the ceremony endpoints on g:
+//  POST register/begin
+//  POST register/finish
+//  POST login/begin
+//  POST login/finish
+func (p *Passkeys) Mount(g *gin.RouterGroup) {
+	g.POST("/register/begin", p.beginRegistration)
+	g.POST("/register/finish", p.finishRegistration)
+	g.POST("/login/begin", p.beginLogin)
+	g.POST("/login/finish", p.finishLogin)
+}
+
+// Credentials returns the passkeys registered to userID.
+func (p *Passkeys) Credentials(userID string) ([]webauthn.Credential, error) {
+	rows, err := surrealQuery[passkeyCredential](p.DB,
+		"SELECT * FROM type::table($tb) WHERE user = $user",
+		map[string]interface{}{"tb": p.credentialTable(), "user": userID})
+	if err != nil {
+		return nil, err
+	}
+	creds := make([]webauthn.Credential, 0, len(rows))
+	for _, row := range rows {
+		creds = append(creds, row.Credential)
+	}
+	return creds, nil
+}
+
+func (p *Passkeys) beginRegistration(c *gin.Context) {
+	user, err := p.CurrentUser(c)
+	if err != nil {
+		FailStatus(c, http.StatusUnauthorized, err)
+		return
+	}
+	if user.Credentials, err = p.Credentials(user.ID); err != nil {
+		Fail(c, err)
+		return
+	}
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.Credentials))
+	for _, cred := range user.Credentials {
+		exclusions = append(exclusions, cred.Descriptor())
+	}
+	options, session, err := p.WebAuthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	if err := p.saveChallenge(c, session); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, options)
+}
+
+func (p *Passkeys) finishRegistration(c *gin.Context) {
+	user, err := p.CurrentUser(c)
+	if err != nil {
+		FailStatus(c, http.StatusUnauthorized, err)
+		return
+	}
+	session, err := p.takeChallenge(c)
+	if err != nil {
+		FailStatus(c, http.StatusBadRequest, err)
+		return
+	}
+	cred, err := p.WebAuthn.FinishRegistration(user, session, c.Request)
+	if err != nil {
+		FailStatus(c, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now().UTC()
+	if _, err := p.DB.Create(p.credentialTable(), passkeyCredential{
+		User:         user.ID,
+		CredentialID: base64.RawURLEncoding.EncodeToString(cred.ID),
+		Credential:   *cred,
+		CreatedAt:    now,
+		LastUsedAt:   now,
+	}); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"credential_id": base64.RawURLEncoding.EncodeToString(cred.ID)})
+}
+
+func (p *Passkeys) beginLogin(c *gin.Context) {
+	options, session, err := p.WebAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	if err := p.saveChallenge(c, session); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, options)
+}
+
+func (p *Passkeys) finishLogin(c *gin.Context) {
+	session, err := p.takeChallenge(c)
+	if err != nil {
+		FailStatus(c, http.StatusBadRequest, err)
+		return
+	}
+	parsed, err := protocol.ParseCredentialRequestResponse(c.Request)
+	if err != nil {
+		FailStatus(c, http.StatusBadRequest, err)
+		return
+	}
+	var userID string
+	cred, err := p.WebAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID = string(userHandle)
+		creds, err := p.Credentials(userID)
+		return PasskeyUser{ID: userID, Credentials: creds}, err
+	}, session, parsed)
+	if err != nil {
+		FailStatus(c, http.StatusUnauthorized, err)
+		return
+	}
+	if _, err := p.DB.Query(
+		"UPDATE type::table($tb) SET credential.Authenticator.SignCount = $count, last_used_at = time::now() WHERE credential_id = $cid",
+		map[string]interface{}{
+			"tb":    p.credentialTable(),
+			"count": cred.Authenticator.SignCount,
+			"cid":   base64.RawURLEncoding.EncodeToString(cred.ID),
+		},
+	); err != nil {
+		Fail(c, err)
+		return
+	}
+	if p.OnLogin != nil {
+		if err := p.OnLogin(c, userID); err != nil {
+			FailStatus(c, http.StatusUnauthorized, err)
+			return
+		}
+	}
+	if !c.Writer.Written() {
+		c.JSON(http.StatusOK, gin.H{"user": userID})
+	}
+}
+
+func (p *Passkeys) saveChallenge(c *gin.Context, session *webauthn.SessionData) error {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	if session.Expires.IsZero() {
+		session.Expires = time.Now().Add(timeout)
+	}
+	id := randomID(16)
+	if _, err := p.DB.Create(recordID(p.challengeTable(), id), passkeyChallenge{Session: *session}); err != nil {
+		return err
+	}
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(PasskeyChallengeCookie, id, int(timeout.Seconds()), "/", "", p.Secure, true)
+	return nil
+}
+
+func (p *Passkeys) takeChallenge(c *gin.Context) (webauthn.SessionData, error) {
+	id, err := c.Cookie(PasskeyChallengeCookie)
+	if err != nil || id == "" {
+		return webauthn.SessionData{}, ErrPasskeyChallenge
+	}
+	c.SetCookie(PasskeyChallengeCookie, "", -1, "/", "", p.Secure, true)
+	thing := recordID(p.challengeTable(), id)
+	challenge, err := surrealdb.SmartUnmarshal[passkeyChallenge](p.DB.Select(thing))
+	if err != nil {
+		return webauthn.SessionData{}, ErrPasskeyChallenge
+	}
+	p.DB.Delete(thing)
+	if time.Now().After(challenge.Session.Expires) {
+		return webauthn.SessionData{}, ErrPasskeyChallenge
+	}
+	return challenge.Session, nil
+}
+
+func (p *Passkeys) credentialTable() string {
+	if p.CredentialTable == "" {
+		return "webauthn_credential"
+	}
+	return p.CredentialTable
+}
+
+func (p *Passkeys) challengeTable() string {
+	if p.ChallengeTable == "" {
+		return "webauthn_challenge"
+	}
+	return p.ChallengeTable
+}
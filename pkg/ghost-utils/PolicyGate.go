@@ -0,0 +1,187 @@
+package ghostutils
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// PolicyConfig is the `policy:` block of ghost.yaml.
+//
+// Example:
+//  policy:
+//    version: "2024-06-01"
+//    accept-path: /legal/accept
+//    exempt: ["/static", "/legal", "/logout"]
+type PolicyConfig struct {
+	Version    string   `yaml:"version"`
+	AcceptPath string   `yaml:"accept-path"`
+	Exempt     []string `yaml:"exempt"`
+}
+
+// PolicyGate makes authenticated users accept the current policy
+// version before using the app, and records every acceptance.
+type PolicyGate struct {
+	DB         *surrealdb.DB
+	Version    string
+	AcceptPath string
+	Exempt     []string
+	// Table defaults to "policy_acceptance".
+	Table    string
+	accepted sync.Map
+}
+
+type policyAcceptance struct {
+	User       string    `json:"user"`
+	Version    string    `json:"version"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+// PolicyGate builds a gate from the policy block of the config.
+//
+// Example:
+//  gate := ghostConfig.PolicyGate(db)
+//  r.Use(auth, gate.Middleware())
+//  r.GET("/legal/accept", showTerms)
+//  r.POST("/legal/accept", gate.AcceptHandler())
+func (ghostConfig GhostConfig) PolicyGate(db *surrealdb.DB) *PolicyGate {
+	return &PolicyGate{
+		DB:         db,
+		Version:    ghostConfig.Policy.Version,
+		AcceptPath: ghostConfig.Policy.AcceptPath,
+		Exempt:     ghostConfig.Policy.Exempt,
+	}
+}
+
+func (g *PolicyGate) table() string {
+	if g.Table == "" {
+		return "policy_acceptance"
+	}
+	return g.Table
+}
+
+func (g *PolicyGate) acceptPath() string {
+	if g.AcceptPath == "" {
+		return "/legal/accept"
+	}
+	return g.AcceptPath
+}
+
+// Accepted reports whether user accepted the current version.
+func (g *PolicyGate) Accepted(user string) (bool, error) {
+	cacheKey := user + "|" + g.Version
+	if _, ok := g.accepted.Load(cacheKey); ok {
+		return true, nil
+	}
+	_, ok, err := surrealFirst[policyAcceptance](g.DB,
+		"SELECT * FROM type::table($tb) WHERE user = $user AND version = $version LIMIT 1",
+		map[string]interface{}{"tb": g.table(), "user": user, "version": g.Version})
+	if ok {
+		g.accepted.Store(cacheKey, true)
+	}
+	return ok, err
+}
+
+// Middleware redirects authenticated users who have not accepted
+// the current version to the accept path. JSON clients receive a 403
+// instead. Anonymous requests and exempt paths pass through.
+func (g *PolicyGate) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, ok := CurrentIdentity(c)
+		if !ok || g.Version == "" || g.exempt(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		accepted, err := g.Accepted(identity.ID)
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		if accepted {
+			c.Next()
+			return
+		}
+		if c.Request.Method != http.MethodGet || c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+			Fail(c, NewGhostError(http.StatusForbidden, "policy_required", "policy acceptance required").WithDetails(gin.H{
+				"version":     g.Version,
+				"accept_path": g.acceptPath(),
+			}))
+			return
+		}
+		c.Redirect(http.StatusSeeOther, g.acceptPath()+"?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+		c.Abort()
+	}
+}
+
+// AcceptHandler records acceptance of the current version for the
+// authenticated user and redirects to the "next" form value.
+func (g *PolicyGate) AcceptHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, ok := CurrentIdentity(c)
+		if !ok {
+			Fail(c, NewGhostError(http.StatusUnauthorized, "unauthenticated", "authentication required"))
+			return
+		}
+		if Impersonating(c) {
+			Fail(c, NewGhostError(http.StatusForbidden, "forbidden", "not allowed while impersonating"))
+			return
+		}
+		if _, err := g.DB.Create(g.table(), policyAcceptance{
+			User:       identity.ID,
+			Version:    g.Version,
+			IP:         c.ClientIP(),
+			UserAgent:  c.Request.UserAgent(),
+			AcceptedAt: time.Now().UTC(),
+		}); err != nil {
+			Fail(c, err)
+			return
+		}
+		g.accepted.Store(identity.ID+"|"+g.Version, true)
+		next := c.PostForm("next")
+		if next == "" {
+			next = c.Query("next")
+		}
+		if !localRedirect(next) {
+			next = "/"
+		}
+		if c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+			c.JSON(http.StatusOK, gin.H{"version": g.Version, "next": next})
+			return
+		}
+		c.Redirect(http.StatusSeeOther, next)
+	}
+}
+
+// exempt reports whether path is the accept path or one of the
+// exempt paths or below it: "/legal" exempts "/legal" and
+// "/legal/terms" but not "/legalese".
+func (g *PolicyGate) exempt(path string) bool {
+	if path == g.acceptPath() {
+		return true
+	}
+	for _, prefix := range g.Exempt {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// localRedirect reports whether target is a path on this site, safe
+// to redirect to. Browsers read "//host" and "/\host" as other hosts,
+// so neither a second slash nor any backslash is allowed.
+func localRedirect(target string) bool {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.ContainsAny(target, "\\\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(target)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
@@ -0,0 +1,298 @@
+package ghostutils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// PreferencesKey is the gin context key holding the preferences of
+// the request.
+const PreferencesKey = "ghost-preferences"
+
+// StandardPreferences is a ready made preference schema. Apps with
+// more preferences embed it in their own struct.
+type StandardPreferences struct {
+	// Theme is e.g. "light", "dark" or "system".
+	Theme    string `json:"theme"`
+	Locale   string `json:"locale"`
+	Timezone string `json:"timezone"`
+	// Notifications turns notification kinds on and off by name.
+	Notifications map[string]bool `json:"notifications,omitempty"`
+}
+
+// Location returns the timezone, UTC when it is unset or unknown.
+func (p StandardPreferences) Location() *time.Location {
+	if p.Timezone != "" {
+		if location, err := time.LoadLocation(p.Timezone); err == nil {
+			return location
+		}
+	}
+	return time.UTC
+}
+
+// LocaleName implements LocalePreference.
+func (p StandardPreferences) LocaleName() string {
+	return p.Locale
+}
+
+// TimezoneName implements TimezonePreference.
+func (p StandardPreferences) TimezoneName() string {
+	return p.Timezone
+}
+
+// Notify reports whether notifications of kind are on, the default
+// when the user did not choose.
+func (p StandardPreferences) Notify(kind string, fallback bool) bool {
+	if on, ok := p.Notifications[kind]; ok {
+		return on
+	}
+	return fallback
+}
+
+// Preferences stores per-user preferences of the schema T, a struct
+// with JSON tags. Signed in users keep theirs in the preference table,
+// anonymous visitors in a cookie; on sign in the cookie is used until
+// the user saves preferences of their own. Stored preferences are
+// decoded over Defaults, so fields added later get their default.
+//
+// Example:
+//  prefs := ghostutils.NewPreferences(db, ghostutils.StandardPreferences{Theme: "system", Locale: "en"})
+//  prefs.Signer = ghostConfig.Signer()
+//  r.Use(auth.Middleware(), prefs.Middleware())
+//  prefs.Mount(r.Group("/"))
+//  layout.Provide("Preferences", prefs.Layout)
+//
+//  tz := ghostutils.CurrentPreferences[ghostutils.StandardPreferences](c).Location()
+//
+//  <html data-theme="{{.Layout.Preferences.Theme}}">
+type Preferences[T any] struct {
+	DB       *surrealdb.DB
+	Defaults T
+	// Validate checks preferences before they are saved, e.g. that the
+	// theme is a known one. Its error answers 422.
+	Validate func(prefs *T) error
+	// Signer signs the cookie of anonymous visitors. Without one the
+	// cookie is plain JSON, so only use unsigned cookies for values
+	// that are validated.
+	Signer *Signer
+	// Table defaults to "preference", CookieName to "ghost_prefs",
+	// MaxAge to one year.
+	Table      string
+	CookieName string
+	MaxAge     time.Duration
+	Secure     bool
+}
+
+// preferencesTokenPurpose is the purpose the cookie of anonymous
+// visitors is signed for.
+const preferencesTokenPurpose = "preferences"
+
+// NewPreferences returns the preferences stored in db.
+func NewPreferences[T any](db *surrealdb.DB, defaults T) *Preferences[T] {
+	return &Preferences[T]{DB: db, Defaults: defaults}
+}
+
+func (p *Preferences[T]) table() string {
+	if p.Table == "" {
+		return "preference"
+	}
+	return p.Table
+}
+
+func (p *Preferences[T]) cookieName() string {
+	if p.CookieName == "" {
+		return "ghost_prefs"
+	}
+	return p.CookieName
+}
+
+func (p *Preferences[T]) maxAge() time.Duration {
+	if p.MaxAge == 0 {
+		return 365 * 24 * time.Hour
+	}
+	return p.MaxAge
+}
+
+// defaults returns a deep copy of Defaults, so decoding over it never
+// changes the maps and slices it shares.
+func (p *Preferences[T]) defaults() T {
+	var prefs T
+	raw, err := json.Marshal(p.Defaults)
+	if err == nil {
+		json.Unmarshal(raw, &prefs)
+	}
+	return prefs
+}
+
+// Middleware loads the preferences of the request for
+// CurrentPreferences. It must run after the middleware setting the
+// Identity.
+func (p *Preferences[T]) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		prefs, err := p.Load(c)
+		if err != nil {
+			c.Error(err)
+		}
+		c.Set(PreferencesKey, prefs)
+		c.Next()
+	}
+}
+
+// Load returns the preferences of the caller: stored ones for signed
+// in users, else those of the cookie, else Defaults.
+func (p *Preferences[T]) Load(c *gin.Context) (T, error) {
+	prefs := p.defaults()
+	if identity, ok := CurrentIdentity(c); ok && p.DB != nil {
+		stored, found, err := surrealFirst[map[string]interface{}](p.DB, "SELECT VALUE data FROM type::thing($tb, $id)", map[string]interface{}{
+			"tb": p.table(),
+			"id": identity.ID,
+		})
+		if err != nil {
+			return prefs, err
+		}
+		if found && stored != nil {
+			raw, err := json.Marshal(stored)
+			if err == nil {
+				err = json.Unmarshal(raw, &prefs)
+			}
+			return prefs, err
+		}
+	}
+	token, err := c.Cookie(p.cookieName())
+	if err != nil || token == "" {
+		return prefs, nil
+	}
+	var decoded T
+	if p.Signer != nil {
+		err = p.Signer.VerifyToken(preferencesTokenPurpose, token, &decoded)
+	} else {
+		var raw []byte
+		raw, err = base64.RawURLEncoding.DecodeString(token)
+		if err == nil {
+			err = json.Unmarshal(raw, &decoded)
+		}
+	}
+	if err != nil {
+		// a stale or tampered cookie is treated as no cookie
+		return prefs, nil
+	}
+	raw, err := json.Marshal(decoded)
+	if err != nil {
+		return prefs, err
+	}
+	// decode over the defaults again so missing fields keep theirs
+	err = json.Unmarshal(raw, &prefs)
+	return prefs, err
+}
+
+// ErrPreferencesInvalid wraps the errors of Preferences.Validate.
+var ErrPreferencesInvalid = errors.New("invalid preferences")
+
+// Save stores prefs for the caller, in the database for signed in
+// users and in the cookie otherwise, and makes them the request's.
+// Errors of Validate are wrapped in ErrPreferencesInvalid.
+func (p *Preferences[T]) Save(c *gin.Context, prefs T) error {
+	if p.Validate != nil {
+		if err := p.Validate(&prefs); err != nil {
+			return fmt.Errorf("%w: %v", ErrPreferencesInvalid, err)
+		}
+	}
+	if identity, ok := CurrentIdentity(c); ok && p.DB != nil {
+		_, err := surrealQuery[map[string]interface{}](p.DB, "UPDATE type::thing($tb, $id) CONTENT { user: $user, data: $data, updated_at: time::now() }", map[string]interface{}{
+			"tb":   p.table(),
+			"id":   identity.ID,
+			"user": identity.ID,
+			"data": prefs,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		var token string
+		if p.Signer != nil {
+			signed, err := p.Signer.SignToken(preferencesTokenPurpose, prefs, p.maxAge())
+			if err != nil {
+				return err
+			}
+			token = signed
+		} else {
+			raw, err := json.Marshal(prefs)
+			if err != nil {
+				return err
+			}
+			token = base64.RawURLEncoding.EncodeToString(raw)
+		}
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(p.cookieName(), token, int(p.maxAge().Seconds()), "/", "", p.Secure, true)
+	}
+	c.Set(PreferencesKey, prefs)
+	return nil
+}
+
+// CurrentPreferences returns the preferences loaded by the middleware
+// of Preferences[T], the zero T without it.
+func CurrentPreferences[T any](c *gin.Context) T {
+	value, _ := c.Get(PreferencesKey)
+	prefs, _ := value.(T)
+	return prefs
+}
+
+// Layout provides the preferences of the request to templates.
+func (p *Preferences[T]) Layout(c *gin.Context) (interface{}, error) {
+	if prefs, ok := c.Get(PreferencesKey); ok {
+		return prefs, nil
+	}
+	return p.Load(c)
+}
+
+// Mount registers the preference endpoints on g:
+//  GET   /preferences  the caller's preferences
+//  PATCH /preferences  merge the fields of the JSON or form body
+// Form posts redirect back to the referring page.
+func (p *Preferences[T]) Mount(g *gin.RouterGroup) {
+	g.GET("/preferences", func(c *gin.Context) {
+		prefs, err := p.Load(c)
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, prefs)
+	})
+	update := func(c *gin.Context) {
+		prefs, err := p.Load(c)
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		// binding into the loaded preferences keeps the fields the body
+		// leaves out
+		if err := c.ShouldBind(&prefs); err != nil {
+			FailStatus(c, http.StatusBadRequest, err)
+			return
+		}
+		if err := p.Save(c, prefs); err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, ErrPreferencesInvalid) {
+				code = http.StatusUnprocessableEntity
+			}
+			FailStatus(c, code, err)
+			return
+		}
+		if ref := c.Request.Referer(); ref != "" && c.ContentType() != gin.MIMEJSON {
+			c.Redirect(http.StatusSeeOther, ref)
+			return
+		}
+		c.JSON(http.StatusOK, prefs)
+	}
+	g.PATCH("/preferences", update)
+	// HTML forms cannot send PATCH
+	g.POST("/preferences", update)
+}
@@ -0,0 +1,341 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// DoctorConfig is the doctor block of ghost.yaml, the
+// expectations of Preflight beyond what the other blocks imply.
+//
+//  doctor:
+//      tables: [user, post]
+//      dirs: [./exports]
+//      max-clock-skew: 5s
+type DoctorConfig struct {
+	// Tables must exist in the database, e.g. those a migration of
+	// another service defines.
+	Tables []string `yaml:"tables"`
+	// Dirs must be writable, on top of the uploads, logging and build
+	// output directories.
+	Dirs []string `yaml:"dirs"`
+	// MaxClockSkew is the largest difference allowed between the clocks
+	// of the instance and SurrealDB, DefaultMaxClockSkew by default.
+	MaxClockSkew time.Duration `yaml:"max-clock-skew"`
+}
+
+// DefaultMaxClockSkew is the MaxClockSkew applied by Validate.
+const DefaultMaxClockSkew = 5 * time.Second
+
+// Remediation is the error of a failed check along with what fixes it,
+// shown as the fix of the check.
+type Remediation struct {
+	Err error
+	Fix string
+}
+
+func (r *Remediation) Error() string {
+	return r.Err.Error()
+}
+
+func (r *Remediation) Unwrap() error {
+	return r.Err
+}
+
+// Remedy returns err with fix, nil when err is nil.
+//
+// Example:
+//  return "", ghostutils.Remedy(err, "start redis, or unset cache.redis-url")
+func Remedy(err error, fix string) error {
+	if err == nil {
+		return nil
+	}
+	return &Remediation{Err: err, Fix: fix}
+}
+
+// PreflightReport is the outcome of Preflight.
+type PreflightReport struct {
+	Checks []StartupResult `json:"checks"`
+}
+
+// OK reports whether no check failed.
+func (report PreflightReport) OK() bool {
+	return StartupReport{Checks: report.Checks}.OK()
+}
+
+// Print writes one line per check to w, followed by the fix of a
+// failed one.
+func (report PreflightReport) Print(w io.Writer) {
+	for _, check := range report.Checks {
+		fmt.Fprintf(w, "%-8s %-12s %s\n", check.Status, check.Name, check.Detail)
+		if check.Status == StartupFailed && check.Fix != "" {
+			fmt.Fprintf(w, "%-8s %-12s fix: %s\n", "", "", check.Fix)
+		}
+	}
+}
+
+// Preflight checks that the app can start, each failure with what
+// fixes it: the config is valid, SurrealDB accepts the credentials and
+// lets the user read and write, the migrations are applied, the
+// database matches them and the tables of the doctor block exist, the clocks agree, the directories the app
+// writes to are writable, the views exist and the tailwindcss CLI is
+// there. The write check creates and deletes a record of the
+// _ghost_preflight table. checks run last; return Remedy errors from
+// them to give a fix.
+//
+// Example:
+//  report := ghostConfig.Preflight(ctx)
+//  report.Print(os.Stdout)
+//  if !report.OK() {
+//      os.Exit(1)
+//  }
+//
+// Returns:
+//  PreflightReport
+func (ghostConfig GhostConfig) Preflight(ctx context.Context, checks ...StartupCheck) PreflightReport {
+	var report PreflightReport
+	run := func(name string, fn func(ctx context.Context) (string, error)) {
+		report.Checks = append(report.Checks, runStartupCheck(ctx, StartupCheck{Name: name, Run: fn}))
+	}
+	validated := ghostConfig
+	run("config", func(ctx context.Context) (string, error) {
+		path := ghostConfig.Path
+		if path == "" {
+			path = "ghost.yaml"
+		}
+		if err := validated.Validate(); err != nil {
+			return "", Remedy(err, "correct the listed values in "+path)
+		}
+		return path, nil
+	})
+	ghostConfig = validated
+
+	db, dbErr := ghostConfig.preflightConnect(ctx)
+	if db != nil {
+		defer db.Close()
+	}
+	run("surrealdb", func(ctx context.Context) (string, error) {
+		if dbErr != nil {
+			return "", dbErr
+		}
+		return fmt.Sprintf("%s as %s on %s/%s", ghostConfig.SurrealDB.URL, ghostConfig.SurrealDB.Username, ghostConfig.SurrealDB.Namespace, ghostConfig.SurrealDB.Database), nil
+	})
+	withDB := func(fn func(ctx context.Context, db GhostDB) (string, error)) func(ctx context.Context) (string, error) {
+		return func(ctx context.Context) (string, error) {
+			if dbErr != nil {
+				return "", errStartupSkipped
+			}
+			return fn(ctx, WithContext(ctx, db))
+		}
+	}
+	run("permissions", withDB(preflightPermissions))
+	run("migrations", withDB(func(ctx context.Context, db GhostDB) (string, error) {
+		dir := ghostConfig.Migrations.Dir
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return "", errStartupSkipped
+		}
+		migrator, err := NewMigrator(db, os.DirFS(dir))
+		if err != nil {
+			return "", Remedy(err, "correct the migration files in "+dir)
+		}
+		detail, err := migrator.StartupCheck().Run(ctx)
+		return detail, Remedy(err, "apply them with Migrate, or set migrations.auto: true")
+	}))
+	run("schema", withDB(func(ctx context.Context, db GhostDB) (string, error) {
+		migrator, err := ghostConfig.schemaMigrator(db)
+		if err != nil {
+			return "", err
+		}
+		detail, err := migrator.SchemaCheck().Run(ctx)
+		return detail, Remedy(err, "write a migration for the changes made to the database, or revert them")
+	}))
+	run("tables", withDB(func(ctx context.Context, db GhostDB) (string, error) {
+		if len(ghostConfig.Doctor.Tables) == 0 {
+			return "", errStartupSkipped
+		}
+		info, err := surrealdb.SmartUnmarshal[map[string]map[string]string](db.Query("INFO FOR DB", map[string]interface{}{}))
+		if err != nil {
+			return "", err
+		}
+		var missing []string
+		for _, table := range ghostConfig.Doctor.Tables {
+			if _, ok := info["tables"][table]; !ok {
+				missing = append(missing, table)
+			}
+		}
+		if len(missing) > 0 {
+			return "", Remedy(fmt.Errorf("missing: %s", strings.Join(missing, ", ")), "run the migrations defining them, or check surrealdb-namespace and surrealdb-database")
+		}
+		return fmt.Sprintf("%d present", len(ghostConfig.Doctor.Tables)), nil
+	}))
+	run("clock", withDB(func(ctx context.Context, db GhostDB) (string, error) {
+		before := time.Now()
+		now, err := surrealdb.SmartUnmarshal[time.Time](db.Query("RETURN time::now()", map[string]interface{}{}))
+		if err != nil {
+			return "", err
+		}
+		// the database read its clock about halfway through the round trip
+		local := before.Add(time.Since(before) / 2)
+		skew := local.Sub(now)
+		if skew < 0 {
+			skew = -skew
+		}
+		detail := "skew " + skew.Round(time.Millisecond).String()
+		if skew > ghostConfig.Doctor.MaxClockSkew {
+			return "", Remedy(errors.New(detail), "synchronize the clocks of the instance and SurrealDB with NTP; tokens, sessions and schedules depend on them")
+		}
+		return detail, nil
+	}))
+	run("dirs", ghostConfig.preflightDirs)
+	run("views", func(ctx context.Context) (string, error) {
+		if info, err := os.Stat(ghostConfig.Views); err != nil || !info.IsDir() {
+			return "", Remedy(fmt.Errorf("%s is not a directory", ghostConfig.Views), "create it, or set views to the template directory")
+		}
+		return ghostConfig.Views, nil
+	})
+	run("tailwind", ghostConfig.preflightTailwind)
+	for _, check := range checks {
+		report.Checks = append(report.Checks, runStartupCheck(ctx, check))
+	}
+	return report
+}
+
+// preflightConnect connects once, each step failing with its own fix.
+func (ghostConfig GhostConfig) preflightConnect(ctx context.Context) (*surrealdb.DB, error) {
+	config := ghostConfig.SurrealDB
+	endpoint, err := config.endpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	db, err := config.Connection.DialContext(ctx, endpoint)
+	if err != nil {
+		return nil, Remedy(err, fmt.Sprintf("start SurrealDB at %s, or correct surrealdb-url", config.URL))
+	}
+	conn := WithContext(ctx, db)
+	if _, err := conn.Signin(config.signinObj()); err != nil {
+		db.Close()
+		return nil, Remedy(err, "correct surrealdb-username and surrealdb-password")
+	}
+	if _, err := conn.Use(config.Namespace, config.Database); err != nil {
+		db.Close()
+		return nil, Remedy(err, fmt.Sprintf("create namespace %s and database %s, or correct surrealdb-namespace and surrealdb-database", config.Namespace, config.Database))
+	}
+	return db, nil
+}
+
+func preflightPermissions(ctx context.Context, db GhostDB) (string, error) {
+	fix := "grant the surrealdb user editor rights on the database"
+	if _, err := db.Query("INFO FOR DB", map[string]interface{}{}); err != nil {
+		return "", Remedy(err, fix)
+	}
+	statements, err := surrealStatements(db, "CREATE _ghost_preflight:check SET at = time::now(); DELETE _ghost_preflight:check;", nil)
+	if err != nil {
+		return "", Remedy(err, fix)
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return "", Remedy(fmt.Errorf("cannot write: %v", statement.Detail), fix+", or define the _ghost_preflight table on a schemafull database")
+		}
+	}
+	return "read and write", nil
+}
+
+// preflightDirs checks that the directories the app writes to are
+// writable, creating the missing ones as the app would.
+func (ghostConfig GhostConfig) preflightDirs(ctx context.Context) (string, error) {
+	var dirs []string
+	if storage := ghostConfig.Uploads.Storage; storage == "" || storage == "local" {
+		dirs = append(dirs, ghostConfig.Uploads.Root)
+	}
+	if output := ghostConfig.Logging.Output; output != "" && output != "stderr" && output != "stdout" {
+		dirs = append(dirs, filepath.Dir(output))
+	}
+	if ghostConfig.TailwindCSS.Output != "" {
+		dirs = append(dirs, filepath.Dir(ghostConfig.TailwindCSS.Output))
+	}
+	if ghostConfig.Scripts.Outdir != "" {
+		dirs = append(dirs, ghostConfig.Scripts.Outdir)
+	}
+	dirs = append(dirs, ghostConfig.Doctor.Dirs...)
+	var failed []string
+	for _, dir := range dirs {
+		if err := writableDir(dir); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return "", Remedy(errors.New(strings.Join(failed, "; ")), "create them with write access for the user running the app")
+	}
+	return strings.Join(dirs, ", "), nil
+}
+
+func writableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".ghost-preflight-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// preflightTailwind checks that the tailwindcss CLI can be run.
+func (ghostConfig GhostConfig) preflightTailwind(ctx context.Context) (string, error) {
+	tailwind := ghostConfig.TailwindCSS
+	if tailwind.Input == "" {
+		return "", errStartupSkipped
+	}
+	if _, err := os.Stat(tailwind.Input); err != nil {
+		return "", Remedy(err, "create it, or correct tailwindcss.input")
+	}
+	if tailwind.Binary != "" {
+		if _, err := exec.LookPath(tailwind.Binary); err != nil {
+			return "", Remedy(err, "install the tailwindcss CLI there, or unset tailwindcss.binary to download it")
+		}
+		return tailwind.Binary, nil
+	}
+	if found, err := exec.LookPath("tailwindcss"); err == nil {
+		return found, nil
+	}
+	return "not installed, downloaded on the first build", nil
+}
+
+// Doctor loads the config at path for env, runs Preflight and prints
+// the report to w, for the doctor command of a CLI. A config that
+// cannot be read or parsed is the only check then.
+//
+// Example:
+//  if !ghostutils.Doctor(ctx, "ghost.yaml", os.Getenv(ghostutils.EnvVariable), os.Stdout) {
+//      os.Exit(1)
+//  }
+//
+// Returns:
+//  whether every check passed
+func Doctor(ctx context.Context, path, env string, w io.Writer) bool {
+	ghostConfig, err := loadConfig(path, env)
+	var problems *ConfigError
+	if err != nil && !errors.As(err, &problems) {
+		report := PreflightReport{Checks: []StartupResult{{
+			Name:   "config",
+			Status: StartupFailed,
+			Detail: err.Error(),
+			Fix:    fmt.Sprintf("create %s, e.g. with InitProject, or correct its YAML and secret references", path),
+		}}}
+		report.Print(w)
+		return false
+	}
+	report := ghostConfig.Preflight(ctx)
+	report.Print(w)
+	return report.OK()
+}
@@ -0,0 +1,325 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SelectQuery builds a parameterized SurrealQL SELECT. Identifiers
+// (fields, tables, sort keys) are validated, and values only ever
+// travel as bound variables, so no caller input is concatenated into
+// the statement. The first invalid identifier is reported by Build.
+//
+// Example:
+//  users, err := ghostutils.QueryAll[User](db, ghostutils.Select("id", "name").
+//      From("user").
+//      Where("age > $min").Bind("min", 18).
+//      WhereField("country", "=", c.Query("country")).
+//      Fetch("posts").
+//      OrderByDesc("created_at").
+//      Limit(20).Start(40))
+type SelectQuery struct {
+	fields  []string
+	from    []string
+	where   []string
+	vars    map[string]interface{}
+	groupBy []string
+	orderBy []string
+	fetch   []string
+	graph   []string
+	limit   int
+	start   int
+	// params numbers the generated variables
+	params int
+	err    error
+}
+
+// Select starts a query returning fields, every field when none are
+// given. Fields may be paths such as "author.name" and may use AS, as
+// in "count() AS total".
+func Select(fields ...string) *SelectQuery {
+	q := &SelectQuery{vars: map[string]interface{}{}}
+	for _, field := range fields {
+		expr, alias, _ := strings.Cut(field, " AS ")
+		if !q.check(strings.TrimSpace(expr), true) || (alias != "" && !q.check(strings.TrimSpace(alias), false)) {
+			break
+		}
+		q.fields = append(q.fields, field)
+	}
+	return q
+}
+
+// aggregateFields are the aggregate calls accepted by Select.
+var aggregateFields = map[string]bool{"count()": true}
+
+func (q *SelectQuery) check(identifier string, allowAggregate bool) bool {
+	if q.err != nil {
+		return false
+	}
+	if identifier == "*" || (allowAggregate && aggregateFields[identifier]) || identifierPattern.MatchString(identifier) {
+		return true
+	}
+	q.err = fmt.Errorf("invalid identifier %q", identifier)
+	return false
+}
+
+// From sets the tables, or record ids such as "user:tobie", to select
+// from.
+func (q *SelectQuery) From(targets ...string) *SelectQuery {
+	for _, target := range targets {
+		if !recordIDPattern.MatchString(target) && !q.check(target, false) {
+			return q
+		}
+		q.from = append(q.from, target)
+	}
+	return q
+}
+
+// Where adds a condition, combined with the others by AND. Values are
+// referenced as $name and set with Bind. cond is SurrealQL and must
+// not contain caller input; use WhereField for that.
+func (q *SelectQuery) Where(cond string) *SelectQuery {
+	q.where = append(q.where, "("+cond+")")
+	return q
+}
+
+// Bind sets the variable $name.
+func (q *SelectQuery) Bind(name string, value interface{}) *SelectQuery {
+	q.vars[name] = value
+	return q
+}
+
+// queryOperators are the operators accepted by WhereField.
+var queryOperators = map[string]bool{
+	"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true,
+	"CONTAINS": true, "CONTAINSNOT": true, "INSIDE": true, "NOTINSIDE": true,
+	"CONTAINSANY": true, "CONTAINSALL": true, "~": true,
+}
+
+// WhereField adds the condition field op value, binding value to a
+// generated variable.
+func (q *SelectQuery) WhereField(field, op string, value interface{}) *SelectQuery {
+	if !q.check(field, false) {
+		return q
+	}
+	if !queryOperators[strings.ToUpper(op)] {
+		q.err = fmt.Errorf("invalid operator %q", op)
+		return q
+	}
+	name := fmt.Sprintf("q_%d", q.params)
+	q.params++
+	q.vars[name] = value
+	q.where = append(q.where, fmt.Sprintf("%s %s $%s", field, strings.ToUpper(op), name))
+	return q
+}
+
+// Filter applies the conditions and sort of a ListFilter.
+func (q *SelectQuery) Filter(filter ListFilter) *SelectQuery {
+	where, vars := filter.where(fmt.Sprintf("q_filter%d", q.params))
+	q.params++
+	if where != "" {
+		q.where = append(q.where, "("+where+")")
+		for name, value := range vars {
+			q.vars[name] = value
+		}
+	}
+	for _, sort := range filter.Sort {
+		if sort.Desc {
+			q.OrderByDesc(sort.Field)
+		} else {
+			q.OrderBy(sort.Field)
+		}
+	}
+	return q
+}
+
+// GroupBy groups the results by fields.
+func (q *SelectQuery) GroupBy(fields ...string) *SelectQuery {
+	for _, field := range fields {
+		if !q.check(field, false) {
+			return q
+		}
+		q.groupBy = append(q.groupBy, field)
+	}
+	return q
+}
+
+// OrderBy sorts ascending by field; later calls break ties.
+func (q *SelectQuery) OrderBy(field string) *SelectQuery {
+	if q.check(field, false) {
+		q.orderBy = append(q.orderBy, field+" ASC")
+	}
+	return q
+}
+
+// OrderByDesc sorts descending by field.
+func (q *SelectQuery) OrderByDesc(field string) *SelectQuery {
+	if q.check(field, false) {
+		q.orderBy = append(q.orderBy, field+" DESC")
+	}
+	return q
+}
+
+// Fetch replaces the record links in fields with the linked records.
+func (q *SelectQuery) Fetch(fields ...string) *SelectQuery {
+	for _, field := range fields {
+		if !q.check(field, false) {
+			return q
+		}
+		q.fetch = append(q.fetch, field)
+	}
+	return q
+}
+
+// graphPattern matches graph traversals such as <-wrote<-user.
+var graphPattern = regexp.MustCompile(`^((<-|->|<->)[A-Za-z_][A-Za-z0-9_]*)+$`)
+
+// Graph adds the records reached by the graph traversal path as the
+// field alias, e.g. Graph("<-wrote<-user", "authors") for the users
+// related to each record by a wrote edge.
+func (q *SelectQuery) Graph(path, alias string) *SelectQuery {
+	if q.err != nil {
+		return q
+	}
+	if !graphPattern.MatchString(path) {
+		q.err = fmt.Errorf("invalid graph path %q", path)
+		return q
+	}
+	if !q.check(alias, false) {
+		return q
+	}
+	q.graph = append(q.graph, path+" AS "+alias)
+	return q
+}
+
+// Limit returns at most n rows.
+func (q *SelectQuery) Limit(n int) *SelectQuery {
+	q.limit = n
+	return q
+}
+
+// Start skips the first n rows.
+func (q *SelectQuery) Start(n int) *SelectQuery {
+	q.start = n
+	return q
+}
+
+// Clone returns a copy of q that can be changed without changing q,
+// as Paginate does to apply a page and QueryOne its LIMIT 1.
+func (q *SelectQuery) Clone() *SelectQuery {
+	clone := *q
+	clone.vars = make(map[string]interface{}, len(q.vars))
+	for name, value := range q.vars {
+		clone.vars[name] = value
+	}
+	clone.fields = append([]string(nil), q.fields...)
+	clone.from = append([]string(nil), q.from...)
+	clone.where = append([]string(nil), q.where...)
+	clone.groupBy = append([]string(nil), q.groupBy...)
+	clone.orderBy = append([]string(nil), q.orderBy...)
+	clone.fetch = append([]string(nil), q.fetch...)
+	clone.graph = append([]string(nil), q.graph...)
+	return &clone
+}
+
+// Build returns the statement and its variables.
+//
+// Returns:
+//  string SurrealQL
+//  map[string]interface{} variables
+//  error if an identifier or operator is invalid or From was not set
+func (q *SelectQuery) Build() (string, map[string]interface{}, error) {
+	if q.err != nil {
+		return "", nil, q.err
+	}
+	if len(q.from) == 0 {
+		return "", nil, fmt.Errorf("select query has no From")
+	}
+	var sql strings.Builder
+	sql.WriteString("SELECT ")
+	if len(q.fields) == 0 {
+		sql.WriteString("*")
+	} else {
+		sql.WriteString(strings.Join(q.fields, ", "))
+	}
+	if len(q.graph) > 0 {
+		sql.WriteString(", " + strings.Join(q.graph, ", "))
+	}
+	sql.WriteString(" FROM " + strings.Join(q.from, ", "))
+	if len(q.where) > 0 {
+		sql.WriteString(" WHERE " + strings.Join(q.where, " AND "))
+	}
+	if len(q.groupBy) > 0 {
+		sql.WriteString(" GROUP BY " + strings.Join(q.groupBy, ", "))
+	}
+	if len(q.orderBy) > 0 {
+		sql.WriteString(" ORDER BY " + strings.Join(q.orderBy, ", "))
+	}
+	if q.limit > 0 {
+		fmt.Fprintf(&sql, " LIMIT %d", q.limit)
+	}
+	if q.start > 0 {
+		fmt.Fprintf(&sql, " START %d", q.start)
+	}
+	if len(q.fetch) > 0 {
+		sql.WriteString(" FETCH " + strings.Join(q.fetch, ", "))
+	}
+	vars := make(map[string]interface{}, len(q.vars))
+	for name, value := range q.vars {
+		vars[name] = value
+	}
+	return sql.String(), vars, nil
+}
+
+// String returns the statement, or the build error.
+func (q *SelectQuery) String() string {
+	sql, _, err := q.Build()
+	if err != nil {
+		return "invalid query: " + err.Error()
+	}
+	return sql
+}
+
+// QueryAll runs q against db and unmarshals the rows into T.
+//
+// Example:
+//  posts, err := ghostutils.QueryAll[Post](db, ghostutils.Select().From("post").Limit(10))
+func QueryAll[T any](db GhostDB, q *SelectQuery) ([]T, error) {
+	return QueryAllContext[T](context.Background(), db, q)
+}
+
+// QueryAllContext is QueryAll traced under the span of ctx, such as
+// the gin context of a request traced by Tracing, and ended with ctx,
+// see WithContext.
+//
+// Example:
+//  posts, err := ghostutils.QueryAllContext[Post](c, db, ghostutils.Select().From("post").Limit(10))
+func QueryAllContext[T any](ctx context.Context, db GhostDB, q *SelectQuery) (rows []T, err error) {
+	span := startDBSpan(ctx, "select", strings.Join(q.from, ","))
+	defer func() { endSpan(span, err) }()
+	sql, vars, err := q.Build()
+	if err != nil {
+		return nil, err
+	}
+	return surrealQuery[T](WithContext(ctx, db), sql, vars)
+}
+
+// QueryOne runs q with LIMIT 1 and returns the row. ok is false when
+// there is none.
+func QueryOne[T any](db GhostDB, q *SelectQuery) (row T, ok bool, err error) {
+	return QueryOneContext[T](context.Background(), db, q)
+}
+
+// QueryOneContext is QueryOne traced under the span of ctx and ended
+// with it.
+func QueryOneContext[T any](ctx context.Context, db GhostDB, q *SelectQuery) (row T, ok bool, err error) {
+	span := startDBSpan(ctx, "select", strings.Join(q.from, ","))
+	defer func() { endSpan(span, err) }()
+	sql, vars, err := q.Clone().Limit(1).Build()
+	if err != nil {
+		return row, false, err
+	}
+	return surrealFirst[T](WithContext(ctx, db), sql, vars)
+}
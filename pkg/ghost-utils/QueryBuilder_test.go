@@ -0,0 +1,27 @@
+package ghostutils_test
+
+import (
+	"testing"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+	"github.com/adamkali/ghost_utils/pkg/ghosttest"
+)
+
+func TestQueryOneKeepsTheQuery(t *testing.T) {
+	db := ghosttest.DB(t)
+	ghosttest.Exec(t, db, "CREATE post:1 SET n = 1; CREATE post:2 SET n = 2;", nil)
+	type post struct {
+		N int `json:"n"`
+	}
+	q := ghostutils.Select("n").From("post").OrderBy("n")
+	if first, ok, err := ghostutils.QueryOne[post](db, q); err != nil || !ok || first.N != 1 {
+		t.Fatalf("QueryOne: %+v, %v, %v", first, ok, err)
+	}
+	rows, err := ghostutils.QueryAll[post](db, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Errorf("QueryAll after QueryOne: %d rows, want 2", len(rows))
+	}
+}
@@ -0,0 +1,194 @@
+package ghostutils
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// ExplainConfig is the metrics.explain block of ghost.yaml. SELECT
+// queries slower than Threshold are explained at the given Rate, a
+// fraction of them, and the last MaxPlans plans are kept.
+//
+//  metrics:
+//      explain:
+//          threshold: 200ms
+//          rate: 0.1
+//          max-plans: 50
+type ExplainConfig struct {
+	Threshold time.Duration `yaml:"threshold"`
+	Rate      float64       `yaml:"rate"`
+	MaxPlans  int           `yaml:"max-plans"`
+}
+
+// Defaults applied to ExplainConfig by Validate when a threshold is
+// set.
+const (
+	DefaultExplainRate     = 0.1
+	DefaultExplainMaxPlans = 50
+)
+
+// QueryPlan is the plan of a slow query, kept once per query text
+// with the number of times it was sampled.
+type QueryPlan struct {
+	ID         string      `json:"id"`
+	SQL        string      `json:"sql"`
+	Duration   string      `json:"duration"`
+	Slowest    string      `json:"slowest"`
+	Samples    int         `json:"samples"`
+	CapturedAt time.Time   `json:"captured_at"`
+	Plan       interface{} `json:"plan,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	slowest    time.Duration
+}
+
+// QueryPlanSampler explains a sample of the slow queries, to show
+// which lack an index. The EXPLAIN runs after the query, off the
+// querying goroutine and one at a time; queries slow while one runs
+// are skipped.
+//
+// Example:
+//  plans := ghostutils.NewQueryPlanSampler(ghostConfig.Metrics.Explain)
+//  ghostutils.ObserveQueries(plans.Observe)
+//  plans.Mount(r.Group("/ghost", ghostutils.RequireRole(ghostutils.AdminRole)))
+type QueryPlanSampler struct {
+	config ExplainConfig
+
+	active int32
+	mu     sync.Mutex
+	plans  []*QueryPlan
+}
+
+// NewQueryPlanSampler returns a sampler of config. A zero threshold
+// explains nothing.
+func NewQueryPlanSampler(config ExplainConfig) *QueryPlanSampler {
+	if config.Rate == 0 {
+		config.Rate = DefaultExplainRate
+	}
+	if config.MaxPlans <= 0 {
+		config.MaxPlans = DefaultExplainMaxPlans
+	}
+	return &QueryPlanSampler{config: config}
+}
+
+// Observe samples query, as a QueryObserver.
+func (s *QueryPlanSampler) Observe(query QueryEvent) {
+	if s.config.Threshold <= 0 || query.Took < s.config.Threshold || query.Err != nil || query.DB == nil {
+		return
+	}
+	sql, ok := explainable(query)
+	if !ok || rand.Float64() >= s.config.Rate {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&s.active, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.active, 0)
+		s.explain(query, sql)
+	}()
+}
+
+// explainable returns the single SELECT statement of query, without
+// its trailing semicolon.
+func explainable(query QueryEvent) (string, bool) {
+	sql := strings.TrimSuffix(strings.TrimSpace(query.SQL), ";")
+	if query.Statement() != "select" || strings.Contains(sql, ";") {
+		return "", false
+	}
+	if fields := strings.Fields(strings.ToUpper(sql)); fields[len(fields)-1] == "EXPLAIN" || fields[len(fields)-1] == "FULL" {
+		return "", false
+	}
+	return sql, true
+}
+
+func (s *QueryPlanSampler) explain(query QueryEvent, sql string) {
+	vars := query.Vars
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	// run on the driver directly, so the EXPLAIN is not observed
+	plan, err := surrealdb.SmartUnmarshal[interface{}](query.DB.Query(sql+" EXPLAIN", vars))
+	captured := &QueryPlan{
+		SQL:        query.SQL,
+		Duration:   query.Took.Round(time.Millisecond).String(),
+		Samples:    1,
+		CapturedAt: time.Now().UTC(),
+		Plan:       plan,
+		slowest:    query.Took,
+	}
+	if err != nil {
+		captured.Plan = nil
+		captured.Error = err.Error()
+	}
+	s.store(captured)
+}
+
+func (s *QueryPlanSampler) store(plan *QueryPlan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plan.ID = randomID(8)
+	for i, stored := range s.plans {
+		if stored.SQL == plan.SQL {
+			plan.ID = stored.ID
+			plan.Samples += stored.Samples
+			if stored.slowest > plan.slowest {
+				plan.slowest = stored.slowest
+			}
+			s.plans = append(s.plans[:i], s.plans[i+1:]...)
+			break
+		}
+	}
+	plan.Slowest = plan.slowest.Round(time.Millisecond).String()
+	s.plans = append(s.plans, plan)
+	if len(s.plans) > s.config.MaxPlans {
+		s.plans = append([]*QueryPlan(nil), s.plans[len(s.plans)-s.config.MaxPlans:]...)
+	}
+}
+
+// Plans returns the stored plans, most recently sampled first.
+func (s *QueryPlanSampler) Plans() []QueryPlan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plans := make([]QueryPlan, 0, len(s.plans))
+	for i := len(s.plans) - 1; i >= 0; i-- {
+		plans = append(plans, *s.plans[i])
+	}
+	return plans
+}
+
+// Reset drops the stored plans, e.g. after adding an index.
+func (s *QueryPlanSampler) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plans = nil
+}
+
+// Mount registers GET /query-plans, listing the plans, GET
+// /query-plans/:id, showing one, and DELETE /query-plans, dropping
+// them.
+func (s *QueryPlanSampler) Mount(r gin.IRoutes) {
+	r.GET("/query-plans", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, s.Plans())
+	})
+	r.GET("/query-plans/:id", func(c *gin.Context) {
+		for _, plan := range s.Plans() {
+			if plan.ID == c.Param("id") {
+				c.JSON(http.StatusOK, plan)
+				return
+			}
+		}
+		Fail(c, NewGhostError(http.StatusNotFound, "not_found", "query plan not found"))
+	})
+	r.DELETE("/query-plans", func(c *gin.Context) {
+		s.Reset()
+		c.Status(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,283 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Rate limit keys.
+const (
+	RateLimitByIP   = "ip"
+	RateLimitByUser = "user"
+)
+
+// RateLimitRule allows Requests per Per, with bursts of up to Burst
+// requests, Requests by default.
+type RateLimitRule struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"`
+	// Key is ip or user, which limits authenticated requests by their
+	// Identity and anonymous ones by IP. Defaults to ip. The user key
+	// is for named routes, whose limiter runs after authentication;
+	// the client IP honours only trusted-proxies.
+	Key string `yaml:"key"`
+}
+
+// RateLimitConfig is the `rate-limit:` block of ghost.yaml. With
+// enabled set Setup applies the rule of the block to every route;
+// routes names rules for single GhostRoutes, see RateLimiter.Named.
+//
+// Example:
+//  rate-limit:
+//    enabled: true
+//    requests: 300
+//    per: 1m
+//    store: redis
+//    redis-url: redis://localhost:6379/0
+//    routes:
+//      search:
+//        requests: 10
+//        per: 1m
+//        key: user
+type RateLimitConfig struct {
+	RateLimitRule `yaml:",inline"`
+	Enabled       bool                     `yaml:"enabled"`
+	Store         string                   `yaml:"store"`
+	RedisURL      string                   `yaml:"redis-url"`
+	Routes        map[string]RateLimitRule `yaml:"routes"`
+}
+
+// RateLimitResult is the outcome of taking a token.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until a token is available when the
+	// request was not allowed.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps token buckets.
+type RateLimitStore interface {
+	// Take takes a token from the bucket key, which holds up to burst
+	// tokens and refills rate tokens per second.
+	Take(ctx context.Context, key string, rate float64, burst int) (RateLimitResult, error)
+}
+
+// RateLimiter limits requests with a token bucket per client.
+type RateLimiter struct {
+	Store RateLimitStore
+	Rule  RateLimitRule
+	// Name separates the buckets of limiters sharing a store.
+	Name string
+	// Routes are the named rules of the config, for Named.
+	Routes map[string]RateLimitRule
+}
+
+// NewRateLimiter builds the rate limiter of the rate-limit block.
+//
+// Example:
+//  limiter, err := ghostConfig.NewRateLimiter()
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  search := ghostutils.NewBasicRoute(db, "/search", searchHandlers).
+//      Use(limiter.Named("search").Middleware())
+//
+// Returns:
+//  *RateLimiter
+//  error for an unknown store or invalid redis-url
+func (ghostConfig GhostConfig) NewRateLimiter() (*RateLimiter, error) {
+	cfg := ghostConfig.RateLimit
+	limiter := &RateLimiter{Rule: cfg.RateLimitRule, Name: "global", Routes: cfg.Routes}
+	switch cfg.Store {
+	case "", "memory":
+		limiter.Store = NewMemoryRateLimitStore()
+	case "redis":
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		limiter.Store = RedisRateLimitStore{Client: redis.NewClient(opts)}
+	default:
+		return nil, fmt.Errorf("unknown rate-limit store %q", cfg.Store)
+	}
+	return limiter, nil
+}
+
+// Named returns a limiter sharing the store with the rule of routes
+// named name, or the rule of the block when there is none.
+func (l *RateLimiter) Named(name string) *RateLimiter {
+	rule, ok := l.Routes[name]
+	if !ok {
+		rule = l.Rule
+	}
+	return l.With(name, rule)
+}
+
+// With returns a limiter sharing the store with its own rule, for
+// limits set in code.
+func (l *RateLimiter) With(name string, rule RateLimitRule) *RateLimiter {
+	return &RateLimiter{Store: l.Store, Rule: rule, Name: name, Routes: l.Routes}
+}
+
+func (l *RateLimiter) key(c *gin.Context) string {
+	if l.Rule.Key == RateLimitByUser {
+		if identity, ok := CurrentIdentity(c); ok {
+			return l.Name + ":user:" + identity.ID
+		}
+	}
+	return l.Name + ":ip:" + c.ClientIP()
+}
+
+// Middleware answers 429 with Retry-After once a client has used up
+// its bucket, and reports the limit in RateLimit-Limit and
+// RateLimit-Remaining. Requests are let through when the store fails.
+// With the user key it must run after the middleware setting the
+// Identity.
+func (l *RateLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rule := l.Rule
+		if rule.Requests <= 0 || rule.Per <= 0 {
+			c.Next()
+			return
+		}
+		burst := rule.Burst
+		if burst <= 0 {
+			burst = rule.Requests
+		}
+		rate := float64(rule.Requests) / rule.Per.Seconds()
+		result, err := l.Store.Take(c.Request.Context(), l.key(c), rate, burst)
+		if err != nil {
+			log.Printf("rate-limit: %v", err)
+			c.Next()
+			return
+		}
+		c.Header("RateLimit-Limit", strconv.Itoa(rule.Requests))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		if !result.Allowed {
+			seconds := int(math.Ceil(result.RetryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			Fail(c, NewGhostError(http.StatusTooManyRequests, "rate_limited", "rate limit exceeded"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// MemoryRateLimitStore keeps buckets in process memory, for single
+// instance deployments.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	swept   time.Time
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket refills completely and can be dropped.
+	full time.Time
+}
+
+// NewMemoryRateLimitStore returns an empty in-memory store.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*memoryBucket{}, swept: time.Now()}
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rate float64, burst int) (RateLimitResult, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) > time.Minute {
+		// full buckets behave like missing ones
+		for k, bucket := range s.buckets {
+			if now.After(bucket.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	result := RateLimitResult{}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(bucket.tokens)
+	bucket.full = now.Add(time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second)))
+	return result, nil
+}
+
+// RedisRateLimitStore keeps buckets in Redis so the limit is shared
+// between instances.
+type RedisRateLimitStore struct {
+	Client *redis.Client
+	// Prefix defaults to "ghost:ratelimit:".
+	Prefix string
+}
+
+// rateLimitScript refills and takes from the bucket atomically. It
+// returns whether the token was taken, the tokens left and the
+// milliseconds until the next token.
+var rateLimitScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, math.floor(tokens), wait}
+`)
+
+// Take implements RateLimitStore.
+func (s RedisRateLimitStore) Take(ctx context.Context, key string, rate float64, burst int) (RateLimitResult, error) {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = "ghost:ratelimit:"
+	}
+	values, err := rateLimitScript.Run(ctx, s.Client, []string{prefix + key}, rate, burst, time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(values) != 3 {
+		return RateLimitResult{}, fmt.Errorf("unexpected rate limit reply %v", values)
+	}
+	return RateLimitResult{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,355 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadRoutingConfig is the read-routing block of ghost.yaml: the reads
+// of Primary go to the nearest healthy of Primary and Replicas, the
+// names of the databases map, see ReadRouter.
+//
+//  databases:
+//      eu:
+//          surrealdb-url: wss://eu.db.example.com/rpc
+//      us:
+//          surrealdb-url: wss://us.db.example.com/rpc
+//  read-routing:
+//      primary: default
+//      replicas: [eu, us]
+//      probe-interval: 10s
+type ReadRoutingConfig struct {
+	// Primary takes the writes, DefaultDatabase when empty.
+	Primary  string   `yaml:"primary"`
+	Replicas []string `yaml:"replicas"`
+	// ProbeInterval is how often the latency of every endpoint is
+	// measured, DefaultProbeInterval by default, and ProbeTimeout how long
+	// a probe may take before the endpoint counts as down,
+	// DefaultProbeTimeout by default.
+	ProbeInterval time.Duration `yaml:"probe-interval"`
+	ProbeTimeout  time.Duration `yaml:"probe-timeout"`
+}
+
+// Defaults of the read-routing block applied by Validate.
+const (
+	DefaultProbeInterval = 10 * time.Second
+	DefaultProbeTimeout  = 2 * time.Second
+)
+
+// ReadEndpoint is the state of an endpoint of a ReadRouter.
+type ReadEndpoint struct {
+	Name    string `json:"name"`
+	Primary bool   `json:"primary"`
+	Healthy bool   `json:"healthy"`
+	// Latency is the moving average of the probe round trips.
+	Latency  time.Duration `json:"latency"`
+	Reads    int64         `json:"reads"`
+	Failures int64         `json:"failures"`
+}
+
+type routedDB struct {
+	ReadEndpoint
+	db GhostDB
+}
+
+// ReadRouter is a GhostDB sending the writes to the primary and the
+// reads, Select and the queries made only of SELECT, INFO and SHOW
+// statements, to the healthy endpoint with the lowest latency, the
+// primary included. A read failing for want of a connection marks its
+// endpoint down and is retried on the next one, the primary last; an
+// error of SurrealDB itself is returned. Every endpoint is probed with
+// RETURN true each interval, which brings the ones that recovered back,
+// and the endpoints that are down are reported as the degraded
+// dependency database:<name>.
+//
+// Replicas lag behind the primary, so a read that must see a write just
+// made goes to Primary.
+//
+// Example:
+//  router, err := ghostutils.NewReadRouter(ctx, databases, ghostutils.ReadRoutingConfig{
+//      Replicas: []string{"eu", "us"},
+//  })
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  defer router.Close()
+//  posts := ghostutils.NewRepository[Post](router, "post")
+type ReadRouter struct {
+	primary  *routedDB
+	replicas []*routedDB
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewReadRouter routes the reads of config.Primary among it and the
+// config.Replicas of reg, probing them once before it returns and then
+// every config.ProbeInterval until Close.
+//
+// Returns:
+//  *ReadRouter
+//  error for a primary or replica that reg does not have
+func NewReadRouter(ctx context.Context, reg *DatabaseRegistry, config ReadRoutingConfig) (*ReadRouter, error) {
+	if config.Primary == "" {
+		config.Primary = DefaultDatabase
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = DefaultProbeInterval
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = DefaultProbeTimeout
+	}
+	primary, ok := reg.Lookup(config.Primary)
+	if !ok {
+		return nil, fmt.Errorf("read routing: no database named %q", config.Primary)
+	}
+	router := &ReadRouter{
+		primary: &routedDB{ReadEndpoint: ReadEndpoint{Name: config.Primary, Primary: true, Healthy: true}, db: primary},
+		timeout: config.ProbeTimeout,
+	}
+	for _, name := range config.Replicas {
+		db, ok := reg.Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("read routing: no database named %q", name)
+		}
+		router.replicas = append(router.replicas, &routedDB{ReadEndpoint: ReadEndpoint{Name: name, Healthy: true}, db: db})
+	}
+	router.probe(ctx)
+	probeCtx, cancel := context.WithCancel(context.Background())
+	router.cancel = cancel
+	router.done = make(chan struct{})
+	go func() {
+		defer close(router.done)
+		ticker := time.NewTicker(config.ProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-probeCtx.Done():
+				return
+			case <-ticker.C:
+				router.probe(probeCtx)
+			}
+		}
+	}()
+	return router, nil
+}
+
+// Close stops the probes. The connections are left open.
+func (router *ReadRouter) Close() {
+	router.cancel()
+	<-router.done
+}
+
+// Primary returns the connection taking the writes, for the reads that
+// must not lag behind them.
+func (router *ReadRouter) Primary() GhostDB {
+	return router.primary.db
+}
+
+// Endpoints returns the state of the endpoints in the order reads try
+// them, followed by the replicas that are down.
+func (router *ReadRouter) Endpoints() []ReadEndpoint {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	var endpoints []ReadEndpoint
+	for _, endpoint := range router.order() {
+		endpoints = append(endpoints, endpoint.ReadEndpoint)
+	}
+	for _, endpoint := range router.replicas {
+		if !endpoint.Healthy {
+			endpoints = append(endpoints, endpoint.ReadEndpoint)
+		}
+	}
+	return endpoints
+}
+
+func (router *ReadRouter) all() []*routedDB {
+	return append([]*routedDB{router.primary}, router.replicas...)
+}
+
+// probe measures every endpoint at once.
+func (router *ReadRouter) probe(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, endpoint := range router.all() {
+		endpoint := endpoint
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, router.timeout)
+			defer cancel()
+			start := time.Now()
+			_, err := WithContext(probeCtx, endpoint.db).Query("RETURN true", map[string]interface{}{})
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				router.markDown(endpoint, err)
+				return
+			}
+			router.markUp(endpoint, time.Since(start))
+		}()
+	}
+	wg.Wait()
+}
+
+func (router *ReadRouter) markDown(endpoint *routedDB, err error) {
+	router.mu.Lock()
+	endpoint.Healthy = false
+	endpoint.Failures++
+	router.mu.Unlock()
+	ReportDown("database:"+endpoint.Name, err)
+}
+
+func (router *ReadRouter) markUp(endpoint *routedDB, latency time.Duration) {
+	router.mu.Lock()
+	endpoint.Healthy = true
+	if endpoint.Latency == 0 {
+		endpoint.Latency = latency
+	} else {
+		endpoint.Latency = (endpoint.Latency*7 + latency*3) / 10
+	}
+	router.mu.Unlock()
+	ReportUp("database:" + endpoint.Name)
+}
+
+// order returns the healthy endpoints by latency, then the primary if
+// it is down. router.mu is held.
+func (router *ReadRouter) order() []*routedDB {
+	var healthy []*routedDB
+	for _, endpoint := range router.all() {
+		if endpoint.Healthy {
+			healthy = append(healthy, endpoint)
+		}
+	}
+	sort.SliceStable(healthy, func(i, j int) bool { return healthy[i].Latency < healthy[j].Latency })
+	if !router.primary.Healthy {
+		healthy = append(healthy, router.primary)
+	}
+	return healthy
+}
+
+// read runs fn on the endpoints in order until one answers.
+func (router *ReadRouter) read(fn func(db GhostDB) (interface{}, error)) (interface{}, error) {
+	router.mu.Lock()
+	endpoints := router.order()
+	router.mu.Unlock()
+	var err error
+	for _, endpoint := range endpoints {
+		var result interface{}
+		result, err = fn(endpoint.db)
+		if err == nil || isRPCError(err) {
+			router.mu.Lock()
+			endpoint.Reads++
+			router.mu.Unlock()
+			return result, err
+		}
+		router.markDown(endpoint, err)
+	}
+	return nil, err
+}
+
+// readOnly reports whether every statement of sql is a SELECT, INFO or
+// SHOW.
+func readOnly(sql string) bool {
+	statements := splitStatements(sql)
+	if len(statements) == 0 {
+		return false
+	}
+	for _, statement := range statements {
+		keyword := strings.ToUpper(strings.Fields(statement)[0])
+		if keyword != "SELECT" && keyword != "INFO" && keyword != "SHOW" {
+			return false
+		}
+	}
+	return true
+}
+
+// splitStatements splits sql on the semicolons outside of strings and
+// escaped identifiers, dropping the empty statements.
+func splitStatements(sql string) []string {
+	var statements []string
+	var quote rune
+	start := 0
+	add := func(statement string) {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	for i, char := range sql {
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"' || char == '`':
+			quote = char
+		case char == '⟨':
+			quote = '⟩'
+		case char == ';':
+			add(sql[start:i])
+			start = i + 1
+		}
+	}
+	add(sql[start:])
+	return statements
+}
+
+// Query runs sql on the nearest endpoint when it only reads, else on
+// the primary.
+func (router *ReadRouter) Query(sql string, vars interface{}) (interface{}, error) {
+	if !readOnly(sql) {
+		return router.primary.db.Query(sql, vars)
+	}
+	return router.read(func(db GhostDB) (interface{}, error) { return db.Query(sql, vars) })
+}
+
+// Create creates a record on the primary.
+func (router *ReadRouter) Create(thing string, data interface{}) (interface{}, error) {
+	return router.primary.db.Create(thing, data)
+}
+
+// Select reads from the nearest endpoint.
+func (router *ReadRouter) Select(what string) (interface{}, error) {
+	return router.read(func(db GhostDB) (interface{}, error) { return db.Select(what) })
+}
+
+// Update updates on the primary.
+func (router *ReadRouter) Update(what string, data interface{}) (interface{}, error) {
+	return router.primary.db.Update(what, data)
+}
+
+// Delete deletes on the primary.
+func (router *ReadRouter) Delete(what string) (interface{}, error) {
+	return router.primary.db.Delete(what)
+}
+
+// Signin signs in on every endpoint, returning the result of the
+// primary.
+func (router *ReadRouter) Signin(vars interface{}) (interface{}, error) {
+	return router.each(func(db GhostDB) (interface{}, error) { return db.Signin(vars) })
+}
+
+// Use switches every endpoint, returning the result of the primary.
+func (router *ReadRouter) Use(ns, database string) (interface{}, error) {
+	return router.each(func(db GhostDB) (interface{}, error) { return db.Use(ns, database) })
+}
+
+func (router *ReadRouter) each(fn func(db GhostDB) (interface{}, error)) (interface{}, error) {
+	var primary interface{}
+	for _, endpoint := range router.all() {
+		result, err := fn(endpoint.db)
+		if err != nil {
+			return nil, fmt.Errorf("database %s: %w", endpoint.Name, err)
+		}
+		if endpoint.Primary {
+			primary = result
+		}
+	}
+	return primary, nil
+}
@@ -0,0 +1,504 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// replayRedacted replaces the secrets of a recorded request.
+const replayRedacted = "[redacted]"
+
+// replayRedactedHeaders are always redacted by a RequestRecorder.
+var replayRedactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key", "X-Csrf-Token"}
+
+// RecordedRequest is a request kept by a RequestRecorder, with its
+// secrets redacted: the values of credential headers, and of body
+// fields named like password, secret, token or key.
+type RecordedRequest struct {
+	ID        string `json:"id"`
+	RequestID string `json:"request_id,omitempty"`
+	Method    string `json:"method"`
+	// URL is the path and query of the request.
+	URL    string      `json:"url"`
+	Route  string      `json:"route,omitempty"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body,omitempty"`
+	// BodyOmitted is set when the body was too large, or of a type
+	// that cannot be redacted, to be kept.
+	BodyOmitted bool      `json:"body_omitted,omitempty"`
+	Identity    string    `json:"identity,omitempty"`
+	Status      int       `json:"status"`
+	Duration    string    `json:"duration"`
+	At          time.Time `json:"at"`
+}
+
+// RequestRecorder keeps the last requests in a ring buffer, to debug
+// them: a request is exported as a ReplayCapture, with a snapshot of
+// the SnapshotTables as fixtures, and replayed against a local
+// instance. Mounted on an Admin, it lists the requests and downloads
+// their captures.
+//
+// Example:
+//  recorder := &ghostutils.RequestRecorder{DB: db, SnapshotTables: []string{"user", "order"}}
+//  r.Use(recorder.Middleware())
+//  admin.Register(recorder)
+//
+//  // locally, with the capture downloaded from /admin/requests/<id>/capture
+//  capture, err := ghostutils.LoadReplayCapture("capture.json")
+//  err = capture.Seed(ctx, localDB)
+//  res, err := capture.Replay(ctx, "http://localhost:8080", http.Header{"Authorization": {"Bearer " + devToken}})
+type RequestRecorder struct {
+	// Size is the number of requests kept. Defaults to 100.
+	Size int
+	// MaxBody is the largest body kept, in bytes. Defaults to 64KB.
+	MaxBody int64
+	// RedactHeaders and RedactFields are redacted on top of the
+	// credential headers and the secret-like fields.
+	RedactHeaders []string
+	RedactFields  []string
+	// Skip leaves requests out, such as those of the admin itself.
+	Skip func(c *gin.Context) bool
+	// DB is read for the snapshot of SnapshotTables, at most
+	// SnapshotLimit records a table, 100 by default.
+	DB             GhostDB
+	SnapshotTables []string
+	SnapshotLimit  int
+
+	mu       sync.Mutex
+	requests []RecordedRequest
+	next     int
+	base     string
+}
+
+// Middleware records the requests, after they ran.
+func (rec *RequestRecorder) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rec.Skip != nil && rec.Skip(c) {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		recorded := RecordedRequest{
+			ID:     randomID(8),
+			Method: c.Request.Method,
+			URL:    c.Request.URL.RequestURI(),
+			Header: rec.redactHeader(c.Request.Header),
+			At:     start.UTC(),
+		}
+		body, omitted := rec.readBody(c)
+		recorded.Body, recorded.BodyOmitted = body, omitted
+
+		c.Next()
+
+		recorded.RequestID = RequestID(c)
+		recorded.Route = c.FullPath()
+		recorded.Status = c.Writer.Status()
+		recorded.Duration = time.Since(start).Round(time.Microsecond).String()
+		if identity, ok := CurrentIdentity(c); ok {
+			recorded.Identity = identity.ID
+		}
+		rec.store(recorded)
+	}
+}
+
+func (rec *RequestRecorder) store(recorded RecordedRequest) {
+	size := rec.Size
+	if size <= 0 {
+		size = 100
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.requests) < size {
+		rec.requests = append(rec.requests, recorded)
+		return
+	}
+	rec.requests[rec.next%len(rec.requests)] = recorded
+	rec.next = (rec.next + 1) % len(rec.requests)
+}
+
+// Requests returns the recorded requests, newest first.
+func (rec *RequestRecorder) Requests() []RecordedRequest {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	out := make([]RecordedRequest, 0, len(rec.requests))
+	for i := len(rec.requests) - 1; i >= 0; i-- {
+		out = append(out, rec.requests[(rec.next+i)%len(rec.requests)])
+	}
+	return out
+}
+
+// Request returns the recorded request with id.
+func (rec *RequestRecorder) Request(id string) (RecordedRequest, bool) {
+	for _, recorded := range rec.Requests() {
+		if recorded.ID == id {
+			return recorded, true
+		}
+	}
+	return RecordedRequest{}, false
+}
+
+func (rec *RequestRecorder) redactHeader(header http.Header) http.Header {
+	out := header.Clone()
+	for _, name := range append(append([]string{}, replayRedactedHeaders...), rec.RedactHeaders...) {
+		if _, ok := out[http.CanonicalHeaderKey(name)]; ok {
+			out.Set(name, replayRedacted)
+		}
+	}
+	return out
+}
+
+// redactField reports whether the body field named name is a secret.
+func (rec *RequestRecorder) redactField(name string) bool {
+	lower := strings.ToLower(name)
+	for _, field := range rec.RedactFields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	for _, word := range redactedConfigWords {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody returns the redacted body of the request, and leaves the
+// body for the handlers to read.
+func (rec *RequestRecorder) readBody(c *gin.Context) (string, bool) {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return "", false
+	}
+	limit := rec.MaxBody
+	if limit <= 0 {
+		limit = 64 << 10
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), c.Request.Body), c.Request.Body}
+	if err != nil || int64(len(data)) > limit {
+		return "", true
+	}
+	if len(data) == 0 {
+		return "", false
+	}
+	switch contentType := c.ContentType(); {
+	case strings.Contains(contentType, "json"):
+		var value interface{}
+		if json.Unmarshal(data, &value) != nil {
+			return "", true
+		}
+		redacted, err := json.Marshal(rec.redactValue(value))
+		if err != nil {
+			return "", true
+		}
+		return string(redacted), false
+	case contentType == gin.MIMEPOSTForm:
+		values, err := url.ParseQuery(string(data))
+		if err != nil {
+			return "", true
+		}
+		for name := range values {
+			if rec.redactField(name) {
+				values.Set(name, replayRedacted)
+			}
+		}
+		return values.Encode(), false
+	case strings.HasPrefix(contentType, "text/"), contentType == gin.MIMEXML, contentType == gin.MIMEXML2:
+		return string(data), false
+	}
+	// binaries and multipart uploads
+	return "", true
+}
+
+func (rec *RequestRecorder) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if rec.redactField(key) {
+				v[key] = replayRedacted
+				continue
+			}
+			v[key] = rec.redactValue(field)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = rec.redactValue(v[i])
+		}
+	}
+	return value
+}
+
+// ReplayCapture is a recorded request with the records it may need,
+// written to a file to be replayed elsewhere.
+type ReplayCapture struct {
+	Request  RecordedRequest `json:"request"`
+	Snapshot []Fixture       `json:"snapshot,omitempty"`
+}
+
+// Capture returns the capture of the recorded request with id.
+//
+// Returns:
+//  ReplayCapture
+//  error, surrealdb.ErrNoRow if no such request is kept, or of the
+//  snapshot
+func (rec *RequestRecorder) Capture(ctx context.Context, id string) (ReplayCapture, error) {
+	recorded, ok := rec.Request(id)
+	if !ok {
+		return ReplayCapture{}, surrealdb.ErrNoRow
+	}
+	capture := ReplayCapture{Request: recorded}
+	if rec.DB == nil {
+		return capture, nil
+	}
+	limit := rec.SnapshotLimit
+	if limit <= 0 {
+		limit = 100
+	}
+	tables := map[string]bool{}
+	for _, table := range rec.SnapshotTables {
+		tables[table] = true
+	}
+	db := WithContext(ctx, rec.DB)
+	for _, table := range rec.SnapshotTables {
+		rows, err := surrealQuery[map[string]interface{}](db, "SELECT * FROM type::table($tb) LIMIT $limit", map[string]interface{}{"tb": table, "limit": limit})
+		if err != nil {
+			return capture, fmt.Errorf("snapshot of %s: %w", table, err)
+		}
+		for _, row := range rows {
+			_, id := splitRecordID(row["id"], table)
+			fixture := Fixture{Table: table, ID: id, Data: map[string]interface{}{}}
+			for key, value := range row {
+				switch key {
+				case "id":
+				case "in", "out":
+					link, _ := value.(string)
+					if key == "in" {
+						fixture.In = link
+					} else {
+						fixture.Out = link
+					}
+				default:
+					fixture.Data[key] = snapshotValue(value, tables)
+				}
+			}
+			if fixture.In == "" || fixture.Out == "" {
+				fixture.In, fixture.Out = "", ""
+			}
+			capture.Snapshot = append(capture.Snapshot, fixture)
+		}
+	}
+	return capture, nil
+}
+
+// snapshotValue writes the links to records of tables in the "@" form
+// of fixtures, and escapes other strings starting with @.
+func snapshotValue(value interface{}, tables map[string]bool) interface{} {
+	switch v := value.(type) {
+	case string:
+		if strings.HasPrefix(v, "@") {
+			return "@" + v
+		}
+		if table, id := splitRecordID(v, ""); id != v && tables[table] {
+			return "@" + v
+		}
+	case map[string]interface{}:
+		for key, field := range v {
+			v[key] = snapshotValue(field, tables)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = snapshotValue(v[i], tables)
+		}
+	}
+	return value
+}
+
+// LoadReplayCapture reads a capture written by the capture route of a
+// RequestRecorder.
+func LoadReplayCapture(path string) (ReplayCapture, error) {
+	var capture ReplayCapture
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return capture, err
+	}
+	if err := json.Unmarshal(data, &capture); err != nil {
+		return capture, fmt.Errorf("%s: %w", path, err)
+	}
+	return capture, nil
+}
+
+// Seed writes the snapshot of the capture into db, replacing the
+// records it holds.
+func (capture ReplayCapture) Seed(ctx context.Context, db *surrealdb.DB) error {
+	seeder := &Seeder{DB: db, Fixtures: capture.Snapshot}
+	_, err := seeder.Run(ctx)
+	return err
+}
+
+// NewRequest returns the recorded request, for the server at target,
+// such as http://localhost:8080. Its redacted headers are left out;
+// header sets headers on top, such as local credentials.
+func (capture ReplayCapture) NewRequest(ctx context.Context, target string, header http.Header) (*http.Request, error) {
+	recorded := capture.Request
+	req, err := http.NewRequestWithContext(ctx, recorded.Method, strings.TrimRight(target, "/")+recorded.URL, strings.NewReader(recorded.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range recorded.Header {
+		if len(values) == 1 && values[0] == replayRedacted {
+			continue
+		}
+		req.Header[name] = append([]string(nil), values...)
+	}
+	req.Header.Del("Content-Length")
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	return req, nil
+}
+
+// Replay sends the recorded request to the server at target, with
+// header set on top of the recorded headers.
+//
+// Example:
+//  res, err := capture.Replay(ctx, "http://localhost:8080", nil)
+//  if err == nil && res.StatusCode != capture.Request.Status {
+//      log.Printf("got %d, production answered %d", res.StatusCode, capture.Request.Status)
+//  }
+func (capture ReplayCapture) Replay(ctx context.Context, target string, header http.Header) (*http.Response, error) {
+	if capture.Request.BodyOmitted {
+		return nil, fmt.Errorf("request %s: its body was not recorded", capture.Request.ID)
+	}
+	req, err := capture.NewRequest(ctx, target, header)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// ReplayHandler serves the recorded request with handler in process,
+// such as the engine of a test.
+//
+// Example:
+//  res := capture.ReplayHandler(r, nil)
+//  fmt.Println(res.Code, res.Body.String())
+func (capture ReplayCapture) ReplayHandler(handler http.Handler, header http.Header) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	req, err := capture.NewRequest(context.Background(), "", header)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		res.WriteString(err.Error())
+		return res
+	}
+	handler.ServeHTTP(res, req)
+	return res
+}
+
+// Mount registers GET /requests, listing the recorded requests, and
+// GET /requests/:id/capture, downloading the capture of one.
+func (rec *RequestRecorder) Mount(r gin.IRoutes) {
+	r.GET("/requests", func(c *gin.Context) {
+		c.JSON(http.StatusOK, rec.Requests())
+	})
+	r.GET("/requests/:id/capture", rec.download)
+}
+
+func (rec *RequestRecorder) download(c *gin.Context) {
+	capture, err := rec.Capture(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="capture-`+capture.Request.ID+`.json"`)
+	c.IndentedJSON(http.StatusOK, capture)
+}
+
+// AdminName implements AdminModel.
+func (rec *RequestRecorder) AdminName() string {
+	return "requests"
+}
+
+// AdminTitle implements AdminModel.
+func (rec *RequestRecorder) AdminTitle() string {
+	return "Requests"
+}
+
+func (rec *RequestRecorder) viewRoles(admin *Admin) []string {
+	return admin.roles()
+}
+
+func (rec *RequestRecorder) mount(admin *Admin, g *gin.RouterGroup) {
+	rec.base = strings.TrimRight(g.BasePath(), "/")
+	auth := RequireRole(admin.roles()...)
+	g.GET("", auth, func(c *gin.Context) {
+		view := admin.view(c, "list")
+		view.Model = AdminLink{Name: rec.AdminName(), Title: rec.AdminTitle(), URL: rec.base}
+		view.Table = TableView{Name: "requests", URL: rec.base}
+		for _, title := range []string{"Request", "Status", "Duration", "Identity", "At"} {
+			view.Table.Headers = append(view.Table.Headers, TableHeader{Title: title})
+		}
+		for _, recorded := range rec.Requests() {
+			view.Table.Rows = append(view.Table.Rows, TableRow{
+				ID:    recorded.ID,
+				URL:   rec.base + "/" + recorded.ID,
+				Cells: []string{recorded.Method + " " + recorded.URL, fmt.Sprint(recorded.Status), recorded.Duration, recorded.Identity, recorded.At.Format(time.RFC3339)},
+			})
+		}
+		admin.render(c, http.StatusOK, view)
+	})
+	g.GET("/:id", auth, func(c *gin.Context) {
+		recorded, ok := rec.Request(c.Param("id"))
+		if !ok {
+			Fail(c, surrealdb.ErrNoRow)
+			return
+		}
+		view := admin.view(c, "detail")
+		view.Model = AdminLink{Name: rec.AdminName(), Title: rec.AdminTitle(), URL: rec.base}
+		view.RecordID = recorded.ID
+		view.RecordURL = rec.base + "/" + recorded.ID
+		view.Actions = []AdminLink{{Name: "capture", Title: "Download capture", URL: view.RecordURL + "/capture"}}
+		names := make([]string, 0, len(recorded.Header))
+		for name := range recorded.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var headers []string
+		for _, name := range names {
+			headers = append(headers, name+": "+strings.Join(recorded.Header[name], ", "))
+		}
+		body := recorded.Body
+		if recorded.BodyOmitted {
+			body = "(not recorded)"
+		}
+		view.Record = []AdminValue{
+			{Label: "Request", Value: recorded.Method + " " + recorded.URL},
+			{Label: "Route", Value: recorded.Route},
+			{Label: "Request id", Value: recorded.RequestID},
+			{Label: "Status", Value: fmt.Sprint(recorded.Status)},
+			{Label: "Duration", Value: recorded.Duration},
+			{Label: "Identity", Value: recorded.Identity},
+			{Label: "At", Value: recorded.At.Format(time.RFC3339)},
+			{Label: "Headers", Value: strings.Join(headers, "\n")},
+			{Label: "Body", Value: body},
+		}
+		admin.render(c, http.StatusOK, view)
+	})
+	g.GET("/:id/capture", auth, rec.download)
+}
@@ -0,0 +1,540 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Repository is the typed CRUD layer over one SurrealDB table. Rows
+// are unmarshalled into T through its JSON tags, so T usually has an
+// `json:"id,omitempty"` field holding the record id.
+//
+// When Authorizer is set every read and write is checked against it:
+// List and Query only return records the caller may see, Get reports
+// hidden records as missing, writes need AuthorizeWrite on both the
+// stored and the new record, and authorizers that are RecordStampers
+// stamp ownership on Create and Update. Records that are Sluggable get
+// a unique slug. A Repository is also a BulkStore; RequestLoader
+// batches and caches its lookups by id within a request, and Cached
+// caches its reads across requests.
+//
+// Example:
+//  type Post struct {
+//      ID    string `json:"id,omitempty"`
+//      Title string `json:"title"`
+//      Owner string `json:"owner"`
+//  }
+//
+//  posts := ghostutils.NewRepository[Post](db, "post")
+//  posts.Authorizer = ghostutils.OwnerAuthorizer{}
+//
+//  r.GET("/posts/:id", func(c *gin.Context) {
+//      post, err := posts.Get(c, c.Param("id"))
+//      if errors.Is(err, surrealdb.ErrNoRow) {
+//          c.AbortWithStatus(http.StatusNotFound)
+//          return
+//      }
+//      c.JSON(http.StatusOK, post)
+//  })
+type Repository[T any] struct {
+	DB         GhostDB
+	Table      string
+	Authorizer RecordAuthorizer
+	// ValidateWrites checks records against their binding tags before
+	// Create, Update and Patch write them, see ValidateRecord.
+	ValidateWrites bool
+	// Cache stores the results of Cached repositories, the cache of
+	// the app when nil, see AppFrom.
+	Cache CacheStore
+	// Cursors keeps the cursors of PageCursor server side when set,
+	// see PaginateStored.
+	Cursors *PageCursors
+
+	// fetch and graph are the relations of With, eagerErr the first
+	// invalid one.
+	fetch    []string
+	graph    []string
+	eagerErr error
+	// cache is set by Cached.
+	cache *repositoryCache
+}
+
+// NewRepository returns a Repository for table.
+func NewRepository[T any](db GhostDB, table string) *Repository[T] {
+	return &Repository[T]{DB: db, Table: table}
+}
+
+func (r *Repository[T]) vars(id string) map[string]interface{} {
+	return map[string]interface{}{"tb": r.Table, "id": strings.TrimPrefix(id, r.Table+":")}
+}
+
+// content returns the fields of record to store, without its id.
+func recordContent(record interface{}) (map[string]interface{}, error) {
+	fields, err := recordFields(record)
+	if err != nil {
+		return nil, err
+	}
+	copied := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if k != "id" {
+			copied[k] = v
+		}
+	}
+	collapseLinks(record, copied)
+	return copied, nil
+}
+
+// db returns the DB bound to ctx, see WithContext.
+func (r *Repository[T]) db(ctx context.Context) GhostDB {
+	return WithContext(ctx, r.DB)
+}
+
+// validate checks a record that is about to be written.
+func (r *Repository[T]) validate(ctx context.Context, record T) error {
+	if !r.ValidateWrites {
+		return nil
+	}
+	return ValidateRecord(ctx, record)
+}
+
+func (r *Repository[T]) authorizeWrite(ctx context.Context, record interface{}) error {
+	if r.Authorizer == nil {
+		return nil
+	}
+	return r.Authorizer.AuthorizeWrite(ctx, record)
+}
+
+// Create stores record under a generated id.
+//
+// Returns:
+//  T as stored, with its id
+//  error, ErrForbidden if the caller may not write it, a *BindError
+//  for an invalid record with ValidateWrites
+func (r *Repository[T]) Create(ctx context.Context, record T) (_ T, err error) {
+	span := startDBSpan(ctx, "create", r.Table)
+	defer func() { endSpan(span, err) }()
+	var row T
+	fields, err := r.createContent(ctx, record)
+	if err != nil {
+		return row, err
+	}
+	row, err = surrealCreate[T](r.db(ctx), r.Table, fields)
+	if err == nil {
+		r.invalidateWrite(ctx)
+	}
+	return row, err
+}
+
+// createContent validates, slugs, stamps and authorizes record for
+// Create, returning the content to store.
+func (r *Repository[T]) createContent(ctx context.Context, record T) (map[string]interface{}, error) {
+	if err := r.validate(ctx, record); err != nil {
+		return nil, err
+	}
+	fields, err := recordContent(record)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.maintainSlug(ctx, record, fields, ""); err != nil {
+		return nil, err
+	}
+	if stamper, ok := r.Authorizer.(RecordStamper); ok {
+		if err := stamper.Stamp(ctx, fields); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.authorizeWrite(ctx, fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// Get returns the record with id, which may be given with or without
+// the table prefix.
+//
+// Returns:
+//  T
+//  error, surrealdb.ErrNoRow if it does not exist or the caller may
+//  not see it
+func (r *Repository[T]) Get(ctx context.Context, id string) (_ T, err error) {
+	span := startDBSpan(ctx, "get", r.Table)
+	defer func() { endSpan(span, err) }()
+	return cachedRead(ctx, r, "get", strings.TrimPrefix(id, r.Table+":"), func() (T, error) {
+		row, _, err := r.get(ctx, id)
+		return row, err
+	})
+}
+
+func (r *Repository[T]) get(ctx context.Context, id string) (T, map[string]interface{}, error) {
+	var row T
+	if r.eagerErr != nil {
+		return row, nil, r.eagerErr
+	}
+	projection, fetch := r.eagerSQL()
+	fields, ok, err := surrealFirst[map[string]interface{}](r.db(ctx), "SELECT "+projection+" FROM type::thing($tb, $id)"+fetch, r.vars(id))
+	if err != nil {
+		return row, nil, err
+	}
+	if !ok {
+		return row, nil, surrealdb.ErrNoRow
+	}
+	if r.Authorizer != nil {
+		if err := r.Authorizer.AuthorizeRead(ctx, fields); err != nil {
+			if errors.Is(err, ErrForbidden) {
+				return row, nil, surrealdb.ErrNoRow
+			}
+			return row, nil, err
+		}
+	}
+	if len(r.fetch) > 0 {
+		records, err := r.fetched(ctx, []map[string]interface{}{fields})
+		if err != nil {
+			return row, nil, err
+		}
+		return records[0], fields, nil
+	}
+	err = surrealdb.Unmarshal(fields, &row)
+	return row, fields, err
+}
+
+// List returns the records matching filters, all of them when none
+// are given. Conditions of several filters are combined with AND and
+// the sort of the first filter with one is used.
+//
+// Example:
+//  filter, err := ghostutils.ListFilterFrom(c, rules)
+//  if err != nil {
+//      ghostutils.FailStatus(c, http.StatusBadRequest, err)
+//      return
+//  }
+//  posts, err := repo.List(c, filter)
+func (r *Repository[T]) List(ctx context.Context, filters ...ListFilter) (_ []T, err error) {
+	span := startDBSpan(ctx, "list", r.Table)
+	defer func() { endSpan(span, err) }()
+	if !identifierPattern.MatchString(r.Table) {
+		return nil, fmt.Errorf("invalid table name %q", r.Table)
+	}
+	if r.eagerErr != nil {
+		return nil, r.eagerErr
+	}
+	var (
+		clauses []string
+		order   string
+	)
+	vars := map[string]interface{}{}
+	for i, filter := range filters {
+		// number the variables so filters do not overwrite each other
+		where, filterVars := filter.where(fmt.Sprintf("filter%d", i))
+		if where != "" {
+			for name, value := range filterVars {
+				vars[name] = value
+			}
+			clauses = append(clauses, "("+where+")")
+		}
+		if order == "" {
+			order = filter.OrderBy()
+		}
+	}
+	if r.Authorizer != nil {
+		scope, scopeVars, err := r.Authorizer.Scope(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if scope != "" {
+			clauses = append(clauses, "("+scope+")")
+			for name, value := range scopeVars {
+				vars[name] = value
+			}
+		}
+	}
+	projection, fetch := r.eagerSQL()
+	sql := "SELECT " + projection + " FROM " + r.Table
+	if len(clauses) > 0 {
+		sql += " WHERE " + strings.Join(clauses, " AND ")
+	}
+	if order != "" {
+		sql += " ORDER BY " + order
+	}
+	return cachedRead(ctx, r, "list", []interface{}{sql + fetch, vars}, func() ([]T, error) {
+		if len(r.fetch) == 0 {
+			return surrealQuery[T](r.db(ctx), sql, vars)
+		}
+		rows, err := surrealQuery[map[string]interface{}](r.db(ctx), sql+fetch, vars)
+		if err != nil {
+			return nil, err
+		}
+		return r.fetched(ctx, rows)
+	})
+}
+
+// Page returns one page of the records matching filters, like List.
+//
+// Example:
+//  page, perPage := ghostutils.PageParams(c, 20, 100)
+//  posts, err := repo.Page(c, page, perPage, filter)
+func (r *Repository[T]) Page(ctx context.Context, page, perPage int, filters ...ListFilter) (_ Page[T], err error) {
+	span := startDBSpan(ctx, "page", r.Table)
+	defer func() { endSpan(span, err) }()
+	if r.eagerErr != nil {
+		return Page[T]{Page: page, PerPage: perPage}, r.eagerErr
+	}
+	q, err := r.pageQuery(ctx, filters)
+	if err != nil {
+		return Page[T]{Page: page, PerPage: perPage}, err
+	}
+	sql, vars, err := q.Build()
+	if err != nil {
+		return Page[T]{Page: page, PerPage: perPage}, err
+	}
+	return cachedRead(ctx, r, "page", []interface{}{sql, vars, page, perPage}, func() (Page[T], error) {
+		if len(r.fetch) == 0 {
+			return Paginate[T](r.db(ctx), q, page, perPage)
+		}
+		rows, err := Paginate[map[string]interface{}](r.db(ctx), q, page, perPage)
+		result := Page[T]{Page: rows.Page, PerPage: rows.PerPage, Total: rows.Total}
+		if err != nil {
+			return result, err
+		}
+		result.Items, err = r.fetched(ctx, rows.Items)
+		return result, err
+	})
+}
+
+// PageCursor returns the page of perPage records after, or before,
+// cursor in the order of field, see PaginateCursor. The sort of the
+// filters is replaced by field.
+//
+// Example:
+//  cursor, perPage := ghostutils.CursorParams(c, 20, 100)
+//  posts, err := repo.PageCursor(c, "created_at", true, cursor, perPage, filter)
+func (r *Repository[T]) PageCursor(ctx context.Context, field string, desc bool, cursor string, perPage int, filters ...ListFilter) (_ CursorPage[T], err error) {
+	span := startDBSpan(ctx, "page", r.Table)
+	defer func() { endSpan(span, err) }()
+	if r.eagerErr != nil {
+		return CursorPage[T]{PerPage: perPage}, r.eagerErr
+	}
+	q, err := r.pageQuery(ctx, filters)
+	if err != nil {
+		return CursorPage[T]{PerPage: perPage}, err
+	}
+	sql, vars, err := q.Build()
+	if err != nil {
+		return CursorPage[T]{PerPage: perPage}, err
+	}
+	return cachedRead(ctx, r, "cursor", []interface{}{sql, vars, field, desc, cursor, perPage}, func() (CursorPage[T], error) {
+		if len(r.fetch) == 0 {
+			return repositoryCursorPage[T](ctx, r.db(ctx), r.Cursors, q, field, desc, cursor, perPage)
+		}
+		rows, err := repositoryCursorPage[map[string]interface{}](ctx, r.db(ctx), r.Cursors, q, field, desc, cursor, perPage)
+		result := CursorPage[T]{PerPage: rows.PerPage, Total: rows.Total, Next: rows.Next, Prev: rows.Prev}
+		if err != nil {
+			return result, err
+		}
+		result.Items, err = r.fetched(ctx, rows.Items)
+		return result, err
+	})
+}
+
+// repositoryCursorPage pages with the stored cursors when set.
+func repositoryCursorPage[T any](ctx context.Context, db GhostDB, cursors *PageCursors, q *SelectQuery, field string, desc bool, cursor string, perPage int) (CursorPage[T], error) {
+	if cursors != nil {
+		return PaginateStored[T](ctx, db, cursors, q, field, desc, cursor, perPage)
+	}
+	return PaginateCursor[T](db, q, field, desc, cursor, perPage)
+}
+
+// pageQuery returns the query of the records matching filters that
+// the caller may read.
+func (r *Repository[T]) pageQuery(ctx context.Context, filters []ListFilter) (*SelectQuery, error) {
+	q := Select().From(r.Table).Fetch(r.fetch...)
+	q.graph = append(q.graph, r.graph...)
+	for _, filter := range filters {
+		q.Filter(filter)
+	}
+	if r.Authorizer != nil {
+		scope, scopeVars, err := r.Authorizer.Scope(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if scope != "" {
+			q.Where(scope)
+			for name, value := range scopeVars {
+				q.Bind(name, value)
+			}
+		}
+	}
+	return q, nil
+}
+
+// Update replaces the record with id by record.
+//
+// Returns:
+//  T as stored
+//  error, surrealdb.ErrNoRow if it does not exist, ErrForbidden if
+//  the caller may not write it
+func (r *Repository[T]) Update(ctx context.Context, id string, record T) (_ T, err error) {
+	span := startDBSpan(ctx, "update", r.Table)
+	defer func() { endSpan(span, err) }()
+	var row T
+	if err := r.validate(ctx, record); err != nil {
+		return row, err
+	}
+	fields, err := recordContent(record)
+	if err != nil {
+		return row, err
+	}
+	if err := r.checkWrite(ctx, id, fields); err != nil {
+		return row, err
+	}
+	if err := r.maintainSlug(ctx, record, fields, id); err != nil {
+		return row, err
+	}
+	vars := r.vars(id)
+	vars["data"] = fields
+	row, _, err = surrealFirst[T](r.db(ctx), "UPDATE type::thing($tb, $id) CONTENT $data RETURN AFTER", vars)
+	forgetLoaded(ctx, r.Table, id)
+	r.invalidateWrite(ctx)
+	return row, err
+}
+
+// Patch merges fields into the record with id.
+//
+// Example:
+//  post, err := repo.Patch(ctx, id, map[string]interface{}{"title": "Renamed"})
+//
+// Returns:
+//  T as stored
+//  error, surrealdb.ErrNoRow if it does not exist, ErrForbidden if
+//  the caller may not write it
+func (r *Repository[T]) Patch(ctx context.Context, id string, fields map[string]interface{}) (_ T, err error) {
+	span := startDBSpan(ctx, "patch", r.Table)
+	defer func() { endSpan(span, err) }()
+	var row T
+	patch, err := r.patchContent(ctx, id, fields)
+	if err != nil {
+		return row, err
+	}
+	vars := r.vars(id)
+	vars["data"] = patch
+	row, _, err = surrealFirst[T](r.db(ctx), "UPDATE type::thing($tb, $id) MERGE $data RETURN AFTER", vars)
+	forgetLoaded(ctx, r.Table, id)
+	r.invalidateWrite(ctx)
+	return row, err
+}
+
+// patchContent checks that the caller may write both the stored record
+// and the record after merging fields into it, returning the fields to
+// MERGE.
+func (r *Repository[T]) patchContent(ctx context.Context, id string, fields map[string]interface{}) (map[string]interface{}, error) {
+	_, stored, err := r.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.authorizeWrite(ctx, stored); err != nil {
+		return nil, err
+	}
+	merged := make(map[string]interface{}, len(stored)+len(fields))
+	for k, v := range stored {
+		merged[k] = v
+	}
+	patch := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if k != "id" {
+			merged[k], patch[k] = v, v
+		}
+	}
+	if err := r.authorizeWrite(ctx, merged); err != nil {
+		return nil, err
+	}
+	if r.ValidateWrites {
+		// the record as it will be after the merge
+		raw, err := json.Marshal(merged)
+		if err != nil {
+			return nil, err
+		}
+		var record T
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return nil, err
+		}
+		if err := r.validate(ctx, record); err != nil {
+			return nil, err
+		}
+	}
+	return patch, nil
+}
+
+// Delete removes the record with id.
+//
+// Returns:
+//  error, surrealdb.ErrNoRow if it does not exist, ErrForbidden if
+//  the caller may not write it
+func (r *Repository[T]) Delete(ctx context.Context, id string) (err error) {
+	span := startDBSpan(ctx, "delete", r.Table)
+	defer func() { endSpan(span, err) }()
+	if err := r.checkWrite(ctx, id, nil); err != nil {
+		return err
+	}
+	_, err = surrealQuery[map[string]interface{}](r.db(ctx), "DELETE type::thing($tb, $id)", r.vars(id))
+	forgetLoaded(ctx, r.Table, id)
+	r.invalidateWrite(ctx)
+	return err
+}
+
+// checkWrite loads the stored record, which must exist, and
+// authorizes writing it and, when set, its replacement.
+func (r *Repository[T]) checkWrite(ctx context.Context, id string, replacement map[string]interface{}) error {
+	_, stored, err := r.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := r.authorizeWrite(ctx, stored); err != nil {
+		return err
+	}
+	if replacement != nil {
+		// a replacement without an owner keeps the caller's
+		if stamper, ok := r.Authorizer.(RecordStamper); ok {
+			if err := stamper.Stamp(ctx, replacement); err != nil {
+				return err
+			}
+		}
+		return r.authorizeWrite(ctx, replacement)
+	}
+	return nil
+}
+
+// Query runs a SurrealQL statement whose rows are records of T, such
+// as a SELECT with a graph traversal. With an Authorizer set, rows
+// the caller may not see are dropped; use the DB directly for
+// statements that do not return records.
+//
+// Example:
+//  recent, err := repo.Query(ctx, "SELECT * FROM post WHERE created_at > $since", map[string]interface{}{
+//      "since": time.Now().Add(-24 * time.Hour),
+//  })
+func (r *Repository[T]) Query(ctx context.Context, sql string, vars map[string]interface{}) (_ []T, err error) {
+	span := startDBSpan(ctx, "query", r.Table)
+	defer func() { endSpan(span, err) }()
+	if r.Authorizer == nil {
+		return surrealQuery[T](r.db(ctx), sql, vars)
+	}
+	rows, err := surrealQuery[map[string]interface{}](r.db(ctx), sql, vars)
+	if err != nil {
+		return nil, err
+	}
+	visible := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		err := r.Authorizer.AuthorizeRead(ctx, row)
+		switch {
+		case err == nil:
+			visible = append(visible, row)
+		case !errors.Is(err, ErrForbidden):
+			return nil, err
+		}
+	}
+	return unmarshalRows[T](visible)
+}
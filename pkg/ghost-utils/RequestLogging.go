@@ -0,0 +1,120 @@
+package ghostutils
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the id of a request, kept from the client or
+// proxy when it sends one and generated otherwise.
+const RequestIDHeader = "X-Request-ID"
+
+const (
+	requestIDKey     = "ghost-request-id"
+	requestLoggerKey = "ghost-logger"
+)
+
+// RequestLogger logs each request to logger with its method, path,
+// route, status, latency, client IP, response size and request id,
+// and trace id when Tracing runs before it, and the usage of Budgets
+// when it runs after, at warn for 4xx statuses
+// and error for 5xx. Handlers log with Log(c), which carries the
+// request id. It replaces gin's logger, so use it with gin.New.
+//
+// Example:
+//  logger, err := ghostutils.NewLogger(ghostConfig.Logging)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  r := gin.New()
+//  r.Use(gin.Recovery(), ghostutils.RequestLogger(logger.Slog()))
+func RequestLogger(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = randomID(8)
+		}
+		c.Set(requestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		requestLogger := logger.With("request_id", id)
+		if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+			// traced by Tracing, installed before
+			requestLogger = requestLogger.With("trace_id", span.TraceID().String())
+		}
+		c.Set(requestLoggerKey, requestLogger)
+		// handlers may rewrite the path
+		path := c.Request.URL.Path
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		size := c.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", path),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Int("bytes", size),
+		}
+		if route := c.FullPath(); route != "" {
+			attrs = append(attrs, slog.String("route", route))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		if budget := RequestBudget(c); budget != nil {
+			// counted by Budgets, installed after
+			attrs = append(attrs, budget.logValue())
+		}
+		requestLogger.LogAttrs(c, level, "request", attrs...)
+	}
+}
+
+// validRequestID reports whether id is fit for the logs: up to 128
+// printable characters without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Log returns the logger of the request, with its request id, or
+// slog.Default outside RequestLogger.
+//
+// Example:
+//  ghostutils.Log(c).Info("post published", "post", post.ID)
+func Log(c *gin.Context) *slog.Logger {
+	if value, ok := c.Get(requestLoggerKey); ok {
+		if logger, ok := value.(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+// RequestID returns the id of the request, empty outside
+// RequestLogger.
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
@@ -0,0 +1,244 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// GhostError is an error with the status it answers and a machine
+// readable code. Handlers return them, or errors wrapping them, to
+// Fail or c.Error.
+//
+// Example:
+//  if order.Paid {
+//      ghostutils.Fail(c, ghostutils.NewGhostError(http.StatusConflict, "order_paid", "the order is already paid"))
+//      return
+//  }
+type GhostError struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+	// Err is the cause, logged but never sent.
+	Err error `json:"-"`
+}
+
+// NewGhostError returns the error answering status with code and
+// message.
+func NewGhostError(status int, code, message string) *GhostError {
+	return &GhostError{Status: status, Code: code, Message: message}
+}
+
+func (e *GhostError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *GhostError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap returns a copy of the error with err as its cause.
+func (e *GhostError) Wrap(err error) *GhostError {
+	wrapped := *e
+	wrapped.Err = err
+	return &wrapped
+}
+
+// WithDetails returns a copy of the error with details, such as the
+// rows already written when a batch failed.
+func (e *GhostError) WithDetails(details interface{}) *GhostError {
+	detailed := *e
+	detailed.Details = details
+	return &detailed
+}
+
+// Envelope is the JSON body of every response sent through OK,
+// Created and Fail:
+//  {"data": {...}, "meta": {...}}
+//  {"error": {"code": "not_found", "message": "not found"}}
+type Envelope struct {
+	Data  interface{} `json:"data,omitempty"`
+	Meta  interface{} `json:"meta,omitempty"`
+	Error *GhostError `json:"error,omitempty"`
+}
+
+// OK answers 200 with data in the envelope, without the fields the
+// caller may not view, see VisibleFields.
+func OK(c *gin.Context, data interface{}) {
+	c.JSON(http.StatusOK, Envelope{Data: VisibleFields(c, data)})
+}
+
+// OKWithMeta answers 200 with data and meta, such as the totals of a
+// page, in the envelope.
+func OKWithMeta(c *gin.Context, data, meta interface{}) {
+	c.JSON(http.StatusOK, Envelope{Data: VisibleFields(c, data), Meta: meta})
+}
+
+// Created answers 201 with the created data in the envelope.
+func Created(c *gin.Context, data interface{}) {
+	c.JSON(http.StatusCreated, Envelope{Data: VisibleFields(c, data)})
+}
+
+// Fail aborts with err in the envelope. Errors that are not a
+// GhostError, and do not wrap one, are mapped by AsGhostError; a
+// cause of a 5xx is logged rather than sent.
+func Fail(c *gin.Context, err error) {
+	ghostErr := AsGhostError(err)
+	if ghostErr.Status >= http.StatusInternalServerError {
+		log.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+	}
+	c.AbortWithStatusJSON(ghostErr.Status, Envelope{Error: ghostErr})
+}
+
+// FailStatus aborts with err answering status, for handlers that know
+// the status but not the error, like a request that failed to bind.
+// The GhostError of err is kept when it answers status too; otherwise
+// the error carries the text of err, or the status text for a 5xx.
+//
+// Example:
+//  if err := c.ShouldBindJSON(&req); err != nil {
+//      ghostutils.FailStatus(c, http.StatusBadRequest, err)
+//      return
+//  }
+func FailStatus(c *gin.Context, status int, err error) {
+	ghostErr := AsGhostError(err)
+	if ghostErr.Status != status {
+		message := err.Error()
+		if status >= http.StatusInternalServerError {
+			message = http.StatusText(status)
+		}
+		ghostErr = NewGhostError(status, codeForStatus(status), message).Wrap(err)
+	}
+	Fail(c, ghostErr)
+}
+
+// AsGhostError returns the GhostError for err: the one it wraps, or
+// one for the errors of this package, like a BindError, ErrForbidden
+// or surrealdb.ErrNoRow. Other errors become an internal error that
+// hides their text.
+func AsGhostError(err error) *GhostError {
+	var ghostErr *GhostError
+	if errors.As(err, &ghostErr) {
+		return ghostErr
+	}
+	var bindErr *BindError
+	if errors.As(err, &bindErr) {
+		code := "invalid_request"
+		if bindErr.Status == http.StatusUnprocessableEntity {
+			code = "validation_failed"
+		}
+		ghostErr := NewGhostError(bindErr.Status, code, bindErr.Message).Wrap(err)
+		if len(bindErr.Fields) > 0 {
+			ghostErr.Details = bindErr.Fields
+		}
+		return ghostErr
+	}
+	var filterErr *FilterError
+	if errors.As(err, &filterErr) {
+		return NewGhostError(http.StatusBadRequest, "invalid_filter", filterErr.Error()).Wrap(err)
+	}
+	switch {
+	case errors.Is(err, ErrUnauthenticated), errors.Is(err, ErrInvalidToken), errors.Is(err, ErrInvalidCredentials), errors.Is(err, ErrAPIKeyInvalid):
+		return NewGhostError(http.StatusUnauthorized, "unauthenticated", err.Error()).Wrap(err)
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrNotMember), errors.Is(err, ErrInviteEmail):
+		return NewGhostError(http.StatusForbidden, "forbidden", err.Error()).Wrap(err)
+	case errors.Is(err, ErrShortLinkNotFound), errors.Is(err, ErrCommentNotFound), errors.Is(err, ErrUploadNotFound), errors.Is(err, ErrTagNotFound), errors.Is(err, ErrAPIKeyNotFound):
+		return NewGhostError(http.StatusNotFound, "not_found", err.Error()).Wrap(err)
+	case errors.Is(err, ErrShortLinkExpired):
+		return NewGhostError(http.StatusGone, "expired", err.Error()).Wrap(err)
+	case errors.Is(err, ErrShortLinkTaken), errors.Is(err, ErrLastOwner):
+		return NewGhostError(http.StatusConflict, "conflict", err.Error()).Wrap(err)
+	case errors.Is(err, ErrShortLinkInvalid), errors.Is(err, ErrCommentInvalid), errors.Is(err, ErrTagInvalid), errors.Is(err, ErrActivityInvalid), errors.Is(err, ErrAPIKeyLimit), errors.Is(err, ErrAPIPlanUnknown):
+		return NewGhostError(http.StatusUnprocessableEntity, "validation_failed", err.Error()).Wrap(err)
+	case errors.Is(err, ErrAPIRateLimited):
+		return NewGhostError(http.StatusTooManyRequests, "rate_limited", err.Error()).Wrap(err)
+	case errors.Is(err, ErrQuotaExceeded):
+		return NewGhostError(http.StatusTooManyRequests, "quota_exceeded", err.Error()).Wrap(err)
+	case errors.Is(err, ErrUploadTooLarge):
+		return NewGhostError(http.StatusRequestEntityTooLarge, "too_large", err.Error()).Wrap(err)
+	case errors.Is(err, ErrUploadType):
+		return NewGhostError(http.StatusUnsupportedMediaType, "unsupported_media_type", err.Error()).Wrap(err)
+	case errors.Is(err, ErrInvalidCursor):
+		return NewGhostError(http.StatusBadRequest, "invalid_cursor", err.Error()).Wrap(err)
+	case errors.Is(err, ErrPoolUnavailable), errors.Is(err, ErrPoolClosed):
+		return NewGhostError(http.StatusServiceUnavailable, "unavailable", err.Error()).Wrap(err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewGhostError(http.StatusGatewayTimeout, "timeout", "the request took too long").Wrap(err)
+	case errors.Is(err, surrealdb.ErrNoRow):
+		return NewGhostError(http.StatusNotFound, "not_found", "not found").Wrap(err)
+	}
+	return NewGhostError(http.StatusInternalServerError, "internal", "internal server error").Wrap(err)
+}
+
+// ErrorHandler answers the last error added with c.Error, or by
+// c.AbortWithError, in the envelope when nothing else was written.
+// Install it first so it sees the errors of every handler.
+//
+// Example:
+//  r.Use(ghostutils.ErrorHandler())
+//  r.GET("/orders/:id", func(c *gin.Context) {
+//      order, err := orders.Get(c, c.Param("id"))
+//      if err != nil {
+//          c.Error(err)
+//          return
+//      }
+//      ghostutils.OK(c, order)
+//  })
+func ErrorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		// AbortWithError writes the status but no body
+		if len(c.Errors) == 0 || c.Writer.Size() > 0 {
+			return
+		}
+		err := c.Errors.Last().Err
+		ghostErr := AsGhostError(err)
+		if c.Writer.Status() != http.StatusOK && ghostErr.Code == "internal" {
+			// c.AbortWithError chose the status
+			ghostErr.Status = c.Writer.Status()
+			ghostErr.Code = codeForStatus(ghostErr.Status)
+			ghostErr.Message = http.StatusText(ghostErr.Status)
+		}
+		if ghostErr.Status >= http.StatusInternalServerError {
+			log.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+		}
+		if c.Writer.Written() {
+			c.Render(-1, render.JSON{Data: Envelope{Error: ghostErr}})
+			return
+		}
+		c.JSON(ghostErr.Status, Envelope{Error: ghostErr})
+	}
+}
+
+// codeForStatus returns the code of errors only known by status.
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request"
+	case http.StatusUnauthorized:
+		return "unauthenticated"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusUnprocessableEntity:
+		return "validation_failed"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	}
+	if status >= http.StatusInternalServerError {
+		return "internal"
+	}
+	return "error"
+}
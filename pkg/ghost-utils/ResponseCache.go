@@ -0,0 +1,186 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultResponseCacheMaxBody is the largest body ResponseCache keeps.
+const DefaultResponseCacheMaxBody = 1 << 20
+
+// ResponseCache caches the 200 answers to GET requests of the routes
+// it is installed on. Answers setting cookies, marked private or
+// no-store, or streamed are not cached. Cached answers carry
+// X-Cache: HIT, fresh ones X-Cache: MISS.
+//
+// Example:
+//  posts := ghostutils.CacheResponses(time.Minute, "table:post")
+//  r.GET("/posts", posts, listPosts)
+//
+//  // after a post changes
+//  ghostutils.InvalidateCache(c, "table:post")
+type ResponseCache struct {
+	// Store keeps the answers, the cache of the app when nil, see
+	// AppFrom.
+	Store CacheStore
+	// TTL is the lifetime of the answers, the ttl of the cache block
+	// when zero.
+	TTL time.Duration
+	// Tags of the answers, "responses" is always added.
+	Tags []string
+	// Vary are request headers keying the answers besides the URL;
+	// Accept and HX-Request always do.
+	Vary []string
+	// PerIdentity keys the answers by the signed in identity too, for
+	// pages that differ by user; anonymous answers are not cached then.
+	PerIdentity bool
+	// MaxBody is the largest body kept, DefaultResponseCacheMaxBody by
+	// default.
+	MaxBody int
+}
+
+// CacheResponses returns the middleware of a ResponseCache with ttl
+// and tags.
+func CacheResponses(ttl time.Duration, tags ...string) gin.HandlerFunc {
+	return (&ResponseCache{TTL: ttl, Tags: tags}).Middleware()
+}
+
+// cachedResponse is a stored answer.
+type cachedResponse struct {
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// responseCacheWriter keeps a copy of the body written through it.
+type responseCacheWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	max      int
+	overflow bool
+	flushed  bool
+}
+
+func (w *responseCacheWriter) Write(data []byte) (int, error) {
+	w.keep(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseCacheWriter) WriteString(s string) (int, error) {
+	w.keep([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *responseCacheWriter) Flush() {
+	w.flushed = true
+	w.ResponseWriter.Flush()
+}
+
+func (w *responseCacheWriter) keep(data []byte) {
+	if w.overflow {
+		return
+	}
+	if w.body.Len()+len(data) > w.max {
+		w.overflow = true
+		w.body.Reset()
+		return
+	}
+	w.body.Write(data)
+}
+
+func (rc *ResponseCache) store(ctx context.Context) CacheStore {
+	if rc.Store == nil {
+		return contextCache(ctx)
+	}
+	return rc.Store
+}
+
+// key returns the cache key of the request.
+func (rc *ResponseCache) key(c *gin.Context) string {
+	parts := []string{c.Request.URL.RequestURI(), c.GetHeader("Accept"), c.GetHeader("HX-Request")}
+	for _, header := range rc.Vary {
+		parts = append(parts, c.GetHeader(header))
+	}
+	if rc.PerIdentity {
+		if identity, ok := CurrentIdentity(c); ok {
+			parts = append(parts, identity.ID)
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return "response:" + hex.EncodeToString(sum[:16])
+}
+
+// cacheable tells whether the answer of the writer may be stored.
+func cacheable(w *responseCacheWriter) bool {
+	if w.Status() != http.StatusOK || w.overflow || w.flushed {
+		return false
+	}
+	header := w.Header()
+	if header.Get("Set-Cookie") != "" || strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+	control := strings.ToLower(header.Get("Cache-Control"))
+	return !strings.Contains(control, "private") && !strings.Contains(control, "no-store")
+}
+
+// Middleware answers GET requests from the cache, or stores the
+// answer of the handlers.
+func (rc *ResponseCache) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+		if rc.PerIdentity {
+			if _, ok := CurrentIdentity(c); !ok {
+				c.Next()
+				return
+			}
+		}
+		key := rc.key(c)
+		ctx := c.Request.Context()
+		if raw, ok, err := rc.store(ctx).Get(ctx, key); err == nil && ok {
+			var cached cachedResponse
+			if json.Unmarshal(raw, &cached) == nil {
+				for name, values := range cached.Header {
+					c.Writer.Header()[name] = values
+				}
+				c.Header("X-Cache", "HIT")
+				c.Status(http.StatusOK)
+				c.Writer.Write(cached.Body)
+				c.Abort()
+				return
+			}
+		}
+		limit := rc.MaxBody
+		if limit <= 0 {
+			limit = DefaultResponseCacheMaxBody
+		}
+		writer := &responseCacheWriter{ResponseWriter: c.Writer, max: limit}
+		c.Writer = writer
+		c.Header("X-Cache", "MISS")
+		c.Next()
+		c.Writer = writer.ResponseWriter
+		if !cacheable(writer) {
+			return
+		}
+		header := writer.Header().Clone()
+		header.Del("X-Cache")
+		header.Del("Date")
+		raw, err := json.Marshal(cachedResponse{Header: header, Body: writer.body.Bytes()})
+		if err != nil {
+			return
+		}
+		tags := append([]string{"responses"}, rc.Tags...)
+		if err := rc.store(ctx).Set(ctx, key, raw, cacheTTL(ctx, rc.TTL), tags); err != nil {
+			c.Error(err)
+		}
+	}
+}
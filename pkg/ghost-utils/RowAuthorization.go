@@ -0,0 +1,139 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by record authorizers.
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+// RecordAuthorizer is consulted by repositories before records are
+// returned or written, so tenant isolation does not depend on every
+// handler remembering a WHERE clause.
+type RecordAuthorizer interface {
+	// AuthorizeRead returns an error if the caller in ctx may not
+	// see record.
+	AuthorizeRead(ctx context.Context, record interface{}) error
+	// AuthorizeWrite returns an error if the caller in ctx may not
+	// create, change or delete record.
+	AuthorizeWrite(ctx context.Context, record interface{}) error
+	// Scope returns a SurrealQL condition, and its variables, that
+	// restricts list queries to records the caller may see. An empty
+	// condition means no restriction.
+	Scope(ctx context.Context) (string, map[string]interface{}, error)
+}
+
+// RecordStamper is implemented by authorizers that fill ownership
+// fields on records before they are created.
+type RecordStamper interface {
+	Stamp(ctx context.Context, record map[string]interface{}) error
+}
+
+// OwnerAuthorizer is the default RecordAuthorizer. Records belong to
+// the organization of the caller when OrgField is set and the caller
+// has an active organization, otherwise to the caller through
+// OwnerField. Identities with a BypassRole see everything.
+//
+// Example:
+//  repo.Authorizer = ghostutils.OwnerAuthorizer{
+//      OwnerField: "owner",
+//      OrgField:   "org",
+//      BypassRoles: []string{ghostutils.AdminRole},
+//  }
+type OwnerAuthorizer struct {
+	OwnerField  string
+	OrgField    string
+	BypassRoles []string
+}
+
+func (a OwnerAuthorizer) ownerField() string {
+	if a.OwnerField == "" {
+		return "owner"
+	}
+	return a.OwnerField
+}
+
+// field returns the record field and expected value for the caller.
+func (a OwnerAuthorizer) field(ctx context.Context) (field, value string, bypass bool, err error) {
+	identity, ok := IdentityFrom(ctx)
+	if !ok {
+		return "", "", false, ErrUnauthenticated
+	}
+	if len(a.BypassRoles) > 0 && identity.HasRole(a.BypassRoles...) && identity.ImpersonatedBy == "" {
+		return "", "", true, nil
+	}
+	if a.OrgField != "" && identity.Organization != "" {
+		return a.OrgField, identity.Organization, false, nil
+	}
+	return a.ownerField(), identity.ID, false, nil
+}
+
+func (a OwnerAuthorizer) check(ctx context.Context, record interface{}) error {
+	field, want, bypass, err := a.field(ctx)
+	if err != nil || bypass {
+		return err
+	}
+	fields, err := recordFields(record)
+	if err != nil {
+		return err
+	}
+	have, _ := fields[field].(string)
+	if have == want {
+		return nil
+	}
+	return ErrForbidden
+}
+
+// AuthorizeRead implements RecordAuthorizer.
+func (a OwnerAuthorizer) AuthorizeRead(ctx context.Context, record interface{}) error {
+	return a.check(ctx, record)
+}
+
+// AuthorizeWrite implements RecordAuthorizer. A record without an
+// owner is refused like any other; writers stamp new records, see
+// Stamp, before authorizing them.
+func (a OwnerAuthorizer) AuthorizeWrite(ctx context.Context, record interface{}) error {
+	return a.check(ctx, record)
+}
+
+// Scope implements RecordAuthorizer.
+func (a OwnerAuthorizer) Scope(ctx context.Context) (string, map[string]interface{}, error) {
+	field, value, bypass, err := a.field(ctx)
+	if err != nil || bypass {
+		return "", nil, err
+	}
+	return fmt.Sprintf("%s = $authz_value", field), map[string]interface{}{"authz_value": value}, nil
+}
+
+// Stamp implements RecordStamper by setting the ownership field of
+// records that do not have one.
+func (a OwnerAuthorizer) Stamp(ctx context.Context, record map[string]interface{}) error {
+	field, value, bypass, err := a.field(ctx)
+	if err != nil || bypass {
+		return err
+	}
+	if have, _ := record[field].(string); have == "" {
+		record[field] = value
+	}
+	return nil
+}
+
+// recordFields flattens a struct or map to its JSON fields.
+func recordFields(record interface{}) (map[string]interface{}, error) {
+	if m, ok := record.(map[string]interface{}); ok {
+		return m, nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
@@ -0,0 +1,81 @@
+package ghostutils
+
+import (
+	"net/http"
+	"os"
+)
+
+// Run modes of the mode setting of ghost.yaml, so one binary scales its
+// web and worker processes apart. ModeWeb serves the routes without
+// running the job queue and the scheduler, ModeWorker runs them and
+// serves only the health and metrics routes, for the probes and the
+// scrapes, and ModeAll, the default, does everything. Setup, the
+// migrations and the connections are the same in every mode.
+//
+//  mode: worker
+//
+// ModeVariable overrides the file, and a flag may override both:
+//
+//  flag.StringVar(&ghostConfig.Mode, "mode", ghostConfig.Mode, "web, worker or all")
+//  flag.Parse()
+const (
+	ModeAll    = "all"
+	ModeWeb    = "web"
+	ModeWorker = "worker"
+)
+
+// ModeVariable sets the run mode, over the mode of ghost.yaml.
+const ModeVariable = "GHOST_MODE"
+
+// modeFromEnv applies ModeVariable.
+func (ghostConfig *GhostConfig) modeFromEnv() {
+	if mode := os.Getenv(ModeVariable); mode != "" {
+		ghostConfig.Mode = mode
+	}
+}
+
+// RunsWeb reports whether the mode serves the routes.
+func (ghostConfig GhostConfig) RunsWeb() bool {
+	return ghostConfig.Mode != ModeWorker
+}
+
+// RunsWorkers reports whether the mode runs the job queue and the
+// scheduler, for the background work an app starts itself.
+//
+// Example:
+//  if ghostConfig.RunsWorkers() {
+//      go feeds.Poll(ctx)
+//  }
+func (ghostConfig GhostConfig) RunsWorkers() bool {
+	return ghostConfig.Mode != ModeWeb
+}
+
+// workerHandler serves the health and metrics routes of r, and 404 for
+// the others.
+func (ghostConfig GhostConfig) workerHandler(r http.Handler) http.Handler {
+	paths := map[string]bool{}
+	if health := ghostConfig.Health; health.Enabled {
+		if health.LivenessPath == "" {
+			health.LivenessPath = DefaultLivenessPath
+		}
+		if health.ReadinessPath == "" {
+			health.ReadinessPath = DefaultReadinessPath
+		}
+		paths[health.LivenessPath] = true
+		paths[health.ReadinessPath] = true
+	}
+	if ghostConfig.Metrics.Enabled {
+		path := ghostConfig.Metrics.Path
+		if path == "" {
+			path = DefaultMetricsPath
+		}
+		paths[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !paths[req.URL.Path] {
+			http.NotFound(w, req)
+			return
+		}
+		r.ServeHTTP(w, req)
+	})
+}
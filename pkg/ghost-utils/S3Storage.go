@@ -0,0 +1,250 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Storage stores blobs in a bucket of S3 or an S3 compatible
+// service such as MinIO, R2 or Spaces, signing the requests with
+// AWS Signature Version 4.
+//
+// Example:
+//  store := ghostutils.S3Storage{
+//      Endpoint:  "http://localhost:9000",
+//      Region:    "us-east-1",
+//      Bucket:    "uploads",
+//      AccessKey: os.Getenv("S3_ACCESS_KEY"),
+//      SecretKey: os.Getenv("S3_SECRET_KEY"),
+//      PathStyle: true,
+//  }
+type S3Storage struct {
+	// Endpoint is the URL of the service, https://s3.<region>.amazonaws.com
+	// by default.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket in the path rather than the host,
+	// which most compatible services need.
+	PathStyle bool
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// s3Unreserved are the characters S3 does not escape in keys.
+const s3Unreserved = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~"
+
+// s3Escape escapes key the way the signature expects, keeping slashes.
+func s3Escape(key string) string {
+	var out strings.Builder
+	for _, b := range []byte(key) {
+		if b == '/' || strings.IndexByte(s3Unreserved, b) >= 0 {
+			out.WriteByte(b)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", b)
+		}
+	}
+	return out.String()
+}
+
+func (s S3Storage) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+// url returns the URL of key.
+func (s S3Storage) url(key string) (*url.URL, error) {
+	key = strings.Trim(strings.TrimSpace(key), "/")
+	if key == "" || s.Bucket == "" {
+		return nil, ErrStorageKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "." || part == ".." {
+			return nil, ErrStorageKey
+		}
+	}
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	escaped := "/" + s3Escape(key)
+	if s.PathStyle {
+		escaped = "/" + s3Escape(s.Bucket) + escaped
+	} else {
+		base.Host = s.Bucket + "." + base.Host
+	}
+	base.Path = strings.TrimRight(base.Path, "/")
+	base.RawPath = base.Path + escaped
+	if unescaped, err := url.PathUnescape(base.RawPath); err == nil {
+		base.Path = unescaped
+	}
+	return base, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds the Signature Version 4 headers to req, whose body hashes
+// to payload.
+func (s S3Storage) sign(req *http.Request, payload string) {
+	now := time.Now().UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	names := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, payload}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+signature)
+}
+
+// do sends a signed request for key.
+func (s S3Storage) do(ctx context.Context, method, key string, body io.ReadSeeker, size int64, payload, contentType string) (*http.Response, error) {
+	target, err := s.url(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil && size > 0 {
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, payload)
+	return s.client().Do(req)
+}
+
+// s3Error returns the error of a failed response, closing its body.
+func s3Error(res *http.Response, key string) error {
+	defer res.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+	return fmt.Errorf("s3: %s %s: %s", key, res.Status, bytes.TrimSpace(detail))
+}
+
+// Put uploads r to key. Readers that cannot seek are spooled to a
+// temporary file first, as the request needs the length and hash of
+// the body.
+func (s S3Storage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		spool, err := os.CreateTemp("", "ghost-s3-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if _, err := io.Copy(spool, r); err != nil {
+			return err
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		body = spool
+	}
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, body)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	res, err := s.do(ctx, http.MethodPut, key, body, size, hex.EncodeToString(hash.Sum(nil)), contentType)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		return s3Error(res, key)
+	}
+	res.Body.Close()
+	return nil
+}
+
+// emptySHA256 is the hash of an empty body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Open returns the body of the object at key. A missing object is an
+// error matching os.ErrNotExist, as with LocalStorage.
+func (s S3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, 0, emptySHA256, "")
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, s3Error(res, key)
+	}
+	return res.Body, nil
+}
+
+// Delete removes the object at key. Deleting a missing key is not an
+// error.
+func (s S3Storage) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, 0, emptySHA256, "")
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusNotFound {
+		return s3Error(res, key)
+	}
+	res.Body.Close()
+	return nil
+}
@@ -0,0 +1,375 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SLOObjective is a service level objective over the routes tagged
+// with Tag, see SLOTag, or listed in Routes as "GET /users/:id" or a
+// bare path for every method. A request is bad when it answers 5xx or
+// takes longer than Latency, when one is set.
+type SLOObjective struct {
+	Name    string        `yaml:"name"`
+	Tag     string        `yaml:"tag"`
+	Routes  []string      `yaml:"routes"`
+	Latency time.Duration `yaml:"latency"`
+	// Target is the fraction of good requests, e.g. 0.999.
+	Target float64 `yaml:"target"`
+}
+
+// SLOConfig is the slo block of ghost.yaml. Alerts follow the
+// multiwindow burn rate method: a fast burn alert fires when the
+// error budget burns FastBurn times faster than sustainable over both
+// the last hour and the last 5 minutes, a slow burn alert at SlowBurn
+// over both 6 hours and 30 minutes.
+//
+//  slo:
+//      window: 720h
+//      webhook: https://alerts.example.com/hooks/slo
+//      objectives:
+//          - name: checkout
+//            tag: checkout
+//            latency: 500ms
+//            target: 0.999
+type SLOConfig struct {
+	Objectives []SLOObjective `yaml:"objectives"`
+	// Window is the error budget period. Defaults to 30 days.
+	Window time.Duration `yaml:"window"`
+	// FastBurn defaults to 14.4, SlowBurn to 6.
+	FastBurn float64 `yaml:"fast-burn"`
+	SlowBurn float64 `yaml:"slow-burn"`
+	// Webhook receives alerts as JSON, signed with WebhookSecret in
+	// the X-Ghost-Signature header when one is set.
+	Webhook       string `yaml:"webhook"`
+	WebhookSecret string `yaml:"webhook-secret"`
+}
+
+// SLO burn alert severities.
+const (
+	SLOFastBurn = "fast-burn"
+	SLOSlowBurn = "slow-burn"
+)
+
+// SLOAlert reports an objective burning its error budget too fast.
+// Resolved alerts are sent once the burn rate drops again.
+type SLOAlert struct {
+	Objective       string    `json:"objective"`
+	Severity        string    `json:"severity"`
+	Resolved        bool      `json:"resolved"`
+	BurnRate        float64   `json:"burn_rate"`
+	Threshold       float64   `json:"threshold"`
+	BudgetRemaining float64   `json:"budget_remaining"`
+	At              time.Time `json:"at"`
+}
+
+// SLOStatus is the state of an objective over the budget window.
+type SLOStatus struct {
+	Objective       string  `json:"objective"`
+	Target          float64 `json:"target"`
+	Requests        int64   `json:"requests"`
+	Bad             int64   `json:"bad"`
+	Ratio           float64 `json:"ratio"`
+	BudgetRemaining float64 `json:"budget_remaining"`
+	BurnRate1h      float64 `json:"burn_rate_1h"`
+}
+
+const sloTagKey = "ghost.slo.tag"
+
+// SLOTag tags the routes it is applied to for the SLOObjective with
+// the same Tag.
+//
+// Example:
+//  checkout := r.Group("/checkout", ghostutils.SLOTag("checkout"))
+func SLOTag(tag string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(sloTagKey, tag)
+		c.Next()
+	}
+}
+
+// SLOTracker evaluates SLOObjectives from the requests recorded by
+// Metrics, see ObserveRequest.
+//
+// Example:
+//  metrics := ghostutils.NewMetrics(ghostConfig.Metrics)
+//  r.Use(metrics.Middleware())
+//  slo := ghostutils.NewSLOTracker(ghostConfig.SLO)
+//  metrics.ObserveRequests(slo.ObserveRequest)
+//  go slo.Run(ctx, time.Minute)
+//  r.GET("/ghost/slo", ghostutils.RequireRole(ghostutils.AdminRole), slo.StatusHandler())
+type SLOTracker struct {
+	config   SLOConfig
+	alerters []func(SLOAlert)
+
+	mu     sync.Mutex
+	states []*sloState
+}
+
+type sloState struct {
+	objective SLOObjective
+	minutes   *sloRing
+	hours     *sloRing
+	firing    map[string]bool
+}
+
+// NewSLOTracker returns a tracker for config. Alerts go to alerters,
+// to LogSLOAlert when none are given, and to config.Webhook when set.
+func NewSLOTracker(config SLOConfig, alerters ...func(SLOAlert)) *SLOTracker {
+	if config.Window <= 0 {
+		config.Window = 30 * 24 * time.Hour
+	}
+	if config.FastBurn <= 0 {
+		config.FastBurn = 14.4
+	}
+	if config.SlowBurn <= 0 {
+		config.SlowBurn = 6
+	}
+	if len(alerters) == 0 {
+		alerters = append(alerters, LogSLOAlert)
+	}
+	if config.Webhook != "" {
+		alerters = append(alerters, WebhookSLOAlert(config.Webhook, config.WebhookSecret))
+	}
+	t := &SLOTracker{config: config, alerters: alerters}
+	hours := int(config.Window / time.Hour)
+	if hours < 1 {
+		hours = 1
+	}
+	for _, objective := range config.Objectives {
+		t.states = append(t.states, &sloState{
+			objective: objective,
+			minutes:   newSLORing(time.Minute, 6*60),
+			hours:     newSLORing(time.Hour, hours),
+			firing:    map[string]bool{},
+		})
+	}
+	return t
+}
+
+// ObserveRequest records the outcome of a request against the
+// objectives matching it, as a RequestObserver of Metrics.
+func (t *SLOTracker) ObserveRequest(request RequestEvent) {
+	route := request.Method + " " + request.Route
+	tag := request.Context.GetString(sloTagKey)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, state := range t.states {
+		if !state.objective.matches(tag, route) {
+			continue
+		}
+		bad := request.Status >= 500 || (state.objective.Latency > 0 && request.Took > state.objective.Latency)
+		state.minutes.add(now, bad)
+		state.hours.add(now, bad)
+	}
+}
+
+func (objective SLOObjective) matches(tag, route string) bool {
+	if objective.Tag != "" && objective.Tag == tag {
+		return true
+	}
+	for _, pattern := range objective.Routes {
+		if pattern == route || (!strings.Contains(pattern, " ") && strings.HasSuffix(route, " "+pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate checks every objective's burn rates and sends alerts that
+// started or resolved since the last evaluation.
+func (t *SLOTracker) Evaluate(now time.Time) []SLOAlert {
+	var alerts []SLOAlert
+	t.mu.Lock()
+	for _, state := range t.states {
+		budget := 1 - state.objective.Target
+		if budget <= 0 {
+			continue
+		}
+		burn := func(d time.Duration) float64 {
+			return state.minutes.sum(now, d).ratio() / budget
+		}
+		remaining := 1 - state.hours.sum(now, t.config.Window).ratio()/budget
+		for _, rule := range []struct {
+			severity    string
+			threshold   float64
+			long, short time.Duration
+		}{
+			{SLOFastBurn, t.config.FastBurn, time.Hour, 5 * time.Minute},
+			{SLOSlowBurn, t.config.SlowBurn, 6 * time.Hour, 30 * time.Minute},
+		} {
+			long, short := burn(rule.long), burn(rule.short)
+			firing := long >= rule.threshold && short >= rule.threshold
+			if firing == state.firing[rule.severity] {
+				continue
+			}
+			state.firing[rule.severity] = firing
+			alerts = append(alerts, SLOAlert{
+				Objective:       state.objective.Name,
+				Severity:        rule.severity,
+				Resolved:        !firing,
+				BurnRate:        long,
+				Threshold:       rule.threshold,
+				BudgetRemaining: remaining,
+				At:              now.UTC(),
+			})
+		}
+	}
+	t.mu.Unlock()
+	for _, alert := range alerts {
+		for _, alerter := range t.alerters {
+			alerter(alert)
+		}
+	}
+	return alerts
+}
+
+// Run evaluates the objectives every interval until ctx is done.
+func (t *SLOTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.Evaluate(now)
+		}
+	}
+}
+
+// Status returns the state of every objective.
+func (t *SLOTracker) Status() []SLOStatus {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statuses := make([]SLOStatus, 0, len(t.states))
+	for _, state := range t.states {
+		window := state.hours.sum(now, t.config.Window)
+		status := SLOStatus{
+			Objective:       state.objective.Name,
+			Target:          state.objective.Target,
+			Requests:        window.total,
+			Bad:             window.bad,
+			Ratio:           1 - window.ratio(),
+			BudgetRemaining: 1,
+		}
+		if budget := 1 - state.objective.Target; budget > 0 {
+			status.BudgetRemaining = 1 - window.ratio()/budget
+			status.BurnRate1h = state.minutes.sum(now, time.Hour).ratio() / budget
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// StatusHandler serves Status as JSON.
+func (t *SLOTracker) StatusHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, t.Status())
+	}
+}
+
+// LogSLOAlert writes alert to the standard logger.
+func LogSLOAlert(alert SLOAlert) {
+	if alert.Resolved {
+		log.Printf("slo: %s %s resolved, budget remaining %.1f%%", alert.Objective, alert.Severity, alert.BudgetRemaining*100)
+		return
+	}
+	log.Printf("slo: %s %s, burn rate %.1f over threshold %.1f, budget remaining %.1f%%",
+		alert.Objective, alert.Severity, alert.BurnRate, alert.Threshold, alert.BudgetRemaining*100)
+}
+
+// WebhookSLOAlert returns an alerter posting alerts as JSON to url,
+// signed like SignWebhook when secret is set.
+func WebhookSLOAlert(url, secret string) func(SLOAlert) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(alert SLOAlert) {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			return
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("slo: webhook: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			req.Header.Set(DefaultWebhookSignatureHeader, "sha256="+hex.EncodeToString(SignWebhook(secret, body)))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("slo: webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("slo: webhook: %s", resp.Status)
+		}
+	}
+}
+
+type sloCount struct {
+	total, bad int64
+}
+
+func (c sloCount) ratio() float64 {
+	if c.total == 0 {
+		return 0
+	}
+	return float64(c.bad) / float64(c.total)
+}
+
+// sloRing counts requests in fixed slots, reusing a slot once it
+// falls out of the ring.
+type sloRing struct {
+	slot   time.Duration
+	counts []sloCount
+	slots  []int64
+}
+
+func newSLORing(slot time.Duration, n int) *sloRing {
+	return &sloRing{slot: slot, counts: make([]sloCount, n), slots: make([]int64, n)}
+}
+
+func (r *sloRing) add(now time.Time, bad bool) {
+	slot := now.UnixNano() / int64(r.slot)
+	i := int(slot % int64(len(r.counts)))
+	if r.slots[i] != slot {
+		r.slots[i], r.counts[i] = slot, sloCount{}
+	}
+	r.counts[i].total++
+	if bad {
+		r.counts[i].bad++
+	}
+}
+
+func (r *sloRing) sum(now time.Time, d time.Duration) sloCount {
+	var total sloCount
+	current := now.UnixNano() / int64(r.slot)
+	n := int(d / r.slot)
+	if n > len(r.counts) {
+		n = len(r.counts)
+	}
+	for k := 0; k < n; k++ {
+		slot := current - int64(k)
+		i := int(slot % int64(len(r.counts)))
+		if r.slots[i] == slot {
+			total.total += r.counts[i].total
+			total.bad += r.counts[i].bad
+		}
+	}
+	return total
+}
@@ -0,0 +1,170 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultSSEHeartbeat is the interval of the keep-alive comments of
+// StreamSSE, short enough for proxies closing idle connections.
+const DefaultSSEHeartbeat = 15 * time.Second
+
+// Event is a server sent event. Data is written as is when it is a
+// string or []byte, one data line per line, and as JSON otherwise.
+type Event struct {
+	// ID is sent back by a reconnecting browser in the Last-Event-ID
+	// header, see LastEventID.
+	ID string
+	// Name is the event type, "message" when empty.
+	Name string
+	Data interface{}
+	// Retry tells the browser how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+// SSEStream writes server sent events to a client.
+type SSEStream struct {
+	// Heartbeat is the interval of keep-alive comments,
+	// DefaultSSEHeartbeat by default.
+	Heartbeat time.Duration
+	// Retry, if set, is sent first as the reconnection delay.
+	Retry time.Duration
+}
+
+// StreamSSE streams the events of ch to the client with the default
+// SSEStream, until ch is closed or the client leaves.
+//
+// Example:
+//  r.GET("/notes/live", func(c *gin.Context) {
+//      sub := hub.Subscribe(c.Request.Context(), "note")
+//      defer sub.Close()
+//      ghostutils.StreamSSE(c, ghostutils.ChangeEvents(c.Request.Context(), sub.Events()))
+//  })
+//
+// Returns:
+//  error if writing to the client failed
+func StreamSSE(c *gin.Context, ch <-chan Event) error {
+	return SSEStream{}.Stream(c, ch)
+}
+
+// Stream streams the events of ch to the client, flushing each one and
+// sending a comment every Heartbeat, until ch is closed or the client
+// leaves.
+func (s SSEStream) Stream(c *gin.Context, ch <-chan Event) error {
+	heartbeat := s.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = DefaultSSEHeartbeat
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-store")
+	c.Header("Connection", "keep-alive")
+	// nginx buffers responses by default
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	if s.Retry > 0 {
+		if _, err := io.WriteString(c.Writer, "retry: "+strconv.FormatInt(s.Retry.Milliseconds(), 10)+"\n\n"); err != nil {
+			return err
+		}
+	}
+	c.Writer.Flush()
+	done := c.Request.Context().Done()
+	for {
+		select {
+		case <-done:
+			return nil
+		case event, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := writeEvent(c.Writer, event); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(c.Writer, ": heartbeat\n\n"); err != nil {
+				return err
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// writeEvent writes event in the text/event-stream format.
+func writeEvent(w io.Writer, event Event) error {
+	var b strings.Builder
+	if event.ID != "" {
+		b.WriteString("id: " + singleLine(event.ID) + "\n")
+	}
+	if event.Name != "" {
+		b.WriteString("event: " + singleLine(event.Name) + "\n")
+	}
+	if event.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+	var data string
+	switch value := event.Data.(type) {
+	case nil:
+	case string:
+		data = value
+	case []byte:
+		data = string(value)
+	default:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		data = string(encoded)
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// singleLine drops the line breaks that would end an SSE field.
+func singleLine(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// LastEventID returns the id of the last event a reconnecting client
+// received, from the Last-Event-ID header or, for the first connection
+// of a page resuming a stream, the lastEventId query parameter. Replay
+// the events after it before streaming new ones.
+//
+// Example:
+//  missed, err := syncLog.Since(c, "note", ghostutils.LastEventID(c), 100)
+func LastEventID(c *gin.Context) string {
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		return id
+	}
+	return c.Query("lastEventId")
+}
+
+// ChangeEvents turns a stream of table changes, such as the events of
+// a LiveSubscription, into "change" events with the cursor of the
+// change as id, closing the returned channel once changes is closed
+// or ctx is done.
+func ChangeEvents(ctx context.Context, changes <-chan SyncChange) <-chan Event {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for change := range changes {
+			select {
+			case events <- Event{ID: change.Cursor, Name: "change", Data: change}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
@@ -0,0 +1,207 @@
+package ghostutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// InitOptions are the values of the ghost.yaml written by InitProject.
+type InitOptions struct {
+	// Name is the project name, the base name of the directory when
+	// empty.
+	Name        string
+	Description string
+	// Port is DefaultPort when 0.
+	Port int
+	// SurrealURL is ws://localhost:8000/rpc when empty.
+	SurrealURL string
+	// Namespace is the project name and Database "main" when empty.
+	Namespace string
+	Database  string
+	// Force replaces an existing ghost.yaml.
+	Force bool
+}
+
+// ErrProjectExists is returned by InitProject for a directory that
+// already has a ghost.yaml.
+var ErrProjectExists = errors.New("ghost.yaml already exists")
+
+// InitProject bootstraps a ghost project in dir: a starter ghost.yaml
+// listing the common settings with their defaults commented out, and
+// the views, static and migrations directories. Existing directories
+// and their files are left alone.
+//
+// Example:
+//  err := ghostutils.InitProject("blog", ghostutils.InitOptions{
+//      Description: "A blog",
+//      Database:    "blog",
+//  })
+//
+// Returns:
+//  error wrapping ErrProjectExists when dir has a ghost.yaml and
+//  opts.Force is not set, or the error of the file system
+func InitProject(dir string, opts InitOptions) error {
+	if opts.Name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		opts.Name = filepath.Base(abs)
+	}
+	if opts.Port == 0 {
+		opts.Port = DefaultPort
+	}
+	if opts.SurrealURL == "" {
+		opts.SurrealURL = "ws://localhost:8000/rpc"
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = opts.Name
+	}
+	if opts.Database == "" {
+		opts.Database = "main"
+	}
+	path := filepath.Join(dir, "ghost.yaml")
+	if _, err := os.Stat(path); err == nil && !opts.Force {
+		return fmt.Errorf("%s: %w", dir, ErrProjectExists)
+	}
+	for _, sub := range []string{DefaultViews, "static", DefaultMigrationsDir} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(sub)), 0o755); err != nil {
+			return err
+		}
+	}
+	var out bytes.Buffer
+	if err := starterConfig.Execute(&out, opts); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0o644)
+}
+
+// starterConfig is the ghost.yaml of InitProject. Strings are quoted
+// with printf %q, which YAML reads back as the same double quoted
+// string.
+var starterConfig = template.Must(template.New("ghost.yaml").Parse(`name: {{printf "%q" .Name}}
+version: "0.1.0"
+description: {{printf "%q" .Description}}
+port: {{.Port}}
+# all, web (routes only) or worker (jobs and scheduler only)
+# mode: all
+
+surrealdb:
+    surrealdb-url: {{printf "%q" .SurrealURL}}
+    # or, without Docker, a server run from the surreal CLI:
+    # surrealdb-url: embedded://memory
+    # read secrets from the environment outside development, e.g.
+    # surrealdb-password: ${SURREALDB_PASS}
+    surrealdb-username: root
+    surrealdb-password: root
+    surrealdb-namespace: {{printf "%q" .Namespace}}
+    surrealdb-database: {{printf "%q" .Database}}
+    # surrealdb-retry:
+    #     max-attempts: 10
+    #     initial-delay: 500ms
+    #     max-delay: 10s
+    # surrealdb-pool:
+    #     size: 4
+
+# views: src/views
+# templates:
+#     glob: "**/*.html"
+
+migrations:
+    dir: migrations
+    auto: true
+
+health:
+    enabled: true
+    # liveness-path: /healthz
+    # readiness-path: /readyz
+
+logging:
+    requests: true
+
+# shutdown:
+#     timeout: 15s
+# cache:
+#     store: memory
+#     ttl: 5m
+# csrf:
+#     enabled: true
+#     secret: ${CSRF_SECRET}
+
+# environments:
+#     production:
+#         port: 80
+#         surrealdb:
+#             surrealdb-url: wss://db.example.com/rpc
+`))
+
+// Write saves the config as YAML to path, leaving out the unset
+// fields, so a config built in code can be loaded back with
+// NewFromPath. Values are written as they are: a config loaded with
+// ${ENV_VAR} references holds the resolved secrets, and one that went
+// through Validate its defaults.
+//
+// Example:
+//  ghostConfig := ghostutils.GhostConfig{Name: "blog", Port: 8080}
+//  ghostConfig.SurrealDB.URL = "ws://localhost:8000/rpc"
+//  if err := ghostConfig.Write("ghost.yaml"); err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  error if the config cannot be encoded or the file written
+func (ghostConfig GhostConfig) Write(path string) error {
+	var doc yaml.Node
+	if err := doc.Encode(ghostConfig); err != nil {
+		return err
+	}
+	pruneYAML(&doc)
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(4)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0o644)
+}
+
+// pruneYAML drops the mapping entries of node whose value is a zero
+// scalar or an empty mapping or sequence, and reports whether node is
+// empty itself.
+func pruneYAML(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.MappingNode:
+		kept := node.Content[:0]
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if !pruneYAML(node.Content[i+1]) {
+				kept = append(kept, node.Content[i], node.Content[i+1])
+			}
+		}
+		node.Content = kept
+		return len(kept) == 0
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			pruneYAML(item)
+		}
+		return len(node.Content) == 0
+	case yaml.ScalarNode:
+		switch node.Value {
+		case "", "0", "false", "0s", "null":
+			return node.Style == 0 || node.Value == ""
+		}
+	case yaml.DocumentNode:
+		for _, item := range node.Content {
+			pruneYAML(item)
+		}
+	}
+	return false
+}
@@ -0,0 +1,338 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// SchedulerConfig is the `scheduler:` block of ghost.yaml. Tasks sets
+// the schedules of the tasks registered in code by name, overriding
+// theirs; with Lock set each run happens on one instance only, which
+// holds a record of LockTable while it runs.
+//
+// Example:
+//  scheduler:
+//    timezone: Europe/Berlin
+//    lock: true
+//    tasks:
+//      purge-sessions: "0 3 * * *"
+//      sync-feeds: "@every 10m"
+type SchedulerConfig struct {
+	// Tasks are cron expressions, descriptors such as @daily, or
+	// @every and a duration, by task name.
+	Tasks    map[string]string `yaml:"tasks"`
+	Timezone string            `yaml:"timezone"`
+	Lock     bool              `yaml:"lock"`
+	// LockTable is schedule_lock by default.
+	LockTable string `yaml:"lock-table"`
+	// LockTTL frees the lock of an instance that crashed during a
+	// run, an hour by default. Runs must be shorter.
+	LockTTL time.Duration `yaml:"lock-ttl"`
+}
+
+// Defaults applied to SchedulerConfig by Validate.
+const (
+	DefaultSchedulerLockTable = "schedule_lock"
+	DefaultSchedulerLockTTL   = time.Hour
+)
+
+// ScheduledFunc is the work of a scheduled task. ctx is done when the
+// scheduler stops.
+type ScheduledFunc func(ctx context.Context) error
+
+// ScheduledTask describes a registered task.
+type ScheduledTask struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Next     time.Time `json:"next"`
+	LastRun  time.Time `json:"last_run,omitempty"`
+	LastErr  string    `json:"last_error,omitempty"`
+	Running  bool      `json:"running"`
+}
+
+type scheduledTask struct {
+	name     string
+	spec     string
+	schedule cron.Schedule
+	fn       ScheduledFunc
+	running  int32
+
+	mu      sync.Mutex
+	next    time.Time
+	lastRun time.Time
+	lastErr error
+}
+
+// intervalSchedule fires every interval, aligned on the Unix epoch so
+// every instance computes the same ticks.
+type intervalSchedule time.Duration
+
+func (every intervalSchedule) Next(t time.Time) time.Time {
+	d := time.Duration(every)
+	return t.Truncate(d).Add(d)
+}
+
+// parseSchedule parses a cron expression, a descriptor or "@every d".
+func parseSchedule(spec string, location *time.Location) (cron.Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("interval %s is shorter than a second", d)
+		}
+		return intervalSchedule(d), nil
+	}
+	if location != nil && location != time.Local && !strings.HasPrefix(spec, "CRON_TZ=") && !strings.HasPrefix(spec, "TZ=") {
+		spec = "CRON_TZ=" + location.String() + " " + spec
+	}
+	return cron.ParseStandard(spec)
+}
+
+// Scheduler runs tasks on cron schedules or intervals. A run is
+// skipped while the previous run of the task goes on.
+//
+// Example:
+//  scheduler, err := ghostConfig.NewScheduler(db)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  scheduler.Cron("purge-sessions", "0 3 * * *", func(ctx context.Context) error {
+//      return sessions.Purge(ctx)
+//  })
+//  scheduler.Every("sync-feeds", 10*time.Minute, feeds.Sync)
+//  scheduler.Start()
+//  ghostConfig.Run(r)
+type Scheduler struct {
+	DB       GhostDB
+	Config   SchedulerConfig
+	Location *time.Location
+
+	holder  string
+	mu      sync.Mutex
+	tasks   []*scheduledTask
+	started bool
+	// web is set in ModeWeb, where Start leaves the tasks to the workers.
+	web bool
+}
+
+// NewScheduler returns the scheduler of the scheduler block, locking
+// through db when lock is set.
+//
+// Returns:
+//  *Scheduler
+//  error for an unknown timezone
+func (ghostConfig GhostConfig) NewScheduler(db GhostDB) (*Scheduler, error) {
+	location := time.Local
+	if ghostConfig.Scheduler.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(ghostConfig.Scheduler.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	host, _ := os.Hostname()
+	return &Scheduler{DB: db, Config: ghostConfig.Scheduler, Location: location, holder: host + "-" + randomID(6), web: !ghostConfig.RunsWorkers()}, nil
+}
+
+// Cron registers fn to run on the cron expression spec, in the
+// timezone of the scheduler, or on the schedule of the task in the
+// scheduler block. It must be called before Start.
+func (s *Scheduler) Cron(name, spec string, fn ScheduledFunc) error {
+	if override, ok := s.Config.Tasks[name]; ok {
+		spec = override
+	}
+	schedule, err := parseSchedule(spec, s.Location)
+	if err != nil {
+		return fmt.Errorf("scheduler: task %s: %w", name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, task := range s.tasks {
+		if task.name == name {
+			return fmt.Errorf("scheduler: task %s is already registered", name)
+		}
+	}
+	s.tasks = append(s.tasks, &scheduledTask{name: name, spec: spec, schedule: schedule, fn: fn})
+	return nil
+}
+
+// Every registers fn to run every interval, or on the schedule of the
+// task in the scheduler block.
+func (s *Scheduler) Every(name string, interval time.Duration, fn ScheduledFunc) error {
+	return s.Cron(name, "@every "+interval.String(), fn)
+}
+
+// Tasks returns the registered tasks, sorted by name.
+func (s *Scheduler) Tasks() []ScheduledTask {
+	s.mu.Lock()
+	tasks := append([]*scheduledTask(nil), s.tasks...)
+	s.mu.Unlock()
+	out := make([]ScheduledTask, 0, len(tasks))
+	for _, task := range tasks {
+		task.mu.Lock()
+		info := ScheduledTask{Name: task.name, Schedule: task.spec, Next: task.next, LastRun: task.lastRun, Running: atomic.LoadInt32(&task.running) == 1}
+		if task.lastErr != nil {
+			info.LastErr = task.lastErr.Error()
+		}
+		task.mu.Unlock()
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Run runs the tasks until ctx is done, then waits for the running
+// ones, whose context is done too.
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return errors.New("scheduler: already running")
+	}
+	s.started = true
+	tasks := append([]*scheduledTask(nil), s.tasks...)
+	s.mu.Unlock()
+	var running sync.WaitGroup
+	var loops sync.WaitGroup
+	for _, task := range tasks {
+		loops.Add(1)
+		go func(task *scheduledTask) {
+			defer loops.Done()
+			for {
+				next := task.schedule.Next(time.Now())
+				task.mu.Lock()
+				task.next = next
+				task.mu.Unlock()
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+				if !atomic.CompareAndSwapInt32(&task.running, 0, 1) {
+					log.Printf("scheduler: %s is still running, skipping the run of %s", task.name, next.Format(time.RFC3339))
+					continue
+				}
+				running.Add(1)
+				go func(tick time.Time) {
+					defer running.Done()
+					defer atomic.StoreInt32(&task.running, 0)
+					s.fire(ctx, task, tick)
+				}(next)
+			}
+		}(task)
+	}
+	loops.Wait()
+	running.Wait()
+	return nil
+}
+
+// fire runs task for tick, once across the instances with lock set.
+func (s *Scheduler) fire(ctx context.Context, task *scheduledTask, tick time.Time) {
+	if s.Config.Lock && s.DB != nil {
+		locked, err := s.lock(task.name, tick)
+		if err != nil {
+			log.Printf("scheduler: locking %s: %v", task.name, err)
+			return
+		}
+		if !locked {
+			// another instance runs this tick
+			return
+		}
+		defer func() {
+			if err := s.unlock(task.name); err != nil {
+				log.Printf("scheduler: unlocking %s: %v", task.name, err)
+			}
+		}()
+	}
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return task.fn(ctx)
+	}()
+	if err != nil {
+		log.Printf("scheduler: %s: %v", task.name, err)
+	}
+	task.mu.Lock()
+	task.lastRun, task.lastErr = tick, err
+	task.mu.Unlock()
+}
+
+func (s *Scheduler) lockTable() string {
+	if s.Config.LockTable == "" {
+		return DefaultSchedulerLockTable
+	}
+	return s.Config.LockTable
+}
+
+// lock takes the record of the task for tick, unless an instance took
+// it for this tick already or still runs an earlier one.
+func (s *Scheduler) lock(name string, tick time.Time) (bool, error) {
+	ttl := s.Config.LockTTL
+	if ttl <= 0 {
+		ttl = DefaultSchedulerLockTTL
+	}
+	_, ok, err := surrealFirst[map[string]interface{}](s.DB, `UPDATE type::thing($tb, $name)
+		SET tick = <datetime>$tick, holder = $holder, locked_until = <datetime>$until
+		WHERE (tick = NONE OR tick < <datetime>$tick) AND (locked_until = NONE OR locked_until < time::now())
+		RETURN AFTER`, map[string]interface{}{
+		"tb":     s.lockTable(),
+		"name":   name,
+		"tick":   tick.UTC(),
+		"holder": s.holder,
+		"until":  time.Now().Add(ttl).UTC(),
+	})
+	return ok, err
+}
+
+// unlock frees the record of the task, keeping its tick.
+func (s *Scheduler) unlock(name string) error {
+	_, err := surrealQuery[map[string]interface{}](s.DB, "UPDATE type::thing($tb, $name) SET locked_until = NONE WHERE holder = $holder", map[string]interface{}{
+		"tb":     s.lockTable(),
+		"name":   name,
+		"holder": s.holder,
+	})
+	return err
+}
+
+// Start runs the scheduler in the background until Run stops the
+// server; its OnStop hooks wait for the running tasks. It does nothing
+// in ModeWeb.
+func (s *Scheduler) Start() {
+	if s.web {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := s.Run(ctx); err != nil {
+			log.Print(err)
+		}
+	}()
+	OnStop(func(stopCtx context.Context) error {
+		cancel()
+		select {
+		case <-stopped:
+			return nil
+		case <-stopCtx.Done():
+			return errors.New("scheduler: running tasks did not finish in time")
+		}
+	})
+}
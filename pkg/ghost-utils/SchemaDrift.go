@@ -0,0 +1,424 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// schemaTable is a table as the migrations define it.
+type schemaTable struct {
+	name       string
+	schemafull bool
+	fields     map[string]string
+	indexes    map[string]schemaIndex
+}
+
+// schemaIndex is an index as the migrations define it.
+type schemaIndex struct {
+	fields []string
+	unique bool
+}
+
+// Kinds of schema drift.
+const (
+	DriftMissingTable = "missing-table"
+	DriftExtraTable   = "extra-table"
+	DriftTableMode    = "table-mode"
+	DriftMissingField = "missing-field"
+	DriftExtraField   = "extra-field"
+	DriftFieldType    = "field-type"
+	DriftMissingIndex = "missing-index"
+	DriftExtraIndex   = "extra-index"
+	DriftIndexChanged = "index-changed"
+)
+
+// SchemaDrift is one difference between the schema the migrations
+// define and the database.
+type SchemaDrift struct {
+	Kind     string `json:"kind"`
+	Table    string `json:"table"`
+	Name     string `json:"name,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (d SchemaDrift) String() string {
+	target := d.Table
+	if d.Name != "" {
+		target += "." + d.Name
+	}
+	switch {
+	case d.Expected != "" && d.Actual != "":
+		return fmt.Sprintf("%s %s: expected %s, found %s", d.Kind, target, d.Expected, d.Actual)
+	case d.Actual != "":
+		return fmt.Sprintf("%s %s: %s", d.Kind, target, d.Actual)
+	}
+	return fmt.Sprintf("%s %s", d.Kind, target)
+}
+
+// SchemaReport lists the drift found by Migrator.CheckSchema.
+type SchemaReport struct {
+	Drift []SchemaDrift `json:"drift"`
+}
+
+// OK reports whether the database matches the migrations.
+func (r SchemaReport) OK() bool {
+	return len(r.Drift) == 0
+}
+
+// WriteTo prints the report one line per drift, for CLIs and
+// startup logs.
+func (r SchemaReport) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	if r.OK() {
+		m, err := fmt.Fprintln(w, "schema: no drift")
+		return int64(m), err
+	}
+	for _, drift := range r.Drift {
+		m, err := fmt.Fprintln(w, "schema: "+drift.String())
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+var (
+	fieldTypePattern  = regexp.MustCompile(`(?i)\bTYPE\s+(.+?)(\s+(VALUE|ASSERT|DEFAULT|PERMISSIONS|FLEXIBLE|READONLY|COMMENT)\b|$)`)
+	indexPattern      = regexp.MustCompile(`(?i)\b(FIELDS|COLUMNS)\s+(.+?)(\s+(UNIQUE|SEARCH|MTREE|COMMENT)\b|$)`)
+	uniquePattern     = regexp.MustCompile(`(?i)\bUNIQUE\b`)
+	schemafullPattern = regexp.MustCompile(`(?i)\bSCHEMAFULL\b`)
+
+	defineTablePattern = regexp.MustCompile(`(?i)^DEFINE TABLE (?:IF NOT EXISTS |OVERWRITE )?([A-Za-z_][A-Za-z0-9_]*)\b`)
+	defineOnPattern    = regexp.MustCompile(`(?i)^DEFINE (FIELD|INDEX) (?:IF NOT EXISTS |OVERWRITE )?(\S+) ON (?:TABLE )?([A-Za-z_][A-Za-z0-9_]*)\b`)
+	removePattern      = regexp.MustCompile(`(?i)^REMOVE (TABLE|FIELD|INDEX) (?:IF EXISTS )?(\S+)(?: ON (?:TABLE )?([A-Za-z_][A-Za-z0-9_]*))?`)
+)
+
+// schema returns the tables, fields and indexes that the applied
+// migrations define, replaying their DEFINE and REMOVE statements in
+// order. Tables only written to, never defined, are not part of it.
+func (m *Migrator) schema(ctx context.Context) (map[string]*schemaTable, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, migration := range m.Migrations {
+		if _, ok := applied[migration.Version]; ok {
+			migrations = append(migrations, migration)
+		}
+	}
+	return migrationSchema(migrations), ctx.Err()
+}
+
+// migrationSchema replays the DEFINE and REMOVE statements of
+// migrations.
+func migrationSchema(migrations []Migration) map[string]*schemaTable {
+	tables := map[string]*schemaTable{}
+	table := func(name string) *schemaTable {
+		if tables[name] == nil {
+			// defining a field defines its table too
+			tables[name] = &schemaTable{name: name, fields: map[string]string{}, indexes: map[string]schemaIndex{}}
+		}
+		return tables[name]
+	}
+	for _, migration := range migrations {
+		for _, statement := range splitSurrealQL(migration.Up) {
+			statement = strings.Join(strings.Fields(statement), " ")
+			if match := defineTablePattern.FindStringSubmatch(statement); match != nil {
+				table(match[1]).schemafull = schemafullPattern.MatchString(statement)
+			} else if match := defineOnPattern.FindStringSubmatch(statement); match != nil {
+				if strings.EqualFold(match[1], "FIELD") {
+					have := ""
+					if typ := fieldTypePattern.FindStringSubmatch(statement); typ != nil {
+						have = strings.TrimSpace(typ[1])
+					}
+					table(match[3]).fields[schemaFieldName(match[2])] = have
+				} else {
+					table(match[3]).indexes[match[2]] = parseIndex(statement)
+				}
+			} else if match := removePattern.FindStringSubmatch(statement); match != nil {
+				switch strings.ToUpper(match[1]) {
+				case "TABLE":
+					delete(tables, match[2])
+				case "FIELD":
+					if tables[match[3]] != nil {
+						delete(tables[match[3]].fields, schemaFieldName(match[2]))
+					}
+				case "INDEX":
+					if tables[match[3]] != nil {
+						delete(tables[match[3]].indexes, match[2])
+					}
+				}
+			}
+		}
+	}
+	return tables
+}
+
+// CheckSchema compares the schema of the applied migrations with the INFO FOR output of the database and reports
+// missing and extra tables, fields and indexes and changed types, so
+// changes made to the database by hand are noticed. Tables the
+// migrations do not define are reported as extra, except the
+// migrations table and those whose name starts with one of ignore
+// (e.g. "sync_log").
+//
+// Example:
+//  report, err := migrator.CheckSchema(ctx)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  report.WriteTo(os.Stderr)
+//
+// Returns:
+//  SchemaReport, empty when there is no drift
+//  error if the database cannot be inspected
+func (m *Migrator) CheckSchema(ctx context.Context, ignore ...string) (SchemaReport, error) {
+	var report SchemaReport
+	tables, err := m.schema(ctx)
+	if err != nil {
+		return report, err
+	}
+	info, err := surrealInfo(m.DB, "INFO FOR DB")
+	if err != nil {
+		return report, err
+	}
+	actualTables := info["tables"]
+	for _, name := range sortedKeys(tables) {
+		table := tables[name]
+		definition, ok := actualTables[name]
+		if !ok {
+			report.Drift = append(report.Drift, SchemaDrift{Kind: DriftMissingTable, Table: name})
+			continue
+		}
+		if full := schemafullPattern.MatchString(definition); full != table.schemafull {
+			report.Drift = append(report.Drift, SchemaDrift{Kind: DriftTableMode, Table: name, Expected: tableMode(table.schemafull), Actual: tableMode(full)})
+		}
+		tableInfo, err := surrealInfo(m.DB, "INFO FOR TABLE "+name)
+		if err != nil {
+			return report, err
+		}
+		report.Drift = append(report.Drift, fieldDrift(table, tableInfo["fields"])...)
+		report.Drift = append(report.Drift, indexDrift(table, tableInfo["indexes"])...)
+	}
+	ignore = append(ignore, m.table())
+	for _, name := range sortedKeys(actualTables) {
+		if tables[name] != nil || hasAnyPrefix(name, ignore) {
+			continue
+		}
+		report.Drift = append(report.Drift, SchemaDrift{Kind: DriftExtraTable, Table: name, Actual: actualTables[name]})
+	}
+	return report, ctx.Err()
+}
+
+// SchemaCheck reports schema drift in the startup report, failing on
+// any difference from the migrations but tables they do not define,
+// which schemaless apps create by writing to them.
+func (m *Migrator) SchemaCheck() StartupCheck {
+	return StartupCheck{Name: "schema", Run: func(ctx context.Context) (string, error) {
+		report, err := m.CheckSchema(ctx)
+		if err != nil {
+			return "", err
+		}
+		var drift []string
+		extra := 0
+		for _, d := range report.Drift {
+			if d.Kind == DriftExtraTable {
+				extra++
+				continue
+			}
+			drift = append(drift, d.String())
+		}
+		if len(drift) > 0 {
+			return "", fmt.Errorf("%d difference(s) from the migrations: %s", len(drift), strings.Join(drift, "; "))
+		}
+		if extra > 0 {
+			return fmt.Sprintf("matches the migrations, %d table(s) not defined by them", extra), nil
+		}
+		return "matches the migrations", nil
+	}}
+}
+
+func fieldDrift(table *schemaTable, actual map[string]string) []SchemaDrift {
+	var drift []SchemaDrift
+	for _, name := range sortedKeys(table.fields) {
+		want := table.fields[name]
+		definition, ok := actual[name]
+		if !ok {
+			definition, ok = actual[strings.ReplaceAll(name, "[*]", ".*")]
+		}
+		if !ok {
+			drift = append(drift, SchemaDrift{Kind: DriftMissingField, Table: table.name, Name: name, Expected: want})
+			continue
+		}
+		if want == "" {
+			continue
+		}
+		have := ""
+		if m := fieldTypePattern.FindStringSubmatch(strings.Join(strings.Fields(definition), " ")); m != nil {
+			have = strings.TrimSpace(m[1])
+		}
+		if !strings.EqualFold(normalizeSurrealType(have), normalizeSurrealType(want)) {
+			drift = append(drift, SchemaDrift{Kind: DriftFieldType, Table: table.name, Name: name, Expected: want, Actual: have})
+		}
+	}
+	for _, name := range sortedKeys(actual) {
+		if _, ok := table.fields[schemaFieldName(name)]; !ok {
+			drift = append(drift, SchemaDrift{Kind: DriftExtraField, Table: table.name, Name: name, Actual: actual[name]})
+		}
+	}
+	return drift
+}
+
+func indexDrift(table *schemaTable, actual map[string]string) []SchemaDrift {
+	var drift []SchemaDrift
+	for _, name := range sortedKeys(table.indexes) {
+		index := table.indexes[name]
+		definition, ok := actual[name]
+		expected := describeIndex(index.fields, index.unique)
+		if !ok {
+			drift = append(drift, SchemaDrift{Kind: DriftMissingIndex, Table: table.name, Name: name, Expected: expected})
+			continue
+		}
+		have := parseIndex(strings.Join(strings.Fields(definition), " "))
+		if described := describeIndex(have.fields, have.unique); described != expected {
+			drift = append(drift, SchemaDrift{Kind: DriftIndexChanged, Table: table.name, Name: name, Expected: expected, Actual: described})
+		}
+	}
+	for _, name := range sortedKeys(actual) {
+		if _, ok := table.indexes[name]; !ok {
+			drift = append(drift, SchemaDrift{Kind: DriftExtraIndex, Table: table.name, Name: name, Actual: actual[name]})
+		}
+	}
+	return drift
+}
+
+// parseIndex reads the fields and uniqueness of a DEFINE INDEX.
+func parseIndex(definition string) schemaIndex {
+	var index schemaIndex
+	if m := indexPattern.FindStringSubmatch(definition); m != nil {
+		for _, field := range strings.Split(m[2], ",") {
+			index.fields = append(index.fields, strings.TrimSpace(field))
+		}
+	}
+	index.unique = uniquePattern.MatchString(definition)
+	return index
+}
+
+// schemaFieldName spells the elements of array fields as INFO FOR
+// TABLE does, tags[*] for tags.*.
+func schemaFieldName(name string) string {
+	return strings.ReplaceAll(name, ".*", "[*]")
+}
+
+// splitSurrealQL splits a script into its statements, keeping the
+// semicolons of blocks, like those of DEFINE EVENT, and strings, and
+// dropping comments.
+func splitSurrealQL(script string) []string {
+	var (
+		statements []string
+		current    strings.Builder
+		depth      int
+		quote      rune
+	)
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		r, next := runes[i], rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		if quote != 0 {
+			current.WriteRune(r)
+			if r == '\\' && next != 0 {
+				current.WriteRune(next)
+				i++
+			} else if r == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '#' || (r == '-' && next == '-') || (r == '/' && next == '/'):
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			current.WriteRune(' ')
+			continue
+		case r == '/' && next == '*':
+			for i += 2; i < len(runes) && !(runes[i-1] == '*' && runes[i] == '/'); i++ {
+			}
+			current.WriteRune(' ')
+			continue
+		case r == '{' || r == '(' || r == '[':
+			depth++
+		case r == '}' || r == ')' || r == ']':
+			depth--
+		case r == ';' && depth == 0:
+			flush()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	flush()
+	return statements
+}
+
+func describeIndex(fields []string, unique bool) string {
+	s := strings.Join(fields, ", ")
+	if unique {
+		s += " UNIQUE"
+	}
+	return s
+}
+
+func tableMode(schemafull bool) string {
+	if schemafull {
+		return "SCHEMAFULL"
+	}
+	return "SCHEMALESS"
+}
+
+// normalizeSurrealType removes whitespace so "option< string >" and
+// "option<string>" compare equal.
+func normalizeSurrealType(t string) string {
+	return strings.Join(strings.Fields(t), "")
+}
+
+// surrealInfo runs an INFO statement and returns its sections, each
+// a map of names to DEFINE statements.
+func surrealInfo(db GhostDB, sql string) (map[string]map[string]string, error) {
+	return surrealdb.SmartUnmarshal[map[string]map[string]string](db.Query(sql, map[string]interface{}{}))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,307 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/surrealdb/surrealdb.go"
+	"gopkg.in/yaml.v3"
+)
+
+// Fixture is one record of a seed file.
+type Fixture struct {
+	Table string
+	ID    string
+	Data  map[string]interface{}
+	// In and Out are set for graph edges, which are created with
+	// RELATE.
+	In  string
+	Out string
+}
+
+// fixtureFilePattern matches <table>.yaml, .yml or .json, optionally
+// prefixed with a number to order the files, e.g. 01_user.yaml.
+var fixtureFilePattern = regexp.MustCompile(`^(?:[0-9]+_)?([A-Za-z_][A-Za-z0-9_]*)\.(ya?ml|json)$`)
+
+// LoadFixtures reads the fixture files in the root of fsys in name
+// order. A file holds the records of the table it is named after,
+// either as a map of id to record or as a list of records with an id
+// field. String values written "@table:id" are record links, "@@"
+// escapes a leading @; records with "in" and "out" links are edges.
+//
+// Example:
+//  # fixtures/01_user.yaml
+//  tobie:
+//    name: Tobie
+//  # fixtures/02_likes.yaml
+//  - id: first
+//    in: "@user:tobie"
+//    out: "@post:hello"
+//
+// Returns:
+//  []Fixture in file order
+//  error if a file cannot be parsed or a record has no id
+func LoadFixtures(fsys fs.FS) ([]Fixture, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []Fixture
+	for _, entry := range entries {
+		m := fixtureFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+		raw, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		var content interface{}
+		if m[2] == "json" {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.UseNumber()
+			err = decoder.Decode(&content)
+		} else {
+			err = yaml.Unmarshal(raw, &content)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", entry.Name(), err)
+		}
+		records, err := fixtureRecords(m[1], normalizeFixture(content))
+		if err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", entry.Name(), err)
+		}
+		fixtures = append(fixtures, records...)
+	}
+	return fixtures, nil
+}
+
+// normalizeFixture turns the map[interface{}]interface{} yaml uses
+// for maps with non-string keys into map[string]interface{}.
+func normalizeFixture(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = normalizeFixture(item)
+		}
+		return value
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			out[fmt.Sprint(key)] = normalizeFixture(item)
+		}
+		return out
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeFixture(item)
+		}
+		return value
+	}
+	return value
+}
+
+func fixtureRecords(table string, content interface{}) ([]Fixture, error) {
+	var records []map[string]interface{}
+	switch content := content.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		for i, item := range content {
+			record, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("record %d is not an object", i)
+			}
+			records = append(records, record)
+		}
+	case map[string]interface{}:
+		ids := make([]string, 0, len(content))
+		for id := range content {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			record, ok := content[id].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("record %s is not an object", id)
+			}
+			record["id"] = id
+			records = append(records, record)
+		}
+	default:
+		return nil, fmt.Errorf("expected a map or list of records")
+	}
+	fixtures := make([]Fixture, 0, len(records))
+	for i, record := range records {
+		_, id := splitRecordID(fmt.Sprint(record["id"]), table)
+		if record["id"] == nil || id == "" || strings.Contains(id, "⟩") {
+			return nil, fmt.Errorf("record %d has no valid id", i)
+		}
+		fixture := Fixture{Table: table, ID: id, Data: map[string]interface{}{}}
+		for key, value := range record {
+			fixture.Data[key] = value
+		}
+		delete(fixture.Data, "id")
+		in, hasIn := fixture.Data["in"].(string)
+		out, hasOut := fixture.Data["out"].(string)
+		if hasIn && hasOut && strings.HasPrefix(in, "@") && strings.HasPrefix(out, "@") {
+			fixture.In, fixture.Out = in[1:], out[1:]
+			delete(fixture.Data, "in")
+			delete(fixture.Data, "out")
+			for _, link := range []string{fixture.In, fixture.Out} {
+				if !recordIDPattern.MatchString(link) {
+					return nil, fmt.Errorf("record %s: invalid edge link %q", id, link)
+				}
+			}
+		}
+		fixtures = append(fixtures, fixture)
+	}
+	return fixtures, nil
+}
+
+// Seeder loads fixtures into a database, for local development and
+// integration test setup.
+//
+// Example:
+//  seeder, err := ghostutils.NewSeeder(db, os.DirFS("fixtures"))
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  seeder.SkipExisting = true
+//  seeded, err := seeder.Run(ctx)
+type Seeder struct {
+	DB       *surrealdb.DB
+	Fixtures []Fixture
+	// SkipExisting leaves records that already exist untouched, so
+	// seeding can run on every start. Otherwise they are replaced.
+	SkipExisting bool
+}
+
+// NewSeeder loads the fixtures in fsys.
+func NewSeeder(db *surrealdb.DB, fsys fs.FS) (*Seeder, error) {
+	fixtures, err := LoadFixtures(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Seeder{DB: db, Fixtures: fixtures}, nil
+}
+
+// Seed replaces the records in the fixture files of dir with their
+// fixture contents.
+//
+// Example:
+//  if _, err := ghostutils.Seed(db, "fixtures/"); err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  []Fixture written
+//  error if loading or any write fails, in which case nothing is written
+func Seed(db *surrealdb.DB, dir string) ([]Fixture, error) {
+	seeder, err := NewSeeder(db, os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+	return seeder.Run(context.Background())
+}
+
+// Run writes the fixtures in one transaction and returns those
+// written.
+func (s *Seeder) Run(ctx context.Context) ([]Fixture, error) {
+	existing := map[string]map[string]bool{}
+	if s.SkipExisting {
+		for _, fixture := range s.Fixtures {
+			if _, ok := existing[fixture.Table]; ok {
+				continue
+			}
+			ids, err := surrealQuery[string](s.DB, "SELECT VALUE <string> meta::id(id) FROM type::table($tb)", map[string]interface{}{"tb": fixture.Table})
+			if err != nil {
+				return nil, err
+			}
+			existing[fixture.Table] = map[string]bool{}
+			for _, id := range ids {
+				existing[fixture.Table][id] = true
+			}
+		}
+	}
+	var written []Fixture
+	err := WithTransaction(s.DB, func(tx *Tx) error {
+		for _, fixture := range s.Fixtures {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if existing[fixture.Table][fixture.ID] {
+				continue
+			}
+			vars := map[string]interface{}{"tb": fixture.Table, "id": fixture.ID}
+			content := fixtureContent(fixture.Data, vars)
+			if fixture.In != "" {
+				tx.Query("DELETE type::thing($tb, $id)", map[string]interface{}{"tb": fixture.Table, "id": fixture.ID})
+				inTable, inID := splitRecordID(fixture.In, "")
+				outTable, outID := splitRecordID(fixture.Out, "")
+				tx.Query(fmt.Sprintf("RELATE %s->%s->%s CONTENT %s",
+					recordID(inTable, inID), recordID(fixture.Table, fixture.ID), recordID(outTable, outID), content), vars)
+			} else {
+				tx.Query("UPDATE type::thing($tb, $id) CONTENT "+content, vars)
+			}
+			written = append(written, fixture)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+// fixtureContent returns a SurrealQL object for data, binding its
+// values in vars and turning "@table:id" strings into record links.
+func fixtureContent(data interface{}, vars map[string]interface{}) string {
+	bind := func(value interface{}) string {
+		name := "v" + strconv.Itoa(len(vars))
+		vars[name] = value
+		return "$" + name
+	}
+	switch data := data.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(data))
+		for key := range data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fields := make([]string, 0, len(keys))
+		for _, key := range keys {
+			fields = append(fields, strconv.Quote(key)+": "+fixtureContent(data[key], vars))
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case []interface{}:
+		items := make([]string, 0, len(data))
+		for _, item := range data {
+			items = append(items, fixtureContent(item, vars))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case string:
+		if strings.HasPrefix(data, "@@") {
+			return bind(data[1:])
+		}
+		if strings.HasPrefix(data, "@") && recordIDPattern.MatchString(data[1:]) {
+			table, id := splitRecordID(data[1:], "")
+			return "type::thing(" + bind(table) + ", " + bind(id) + ")"
+		}
+		return bind(data)
+	case json.Number:
+		if n, err := data.Int64(); err == nil {
+			return bind(n)
+		}
+		f, _ := data.Float64()
+		return bind(f)
+	}
+	return bind(data)
+}
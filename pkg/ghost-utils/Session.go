@@ -0,0 +1,383 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Defaults applied by Sessions to the session block.
+const (
+	DefaultSessionCookie = "ghost_session"
+	DefaultSessionTTL    = 14 * 24 * time.Hour
+	DefaultSessionTable  = "session"
+)
+
+// sessionFlashKey is the session value holding pending flashes.
+const sessionFlashKey = "_flash"
+
+// sessionStateKey is the gin context key of the request's session.
+const sessionStateKey = "ghost-session"
+
+// SessionConfig is the `session:` block of ghost.yaml.
+//
+// Example:
+//  session:
+//    cookie-name: ghost_session
+//    ttl: 336h
+//    same-site: lax
+//    secure: true
+type SessionConfig struct {
+	CookieName string        `yaml:"cookie-name"`
+	TTL        time.Duration `yaml:"ttl"`
+	// SameSite is lax, strict or none, which needs secure.
+	SameSite string `yaml:"same-site"`
+	Secure   bool   `yaml:"secure"`
+	Table    string `yaml:"table"`
+}
+
+// SessionStore persists session values by session id.
+type SessionStore interface {
+	// Load returns the values of the session with id, or
+	// surrealdb.ErrNoRow if it does not exist or has expired.
+	Load(ctx context.Context, id string) (values map[string]interface{}, expires time.Time, err error)
+	Save(ctx context.Context, id string, values map[string]interface{}, expires time.Time) error
+	Delete(ctx context.Context, id string) error
+}
+
+// SurrealSessionStore keeps sessions as records of a SurrealDB table,
+// with their values as an object. Values come back as decoded JSON,
+// so numbers are float64.
+type SurrealSessionStore struct {
+	DB    *surrealdb.DB
+	Table string
+}
+
+type sessionRecord struct {
+	Values  map[string]interface{} `json:"values"`
+	Expires time.Time              `json:"expires_at"`
+}
+
+// Load implements SessionStore.
+func (s *SurrealSessionStore) Load(ctx context.Context, id string) (map[string]interface{}, time.Time, error) {
+	record, ok, err := surrealFirst[sessionRecord](s.DB, "SELECT values, expires_at FROM type::thing($tb, $id) WHERE expires_at > time::now()", map[string]interface{}{
+		"tb": s.Table,
+		"id": id,
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !ok {
+		return nil, time.Time{}, surrealdb.ErrNoRow
+	}
+	return record.Values, record.Expires, nil
+}
+
+// Save implements SessionStore.
+func (s *SurrealSessionStore) Save(ctx context.Context, id string, values map[string]interface{}, expires time.Time) error {
+	_, err := surrealQuery[map[string]interface{}](s.DB, "UPDATE type::thing($tb, $id) CONTENT { values: $values, expires_at: <datetime>$expires }", map[string]interface{}{
+		"tb":      s.Table,
+		"id":      id,
+		"values":  values,
+		"expires": expires.UTC().Format(time.RFC3339Nano),
+	})
+	return err
+}
+
+// Delete implements SessionStore.
+func (s *SurrealSessionStore) Delete(ctx context.Context, id string) error {
+	_, err := surrealQuery[map[string]interface{}](s.DB, "DELETE type::thing($tb, $id)", map[string]interface{}{
+		"tb": s.Table,
+		"id": id,
+	})
+	return err
+}
+
+// Purge removes the expired sessions, e.g. from a daily job.
+func (s *SurrealSessionStore) Purge(ctx context.Context) error {
+	_, err := surrealQuery[map[string]interface{}](s.DB, "DELETE type::table($tb) WHERE expires_at <= time::now()", map[string]interface{}{
+		"tb": s.Table,
+	})
+	return err
+}
+
+// Sessions keeps server side sessions for cookie authenticated apps.
+// The cookie holds a random session id only, the values live in the
+// Store. Sessions are loaded on first use and saved, with the cookie
+// set, just before the response is written; a session that never held
+// a value is not stored at all.
+type Sessions struct {
+	Config SessionConfig
+	Store  SessionStore
+}
+
+// Sessions returns the session middleware of the session block,
+// storing sessions in db.
+//
+// Example:
+//  sessions := ghostConfig.Sessions(db)
+//  r.Use(sessions.Middleware())
+//
+//  r.POST("/login", func(c *gin.Context) {
+//      // ... check the credentials
+//      session := ghostutils.CurrentSession(c)
+//      session.Regenerate()
+//      session.Set("user", user.ID)
+//      ghostutils.AddFlash(c, "success", "Welcome back!")
+//      c.Redirect(http.StatusSeeOther, "/")
+//  })
+func (ghostConfig GhostConfig) Sessions(db *surrealdb.DB) *Sessions {
+	config := ghostConfig.Session
+	if config.CookieName == "" {
+		config.CookieName = DefaultSessionCookie
+	}
+	if config.TTL == 0 {
+		config.TTL = DefaultSessionTTL
+	}
+	if config.Table == "" {
+		config.Table = DefaultSessionTable
+	}
+	return &Sessions{Config: config, Store: &SurrealSessionStore{DB: db, Table: config.Table}}
+}
+
+// Session is the session of one visitor.
+type Session struct {
+	ID      string
+	Values  map[string]interface{}
+	expires time.Time
+	dirty   bool
+	// previous is the id replaced by Regenerate, deleted on save.
+	previous  string
+	destroyed bool
+}
+
+// Get returns the value of key, nil if unset.
+func (s *Session) Get(key string) interface{} {
+	return s.Values[key]
+}
+
+// GetString returns the value of key if it is a string.
+func (s *Session) GetString(key string) string {
+	value, _ := s.Values[key].(string)
+	return value
+}
+
+// Set sets the value of key. Values must encode to JSON.
+func (s *Session) Set(key string, value interface{}) {
+	s.Values[key] = value
+	s.dirty = true
+}
+
+// Delete removes key.
+func (s *Session) Delete(key string) {
+	if _, ok := s.Values[key]; ok {
+		delete(s.Values, key)
+		s.dirty = true
+	}
+}
+
+// Regenerate moves the values to a new session id. Call it when the
+// visitor signs in, so an id planted before cannot be used after.
+func (s *Session) Regenerate() {
+	if s.previous == "" && s.ID != "" {
+		s.previous = s.ID
+	}
+	s.ID = randomID(32)
+	s.destroyed = false
+	s.dirty = true
+}
+
+// Destroy deletes the session and its cookie, e.g. on sign out.
+func (s *Session) Destroy() {
+	s.Values = map[string]interface{}{}
+	s.destroyed = true
+	s.dirty = true
+}
+
+// sessionState is the lazily loaded session of a request.
+type sessionState struct {
+	sessions  *Sessions
+	c         *gin.Context
+	once      sync.Once
+	session   *Session
+	committed bool
+}
+
+func (state *sessionState) load() *Session {
+	state.once.Do(func() {
+		session := &Session{Values: map[string]interface{}{}}
+		if id, err := state.c.Cookie(state.sessions.Config.CookieName); err == nil && id != "" {
+			values, expires, err := state.sessions.Store.Load(state.c.Request.Context(), id)
+			switch {
+			case err == nil:
+				session.ID, session.expires = id, expires
+				if values != nil {
+					session.Values = values
+				}
+			case !errors.Is(err, surrealdb.ErrNoRow):
+				log.Printf("session: loading: %v", err)
+			}
+		}
+		state.session = session
+	})
+	return state.session
+}
+
+// commit saves the session and sets its cookie, once, before the
+// response headers are written.
+func (state *sessionState) commit() {
+	if state.committed || state.session == nil {
+		return
+	}
+	state.committed = true
+	session, sessions, c := state.session, state.sessions, state.c
+	ctx := c.Request.Context()
+	if session.previous != "" {
+		if err := sessions.Store.Delete(ctx, session.previous); err != nil {
+			log.Printf("session: deleting: %v", err)
+		}
+	}
+	if session.destroyed {
+		if session.ID != "" {
+			if err := sessions.Store.Delete(ctx, session.ID); err != nil {
+				log.Printf("session: deleting: %v", err)
+			}
+		}
+		sessions.setCookie(c, "", -1)
+		return
+	}
+	// sessions are extended once half their lifetime has passed
+	stale := !session.expires.IsZero() && time.Until(session.expires) < sessions.Config.TTL/2
+	if !session.dirty && !stale {
+		return
+	}
+	if session.ID == "" {
+		if len(session.Values) == 0 {
+			return
+		}
+		session.ID = randomID(32)
+	}
+	session.expires = time.Now().Add(sessions.Config.TTL)
+	if err := sessions.Store.Save(ctx, session.ID, session.Values, session.expires); err != nil {
+		log.Printf("session: saving: %v", err)
+		return
+	}
+	sessions.setCookie(c, session.ID, int(sessions.Config.TTL/time.Second))
+}
+
+func (sessions *Sessions) setCookie(c *gin.Context, value string, maxAge int) {
+	switch strings.ToLower(sessions.Config.SameSite) {
+	case "strict":
+		c.SetSameSite(http.SameSiteStrictMode)
+	case "none":
+		c.SetSameSite(http.SameSiteNoneMode)
+	default:
+		c.SetSameSite(http.SameSiteLaxMode)
+	}
+	c.SetCookie(sessions.Config.CookieName, value, maxAge, "/", "", sessions.Config.Secure, true)
+}
+
+// sessionWriter commits the session before anything is written.
+type sessionWriter struct {
+	gin.ResponseWriter
+	state *sessionState
+}
+
+func (w *sessionWriter) Write(data []byte) (int, error) {
+	w.state.commit()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *sessionWriter) WriteString(s string) (int, error) {
+	w.state.commit()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *sessionWriter) WriteHeaderNow() {
+	w.state.commit()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *sessionWriter) Flush() {
+	w.state.commit()
+	w.ResponseWriter.Flush()
+}
+
+// Middleware makes the session available to CurrentSession.
+func (sessions *Sessions) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := &sessionState{sessions: sessions, c: c}
+		c.Set(sessionStateKey, state)
+		c.Writer = &sessionWriter{ResponseWriter: c.Writer, state: state}
+		c.Next()
+		// responses without a body are written by gin after the chain
+		state.commit()
+	}
+}
+
+// CurrentSession returns the session of the request, loading it on
+// first use. Without the session middleware it returns an empty
+// session that is never saved.
+func CurrentSession(c *gin.Context) *Session {
+	if value, ok := c.Get(sessionStateKey); ok {
+		return value.(*sessionState).load()
+	}
+	return &Session{Values: map[string]interface{}{}}
+}
+
+// Flash is a one-time message shown on the next page, e.g. after a
+// redirect.
+type Flash struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// AddFlash queues a message of kind, such as "success" or "error",
+// for the next page rendered for the visitor.
+func AddFlash(c *gin.Context, kind, message string) {
+	session := CurrentSession(c)
+	session.Set(sessionFlashKey, append(sessionFlashes(session), Flash{Kind: kind, Message: message}))
+}
+
+// Flashes returns and clears the queued messages.
+func Flashes(c *gin.Context) []Flash {
+	session := CurrentSession(c)
+	flashes := sessionFlashes(session)
+	session.Delete(sessionFlashKey)
+	return flashes
+}
+
+// sessionFlashes reads the queued flashes, which are generic JSON once
+// loaded from the store.
+func sessionFlashes(session *Session) []Flash {
+	switch value := session.Values[sessionFlashKey].(type) {
+	case nil:
+		return nil
+	case []Flash:
+		return value
+	default:
+		var flashes []Flash
+		if raw, err := json.Marshal(value); err == nil {
+			json.Unmarshal(raw, &flashes)
+		}
+		return flashes
+	}
+}
+
+// FlashLayout provides the queued flashes, clearing them.
+//
+// Example:
+//  layout.Provide("Flashes", ghostutils.FlashLayout)
+//
+//  {{range .Layout.Flashes}}<div class="flash flash-{{.Kind}}">{{.Message}}</div>{{end}}
+func FlashLayout(c *gin.Context) (interface{}, error) {
+	return Flashes(c), nil
+}
@@ -0,0 +1,149 @@
+package ghostutils_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+	"github.com/adamkali/ghost_utils/pkg/ghosttest"
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// sessionServer serves the session middleware of the test config on
+// the connection of the test.
+func sessionServer(t *testing.T) *ghosttest.Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db := ghosttest.DB(t)
+	config := ghosttest.Config(t)
+	r := gin.New()
+	r.Use(config.Sessions(db).Middleware())
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "home")
+	})
+	r.POST("/cart", func(c *gin.Context) {
+		ghostutils.CurrentSession(c).Set("cart", "book")
+		c.Status(http.StatusNoContent)
+	})
+	r.POST("/login", func(c *gin.Context) {
+		session := ghostutils.CurrentSession(c)
+		session.Regenerate()
+		session.Set("user", "account:ada")
+		ghostutils.AddFlash(c, "success", "Welcome back!")
+		c.Redirect(http.StatusSeeOther, "/me")
+	})
+	r.GET("/me", func(c *gin.Context) {
+		session := ghostutils.CurrentSession(c)
+		c.JSON(http.StatusOK, gin.H{
+			"user":    session.GetString("user"),
+			"cart":    session.GetString("cart"),
+			"flashes": ghostutils.Flashes(c),
+		})
+	})
+	r.POST("/logout", func(c *gin.Context) {
+		ghostutils.CurrentSession(c).Destroy()
+		c.Status(http.StatusNoContent)
+	})
+	return ghosttest.NewEngineServer(t, r, db, config)
+}
+
+func sessionCookie(res *ghosttest.Response) *http.Cookie {
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == ghostutils.DefaultSessionCookie {
+			return cookie
+		}
+	}
+	return nil
+}
+
+type sessionMe struct {
+	User    string
+	Cart    string
+	Flashes []ghostutils.Flash
+}
+
+// sessionOf gets /me with cookie only, outside the cookie jar of srv.
+func sessionOf(t *testing.T, srv *ghosttest.Server, cookie *http.Cookie) sessionMe {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	srv.Engine.ServeHTTP(w, req)
+	var me sessionMe
+	if err := json.Unmarshal(w.Body.Bytes(), &me); err != nil {
+		t.Fatalf("GET /me: %d %s", w.Code, w.Body)
+	}
+	return me
+}
+
+func TestSessionLogin(t *testing.T) {
+	srv := sessionServer(t)
+	if cookie := sessionCookie(srv.Get("/").AssertStatus(http.StatusOK)); cookie != nil {
+		t.Errorf("cookie %+v for a session without values", cookie)
+	}
+
+	before := sessionCookie(srv.PostJSON("/cart", nil).AssertStatus(http.StatusNoContent))
+	if before == nil || !before.HttpOnly {
+		t.Fatalf("session cookie %+v, want an HttpOnly one", before)
+	}
+	after := sessionCookie(srv.PostJSON("/login", nil).AssertRedirect("/me"))
+	if after == nil || after.Value == before.Value {
+		t.Fatalf("session cookie %+v after login, want a new id", after)
+	}
+
+	var me sessionMe
+	srv.Get("/me").AssertStatus(http.StatusOK).JSON(&me)
+	if me.User != "account:ada" || me.Cart != "book" {
+		t.Errorf("session %+v, want the user and the cart", me)
+	}
+	if len(me.Flashes) != 1 || me.Flashes[0].Message != "Welcome back!" {
+		t.Errorf("flashes %+v", me.Flashes)
+	}
+	srv.Get("/me").AssertStatus(http.StatusOK).JSON(&me)
+	if len(me.Flashes) != 0 {
+		t.Errorf("flashes %+v shown twice", me.Flashes)
+	}
+
+	// the id from before the login is of no use after it
+	if me := sessionOf(t, srv, before); me.User != "" || me.Cart != "" {
+		t.Errorf("session %+v of the id before the login", me)
+	}
+
+	ended := sessionCookie(srv.PostJSON("/logout", nil).AssertStatus(http.StatusNoContent))
+	if ended == nil || ended.MaxAge >= 0 {
+		t.Errorf("cookie %+v after logout, want it removed", ended)
+	}
+	if me := sessionOf(t, srv, after); me.User != "" || me.Cart != "" {
+		t.Errorf("session %+v after logout", me)
+	}
+}
+
+func TestSurrealSessionStoreExpires(t *testing.T) {
+	ctx := context.Background()
+	store := &ghostutils.SurrealSessionStore{DB: ghosttest.DB(t), Table: ghostutils.DefaultSessionTable}
+	if err := store.Save(ctx, "live", map[string]interface{}{"user": "account:ada"}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "expired", map[string]interface{}{"user": "account:ada"}, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	values, expires, err := store.Load(ctx, "live")
+	if err != nil || values["user"] != "account:ada" || time.Until(expires) < 59*time.Minute {
+		t.Errorf("live session: %v, %s, %v", values, expires, err)
+	}
+	if _, _, err := store.Load(ctx, "expired"); !errors.Is(err, surrealdb.ErrNoRow) {
+		t.Errorf("expired session: %v, want ErrNoRow", err)
+	}
+	if err := store.Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Load(ctx, "live"); err != nil {
+		t.Errorf("live session purged: %v", err)
+	}
+}
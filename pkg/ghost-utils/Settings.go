@@ -0,0 +1,552 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Setting types.
+const (
+	SettingString   = "string"
+	SettingBool     = "bool"
+	SettingInt      = "int"
+	SettingFloat    = "float"
+	SettingDuration = "duration"
+	// SettingJSON values are any JSON value, kept as decoded.
+	SettingJSON = "json"
+)
+
+// SettingDefinition declares a runtime setting. Only defined keys can
+// be read or set.
+type SettingDefinition struct {
+	Key string
+	// Type is one of the Setting types, SettingString when empty.
+	Type    string
+	Default interface{}
+	// Description is shown next to the value by admin pages.
+	Description string
+	// Validate checks a converted value before it is stored.
+	Validate func(value interface{}) error
+}
+
+// SettingChange is published to OnChange listeners when a value
+// changes, here or on another instance.
+type SettingChange struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+	// By is the identity that changed it, empty when unknown.
+	By string    `json:"by,omitempty"`
+	At time.Time `json:"at"`
+}
+
+// SettingValue is a setting as listed by the admin endpoint.
+type SettingValue struct {
+	Key         string      `json:"key"`
+	Type        string      `json:"type"`
+	Value       interface{} `json:"value"`
+	Default     interface{} `json:"default"`
+	Description string      `json:"description,omitempty"`
+	// Overridden is false while the setting has its default.
+	Overridden bool       `json:"overridden"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	UpdatedBy  string     `json:"updated_by,omitempty"`
+}
+
+type settingRecord struct {
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	UpdatedBy string      `json:"updated_by"`
+}
+
+// Settings are runtime settings, such as feature toggles, that admins
+// change without a deploy, unlike the static ghost.yaml. Values are
+// stored in the setting table and cached for TTL, so a change made on
+// one instance reaches the others within TTL and their OnChange
+// listeners fire too.
+//
+// Example:
+//  settings := ghostutils.NewSettings(db).
+//      Define(ghostutils.SettingDefinition{Key: "signups.open", Type: ghostutils.SettingBool, Default: true}).
+//      Define(ghostutils.SettingDefinition{Key: "upload.max_mb", Type: ghostutils.SettingInt, Default: 10})
+//  settings.OnChange(func(change ghostutils.SettingChange) {
+//      log.Printf("%s changed to %v by %s", change.Key, change.New, change.By)
+//  })
+//  settings.Mount(r.Group("/", ghostutils.RequireRole(ghostutils.AdminRole)))
+//
+//  if !settings.Bool(c, "signups.open") {
+//      c.AbortWithStatus(http.StatusForbidden)
+//      return
+//  }
+type Settings struct {
+	DB *surrealdb.DB
+	// Table defaults to "setting".
+	Table string
+	// TTL is how long values are cached. Defaults to 30 seconds.
+	TTL time.Duration
+	// Audit records changes made through the admin endpoint.
+	Audit AuditLog
+
+	mu        sync.Mutex
+	defs      map[string]SettingDefinition
+	records   map[string]settingRecord
+	loaded    time.Time
+	listeners []func(SettingChange)
+}
+
+// NewSettings returns the settings stored in db.
+func NewSettings(db *surrealdb.DB) *Settings {
+	return &Settings{DB: db, defs: map[string]SettingDefinition{}}
+}
+
+func (s *Settings) table() string {
+	if s.Table == "" {
+		return "setting"
+	}
+	return s.Table
+}
+
+// Define declares a setting, panicking when its default does not
+// convert to its type.
+func (s *Settings) Define(def SettingDefinition) *Settings {
+	if def.Type == "" {
+		def.Type = SettingString
+	}
+	value, err := convertSetting(def.Type, def.Default)
+	if err != nil {
+		panic(fmt.Sprintf("ghostutils: default of setting %s: %v", def.Key, err))
+	}
+	def.Default = value
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.defs == nil {
+		s.defs = map[string]SettingDefinition{}
+	}
+	s.defs[def.Key] = def
+	return s
+}
+
+// OnChange registers a listener for value changes.
+func (s *Settings) OnChange(listener func(SettingChange)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// refresh reloads the stored values when the cache is older than TTL,
+// publishing the changes made elsewhere.
+func (s *Settings) refresh(force bool) error {
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	s.mu.Lock()
+	fresh := !force && s.records != nil && time.Since(s.loaded) < ttl
+	s.mu.Unlock()
+	if fresh {
+		return nil
+	}
+	rows, err := surrealQuery[settingRecord](s.DB, "SELECT meta::id(id) AS key, value, updated_at, updated_by FROM type::table($tb)", map[string]interface{}{
+		"tb": s.table(),
+	})
+	if err != nil {
+		return err
+	}
+	records := make(map[string]settingRecord, len(rows))
+	for _, row := range rows {
+		records[row.Key] = row
+	}
+	s.mu.Lock()
+	var changes []SettingChange
+	if s.records != nil {
+		for key, def := range s.defs {
+			old, _ := s.value(def, s.records)
+			updated, _ := s.value(def, records)
+			if !reflect.DeepEqual(old, updated) {
+				changes = append(changes, SettingChange{Key: key, Old: old, New: updated, By: records[key].UpdatedBy, At: time.Now()})
+			}
+		}
+	}
+	s.records, s.loaded = records, time.Now()
+	listeners := s.listeners
+	s.mu.Unlock()
+	for _, change := range changes {
+		for _, listener := range listeners {
+			listener(change)
+		}
+	}
+	return nil
+}
+
+// value returns the value of def in records, or its default. ok is
+// false for stored values that no longer convert.
+func (s *Settings) value(def SettingDefinition, records map[string]settingRecord) (interface{}, bool) {
+	record, stored := records[def.Key]
+	if !stored {
+		return def.Default, true
+	}
+	value, err := convertSetting(def.Type, record.Value)
+	if err != nil {
+		return def.Default, false
+	}
+	return value, true
+}
+
+// Get returns the value of key, its default when unset.
+//
+// Returns:
+//  interface{} of the Go type of the setting: string, bool, int64,
+//  float64, time.Duration or decoded JSON
+//  error for undefined keys or when the store cannot be read
+func (s *Settings) Get(ctx context.Context, key string) (interface{}, error) {
+	s.mu.Lock()
+	def, ok := s.defs[key]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("undefined setting %q", key)
+	}
+	if err := s.refresh(false); err != nil {
+		return def.Default, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, converts := s.value(def, s.records)
+	if !converts {
+		log.Printf("settings: stored value of %s is not a %s, using the default", key, def.Type)
+	}
+	return value, nil
+}
+
+// lookup is Get for the typed accessors, which fall back to the
+// default and log when the store cannot be read.
+func (s *Settings) lookup(ctx context.Context, key string) interface{} {
+	value, err := s.Get(ctx, key)
+	if err != nil {
+		log.Printf("settings: %s: %v", key, err)
+	}
+	return value
+}
+
+// String returns a string setting.
+func (s *Settings) String(ctx context.Context, key string) string {
+	value, _ := s.lookup(ctx, key).(string)
+	return value
+}
+
+// Bool returns a bool setting.
+func (s *Settings) Bool(ctx context.Context, key string) bool {
+	value, _ := s.lookup(ctx, key).(bool)
+	return value
+}
+
+// Int returns an int setting.
+func (s *Settings) Int(ctx context.Context, key string) int64 {
+	value, _ := s.lookup(ctx, key).(int64)
+	return value
+}
+
+// Float returns a float setting.
+func (s *Settings) Float(ctx context.Context, key string) float64 {
+	value, _ := s.lookup(ctx, key).(float64)
+	return value
+}
+
+// Duration returns a duration setting.
+func (s *Settings) Duration(ctx context.Context, key string) time.Duration {
+	value, _ := s.lookup(ctx, key).(time.Duration)
+	return value
+}
+
+// Set stores value for key after converting it to the type of the
+// setting, e.g. "15m" for a duration or "true" for a bool, and
+// publishes the change. The acting Identity of ctx is recorded.
+func (s *Settings) Set(ctx context.Context, key string, value interface{}) error {
+	s.mu.Lock()
+	def, ok := s.defs[key]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("undefined setting %q", key)
+	}
+	converted, err := convertSetting(def.Type, value)
+	if err != nil {
+		return fmt.Errorf("setting %s: %w", key, err)
+	}
+	if def.Validate != nil {
+		if err := def.Validate(converted); err != nil {
+			return fmt.Errorf("setting %s: %w", key, err)
+		}
+	}
+	old, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	by := ""
+	if identity, ok := IdentityFrom(ctx); ok {
+		by = identity.ID
+	}
+	stored := converted
+	if duration, ok := converted.(time.Duration); ok {
+		stored = duration.String()
+	}
+	_, err = surrealQuery[map[string]interface{}](s.DB, "UPDATE type::thing($tb, $key) CONTENT { value: $value, updated_at: time::now(), updated_by: $by }", map[string]interface{}{
+		"tb":    s.table(),
+		"key":   key,
+		"value": stored,
+		"by":    by,
+	})
+	if err != nil {
+		return err
+	}
+	return s.changed(SettingChange{Key: key, Old: old, New: converted, By: by, At: time.Now()})
+}
+
+// Reset removes the stored value of key, restoring its default.
+func (s *Settings) Reset(ctx context.Context, key string) error {
+	old, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, err = surrealQuery[map[string]interface{}](s.DB, "DELETE type::thing($tb, $key)", map[string]interface{}{
+		"tb":  s.table(),
+		"key": key,
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	def := s.defs[key]
+	s.mu.Unlock()
+	by := ""
+	if identity, ok := IdentityFrom(ctx); ok {
+		by = identity.ID
+	}
+	return s.changed(SettingChange{Key: key, Old: old, New: def.Default, By: by, At: time.Now()})
+}
+
+// changed reloads the cache without publishing, then publishes change
+// once.
+func (s *Settings) changed(change SettingChange) error {
+	s.mu.Lock()
+	// drop the cache so refresh does not publish the change again
+	s.records = nil
+	s.mu.Unlock()
+	if err := s.refresh(true); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	if !reflect.DeepEqual(change.Old, change.New) {
+		for _, listener := range listeners {
+			listener(change)
+		}
+	}
+	return nil
+}
+
+// List returns every defined setting with its value, sorted by key.
+func (s *Settings) List(ctx context.Context) ([]SettingValue, error) {
+	if err := s.refresh(false); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]SettingValue, 0, len(s.defs))
+	for key, def := range s.defs {
+		value, _ := s.value(def, s.records)
+		entry := SettingValue{Key: key, Type: def.Type, Value: value, Default: def.Default, Description: def.Description}
+		if record, ok := s.records[key]; ok {
+			at := record.UpdatedAt
+			entry.Overridden, entry.UpdatedAt, entry.UpdatedBy = true, &at, record.UpdatedBy
+		}
+		values = append(values, entry)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Key < values[j].Key })
+	for i := range values {
+		// durations are listed the way they are set
+		if duration, ok := values[i].Value.(time.Duration); ok {
+			values[i].Value = duration.String()
+		}
+		if duration, ok := values[i].Default.(time.Duration); ok {
+			values[i].Default = duration.String()
+		}
+	}
+	return values, nil
+}
+
+// Mount registers the admin endpoints on g, next to the dashboard's:
+//  GET    /ghost/settings       every setting with its value
+//  PUT    /ghost/settings/:key  set {"value": ...}
+//  DELETE /ghost/settings/:key  restore the default
+// Mount them on a group requiring AdminRole.
+func (s *Settings) Mount(g *gin.RouterGroup) {
+	g.GET("/ghost/settings", func(c *gin.Context) {
+		values, err := s.List(c.Request.Context())
+		if err != nil {
+			Fail(c, err)
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, values)
+	})
+	g.PUT("/ghost/settings/:key", func(c *gin.Context) {
+		var body struct {
+			Value interface{} `json:"value"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			FailStatus(c, http.StatusBadRequest, err)
+			return
+		}
+		s.adminChange(c, "setting.update", func(ctx context.Context, key string) error {
+			return s.Set(ctx, key, body.Value)
+		})
+	})
+	g.DELETE("/ghost/settings/:key", func(c *gin.Context) {
+		s.adminChange(c, "setting.reset", s.Reset)
+	})
+}
+
+func (s *Settings) adminChange(c *gin.Context, action string, change func(ctx context.Context, key string) error) {
+	key := c.Param("key")
+	s.mu.Lock()
+	_, defined := s.defs[key]
+	s.mu.Unlock()
+	if !defined {
+		Fail(c, NewGhostError(http.StatusNotFound, "not_found", fmt.Sprintf("undefined setting %q", key)))
+		return
+	}
+	ctx := c.Request.Context()
+	identity, _ := CurrentIdentity(c)
+	if identity.ID != "" {
+		ctx = WithIdentity(ctx, identity)
+	}
+	old, _ := s.Get(ctx, key)
+	if err := change(ctx, key); err != nil {
+		FailStatus(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+	updated, err := s.Get(ctx, key)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	audit := s.Audit
+	if audit == nil {
+		audit = LogAuditLog{}
+	}
+	err = audit.Record(ctx, AuditEntry{
+		Action:  action,
+		Actor:   identity.ID,
+		Subject: key,
+		IP:      c.ClientIP(),
+		Details: map[string]interface{}{"old": fmt.Sprint(old), "new": fmt.Sprint(updated)},
+		At:      time.Now().UTC(),
+	})
+	if err != nil {
+		c.Error(err)
+	}
+	if duration, ok := updated.(time.Duration); ok {
+		updated = duration.String()
+	}
+	c.JSON(http.StatusOK, gin.H{"key": key, "value": updated})
+}
+
+// FuncMap returns the template helper reading a setting:
+//  setting "signups.open"
+func (s *Settings) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"setting": func(key string) (interface{}, error) {
+			return s.Get(context.Background(), key)
+		},
+	}
+}
+
+// convertSetting converts value, as set by code, sent as JSON or read
+// back from the store, to the Go type of typ.
+func convertSetting(typ string, value interface{}) (interface{}, error) {
+	if number, ok := value.(json.Number); ok {
+		value = number.String()
+	}
+	switch typ {
+	case SettingString:
+		switch value := value.(type) {
+		case nil:
+			return "", nil
+		case string:
+			return value, nil
+		}
+	case SettingBool:
+		switch value := value.(type) {
+		case nil:
+			return false, nil
+		case bool:
+			return value, nil
+		case string:
+			if b, err := strconv.ParseBool(value); err == nil {
+				return b, nil
+			}
+		}
+	case SettingInt:
+		switch value := value.(type) {
+		case nil:
+			return int64(0), nil
+		case string:
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return n, nil
+			}
+		case float64:
+			if value == math.Trunc(value) {
+				return int64(value), nil
+			}
+		default:
+			if v := reflect.ValueOf(value); v.CanInt() {
+				return v.Int(), nil
+			}
+		}
+	case SettingFloat:
+		switch value := value.(type) {
+		case nil:
+			return float64(0), nil
+		case string:
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				return f, nil
+			}
+		default:
+			if v := reflect.ValueOf(value); v.CanFloat() {
+				return v.Float(), nil
+			} else if v.CanInt() {
+				return float64(v.Int()), nil
+			}
+		}
+	case SettingDuration:
+		switch value := value.(type) {
+		case nil:
+			return time.Duration(0), nil
+		case time.Duration:
+			return value, nil
+		case string:
+			if d, err := time.ParseDuration(value); err == nil {
+				return d, nil
+			}
+		}
+	case SettingJSON:
+		return value, nil
+	default:
+		return nil, fmt.Errorf("unknown setting type %q", typ)
+	}
+	return nil, fmt.Errorf("%v is not a valid %s", value, typ)
+}
@@ -0,0 +1,497 @@
+package ghostutils
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Defaults of ShortLinks.
+const (
+	DefaultShortLinkTable  = "shortlink"
+	DefaultShortLinkLength = 7
+)
+
+// Short link errors, answered 404, 410, 409 and 422 by Fail.
+var (
+	ErrShortLinkNotFound = errors.New("short link not found")
+	ErrShortLinkExpired  = errors.New("short link expired")
+	ErrShortLinkTaken    = errors.New("short link code is taken")
+	ErrShortLinkInvalid  = errors.New("invalid short link")
+)
+
+// shortLinkAlphabet leaves out the characters read alike, 0/O and
+// 1/l/I, for codes typed from print.
+const shortLinkAlphabet = "23456789abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// shortLinkCodePattern matches vanity codes.
+var shortLinkCodePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// ShortLinkSchema defines the tables used by ShortLinks with the
+// default table. Run it once, or ship it as a migration.
+const ShortLinkSchema = `
+DEFINE TABLE shortlink SCHEMALESS;
+DEFINE FIELD target ON shortlink TYPE string;
+DEFINE FIELD clicks ON shortlink TYPE int DEFAULT 0;
+DEFINE FIELD created_at ON shortlink TYPE datetime;
+DEFINE FIELD expires_at ON shortlink TYPE option<datetime>;
+DEFINE INDEX shortlink_created_by ON shortlink FIELDS created_by;
+DEFINE TABLE shortlink_click SCHEMALESS;
+DEFINE INDEX shortlink_click_link ON shortlink_click FIELDS link, at;
+`
+
+// ShortLink redirects its code to Target. The code is the id of its
+// record, so codes are unique by construction.
+type ShortLink struct {
+	ID        string     `json:"id,omitempty"`
+	Code      string     `json:"code"`
+	Target    string     `json:"target"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Clicks    int        `json:"clicks"`
+	LastClick *time.Time `json:"last_click,omitempty"`
+}
+
+// Expired tells whether the link expired at now.
+func (l ShortLink) Expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
+}
+
+// ShortLinkClick is a click recorded with LogClicks.
+type ShortLinkClick struct {
+	ID        string    `json:"id,omitempty"`
+	Link      string    `json:"link"`
+	At        time.Time `json:"at"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// ShortLinks creates short links and serves their redirects.
+//
+// Example:
+//  links := &ghostutils.ShortLinks{DB: db, BaseURL: "https://ghost.to"}
+//  links.Mount(r)
+//  links.MountAPI(r.Group("/api/shortlinks", ghostutils.RequireIdentity()), nil)
+//
+//  link, err := links.Create(c, "https://example.com/spring-sale?utm_source=print", "spring", 30*24*time.Hour, "")
+//  // links.URL(link) == "https://ghost.to/spring"
+type ShortLinks struct {
+	DB *surrealdb.DB
+	// Table is DefaultShortLinkTable by default; clicks go to the
+	// table with the _click suffix.
+	Table string
+	// BaseURL prefixes the codes in URL, e.g. https://ghost.to.
+	BaseURL string
+	// Length is the length of generated codes, DefaultShortLinkLength
+	// by default.
+	Length int
+	// LogClicks records every click with its referrer and user agent,
+	// besides counting it.
+	LogClicks bool
+	// Reserved are codes that may not be taken, such as the paths of
+	// other routes next to the redirects.
+	Reserved []string
+}
+
+// EnsureSchema runs ShortLinkSchema against the database.
+func (s *ShortLinks) EnsureSchema() error {
+	schema := ShortLinkSchema
+	if table := s.table(); table != DefaultShortLinkTable {
+		schema = strings.ReplaceAll(schema, DefaultShortLinkTable, table)
+	}
+	_, err := s.DB.Query(schema, map[string]interface{}{})
+	return err
+}
+
+func (s *ShortLinks) table() string {
+	if s.Table == "" {
+		return DefaultShortLinkTable
+	}
+	return s.Table
+}
+
+// URL returns the short URL of link.
+func (s *ShortLinks) URL(link ShortLink) string {
+	return strings.TrimRight(s.BaseURL, "/") + "/" + link.Code
+}
+
+// checkTarget accepts absolute http(s) URLs and paths of this site.
+func checkTarget(target string) error {
+	if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrShortLinkInvalid
+	}
+	return nil
+}
+
+func (s *ShortLinks) checkCode(code string) error {
+	if !shortLinkCodePattern.MatchString(code) {
+		return ErrShortLinkInvalid
+	}
+	for _, reserved := range s.Reserved {
+		if strings.EqualFold(strings.Trim(reserved, "/"), code) {
+			return ErrShortLinkTaken
+		}
+	}
+	return nil
+}
+
+// generateCode returns a random code of n characters.
+func generateCode(n int) string {
+	code := make([]byte, n)
+	limit := big.NewInt(int64(len(shortLinkAlphabet)))
+	for i := range code {
+		index, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			panic(err)
+		}
+		code[i] = shortLinkAlphabet[index.Int64()]
+	}
+	return string(code)
+}
+
+// Create stores a link to target under code, or under a generated
+// code when code is empty, expiring after ttl unless ttl is zero.
+//
+// Returns:
+//  ShortLink as stored
+//  error, ErrShortLinkTaken for a code in use, ErrShortLinkInvalid
+//  for a malformed code or target
+func (s *ShortLinks) Create(ctx context.Context, target, code string, ttl time.Duration, createdBy string) (ShortLink, error) {
+	if err := checkTarget(target); err != nil {
+		return ShortLink{}, err
+	}
+	link := ShortLink{Target: target, CreatedBy: createdBy, CreatedAt: time.Now().UTC()}
+	if ttl > 0 {
+		expires := link.CreatedAt.Add(ttl)
+		link.ExpiresAt = &expires
+	}
+	if code != "" {
+		if err := s.checkCode(code); err != nil {
+			return ShortLink{}, err
+		}
+		link.Code = code
+		return s.insert(link)
+	}
+	length := s.Length
+	if length <= 0 {
+		length = DefaultShortLinkLength
+	}
+	// a collision retries, one character longer after a few
+	for attempt := 0; attempt < 8; attempt++ {
+		link.Code = generateCode(length + attempt/4)
+		if s.checkCode(link.Code) != nil {
+			continue
+		}
+		stored, err := s.insert(link)
+		if !errors.Is(err, ErrShortLinkTaken) {
+			return stored, err
+		}
+	}
+	return ShortLink{}, ErrShortLinkTaken
+}
+
+// insert creates the record of link, failing on an existing code.
+// The creation time is the one of the database.
+func (s *ShortLinks) insert(link ShortLink) (ShortLink, error) {
+	sets := []string{"code = $code", "target = $target", "clicks = 0", "created_at = time::now()"}
+	vars := map[string]interface{}{
+		"tb":     s.table(),
+		"code":   link.Code,
+		"target": link.Target,
+	}
+	if link.CreatedBy != "" {
+		sets = append(sets, "created_by = $created_by")
+		vars["created_by"] = link.CreatedBy
+	}
+	if link.ExpiresAt != nil {
+		sets = append(sets, "expires_at = <datetime>$expires")
+		vars["expires"] = link.ExpiresAt.UTC()
+	}
+	stored, _, err := surrealFirst[ShortLink](s.DB, "CREATE type::thing($tb, $code) SET "+strings.Join(sets, ", "), vars)
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		return ShortLink{}, ErrShortLinkTaken
+	}
+	return stored, err
+}
+
+// Get returns the link of code, or ErrShortLinkNotFound.
+func (s *ShortLinks) Get(ctx context.Context, code string) (ShortLink, error) {
+	link, ok, err := surrealFirst[ShortLink](s.DB, "SELECT * FROM type::thing($tb, $code)", map[string]interface{}{
+		"tb":   s.table(),
+		"code": code,
+	})
+	if err == nil && !ok {
+		err = ErrShortLinkNotFound
+	}
+	return link, err
+}
+
+// List returns a page of the links, the newest first, of createdBy
+// only unless it is empty.
+func (s *ShortLinks) List(ctx context.Context, createdBy string, page, perPage int) (Page[ShortLink], error) {
+	q := Select().From(s.table()).OrderByDesc("created_at")
+	if createdBy != "" {
+		q.WhereField("created_by", "=", createdBy)
+	}
+	return Paginate[ShortLink](s.DB, q, page, perPage)
+}
+
+// Update changes the target of the link of code, and its expiry when
+// expiresAt is not nil; a zero expiresAt removes it.
+func (s *ShortLinks) Update(ctx context.Context, code, target string, expiresAt *time.Time) (ShortLink, error) {
+	sets := []string{}
+	vars := map[string]interface{}{"tb": s.table(), "code": code}
+	if target != "" {
+		if err := checkTarget(target); err != nil {
+			return ShortLink{}, err
+		}
+		sets = append(sets, "target = $target")
+		vars["target"] = target
+	}
+	if expiresAt != nil {
+		if expiresAt.IsZero() {
+			sets = append(sets, "expires_at = NONE")
+		} else {
+			sets = append(sets, "expires_at = <datetime>$expires")
+			vars["expires"] = expiresAt.UTC()
+		}
+	}
+	// UPDATE would create a missing record
+	link, err := s.Get(ctx, code)
+	if err != nil || len(sets) == 0 {
+		return link, err
+	}
+	link, _, err = surrealFirst[ShortLink](s.DB, "UPDATE type::thing($tb, $code) SET "+strings.Join(sets, ", ")+" RETURN AFTER", vars)
+	return link, err
+}
+
+// Delete removes the link of code and its clicks.
+func (s *ShortLinks) Delete(ctx context.Context, code string) error {
+	_, err := s.DB.Query(`DELETE type::thing($tb, $code);
+		DELETE type::table($clicks) WHERE link = type::thing($tb, $code)`, map[string]interface{}{
+		"tb":     s.table(),
+		"clicks": s.table() + "_click",
+		"code":   code,
+	})
+	return err
+}
+
+// Resolve returns the link of code and counts a click on it.
+//
+// Returns:
+//  ShortLink before the click
+//  error, ErrShortLinkNotFound or ErrShortLinkExpired
+func (s *ShortLinks) Resolve(ctx context.Context, code string, click ShortLinkClick) (ShortLink, error) {
+	link, err := s.Get(ctx, code)
+	if err != nil {
+		return ShortLink{}, err
+	}
+	if link.Expired(time.Now()) {
+		return link, ErrShortLinkExpired
+	}
+	statements := "UPDATE type::thing($tb, $code) SET clicks += 1, last_click = time::now()"
+	vars := map[string]interface{}{"tb": s.table(), "code": code}
+	if s.LogClicks {
+		statements += ";\nCREATE type::table($clicks) CONTENT { link: type::thing($tb, $code), at: time::now(), referrer: $referrer, user_agent: $agent }"
+		vars["clicks"] = s.table() + "_click"
+		vars["referrer"] = click.Referrer
+		vars["agent"] = click.UserAgent
+	}
+	_, err = s.DB.Query(statements, vars)
+	return link, err
+}
+
+// Clicks returns the clicks recorded with LogClicks on the link of
+// code since since, the newest first.
+func (s *ShortLinks) Clicks(ctx context.Context, code string, since time.Time, limit int) ([]ShortLinkClick, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	return surrealQuery[ShortLinkClick](s.DB, "SELECT * FROM type::table($clicks) WHERE link = type::thing($tb, $code) AND at >= <datetime>$since ORDER BY at DESC LIMIT $limit", map[string]interface{}{
+		"tb":     s.table(),
+		"clicks": s.table() + "_click",
+		"code":   code,
+		"since":  since.UTC(),
+		"limit":  limit,
+	})
+}
+
+// Mount registers GET /:code, redirecting with 302 so every visit is
+// counted. Unknown codes answer 404 and expired ones 410.
+func (s *ShortLinks) Mount(r gin.IRoutes) {
+	r.GET("/:code", s.redirect)
+}
+
+func (s *ShortLinks) redirect(c *gin.Context) {
+	link, err := s.Resolve(c.Request.Context(), c.Param("code"), ShortLinkClick{
+		Referrer:  c.Request.Referer(),
+		UserAgent: c.Request.UserAgent(),
+	})
+	if (err != nil && link.Target == "") || errors.Is(err, ErrShortLinkExpired) {
+		Fail(c, err)
+		return
+	}
+	if err != nil {
+		// the click was not counted, the visitor still gets through
+		c.Error(err)
+	}
+	c.Header("Cache-Control", "private, max-age=0")
+	c.Redirect(http.StatusFound, link.Target)
+}
+
+// MountAPI registers the management endpoints on g, guarded by the
+// middleware of g. Callers list and change their own links only,
+// unless admin says they may manage every link:
+//  GET    ""               list links, paginated
+//  POST   ""               create a link from target, code and ttl
+//  GET    "/:code"         get a link
+//  GET    "/:code/clicks"  list the recorded clicks
+//  PATCH  "/:code"         change target or expires_at
+//  DELETE "/:code"         delete a link
+func (s *ShortLinks) MountAPI(g *gin.RouterGroup, admin func(c *gin.Context) bool) {
+	api := &shortLinksAPI{links: s, admin: admin}
+	g.GET("", api.list)
+	g.POST("", api.create)
+	g.GET("/:code", api.get)
+	g.GET("/:code/clicks", api.clicks)
+	g.PATCH("/:code", api.update)
+	g.DELETE("/:code", api.delete)
+}
+
+type shortLinksAPI struct {
+	links *ShortLinks
+	admin func(c *gin.Context) bool
+}
+
+// owner returns the identity links are scoped to, empty for admins.
+func (api *shortLinksAPI) owner(c *gin.Context) string {
+	if api.admin != nil && api.admin(c) {
+		return ""
+	}
+	identity, _ := CurrentIdentity(c)
+	return identity.ID
+}
+
+// find returns the link of the code parameter the caller may manage.
+func (api *shortLinksAPI) find(c *gin.Context) (ShortLink, bool) {
+	link, err := api.links.Get(c.Request.Context(), c.Param("code"))
+	if err == nil {
+		if owner := api.owner(c); owner != "" && link.CreatedBy != owner {
+			err = ErrShortLinkNotFound
+		}
+	}
+	if err != nil {
+		Fail(c, err)
+		return link, false
+	}
+	return link, true
+}
+
+func (api *shortLinksAPI) list(c *gin.Context) {
+	page, perPage := PageParams(c, 20, 100)
+	links, err := api.links.List(c.Request.Context(), api.owner(c), page, perPage)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	RespondPage(c, links.Envelope(c.Request.URL))
+}
+
+func (api *shortLinksAPI) create(c *gin.Context) {
+	body, ok := BindOrAbort[struct {
+		Target string `json:"target" form:"target" binding:"required"`
+		Code   string `json:"code" form:"code"`
+		TTL    string `json:"ttl" form:"ttl"`
+	}](c)
+	if !ok {
+		return
+	}
+	var ttl time.Duration
+	if body.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(body.TTL); err != nil || ttl < 0 {
+			Fail(c, ErrShortLinkInvalid)
+			return
+		}
+	}
+	identity, _ := CurrentIdentity(c)
+	link, err := api.links.Create(c.Request.Context(), body.Target, body.Code, ttl, identity.ID)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	Created(c, gin.H{"link": link, "url": api.links.URL(link)})
+}
+
+func (api *shortLinksAPI) get(c *gin.Context) {
+	if link, ok := api.find(c); ok {
+		OK(c, gin.H{"link": link, "url": api.links.URL(link)})
+	}
+}
+
+func (api *shortLinksAPI) clicks(c *gin.Context) {
+	link, ok := api.find(c)
+	if !ok {
+		return
+	}
+	since := time.Now().AddDate(0, 0, -30)
+	if value := c.Query("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			Fail(c, NewGhostError(http.StatusBadRequest, "invalid_request", "since must be an RFC 3339 time"))
+			return
+		}
+	}
+	clicks, err := api.links.Clicks(c.Request.Context(), link.Code, since, 500)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OKWithMeta(c, clicks, gin.H{"clicks": link.Clicks, "last_click": link.LastClick})
+}
+
+func (api *shortLinksAPI) update(c *gin.Context) {
+	link, ok := api.find(c)
+	if !ok {
+		return
+	}
+	body, ok := BindOrAbort[struct {
+		Target    string     `json:"target"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}](c)
+	if !ok {
+		return
+	}
+	updated, err := api.links.Update(c.Request.Context(), link.Code, body.Target, body.ExpiresAt)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, gin.H{"link": updated, "url": api.links.URL(updated)})
+}
+
+func (api *shortLinksAPI) delete(c *gin.Context) {
+	link, ok := api.find(c)
+	if !ok {
+		return
+	}
+	if err := api.links.Delete(c.Request.Context(), link.Code); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
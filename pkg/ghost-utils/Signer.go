@@ -0,0 +1,268 @@
+package ghostutils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Errors returned when verifying signed URLs and tokens.
+var (
+	ErrSignatureInvalid = errors.New("signature invalid")
+	ErrSignatureExpired = errors.New("signature expired")
+	ErrNoSigningKey     = errors.New("no signing key configured")
+	ErrNoTokenPurpose   = errors.New("token purpose is required")
+)
+
+// SignedClaimsKey is the gin context key holding the claims of a
+// verified signed URL.
+const SignedClaimsKey = "ghost-signed-claims"
+
+// Reserved query parameters added by SignURL.
+const (
+	signedExpiresParam = "exp"
+	signedKeyParam     = "kid"
+	signedSigParam     = "sig"
+)
+
+// SigningKey is a named HMAC secret. The id is embedded in every
+// signature so old keys keep verifying after rotation.
+type SigningKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+// SigningConfig is the `signing:` block of ghost.yaml. The first key
+// signs new URLs and tokens, all keys are accepted on verification.
+//
+// Example:
+//  signing:
+//    keys:
+//      - id: "2024-06"
+//        secret: new-secret
+//      - id: "2024-01"
+//        secret: old-secret
+type SigningConfig struct {
+	Keys []SigningKey `yaml:"keys"`
+}
+
+// Signer signs and verifies URLs and compact tokens.
+type Signer struct {
+	Keys []SigningKey
+}
+
+// Signer returns a Signer using the keys of the signing block.
+//
+// Example:
+//  signer := ghostConfig.Signer()
+//  link, err := signer.SignURL("/unsubscribe", map[string]string{"user": id}, 7*24*time.Hour)
+//  r.GET("/unsubscribe", signer.Verify(), unsubscribeHandler)
+func (ghostConfig GhostConfig) Signer() *Signer {
+	return &Signer{Keys: ghostConfig.Signing.Keys}
+}
+
+func (s *Signer) key(id string) (SigningKey, bool) {
+	for _, key := range s.Keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func (s *Signer) mac(key SigningKey, data string) []byte {
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// SignURL returns path with claims, an expiry and a signature in the
+// query string. A ttl of zero produces a URL that never expires.
+//
+// Returns:
+//  the signed path and query, e.g. /download?file=a.pdf&exp=..&kid=..&sig=..
+//  error if no signing key is configured
+func (s *Signer) SignURL(path string, claims map[string]string, ttl time.Duration) (string, error) {
+	if len(s.Keys) == 0 {
+		return "", ErrNoSigningKey
+	}
+	key := s.Keys[0]
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for name, value := range claims {
+		query.Set(name, value)
+	}
+	if ttl > 0 {
+		query.Set(signedExpiresParam, strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	}
+	query.Set(signedKeyParam, key.ID)
+	query.Del(signedSigParam)
+	sig := s.mac(key, canonicalSigned(u.Path, query))
+	query.Set(signedSigParam, base64.RawURLEncoding.EncodeToString(sig))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// VerifyURL checks the signature and expiry of u and returns its
+// claims without the reserved parameters.
+func (s *Signer) VerifyURL(u *url.URL) (map[string]string, error) {
+	query := u.Query()
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get(signedSigParam))
+	if err != nil {
+		return nil, ErrSignatureInvalid
+	}
+	key, ok := s.key(query.Get(signedKeyParam))
+	if !ok {
+		return nil, ErrSignatureInvalid
+	}
+	query.Del(signedSigParam)
+	if !hmac.Equal(sig, s.mac(key, canonicalSigned(u.Path, query))) {
+		return nil, ErrSignatureInvalid
+	}
+	if exp := query.Get(signedExpiresParam); exp != "" {
+		unix, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			return nil, ErrSignatureInvalid
+		}
+		if time.Now().Unix() > unix {
+			return nil, ErrSignatureExpired
+		}
+	}
+	claims := map[string]string{}
+	for name := range query {
+		if name != signedExpiresParam && name != signedKeyParam {
+			claims[name] = query.Get(name)
+		}
+	}
+	return claims, nil
+}
+
+// Verify returns middleware that rejects requests whose URL is not
+// validly signed. The claims are stored under SignedClaimsKey.
+func (s *Signer) Verify() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := s.VerifyURL(c.Request.URL)
+		if errors.Is(err, ErrSignatureExpired) {
+			FailStatus(c, http.StatusGone, err)
+			return
+		}
+		if err != nil {
+			FailStatus(c, http.StatusForbidden, err)
+			return
+		}
+		c.Set(SignedClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// SignedClaims returns the claims set by Signer.Verify.
+func SignedClaims(c *gin.Context) map[string]string {
+	claims, _ := c.Get(SignedClaimsKey)
+	m, _ := claims.(map[string]string)
+	return m
+}
+
+// SignToken encodes v as a compact "kid.payload.signature" token,
+// used where a value rather than a URL has to be signed, such as
+// cookies and invitation codes. The purpose, e.g. "invitation", is
+// signed along and must be given again to VerifyToken, so a token of
+// one feature never verifies in another sharing the keys.
+//
+// Example:
+//  token, err := signer.SignToken("calendar-feed", user.ID, 0)
+func (s *Signer) SignToken(purpose string, v interface{}, ttl time.Duration) (string, error) {
+	if len(s.Keys) == 0 {
+		return "", ErrNoSigningKey
+	}
+	if purpose == "" {
+		return "", ErrNoTokenPurpose
+	}
+	envelope := struct {
+		Purpose string      `json:"p"`
+		Data    interface{} `json:"d"`
+		Expires int64       `json:"e,omitempty"`
+	}{Purpose: purpose, Data: v}
+	if ttl > 0 {
+		envelope.Expires = time.Now().Add(ttl).Unix()
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	key := s.Keys[0]
+	body := key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + base64.RawURLEncoding.EncodeToString(s.mac(key, body)), nil
+}
+
+// VerifyToken checks a token produced by SignToken for purpose and
+// decodes its value into v. Tokens signed for another purpose are
+// ErrSignatureInvalid.
+func (s *Signer) VerifyToken(purpose, token string, v interface{}) error {
+	if purpose == "" {
+		return ErrNoTokenPurpose
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrSignatureInvalid
+	}
+	key, ok := s.key(parts[0])
+	if !ok {
+		return ErrSignatureInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, s.mac(key, parts[0]+"."+parts[1])) {
+		return ErrSignatureInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	var envelope struct {
+		Purpose string          `json:"p"`
+		Data    json.RawMessage `json:"d"`
+		Expires int64           `json:"e"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil || envelope.Purpose != purpose {
+		return ErrSignatureInvalid
+	}
+	if envelope.Expires != 0 && time.Now().Unix() > envelope.Expires {
+		return ErrSignatureExpired
+	}
+	return json.Unmarshal(envelope.Data, v)
+}
+
+// canonicalSigned renders the path and query with sorted keys so the
+// signature does not depend on parameter order.
+func canonicalSigned(path string, query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(path)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		for _, value := range values {
+			b.WriteByte('\n')
+			b.WriteString(url.QueryEscape(name))
+			b.WriteByte('=')
+			b.WriteString(url.QueryEscape(value))
+		}
+	}
+	return b.String()
+}
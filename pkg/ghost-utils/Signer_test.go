@@ -0,0 +1,127 @@
+package ghostutils_test
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+)
+
+func testSigner() *ghostutils.Signer {
+	return &ghostutils.Signer{Keys: []ghostutils.SigningKey{
+		{ID: "new", Secret: "new-secret"},
+		{ID: "old", Secret: "old-secret"},
+	}}
+}
+
+func TestSignURL(t *testing.T) {
+	signer := testSigner()
+	link, err := signer.SignURL("/download", map[string]string{"file": "a.pdf"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := signer.VerifyURL(u)
+	if err != nil {
+		t.Fatalf("verifying %s: %v", link, err)
+	}
+	if claims["file"] != "a.pdf" || len(claims) != 1 {
+		t.Errorf("claims %v, want the file alone", claims)
+	}
+
+	tampered := *u
+	query := tampered.Query()
+	query.Set("file", "b.pdf")
+	tampered.RawQuery = query.Encode()
+	if _, err := signer.VerifyURL(&tampered); !errors.Is(err, ghostutils.ErrSignatureInvalid) {
+		t.Errorf("tampered claim: %v, want ErrSignatureInvalid", err)
+	}
+	moved := *u
+	moved.Path = "/admin"
+	if _, err := signer.VerifyURL(&moved); !errors.Is(err, ghostutils.ErrSignatureInvalid) {
+		t.Errorf("other path: %v, want ErrSignatureInvalid", err)
+	}
+}
+
+func TestSignURLExpires(t *testing.T) {
+	signer := testSigner()
+	link, err := signer.SignURL("/download", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(link)
+	query := u.Query()
+	query.Set("exp", "1")
+	u.RawQuery = query.Encode()
+	if _, err := signer.VerifyURL(u); !errors.Is(err, ghostutils.ErrSignatureInvalid) {
+		t.Errorf("changed expiry: %v, want ErrSignatureInvalid", err)
+	}
+}
+
+func TestSignTokenRotation(t *testing.T) {
+	old := &ghostutils.Signer{Keys: []ghostutils.SigningKey{{ID: "old", Secret: "old-secret"}}}
+	token, err := old.SignToken("invitation", "org:1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := testSigner().VerifyToken("invitation", token, &value); err != nil || value != "org:1" {
+		t.Errorf("token of the old key: %q, %v", value, err)
+	}
+	removed := &ghostutils.Signer{Keys: []ghostutils.SigningKey{{ID: "new", Secret: "new-secret"}}}
+	if err := removed.VerifyToken("invitation", token, &value); !errors.Is(err, ghostutils.ErrSignatureInvalid) {
+		t.Errorf("token of a removed key: %v, want ErrSignatureInvalid", err)
+	}
+}
+
+func TestSignTokenPurpose(t *testing.T) {
+	signer := testSigner()
+	type claims struct {
+		ID string `json:"i"`
+	}
+	token, err := signer.SignToken("invitation", claims{ID: "invitation:1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got claims
+	if err := signer.VerifyToken("invitation", token, &got); err != nil || got.ID != "invitation:1" {
+		t.Fatalf("verifying: %+v, %v", got, err)
+	}
+	if err := signer.VerifyToken("consent", token, &got); !errors.Is(err, ghostutils.ErrSignatureInvalid) {
+		t.Errorf("token of another purpose: %v, want ErrSignatureInvalid", err)
+	}
+	if _, err := signer.SignToken("", claims{}, 0); !errors.Is(err, ghostutils.ErrNoTokenPurpose) {
+		t.Errorf("empty purpose: %v, want ErrNoTokenPurpose", err)
+	}
+}
+
+func TestSignTokenTampered(t *testing.T) {
+	signer := testSigner()
+	token, err := signer.SignToken("barcode", "ticket-1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := signer.VerifyToken("barcode", token, &value); err != nil {
+		t.Fatalf("a token without ttl: %v", err)
+	}
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + parts[1] + "x." + parts[2]
+	if err := signer.VerifyToken("barcode", forged, &value); !errors.Is(err, ghostutils.ErrSignatureInvalid) {
+		t.Errorf("forged payload: %v, want ErrSignatureInvalid", err)
+	}
+	expired, err := signer.SignToken("barcode", "ticket-1", time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := signer.VerifyToken("barcode", expired, &value); !errors.Is(err, ghostutils.ErrSignatureExpired) {
+		t.Errorf("expired token: %v, want ErrSignatureExpired", err)
+	}
+}
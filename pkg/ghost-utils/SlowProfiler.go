@@ -0,0 +1,142 @@
+package ghostutils
+
+import (
+	"bytes"
+	"net/http"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SlowProfile is a CPU profile captured during a slow request.
+type SlowProfile struct {
+	ID         string    `json:"id"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Duration   string    `json:"duration"`
+	CapturedAt time.Time `json:"captured_at"`
+	Size       int       `json:"size"`
+	data       []byte
+}
+
+// SlowProfiler captures CPU profiles of slow requests. Once a request
+// has run for Threshold its CPU profile starts, and stops when the
+// request finishes or after MaxDuration. Go has one CPU profiler per
+// process, so a profile covers everything running at the time and
+// only one is captured at once; the rest of the slow requests are
+// skipped. The last MaxProfiles profiles are kept in memory.
+//
+// Example:
+//  profiler := &ghostutils.SlowProfiler{Threshold: 2 * time.Second}
+//  r.Use(profiler.Middleware())
+//  profiler.Mount(r.Group("/ghost", ghostutils.RequireRole(ghostutils.AdminRole)))
+//
+//  // go tool pprof -http=: slow-<id>.pprof
+type SlowProfiler struct {
+	Threshold time.Duration
+	// MaxDuration bounds a profile. Defaults to 30s.
+	MaxDuration time.Duration
+	// MaxProfiles is the number of profiles kept. Defaults to 10.
+	MaxProfiles int
+
+	active   int32
+	mu       sync.Mutex
+	profiles []*SlowProfile
+}
+
+// Middleware profiles the requests that pass Threshold.
+func (p *SlowProfiler) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if p.Threshold <= 0 {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		method, path := c.Request.Method, c.FullPath()
+		if path == "" {
+			path = c.Request.URL.Path
+		}
+		done := make(chan struct{})
+		timer := time.AfterFunc(p.Threshold, func() { p.capture(method, path, start, done) })
+		defer func() {
+			timer.Stop()
+			close(done)
+		}()
+		c.Next()
+	}
+}
+
+func (p *SlowProfiler) capture(method, path string, start time.Time, done <-chan struct{}) {
+	if !atomic.CompareAndSwapInt32(&p.active, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&p.active, 0)
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		// another profile, e.g. from net/http/pprof, is running
+		return
+	}
+	maxDuration := p.MaxDuration
+	if maxDuration <= 0 {
+		maxDuration = 30 * time.Second
+	}
+	select {
+	case <-done:
+	case <-time.After(maxDuration):
+	}
+	pprof.StopCPUProfile()
+	p.store(&SlowProfile{
+		ID:         randomID(8),
+		Method:     method,
+		Path:       path,
+		Duration:   time.Since(start).Round(time.Millisecond).String(),
+		CapturedAt: time.Now().UTC(),
+		Size:       buf.Len(),
+		data:       buf.Bytes(),
+	})
+}
+
+func (p *SlowProfiler) store(profile *SlowProfile) {
+	limit := p.MaxProfiles
+	if limit <= 0 {
+		limit = 10
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profiles = append(p.profiles, profile)
+	if len(p.profiles) > limit {
+		p.profiles = append([]*SlowProfile(nil), p.profiles[len(p.profiles)-limit:]...)
+	}
+}
+
+// Profiles returns the stored profiles, newest first.
+func (p *SlowProfiler) Profiles() []SlowProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	profiles := make([]SlowProfile, 0, len(p.profiles))
+	for i := len(p.profiles) - 1; i >= 0; i-- {
+		profiles = append(profiles, *p.profiles[i])
+	}
+	return profiles
+}
+
+// Mount registers GET /profiles, listing the profiles, and GET
+// /profiles/:id, downloading one in pprof format.
+func (p *SlowProfiler) Mount(r gin.IRoutes) {
+	r.GET("/profiles", func(c *gin.Context) {
+		c.JSON(http.StatusOK, p.Profiles())
+	})
+	r.GET("/profiles/:id", func(c *gin.Context) {
+		for _, profile := range p.Profiles() {
+			if profile.ID == c.Param("id") {
+				c.Header("Content-Disposition", `attachment; filename="slow-`+profile.ID+`.pprof"`)
+				c.Data(http.StatusOK, "application/octet-stream", profile.data)
+				return
+			}
+		}
+		Fail(c, NewGhostError(http.StatusNotFound, "not_found", "profile not found"))
+	})
+}
@@ -0,0 +1,156 @@
+package ghostutils
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// SlugField is the field a Repository keeps the slug of Sluggable
+// records in.
+const SlugField = "slug"
+
+// maxSlugLen bounds the length of generated slugs, before a suffix.
+const maxSlugLen = 80
+
+// slugLetters transliterates the letters that do not decompose into a
+// base letter and marks.
+var slugLetters = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "ae", 'ø': "o", 'Ø': "o", 'œ': "oe", 'Œ': "oe",
+	'đ': "d", 'Đ': "d", 'ð': "d", 'Ð': "d", 'ł': "l", 'Ł': "l", 'þ': "th", 'Þ': "th",
+	'ı': "i", '&': "and",
+}
+
+// Sluggify returns s as a URL slug: lowercase ASCII letters and digits
+// separated by single dashes. Accented letters lose their accents and
+// letters like ß and ø are transliterated; other characters separate
+// words.
+//
+// Example:
+//  ghostutils.Sluggify("Crème Brûlée & Straße!")  // creme-brulee-and-strasse
+func Sluggify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		word := ""
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			word = string(unicode.ToLower(r))
+		case slugLetters[r] != "":
+			word = slugLetters[r]
+		}
+		if word == "" {
+			dash = b.Len() > 0
+			continue
+		}
+		if dash {
+			b.WriteByte('-')
+			dash = false
+		}
+		b.WriteString(word)
+	}
+	slug := b.String()
+	if len(slug) > maxSlugLen {
+		slug = strings.TrimRight(slug[:maxSlugLen], "-")
+		if i := strings.LastIndex(slug, "-"); i > maxSlugLen/2 {
+			// cut at a word
+			slug = slug[:i]
+		}
+	}
+	return slug
+}
+
+// Sluggable is implemented by records whose slug a Repository
+// maintains: Create fills the slug field from SlugSource when it is
+// empty, Update keeps the stored slug, and slugs set by hand are
+// sluggified. Slugs are made unique within the table with a -2, -3,
+// ... suffix.
+//
+// Example:
+//  type Post struct {
+//      ID    string `json:"id,omitempty"`
+//      Title string `json:"title"`
+//      Slug  string `json:"slug"`
+//  }
+//
+//  func (p Post) SlugSource() string { return p.Title }
+type Sluggable interface {
+	SlugSource() string
+}
+
+// UniqueSlug returns the slug of base that no record of repo's table
+// has yet, base itself or base with the first free suffix.
+//
+// Example:
+//  slug, err := ghostutils.UniqueSlug(ctx, posts, post.Title)  // hello-world-2
+func UniqueSlug[T any](ctx context.Context, repo *Repository[T], base string) (string, error) {
+	return uniqueSlug(repo.db(ctx), repo.Table, Sluggify(base), "")
+}
+
+// uniqueSlug returns slug or slug with a suffix, not used by a record
+// of table other than except.
+func uniqueSlug(db GhostDB, table, slug, except string) (string, error) {
+	if slug == "" {
+		slug = "item"
+	}
+	taken, err := surrealQuery[string](db, "SELECT VALUE slug FROM type::table($tb) WHERE (slug = $slug OR string::starts_with(slug, $prefix)) AND id != $except", map[string]interface{}{
+		"tb":     table,
+		"slug":   slug,
+		"prefix": slug + "-",
+		"except": recordID(table, strings.TrimPrefix(except, table+":")),
+	})
+	if err != nil {
+		return "", err
+	}
+	used := make(map[string]bool, len(taken))
+	for _, s := range taken {
+		used[s] = true
+	}
+	if !used[slug] {
+		return slug, nil
+	}
+	for n := 2; ; n++ {
+		candidate := slug + "-" + strconv.Itoa(n)
+		if !used[candidate] {
+			return candidate, nil
+		}
+	}
+}
+
+// maintainSlug sets the slug field of fields, the content of record,
+// for Sluggable records. id is the record being replaced, empty on
+// create.
+func (r *Repository[T]) maintainSlug(ctx context.Context, record T, fields map[string]interface{}, id string) error {
+	sluggable, ok := interface{}(record).(Sluggable)
+	if !ok {
+		if sluggable, ok = interface{}(&record).(Sluggable); !ok {
+			return nil
+		}
+	}
+	slug, _ := fields[SlugField].(string)
+	if slug == "" && id != "" {
+		_, stored, err := r.get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if storedSlug, _ := stored[SlugField].(string); storedSlug != "" {
+			fields[SlugField] = storedSlug
+			return nil
+		}
+	}
+	if slug == "" {
+		slug = sluggable.SlugSource()
+	}
+	unique, err := uniqueSlug(r.db(ctx), r.Table, Sluggify(slug), id)
+	if err != nil {
+		return err
+	}
+	fields[SlugField] = unique
+	return nil
+}
@@ -0,0 +1,468 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrSocketClientTooSlow closes a socket client that stopped
+	// reading its messages.
+	ErrSocketClientTooSlow = errors.New("socket client is not reading its messages")
+	// ErrSocketClosed is returned when sending to a client that left.
+	ErrSocketClosed = errors.New("socket client is closed")
+)
+
+// SocketRoute is the GhostRoute for WebSocket endpoints. GET on its
+// path upgrades the connection and adds the client to Hub; messages
+// from the client go to OnMessage, and messages are sent with
+// SocketClient.Send or broadcast through the hub, to all its clients
+// or to a room.
+//
+// Example:
+//  chat := ghostutils.NewSocketRoute(db, "/chat", func(client *ghostutils.SocketClient, message []byte) {
+//      client.Hub().BroadcastRoom(client.Request.URL.Query().Get("room"), message, client)
+//  }).Use(ghostutils.RequireIdentity())
+//  chat.OnConnect = func(client *ghostutils.SocketClient) error {
+//      client.Join(client.Request.URL.Query().Get("room"))
+//      return nil
+//  }
+//  chat.Route(r)
+type SocketRoute struct {
+	Path string
+	// Hub holds the connected clients. Routes sharing a hub broadcast
+	// to the clients of each other.
+	Hub *SocketHub
+	// Upgrader upgrades the requests. The zero value only accepts
+	// same-origin requests.
+	Upgrader websocket.Upgrader
+	// OnConnect runs once the connection is upgraded, before any
+	// message is read. An error closes the connection with its text.
+	OnConnect func(client *SocketClient) error
+	// OnMessage runs for every message of the client, one at a time.
+	OnMessage func(client *SocketClient, message []byte)
+	// OnSend runs before every message is written to the client and
+	// returns the message to write, or nil to drop it.
+	OnSend func(client *SocketClient, message []byte) []byte
+	// OnClose runs once the client has left, with the reason it was
+	// closed by the server, if any.
+	OnClose func(client *SocketClient, err error)
+	// Buffer is the number of messages queued per client before it is
+	// disconnected. Defaults to 64.
+	Buffer int
+	// KeepAlive is the interval of pings. Defaults to 25 seconds.
+	KeepAlive time.Duration
+	// ReadLimit is the largest message read from a client, in bytes,
+	// unlimited when zero.
+	ReadLimit int64
+	// Binary writes binary rather than text messages.
+	Binary bool
+
+	middleware []gin.HandlerFunc
+	db         GhostDB
+}
+
+// NewSocketRoute returns a route upgrading the requests on path and
+// passing the messages of the clients to onMessage, with a hub of its
+// own.
+func NewSocketRoute(db GhostDB, path string, onMessage func(client *SocketClient, message []byte), middleware ...gin.HandlerFunc) *SocketRoute {
+	return &SocketRoute{Path: path, Hub: NewSocketHub(), OnMessage: onMessage, middleware: middleware, db: db}
+}
+
+// Use appends middleware to the chain of the route, run before the
+// upgrade. It must be called before Route.
+func (s *SocketRoute) Use(middleware ...gin.HandlerFunc) *SocketRoute {
+	s.middleware = append(s.middleware, middleware...)
+	return s
+}
+
+// Middleware implements GhostRoute.
+func (s *SocketRoute) Middleware() []gin.HandlerFunc {
+	return s.middleware
+}
+
+// DB implements GhostRoute.
+func (s *SocketRoute) DB() GhostDB {
+	return s.db
+}
+
+func (s *SocketRoute) bindDB(db GhostDB) {
+	if s.db == nil {
+		s.db = db
+	}
+}
+
+// Route implements GhostRoute, registering the upgrade on GET of the
+// group path. Further handlers may be added to the group returned.
+func (s *SocketRoute) Route(r gin.IRouter) *gin.RouterGroup {
+	g := r.Group(s.Path, s.middleware...)
+	g.GET("", s.Handler())
+	return g
+}
+
+// Handler upgrades the request and serves the client until it leaves.
+func (s *SocketRoute) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		conn, err := s.Upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// the upgrader has written the error response
+			c.Abort()
+			return
+		}
+		defer conn.Close()
+		if s.ReadLimit > 0 {
+			conn.SetReadLimit(s.ReadLimit)
+		}
+		if s.Hub == nil {
+			s.Hub = NewSocketHub()
+		}
+		buffer := s.Buffer
+		if buffer <= 0 {
+			buffer = 64
+		}
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		client := &SocketClient{
+			ID:      randomID(12),
+			Request: c.Request.WithContext(ctx),
+			hub:     s.Hub,
+			send:    make(chan []byte, buffer),
+			done:    make(chan struct{}),
+			cancel:  cancel,
+			rooms:   map[string]bool{},
+		}
+		client.Identity, _ = CurrentIdentity(c)
+		s.Hub.add(client)
+		defer client.close(nil)
+		if s.OnConnect != nil {
+			if err := s.OnConnect(client); err != nil {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
+					time.Now().Add(time.Second))
+				return
+			}
+		}
+		read := make(chan struct{})
+		go func() {
+			defer close(read)
+			defer client.close(nil)
+			for {
+				_, message, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if s.OnMessage != nil {
+					s.OnMessage(client, message)
+				}
+			}
+		}()
+		s.write(conn, client)
+		// stop the reader before OnClose
+		conn.Close()
+		<-read
+		if s.OnClose != nil {
+			s.OnClose(client, client.Err())
+		}
+	}
+}
+
+// write writes the messages queued for client until it is closed.
+func (s *SocketRoute) write(conn *websocket.Conn, client *SocketClient) {
+	keepAlive := s.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = 25 * time.Second
+	}
+	kind := websocket.TextMessage
+	if s.Binary {
+		kind = websocket.BinaryMessage
+	}
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-client.send:
+			if s.OnSend != nil {
+				if message = s.OnSend(client, message); message == nil {
+					continue
+				}
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(kind, message); err != nil {
+				client.close(nil)
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				client.close(nil)
+				return
+			}
+		case <-client.done:
+			if err := client.Err(); err != nil {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()),
+					time.Now().Add(time.Second))
+			} else {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+					time.Now().Add(time.Second))
+			}
+			return
+		}
+	}
+}
+
+// SocketClient is one connection of a SocketRoute.
+type SocketClient struct {
+	ID string
+	// Identity is the identity of the upgrade request, zero without
+	// one.
+	Identity Identity
+	// Request is the upgrade request, with a context done when the
+	// client leaves.
+	Request *http.Request
+
+	hub    *SocketHub
+	send   chan []byte
+	done   chan struct{}
+	cancel context.CancelFunc
+	// rooms is guarded by the lock of the hub.
+	rooms map[string]bool
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+// Context returns the context of the client, done when it leaves, for
+// the queries made on its behalf.
+func (c *SocketClient) Context() context.Context {
+	return c.Request.Context()
+}
+
+// Hub returns the hub of the client.
+func (c *SocketClient) Hub() *SocketHub {
+	return c.hub
+}
+
+// Send queues message for the client, closing it with
+// ErrSocketClientTooSlow when its queue is full.
+//
+// Returns:
+//  ErrSocketClosed if the client has left
+func (c *SocketClient) Send(message []byte) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrSocketClosed
+	}
+	select {
+	case c.send <- message:
+		c.mu.Unlock()
+		return nil
+	default:
+		c.mu.Unlock()
+		c.close(ErrSocketClientTooSlow)
+		return ErrSocketClientTooSlow
+	}
+}
+
+// SendJSON queues v, encoded as JSON, for the client.
+func (c *SocketClient) SendJSON(v interface{}) error {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(message)
+}
+
+// Join adds the client to rooms, created on first join.
+func (c *SocketClient) Join(rooms ...string) {
+	c.hub.join(c, rooms)
+}
+
+// Leave removes the client from rooms.
+func (c *SocketClient) Leave(rooms ...string) {
+	c.hub.leave(c, rooms)
+}
+
+// Rooms returns the rooms of the client, sorted.
+func (c *SocketClient) Rooms() []string {
+	c.hub.mu.RLock()
+	defer c.hub.mu.RUnlock()
+	rooms := make([]string, 0, len(c.rooms))
+	for room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Err returns why the server closed the client, nil if it left or was
+// closed with Close.
+func (c *SocketClient) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close disconnects the client.
+func (c *SocketClient) Close() {
+	c.close(nil)
+}
+
+func (c *SocketClient) close(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed, c.err = true, err
+	close(c.done)
+	c.mu.Unlock()
+	c.cancel()
+	c.hub.remove(c)
+}
+
+// SocketHub holds the clients of one or more SocketRoutes and their
+// rooms. The zero value is ready to use.
+type SocketHub struct {
+	mu      sync.RWMutex
+	clients map[*SocketClient]struct{}
+	rooms   map[string]map[*SocketClient]struct{}
+}
+
+// NewSocketHub returns an empty hub.
+func NewSocketHub() *SocketHub {
+	return &SocketHub{clients: map[*SocketClient]struct{}{}, rooms: map[string]map[*SocketClient]struct{}{}}
+}
+
+func (h *SocketHub) add(client *SocketClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients == nil {
+		h.clients = map[*SocketClient]struct{}{}
+	}
+	h.clients[client] = struct{}{}
+}
+
+func (h *SocketHub) remove(client *SocketClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, client)
+	for room := range client.rooms {
+		h.leaveRoom(client, room)
+	}
+}
+
+func (h *SocketHub) join(client *SocketClient, rooms []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[client]; !ok {
+		// closed already
+		return
+	}
+	if h.rooms == nil {
+		h.rooms = map[string]map[*SocketClient]struct{}{}
+	}
+	for _, room := range rooms {
+		members, ok := h.rooms[room]
+		if !ok {
+			members = map[*SocketClient]struct{}{}
+			h.rooms[room] = members
+		}
+		members[client] = struct{}{}
+		client.rooms[room] = true
+	}
+}
+
+func (h *SocketHub) leave(client *SocketClient, rooms []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, room := range rooms {
+		h.leaveRoom(client, room)
+	}
+}
+
+// leaveRoom removes client from room, dropping the room once empty.
+// h.mu is held.
+func (h *SocketHub) leaveRoom(client *SocketClient, room string) {
+	delete(client.rooms, room)
+	if members, ok := h.rooms[room]; ok {
+		delete(members, client)
+		if len(members) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+}
+
+// Broadcast sends message to every client of the hub but those of
+// except, such as the sender.
+func (h *SocketHub) Broadcast(message []byte, except ...*SocketClient) {
+	h.mu.RLock()
+	clients := make([]*SocketClient, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+	sendAll(clients, message, except)
+}
+
+// BroadcastRoom sends message to the clients in room but those of
+// except.
+//
+// Example:
+//  hub.BroadcastRoom("post:1", []byte(`{"type":"comment"}`))
+func (h *SocketHub) BroadcastRoom(room string, message []byte, except ...*SocketClient) {
+	h.mu.RLock()
+	members := h.rooms[room]
+	clients := make([]*SocketClient, 0, len(members))
+	for client := range members {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+	sendAll(clients, message, except)
+}
+
+// sendAll sends message to clients outside except, outside the lock of
+// the hub since a slow client is removed from it.
+func sendAll(clients []*SocketClient, message []byte, except []*SocketClient) {
+	for _, client := range clients {
+		skip := false
+		for _, excluded := range except {
+			if client == excluded {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			_ = client.Send(message)
+		}
+	}
+}
+
+// Clients returns the number of connected clients.
+func (h *SocketHub) Clients() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// Rooms returns the rooms with at least one client, sorted.
+func (h *SocketHub) Rooms() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	rooms := make([]string, 0, len(h.rooms))
+	for room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
@@ -0,0 +1,307 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FieldSelectionKey is the gin context key holding the route's
+// FieldAllowlist.
+const FieldSelectionKey = "ghost-field-selection"
+
+// FieldAllowlist limits which fields a route lets clients select
+// with ?fields= and which relationships they may ?expand=. Empty
+// lists allow everything the model declares.
+type FieldAllowlist struct {
+	Fields []string
+	Expand []string
+	// Expander loads related records for ?expand=.
+	Expander Expander
+}
+
+// FieldSelection is the parsed ?fields=a,b.c&expand=rel query.
+type FieldSelection struct {
+	Fields []string
+	Expand []string
+}
+
+// Expander loads the records with ids, keyed by id. Records the
+// caller may not see are left out, and the fields of those returned
+// are filtered for the caller, as RepositoryExpander does.
+type Expander func(ctx context.Context, ids []string) (map[string]interface{}, error)
+
+var recordIDPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*:(⟨[^⟩]+⟩|[A-Za-z0-9_]+)$`)
+
+// RepositoryExpander loads related records through repo in one query,
+// so they pass its Authorizer, and removes the fields of T the caller
+// may not view, see FilterFields.
+//
+// Example:
+//  users := ghostutils.NewRepository[User](db, "user")
+//  users.Authorizer = ghostutils.OwnerAuthorizer{OrgField: "org"}
+//  r.GET("/posts", ghostutils.SparseFieldset(ghostutils.FieldAllowlist{
+//      Expand:   []string{"author"},
+//      Expander: ghostutils.RepositoryExpander(users),
+//  }), listPosts)
+func RepositoryExpander[T any](repo *Repository[T]) Expander {
+	return func(ctx context.Context, ids []string) (map[string]interface{}, error) {
+		for _, id := range ids {
+			if !recordIDPattern.MatchString(id) {
+				return nil, fmt.Errorf("invalid record id %q", id)
+			}
+		}
+		rows, err := repo.GetMany(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		identity, _ := IdentityFrom(ctx)
+		out := make(map[string]interface{}, len(rows))
+		for _, id := range ids {
+			if row, ok := rows[loaderKey(repo.Table, id)]; ok {
+				out[id] = FilterFields(row, identity.Roles)
+			}
+		}
+		return out, nil
+	}
+}
+
+// ExpandTables dispatches the ids of relations to several tables to
+// the expander of their table; ids of other tables are not expanded.
+//
+// Example:
+//  Expander: ghostutils.ExpandTables(map[string]ghostutils.Expander{
+//      "user": ghostutils.RepositoryExpander(users),
+//      "org":  ghostutils.RepositoryExpander(orgs),
+//  }),
+func ExpandTables(expanders map[string]Expander) Expander {
+	return func(ctx context.Context, ids []string) (map[string]interface{}, error) {
+		byTable := map[string][]string{}
+		for _, id := range ids {
+			table, _, _ := strings.Cut(id, ":")
+			byTable[table] = append(byTable[table], id)
+		}
+		out := make(map[string]interface{}, len(ids))
+		for table, tableIDs := range byTable {
+			expander, ok := expanders[table]
+			if !ok {
+				continue
+			}
+			loaded, err := expander(ctx, tableIDs)
+			if err != nil {
+				return nil, err
+			}
+			for id, record := range loaded {
+				out[id] = record
+			}
+		}
+		return out, nil
+	}
+}
+
+// SparseFieldset installs the allowlist for the route.
+//
+// Example:
+//  r.GET("/users", ghostutils.SparseFieldset(ghostutils.FieldAllowlist{
+//      Fields:   []string{"name", "email", "organization.name"},
+//      Expand:   []string{"organization"},
+//      Expander: ghostutils.RepositoryExpander(orgs),
+//  }), listUsers)
+func SparseFieldset(allow FieldAllowlist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(FieldSelectionKey, allow)
+		c.Next()
+	}
+}
+
+// ParseFieldSelection reads ?fields= and ?expand= and checks them
+// against allow.
+func ParseFieldSelection(c *gin.Context, allow FieldAllowlist) (FieldSelection, error) {
+	sel := FieldSelection{
+		Fields: splitList(c.Query("fields")),
+		Expand: splitList(c.Query("expand")),
+	}
+	for _, field := range sel.Fields {
+		if len(allow.Fields) > 0 && !containsString(allow.Fields, field) {
+			return sel, fmt.Errorf("field %q cannot be selected", field)
+		}
+	}
+	for _, rel := range sel.Expand {
+		if len(allow.Expand) > 0 && !containsString(allow.Expand, rel) {
+			return sel, fmt.Errorf("relation %q cannot be expanded", rel)
+		}
+	}
+	return sel, nil
+}
+
+// SelectFields applies the request's field selection to data: it
+// removes fields the caller may not view, expands the requested
+// relationships (only fields tagged ghost:"rel") and prunes the
+// result to the selected fields. "id" is always kept.
+func SelectFields(c *gin.Context, data interface{}) (interface{}, error) {
+	value, _ := c.Get(FieldSelectionKey)
+	allow, _ := value.(FieldAllowlist)
+	sel, err := ParseFieldSelection(c, allow)
+	if err != nil {
+		return nil, err
+	}
+	out := VisibleFields(c, data)
+	if len(sel.Expand) > 0 {
+		rels := relationFieldsOf(data)
+		for _, rel := range sel.Expand {
+			if !containsString(rels, rel) {
+				return nil, fmt.Errorf("%q is not a relation", rel)
+			}
+		}
+		if allow.Expander == nil {
+			return nil, fmt.Errorf("route has no expander")
+		}
+		if err := expandRelations(c, out, sel.Expand, allow.Expander); err != nil {
+			return nil, err
+		}
+	}
+	if len(sel.Fields) > 0 {
+		out = pruneFields(out, sel.Fields)
+	}
+	return out, nil
+}
+
+// JSONSelected renders data as JSON after SelectFields. Invalid
+// selections are answered with 400.
+func JSONSelected(c *gin.Context, code int, data interface{}) {
+	out, err := SelectFields(c, data)
+	if err != nil {
+		FailStatus(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(code, out)
+}
+
+func expandRelations(c *gin.Context, data interface{}, rels []string, expander Expander) error {
+	records := asRecordList(data)
+	seen := map[string]bool{}
+	var ids []string
+	for _, record := range records {
+		for _, rel := range rels {
+			for _, id := range relationIDs(record[rel]) {
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	loaded, err := expander(c, ids)
+	if err != nil {
+		return err
+	}
+	// records the expander left out, missing or hidden from the
+	// caller, become null
+	related := func(id string) interface{} {
+		if record, ok := loaded[id]; ok {
+			return VisibleFields(c, record)
+		}
+		return nil
+	}
+	for _, record := range records {
+		for _, rel := range rels {
+			switch v := record[rel].(type) {
+			case string:
+				record[rel] = related(v)
+			case []interface{}:
+				for i, entry := range v {
+					if id, ok := entry.(string); ok {
+						v[i] = related(id)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func relationIDs(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var ids []string
+		for _, entry := range v {
+			if id, ok := entry.(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	return nil
+}
+
+func asRecordList(data interface{}) []map[string]interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}
+	case []interface{}:
+		out := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			if m, ok := item.(map[string]interface{}); ok {
+				out = append(out, m)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// pruneFields keeps only the dotted paths in fields.
+func pruneFields(data interface{}, fields []string) interface{} {
+	switch v := data.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = pruneFields(item, fields)
+		}
+		return out
+	case map[string]interface{}:
+		nested := map[string][]string{}
+		out := map[string]interface{}{}
+		if id, ok := v["id"]; ok {
+			out["id"] = id
+		}
+		for _, field := range fields {
+			head, rest, hasRest := strings.Cut(field, ".")
+			value, ok := v[head]
+			if !ok {
+				continue
+			}
+			if hasRest {
+				nested[head] = append(nested[head], rest)
+				continue
+			}
+			out[head] = value
+		}
+		for head, rest := range nested {
+			if _, whole := out[head]; !whole {
+				out[head] = pruneFields(v[head], rest)
+			}
+		}
+		return out
+	}
+	return data
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
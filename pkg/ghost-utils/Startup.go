@@ -0,0 +1,226 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Startup check statuses.
+const (
+	StartupOK      = "ok"
+	StartupFailed  = "failed"
+	StartupSkipped = "skipped"
+)
+
+// StartupCheck is a diagnostic run once at startup, such as the
+// migration status. Run returns a short detail for the report.
+type StartupCheck struct {
+	Name string
+	Run  func(ctx context.Context) (string, error)
+}
+
+// StartupResult is the outcome of a StartupCheck.
+type StartupResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Duration string `json:"duration"`
+	// Fix is what resolves a failure, set by checks returning a Remedy.
+	Fix string `json:"fix,omitempty"`
+}
+
+// StartupReport describes what an instance loaded.
+type StartupReport struct {
+	Name      string                 `json:"name"`
+	Version   string                 `json:"version"`
+	Env       string                 `json:"env"`
+	Host      string                 `json:"host"`
+	StartedAt time.Time              `json:"started_at"`
+	Routes    int                    `json:"routes"`
+	Config    map[string]interface{} `json:"config"`
+	Checks    []StartupResult        `json:"checks"`
+}
+
+// OK reports whether no check failed.
+func (report StartupReport) OK() bool {
+	for _, check := range report.Checks {
+		if check.Status == StartupFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// redactedConfigWords mark config paths whose values are secrets.
+var redactedConfigWords = []string{"password", "secret", "token", "key"}
+
+// Startup builds the startup report for an instance: the effective
+// config with secrets redacted, the number of routes on r, the
+// SurrealDB round trip latency, whether the database matches the
+// migrations, the tailwind build status and any extra checks. r and
+// db may be nil; their parts are skipped. Call it after every route
+// is mounted, then Log the report and serve it with StartupHandler.
+//
+// Example:
+//  report := ghostConfig.Startup(ctx, r, db, ghostutils.StartupCheck{
+//      Name: "cache",
+//      Run: func(ctx context.Context) (string, error) {
+//          return "connected", rdb.Ping(ctx).Err()
+//      },
+//  })
+//  report.Log()
+//  r.GET("/ghost/startup", ghostutils.RequireRole(ghostutils.AdminRole), ghostutils.StartupHandler(report))
+//
+// Returns:
+//  StartupReport
+func (ghostConfig GhostConfig) Startup(ctx context.Context, r *gin.Engine, db GhostDB, checks ...StartupCheck) StartupReport {
+	host, _ := os.Hostname()
+	report := StartupReport{
+		Name:      ghostConfig.Name,
+		Version:   ghostConfig.Version,
+		Env:       ghostConfig.Env,
+		Host:      host,
+		StartedAt: time.Now().UTC(),
+		Config:    redactedConfig(ghostConfig),
+	}
+	if r != nil {
+		report.Routes = len(r.Routes())
+	}
+	builtin := []StartupCheck{
+		{Name: "surrealdb", Run: func(ctx context.Context) (string, error) {
+			if db == nil {
+				return "", errStartupSkipped
+			}
+			start := time.Now()
+			if _, err := db.Query("RETURN true", map[string]interface{}{}); err != nil {
+				return "", err
+			}
+			return "latency " + time.Since(start).Round(time.Microsecond).String(), nil
+		}},
+		{Name: "schema", Run: func(ctx context.Context) (string, error) {
+			if db == nil {
+				return "", errStartupSkipped
+			}
+			migrator, err := ghostConfig.schemaMigrator(WithContext(ctx, db))
+			if err != nil {
+				return "", err
+			}
+			return migrator.SchemaCheck().Run(ctx)
+		}},
+		{Name: "tailwind", Run: ghostConfig.tailwindStatus},
+	}
+	for _, check := range append(builtin, checks...) {
+		report.Checks = append(report.Checks, runStartupCheck(ctx, check))
+	}
+	return report
+}
+
+var errStartupSkipped = errors.New("skipped")
+
+// schemaMigrator returns the migrator of the migrations directory
+// for the schema check, skipping it without one.
+func (ghostConfig GhostConfig) schemaMigrator(db GhostDB) (*Migrator, error) {
+	dir := ghostConfig.Migrations.Dir
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, errStartupSkipped
+	}
+	return NewMigrator(db, os.DirFS(dir))
+}
+
+func runStartupCheck(ctx context.Context, check StartupCheck) StartupResult {
+	start := time.Now()
+	detail, err := check.Run(ctx)
+	result := StartupResult{Name: check.Name, Status: StartupOK, Detail: detail, Duration: time.Since(start).Round(time.Microsecond).String()}
+	if errors.Is(err, errStartupSkipped) {
+		result.Status = StartupSkipped
+	} else if err != nil {
+		result.Status, result.Detail = StartupFailed, err.Error()
+		var remedy *Remediation
+		if errors.As(err, &remedy) {
+			result.Fix = remedy.Fix
+		}
+	}
+	return result
+}
+
+// tailwindStatus reports whether the tailwind output exists and is
+// newer than its input.
+func (ghostConfig GhostConfig) tailwindStatus(ctx context.Context) (string, error) {
+	tailwind := ghostConfig.TailwindCSS
+	if tailwind.Output == "" {
+		return "", errStartupSkipped
+	}
+	output, err := os.Stat(tailwind.Output)
+	if err != nil {
+		return "", fmt.Errorf("%s has not been built", tailwind.Output)
+	}
+	if input, err := os.Stat(tailwind.Input); err == nil && input.ModTime().After(output.ModTime()) {
+		return "", fmt.Errorf("%s is older than %s", tailwind.Output, tailwind.Input)
+	}
+	return fmt.Sprintf("%s built %s", tailwind.Output, output.ModTime().UTC().Format(time.RFC3339)), nil
+}
+
+func redactedConfig(ghostConfig GhostConfig) map[string]interface{} {
+	values := configValues(ghostConfig)
+	for path, value := range values {
+		if text, ok := value.(string); ok && strings.Contains(text, "://") {
+			// connection strings may carry credentials
+			if u, err := url.Parse(text); err == nil && u.User != nil {
+				u.User = url.User(u.User.Username())
+				values[path] = u.String()
+			}
+		}
+		lower := strings.ToLower(path)
+		for _, word := range redactedConfigWords {
+			if strings.Contains(lower, word) && value != "" {
+				values[path] = "[redacted]"
+				break
+			}
+		}
+	}
+	return values
+}
+
+// Log writes the report as key=value lines, one for the instance, one
+// for its config and one per check.
+func (report StartupReport) Log() {
+	log.Printf("startup: name=%s version=%s env=%q host=%s routes=%d ok=%t",
+		report.Name, report.Version, report.Env, report.Host, report.Routes, report.OK())
+	paths := make([]string, 0, len(report.Config))
+	for path := range report.Config {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	pairs := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if value := report.Config[path]; value != "" && value != 0 {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", path, value))
+		}
+	}
+	log.Printf("startup: config %s", strings.Join(pairs, " "))
+	for _, check := range report.Checks {
+		log.Printf("startup: check=%s status=%s duration=%s detail=%q", check.Name, check.Status, check.Duration, check.Detail)
+	}
+}
+
+// StartupHandler serves report as JSON, with status 503 when a check
+// failed.
+func StartupHandler(report StartupReport) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := http.StatusOK
+		if !report.OK() {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, report)
+	}
+}
@@ -0,0 +1,83 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrStorageKey is returned when a storage key escapes the
+// storage root or is otherwise unusable.
+var ErrStorageKey = errors.New("invalid storage key")
+
+// Storage is the backend used to persist binary blobs such as
+// mail attachments and uploaded files. Keys are slash separated
+// paths relative to the root of the backend.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalStorage stores blobs on the local disk under Root.
+//
+// Example:
+//  store := ghostutils.LocalStorage{Root: "./storage"}
+//  err := store.Put(ctx, "avatars/1.png", file, "image/png")
+type LocalStorage struct {
+	Root string
+}
+
+func (s LocalStorage) path(key string) (string, error) {
+	clean := filepath.Clean("/" + strings.TrimSpace(key))
+	if clean == "/" {
+		return "", ErrStorageKey
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(clean)), nil
+}
+
+// Put writes r to key, creating parent directories as needed.
+func (s LocalStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// Open returns a reader for the blob stored at key.
+func (s LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Delete removes the blob stored at key. Deleting a missing
+// key is not an error.
+func (s LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
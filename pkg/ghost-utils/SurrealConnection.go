@@ -0,0 +1,230 @@
+package ghostutils
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// ConnectionConfig is the surrealdb-connection block of ghost.yaml,
+// tuning the websocket to SurrealDB. Compression deflates the queries
+// sent (permessage-deflate); results are deflated by SurrealDB once
+// the extension is negotiated, which the driver always offers.
+// ReadLimit bounds the size of one result, closing the connection on
+// larger ones, and the buffer sizes set the frames read and written.
+//
+//  surrealdb:
+//      surrealdb-connection:
+//          compression: true
+//          compression-level: 6
+//          read-limit: 67108864
+//          read-buffer-size: 65536
+//          write-buffer-size: 65536
+//          timeout: 1m
+type ConnectionConfig struct {
+	Compression bool `yaml:"compression"`
+	// CompressionLevel is 1 (fastest) to 9 (smallest), 1 by default.
+	CompressionLevel int           `yaml:"compression-level"`
+	ReadLimit        int64         `yaml:"read-limit"`
+	ReadBufferSize   int           `yaml:"read-buffer-size"`
+	WriteBufferSize  int           `yaml:"write-buffer-size"`
+	// Timeout bounds each request, 30s by default.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// dialMu serializes the dials, which share the driver's dialer.
+var dialMu sync.Mutex
+
+// Dial connects to SurrealDB at url with the connection settings.
+// Setup dials the surrealdb-url with them; use Dial for the other
+// connections of the app, e.g. to another database.
+//
+// Example:
+//  db, err := ghostConfig.SurrealDB.Connection.Dial("ws://analytics:8000/rpc")
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  *surrealdb.DB, not signed in
+//  error if the connection fails
+func (c ConnectionConfig) Dial(url string) (*surrealdb.DB, error) {
+	return c.dial(url, nil)
+}
+
+func (c ConnectionConfig) dial(url string, watch *connWatch) (*surrealdb.DB, error) {
+	var options []surrealdb.Option
+	if c.Timeout > 0 {
+		options = append(options, surrealdb.WithTimeout(c.Timeout))
+	}
+	if c.Compression {
+		options = append(options, surrealdb.UseWriteCompression(true))
+		if c.CompressionLevel != 0 {
+			level := c.CompressionLevel
+			options = append(options, connOption(func(conn *websocket.Conn) error {
+				return conn.SetCompressionLevel(level)
+			}))
+		}
+	}
+	if c.ReadLimit > 0 {
+		limit := c.ReadLimit
+		options = append(options, connOption(func(conn *websocket.Conn) error {
+			conn.SetReadLimit(limit)
+			return nil
+		}))
+	}
+	dialMu.Lock()
+	defer dialMu.Unlock()
+	// the driver dials with websocket.DefaultDialer
+	dialer := websocket.DefaultDialer
+	readSize, writeSize := dialer.ReadBufferSize, dialer.WriteBufferSize
+	netDial := dialer.NetDialContext
+	dialer.ReadBufferSize, dialer.WriteBufferSize = c.ReadBufferSize, c.WriteBufferSize
+	dialer.NetDialContext = watchedDial(netDial, dialer.NetDial, watch)
+	defer func() {
+		dialer.ReadBufferSize, dialer.WriteBufferSize = readSize, writeSize
+		dialer.NetDialContext = netDial
+	}()
+	return surrealdb.New(url, options...)
+}
+
+// DialContext is Dial giving up once ctx is done. A connection made
+// after that is closed.
+func (c ConnectionConfig) DialContext(ctx context.Context, url string) (*surrealdb.DB, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type dialed struct {
+		db  *surrealdb.DB
+		err error
+	}
+	done := make(chan dialed, 1)
+	watch, _ := ctx.Value(connWatchKey{}).(*connWatch)
+	go func() {
+		db, err := c.dial(url, watch)
+		done <- dialed{db, err}
+	}()
+	select {
+	case d := <-done:
+		return d.db, d.err
+	case <-ctx.Done():
+		go func() {
+			if d := <-done; d.err == nil {
+				d.db.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// connOption returns the option calling fn with the websocket of the
+// connection, which the driver passes as an internal type.
+func connOption(fn func(conn *websocket.Conn) error) surrealdb.Option {
+	var option surrealdb.Option
+	field := reflect.ValueOf(&option).Elem().FieldByName("WsOption")
+	field.Set(reflect.MakeFunc(field.Type(), func(args []reflect.Value) []reflect.Value {
+		var err error
+		if conn, ok := args[0].Elem().FieldByName("Conn").Interface().(*websocket.Conn); ok {
+			err = fn(conn)
+		}
+		result := reflect.New(field.Type().Out(0)).Elem()
+		if err != nil {
+			result.Set(reflect.ValueOf(err))
+		}
+		return []reflect.Value{result}
+	}))
+	return option
+}
+
+// lossConn is the network connection under the websocket of a
+// SurrealDB connection. The driver reads the websocket in a loop that
+// skips errors, and gorilla panics once a failed socket has been read
+// a thousand times, so a dropped connection would take the app down. A
+// failed read of lossConn reports the loss instead, then waits for
+// Close.
+type lossConn struct {
+	net.Conn
+	watch *connWatch
+}
+
+func (conn *lossConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if err != nil {
+		conn.watch.lose(err)
+		<-conn.watch.closed
+	}
+	return n, err
+}
+
+func (conn *lossConn) Close() error {
+	conn.watch.release()
+	return conn.Conn.Close()
+}
+
+// connWatch follows the network connection of one dial: lost is closed
+// when it fails, closed once it is closed.
+type connWatch struct {
+	conn      *lossConn
+	err       error
+	lost      chan struct{}
+	closed    chan struct{}
+	loseOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// connWatchKey is the context key of the connWatch DialContext reports
+// to.
+type connWatchKey struct{}
+
+func newConnWatch() *connWatch {
+	return &connWatch{lost: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (watch *connWatch) lose(err error) {
+	watch.loseOnce.Do(func() {
+		watch.err = err
+		close(watch.lost)
+	})
+}
+
+func (watch *connWatch) release() {
+	watch.closeOnce.Do(func() { close(watch.closed) })
+}
+
+// shutdown closes the network connection, ending the read loop of the
+// driver once the driver connection is closed too.
+func (watch *connWatch) shutdown() {
+	if watch.conn != nil {
+		watch.conn.Close()
+	}
+}
+
+// watchedDial wraps the connections of the dialer in a lossConn
+// reporting to watch, a new one when watch is nil.
+func watchedDial(dialContext func(ctx context.Context, network, addr string) (net.Conn, error), dial func(network, addr string) (net.Conn, error), watch *connWatch) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if watch == nil {
+		watch = newConnWatch()
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		switch {
+		case dialContext != nil:
+			conn, err = dialContext(ctx, network, addr)
+		case dial != nil:
+			conn, err = dial(network, addr)
+		default:
+			conn, err = (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		watch.conn = &lossConn{Conn: conn, watch: watch}
+		return watch.conn, nil
+	}
+}
@@ -0,0 +1,83 @@
+package ghostutils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// surrealQuery runs a single SurrealQL statement and unmarshals the
+// result rows into a slice of T.
+func surrealQuery[T any](db GhostDB, sql string, vars map[string]interface{}) ([]T, error) {
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	start := time.Now()
+	rows, err := surrealdb.SmartUnmarshal[[]T](db.Query(sql, vars))
+	observeQuery(db, sql, vars, start, err)
+	return rows, err
+}
+
+// surrealStatements runs a multi statement query and returns the
+// raw result of every statement, so callers can inspect each status.
+func surrealStatements(db GhostDB, sql string, vars map[string]interface{}) ([]surrealdb.RawQuery[interface{}], error) {
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	start := time.Now()
+	res, err := db.Query(sql, vars)
+	observeQuery(db, sql, vars, start, err)
+	if err != nil {
+		return nil, err
+	}
+	var statements []surrealdb.RawQuery[interface{}]
+	err = surrealdb.Unmarshal(res, &statements)
+	return statements, err
+}
+
+// surrealFirst is surrealQuery for statements expected to return at
+// most one row. ok is false when no row matched.
+func surrealFirst[T any](db GhostDB, sql string, vars map[string]interface{}) (row T, ok bool, err error) {
+	rows, err := surrealQuery[T](db, sql, vars)
+	if err != nil || len(rows) == 0 {
+		return row, false, err
+	}
+	return rows[0], true, nil
+}
+
+// surrealCreate creates a record in thing, which is either a table
+// or a record id, and returns the stored row.
+func surrealCreate[T any](db GhostDB, thing string, data interface{}) (row T, err error) {
+	start := time.Now()
+	res, err := db.Create(thing, data)
+	observeQuery(db, "CREATE "+thing, nil, start, err)
+	if err != nil {
+		return row, err
+	}
+	if rows, ok := res.([]interface{}); ok {
+		if len(rows) == 0 {
+			return row, surrealdb.ErrNoRow
+		}
+		res = rows[0]
+	}
+	err = surrealdb.Unmarshal(res, &row)
+	return row, err
+}
+
+// recordID joins a table and id into a record id, escaping the id
+// so generated ids starting with digits parse as strings.
+func recordID(table, id string) string {
+	return table + ":⟨" + id + "⟩"
+}
+
+// randomID returns n random bytes hex encoded, suitable for record
+// IDs and tokens.
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,664 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// PoolConfig is the surrealdb-pool block of ghost.yaml. SetupPool opens
+// Size connections to SurrealDB and spreads the calls over them; a
+// connection that drops is dialed again in the background, signed in
+// and set to the namespace and database, while the others serve. Every
+// HealthInterval the idle connections are pinged, so a dead one is
+// found before a request needs it.
+//
+//  surrealdb:
+//      surrealdb-pool:
+//          size: 4
+//          health-interval: 15s
+type PoolConfig struct {
+	Size           int           `yaml:"size"`
+	HealthInterval time.Duration `yaml:"health-interval"`
+}
+
+// Defaults applied to PoolConfig by NewPool.
+const (
+	DefaultPoolSize           = 4
+	DefaultPoolHealthInterval = 30 * time.Second
+)
+
+// ErrPoolUnavailable is returned by the calls of a SurrealPool while
+// none of its connections is up.
+var ErrPoolUnavailable = errors.New("no database connection is available")
+
+// ErrPoolClosed is returned by the calls of a closed SurrealPool.
+var ErrPoolClosed = errors.New("database pool is closed")
+
+// errConnectionLost is returned by the calls running on a connection
+// that drops. SurrealDB may have run them.
+var errConnectionLost = fmt.Errorf("%w: the connection was lost", ErrPoolUnavailable)
+
+// poolPingTimeout bounds the health check of one connection.
+const poolPingTimeout = 5 * time.Second
+
+// poolSession is one dial of a poolConn.
+type poolSession struct {
+	db      *surrealdb.DB
+	watch   *connWatch
+	inUse   int32
+	calls   sync.WaitGroup
+	retired bool
+}
+
+func (session *poolSession) release() {
+	atomic.AddInt32(&session.inUse, -1)
+	session.calls.Done()
+}
+
+// run calls fn on the session, returning errConnectionLost as soon as
+// its network connection fails: the driver would wait for its timeout.
+// The session is released once fn returns.
+func (session *poolSession) run(fn func(db *surrealdb.DB) (interface{}, error)) (interface{}, error) {
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer session.release()
+		value, err := fn(session.db)
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-session.watch.lost:
+		return nil, errConnectionLost
+	}
+}
+
+// poolConn is one connection of a SurrealPool, dialed again when lost.
+type poolConn struct {
+	mu      sync.RWMutex
+	session *poolSession
+	healthy int32
+	pinging int32
+}
+
+func (conn *poolConn) up() bool {
+	return atomic.LoadInt32(&conn.healthy) == 1
+}
+
+// inUse returns the calls running on the session of conn.
+func (conn *poolConn) inUse() int {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return int(atomic.LoadInt32(&conn.session.inUse))
+}
+
+func (conn *poolConn) idle() bool {
+	return conn.inUse() == 0
+}
+
+// acquire returns the session to run a call on, nil once it is retired.
+func (conn *poolConn) acquire() *poolSession {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	session := conn.session
+	if session.retired {
+		return nil
+	}
+	atomic.AddInt32(&session.inUse, 1)
+	session.calls.Add(1)
+	return session
+}
+
+// retire stops the calls on the session of conn and closes it once the
+// running ones are done: the driver does not lock its close against its
+// requests. The driver connection closes first, so its read loop ends
+// when the network connection is closed.
+func (conn *poolConn) retire() {
+	conn.mu.Lock()
+	session := conn.session
+	retired := session.retired
+	session.retired = true
+	conn.mu.Unlock()
+	if retired {
+		return
+	}
+	go func() {
+		session.calls.Wait()
+		session.db.Close()
+		session.watch.shutdown()
+	}()
+}
+
+// SurrealPool is a GhostDB over several connections to SurrealDB. Calls
+// go round-robin to the connections that are up. One whose websocket
+// fails is taken out and reconnected in the background with Retry, then
+// signed in and set with the last Signin and Use of the pool. A call
+// that failed before reaching SurrealDB is sent again on another
+// connection; one that may have run is returned with its error, as it
+// is not safe to repeat.
+//
+// Example:
+//  pool, err := ghostConfig.SetupPool(r)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  users := ghostutils.NewRepository[User](pool, "user")
+//  watchdog.Pool = pool.Usage
+type SurrealPool struct {
+	// Dial opens one connection, signed in and using its namespace.
+	Dial func(ctx context.Context) (*surrealdb.DB, error)
+	// Retry paces the reconnects, which go on until the pool closes.
+	Retry RetryConfig
+	// HealthInterval is the time between health checks, none when 0.
+	HealthInterval time.Duration
+
+	conns []*poolConn
+	next  uint32
+
+	mu        sync.Mutex
+	signin    interface{}
+	namespace string
+	database  string
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSurrealPool opens size connections with dial, retrying each with
+// retry, and starts checking them every interval.
+//
+// Returns:
+//  *SurrealPool, closed by the caller
+//  error of the first connection that could not be opened
+func NewSurrealPool(ctx context.Context, size int, dial func(ctx context.Context) (*surrealdb.DB, error), retry RetryConfig, interval time.Duration) (*SurrealPool, error) {
+	if size < 1 {
+		size = 1
+	}
+	pool := &SurrealPool{Dial: dial, Retry: retry, HealthInterval: interval, done: make(chan struct{})}
+	for i := 0; i < size; i++ {
+		var session *poolSession
+		err := retry.DoContext(ctx, func() error {
+			var err error
+			session, err = pool.open(ctx)
+			return err
+		})
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("surrealdb pool connection %d: %w", i+1, err)
+		}
+		conn := &poolConn{session: session, healthy: 1}
+		pool.conns = append(pool.conns, conn)
+		go pool.follow(conn, session)
+	}
+	if interval > 0 {
+		go pool.check()
+	}
+	return pool, nil
+}
+
+// NewPool opens the pool of the surrealdb block: surrealdb-pool.size
+// connections dialed, signed in and set to the namespace and database
+// as Connect does.
+//
+// Example:
+//  pool, err := ghostConfig.NewPool(ctx)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  defer pool.Close()
+//
+// Returns:
+//  *SurrealPool, closed by the caller
+//  error
+func (ghostConfig GhostConfig) NewPool(ctx context.Context) (*SurrealPool, error) {
+	return ghostConfig.SurrealDB.newPool(ctx)
+}
+
+func (config SurrealDBConfig) newPool(ctx context.Context) (*SurrealPool, error) {
+	pool := config.Pool
+	if pool.Size == 0 {
+		pool.Size = DefaultPoolSize
+	}
+	if pool.HealthInterval == 0 {
+		pool.HealthInterval = DefaultPoolHealthInterval
+	}
+	return NewSurrealPool(ctx, pool.Size, config.dial, config.Retry, pool.HealthInterval)
+}
+
+// dial makes one attempt at a connection.
+func (config SurrealDBConfig) dial(ctx context.Context) (*surrealdb.DB, error) {
+	endpoint, err := config.endpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	db, err := config.Connection.DialContext(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn := WithContext(ctx, db)
+	if _, err := conn.Signin(config.signinObj()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := conn.Use(config.Namespace, config.Database); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// SetupPool is BasicSurrealSetup over a SurrealPool instead of a single
+// connection: the migrations, health routes and jobs use the pool, and
+// it closes when the app stops.
+//
+// Example:
+//  pool, err := ghostConfig.SetupPool(r)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  ghostutils.RegisterRoutes(r, pool, users, posts)
+//
+// Returns:
+//  *SurrealPool
+//  error
+func (ghostConfig GhostConfig) SetupPool(r *gin.Engine) (*SurrealPool, error) {
+	return ghostConfig.setupPool(context.Background(), r, nil, nil)
+}
+
+// SetupPoolContext is SetupPool bounded by ctx, see SetupContext.
+//
+// Returns:
+//  *SurrealPool
+//  error, wrapping ctx.Err() when ctx ended the setup
+func (ghostConfig GhostConfig) SetupPoolContext(ctx context.Context, r *gin.Engine) (*SurrealPool, error) {
+	return ghostConfig.setupPool(ctx, r, nil, nil)
+}
+
+func (ghostConfig GhostConfig) setupPool(ctx context.Context, r *gin.Engine, templates, static fs.FS) (*SurrealPool, error) {
+	app, err := ghostConfig.wire(r, templates, static)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := ghostConfig.NewPool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	app.onStop(func(context.Context) error {
+		pool.Close()
+		return nil
+	})
+	return pool, ghostConfig.start(app, pool)
+}
+
+// open dials one connection, watching the network connection under it
+// when Dial passes ctx to ConnectionConfig.DialContext.
+func (pool *SurrealPool) open(ctx context.Context) (*poolSession, error) {
+	watch := newConnWatch()
+	db, err := pool.Dial(context.WithValue(ctx, connWatchKey{}, watch))
+	if err != nil {
+		return nil, err
+	}
+	return &poolSession{db: db, watch: watch}, nil
+}
+
+// follow takes conn out once the network connection of session fails.
+func (pool *SurrealPool) follow(conn *poolConn, session *poolSession) {
+	select {
+	case <-session.watch.lost:
+		pool.down(conn, session, session.watch.err)
+	case <-session.watch.closed:
+	case <-pool.done:
+	}
+}
+
+// pick returns the next connection that is up, nil when none is.
+func (pool *SurrealPool) pick() *poolConn {
+	n := uint32(len(pool.conns))
+	if n == 0 {
+		return nil
+	}
+	start := atomic.AddUint32(&pool.next, 1)
+	for i := uint32(0); i < n; i++ {
+		if conn := pool.conns[(start+i)%n]; conn.up() {
+			return conn
+		}
+	}
+	return nil
+}
+
+// call runs fn on a connection, moving to another one when the
+// connection failed before the request was sent.
+func (pool *SurrealPool) call(fn func(db *surrealdb.DB) (interface{}, error)) (interface{}, error) {
+	for attempt := 0; attempt < len(pool.conns); attempt++ {
+		if pool.closed() {
+			return nil, ErrPoolClosed
+		}
+		conn := pool.pick()
+		if conn == nil {
+			break
+		}
+		session := conn.acquire()
+		if session == nil {
+			continue
+		}
+		result, err := session.run(fn)
+		switch {
+		case err == nil, isRPCError(err), errors.Is(err, surrealdb.ErrNoRow):
+			return result, err
+		case isTimeout(err):
+			// slow, or talking to a dead socket: the ping tells apart
+			go pool.ping(conn)
+			return result, err
+		}
+		pool.down(conn, session, err)
+		if !unsent(err) {
+			return result, err
+		}
+	}
+	return nil, ErrPoolUnavailable
+}
+
+// down takes conn out of the pool and reconnects it, once for session.
+func (pool *SurrealPool) down(conn *poolConn, session *poolSession, err error) {
+	conn.mu.RLock()
+	current := conn.session == session
+	conn.mu.RUnlock()
+	if !current || !atomic.CompareAndSwapInt32(&conn.healthy, 1, 0) {
+		return
+	}
+	log.Printf("ghost: surrealdb connection lost, reconnecting: %v", err)
+	go pool.reconnect(conn)
+}
+
+// reconnect dials conn again until it is up or the pool closes.
+func (pool *SurrealPool) reconnect(conn *poolConn) {
+	conn.retire()
+	retry := pool.Retry
+	if retry.InitialDelay <= 0 {
+		retry.InitialDelay = DefaultRetryInitialDelay
+	}
+	if retry.MaxDelay <= 0 {
+		retry.MaxDelay = DefaultRetryMaxDelay
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-pool.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		session, err := pool.open(ctx)
+		if err == nil {
+			if err = pool.restore(ctx, session.db); err == nil {
+				conn.mu.Lock()
+				conn.session = session
+				conn.mu.Unlock()
+				atomic.StoreInt32(&conn.healthy, 1)
+				if pool.closed() && atomic.CompareAndSwapInt32(&conn.healthy, 1, 0) {
+					conn.retire()
+					return
+				}
+				go pool.follow(conn, session)
+				log.Printf("ghost: surrealdb connection restored after %d attempt(s)", attempt)
+				return
+			}
+			session.db.Close()
+			session.watch.shutdown()
+		}
+		select {
+		case <-pool.done:
+			return
+		case <-time.After(retry.Delay(attempt)):
+		}
+	}
+}
+
+// restore replays the Signin and Use of the pool on a new connection.
+func (pool *SurrealPool) restore(ctx context.Context, db *surrealdb.DB) error {
+	pool.mu.Lock()
+	signin, namespace, database := pool.signin, pool.namespace, pool.database
+	pool.mu.Unlock()
+	conn := WithContext(ctx, db)
+	if signin != nil {
+		if _, err := conn.Signin(signin); err != nil {
+			return err
+		}
+	}
+	if namespace != "" {
+		if _, err := conn.Use(namespace, database); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ping checks one connection, taking it out when it does not answer.
+func (pool *SurrealPool) ping(conn *poolConn) {
+	if !atomic.CompareAndSwapInt32(&conn.pinging, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&conn.pinging, 0)
+	session := conn.acquire()
+	if session == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), poolPingTimeout)
+	defer cancel()
+	_, err := session.run(func(db *surrealdb.DB) (interface{}, error) {
+		return WithContext(ctx, db).Query("RETURN true", nil)
+	})
+	if err != nil && !isRPCError(err) {
+		pool.down(conn, session, err)
+	}
+}
+
+// check pings the idle connections every HealthInterval.
+func (pool *SurrealPool) check() {
+	ticker := time.NewTicker(pool.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.done:
+			return
+		case <-ticker.C:
+			for _, conn := range pool.conns {
+				if conn.up() && conn.idle() {
+					go pool.ping(conn)
+				}
+			}
+		}
+	}
+}
+
+// isRPCError reports whether SurrealDB answered err, so the connection
+// works. The driver keeps its RPCError type internal.
+func isRPCError(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		t := reflect.TypeOf(err)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Name() == "RPCError" && t.PkgPath() == "github.com/surrealdb/surrealdb.go/internal/websocket" {
+			return true
+		}
+	}
+	return false
+}
+
+// isTimeout reports whether err is the driver giving up on a response.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		if errors.Unwrap(err) == nil && err.Error() == "timeout" {
+			return true
+		}
+	}
+	return false
+}
+
+// unsent reports whether err kept the request from reaching SurrealDB.
+func unsent(err error) bool {
+	if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "write"
+}
+
+func (pool *SurrealPool) closed() bool {
+	select {
+	case <-pool.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Query runs sql on a connection of the pool.
+func (pool *SurrealPool) Query(sql string, vars interface{}) (interface{}, error) {
+	return pool.call(func(db *surrealdb.DB) (interface{}, error) { return db.Query(sql, vars) })
+}
+
+// Create creates a record on a connection of the pool.
+func (pool *SurrealPool) Create(thing string, data interface{}) (interface{}, error) {
+	return pool.call(func(db *surrealdb.DB) (interface{}, error) { return db.Create(thing, data) })
+}
+
+// Select selects records on a connection of the pool.
+func (pool *SurrealPool) Select(what string) (interface{}, error) {
+	return pool.call(func(db *surrealdb.DB) (interface{}, error) { return db.Select(what) })
+}
+
+// Update updates records on a connection of the pool.
+func (pool *SurrealPool) Update(what string, data interface{}) (interface{}, error) {
+	return pool.call(func(db *surrealdb.DB) (interface{}, error) { return db.Update(what, data) })
+}
+
+// Delete deletes records on a connection of the pool.
+func (pool *SurrealPool) Delete(what string) (interface{}, error) {
+	return pool.call(func(db *surrealdb.DB) (interface{}, error) { return db.Delete(what) })
+}
+
+// Signin signs every connection of the pool in with vars, and the
+// connections opened later. The connections are shared, so sign in as
+// the app, not as the user of one request.
+//
+// Returns:
+//  the result of the first connection
+//  error of the first connection that failed
+func (pool *SurrealPool) Signin(vars interface{}) (interface{}, error) {
+	pool.mu.Lock()
+	pool.signin = vars
+	pool.mu.Unlock()
+	return pool.each(func(db *surrealdb.DB) (interface{}, error) { return db.Signin(vars) })
+}
+
+// Use sets the namespace and database of every connection of the
+// pool, and of the connections opened later.
+//
+// Returns:
+//  the result of the first connection
+//  error of the first connection that failed
+func (pool *SurrealPool) Use(ns, database string) (interface{}, error) {
+	pool.mu.Lock()
+	pool.namespace, pool.database = ns, database
+	pool.mu.Unlock()
+	return pool.each(func(db *surrealdb.DB) (interface{}, error) { return db.Use(ns, database) })
+}
+
+// each runs fn on every connection that is up; the ones down get the
+// new state when they reconnect.
+func (pool *SurrealPool) each(fn func(db *surrealdb.DB) (interface{}, error)) (interface{}, error) {
+	if pool.closed() {
+		return nil, ErrPoolClosed
+	}
+	var first interface{}
+	ran := false
+	for _, conn := range pool.conns {
+		if !conn.up() {
+			continue
+		}
+		session := conn.acquire()
+		if session == nil {
+			continue
+		}
+		result, err := session.run(fn)
+		if err != nil && !isRPCError(err) {
+			pool.down(conn, session, err)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if !ran {
+			first, ran = result, true
+		}
+	}
+	if !ran {
+		return nil, ErrPoolUnavailable
+	}
+	return first, nil
+}
+
+// PoolStats is the state of a SurrealPool.
+type PoolStats struct {
+	Size    int `json:"size"`
+	Healthy int `json:"healthy"`
+	InUse   int `json:"in_use"`
+}
+
+// Stats returns the connections of the pool, those up and those
+// running a call.
+func (pool *SurrealPool) Stats() PoolStats {
+	stats := PoolStats{Size: len(pool.conns)}
+	for _, conn := range pool.conns {
+		if conn.up() {
+			stats.Healthy++
+		}
+		stats.InUse += conn.inUse()
+	}
+	return stats
+}
+
+// Usage returns the connections running a call and the pool size, the
+// Pool of a Watchdog.
+func (pool *SurrealPool) Usage() (inUse, size int) {
+	stats := pool.Stats()
+	return stats.InUse, stats.Size
+}
+
+// Close stops the health checks and reconnects and closes the
+// connections. The calls after it return ErrPoolClosed.
+func (pool *SurrealPool) Close() {
+	pool.closeOnce.Do(func() {
+		close(pool.done)
+		for _, conn := range pool.conns {
+			if atomic.CompareAndSwapInt32(&conn.healthy, 1, 0) {
+				conn.retire()
+			}
+		}
+	})
+}
+
+var _ GhostDB = (*SurrealPool)(nil)
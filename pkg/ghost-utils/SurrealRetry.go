@@ -0,0 +1,110 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// RetryConfig is the surrealdb-retry block of ghost.yaml. Setup
+// retries connecting to SurrealDB with exponential backoff: each delay
+// doubles from InitialDelay up to MaxDelay, then is spread by up to
+// Jitter (a fraction) either way so instances do not reconnect in
+// lockstep.
+//
+//  surrealdb:
+//      surrealdb-retry:
+//          max-attempts: 10
+//          initial-delay: 500ms
+//          max-delay: 10s
+//          jitter: 0.2
+type RetryConfig struct {
+	MaxAttempts  int           `yaml:"max-attempts"`
+	InitialDelay time.Duration `yaml:"initial-delay"`
+	MaxDelay     time.Duration `yaml:"max-delay"`
+	Jitter       float64       `yaml:"jitter"`
+}
+
+// Defaults applied to RetryConfig by Validate.
+const (
+	DefaultRetryAttempts     = 10
+	DefaultRetryInitialDelay = 500 * time.Millisecond
+	DefaultRetryMaxDelay     = 10 * time.Second
+	DefaultRetryJitter       = 0.2
+)
+
+// Delay returns the wait after the given failed attempt, counting
+// from 1.
+func (retry RetryConfig) Delay(attempt int) time.Duration {
+	delay := retry.InitialDelay
+	for i := 1; i < attempt && (retry.MaxDelay <= 0 || delay < retry.MaxDelay); i++ {
+		delay *= 2
+	}
+	if retry.MaxDelay > 0 && delay > retry.MaxDelay {
+		delay = retry.MaxDelay
+	}
+	if retry.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * retry.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// Do calls fn until it succeeds or MaxAttempts calls have failed,
+// sleeping Delay between attempts. A MaxAttempts below 1 calls fn
+// once.
+//
+// Example:
+//  err := ghostConfig.SurrealDB.Retry.Do(func() error {
+//      return redisClient.Ping(ctx).Err()
+//  })
+//
+// Returns:
+//  nil, or the last error of fn
+func (retry RetryConfig) Do(fn func() error) error {
+	return retry.DoContext(context.Background(), fn)
+}
+
+// DoContext is Do giving up once ctx is done, during an attempt or
+// between two.
+//
+// Returns:
+//  nil, the last error of fn, or an error wrapping ctx.Err()
+func (retry RetryConfig) DoContext(ctx context.Context, fn func() error) error {
+	attempts := retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if ctx.Err() != nil {
+			break
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			break
+		}
+		delay := retry.Delay(attempt)
+		log.Printf("retry: attempt %d/%d failed: %v, retrying in %s", attempt, attempts, err, delay.Round(time.Millisecond))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	if ctx.Err() != nil {
+		if err == nil || errors.Is(err, ctx.Err()) {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	if attempts > 1 {
+		return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+	}
+	return err
+}
@@ -0,0 +1,440 @@
+package ghostutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Sync change operations.
+const (
+	SyncUpsert = "upsert"
+	SyncDelete = "delete"
+	// SyncSchema is a change to the table definition only. It is
+	// never sent to clients, its cursor just moves past it.
+	SyncSchema = "schema"
+)
+
+// Conflict policies for uploads that change records modified on the
+// server since the client's cursor.
+const (
+	// ConflictServerWins drops the client change and returns the
+	// server record.
+	ConflictServerWins = "server-wins"
+	// ConflictClientWins applies the client change.
+	ConflictClientWins = "client-wins"
+	// ConflictReject refuses the change and reports the conflict.
+	ConflictReject = "reject"
+)
+
+// SyncChange is one entry of a table's change feed. Deletes are
+// tombstones: Data is empty and the client removes the record.
+// Cursors of the changefeed are versionstamps, which order commits
+// the way the database applied them.
+type SyncChange struct {
+	Cursor string                 `json:"cursor"`
+	Table  string                 `json:"table"`
+	ID     string                 `json:"id"`
+	Op     string                 `json:"op"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+	At     time.Time              `json:"at"`
+}
+
+// SyncLog is the ordered change feed behind Sync. Cursors are opaque
+// to clients and must sort in feed order.
+type SyncLog interface {
+	// Append records a change and returns it with its cursor.
+	Append(ctx context.Context, change SyncChange) (SyncChange, error)
+	// Since returns up to limit changes of table after cursor, which
+	// is empty for a full sync.
+	Since(ctx context.Context, table, cursor string, limit int) ([]SyncChange, error)
+	// ChangedSince reports whether a record has changed after
+	// cursor.
+	ChangedSince(ctx context.Context, table, id, cursor string) (bool, error)
+}
+
+// SyncTable configures one synced table.
+type SyncTable struct {
+	// Conflict is one of the Conflict policies, ConflictReject by
+	// default. Resolve, when set, overrides it and returns the record
+	// to store.
+	Conflict string
+	Resolve  func(server, client map[string]interface{}) (map[string]interface{}, error)
+	// Authorizer filters the feed and checks uploads. Tombstones are
+	// checked against the record as it was deleted, see
+	// SyncTombstoneMigration; those it cannot be checked against are
+	// not sent.
+	Authorizer RecordAuthorizer
+	// Model, if set, is a value of the record struct whose ghost view
+	// tags filter the fields of the feed for the caller's roles, see
+	// FilterFields.
+	Model interface{}
+}
+
+// syncTombstoneTable keeps the last state of deleted synced records.
+const syncTombstoneTable = "sync_tombstone"
+
+// SyncTombstoneMigration returns the migration, at version, keeping
+// the last state of each record deleted from tables, so Sync can
+// authorize tombstones of records deleted by any writer. It panics on
+// an invalid table name.
+//
+// Example:
+//  ghostutils.RegisterMigrations(ghostutils.SyncTombstoneMigration(12, "note", "comment"))
+func SyncTombstoneMigration(version int, tables ...string) Migration {
+	var up, down strings.Builder
+	fmt.Fprintf(&up, "DEFINE TABLE %[1]s SCHEMALESS;\nDEFINE INDEX %[1]s_record ON %[1]s FIELDS table, record;\n", syncTombstoneTable)
+	for _, table := range tables {
+		if !identifierPattern.MatchString(table) {
+			panic(fmt.Sprintf("invalid table name %q", table))
+		}
+		fmt.Fprintf(&up, "DEFINE EVENT %[1]s ON TABLE %[2]s WHEN $event = \"DELETE\" THEN (UPDATE type::thing(\"%[1]s\", [\"%[2]s\", meta::id($before.id)]) CONTENT { table: \"%[2]s\", record: <string> meta::id($before.id), data: $before, at: time::now() });\n", syncTombstoneTable, table)
+		fmt.Fprintf(&down, "REMOVE EVENT %s ON TABLE %s;\n", syncTombstoneTable, table)
+	}
+	fmt.Fprintf(&down, "REMOVE TABLE %s;\n", syncTombstoneTable)
+	return Migration{Version: version, Name: "sync tombstones", Up: up.String(), Down: down.String()}
+}
+
+// Sync serves delta sync endpoints for offline clients.
+//
+// Example:
+//  err := ghostutils.EnableChangefeed(db, "note", "30d", "SCHEMALESS")
+//  sync := &ghostutils.Sync{
+//      DB: db,
+//      Tables: map[string]ghostutils.SyncTable{
+//          "note": {Conflict: ghostutils.ConflictServerWins, Authorizer: ghostutils.OwnerAuthorizer{}, Model: Note{}},
+//      },
+//  }
+//  sync.Mount(r.Group("/api"))
+//
+// Clients call GET /sync/note?since=<cursor> until "more" is false,
+// keep the returned cursor, and upload local edits with
+// POST /sync/note {"cursor": <cursor>, "changes": [...]}.
+type Sync struct {
+	DB *surrealdb.DB
+	// Log is the change feed, the changefeed of each table by
+	// default, see ChangefeedSyncLog.
+	Log    SyncLog
+	Tables map[string]SyncTable
+	// Limit is the page size of the feed. Defaults to 500.
+	Limit int
+}
+
+// SyncConflict reports an upload that changed a record modified on
+// the server since the client's cursor.
+type SyncConflict struct {
+	ID     string                 `json:"id"`
+	Policy string                 `json:"policy"`
+	Server map[string]interface{} `json:"server,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// SyncUpload is the body of POST /sync/:table.
+type SyncUpload struct {
+	Cursor  string       `json:"cursor"`
+	Changes []SyncChange `json:"changes"`
+}
+
+// ErrUnknownSyncTable is returned for tables not configured in Sync.
+var ErrUnknownSyncTable = errors.New("table is not synced")
+
+// Mount registers GET and POST /sync/:table.
+func (s *Sync) Mount(g *gin.RouterGroup) {
+	g.GET("/sync/:table", s.pull)
+	g.POST("/sync/:table", s.push)
+}
+
+func (s *Sync) log() SyncLog {
+	if s.Log == nil {
+		return ChangefeedSyncLog{DB: s.DB}
+	}
+	return s.Log
+}
+
+func (s *Sync) limit(c *gin.Context) int {
+	limit := s.Limit
+	if limit <= 0 {
+		limit = 500
+	}
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	return limit
+}
+
+// Pull returns the changes of table visible to the caller in ctx
+// after cursor, the cursor to continue from and whether more remain.
+func (s *Sync) Pull(ctx context.Context, table, cursor string, limit int) ([]SyncChange, string, bool, error) {
+	config, ok := s.Tables[table]
+	if !ok {
+		return nil, "", false, ErrUnknownSyncTable
+	}
+	changes, err := s.log().Since(ctx, table, cursor, limit)
+	if err != nil {
+		return nil, "", false, err
+	}
+	var tombstones map[string]map[string]interface{}
+	if config.Authorizer != nil {
+		if tombstones, err = s.tombstones(table, changes); err != nil {
+			return nil, "", false, err
+		}
+	}
+	identity, _ := IdentityFrom(ctx)
+	next := cursor
+	visible := make([]SyncChange, 0, len(changes))
+	for _, change := range changes {
+		next = change.Cursor
+		if change.Op == SyncSchema {
+			continue
+		}
+		if config.Authorizer != nil {
+			record := change.Data
+			if change.Op == SyncDelete {
+				record = tombstones[change.ID]
+			}
+			if record == nil {
+				continue
+			}
+			if err := config.Authorizer.AuthorizeRead(ctx, record); err != nil {
+				continue
+			}
+		}
+		if change.Op == SyncDelete {
+			change.Data = nil
+		} else if config.Model != nil && change.Data != nil {
+			if change.Data, err = syncFields(config.Model, change.Data, identity.Roles); err != nil {
+				return nil, "", false, err
+			}
+		}
+		visible = append(visible, change)
+	}
+	return visible, next, len(changes) >= limit, nil
+}
+
+// tombstones returns the record each delete of changes removed: the
+// change's own data, the last upsert before it in changes, or the
+// state kept by SyncTombstoneMigration.
+func (s *Sync) tombstones(table string, changes []SyncChange) (map[string]map[string]interface{}, error) {
+	records := map[string]map[string]interface{}{}
+	var missing []string
+	last := map[string]map[string]interface{}{}
+	for _, change := range changes {
+		if change.Op == SyncUpsert {
+			last[change.ID] = change.Data
+		}
+		if change.Op != SyncDelete {
+			continue
+		}
+		switch {
+		case change.Data != nil:
+			records[change.ID] = change.Data
+		case last[change.ID] != nil:
+			records[change.ID] = last[change.ID]
+		default:
+			missing = append(missing, change.ID)
+		}
+		delete(last, change.ID)
+	}
+	if len(missing) == 0 {
+		return records, nil
+	}
+	rows, err := surrealQuery[struct {
+		Record string                 `json:"record"`
+		Data   map[string]interface{} `json:"data"`
+	}](s.DB, "SELECT record, data FROM type::table($log) WHERE table = $tb AND record INSIDE $ids", map[string]interface{}{
+		"log": syncTombstoneTable,
+		"tb":  table,
+		"ids": missing,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if _, ok := records[row.Record]; !ok {
+			records[row.Record] = row.Data
+		}
+	}
+	return records, nil
+}
+
+// syncFields decodes record into a value of model's type and returns
+// the fields of it the roles may view.
+func syncFields(model interface{}, record map[string]interface{}, roles []string) (map[string]interface{}, error) {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	typed := reflect.New(reflect.TypeOf(model))
+	if err := json.Unmarshal(raw, typed.Interface()); err != nil {
+		return nil, err
+	}
+	filtered, _ := FilterFields(typed.Elem().Interface(), roles).(map[string]interface{})
+	return filtered, nil
+}
+
+func (s *Sync) pull(c *gin.Context) {
+	changes, next, more, err := s.Pull(c.Request.Context(), c.Param("table"), c.Query("since"), s.limit(c))
+	if err != nil {
+		FailStatus(c, syncErrorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changes": changes, "cursor": next, "more": more})
+}
+
+// Push applies client changes to table. Changes to records modified
+// after cursor are resolved with the table's conflict policy; the
+// conflicts are returned along with the new changes written.
+func (s *Sync) Push(ctx context.Context, table string, upload SyncUpload) ([]SyncChange, []SyncConflict, error) {
+	config, ok := s.Tables[table]
+	if !ok {
+		return nil, nil, ErrUnknownSyncTable
+	}
+	policy := config.Conflict
+	if policy == "" {
+		policy = ConflictReject
+	}
+	identity, _ := IdentityFrom(ctx)
+	var (
+		applied   []SyncChange
+		conflicts []SyncConflict
+	)
+	for _, change := range upload.Changes {
+		id := strings.TrimPrefix(change.ID, table+":")
+		if id == "" || (change.Op != SyncUpsert && change.Op != SyncDelete) {
+			conflicts = append(conflicts, SyncConflict{ID: change.ID, Policy: policy, Error: "invalid change"})
+			continue
+		}
+		server, exists, err := surrealFirst[map[string]interface{}](s.DB, "SELECT * FROM type::thing($tb, $id)", map[string]interface{}{"tb": table, "id": id})
+		if err != nil {
+			return applied, conflicts, err
+		}
+		if config.Authorizer != nil {
+			existing := server
+			if !exists {
+				// a new record is authorized as it will be stamped
+				existing = make(map[string]interface{}, len(change.Data))
+				for k, v := range change.Data {
+					existing[k] = v
+				}
+				if stamper, ok := config.Authorizer.(RecordStamper); ok {
+					err = stamper.Stamp(ctx, existing)
+				}
+			}
+			if err == nil {
+				err = config.Authorizer.AuthorizeWrite(ctx, existing)
+			}
+			if err != nil {
+				conflicts = append(conflicts, SyncConflict{ID: change.ID, Policy: policy, Error: err.Error()})
+				continue
+			}
+		}
+		changed, err := s.log().ChangedSince(ctx, table, id, upload.Cursor)
+		if err != nil {
+			return applied, conflicts, err
+		}
+		// conflicts show the server record as the feed would
+		shown := server
+		if config.Model != nil && exists {
+			if shown, err = syncFields(config.Model, server, identity.Roles); err != nil {
+				return applied, conflicts, err
+			}
+		}
+		data := change.Data
+		if changed {
+			switch {
+			case config.Resolve != nil:
+				if data, err = config.Resolve(server, change.Data); err != nil {
+					conflicts = append(conflicts, SyncConflict{ID: change.ID, Policy: "resolve", Server: shown, Error: err.Error()})
+					continue
+				}
+			case policy == ConflictClientWins:
+			default:
+				conflicts = append(conflicts, SyncConflict{ID: change.ID, Policy: policy, Server: shown})
+				continue
+			}
+		}
+		written, err := s.apply(ctx, config, table, id, change.Op, data)
+		if err != nil {
+			return applied, conflicts, err
+		}
+		if config.Model != nil && written.Data != nil {
+			if written.Data, err = syncFields(config.Model, written.Data, identity.Roles); err != nil {
+				return applied, conflicts, err
+			}
+		}
+		applied = append(applied, written)
+	}
+	return applied, conflicts, nil
+}
+
+func (s *Sync) apply(ctx context.Context, config SyncTable, table, id, op string, data map[string]interface{}) (SyncChange, error) {
+	change := SyncChange{Table: table, ID: id, Op: op, At: time.Now().UTC()}
+	if op == SyncDelete {
+		if _, err := s.DB.Delete(recordID(table, id)); err != nil {
+			return change, err
+		}
+		return s.log().Append(ctx, change)
+	}
+	record := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if k != "id" {
+			record[k] = v
+		}
+	}
+	if stamper, ok := config.Authorizer.(RecordStamper); ok {
+		if err := stamper.Stamp(ctx, record); err != nil {
+			return change, err
+		}
+	}
+	res, err := s.DB.Update(recordID(table, id), record)
+	if err != nil {
+		return change, err
+	}
+	if err := surrealdb.Unmarshal(res, &change.Data); err != nil {
+		change.Data = record
+	}
+	return s.log().Append(ctx, change)
+}
+
+func (s *Sync) push(c *gin.Context) {
+	var upload SyncUpload
+	if err := c.ShouldBindJSON(&upload); err != nil {
+		FailStatus(c, http.StatusBadRequest, err)
+		return
+	}
+	applied, conflicts, err := s.Push(c.Request.Context(), c.Param("table"), upload)
+	if err != nil {
+		FailStatus(c, syncErrorStatus(err), err)
+		return
+	}
+	// server-wins conflicts are resolved, the client just takes the
+	// server record
+	status := http.StatusOK
+	for _, conflict := range conflicts {
+		if conflict.Policy != ConflictServerWins || conflict.Error != "" {
+			status = http.StatusConflict
+		}
+	}
+	c.JSON(status, gin.H{"applied": applied, "conflicts": conflicts})
+}
+
+func syncErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownSyncTable):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
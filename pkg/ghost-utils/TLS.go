@@ -0,0 +1,110 @@
+package ghostutils
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig is the `tls:` block of ghost.yaml. Run serves HTTPS on
+// the port with the certificate of cert-file and key-file, or with
+// certificates from Let's Encrypt for the hosts of autocert, and
+// redirects plain HTTP on http-port.
+//
+// Example:
+//  port: 443
+//  tls:
+//    autocert:
+//      hosts: [example.com, www.example.com]
+//      email: ops@example.com
+//
+//  tls:
+//    cert-file: /etc/ghost/tls.crt
+//    key-file: /etc/ghost/tls.key
+//    redirect: true
+type TLSConfig struct {
+	CertFile string         `yaml:"cert-file"`
+	KeyFile  string         `yaml:"key-file"`
+	Autocert AutocertConfig `yaml:"autocert"`
+	// HTTPPort serves the HTTP to HTTPS redirect and, for autocert, the
+	// ACME challenges; 80 by default.
+	HTTPPort int `yaml:"http-port"`
+	// Redirect serves the redirect with cert-file too. Autocert always
+	// serves it, as Let's Encrypt needs the port.
+	Redirect bool `yaml:"redirect"`
+}
+
+// AutocertConfig requests certificates from Let's Encrypt.
+type AutocertConfig struct {
+	// Hosts are the only names certificates are requested for.
+	Hosts []string `yaml:"hosts"`
+	Email string   `yaml:"email"`
+	// CacheDir keeps the certificates across restarts, .autocert by
+	// default. Instances behind one name should share it.
+	CacheDir string `yaml:"cache-dir"`
+}
+
+// DefaultTLSHTTPPort is the tls.http-port applied by Validate.
+const DefaultTLSHTTPPort = 80
+
+// Enabled reports whether the block serves HTTPS.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || len(t.Autocert.Hosts) > 0
+}
+
+// configure sets up server for HTTPS and returns the function serving
+// it and the plain HTTP server to run beside it, nil when there is
+// none.
+func (t TLSConfig) configure(server *http.Server) (func() error, *http.Server) {
+	httpPort := t.HTTPPort
+	if httpPort == 0 {
+		httpPort = DefaultTLSHTTPPort
+	}
+	_, port, _ := net.SplitHostPort(server.Addr)
+	redirect := httpsRedirect(port)
+	if len(t.Autocert.Hosts) > 0 {
+		cacheDir := t.Autocert.CacheDir
+		if cacheDir == "" {
+			cacheDir = ".autocert"
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(t.Autocert.Hosts...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      t.Autocert.Email,
+		}
+		server.TLSConfig = manager.TLSConfig()
+		server.TLSConfig.MinVersion = tls.VersionTLS12
+		challenges := &http.Server{Addr: fmt.Sprintf(":%d", httpPort), Handler: manager.HTTPHandler(redirect)}
+		return func() error { return server.ListenAndServeTLS("", "") }, challenges
+	}
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	serve := func() error { return server.ListenAndServeTLS(t.CertFile, t.KeyFile) }
+	if !t.Redirect {
+		return serve, nil
+	}
+	return serve, &http.Server{Addr: fmt.Sprintf(":%d", httpPort), Handler: redirect}
+}
+
+// httpsRedirect redirects requests to the same URL over HTTPS on port.
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			// keep the method and body
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
+
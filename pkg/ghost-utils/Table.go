@@ -0,0 +1,295 @@
+package ghostutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TableColumn is one column of a Table.
+type TableColumn struct {
+	// Field is the JSON field shown, dotted for nested fields.
+	Field string
+	Title string
+	// Sortable columns get a sort link in their header.
+	Sortable bool
+	// Filter, if set, adds a filter input for the column, filtering
+	// with its first operator.
+	Filter *FilterField
+	// Format renders the value of the cell. Defaults to fmt.Sprint,
+	// with nil shown empty.
+	Format func(value interface{}) string
+}
+
+// Table is a server rendered, sortable, filterable and paged list of
+// the records of a Repository. Its state lives in the query string,
+// in the filter DSL of ParseListFilter, so a table URL can be shared;
+// with htmx loaded, sorting, filtering and paging swap the table in
+// place.
+//
+// Example:
+//  users := ghostutils.NewTable("users", repo,
+//      ghostutils.TableColumn{Field: "name", Title: "Name", Sortable: true,
+//          Filter: &ghostutils.FilterField{Ops: []string{ghostutils.FilterContains}}},
+//      ghostutils.TableColumn{Field: "created_at", Title: "Joined", Sortable: true},
+//  )
+//  users.DefaultSort = "-created_at"
+//  r.SetFuncMap(ghostutils.TableFuncMap())
+//  r.GET("/admin/users", users.Handler("admin/users.html"))
+//
+//  // admin/users.html: {{table .Table}}
+type Table[T any] struct {
+	Name       string
+	Repository *Repository[T]
+	Columns    []TableColumn
+	// DefaultSort is used without ?sort=, e.g. "-created_at".
+	DefaultSort string
+	// PerPage and MaxPerPage bound ?per_page=. Default to 20 and 100.
+	PerPage    int
+	MaxPerPage int
+	// RowURL, if set, links the first cell of each row to the URL it
+	// returns for the id of the record.
+	RowURL func(id string) string
+}
+
+// NewTable returns a table called name, which is also the id of its
+// element.
+func NewTable[T any](name string, repo *Repository[T], columns ...TableColumn) *Table[T] {
+	return &Table[T]{Name: name, Repository: repo, Columns: columns}
+}
+
+// Rules returns the FilterRules allowed by the columns.
+func (t *Table[T]) Rules() FilterRules {
+	rules := FilterRules{Fields: map[string]FilterField{}, DefaultSort: t.DefaultSort}
+	for _, column := range t.Columns {
+		if column.Sortable {
+			rules.Sort = append(rules.Sort, column.Field)
+		}
+		if column.Filter != nil {
+			rules.Fields[column.Field] = *column.Filter
+		}
+	}
+	return rules
+}
+
+// TableView is a Table loaded for a request, as passed to templates.
+type TableView struct {
+	Name       string
+	URL        string
+	Headers    []TableHeader
+	Rows       []TableRow
+	Pagination Pagination
+	// Hidden are the query parameters the filter form keeps, such as
+	// the sort.
+	Hidden map[string]string
+}
+
+// TableHeader is the header of a column.
+type TableHeader struct {
+	Title    string
+	Sortable bool
+	SortURL  string
+	// Sorted is "asc" or "desc" for the column the table is sorted by.
+	Sorted string
+	// FilterParam is the query parameter of the filter input, empty
+	// when the column cannot be filtered.
+	FilterParam string
+	FilterValue string
+}
+
+// TableRow is one record of a TableView.
+type TableRow struct {
+	ID    string
+	URL   string
+	Cells []string
+}
+
+// Load runs the query for the request.
+//
+// Returns:
+//  TableView
+//  error, a *FilterError for invalid query parameters
+func (t *Table[T]) Load(c *gin.Context) (TableView, error) {
+	query := c.Request.URL.Query()
+	for param, values := range query {
+		// empty filter inputs are submitted too, and mean no filter
+		if strings.HasPrefix(param, "filter[") && len(values) == 1 && values[0] == "" {
+			query.Del(param)
+		}
+	}
+	filter, err := ParseListFilter(query, t.Rules())
+	if err != nil {
+		return TableView{}, err
+	}
+	perPage, maxPerPage := t.PerPage, t.MaxPerPage
+	if perPage <= 0 {
+		perPage = 20
+	}
+	if maxPerPage <= 0 {
+		maxPerPage = 100
+	}
+	number, size := PageParams(c, perPage, maxPerPage)
+	page, err := t.Repository.Page(c, number, size, filter)
+	if err != nil {
+		return TableView{}, err
+	}
+	view := TableView{
+		Name:       t.Name,
+		URL:        c.Request.URL.Path,
+		Pagination: page.Pagination(c.Request.URL),
+		Hidden:     map[string]string{},
+	}
+	if sort := query.Get("sort"); sort != "" {
+		view.Hidden["sort"] = sort
+	}
+	if perPageParam := query.Get("per_page"); perPageParam != "" {
+		view.Hidden["per_page"] = perPageParam
+	}
+	for _, column := range t.Columns {
+		header := TableHeader{Title: column.Title, Sortable: column.Sortable}
+		if header.Title == "" {
+			header.Title = column.Field
+		}
+		if column.Sortable {
+			next := column.Field
+			if len(filter.Sort) > 0 && filter.Sort[0].Field == column.Field {
+				header.Sorted, next = "asc", "-"+column.Field
+				if filter.Sort[0].Desc {
+					header.Sorted, next = "desc", column.Field
+				}
+			}
+			header.SortURL = tableURL(c.Request.URL, "sort", next)
+		}
+		if column.Filter != nil {
+			header.FilterParam = tableFilterParam(column)
+			header.FilterValue = query.Get(header.FilterParam)
+		}
+		view.Headers = append(view.Headers, header)
+	}
+	for _, record := range page.Items {
+		fields, err := recordFields(record)
+		if err != nil {
+			return TableView{}, err
+		}
+		row := TableRow{ID: fmt.Sprint(fields["id"])}
+		if t.RowURL != nil {
+			row.URL = t.RowURL(row.ID)
+		}
+		for _, column := range t.Columns {
+			value := tableValue(fields, column.Field)
+			switch {
+			case column.Format != nil:
+				row.Cells = append(row.Cells, column.Format(value))
+			case value == nil:
+				row.Cells = append(row.Cells, "")
+			default:
+				row.Cells = append(row.Cells, fmt.Sprint(value))
+			}
+		}
+		view.Rows = append(view.Rows, row)
+	}
+	return view, nil
+}
+
+func tableFilterParam(column TableColumn) string {
+	if len(column.Filter.Ops) == 0 || column.Filter.Ops[0] == FilterEq {
+		return "filter[" + column.Field + "]"
+	}
+	return "filter[" + column.Field + "][" + column.Filter.Ops[0] + "]"
+}
+
+// tableURL returns u with param set to value and the page reset.
+func tableURL(u *url.URL, param, value string) string {
+	query := u.Query()
+	query.Set(param, value)
+	query.Del("page")
+	target := *u
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+func tableValue(fields map[string]interface{}, field string) interface{} {
+	var value interface{} = fields
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// Handler serves the table. Full page requests render page with the
+// TableView as "Table"; htmx requests, marked by HX-Request, get the
+// table element alone and push its URL, so the back button returns to
+// the previous sort and page. Invalid query parameters answer 400.
+func (t *Table[T]) Handler(page string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		view, err := t.Load(c)
+		if err != nil {
+			code := crudErrorStatus(err)
+			var filterErr *FilterError
+			if errors.As(err, &filterErr) {
+				code = http.StatusBadRequest
+			}
+			FailStatus(c, code, err)
+			return
+		}
+		varyHTMX(c)
+		if WantsFragment(c) {
+			body, err := renderTable(view)
+			if err != nil {
+				Fail(c, err)
+				return
+			}
+			HTMX(c).PushURL(c.Request.URL.RequestURI())
+			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(body))
+			return
+		}
+		HTML(c, http.StatusOK, page, gin.H{"Table": view})
+	}
+}
+
+// TableFuncMap returns the template helper rendering a TableView, with
+// the pagination helper it uses. Add it before loading the templates.
+//
+// Example:
+//  r.SetFuncMap(ghostutils.TableFuncMap())
+//  r.LoadHTMLGlob(ghostConfig.Views + "/**/*")
+func TableFuncMap() template.FuncMap {
+	funcs := PaginationFuncMap()
+	funcs["table"] = renderTable
+	return funcs
+}
+
+func renderTable(view TableView) (template.HTML, error) {
+	var out bytes.Buffer
+	if err := tableTemplate.Execute(&out, view); err != nil {
+		return "", err
+	}
+	return template.HTML(out.String()), nil
+}
+
+var tableTemplate = template.Must(template.New("table").Funcs(PaginationFuncMap()).Parse(`<div id="{{.Name}}" class="ghost-table" hx-boost="true" hx-target="this" hx-swap="outerHTML">
+<form class="ghost-table-filters" action="{{.URL}}" method="get" hx-get="{{.URL}}" hx-trigger="submit, input changed delay:300ms" hx-push-url="true">
+{{range $name, $value := .Hidden}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<table>
+<thead>
+<tr>{{range .Headers}}<th{{if .Sorted}} aria-sort="{{if eq .Sorted "asc"}}ascending{{else}}descending{{end}}"{{end}}>{{if .Sortable}}<a href="{{.SortURL}}">{{.Title}}{{if eq .Sorted "asc"}} &uarr;{{else if eq .Sorted "desc"}} &darr;{{end}}</a>{{else}}{{.Title}}{{end}}</th>{{end}}</tr>
+<tr class="ghost-table-filter-row">{{range .Headers}}<th>{{if .FilterParam}}<input type="search" name="{{.FilterParam}}" value="{{.FilterValue}}" aria-label="Filter {{.Title}}">{{end}}</th>{{end}}</tr>
+</thead>
+<tbody>
+{{range .Rows}}<tr data-id="{{.ID}}">{{$url := .URL}}{{range $i, $cell := .Cells}}<td>{{if and $url (not $i)}}<a href="{{$url}}" hx-boost="false">{{$cell}}</a>{{else}}{{$cell}}{{end}}</td>{{end}}</tr>
+{{else}}<tr><td colspan="{{len .Headers}}">No results</td></tr>
+{{end}}</tbody>
+</table>
+</form>
+{{pagination .Pagination}}
+</div>`))
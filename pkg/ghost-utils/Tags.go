@@ -0,0 +1,680 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Defaults of Tags.
+const (
+	DefaultTagTable = "tag"
+	DefaultTagEdge  = "tagged"
+	// DefaultTagPath is the graph path FilterTagged conditions compare
+	// when their FilterField has no Path.
+	DefaultTagPath = "->tagged->tag.slug"
+)
+
+// Tag errors, answered 404 and 422 by Fail.
+var (
+	ErrTagNotFound = errors.New("tag not found")
+	ErrTagInvalid  = errors.New("invalid tag")
+)
+
+// TagSchema defines the tables used by Tags with the default tables.
+// Run it once, or ship it as a migration. The id of a tag is its slug
+// and records are related to their tags by tagged edges, so
+//  SELECT ->tagged->tag.name AS tags FROM post:42
+//  SELECT <-tagged<-post AS posts FROM tag:surrealdb
+// walk the graph both ways.
+const TagSchema = `
+DEFINE TABLE tag SCHEMALESS;
+DEFINE FIELD name ON tag TYPE string;
+DEFINE FIELD slug ON tag TYPE string;
+DEFINE FIELD created_at ON tag TYPE datetime;
+DEFINE TABLE tagged SCHEMALESS;
+DEFINE INDEX tagged_pair ON tagged FIELDS in, out UNIQUE;
+DEFINE INDEX tagged_out ON tagged FIELDS out;
+`
+
+// Tag is a tag, with the number of records it is on when returned by
+// Popular.
+type Tag struct {
+	ID        string    `json:"id,omitempty"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	Count     int       `json:"count,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Tags tags records of any table, keeping the tags in their own table
+// related to the records by edges rather than in string arrays on
+// each record.
+//
+// Example:
+//  tags := &ghostutils.Tags{DB: db}
+//  _, err := tags.Set(c, post.ID, "Go", "SurrealDB")
+//
+//  // posts tagged go, as ?filter[tags][tagged]=go does with the rules
+//  posts, err := repo.List(c, tags.Filter("go"))
+type Tags struct {
+	DB *surrealdb.DB
+	// Table and Edge default to DefaultTagTable and DefaultTagEdge.
+	Table string
+	Edge  string
+	// Tables are the tables that may be tagged, any when empty.
+	Tables []string
+	// MaxTags bounds the tags of one record, unbounded when zero.
+	MaxTags int
+}
+
+// EnsureSchema runs TagSchema against the database.
+func (t *Tags) EnsureSchema() error {
+	schema := TagSchema
+	if table := t.table(); table != DefaultTagTable {
+		schema = strings.ReplaceAll(schema, "ON tag ", "ON "+table+" ")
+		schema = strings.ReplaceAll(schema, "TABLE tag ", "TABLE "+table+" ")
+	}
+	if edge := t.edge(); edge != DefaultTagEdge {
+		schema = strings.ReplaceAll(schema, "tagged", edge)
+	}
+	_, err := t.DB.Query(schema, map[string]interface{}{})
+	return err
+}
+
+func (t *Tags) table() string {
+	if t.Table == "" {
+		return DefaultTagTable
+	}
+	return t.Table
+}
+
+func (t *Tags) edge() string {
+	if t.Edge == "" {
+		return DefaultTagEdge
+	}
+	return t.Edge
+}
+
+// path returns the graph path from a record to the slugs of its tags.
+func (t *Tags) path() string {
+	return "->" + t.edge() + "->" + t.table() + ".slug"
+}
+
+// check rejects table names that cannot be put in the query text.
+func (t *Tags) check() error {
+	for _, name := range []string{t.table(), t.edge()} {
+		if !identifierPattern.MatchString(name) || strings.Contains(name, ".") {
+			return fmt.Errorf("invalid table name %q", name)
+		}
+	}
+	return nil
+}
+
+// taggable splits record into its table and id, checking the table
+// may be tagged.
+func (t *Tags) taggable(record string) (string, string, error) {
+	table, id := splitRecordID(record, "")
+	if table == "" || id == "" || !identifierPattern.MatchString(table) {
+		return "", "", ErrTagInvalid
+	}
+	if len(t.Tables) > 0 && !containsString(t.Tables, table) {
+		return "", "", ErrTagInvalid
+	}
+	return table, id, nil
+}
+
+// slugs returns the distinct slugs of names, with the name first
+// given for each.
+func slugs(names []string) ([]string, map[string]string, error) {
+	var order []string
+	byslug := map[string]string{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		slug := Sluggify(name)
+		if slug == "" {
+			return nil, nil, ErrTagInvalid
+		}
+		if _, seen := byslug[slug]; !seen {
+			byslug[slug] = name
+			order = append(order, slug)
+		}
+	}
+	return order, byslug, nil
+}
+
+// Ensure creates the tags of names that do not exist yet, keeping the
+// name of those that do.
+//
+// Returns:
+//  []Tag in the order of names, without duplicates
+//  error, ErrTagInvalid for a name without letters or digits
+func (t *Tags) Ensure(ctx context.Context, names ...string) ([]Tag, error) {
+	order, byslug, err := slugs(names)
+	if err != nil || len(order) == 0 {
+		return nil, err
+	}
+	sql := make([]string, len(order))
+	vars := map[string]interface{}{"tb": t.table()}
+	for i, slug := range order {
+		// UPDATE creates missing records, ?? keeps existing values
+		sql[i] = fmt.Sprintf("UPDATE type::thing($tb, $slug%d) SET slug = $slug%d, name = name ?? $name%d, created_at = created_at ?? time::now() RETURN AFTER", i, i, i)
+		vars[fmt.Sprintf("slug%d", i)] = slug
+		vars[fmt.Sprintf("name%d", i)] = byslug[slug]
+	}
+	statements, err := surrealStatements(t.DB, strings.Join(sql, ";\n"), vars)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]Tag, 0, len(order))
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return nil, fmt.Errorf("tags: %s", statement.Detail)
+		}
+		var rows []Tag
+		if err := surrealdb.Unmarshal(statement.Result, &rows); err != nil {
+			return nil, err
+		}
+		tags = append(tags, rows...)
+	}
+	return tags, nil
+}
+
+// Get returns the tag with slug, or ErrTagNotFound.
+func (t *Tags) Get(ctx context.Context, slug string) (Tag, error) {
+	tag, ok, err := surrealFirst[Tag](t.DB, "SELECT * FROM type::thing($tb, $slug)", map[string]interface{}{
+		"tb":   t.table(),
+		"slug": Sluggify(slug),
+	})
+	if err == nil && !ok {
+		err = ErrTagNotFound
+	}
+	return tag, err
+}
+
+// Add tags record, a record id, with names, creating the missing tags.
+func (t *Tags) Add(ctx context.Context, record string, names ...string) ([]Tag, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	table, id, err := t.taggable(record)
+	if err != nil {
+		return nil, err
+	}
+	if t.MaxTags > 0 {
+		current, err := t.For(ctx, record)
+		if err != nil {
+			return nil, err
+		}
+		order, _, err := slugs(names)
+		if err != nil {
+			return nil, err
+		}
+		have := map[string]bool{}
+		for _, tag := range current {
+			have[tag.Slug] = true
+		}
+		total := len(current)
+		for _, slug := range order {
+			if !have[slug] {
+				total++
+			}
+		}
+		if total > t.MaxTags {
+			return nil, ErrTagInvalid
+		}
+	}
+	tags, err := t.Ensure(ctx, names...)
+	if err != nil || len(tags) == 0 {
+		return tags, err
+	}
+	sql := []string{"LET $record = type::thing($record_tb, $record_id)"}
+	vars := map[string]interface{}{"record_tb": table, "record_id": id, "tb": t.table()}
+	for i, tag := range tags {
+		// records already tagged keep their edge
+		sql = append(sql, fmt.Sprintf("IF (SELECT id FROM %s WHERE in = $record AND out = type::thing($tb, $slug%d)) = [] { RELATE $record->%s->(type::thing($tb, $slug%d)) SET created_at = time::now() }", t.edge(), i, t.edge(), i))
+		vars[fmt.Sprintf("slug%d", i)] = tag.Slug
+	}
+	if err := t.run(strings.Join(sql, ";\n"), vars); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// Remove removes the tags of names from record. Tags the record does
+// not have are skipped.
+func (t *Tags) Remove(ctx context.Context, record string, names ...string) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	table, id, err := t.taggable(record)
+	if err != nil {
+		return err
+	}
+	order, _, err := slugs(names)
+	if err != nil || len(order) == 0 {
+		return err
+	}
+	return t.run("DELETE "+t.edge()+" WHERE in = type::thing($record_tb, $record_id) AND out.slug INSIDE $slugs", map[string]interface{}{
+		"record_tb": table,
+		"record_id": id,
+		"slugs":     order,
+	})
+}
+
+// Set replaces the tags of record by names.
+//
+// Returns:
+//  []Tag of the record
+//  error, ErrTagInvalid for more tags than MaxTags
+func (t *Tags) Set(ctx context.Context, record string, names ...string) ([]Tag, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	table, id, err := t.taggable(record)
+	if err != nil {
+		return nil, err
+	}
+	order, _, err := slugs(names)
+	if err != nil {
+		return nil, err
+	}
+	if t.MaxTags > 0 && len(order) > t.MaxTags {
+		return nil, ErrTagInvalid
+	}
+	err = t.run("DELETE "+t.edge()+" WHERE in = type::thing($record_tb, $record_id) AND out.slug NOTINSIDE $slugs", map[string]interface{}{
+		"record_tb": table,
+		"record_id": id,
+		"slugs":     order,
+	})
+	if err != nil || len(order) == 0 {
+		return []Tag{}, err
+	}
+	return t.Add(ctx, record, names...)
+}
+
+// For returns the tags of record, sorted by name.
+func (t *Tags) For(ctx context.Context, record string) ([]Tag, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	table, id, err := t.taggable(record)
+	if err != nil {
+		return nil, err
+	}
+	return surrealQuery[Tag](t.DB, "SELECT * FROM (SELECT VALUE out FROM "+t.edge()+" WHERE in = type::thing($record_tb, $record_id)) ORDER BY name", map[string]interface{}{
+		"record_tb": table,
+		"record_id": id,
+	})
+}
+
+// Records returns the ids of the records tagged slug, of table unless
+// it is empty, the most recently tagged first.
+func (t *Tags) Records(ctx context.Context, slug, table string, limit int) ([]string, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	sql := "SELECT in, created_at FROM " + t.edge() + " WHERE out = type::thing($tb, $slug)"
+	if table != "" {
+		sql += " AND meta::tb(in) = $table"
+	}
+	rows, err := surrealQuery[struct {
+		In string `json:"in"`
+	}](t.DB, sql+" ORDER BY created_at DESC LIMIT $limit", map[string]interface{}{
+		"tb":    t.table(),
+		"slug":  Sluggify(slug),
+		"table": table,
+		"limit": limit,
+	})
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row.In
+	}
+	return ids, err
+}
+
+// Popular returns the limit most used tags, on records of table unless
+// it is empty, with their Count.
+//
+// Example:
+//  cloud, err := tags.Popular(c, "post", 30)
+func (t *Tags) Popular(ctx context.Context, table string, limit int) ([]Tag, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 20
+	}
+	sql := "SELECT out, count() AS count FROM " + t.edge()
+	if table != "" {
+		sql += " WHERE meta::tb(in) = $table"
+	}
+	rows, err := surrealQuery[struct {
+		Out   Tag `json:"out"`
+		Count int `json:"count"`
+	}](t.DB, sql+" GROUP BY out ORDER BY count DESC LIMIT $limit FETCH out", map[string]interface{}{
+		"table": table,
+		"limit": limit,
+	})
+	tags := make([]Tag, len(rows))
+	for i, row := range rows {
+		tags[i] = row.Out
+		tags[i].Count = row.Count
+	}
+	return tags, err
+}
+
+// Merge moves the records tagged with the from slugs to the tag into,
+// created as needed, and deletes the from tags.
+func (t *Tags) Merge(ctx context.Context, into string, from ...string) (Tag, error) {
+	if err := t.check(); err != nil {
+		return Tag{}, err
+	}
+	tags, err := t.Ensure(ctx, into)
+	if err != nil {
+		return Tag{}, err
+	}
+	target := tags[0]
+	var sources []string
+	for _, slug := range from {
+		if slug = Sluggify(slug); slug != "" && slug != target.Slug {
+			sources = append(sources, slug)
+		}
+	}
+	if len(sources) == 0 {
+		return target, nil
+	}
+	edges, err := surrealQuery[struct {
+		In string `json:"in"`
+	}](t.DB, "SELECT in FROM "+t.edge()+" WHERE out.slug INSIDE $sources AND in NOTINSIDE (SELECT VALUE in FROM "+t.edge()+" WHERE out = type::thing($tb, $into))", map[string]interface{}{
+		"tb":      t.table(),
+		"into":    target.Slug,
+		"sources": sources,
+	})
+	if err != nil {
+		return target, err
+	}
+	err = WithTransaction(t.DB, func(tx *Tx) error {
+		seen := map[string]bool{}
+		for _, edge := range edges {
+			if seen[edge.In] {
+				continue
+			}
+			seen[edge.In] = true
+			table, id := splitRecordID(edge.In, "")
+			tx.Query("RELATE (type::thing($record_tb, $record_id))->"+t.edge()+"->(type::thing($tb, $into)) SET created_at = time::now()", map[string]interface{}{
+				"record_tb": table,
+				"record_id": id,
+				"tb":        t.table(),
+				"into":      target.Slug,
+			})
+		}
+		vars := map[string]interface{}{"tb": t.table(), "sources": sources}
+		tx.Query("DELETE "+t.edge()+" WHERE out.slug INSIDE $sources", vars)
+		tx.Query("DELETE type::table($tb) WHERE slug INSIDE $sources", vars)
+		return nil
+	})
+	return target, err
+}
+
+// Rename gives the tag slug the name name. A name with another slug
+// moves the records to the tag of that slug, merging the two when it
+// exists.
+func (t *Tags) Rename(ctx context.Context, slug, name string) (Tag, error) {
+	tag, err := t.Get(ctx, slug)
+	if err != nil {
+		return tag, err
+	}
+	name = strings.TrimSpace(name)
+	renamed := Sluggify(name)
+	if renamed == "" {
+		return tag, ErrTagInvalid
+	}
+	if renamed != tag.Slug {
+		if _, err := t.Ensure(ctx, name); err != nil {
+			return tag, err
+		}
+		if _, err := t.Merge(ctx, renamed, tag.Slug); err != nil {
+			return tag, err
+		}
+	}
+	renamedTag, ok, err := surrealFirst[Tag](t.DB, "UPDATE type::thing($tb, $slug) SET name = $name RETURN AFTER", map[string]interface{}{
+		"tb":   t.table(),
+		"slug": renamed,
+		"name": name,
+	})
+	if err == nil && !ok {
+		err = ErrTagNotFound
+	}
+	return renamedTag, err
+}
+
+// Delete removes the tag slug from every record and deletes it.
+func (t *Tags) Delete(ctx context.Context, slug string) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	if _, err := t.Get(ctx, slug); err != nil {
+		return err
+	}
+	return WithTransaction(t.DB, func(tx *Tx) error {
+		vars := map[string]interface{}{"tb": t.table(), "slug": Sluggify(slug)}
+		tx.Query("DELETE "+t.edge()+" WHERE out = type::thing($tb, $slug)", vars)
+		tx.Query("DELETE type::thing($tb, $slug)", vars)
+		return nil
+	})
+}
+
+// run runs statements, returning the first that failed.
+func (t *Tags) run(sql string, vars map[string]interface{}) error {
+	statements, err := surrealStatements(t.DB, sql, vars)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if statement.Status != "OK" {
+			return fmt.Errorf("tags: %s", statement.Detail)
+		}
+	}
+	return nil
+}
+
+// Filter returns the ListFilter matching the records tagged with every
+// one of slugs, for Repository.List and SelectQuery.Filter.
+func (t *Tags) Filter(slugs ...string) ListFilter {
+	values := make([]interface{}, 0, len(slugs))
+	for _, slug := range slugs {
+		values = append(values, Sluggify(slug))
+	}
+	return ListFilter{Conditions: []FilterCondition{{Field: t.path(), Op: FilterTagged, Value: values}}}
+}
+
+// FilterField returns the FilterField allowing ?filter[tags][tagged]=
+// with the tags of t, for FilterRules.
+//
+// Example:
+//  rules := ghostutils.FilterRules{
+//      Fields: map[string]ghostutils.FilterField{
+//          "tags": tags.FilterField(),
+//      },
+//  }
+func (t *Tags) FilterField() FilterField {
+	return FilterField{Ops: []string{FilterTagged}, Path: t.path()}
+}
+
+// Mount registers the endpoints of the tags on g:
+//  GET    /                 the popular tags, ?table= and ?limit=
+//  GET    /on/:record       the tags of a record
+//  PUT    /on/:record       replace the tags of a record with names
+//  POST   /on/:record       add names to the tags of a record
+//  DELETE /on/:record/:tag  remove a tag from a record
+//  GET    /:tag             a tag, with the records tagged, ?table=
+//  PATCH  /:tag             rename a tag
+//  POST   /:tag/merge       merge the tags of from into a tag
+//  DELETE /:tag             delete a tag
+// Changing the tags of a record requires authorize to allow it, and
+// changing tags admin.
+func (t *Tags) Mount(g *gin.RouterGroup, authorize func(c *gin.Context, record string) error, admin func(c *gin.Context) bool) {
+	api := &tagsAPI{tags: t, authorize: authorize, admin: admin}
+	g.GET("", api.popular)
+	g.GET("/on/:record", api.record)
+	g.PUT("/on/:record", api.write, api.set)
+	g.POST("/on/:record", api.write, api.add)
+	g.DELETE("/on/:record/:tag", api.write, api.remove)
+	g.GET("/:tag", api.get)
+	g.PATCH("/:tag", api.requireAdmin, api.rename)
+	g.POST("/:tag/merge", api.requireAdmin, api.merge)
+	g.DELETE("/:tag", api.requireAdmin, api.delete)
+}
+
+type tagsAPI struct {
+	tags      *Tags
+	authorize func(c *gin.Context, record string) error
+	admin     func(c *gin.Context) bool
+}
+
+func (api *tagsAPI) requireAdmin(c *gin.Context) {
+	if api.admin == nil || !api.admin(c) {
+		Fail(c, ErrForbidden)
+	}
+}
+
+// write lets the callers authorize allows change the tags of record.
+func (api *tagsAPI) write(c *gin.Context) {
+	if _, ok := CurrentIdentity(c); !ok {
+		Fail(c, ErrUnauthenticated)
+		return
+	}
+	if api.authorize == nil {
+		Fail(c, ErrForbidden)
+		return
+	}
+	if err := api.authorize(c, c.Param("record")); err != nil {
+		Fail(c, err)
+	}
+}
+
+func (api *tagsAPI) popular(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit > 100 {
+		limit = 100
+	}
+	tags, err := api.tags.Popular(c.Request.Context(), c.Query("table"), limit)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, tags)
+}
+
+func (api *tagsAPI) record(c *gin.Context) {
+	tags, err := api.tags.For(c.Request.Context(), c.Param("record"))
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, tags)
+}
+
+type tagNames struct {
+	Names []string `json:"names" form:"names"`
+}
+
+func (api *tagsAPI) set(c *gin.Context) {
+	body, ok := BindOrAbort[tagNames](c)
+	if !ok {
+		return
+	}
+	tags, err := api.tags.Set(c.Request.Context(), c.Param("record"), body.Names...)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, tags)
+}
+
+func (api *tagsAPI) add(c *gin.Context) {
+	body, ok := BindOrAbort[tagNames](c)
+	if !ok {
+		return
+	}
+	if _, err := api.tags.Add(c.Request.Context(), c.Param("record"), body.Names...); err != nil {
+		Fail(c, err)
+		return
+	}
+	api.record(c)
+}
+
+func (api *tagsAPI) remove(c *gin.Context) {
+	if err := api.tags.Remove(c.Request.Context(), c.Param("record"), c.Param("tag")); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (api *tagsAPI) get(c *gin.Context) {
+	tag, err := api.tags.Get(c.Request.Context(), c.Param("tag"))
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	records, err := api.tags.Records(c.Request.Context(), tag.Slug, c.Query("table"), 100)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, gin.H{"tag": tag, "records": records})
+}
+
+func (api *tagsAPI) rename(c *gin.Context) {
+	body, ok := BindOrAbort[struct {
+		Name string `json:"name" form:"name" binding:"required"`
+	}](c)
+	if !ok {
+		return
+	}
+	tag, err := api.tags.Rename(c.Request.Context(), c.Param("tag"), body.Name)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, tag)
+}
+
+func (api *tagsAPI) merge(c *gin.Context) {
+	body, ok := BindOrAbort[struct {
+		From []string `json:"from" form:"from" binding:"required"`
+	}](c)
+	if !ok {
+		return
+	}
+	if _, err := api.tags.Get(c.Request.Context(), c.Param("tag")); err != nil {
+		Fail(c, err)
+		return
+	}
+	tag, err := api.tags.Merge(c.Request.Context(), c.Param("tag"), body.From...)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	OK(c, tag)
+}
+
+func (api *tagsAPI) delete(c *gin.Context) {
+	if err := api.tags.Delete(c.Request.Context(), c.Param("tag")); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
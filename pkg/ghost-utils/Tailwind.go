@@ -0,0 +1,193 @@
+package ghostutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// TailwindConfig is the `tailwindcss:` block of ghost.yaml. With
+// watch set Setup rebuilds the CSS on change in gin's debug mode, see
+// Tailwind.
+//
+// Example:
+//  tailwindcss:
+//    input: src/css/app.css
+//    output: static/app.css
+//    version: 3.4.17
+//    watch: true
+type TailwindConfig struct {
+	Input  string `yaml:"input"`
+	Output string `yaml:"output"`
+	// Binary is the tailwindcss executable. Without one the one on the
+	// PATH is used, else the standalone CLI of Version is downloaded
+	// into the user cache directory.
+	Binary string `yaml:"binary"`
+	// Version of the downloaded CLI, the latest release by default.
+	Version string `yaml:"version"`
+	Minify  bool   `yaml:"minify"`
+	// Watch makes Setup rebuild the CSS on change in gin's debug mode.
+	Watch bool `yaml:"watch"`
+}
+
+// Tailwind runs the tailwindcss CLI for the tailwindcss block.
+type Tailwind struct {
+	Config TailwindConfig
+	// Stdout and Stderr receive the output of the CLI, os.Stderr by
+	// default.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Tailwind returns the runner of the tailwindcss block.
+//
+// Example:
+//  if err := ghostConfig.Tailwind().Build(); err != nil {
+//      log.Fatal(err)
+//  }
+func (ghostConfig GhostConfig) Tailwind() *Tailwind {
+	return &Tailwind{Config: ghostConfig.TailwindCSS}
+}
+
+// Build builds the output CSS once, minified when minify is set.
+func (t *Tailwind) Build() error {
+	return t.run(context.Background(), false)
+}
+
+// Watch rebuilds the output CSS whenever a source changes, until ctx
+// is done.
+//
+// Example:
+//  ctx, cancel := context.WithCancel(context.Background())
+//  defer cancel()
+//  go ghostConfig.Tailwind().Watch(ctx)
+func (t *Tailwind) Watch(ctx context.Context) error {
+	return t.run(ctx, true)
+}
+
+func (t *Tailwind) run(ctx context.Context, watch bool) error {
+	if t.Config.Input == "" || t.Config.Output == "" {
+		return fmt.Errorf("tailwindcss.input and tailwindcss.output are required")
+	}
+	binary, err := t.binary(ctx)
+	if err != nil {
+		return err
+	}
+	args := []string{"-i", t.Config.Input, "-o", t.Config.Output}
+	if t.Config.Minify {
+		args = append(args, "--minify")
+	}
+	if watch {
+		args = append(args, "--watch")
+	}
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout, cmd.Stderr = t.Stdout, t.Stderr
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stderr
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if !watch {
+		return cmd.Run()
+	}
+	// the CLI stops watching when its stdin closes, so it is kept open
+	// until ctx is done
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// binary returns the CLI to run, downloading it when there is none.
+func (t *Tailwind) binary(ctx context.Context) (string, error) {
+	if t.Config.Binary != "" {
+		return t.Config.Binary, nil
+	}
+	if found, err := exec.LookPath("tailwindcss"); err == nil {
+		return found, nil
+	}
+	version := t.Config.Version
+	if version == "" {
+		version = "latest"
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	asset, err := tailwindAsset()
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(cache, "ghost", "tailwindcss-"+version, asset)
+	if _, err := os.Stat(target); err == nil {
+		// downloaded once, the latest release too, not on every run
+		return target, nil
+	}
+	url := "https://github.com/tailwindlabs/tailwindcss/releases/latest/download/" + asset
+	if version != "latest" {
+		url = "https://github.com/tailwindlabs/tailwindcss/releases/download/v" + version + "/" + asset
+	}
+	return target, downloadExecutable(ctx, url, target)
+}
+
+// tailwindAsset returns the name of the standalone CLI of the platform.
+func tailwindAsset() (string, error) {
+	platform := map[string]string{"linux": "linux", "darwin": "macos", "windows": "windows"}[runtime.GOOS]
+	arch := map[string]string{"amd64": "x64", "arm64": "arm64"}[runtime.GOARCH]
+	if platform == "" || arch == "" {
+		return "", fmt.Errorf("no tailwindcss CLI for %s/%s, set tailwindcss.binary", runtime.GOOS, runtime.GOARCH)
+	}
+	asset := "tailwindcss-" + platform + "-" + arch
+	if platform == "windows" {
+		asset += ".exe"
+	}
+	return asset, nil
+}
+
+// downloadExecutable saves the file at url as the executable target.
+func downloadExecutable(ctx context.Context, url, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", url, resp.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	// written next to the target and renamed, so an interrupted download
+	// is never run
+	file, err := os.CreateTemp(filepath.Dir(target), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), target)
+}
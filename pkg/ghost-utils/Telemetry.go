@@ -0,0 +1,195 @@
+package ghostutils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TelemetryConfig is the `telemetry:` block of ghost.yaml. When
+// Enabled, Setup exports traces over OTLP/HTTP: a span per request,
+// with child spans for the Repository and query builder calls made
+// with its context.
+//
+// Example:
+//  telemetry:
+//    enabled: true
+//    endpoint: otel-collector:4318
+//    insecure: true
+//    sample-rate: 0.1
+type TelemetryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ServiceName defaults to the name of the config.
+	ServiceName string `yaml:"service-name"`
+	// Endpoint is the host:port of the collector, or of
+	// OTEL_EXPORTER_OTLP_ENDPOINT when empty.
+	Endpoint string            `yaml:"endpoint"`
+	Insecure bool              `yaml:"insecure"`
+	Headers  map[string]string `yaml:"headers"`
+	// SampleRate is the fraction of traces started here that are
+	// kept, 1 by default. Traces started upstream keep their decision.
+	SampleRate float64 `yaml:"sample-rate"`
+}
+
+// tracerName is the instrumentation scope of the spans of the package.
+const tracerName = "github.com/adamkali/ghost_utils"
+
+// NewTracerProvider returns the provider exporting the traces of the
+// telemetry block and installs it, with the W3C trace context and
+// baggage propagators, as the global one. Shut it down to flush the
+// last spans; Setup does so in the OnStop hooks of Run.
+//
+// Example:
+//  provider, err := ghostConfig.NewTracerProvider(ctx)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  defer provider.Shutdown(context.Background())
+//  r.Use(ghostutils.Tracing())
+//
+// Returns:
+//  *sdktrace.TracerProvider
+//  error if the exporter cannot be created
+func (ghostConfig GhostConfig) NewTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	config := ghostConfig.Telemetry
+	var options []otlptracehttp.Option
+	if config.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+	}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if len(config.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(config.Headers))
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	service := config.ServiceName
+	if service == "" {
+		service = ghostConfig.Name
+	}
+	rate := config.SampleRate
+	if rate == 0 {
+		rate = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(rate))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(service),
+			semconv.ServiceVersion(ghostConfig.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider, nil
+}
+
+// Tracing starts a span for every request, continuing the trace of
+// the traceparent header, named after the method and route. The span
+// is in c.Request.Context(), and the Repository and query builder
+// calls given c or that context start their spans under it. Responses
+// with 5xx statuses mark the span as failed.
+func Tracing() gin.HandlerFunc {
+	tracer := otel.Tracer(tracerName)
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		name := c.Request.Method + " " + route
+		if route == "" {
+			name = c.Request.Method
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.URLPath(c.Request.URL.Path),
+			),
+		)
+		defer span.End()
+		if route != "" {
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		if len(c.Errors) > 0 {
+			span.RecordError(c.Errors.Last())
+		}
+	}
+}
+
+// spanContext returns the context holding the span of ctx. A
+// *gin.Context only reaches its request context with
+// ContextWithFallback, so its request is used.
+func spanContext(ctx context.Context) context.Context {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		return c.Request.Context()
+	}
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// startDBSpan starts the span of a SurrealDB call on table, under the
+// span of ctx.
+func startDBSpan(ctx context.Context, operation, table string) trace.Span {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemKey.String("surrealdb"),
+		semconv.DBOperation(operation),
+	}
+	name := "surrealdb " + operation
+	if table != "" {
+		attrs = append(attrs, semconv.DBSQLTable(table))
+		name += " " + table
+	}
+	_, span := otel.Tracer(tracerName).Start(spanContext(ctx), name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	return span
+}
+
+// endSpan ends span, marking it failed by err unless the record was
+// only missing, and returns err.
+func endSpan(span trace.Span, err error) error {
+	if err != nil && !errors.Is(err, surrealdb.ErrNoRow) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+// mountTelemetry installs the tracing of the telemetry block on r for
+// Setup, flushing the spans when Run stops.
+func (ghostConfig GhostConfig) mountTelemetry(app *App, r *gin.Engine) error {
+	provider, err := ghostConfig.NewTracerProvider(context.Background())
+	if err != nil {
+		return err
+	}
+	app.onStop(provider.Shutdown)
+	r.Use(Tracing())
+	return nil
+}
@@ -0,0 +1,425 @@
+package ghostutils
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template/parse"
+	"time"
+)
+
+// DefaultTemplateRuns is the number of renders of a template benchmark.
+const DefaultTemplateRuns = 100
+
+// TemplateCheckError lists every problem Check found in the templates.
+type TemplateCheckError struct {
+	Problems []string
+}
+
+func (e *TemplateCheckError) Error() string {
+	if len(e.Problems) == 1 {
+		return "templates: " + e.Problems[0]
+	}
+	return fmt.Sprintf("templates: %d problems:\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+// Check finds the {{template}} calls naming a template the page does
+// not have, which html/template only reports once the page renders.
+// Syntax errors already failed the Load of the engine.
+//
+// Returns:
+//  *TemplateCheckError listing every undefined template by page
+func (e *TemplateEngine) Check() error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	problems := &TemplateCheckError{}
+	sets := make(map[string]*template.Template, len(e.pages)+1)
+	for name, set := range e.pages {
+		sets[name] = set
+	}
+	if len(e.pages) == 0 && e.shared != nil {
+		sets[""] = e.shared
+	}
+	for _, page := range sortedTemplateSets(sets) {
+		set := sets[page]
+		templates := set.Templates()
+		sort.Slice(templates, func(i, j int) bool { return templates[i].Name() < templates[j].Name() })
+		for _, tmpl := range templates {
+			if tmpl.Tree == nil {
+				continue
+			}
+			walkTemplateCalls(tmpl.Tree.Root, func(call *parse.TemplateNode) {
+				if set.Lookup(call.Name) != nil {
+					return
+				}
+				location, _ := tmpl.Tree.ErrorContext(call)
+				if page == "" || page == tmpl.Name() {
+					problems.add("%s: undefined template %q", location, call.Name)
+				} else {
+					problems.add("%s: undefined template %q, rendering %s", location, call.Name, page)
+				}
+			})
+		}
+	}
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func (e *TemplateCheckError) add(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	// a layout or partial missing a template fails every page using it
+	for _, known := range e.Problems {
+		if known == problem {
+			return
+		}
+	}
+	e.Problems = append(e.Problems, problem)
+}
+
+func sortedTemplateSets(sets map[string]*template.Template) []string {
+	names := make([]string, 0, len(sets))
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// walkTemplateCalls calls fn on every {{template}} call under node.
+func walkTemplateCalls(node parse.Node, fn func(*parse.TemplateNode)) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, child := range node.Nodes {
+			walkTemplateCalls(child, fn)
+		}
+	case *parse.TemplateNode:
+		fn(node)
+	case *parse.IfNode:
+		walkTemplateCalls(node.List, fn)
+		walkTemplateCalls(node.ElseList, fn)
+	case *parse.RangeNode:
+		walkTemplateCalls(node.List, fn)
+		walkTemplateCalls(node.ElseList, fn)
+	case *parse.WithNode:
+		walkTemplateCalls(node.List, fn)
+		walkTemplateCalls(node.ElseList, fn)
+	}
+}
+
+// TemplateBenchmark is the cost of rendering a template.
+type TemplateBenchmark struct {
+	Name   string        `json:"name"`
+	Runs   int           `json:"runs"`
+	Render time.Duration `json:"render"`
+	Bytes  int           `json:"bytes"`
+	Allocs uint64        `json:"allocs"`
+}
+
+// Benchmark renders the template name with data runs times, or
+// DefaultTemplateRuns, as Execute does.
+//
+// Returns:
+//  TemplateBenchmark with the time, output size and allocations of one
+//  render
+//  error of the first render
+func (e *TemplateEngine) Benchmark(name string, data interface{}, runs int) (TemplateBenchmark, error) {
+	if runs <= 0 {
+		runs = DefaultTemplateRuns
+	}
+	var out bytes.Buffer
+	if err := e.Execute(&out, name, data); err != nil {
+		return TemplateBenchmark{}, err
+	}
+	result := TemplateBenchmark{Name: name, Runs: runs, Bytes: out.Len()}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 0; i < runs; i++ {
+		out.Reset()
+		e.Execute(&out, name, data)
+	}
+	result.Render = time.Since(start) / time.Duration(runs)
+	runtime.ReadMemStats(&after)
+	result.Allocs = (after.Mallocs - before.Mallocs) / uint64(runs)
+	return result, nil
+}
+
+// TemplateCompileOptions configure CompileTemplates.
+type TemplateCompileOptions struct {
+	// Output is the Go file the templates are written to; when empty
+	// they are only checked.
+	Output string
+	// Package is the package of Output, the name of its directory by
+	// default, and Var the name of the TemplateBundle, Templates by
+	// default.
+	Package string
+	Var     string
+	// Funcs are the helpers of the templates on top of those of Setup,
+	// needed to parse the templates calling them.
+	Funcs []template.FuncMap
+	// Samples are the data to benchmark templates with by name, e.g.
+	// "posts/index.html"; every sample is rendered Runs times, or
+	// DefaultTemplateRuns, and reported to Report when set.
+	Samples map[string]interface{}
+	Runs    int
+	Report  io.Writer
+}
+
+// CompileTemplates parses the templates of views and checks them, so a
+// syntax error or an undefined template fails the build rather than
+// the first request, benchmarks the Samples, and writes the templates
+// to opts.Output as a TemplateBundle. The app then loads them from the
+// binary with NewTemplatesFS or SetupWithFS, without reading views. The
+// bundle holds the sources: html/template has no compiled form, so the
+// sets are still parsed, from memory, when the app starts.
+//
+// Run it from go generate with a small program that passes the
+// helpers of the app.
+//
+// Example:
+//  // views/generate.go
+//  //go:generate go run ../tools/templates
+//
+//  // tools/templates/main.go
+//  func main() {
+//      ghostConfig, err := ghostutils.NewFromPath("ghost.yaml", os.Getenv(ghostutils.EnvVariable))
+//      if err != nil {
+//          log.Fatal(err)
+//      }
+//      _, err = ghostConfig.CompileTemplates(ghostutils.TemplateCompileOptions{
+//          Output:  "views/templates_gen.go",
+//          Funcs:   []template.FuncMap{app.FuncMap()},
+//          Samples: map[string]interface{}{"posts/index.html": app.SamplePosts()},
+//          Report:  os.Stdout,
+//      })
+//      if err != nil {
+//          log.Fatal(err)
+//      }
+//  }
+//
+//  // main.go
+//  db, err := ghostConfig.SetupWithFS(r, views.Templates, static)
+//
+// Returns:
+//  the benchmarks of the Samples
+//  error for a template that does not parse or calls an undefined
+//  template, a sample that fails to render, or the file not written
+func (ghostConfig GhostConfig) CompileTemplates(opts TemplateCompileOptions) ([]TemplateBenchmark, error) {
+	funcs := append(ghostConfig.templateFuncs(nil), opts.Funcs...)
+	engine, err := ghostConfig.NewTemplates(funcs...)
+	if err != nil {
+		return nil, err
+	}
+	if err := engine.Check(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(opts.Samples))
+	for name := range opts.Samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var benchmarks []TemplateBenchmark
+	for _, name := range names {
+		benchmark, err := engine.Benchmark(name, opts.Samples[name], opts.Runs)
+		if err != nil {
+			return benchmarks, fmt.Errorf("template %s: %w", name, err)
+		}
+		benchmarks = append(benchmarks, benchmark)
+		if opts.Report != nil {
+			fmt.Fprintf(opts.Report, "%-32s %10s %8d B %6d allocs\n", name, benchmark.Render, benchmark.Bytes, benchmark.Allocs)
+		}
+	}
+	if opts.Output == "" {
+		return benchmarks, nil
+	}
+	source, err := engine.bundleSource(opts)
+	if err != nil {
+		return benchmarks, err
+	}
+	if err := os.MkdirAll(filepath.Dir(opts.Output), 0o755); err != nil {
+		return benchmarks, err
+	}
+	return benchmarks, os.WriteFile(opts.Output, source, 0o644)
+}
+
+// bundleSource returns the Go file holding the files of the engine.
+func (e *TemplateEngine) bundleSource(opts TemplateCompileOptions) ([]byte, error) {
+	pkg := opts.Package
+	if pkg == "" {
+		abs, err := filepath.Abs(filepath.Dir(opts.Output))
+		if err != nil {
+			return nil, err
+		}
+		pkg = strings.NewReplacer("-", "_", ".", "_").Replace(filepath.Base(abs))
+	}
+	name := opts.Var
+	if name == "" {
+		name = "Templates"
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by ghostutils.CompileTemplates from %s; DO NOT EDIT.\n\n", e.Views)
+	fmt.Fprintf(&out, "package %s\n\n", pkg)
+	fmt.Fprintf(&out, "import ghostutils %q\n\n", "github.com/adamkali/ghost_utils/pkg/ghost-utils")
+	fmt.Fprintf(&out, "// %s are the templates of %s, checked when generated.\n", name, e.Views)
+	fmt.Fprintf(&out, "var %s = ghostutils.TemplateBundle{\n", name)
+	err := fs.WalkDir(e.FS, ".", func(rel string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !matchTemplateGlob(e.Config.Glob, rel) {
+			return err
+		}
+		source, err := fs.ReadFile(e.FS, rel)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&out, "%s: %s,\n", strconv.Quote(rel), strconv.Quote(string(source)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.WriteString("}\n")
+	return format.Source(out.Bytes())
+}
+
+// TemplateBundle holds templates by their slash separated path, as
+// written by CompileTemplates, and serves them as a read-only fs.FS.
+type TemplateBundle map[string]string
+
+// Open implements fs.FS.
+func (b TemplateBundle) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if source, ok := b[name]; ok {
+		return &bundleFile{name: name, Reader: strings.NewReader(source), size: int64(len(source))}, nil
+	}
+	entries, err := b.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &bundleDir{name: name, entries: entries}, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (b TemplateBundle) ReadFile(name string) ([]byte, error) {
+	source, ok := b[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return []byte(source), nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (b TemplateBundle) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix := ""
+	if name != "." {
+		prefix = name + "/"
+	}
+	seen := map[string]bool{}
+	var entries []fs.DirEntry
+	for file, source := range b {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(file, prefix)
+		child, _, isDir := strings.Cut(rest, "/")
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		info := bundleInfo{name: child, dir: isDir}
+		if !isDir {
+			info.size = int64(len(source))
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Stat implements fs.StatFS.
+func (b TemplateBundle) Stat(name string) (fs.FileInfo, error) {
+	file, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+type bundleInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i bundleInfo) Name() string { return i.name }
+func (i bundleInfo) Size() int64  { return i.size }
+func (i bundleInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+func (i bundleInfo) ModTime() time.Time { return time.Time{} }
+func (i bundleInfo) IsDir() bool        { return i.dir }
+func (i bundleInfo) Sys() interface{}   { return nil }
+
+type bundleFile struct {
+	*strings.Reader
+	name string
+	size int64
+}
+
+func (f *bundleFile) Stat() (fs.FileInfo, error) {
+	return bundleInfo{name: path.Base(f.name), size: f.size}, nil
+}
+
+func (f *bundleFile) Close() error { return nil }
+
+type bundleDir struct {
+	name    string
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *bundleDir) Stat() (fs.FileInfo, error) {
+	return bundleInfo{name: path.Base(d.name), dir: true}, nil
+}
+
+func (d *bundleDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *bundleDir) Close() error { return nil }
+
+// ReadDir implements fs.ReadDirFile.
+func (d *bundleDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(rest) > n {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	return rest, nil
+}
@@ -0,0 +1,203 @@
+package ghostutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+// TemplateDiagnostics makes template execution errors visible. Every
+// c.HTML is rendered into a buffer first, so a failing template
+// answers 500 instead of a 200 with half a page. With dev set the 500
+// is a diagnostic page showing the template, line, offending
+// expression, the surrounding source from views and the data passed
+// to it; otherwise the error is logged and the body left empty. Call
+// it after the templates are loaded.
+//
+// Example:
+//  r.LoadHTMLGlob(ghostConfig.Views + "/**/*")
+//  ghostutils.TemplateDiagnostics(r, gin.IsDebugging(), ghostConfig.Views)
+func TemplateDiagnostics(r *gin.Engine, dev bool, views string) {
+	if r.HTMLRender == nil {
+		return
+	}
+	r.HTMLRender = diagnosticHTMLRender{base: r.HTMLRender, dev: dev, views: views}
+}
+
+type diagnosticHTMLRender struct {
+	base  render.HTMLRender
+	dev   bool
+	views string
+}
+
+func (d diagnosticHTMLRender) Instance(name string, data interface{}) render.Render {
+	return diagnosticHTML{inner: d.base.Instance(name, data), name: name, data: data, dev: d.dev, views: d.views}
+}
+
+type diagnosticHTML struct {
+	inner render.Render
+	name  string
+	data  interface{}
+	dev   bool
+	views string
+}
+
+func (h diagnosticHTML) WriteContentType(w http.ResponseWriter) {
+	h.inner.WriteContentType(w)
+}
+
+func (h diagnosticHTML) Render(w http.ResponseWriter) error {
+	buf := &bufferedResponse{header: w.Header()}
+	err := h.inner.Render(buf)
+	if err == nil {
+		_, err = w.Write(buf.body.Bytes())
+		return err
+	}
+	log.Printf("template %s: %v", h.name, err)
+	w.WriteHeader(http.StatusInternalServerError)
+	if !h.dev {
+		return err
+	}
+	page := newTemplateDiagnostic(h.name, err, h.data, h.views)
+	var out bytes.Buffer
+	if renderErr := diagnosticPage.Execute(&out, page); renderErr != nil {
+		return renderErr
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, writeErr := w.Write(out.Bytes())
+	if writeErr != nil {
+		return writeErr
+	}
+	// the diagnostic page was served, gin need not abort with the error
+	return nil
+}
+
+// bufferedResponse collects a render so nothing reaches the client
+// until it succeeds.
+type bufferedResponse struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(int)             {}
+
+// exec errors look like:
+//  template: post.html:12:5: executing "post.html" at <.Author.Name>: nil pointer evaluating *main.User.Name
+var templateErrorPattern = regexp.MustCompile(`template: ([^:]+):(\d+):(\d+): executing "([^"]*)" at <([^>]*)>: (.*)`)
+
+type templateDiagnostic struct {
+	Template   string
+	File       string
+	Line       int
+	Column     int
+	Expression string
+	Message    string
+	Error      string
+	Source     []templateSourceLine
+	Data       string
+}
+
+type templateSourceLine struct {
+	Number  int
+	Text    string
+	Current bool
+}
+
+func newTemplateDiagnostic(name string, err error, data interface{}, views string) templateDiagnostic {
+	d := templateDiagnostic{Template: name, Error: err.Error(), Message: err.Error()}
+	if m := templateErrorPattern.FindStringSubmatch(err.Error()); m != nil {
+		d.File = m[1]
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		d.Template, d.Expression, d.Message = m[4], m[5], m[6]
+		d.Source = templateSource(views, m[1], d.Line)
+	}
+	if dump, jsonErr := json.MarshalIndent(data, "", "  "); jsonErr == nil {
+		d.Data = string(dump)
+	} else {
+		d.Data = fmt.Sprintf("%#v", data)
+	}
+	if len(d.Data) > 64<<10 {
+		d.Data = d.Data[:64<<10] + "\n… truncated"
+	}
+	return d
+}
+
+// templateSource returns the lines around line of the first file
+// called name under views.
+func templateSource(views, name string, line int) []templateSourceLine {
+	if views == "" {
+		return nil
+	}
+	var path string
+	_ = filepath.Walk(views, func(p string, info os.FileInfo, err error) error {
+		if err == nil && path == "" && !info.IsDir() && (info.Name() == name || filepath.ToSlash(p) == filepath.ToSlash(filepath.Join(views, name))) {
+			path = p
+		}
+		return nil
+	})
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []templateSourceLine
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if n >= line-5 && n <= line+5 {
+			lines = append(lines, templateSourceLine{Number: n, Text: scanner.Text(), Current: n == line})
+		}
+		if n > line+5 {
+			break
+		}
+	}
+	return lines
+}
+
+var diagnosticPage = template.Must(template.New("diagnostic").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Template error: {{.Template}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem; color: #1f2937; }
+h1 { color: #b91c1c; font-size: 1.4rem; }
+code, pre { font-family: ui-monospace, monospace; font-size: .9rem; }
+pre { background: #f3f4f6; padding: 1rem; overflow: auto; }
+.current { background: #fee2e2; display: block; }
+dt { font-weight: 600; margin-top: .5rem; }
+</style>
+</head>
+<body>
+<h1>Template error in {{.Template}}</h1>
+<p>{{.Message}}</p>
+<dl>
+{{if .File}}<dt>Location</dt><dd><code>{{.File}}:{{.Line}}:{{.Column}}</code></dd>{{end}}
+{{if .Expression}}<dt>Expression</dt><dd><code>{{.Expression}}</code></dd>{{end}}
+<dt>Error</dt><dd><code>{{.Error}}</code></dd>
+</dl>
+{{if .Source}}<h2>Source</h2>
+<pre>{{range .Source}}<span{{if .Current}} class="current"{{end}}>{{printf "%4d" .Number}}  {{.Text}}</span>
+{{end}}</pre>{{end}}
+<h2>Data</h2>
+<pre>{{.Data}}</pre>
+<p><small>Shown because template diagnostics are enabled in development.</small></p>
+</body>
+</html>
+`))
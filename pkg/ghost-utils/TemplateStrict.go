@@ -0,0 +1,363 @@
+package ghostutils
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"text/template/parse"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+// StrictTemplates stops templates from silently rendering an empty
+// string for keys missing from their data. With dev set a missing key
+// fails the render, shown by TemplateDiagnostics when it is enabled;
+// otherwise it is logged and the page rendered as before. Call it
+// after loading the templates and before TemplateDiagnostics.
+//
+// Example:
+//  r.LoadHTMLGlob(ghostConfig.Views + "/**/*")
+//  ghostutils.StrictTemplates(r, gin.IsDebugging())
+//  ghostutils.TemplateDiagnostics(r, gin.IsDebugging(), ghostConfig.Views)
+func StrictTemplates(r *gin.Engine, dev bool) {
+	if r.HTMLRender == nil {
+		return
+	}
+	strict := strictHTMLRender{base: r.HTMLRender, dev: dev}
+	if production, ok := r.HTMLRender.(render.HTMLProduction); ok && production.Template != nil {
+		// keep an unrestricted copy to fall back to in production
+		if lenient, err := production.Template.Clone(); err == nil {
+			strict.lenient = lenient
+		}
+		production.Template.Option("missingkey=error")
+	}
+	r.HTMLRender = strict
+}
+
+type strictHTMLRender struct {
+	base    render.HTMLRender
+	dev     bool
+	lenient *template.Template
+}
+
+func (s strictHTMLRender) Instance(name string, data interface{}) render.Render {
+	instance := s.base.Instance(name, data)
+	html, ok := instance.(render.HTML)
+	if !ok || html.Template == nil {
+		return instance
+	}
+	lenient := s.lenient
+	if _, production := s.base.(render.HTMLProduction); !production {
+		// debug renderers parse the templates again for every request
+		if !s.dev {
+			lenient, _ = html.Template.Clone()
+		}
+		html.Template.Option("missingkey=error")
+	}
+	return strictHTML{html: html, lenient: lenient, dev: s.dev}
+}
+
+type strictHTML struct {
+	html    render.HTML
+	lenient *template.Template
+	dev     bool
+}
+
+func (s strictHTML) WriteContentType(w http.ResponseWriter) {
+	s.html.WriteContentType(w)
+}
+
+func (s strictHTML) Render(w http.ResponseWriter) error {
+	buf := &bufferedResponse{header: w.Header()}
+	err := s.html.Render(buf)
+	if err == nil {
+		_, err = w.Write(buf.body.Bytes())
+		return err
+	}
+	if s.dev || s.lenient == nil || !strings.Contains(err.Error(), "map has no entry for key") {
+		return err
+	}
+	log.Printf("template %s: %v", s.html.Name, err)
+	return render.HTML{Template: s.lenient, Name: s.html.Name, Data: s.html.Data}.Render(w)
+}
+
+// TypedTemplate is a template rendered with data of one type, so the
+// compiler checks that every call site passes a T and TypedPage has
+// checked the template against T once. Embed ViewModel in T to
+// receive the layout data.
+//
+// Example:
+//  type PostPage struct {
+//      ghostutils.ViewModel
+//      Title string
+//      Post  Post
+//  }
+//
+//  postPage, err := ghostutils.TypedPage[PostPage](templates, "post.html")
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  r.GET("/posts/:id", func(c *gin.Context) {
+//      postPage.Render(c, PostPage{Title: post.Title, Post: post})
+//  })
+type TypedTemplate[T any] struct {
+	Name string
+}
+
+// TypedPage returns the template name of templates for data of type
+// T, after checking it with CheckTemplateData.
+//
+// Returns:
+//  TypedTemplate[T]
+//  error listing every field of the template T does not have
+func TypedPage[T any](templates *template.Template, name string) (TypedTemplate[T], error) {
+	return TypedTemplate[T]{Name: name}, CheckTemplateData[T](templates, name)
+}
+
+// Render renders the template with data and the layout, see HTML.
+func (t TypedTemplate[T]) Render(c *gin.Context, data T) {
+	HTML(c, http.StatusOK, t.Name, data)
+}
+
+// CheckTemplateData reports the fields referenced by the template
+// name, and the templates it calls, that T does not have. The type
+// of dot is followed into range, with and template calls, as are
+// the variables they declare; past a map, an interface or a function
+// result the fields are only known at run time and not checked. Run
+// it at startup or in CI to catch a renamed field before a page
+// renders blank.
+//
+// Example:
+//  if err := ghostutils.CheckTemplateData[PostPage](templates, "post.html"); err != nil {
+//      log.Fatal(err)
+//  }
+//
+// Returns:
+//  error listing every unknown field, nil if all resolve
+func CheckTemplateData[T any](templates *template.Template, name string) error {
+	tmpl := templates.Lookup(name)
+	if tmpl == nil || tmpl.Tree == nil {
+		return fmt.Errorf("template %s is not defined", name)
+	}
+	root := reflect.TypeOf((*T)(nil)).Elem()
+	check := &templateCheck{templates: templates, visited: map[string]bool{}}
+	check.template(name, root)
+	if len(check.missing) > 0 {
+		return fmt.Errorf("template %s: %s", name, strings.Join(check.missing, "; "))
+	}
+	return nil
+}
+
+// templateCheck walks templates tracking the type of dot; a nil type
+// is not known.
+type templateCheck struct {
+	templates *template.Template
+	visited   map[string]bool
+	missing   []string
+}
+
+// template walks the named template with dot of type dot, once per
+// type.
+func (check *templateCheck) template(name string, dot reflect.Type) {
+	key := fmt.Sprintf("%s %v", name, dot)
+	tmpl := check.templates.Lookup(name)
+	if check.visited[key] || tmpl == nil || tmpl.Tree == nil {
+		return
+	}
+	check.visited[key] = true
+	check.list(tmpl.Tree.Root, dot, map[string]reflect.Type{"$": dot})
+}
+
+func (check *templateCheck) list(list *parse.ListNode, dot reflect.Type, vars map[string]reflect.Type) {
+	if list == nil {
+		return
+	}
+	for _, node := range list.Nodes {
+		check.node(node, dot, vars)
+	}
+}
+
+func (check *templateCheck) node(node parse.Node, dot reflect.Type, vars map[string]reflect.Type) {
+	switch node := node.(type) {
+	case *parse.ActionNode:
+		check.declare(node.Pipe, check.pipe(node.Pipe, dot, vars), vars)
+	case *parse.IfNode:
+		scope := copyTypes(vars)
+		check.declare(node.Pipe, check.pipe(node.Pipe, dot, scope), scope)
+		check.list(node.List, dot, scope)
+		check.list(node.ElseList, dot, copyTypes(vars))
+	case *parse.WithNode:
+		scope := copyTypes(vars)
+		typ := check.pipe(node.Pipe, dot, scope)
+		check.declare(node.Pipe, typ, scope)
+		check.list(node.List, typ, scope)
+		check.list(node.ElseList, dot, copyTypes(vars))
+	case *parse.RangeNode:
+		scope := copyTypes(vars)
+		key, elem := rangeTypes(check.pipe(node.Pipe, dot, scope))
+		if node.Pipe != nil {
+			switch len(node.Pipe.Decl) {
+			case 1:
+				scope[node.Pipe.Decl[0].Ident[0]] = elem
+			case 2:
+				scope[node.Pipe.Decl[0].Ident[0]] = key
+				scope[node.Pipe.Decl[1].Ident[0]] = elem
+			}
+		}
+		check.list(node.List, elem, scope)
+		check.list(node.ElseList, dot, copyTypes(vars))
+	case *parse.TemplateNode:
+		typ := check.pipe(node.Pipe, dot, vars)
+		if node.Pipe == nil {
+			typ = nil
+		}
+		check.template(node.Name, typ)
+	case *parse.ListNode:
+		check.list(node, dot, vars)
+	}
+}
+
+// declare records the variables a pipeline declares, $x := ...
+func (check *templateCheck) declare(pipe *parse.PipeNode, typ reflect.Type, vars map[string]reflect.Type) {
+	if pipe == nil {
+		return
+	}
+	for _, variable := range pipe.Decl {
+		vars[variable.Ident[0]] = typ
+	}
+}
+
+// pipe checks the fields of pipe and returns the type it evaluates
+// to, nil when it is not known.
+func (check *templateCheck) pipe(pipe *parse.PipeNode, dot reflect.Type, vars map[string]reflect.Type) reflect.Type {
+	if pipe == nil {
+		return nil
+	}
+	var typ reflect.Type
+	for i, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			check.arg(arg, dot, vars)
+		}
+		typ = nil
+		if i == len(pipe.Cmds)-1 && len(cmd.Args) == 1 {
+			typ = check.argType(cmd.Args[0], dot, vars)
+		}
+	}
+	return typ
+}
+
+func (check *templateCheck) arg(arg parse.Node, dot reflect.Type, vars map[string]reflect.Type) {
+	switch arg := arg.(type) {
+	case *parse.FieldNode:
+		check.resolve(dot, arg.Ident, ".")
+	case *parse.VariableNode:
+		if len(arg.Ident) > 1 {
+			check.resolve(vars[arg.Ident[0]], arg.Ident[1:], arg.Ident[0]+".")
+		}
+	case *parse.PipeNode:
+		check.pipe(arg, dot, vars)
+	case *parse.ChainNode:
+		check.arg(arg.Node, dot, vars)
+	}
+}
+
+// argType returns the type of a lone argument, nil when unknown.
+func (check *templateCheck) argType(arg parse.Node, dot reflect.Type, vars map[string]reflect.Type) reflect.Type {
+	switch arg := arg.(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		typ, _, _ := resolveTemplateField(dot, arg.Ident)
+		return typ
+	case *parse.VariableNode:
+		typ, _, _ := resolveTemplateField(vars[arg.Ident[0]], arg.Ident[1:])
+		return typ
+	case *parse.PipeNode:
+		return check.pipe(arg, dot, vars)
+	}
+	return nil
+}
+
+func (check *templateCheck) resolve(typ reflect.Type, chain []string, prefix string) {
+	if _, field, ok := resolveTemplateField(typ, chain); !ok {
+		check.missing = append(check.missing, fmt.Sprintf("%s has no %s%s", typ, prefix, field))
+	}
+}
+
+func copyTypes(vars map[string]reflect.Type) map[string]reflect.Type {
+	scope := make(map[string]reflect.Type, len(vars))
+	for name, typ := range vars {
+		scope[name] = typ
+	}
+	return scope
+}
+
+// rangeTypes returns the key and element types of ranging over t.
+func rangeTypes(t reflect.Type) (key, elem reflect.Type) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return nil, nil
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		return reflect.TypeOf(0), t.Elem()
+	case reflect.Map:
+		return t.Key(), t.Elem()
+	case reflect.Chan:
+		return nil, t.Elem()
+	}
+	return nil, nil
+}
+
+// resolveTemplateField follows chain through t and returns the type
+// it ends at. It stops, successfully and with a nil type, at maps,
+// interfaces and types that are not known, whose keys are only known
+// at run time.
+func resolveTemplateField(t reflect.Type, chain []string) (reflect.Type, string, bool) {
+	for i, name := range chain {
+		if t == nil {
+			return nil, "", true
+		}
+		if method, ok := t.MethodByName(name); ok {
+			t = methodResult(method)
+			continue
+		}
+		if t.Kind() != reflect.Ptr {
+			if method, ok := reflect.PtrTo(t).MethodByName(name); ok {
+				t = methodResult(method)
+				continue
+			}
+		}
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Map, reflect.Interface:
+			return nil, "", true
+		case reflect.Struct:
+			field, ok := t.FieldByName(name)
+			if !ok || field.PkgPath != "" {
+				return nil, strings.Join(chain[:i+1], "."), false
+			}
+			t = field.Type
+		default:
+			return nil, strings.Join(chain[:i+1], "."), false
+		}
+	}
+	return t, "", true
+}
+
+// methodResult returns the first result of a method called from a
+// template, nil without one.
+func methodResult(method reflect.Method) reflect.Type {
+	if method.Type.NumOut() == 0 {
+		return nil
+	}
+	return method.Type.Out(0)
+}
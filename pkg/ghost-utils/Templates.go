@@ -0,0 +1,386 @@
+package ghostutils
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+// Defaults applied by NewTemplates to the templates block.
+const (
+	DefaultTemplateGlob     = "**/*.html"
+	DefaultTemplateLayouts  = "layouts"
+	DefaultTemplatePartials = "partials"
+	DefaultTemplateLayout   = "base"
+)
+
+// TemplateConfig is the `templates:` block of ghost.yaml. Files under
+// views matching glob are pages, except those in the layouts and
+// partials directories. When the router has no HTML renderer yet,
+// Setup loads them with the helpers of the package, see NewTemplates,
+// and SetupWithFS from an embedded filesystem.
+//
+// Example:
+//  templates:
+//    glob: "**/*.html"
+//    layouts: layouts
+//    partials: partials
+//    layout: base
+//    reload: true
+type TemplateConfig struct {
+	Glob     string `yaml:"glob"`
+	Layouts  string `yaml:"layouts"`
+	Partials string `yaml:"partials"`
+	// Layout is the layout of pages that do not name one.
+	Layout string `yaml:"layout"`
+	// Reload parses the templates again when a file under views
+	// changes, for development.
+	Reload bool `yaml:"reload"`
+}
+
+// templateLayoutPattern finds the layout comment of a page.
+var templateLayoutPattern = regexp.MustCompile(`^\s*{{/\*\s*layout:\s*([\w/.-]+)\s*\*/}}`)
+
+// TemplateEngine renders pages composed with a layout and partials.
+//
+// A page is named by its path under views, like "posts/show.html", and
+// defines the blocks of its layout, such as "content" and "title". The
+// layout is the one of the page's first line, {{/* layout: admin */}},
+// or the default one; "none" renders the page alone, as do pages when
+// there is no layout. Layouts and partials are named by their path in
+// their directory without the extension: layouts/base.html is "base"
+// and partials/forms/input.html is {{template "forms/input" .}}.
+//
+// A block of a page renders alone as "page#block", for htmx fragments,
+// and partials render by their name.
+//
+// Example:
+//  // layouts/base.html:  <html><title>{{block "title" .}}Ghost{{end}}</title><body>{{block "content" .}}{{end}}</body></html>
+//  // posts/show.html:    {{define "title"}}{{.Post.Title}}{{end}}{{define "content"}}{{template "post" .Post}}{{end}}
+//  // partials/post.html: <article>{{.Title}}</article>
+//
+//  engine, err := ghostConfig.NewTemplates(ghostutils.FormFuncMap(), ghostutils.MoneyFuncMap())
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  engine.Install(r)
+//
+//  ghostutils.HTML(c, http.StatusOK, "posts/show.html", gin.H{"Post": post})
+//  ghostutils.Fragment(c, http.StatusOK, "posts/index.html", "posts/index.html#list", data)
+type TemplateEngine struct {
+	// Views names the templates in errors.
+	Views  string
+	// FS holds the templates, the views directory or an embedded copy.
+	FS     fs.FS
+	Config TemplateConfig
+	Funcs  template.FuncMap
+
+	mu sync.RWMutex
+	// pages holds the template set of every page, shared the set of
+	// layouts and partials alone.
+	pages   map[string]*template.Template
+	layouts map[string]string
+	shared  *template.Template
+	// stamp sums the files and modification times of views at the last
+	// load, for Reload.
+	stamp int64
+}
+
+// NewTemplates parses the templates of views with the templates block
+// and the helpers of funcs.
+//
+// Returns:
+//  *TemplateEngine
+//  error for a template that does not parse
+func (ghostConfig GhostConfig) NewTemplates(funcs ...template.FuncMap) (*TemplateEngine, error) {
+	views := ghostConfig.Views
+	if views == "" {
+		views = DefaultViews
+	}
+	return ghostConfig.newTemplates(views, os.DirFS(views), funcs)
+}
+
+// NewTemplatesFS parses the templates of fsys, such as an embed.FS,
+// like NewTemplates. When fsys holds the views directory, as it does
+// when views is embedded with its path, the templates are those of the
+// directory.
+//
+// Example:
+//  //go:embed src/views
+//  var views embed.FS
+//
+//  engine, err := ghostConfig.NewTemplatesFS(views, ghostutils.FormFuncMap())
+func (ghostConfig GhostConfig) NewTemplatesFS(fsys fs.FS, funcs ...template.FuncMap) (*TemplateEngine, error) {
+	views := ghostConfig.Views
+	if views == "" {
+		views = DefaultViews
+	}
+	fsys, err := subFS(fsys, views)
+	if err != nil {
+		return nil, err
+	}
+	return ghostConfig.newTemplates("embedded "+views, fsys, funcs)
+}
+
+func (ghostConfig GhostConfig) newTemplates(views string, fsys fs.FS, funcs []template.FuncMap) (*TemplateEngine, error) {
+	config := ghostConfig.Templates
+	if config.Glob == "" {
+		config.Glob = DefaultTemplateGlob
+	}
+	if config.Layouts == "" {
+		config.Layouts = DefaultTemplateLayouts
+	}
+	if config.Partials == "" {
+		config.Partials = DefaultTemplatePartials
+	}
+	if config.Layout == "" {
+		config.Layout = DefaultTemplateLayout
+	}
+	engine := &TemplateEngine{Views: views, FS: fsys, Config: config, Funcs: template.FuncMap{}}
+	for _, funcMap := range funcs {
+		for name, fn := range funcMap {
+			engine.Funcs[name] = fn
+		}
+	}
+	return engine, engine.Load()
+}
+
+// Install makes the engine render the c.HTML of r. Install it before
+// StrictTemplates and TemplateDiagnostics.
+func (e *TemplateEngine) Install(r *gin.Engine) {
+	r.HTMLRender = e
+}
+
+// Load parses the templates again.
+func (e *TemplateEngine) Load() error {
+	layouts, partials, pages := map[string]string{}, map[string]string{}, map[string]string{}
+	stamp, err := e.viewsStamp()
+	if err != nil {
+		return err
+	}
+	err = fs.WalkDir(e.FS, ".", func(rel string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if !matchTemplateGlob(e.Config.Glob, rel) {
+			return nil
+		}
+		source, err := fs.ReadFile(e.FS, rel)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(rel, e.Config.Layouts+"/"):
+			layouts[templateBaseName(strings.TrimPrefix(rel, e.Config.Layouts+"/"))] = string(source)
+		case strings.HasPrefix(rel, e.Config.Partials+"/"):
+			partials[templateBaseName(strings.TrimPrefix(rel, e.Config.Partials+"/"))] = string(source)
+		default:
+			pages[rel] = string(source)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// parsed in name order so the sets are the same on every load
+	shared := template.New("").Funcs(e.Funcs)
+	for _, group := range []map[string]string{layouts, partials} {
+		for _, name := range sortedTemplateNames(group) {
+			if _, err := shared.New(name).Parse(group[name]); err != nil {
+				return err
+			}
+		}
+	}
+	sets := make(map[string]*template.Template, len(pages))
+	pageLayouts := make(map[string]string, len(pages))
+	for _, name := range sortedTemplateNames(pages) {
+		set, err := shared.Clone()
+		if err != nil {
+			return err
+		}
+		// the page is parsed last so its blocks replace the defaults of
+		// the layout
+		if _, err := set.New(name).Parse(pages[name]); err != nil {
+			return err
+		}
+		layout := e.Config.Layout
+		if match := templateLayoutPattern.FindStringSubmatch(pages[name]); match != nil {
+			layout = match[1]
+		}
+		if _, ok := layouts[layout]; ok {
+			pageLayouts[name] = layout
+		} else if layout != "none" && layout != e.Config.Layout {
+			return fmt.Errorf("template %s: no layout %q in %s", name, layout, path.Join(e.Views, e.Config.Layouts))
+		}
+		sets[name] = set
+	}
+	e.mu.Lock()
+	e.pages, e.layouts, e.shared, e.stamp = sets, pageLayouts, shared, stamp
+	e.mu.Unlock()
+	return nil
+}
+
+// viewsStamp returns a value that changes when a file under views is
+// added, removed or modified.
+func (e *TemplateEngine) viewsStamp() (int64, error) {
+	var stamp int64
+	err := fs.WalkDir(e.FS, ".", func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stamp += info.ModTime().UnixNano() + int64(len(file))
+		return nil
+	})
+	return stamp, err
+}
+
+// Instance implements render.HTMLRender.
+func (e *TemplateEngine) Instance(name string, data interface{}) render.Render {
+	if e.Config.Reload {
+		e.mu.RLock()
+		loaded := e.stamp
+		e.mu.RUnlock()
+		if stamp, err := e.viewsStamp(); err != nil || stamp != loaded {
+			if err := e.Load(); err != nil {
+				return templateError{err}
+			}
+		}
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	page, block := name, ""
+	if i := strings.Index(name, "#"); i >= 0 {
+		page, block = name[:i], name[i+1:]
+	}
+	if set, ok := e.pages[page]; ok {
+		switch {
+		case block != "":
+			return render.HTML{Template: set, Name: block, Data: data}
+		case e.layouts[page] != "":
+			return render.HTML{Template: set, Name: e.layouts[page], Data: data}
+		}
+		return render.HTML{Template: set, Name: page, Data: data}
+	}
+	if e.shared != nil && e.shared.Lookup(name) != nil {
+		return render.HTML{Template: e.shared, Name: name, Data: data}
+	}
+	return templateError{fmt.Errorf("no template %q in %s", name, e.Views)}
+}
+
+// Execute renders the template name with data to w outside of a
+// request, e.g. in a job, with the layout of the page as Instance does.
+func (e *TemplateEngine) Execute(w io.Writer, name string, data interface{}) error {
+	switch r := e.Instance(name, data).(type) {
+	case render.HTML:
+		if r.Name == "" {
+			return r.Template.Execute(w, r.Data)
+		}
+		return r.Template.ExecuteTemplate(w, r.Name, r.Data)
+	case templateError:
+		return r.err
+	default:
+		return fmt.Errorf("no template %q in %s", name, e.Views)
+	}
+}
+
+// Pages returns the names of the pages.
+func (e *TemplateEngine) Pages() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	names := make([]string, 0, len(e.pages))
+	for name := range e.pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// templateError fails a render, e.g. for an unknown template.
+type templateError struct {
+	err error
+}
+
+func (t templateError) Render(w http.ResponseWriter) error {
+	return t.err
+}
+
+func (t templateError) WriteContentType(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+}
+
+// subFS returns the directory dir of fsys when fsys has it, else fsys.
+func subFS(fsys fs.FS, dir string) (fs.FS, error) {
+	dir = path.Clean(strings.TrimPrefix(filepath.ToSlash(dir), "./"))
+	if info, err := fs.Stat(fsys, dir); err == nil && info.IsDir() {
+		return fs.Sub(fsys, dir)
+	}
+	return fsys, nil
+}
+
+// templateBaseName drops the extension of a template path.
+func templateBaseName(rel string) string {
+	return strings.TrimSuffix(rel, path.Ext(rel))
+}
+
+func sortedTemplateNames(templates map[string]string) []string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matchTemplateGlob matches a slash separated path against pattern,
+// where ** matches any number of directories.
+func matchTemplateGlob(pattern, name string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// validTemplateGlob reports whether pattern is a valid glob.
+func validTemplateGlob(pattern string) bool {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); errors.Is(err, path.ErrBadPattern) {
+			return false
+		}
+	}
+	return true
+}
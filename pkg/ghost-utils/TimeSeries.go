@@ -0,0 +1,190 @@
+package ghostutils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Time series bucket sizes.
+const (
+	BucketHour  = "hour"
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+)
+
+// SeriesPoint is one bucket of a series. Time is the start of the
+// bucket in the query's location.
+type SeriesPoint struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+}
+
+// TimeSeriesQuery selects the rows of a series. Rows of Table with
+// TimeField in [From, To) are counted, or ValueField is summed. Where
+// is an extra SurrealQL condition with its Vars. Buckets follow the
+// calendar of Location, UTC by default, including DST changes.
+type TimeSeriesQuery struct {
+	Table      string
+	TimeField  string
+	ValueField string
+	Where      string
+	Vars       map[string]interface{}
+	From       time.Time
+	To         time.Time
+	Location   *time.Location
+}
+
+// CountByDay counts rows per local day, with empty days as 0.
+//
+// Example:
+//  nyc, _ := time.LoadLocation("America/New_York")
+//  series, err := ghostutils.CountByDay(db, ghostutils.TimeSeriesQuery{
+//      Table:     "order",
+//      TimeField: "created_at",
+//      From:      time.Now().AddDate(0, 0, -30),
+//      To:        time.Now(),
+//      Location:  nyc,
+//  })
+//
+// Returns:
+//  one SeriesPoint per day from From to To
+func CountByDay(db *surrealdb.DB, q TimeSeriesQuery) ([]SeriesPoint, error) {
+	return TimeSeries(db, q, BucketDay, false)
+}
+
+// CountByHour counts rows per hour.
+func CountByHour(db *surrealdb.DB, q TimeSeriesQuery) ([]SeriesPoint, error) {
+	return TimeSeries(db, q, BucketHour, false)
+}
+
+// SumByDay sums ValueField per local day.
+func SumByDay(db *surrealdb.DB, q TimeSeriesQuery) ([]SeriesPoint, error) {
+	return TimeSeries(db, q, BucketDay, true)
+}
+
+// SumByHour sums ValueField per hour.
+func SumByHour(db *surrealdb.DB, q TimeSeriesQuery) ([]SeriesPoint, error) {
+	return TimeSeries(db, q, BucketHour, true)
+}
+
+// TimeSeries aggregates q into buckets of size bucket, summing
+// ValueField when sum is set and counting rows otherwise. Every
+// bucket from From to To is present, empty ones as 0.
+//
+// The database groups rows by UTC hour (quarter hour for zones with
+// such offsets) and the buckets are folded into local calendar units
+// here, as SurrealDB only floors times in UTC.
+func TimeSeries(db *surrealdb.DB, q TimeSeriesQuery, bucket string, sum bool) ([]SeriesPoint, error) {
+	loc := q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	if !identifierPattern.MatchString(q.Table) || !identifierPattern.MatchString(q.TimeField) {
+		return nil, fmt.Errorf("invalid table or time field")
+	}
+	if sum && !identifierPattern.MatchString(q.ValueField) {
+		return nil, fmt.Errorf("invalid value field %q", q.ValueField)
+	}
+	if !q.To.After(q.From) {
+		return nil, fmt.Errorf("time series range is empty")
+	}
+	switch bucket {
+	case BucketHour, BucketDay, BucketWeek, BucketMonth:
+	default:
+		return nil, fmt.Errorf("unknown bucket %q", bucket)
+	}
+
+	base := "1h"
+	if !wholeHourOffsets(loc, q.From, q.To) {
+		base = "15m"
+	}
+	aggregate := "count()"
+	if sum {
+		aggregate = fmt.Sprintf("math::sum(%s)", q.ValueField)
+	}
+	sql := fmt.Sprintf("SELECT time::floor(%[1]s, %[2]s) AS bucket, %[3]s AS value FROM %[4]s WHERE %[1]s >= <datetime>$ts_from AND %[1]s < <datetime>$ts_to",
+		q.TimeField, base, aggregate, q.Table)
+	if q.Where != "" {
+		sql += " AND (" + q.Where + ")"
+	}
+	sql += " GROUP BY bucket"
+	vars := map[string]interface{}{}
+	for k, v := range q.Vars {
+		vars[k] = v
+	}
+	vars["ts_from"] = q.From.UTC().Format(time.RFC3339Nano)
+	vars["ts_to"] = q.To.UTC().Format(time.RFC3339Nano)
+
+	rows, err := surrealQuery[struct {
+		Bucket time.Time `json:"bucket"`
+		Value  float64   `json:"value"`
+	}](db, sql, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	points := []SeriesPoint{}
+	index := map[int64]int{}
+	for t := bucketStart(q.From.In(loc), bucket); t.Before(q.To); t = nextBucket(t, bucket) {
+		index[t.Unix()] = len(points)
+		points = append(points, SeriesPoint{Time: t})
+	}
+	for _, row := range rows {
+		start := bucketStart(row.Bucket.In(loc), bucket)
+		if i, ok := index[start.Unix()]; ok {
+			points[i].Value += row.Value
+		}
+	}
+	return points, nil
+}
+
+// wholeHourOffsets reports whether loc is a whole number of hours
+// from UTC throughout [from, to].
+func wholeHourOffsets(loc *time.Location, from, to time.Time) bool {
+	for t := from; ; t = t.Add(24 * time.Hour) {
+		if t.After(to) {
+			t = to
+		}
+		if _, offset := t.In(loc).Zone(); offset%3600 != 0 {
+			return false
+		}
+		if !t.Before(to) {
+			return true
+		}
+	}
+}
+
+// bucketStart returns the start of the bucket containing t, in t's
+// location. Weeks start on Monday.
+func bucketStart(t time.Time, bucket string) time.Time {
+	y, m, d := t.Date()
+	switch bucket {
+	case BucketHour:
+		// truncate in absolute time so both occurrences of a repeated
+		// DST hour get their own bucket
+		_, offset := t.Zone()
+		shift := time.Duration(offset) * time.Second
+		return t.Add(shift).Truncate(time.Hour).Add(-shift)
+	case BucketWeek:
+		weekday := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-weekday, 0, 0, 0, 0, t.Location())
+	case BucketMonth:
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func nextBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case BucketHour:
+		return bucketStart(t.Add(time.Hour), bucket)
+	case BucketWeek:
+		return t.AddDate(0, 0, 7)
+	case BucketMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
@@ -0,0 +1,139 @@
+package ghostutils
+
+import (
+	"html/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Where RequestLocation looks for the timezone of a request, after the
+// preferences.
+const (
+	TimezoneCookie = "ghost_tz"
+	TimezoneHeader = "Time-Zone"
+)
+
+// timezoneKey is the gin context key caching the request location.
+const timezoneKey = "ghost-timezone"
+
+// DefaultLocation is the timezone of requests that state none.
+var DefaultLocation = time.UTC
+
+// TimezonePreference is implemented by preference schemas holding a
+// timezone, such as StandardPreferences and the structs embedding it.
+type TimezonePreference interface {
+	TimezoneName() string
+}
+
+// TimezoneScript stores the browser's timezone in the TimezoneCookie,
+// so pages after the first render in the visitor's time. Put it in
+// the head of the layout.
+const TimezoneScript template.HTML = `<script>document.cookie="ghost_tz="+encodeURIComponent(Intl.DateTimeFormat().resolvedOptions().timeZone)+";path=/;max-age=31536000;samesite=lax"</script>`
+
+// RequestLocation returns the timezone of the request: the one of the
+// preferences loaded by Preferences.Middleware, else of the
+// TimezoneCookie, else of the Time-Zone header, else DefaultLocation.
+// Unknown names are skipped.
+//
+// Example:
+//  loc := ghostutils.RequestLocation(c)
+//  today := time.Now().In(loc).Format("2006-01-02")
+func RequestLocation(c *gin.Context) *time.Location {
+	if cached, ok := c.Get(timezoneKey); ok {
+		return cached.(*time.Location)
+	}
+	var names []string
+	if prefs, ok := c.Get(PreferencesKey); ok {
+		if tz, ok := prefs.(TimezonePreference); ok {
+			names = append(names, tz.TimezoneName())
+		}
+	}
+	if cookie, err := c.Cookie(TimezoneCookie); err == nil {
+		names = append(names, cookie)
+	}
+	names = append(names, c.GetHeader(TimezoneHeader))
+	location := DefaultLocation
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if loaded, err := time.LoadLocation(name); err == nil {
+			location = loaded
+			break
+		}
+	}
+	c.Set(timezoneKey, location)
+	return location
+}
+
+// LocalTime returns t, such as a UTC timestamp from the database, in
+// the timezone of the request.
+func LocalTime(c *gin.Context, t time.Time) time.Time {
+	return t.In(RequestLocation(c))
+}
+
+// ParseLocalTime parses a time entered by the user, like the value of
+// a datetime-local input, in the timezone of the request.
+//
+// Example:
+//  startsAt, err := ghostutils.ParseLocalTime(c, "2006-01-02T15:04", c.PostForm("starts_at"))
+//
+// Returns:
+//  the time in UTC, for storing
+//  error when value does not match layout
+func ParseLocalTime(c *gin.Context, layout, value string) (time.Time, error) {
+	t, err := time.ParseInLocation(layout, value, RequestLocation(c))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// TimezoneLayout provides the location of the request for the
+// helpers of TimeFuncMap.
+//
+// Example:
+//  layout.Provide("Timezone", ghostutils.TimezoneLayout)
+func TimezoneLayout(c *gin.Context) (interface{}, error) {
+	return RequestLocation(c), nil
+}
+
+// TimeFuncMap returns the template helpers showing times in a
+// location, usually the one of TimezoneLayout:
+//  localTime loc t layout   t in loc, formatted with layout
+//  localInput loc t         t in loc for a datetime-local input
+//  tzName loc               the name of loc, e.g. Europe/Berlin
+// Zero times render as an empty string.
+//
+// Example:
+//  r.SetFuncMap(ghostutils.TimeFuncMap())
+//
+//  {{localTime .Layout.Timezone .Post.CreatedAt "Jan 2, 2006 15:04"}}
+//  <input type="datetime-local" name="starts_at" value="{{localInput .Layout.Timezone .Event.StartsAt}}">
+func TimeFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"localTime": func(loc *time.Location, t time.Time, layout string) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.In(timeLocation(loc)).Format(layout)
+		},
+		"localInput": func(loc *time.Location, t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.In(timeLocation(loc)).Format("2006-01-02T15:04")
+		},
+		"tzName": func(loc *time.Location) string {
+			return timeLocation(loc).String()
+		},
+	}
+}
+
+func timeLocation(loc *time.Location) *time.Location {
+	if loc == nil {
+		return DefaultLocation
+	}
+	return loc
+}
@@ -0,0 +1,192 @@
+package ghostutils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// ErrTransactionNotRun is returned by TxResult before its transaction
+// has committed.
+var ErrTransactionNotRun = errors.New("transaction has not been committed")
+
+// Tx collects the statements of a transaction. SurrealDB transactions
+// cannot span several requests, so the statements are a deferred
+// batch: nothing is sent until the callback of WithTransaction
+// returns, the statements then run in one BEGIN/COMMIT request, and
+// only then do their TxResults hold rows. The callback can therefore
+// not branch on what a statement returns; a later statement uses the
+// result of an earlier one through a variable bound with Let, and a
+// condition on stored data is checked with Ensure.
+type Tx struct {
+	statements []string
+	vars       map[string]interface{}
+	results    []*TxResult
+	err        error
+}
+
+// TxResult is the result of one statement of a transaction.
+type TxResult struct {
+	raw surrealdb.RawQuery[interface{}]
+	run bool
+}
+
+// Unmarshal decodes the rows of the statement into v.
+func (r *TxResult) Unmarshal(v interface{}) error {
+	if !r.run {
+		return ErrTransactionNotRun
+	}
+	return surrealdb.Unmarshal(r.raw.Result, v)
+}
+
+var txVariablePattern = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Query adds one statement. Its variables are renamed so they cannot
+// clash with those of other statements, which means $name must not
+// appear inside string literals of sql.
+func (tx *Tx) Query(sql string, vars map[string]interface{}) *TxResult {
+	prefix := "tx" + strconv.Itoa(len(tx.statements)) + "_"
+	sql = txVariablePattern.ReplaceAllStringFunc(sql, func(ref string) string {
+		if _, ok := vars[ref[1:]]; ok {
+			return "$" + prefix + ref[1:]
+		}
+		return ref
+	})
+	for name, value := range vars {
+		tx.vars[prefix+name] = value
+	}
+	sql = strings.TrimSpace(sql)
+	if !strings.HasSuffix(sql, ";") {
+		sql += ";"
+	}
+	tx.statements = append(tx.statements, sql)
+	result := &TxResult{}
+	tx.results = append(tx.results, result)
+	return result
+}
+
+var txLetPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Let adds a statement binding the result of sql to the variable
+// $name, which the later statements of the transaction can use, like
+// the id of a record created earlier. The binding itself has no rows
+// to Unmarshal. Names starting with tx are taken by the variables of
+// Query, and name must not be one of vars.
+//
+// Example:
+//  err := ghostutils.WithTransaction(db, func(tx *ghostutils.Tx) error {
+//      tx.Let("order", "CREATE ONLY order CONTENT $data", map[string]interface{}{"data": newOrder})
+//      tx.Query("CREATE order_line CONTENT { order: $order.id, sku: $sku }", map[string]interface{}{"sku": sku})
+//      return nil
+//  })
+func (tx *Tx) Let(name, sql string, vars map[string]interface{}) {
+	if _, shadowed := vars[name]; shadowed || !txLetPattern.MatchString(name) || strings.HasPrefix(name, "tx") {
+		if tx.err == nil {
+			tx.err = fmt.Errorf("invalid transaction variable %q", name)
+		}
+		return
+	}
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	tx.Query("LET $"+name+" = ("+sql+")", vars)
+}
+
+// Create adds a CREATE of data in thing, a table or record id.
+func (tx *Tx) Create(thing string, data interface{}) *TxResult {
+	return tx.Query("CREATE type::thing($tb, $id) CONTENT $data", thingVars(thing, data))
+}
+
+// Merge adds an UPDATE merging data into the record id.
+func (tx *Tx) Merge(id string, data interface{}) *TxResult {
+	return tx.Query("UPDATE type::thing($tb, $id) MERGE $data", thingVars(id, data))
+}
+
+// Delete adds a DELETE of the record id.
+func (tx *Tx) Delete(id string) *TxResult {
+	return tx.Query("DELETE type::thing($tb, $id)", thingVars(id, nil))
+}
+
+// Ensure aborts the transaction with message unless cond, a SurrealQL
+// condition, holds when the statement is reached.
+//
+// Example:
+//  tx.Ensure("(SELECT VALUE balance FROM ONLY type::thing('account', $id)) >= $amount",
+//      map[string]interface{}{"id": from, "amount": amount}, "insufficient funds")
+func (tx *Tx) Ensure(cond string, vars map[string]interface{}, message string) {
+	tx.Query(fmt.Sprintf("IF !(%s) { THROW %s }", cond, strconv.Quote(message)), vars)
+}
+
+// thingVars splits thing into the table and id variables. A bare
+// table creates a record with a random id.
+func thingVars(thing string, data interface{}) map[string]interface{} {
+	table, id := thing, ""
+	if i := strings.Index(thing, ":"); i >= 0 {
+		table, id = thing[:i], strings.Trim(thing[i+1:], "⟨⟩")
+	}
+	if id == "" {
+		id = randomID(10)
+	}
+	vars := map[string]interface{}{"tb": table, "id": id}
+	if data != nil {
+		vars["data"] = data
+	}
+	return vars
+}
+
+// WithTransaction runs the statements fn adds to tx as one atomic
+// transaction, after fn returns, see Tx. If fn returns an error or
+// panics nothing is sent, which is the same as a CANCEL, and the error
+// or panic is passed on. If a statement fails SurrealDB cancels the
+// whole transaction and its error is returned.
+//
+// Example:
+//  var order *ghostutils.TxResult
+//  err := ghostutils.WithTransaction(db, func(tx *ghostutils.Tx) error {
+//      order = tx.Create("order", newOrder)
+//      tx.Merge("product:"+productID, map[string]interface{}{"reserved": true})
+//      return nil
+//  })
+//  if err != nil {
+//      return err
+//  }
+//  var created []Order
+//  err = order.Unmarshal(&created)
+//
+// Returns:
+//  error from fn or from the first failing statement
+func WithTransaction(db GhostDB, fn func(tx *Tx) error) error {
+	tx := &Tx{vars: map[string]interface{}{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	if len(tx.statements) == 0 {
+		return nil
+	}
+	sql := "BEGIN TRANSACTION;\n" + strings.Join(tx.statements, "\n") + "\nCOMMIT TRANSACTION;"
+	statements, err := surrealStatements(db, sql, tx.vars)
+	if err != nil {
+		return err
+	}
+	var failure string
+	for i, statement := range statements {
+		if statement.Status != "OK" && (failure == "" || strings.Contains(failure, "not executed")) {
+			failure = statement.Detail
+		}
+		if i < len(tx.results) {
+			tx.results[i].raw, tx.results[i].run = statement, true
+		}
+	}
+	if failure != "" {
+		for _, result := range tx.results {
+			result.run = false
+		}
+		return fmt.Errorf("transaction cancelled: %s", failure)
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package ghostutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TransformStep is one transformer of a chain of the transforms block
+// of ghost.yaml: the name it was registered under and its options.
+// Chains are named after the tag routes use with Transform, and like
+// every block may differ per environment.
+//
+//  transforms:
+//      legacy:
+//          - use: rename
+//            with: {created_at: createdAt, author: user}
+//          - use: strip-nulls
+//          - use: headers
+//            with: {Deprecation: "true"}
+type TransformStep struct {
+	Use  string            `yaml:"use"`
+	With map[string]string `yaml:"with"`
+}
+
+// Transformer rewrites the decoded JSON bodies of the requests and
+// responses of tagged routes. Either func may be nil. Response runs
+// before the status and headers are sent, so it may set headers.
+type Transformer struct {
+	Request  func(c *gin.Context, body interface{}) (interface{}, error)
+	Response func(c *gin.Context, body interface{}) (interface{}, error)
+}
+
+// TransformerFactory builds a Transformer from the with options of a
+// TransformStep.
+type TransformerFactory func(with map[string]string) (Transformer, error)
+
+// transformers are the factories by name, with the built in ones:
+//  headers      sets the with headers on the response
+//  rename       renames the with keys of the response objects, and
+//               the other way round on the request
+//  drop         removes the with keys from the response objects
+//  strip-nulls  removes the null values of the response objects
+var transformers = struct {
+	sync.RWMutex
+	factories map[string]TransformerFactory
+	chains    map[string][]Transformer
+}{factories: map[string]TransformerFactory{
+	"headers":     headersTransformer,
+	"rename":      renameTransformer,
+	"drop":        dropTransformer,
+	"strip-nulls": stripNullsTransformer,
+}, chains: map[string][]Transformer{}}
+
+// RegisterTransformer makes factory usable by name in the transforms
+// block. Register before Setup, which builds the chains.
+//
+// Example:
+//  ghostutils.RegisterTransformer("envelope", func(with map[string]string) (ghostutils.Transformer, error) {
+//      key := with["key"]
+//      return ghostutils.Transformer{Response: func(c *gin.Context, body interface{}) (interface{}, error) {
+//          return map[string]interface{}{key: body}, nil
+//      }}, nil
+//  })
+func RegisterTransformer(name string, factory TransformerFactory) {
+	transformers.Lock()
+	defer transformers.Unlock()
+	transformers.factories[name] = factory
+}
+
+// SetTransformChain sets the chain of tag, replacing the one of the
+// transforms block; an empty chain leaves the routes of tag alone.
+func SetTransformChain(tag string, chain ...Transformer) {
+	transformers.Lock()
+	defer transformers.Unlock()
+	transformers.chains[tag] = chain
+}
+
+// TransformChains builds the chains of the transforms block.
+//
+// Returns:
+//  the chains by tag
+//  error naming the step whose transformer is unknown or refused its
+//  options
+func (ghostConfig GhostConfig) TransformChains() (map[string][]Transformer, error) {
+	transformers.RLock()
+	defer transformers.RUnlock()
+	tags := make([]string, 0, len(ghostConfig.Transforms))
+	for tag := range ghostConfig.Transforms {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	chains := map[string][]Transformer{}
+	for _, tag := range tags {
+		for i, step := range ghostConfig.Transforms[tag] {
+			factory, ok := transformers.factories[step.Use]
+			if !ok {
+				return nil, fmt.Errorf("transforms.%s[%d]: unknown transformer %q", tag, i, step.Use)
+			}
+			transformer, err := factory(step.With)
+			if err != nil {
+				return nil, fmt.Errorf("transforms.%s[%d] %s: %w", tag, i, step.Use, err)
+			}
+			chains[tag] = append(chains[tag], transformer)
+		}
+	}
+	return chains, nil
+}
+
+// installTransforms makes the chains of the transforms block those of
+// Transform.
+func (ghostConfig GhostConfig) installTransforms() error {
+	chains, err := ghostConfig.TransformChains()
+	if err != nil {
+		return err
+	}
+	for tag, chain := range chains {
+		SetTransformChain(tag, chain...)
+	}
+	return nil
+}
+
+// Transform tags the routes it is used on with tag: the JSON bodies of
+// their requests and responses go through the chain of tag, looked up
+// per request, so the routes of a tag without a chain in the current
+// environment are served as they are. Other bodies, and streamed
+// responses, are not transformed.
+//
+// Example:
+//  v1 := r.Group("/api/v1", ghostutils.Transform("legacy"))
+//  v1.GET("/posts", listPosts) // the handler knows nothing of old clients
+func Transform(tag string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		transformers.RLock()
+		chain := transformers.chains[tag]
+		transformers.RUnlock()
+		runTransforms(c, chain)
+	}
+}
+
+// runTransforms runs the rest of the handlers with the bodies going
+// through chain.
+func runTransforms(c *gin.Context, chain []Transformer) {
+	if len(chain) == 0 {
+		c.Next()
+		return
+	}
+	if err := transformRequest(c, chain); err != nil {
+		Fail(c, err)
+		return
+	}
+	writer := &transformWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+	c.Writer = writer.ResponseWriter
+	if err := writer.finish(c, chain); err != nil {
+		c.Error(err)
+	}
+}
+
+func isJSON(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json") || strings.Contains(contentType, "+json")
+}
+
+func transformRequest(c *gin.Context, chain []Transformer) error {
+	if c.Request.Body == nil || !isJSON(c.ContentType()) {
+		return nil
+	}
+	raw, err := io.ReadAll(c.Request.Body)
+	c.Request.Body.Close()
+	if err != nil {
+		return err
+	}
+	body, err := decodeTransformed(raw)
+	if err == nil {
+		changed := false
+		for _, transformer := range chain {
+			if transformer.Request == nil {
+				continue
+			}
+			if body, err = transformer.Request(c, body); err != nil {
+				return err
+			}
+			changed = true
+		}
+		if changed {
+			if raw, err = json.Marshal(body); err != nil {
+				return err
+			}
+		}
+	}
+	// a body that is not JSON is left for the binding to reject
+	c.Request.Body = io.NopCloser(bytes.NewReader(raw))
+	c.Request.ContentLength = int64(len(raw))
+	return nil
+}
+
+func decodeTransformed(raw []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var body interface{}
+	err := decoder.Decode(&body)
+	return body, err
+}
+
+// transformWriter holds the response until the chain ran, or passes it
+// through once flushed.
+type transformWriter struct {
+	gin.ResponseWriter
+	body    bytes.Buffer
+	status  int
+	written bool
+	direct  bool
+}
+
+func (w *transformWriter) Write(data []byte) (int, error) {
+	if w.direct {
+		return w.ResponseWriter.Write(data)
+	}
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *transformWriter) WriteString(s string) (int, error) {
+	if w.direct {
+		return w.ResponseWriter.WriteString(s)
+	}
+	w.written = true
+	return w.body.WriteString(s)
+}
+
+func (w *transformWriter) WriteHeader(code int) {
+	if w.direct {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code > 0 {
+		w.status = code
+	}
+}
+
+func (w *transformWriter) WriteHeaderNow() {
+	if w.direct {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.written = true
+}
+
+func (w *transformWriter) Status() int {
+	if w.direct {
+		return w.ResponseWriter.Status()
+	}
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *transformWriter) Size() int {
+	if w.direct {
+		return w.ResponseWriter.Size()
+	}
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *transformWriter) Written() bool {
+	if w.direct {
+		return w.ResponseWriter.Written()
+	}
+	return w.written
+}
+
+// Flush sends what was held untransformed, and the rest as it comes.
+func (w *transformWriter) Flush() {
+	if !w.direct {
+		w.send(w.body.Bytes())
+		w.direct = true
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *transformWriter) send(body []byte) {
+	w.ResponseWriter.WriteHeader(w.Status())
+	w.ResponseWriter.WriteHeaderNow()
+	if len(body) > 0 {
+		w.ResponseWriter.Write(body)
+	}
+}
+
+// finish runs the chain on the held response and sends it. A failing
+// transformer sends the response as the handler wrote it.
+func (w *transformWriter) finish(c *gin.Context, chain []Transformer) error {
+	if w.direct {
+		return nil
+	}
+	if !w.written {
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+		return nil
+	}
+	raw := w.body.Bytes()
+	if !isJSON(w.Header().Get("Content-Type")) || len(raw) == 0 {
+		w.send(raw)
+		return nil
+	}
+	body, err := decodeTransformed(raw)
+	if err != nil {
+		w.send(raw)
+		return nil
+	}
+	for _, transformer := range chain {
+		if transformer.Response == nil {
+			continue
+		}
+		if body, err = transformer.Response(c, body); err != nil {
+			w.send(raw)
+			return err
+		}
+	}
+	transformed, err := json.Marshal(body)
+	if err != nil {
+		w.send(raw)
+		return err
+	}
+	w.Header().Del("Content-Length")
+	w.send(transformed)
+	return nil
+}
+
+func headersTransformer(with map[string]string) (Transformer, error) {
+	if len(with) == 0 {
+		return Transformer{}, fmt.Errorf("with lists no headers")
+	}
+	return Transformer{Response: func(c *gin.Context, body interface{}) (interface{}, error) {
+		for name, value := range with {
+			c.Writer.Header().Set(name, value)
+		}
+		return body, nil
+	}}, nil
+}
+
+func renameTransformer(with map[string]string) (Transformer, error) {
+	if len(with) == 0 {
+		return Transformer{}, fmt.Errorf("with lists no keys")
+	}
+	back := make(map[string]string, len(with))
+	for from, to := range with {
+		back[to] = from
+	}
+	return Transformer{
+		Request: func(c *gin.Context, body interface{}) (interface{}, error) {
+			return mapObjects(body, func(object map[string]interface{}) { renameKeys(object, back) }), nil
+		},
+		Response: func(c *gin.Context, body interface{}) (interface{}, error) {
+			return mapObjects(body, func(object map[string]interface{}) { renameKeys(object, with) }), nil
+		},
+	}, nil
+}
+
+func renameKeys(object map[string]interface{}, names map[string]string) {
+	renamed := map[string]interface{}{}
+	for from, to := range names {
+		if value, ok := object[from]; ok {
+			delete(object, from)
+			renamed[to] = value
+		}
+	}
+	for key, value := range renamed {
+		object[key] = value
+	}
+}
+
+func dropTransformer(with map[string]string) (Transformer, error) {
+	if len(with) == 0 {
+		return Transformer{}, fmt.Errorf("with lists no keys")
+	}
+	return Transformer{Response: func(c *gin.Context, body interface{}) (interface{}, error) {
+		return mapObjects(body, func(object map[string]interface{}) {
+			for key := range with {
+				delete(object, key)
+			}
+		}), nil
+	}}, nil
+}
+
+func stripNullsTransformer(with map[string]string) (Transformer, error) {
+	return Transformer{Response: func(c *gin.Context, body interface{}) (interface{}, error) {
+		return mapObjects(body, func(object map[string]interface{}) {
+			for key, value := range object {
+				if value == nil {
+					delete(object, key)
+				}
+			}
+		}), nil
+	}}, nil
+}
+
+// mapObjects calls fn on every object of a decoded JSON value, the
+// nested ones first.
+func mapObjects(value interface{}, fn func(map[string]interface{})) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = mapObjects(item, fn)
+		}
+		fn(value)
+	case []interface{}:
+		for i, item := range value {
+			value[i] = mapObjects(item, fn)
+		}
+	}
+	return value
+}
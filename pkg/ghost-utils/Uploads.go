@@ -0,0 +1,519 @@
+package ghostutils
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// UploadsConfig is the `uploads:` block of ghost.yaml.
+//
+// Example:
+//  uploads:
+//    max-size: 10485760
+//    types: [image/*, application/pdf]
+//    storage: s3
+//    s3:
+//      endpoint: http://localhost:9000
+//      region: us-east-1
+//      bucket: uploads
+//      access-key: ${S3_ACCESS_KEY}
+//      secret-key: ${S3_SECRET_KEY}
+//      path-style: true
+type UploadsConfig struct {
+	// MaxSize is the largest upload in bytes, DefaultUploadMaxSize by
+	// default.
+	MaxSize int64 `yaml:"max-size"`
+	// Types are the accepted MIME types, sniffed from the content;
+	// "image/*" accepts every image. Any type is accepted when empty.
+	Types []string `yaml:"types"`
+	// Storage is local, the default, or s3.
+	Storage string `yaml:"storage"`
+	// Root is the directory of the local storage, DefaultUploadRoot by
+	// default.
+	Root  string   `yaml:"root"`
+	S3    S3Config `yaml:"s3"`
+	Table string   `yaml:"table"`
+}
+
+// S3Config is the bucket of the s3 upload storage, see S3Storage.
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"access-key"`
+	SecretKey string `yaml:"secret-key"`
+	PathStyle bool   `yaml:"path-style"`
+}
+
+// Defaults of the uploads block applied by Validate.
+const (
+	DefaultUploadMaxSize = 10 << 20
+	DefaultUploadRoot    = "./uploads"
+	DefaultUploadTable   = "upload"
+)
+
+// Upload errors, answered 404, 413 and 415 by Fail.
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrUploadTooLarge = errors.New("upload too large")
+	ErrUploadType     = errors.New("upload type not accepted")
+)
+
+// UploadSchema defines the table of the uploads with the default
+// table. Run it once, or ship it as a migration.
+const UploadSchema = `
+DEFINE TABLE upload SCHEMALESS;
+DEFINE FIELD key ON upload TYPE string;
+DEFINE FIELD size ON upload TYPE int;
+DEFINE FIELD created_at ON upload TYPE datetime;
+DEFINE INDEX upload_key ON upload FIELDS key UNIQUE;
+DEFINE INDEX upload_owner ON upload FIELDS owner, created_at;
+`
+
+// Upload is the metadata of an uploaded file.
+type Upload struct {
+	ID string `json:"id,omitempty"`
+	// Key is the storage key of the content.
+	Key string `json:"key"`
+	// Name is the file name given by the client.
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Owner       string `json:"owner,omitempty"`
+	// Public uploads are served to anyone, see Uploads.Authorize.
+	Public    bool      `json:"public"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewStorage returns the storage of the uploads block.
+//
+// Returns:
+//  Storage
+//  error for an unknown storage or an s3 storage without bucket
+func (ghostConfig GhostConfig) NewStorage() (Storage, error) {
+	config := ghostConfig.Uploads
+	switch config.Storage {
+	case "", "local":
+		root := config.Root
+		if root == "" {
+			root = DefaultUploadRoot
+		}
+		return LocalStorage{Root: root}, nil
+	case "s3":
+		s3 := config.S3
+		if s3.Bucket == "" || s3.Region == "" {
+			return nil, errors.New("uploads.s3.bucket and uploads.s3.region are required for the s3 storage")
+		}
+		return S3Storage{
+			Endpoint:  s3.Endpoint,
+			Region:    s3.Region,
+			Bucket:    s3.Bucket,
+			AccessKey: s3.AccessKey,
+			SecretKey: s3.SecretKey,
+			PathStyle: s3.PathStyle,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown uploads storage %q", config.Storage)
+}
+
+// NewUploads returns the uploads on db stored in the storage of the
+// uploads block.
+//
+// Example:
+//  uploads, err := ghostConfig.NewUploads(db)
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  uploads.Mount(r.Group("/files"))
+func (ghostConfig GhostConfig) NewUploads(db *surrealdb.DB) (*Uploads, error) {
+	storage, err := ghostConfig.NewStorage()
+	if err != nil {
+		return nil, err
+	}
+	config := ghostConfig.Uploads
+	return &Uploads{DB: db, Storage: storage, Table: config.Table, MaxSize: config.MaxSize, Types: config.Types}, nil
+}
+
+// Uploads receives files into a Storage, keeping their metadata in
+// SurrealDB, and serves them to the callers allowed to read them.
+type Uploads struct {
+	DB      *surrealdb.DB
+	Storage Storage
+	// Table is DefaultUploadTable by default.
+	Table string
+	// MaxSize is the largest upload in bytes, DefaultUploadMaxSize by
+	// default.
+	MaxSize int64
+	// Types are the accepted MIME types, see UploadsConfig.
+	Types []string
+	// Prefix of the storage keys, "uploads" by default.
+	Prefix string
+	// Authorize tells whether the caller may download, or delete when
+	// write is set, upload. By default public uploads are served to
+	// anyone and the others to their owner only. Its errors answer
+	// through Fail.
+	Authorize func(c *gin.Context, upload Upload, write bool) error
+}
+
+// EnsureSchema runs UploadSchema against the database.
+func (u *Uploads) EnsureSchema() error {
+	schema := UploadSchema
+	if table := u.table(); table != DefaultUploadTable {
+		schema = strings.ReplaceAll(schema, "ON upload ", "ON "+table+" ")
+		schema = strings.ReplaceAll(schema, "TABLE upload ", "TABLE "+table+" ")
+	}
+	_, err := u.DB.Query(schema, map[string]interface{}{})
+	return err
+}
+
+func (u *Uploads) table() string {
+	if u.Table == "" {
+		return DefaultUploadTable
+	}
+	return u.Table
+}
+
+func (u *Uploads) maxSize() int64 {
+	if u.MaxSize <= 0 {
+		return DefaultUploadMaxSize
+	}
+	return u.MaxSize
+}
+
+// accepts tells whether contentType is one of the Types.
+func (u *Uploads) accepts(contentType string) bool {
+	if len(u.Types) == 0 {
+		return true
+	}
+	for _, accepted := range u.Types {
+		if accepted == contentType || strings.HasSuffix(accepted, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(accepted, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeLimiter fails reads past its limit with ErrUploadTooLarge.
+type sizeLimiter struct {
+	r    io.Reader
+	left int64
+	hash io.Writer
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, ErrUploadTooLarge
+	}
+	l.hash.Write(p[:n])
+	return n, err
+}
+
+// Save stores the content of r for owner, named name, checking its
+// size and the MIME type sniffed from its first bytes; the type
+// declared by the client is ignored.
+//
+// Returns:
+//  Upload as stored
+//  error, ErrUploadTooLarge or ErrUploadType for rejected content
+func (u *Uploads) Save(ctx context.Context, owner, name string, r io.Reader, public bool) (Upload, error) {
+	buffered := bufio.NewReaderSize(r, 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return Upload{}, err
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if contentType == "text/plain" || contentType == "application/octet-stream" {
+		// the sniffer does not know them, trust the extension
+		if byExtension, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name))); err == nil && !strings.HasPrefix(byExtension, "text/html") {
+			contentType = byExtension
+		}
+	}
+	if !u.accepts(contentType) {
+		return Upload{}, ErrUploadType
+	}
+	prefix := u.Prefix
+	if prefix == "" {
+		prefix = "uploads"
+	}
+	now := time.Now().UTC()
+	upload := Upload{
+		Key:         path.Join(prefix, now.Format("2006/01"), randomID(16)+strings.ToLower(path.Ext(name))),
+		Name:        path.Base(strings.ReplaceAll(name, "\\", "/")),
+		ContentType: contentType,
+		Owner:       owner,
+		Public:      public,
+	}
+	hash := sha256.New()
+	limited := &sizeLimiter{r: buffered, left: u.maxSize(), hash: hash}
+	counted := &countingReader{r: limited}
+	if err := u.Storage.Put(ctx, upload.Key, counted, contentType); err != nil {
+		u.Storage.Delete(ctx, upload.Key)
+		return Upload{}, err
+	}
+	upload.Size, upload.SHA256 = counted.n, hex.EncodeToString(hash.Sum(nil))
+	sets := "key = $key, name = $name, content_type = $content_type, size = $size, sha256 = $sha256, public = $public, created_at = time::now()"
+	if owner != "" {
+		sets += ", owner = $owner"
+	}
+	stored, _, err := surrealFirst[Upload](u.DB, "CREATE type::table($tb) SET "+sets, map[string]interface{}{
+		"tb":           u.table(),
+		"key":          upload.Key,
+		"name":         upload.Name,
+		"content_type": upload.ContentType,
+		"size":         upload.Size,
+		"sha256":       upload.SHA256,
+		"public":       upload.Public,
+		"owner":        upload.Owner,
+	})
+	if err != nil {
+		u.Storage.Delete(ctx, upload.Key)
+	}
+	return stored, err
+}
+
+// Receive saves the file of the multipart field of the request for
+// the current identity, streaming it to the storage without buffering
+// the form.
+//
+// Example:
+//  r.POST("/avatar", ghostutils.RequireIdentity(), func(c *gin.Context) {
+//      upload, err := uploads.Receive(c, "avatar", true)
+//      if err != nil {
+//          ghostutils.Fail(c, err)
+//          return
+//      }
+//      ghostutils.Created(c, upload)
+//  })
+//
+// Returns:
+//  Upload as stored
+//  error, ErrUploadTooLarge, ErrUploadType or ErrStorageKey without
+//  the field
+func (u *Uploads) Receive(c *gin.Context, field string, public bool) (Upload, error) {
+	// the form fields and part headers on top of the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, u.maxSize()+1<<16)
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return Upload{}, ErrUploadNotFound
+	}
+	identity, _ := CurrentIdentity(c)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return Upload{}, ErrUploadNotFound
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return Upload{}, ErrUploadTooLarge
+		}
+		if err != nil {
+			return Upload{}, err
+		}
+		if part.FormName() != field || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		upload, err := u.Save(c.Request.Context(), identity.ID, part.FileName(), part, public)
+		part.Close()
+		if errors.As(err, &tooLarge) {
+			err = ErrUploadTooLarge
+		}
+		return upload, err
+	}
+}
+
+// Get returns the upload with id, or ErrUploadNotFound.
+func (u *Uploads) Get(ctx context.Context, id string) (Upload, error) {
+	table, key := splitRecordID(id, "")
+	if table == "" {
+		table = u.table()
+	}
+	if table != u.table() || key == "" {
+		return Upload{}, ErrUploadNotFound
+	}
+	upload, ok, err := surrealFirst[Upload](u.DB, "SELECT * FROM type::thing($tb, $id)", map[string]interface{}{
+		"tb": table,
+		"id": key,
+	})
+	if err == nil && !ok {
+		err = ErrUploadNotFound
+	}
+	return upload, err
+}
+
+// List returns the uploads of owner, the newest first.
+func (u *Uploads) List(ctx context.Context, owner string, page, perPage int) (Page[Upload], error) {
+	q := Select().From(u.table()).WhereField("owner", "=", owner).OrderByDesc("created_at")
+	return Paginate[Upload](u.DB, q, page, perPage)
+}
+
+// Delete removes the upload with id and its content.
+func (u *Uploads) Delete(ctx context.Context, id string) error {
+	upload, err := u.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := u.Storage.Delete(ctx, upload.Key); err != nil {
+		return err
+	}
+	table, key := splitRecordID(upload.ID, u.table())
+	_, err = surrealStatements(u.DB, "DELETE type::thing($tb, $id)", map[string]interface{}{
+		"tb": table,
+		"id": key,
+	})
+	return err
+}
+
+// authorize answers whether the caller may read or delete upload.
+func (u *Uploads) authorize(c *gin.Context, upload Upload, write bool) error {
+	if u.Authorize != nil {
+		return u.Authorize(c, upload, write)
+	}
+	if upload.Public && !write {
+		return nil
+	}
+	identity, ok := CurrentIdentity(c)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if identity.ID != upload.Owner {
+		// hide the uploads of others
+		return ErrUploadNotFound
+	}
+	return nil
+}
+
+// Serve answers the content of upload, with its type and name, after
+// checking the caller may read it. Browsers get images, PDFs and
+// plain text inline and download the rest; the content is never
+// sniffed by them.
+func (u *Uploads) Serve(c *gin.Context, upload Upload) {
+	if err := u.authorize(c, upload, false); err != nil {
+		Fail(c, err)
+		return
+	}
+	etag := `"` + upload.SHA256 + `"`
+	cacheControl := "private, max-age=3600"
+	if upload.Public {
+		cacheControl = "public, max-age=86400"
+	}
+	c.Header("Cache-Control", cacheControl)
+	c.Header("ETag", etag)
+	if upload.SHA256 != "" && c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	content, err := u.Storage.Open(c.Request.Context(), upload.Key)
+	if errors.Is(err, os.ErrNotExist) {
+		err = ErrUploadNotFound
+	}
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	defer content.Close()
+	disposition := "attachment"
+	if strings.HasPrefix(upload.ContentType, "image/") && upload.ContentType != "image/svg+xml" ||
+		upload.ContentType == "application/pdf" || upload.ContentType == "text/plain" {
+		disposition = "inline"
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": upload.Name}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+	c.DataFromReader(http.StatusOK, upload.Size, upload.ContentType, content, map[string]string{
+		"Content-Length": strconv.FormatInt(upload.Size, 10),
+	})
+}
+
+// Mount registers the endpoints of the uploads on g:
+//  POST   /           upload the file field, public when public=true
+//  GET    /           the uploads of the caller
+//  GET    /:id        download an upload
+//  GET    /:id/meta   the metadata of an upload
+//  DELETE /:id        delete an upload
+// Uploading and listing require an Identity.
+func (u *Uploads) Mount(g *gin.RouterGroup) {
+	g.POST("", RequireIdentity(), u.create)
+	g.GET("", RequireIdentity(), u.list)
+	g.GET("/:id", u.download)
+	g.GET("/:id/meta", u.meta)
+	g.DELETE("/:id", RequireIdentity(), u.delete)
+}
+
+func (u *Uploads) create(c *gin.Context) {
+	upload, err := u.Receive(c, "file", c.Query("public") == "true")
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	Created(c, upload)
+}
+
+func (u *Uploads) list(c *gin.Context) {
+	identity, _ := CurrentIdentity(c)
+	number, perPage := PageParams(c, 20, 100)
+	page, err := u.List(c.Request.Context(), identity.ID, number, perPage)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	RespondPage(c, page.Envelope(c.Request.URL))
+}
+
+// find returns the upload of the id parameter.
+func (u *Uploads) find(c *gin.Context, write bool) (Upload, bool) {
+	upload, err := u.Get(c.Request.Context(), c.Param("id"))
+	if err == nil {
+		err = u.authorize(c, upload, write)
+	}
+	if err != nil {
+		Fail(c, err)
+		return upload, false
+	}
+	return upload, true
+}
+
+func (u *Uploads) download(c *gin.Context) {
+	upload, err := u.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	u.Serve(c, upload)
+}
+
+func (u *Uploads) meta(c *gin.Context) {
+	if upload, ok := u.find(c, false); ok {
+		OK(c, upload)
+	}
+}
+
+func (u *Uploads) delete(c *gin.Context) {
+	upload, ok := u.find(c, true)
+	if !ok {
+		return
+	}
+	if err := u.Delete(c.Request.Context(), upload.ID); err != nil {
+		Fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,280 @@
+package ghostutils
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/text/language"
+)
+
+// validationEngine is gin's validator, with the rules of this package
+// and the app registered on it.
+var validationEngine = newValidationEngine()
+
+func newValidationEngine() *validator.Validate {
+	engine, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		// gin's validator was replaced; rules are registered on a
+		// validator of our own, used by ValidateRecord
+		engine = validator.New()
+		engine.SetTagName("binding")
+	}
+	engine.RegisterValidation("range", validateRange)
+	return engine
+}
+
+// validateRange checks range=min..max against numbers and lengths.
+func validateRange(fl validator.FieldLevel) bool {
+	bounds := strings.SplitN(fl.Param(), "..", 2)
+	if len(bounds) != 2 {
+		return false
+	}
+	low, errLow := strconv.ParseFloat(bounds[0], 64)
+	high, errHigh := strconv.ParseFloat(bounds[1], 64)
+	if errLow != nil || errHigh != nil {
+		return false
+	}
+	var n float64
+	field := fl.Field()
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(field.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(field.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = field.Float()
+	case reflect.String:
+		n = float64(len([]rune(field.String())))
+	case reflect.Slice, reflect.Map, reflect.Array:
+		n = float64(field.Len())
+	default:
+		return false
+	}
+	return n >= low && n <= high
+}
+
+// RegisterRule adds the rule tag, checked by fn with the value of the
+// field and the parameter of the tag, and its English message. Call it
+// at startup, before any request is bound.
+//
+// Rules are the binding tags of a struct, checked by gin's validator
+// everywhere: by Bind and BindQuery, by BindForm for forms, and by a
+// Repository with ValidateWrites for records written in code. The
+// tags of the validator are available, such as required, email, url,
+// min, max, oneof and eqfield, plus the ones of this package:
+//  range=1..10   a number, or a length, between both bounds
+//
+// Rules of the app are added with RegisterRule and RegisterStructRule,
+// and their messages, in any locale, with SetValidationMessages.
+//
+// Example:
+//  type Event struct {
+//      Title    string    `json:"title" binding:"required,max=120"`
+//      Seats    int       `json:"seats" binding:"range=1..500"`
+//      Slug     string    `json:"slug" binding:"required,slug"`
+//      StartsAt time.Time `json:"starts_at"`
+//      EndsAt   time.Time `json:"ends_at" binding:"gtfield=StartsAt"`
+//  }
+//
+//  ghostutils.RegisterRule("slug", func(value interface{}, param string) bool {
+//      s, _ := value.(string)
+//      return slugPattern.MatchString(s)
+//  }, "must only contain lowercase letters, digits and dashes")
+//  ghostutils.SetValidationMessages("de", map[string]string{
+//      "required": "ist erforderlich",
+//      "slug":     "darf nur Kleinbuchstaben, Ziffern und Bindestriche enthalten",
+//  })
+func RegisterRule(tag string, fn func(value interface{}, param string) bool, message string) {
+	validationEngine.RegisterValidation(tag, func(fl validator.FieldLevel) bool {
+		return fn(fl.Field().Interface(), fl.Param())
+	})
+	if message != "" {
+		SetValidationMessages("en", map[string]string{tag: message})
+	}
+}
+
+// RegisterStructRule adds a rule checking records of T as a whole, for
+// rules across fields the tags cannot express. It calls report with
+// the Go name of each invalid field and the tag whose message is
+// shown, such as a tag added with SetValidationMessages.
+//
+// Example:
+//  ghostutils.RegisterStructRule(func(order Order, report func(field, tag, param string)) {
+//      if order.Shipping == "pickup" && order.Address != "" {
+//          report("Address", "excluded_with", "pickup")
+//      }
+//  })
+func RegisterStructRule[T any](rule func(record T, report func(field, tag, param string))) {
+	var zero T
+	validationEngine.RegisterStructValidation(func(sl validator.StructLevel) {
+		record, ok := sl.Current().Interface().(T)
+		if !ok {
+			return
+		}
+		rule(record, func(field, tag, param string) {
+			var value interface{}
+			if fv := sl.Current().FieldByName(field); fv.IsValid() {
+				value = fv.Interface()
+			}
+			sl.ReportError(value, field, field, tag, param)
+		})
+	}, zero)
+}
+
+// ValidateRecord checks v, a struct or pointer to one, against its
+// binding tags and the registered rules, with messages in the locale
+// of ctx when it is a request.
+//
+// Returns:
+//  *BindError listing the invalid fields, nil when v is valid
+func ValidateRecord(ctx context.Context, v interface{}) error {
+	err := validationEngine.Struct(v)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*validator.InvalidValidationError); ok {
+		return err
+	}
+	return newBindError(reflect.TypeOf(v), err, contextLocale(ctx))
+}
+
+var (
+	validationMessagesMu sync.RWMutex
+	// validationMessages holds the messages of each locale by tag. A
+	// tag may have one message per kind, tag.string for lengths and
+	// tag.items for counts. {param} is replaced by the tag's parameter.
+	validationMessages = map[string]map[string]string{
+		"en": {
+			"required":     "is required",
+			"email":        "must be a valid email address",
+			"url":          "must be a valid URL",
+			"uuid":         "must be a valid UUID",
+			"min":          "must be at least {param}",
+			"min.string":   "must be at least {param} characters",
+			"min.items":    "must have at least {param} items",
+			"gte":          "must be at least {param}",
+			"gte.string":   "must be at least {param} characters",
+			"gte.items":    "must have at least {param} items",
+			"max":          "must be at most {param}",
+			"max.string":   "must be at most {param} characters",
+			"max.items":    "must have at most {param} items",
+			"lte":          "must be at most {param}",
+			"lte.string":   "must be at most {param} characters",
+			"lte.items":    "must have at most {param} items",
+			"gt":           "must be more than {param}",
+			"gt.string":    "must be more than {param} characters",
+			"gt.items":     "must have more than {param} items",
+			"lt":           "must be less than {param}",
+			"lt.string":    "must be less than {param} characters",
+			"lt.items":     "must have less than {param} items",
+			"len":          "must be exactly {param}",
+			"len.string":   "must be exactly {param} characters",
+			"len.items":    "must have exactly {param} items",
+			"range":        "must be between {param}",
+			"range.string": "must be between {param} characters",
+			"range.items":  "must have between {param} items",
+			"oneof":        "must be one of {param}",
+			"eqfield":      "must match {param}",
+			"nefield":      "must differ from {param}",
+			"gtfield":      "must be after {param}",
+			"gtefield":     "must not be before {param}",
+			"ltfield":      "must be before {param}",
+			"ltefield":     "must not be after {param}",
+			"invalid":      "is invalid",
+		},
+	}
+)
+
+// SetValidationMessages adds or replaces messages of locale, a BCP 47
+// tag like "de" or "pt-BR", by rule tag. Locales without a message
+// for a rule fall back to their base language, then to English.
+func SetValidationMessages(locale string, messages map[string]string) {
+	validationMessagesMu.Lock()
+	defer validationMessagesMu.Unlock()
+	catalog := validationMessages[locale]
+	if catalog == nil {
+		catalog = map[string]string{}
+		validationMessages[locale] = catalog
+	}
+	for tag, message := range messages {
+		catalog[tag] = message
+	}
+}
+
+// ValidationMessage returns the message of a validation error in
+// locale, without the field name, like "must be at least 3 characters".
+func ValidationMessage(fieldErr validator.FieldError, locale string) string {
+	tag := fieldErr.Tag()
+	keys := []string{tag}
+	switch fieldErr.Kind() {
+	case reflect.String:
+		keys = []string{tag + ".string", tag}
+	case reflect.Slice, reflect.Map, reflect.Array:
+		keys = []string{tag + ".items", tag}
+	}
+	param := fieldErr.Param()
+	switch tag {
+	case "oneof":
+		param = strings.Join(strings.Fields(param), ", ")
+	case "range":
+		param = strings.Replace(param, "..", " and ", 1)
+	}
+	validationMessagesMu.RLock()
+	defer validationMessagesMu.RUnlock()
+	for _, candidate := range localeFallbacks(locale) {
+		catalog := validationMessages[candidate]
+		for _, key := range append(keys, "invalid") {
+			if message, ok := catalog[key]; ok {
+				return strings.ReplaceAll(message, "{param}", param)
+			}
+		}
+	}
+	return "is invalid"
+}
+
+// localeFallbacks returns locale, its base language and English.
+func localeFallbacks(locale string) []string {
+	fallbacks := []string{}
+	if locale != "" {
+		fallbacks = append(fallbacks, locale)
+		if base, _ := language.Make(locale).Base(); base.String() != locale {
+			fallbacks = append(fallbacks, base.String())
+		}
+	}
+	return append(fallbacks, "en")
+}
+
+// LocalePreference is implemented by preference schemas holding a
+// locale, such as StandardPreferences.
+type LocalePreference interface {
+	LocaleName() string
+}
+
+// RequestLocale returns the locale of the request: the one of the
+// preferences loaded by Preferences.Middleware, else the first of the
+// Accept-Language header, else "en".
+func RequestLocale(c *gin.Context) string {
+	if prefs, ok := c.Get(PreferencesKey); ok {
+		if locale, ok := prefs.(LocalePreference); ok && locale.LocaleName() != "" {
+			return locale.LocaleName()
+		}
+	}
+	if tags, _, err := language.ParseAcceptLanguage(c.GetHeader("Accept-Language")); err == nil && len(tags) > 0 {
+		return tags[0].String()
+	}
+	return "en"
+}
+
+// contextLocale returns the locale of ctx if it is a request.
+func contextLocale(ctx context.Context) string {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		return RequestLocale(c)
+	}
+	return "en"
+}
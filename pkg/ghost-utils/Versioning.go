@@ -0,0 +1,177 @@
+package ghostutils
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIVersionHeader names the version of the API on every response of
+// a VersionedAPI.
+const APIVersionHeader = "API-Version"
+
+// APIVersionKey is the gin context key holding the name of the version
+// serving a request of a VersionedAPI.
+const APIVersionKey = "ghost-api-version"
+
+// APIVersion is one version of a VersionedAPI, with its own routes.
+type APIVersion struct {
+	Name   string
+	Routes []GhostRoute
+	// Deprecated versions answer with the Deprecation header, and
+	// Sunset and Link when set.
+	Deprecated bool
+	// Sunset is when the version stops being served, if known.
+	Sunset time.Time
+	// Successor is the name of the version replacing this one, linked
+	// as its successor-version.
+	Successor string
+}
+
+// Deprecate marks the version deprecated, to be removed at sunset if
+// it is not zero, in favour of the version named successor.
+//
+// Example:
+//  v1.Deprecate(time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), "v2")
+func (v *APIVersion) Deprecate(sunset time.Time, successor string) *APIVersion {
+	v.Deprecated = true
+	v.Sunset = sunset
+	v.Successor = successor
+	return v
+}
+
+// VersionedAPI serves versions of an API side by side, each under
+// Prefix/name, like /api/v1 and /api/v2, and the Default version also
+// under Prefix itself.
+//
+// Example:
+//  api := ghostutils.NewVersionedAPI("/api")
+//  api.Version("v1", usersV1, postsV1).Deprecate(sunset, "v2")
+//  api.Version("v2", usersV2, postsV2)
+//  api.Default = "v2"
+//  if err := api.Register(r, db); err != nil {   // /api/v1/users, /api/v2/users, /api/users
+//      log.Fatal(err)
+//  }
+type VersionedAPI struct {
+	Prefix string
+	// Default is the version also served under Prefix, none when empty.
+	Default  string
+	versions []*APIVersion
+}
+
+// NewVersionedAPI returns a VersionedAPI under prefix, without versions.
+func NewVersionedAPI(prefix string) *VersionedAPI {
+	return &VersionedAPI{Prefix: prefix}
+}
+
+// Version returns the version named name, added in the order of the
+// calls, with routes appended to it.
+func (api *VersionedAPI) Version(name string, routes ...GhostRoute) *APIVersion {
+	for _, version := range api.versions {
+		if version.Name == name {
+			version.Routes = append(version.Routes, routes...)
+			return version
+		}
+	}
+	version := &APIVersion{Name: name, Routes: routes}
+	api.versions = append(api.versions, version)
+	return version
+}
+
+// Versions returns the versions, in the order they were added.
+func (api *VersionedAPI) Versions() []*APIVersion {
+	return api.versions
+}
+
+// Path returns the path a version is served under.
+func (api *VersionedAPI) Path(name string) string {
+	return joinRoutePath(api.Prefix, name)
+}
+
+func (api *VersionedAPI) lookup(name string) *APIVersion {
+	for _, version := range api.versions {
+		if version.Name == name {
+			return version
+		}
+	}
+	return nil
+}
+
+// Register mounts the routes of every version, and of the default one
+// under Prefix, with RegisterRoutes.
+//
+// Returns:
+//  error if a version name is not a path segment, or Default or a
+//  Successor is not a version
+func (api *VersionedAPI) Register(r gin.IRouter, db GhostDB) error {
+	for _, version := range api.versions {
+		if version.Name == "" || strings.Contains(version.Name, "/") {
+			return fmt.Errorf("api version %q is not a path segment", version.Name)
+		}
+		if version.Successor != "" && api.lookup(version.Successor) == nil {
+			return fmt.Errorf("api version %s: successor %q is not a version", version.Name, version.Successor)
+		}
+	}
+	var fallback *APIVersion
+	if api.Default != "" {
+		if fallback = api.lookup(api.Default); fallback == nil {
+			return fmt.Errorf("default api version %q is not a version", api.Default)
+		}
+	}
+	for _, version := range api.versions {
+		g := r.Group(api.Path(version.Name), api.headers(version))
+		RegisterRoutes(g, db, version.Routes...)
+	}
+	if fallback != nil {
+		g := r.Group(api.Prefix, api.headers(fallback))
+		RegisterRoutes(g, db, fallback.Routes...)
+	}
+	return nil
+}
+
+// headers names the version on the responses of its routes, with the
+// deprecation headers of RFC 9745 and RFC 8594 for an old version.
+func (api *VersionedAPI) headers(version *APIVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(APIVersionKey, version.Name)
+		c.Header(APIVersionHeader, version.Name)
+		if version.Deprecated {
+			c.Header("Deprecation", "true")
+			if !version.Sunset.IsZero() {
+				c.Header("Sunset", version.Sunset.UTC().Format(http.TimeFormat))
+			}
+			if version.Successor != "" {
+				c.Header("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, api.Path(version.Successor)))
+			}
+		}
+		c.Next()
+	}
+}
+
+// Document adds the routes of every version to docs under their
+// version path, the operations of deprecated versions marked so.
+//
+// Example:
+//  docs := api.Document(ghostutils.NewOpenAPI("Blog API", "2.0.0"))
+//  docs.Mount(r.Group("/"))
+func (api *VersionedAPI) Document(docs *OpenAPI) *OpenAPI {
+	for _, version := range api.versions {
+		from := len(docs.operations)
+		docs.Add(api.Path(version.Name), version.Routes...)
+		if version.Deprecated {
+			for i := from; i < len(docs.operations); i++ {
+				docs.operations[i].Deprecated = true
+			}
+		}
+	}
+	return docs
+}
+
+// CurrentAPIVersion returns the name of the version serving the
+// request, empty outside of a VersionedAPI.
+func CurrentAPIVersion(c *gin.Context) string {
+	return c.GetString(APIVersionKey)
+}
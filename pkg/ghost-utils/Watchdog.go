@@ -0,0 +1,235 @@
+package ghostutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// WatchdogConfig is the watchdog block of ghost.yaml. A zero limit is
+// not checked.
+//
+//  watchdog:
+//      interval: 30s
+//      max-heap-mb: 1024
+//      max-goroutines: 10000
+//      max-pool-usage: 0.9
+//      sustained: 3
+//      restart: true
+type WatchdogConfig struct {
+	Interval      time.Duration `yaml:"interval"`
+	MaxHeapMB     int           `yaml:"max-heap-mb"`
+	MaxGoroutines int           `yaml:"max-goroutines"`
+	// MaxPoolUsage is the fraction of the DB pool in use.
+	MaxPoolUsage float64 `yaml:"max-pool-usage"`
+	// Sustained is the number of consecutive samples over a limit
+	// before the watchdog acts. Defaults to 3.
+	Sustained int `yaml:"sustained"`
+	// Restart triggers a graceful restart once a limit is sustained.
+	Restart bool `yaml:"restart"`
+}
+
+// Watchdog checks.
+const (
+	WatchdogHeap       = "heap"
+	WatchdogGoroutines = "goroutines"
+	WatchdogPool       = "pool"
+)
+
+// WatchdogSample is one reading of the process.
+type WatchdogSample struct {
+	At         time.Time `json:"at"`
+	HeapBytes  uint64    `json:"heap_bytes"`
+	Goroutines int       `json:"goroutines"`
+	PoolInUse  int       `json:"pool_in_use"`
+	PoolSize   int       `json:"pool_size"`
+}
+
+// WatchdogAlert reports a limit exceeded for Sustained samples.
+// Bundle is the Storage prefix of the diagnostics, when one was
+// written.
+type WatchdogAlert struct {
+	Check  string         `json:"check"`
+	Value  float64        `json:"value"`
+	Limit  float64        `json:"limit"`
+	Sample WatchdogSample `json:"sample"`
+	Bundle string         `json:"bundle,omitempty"`
+}
+
+// Watchdog samples heap, goroutines and DB pool usage and acts when
+// one stays over its limit: it writes a diagnostics bundle (goroutine
+// dump, heap profile and the sample) to Storage, reports an alert and,
+// with Restart set, asks the process to shut down gracefully so its
+// supervisor starts a fresh one. It acts once per episode and rearms
+// when the value drops under the limit.
+//
+// Example:
+//  watchdog := &ghostutils.Watchdog{
+//      Config:  ghostConfig.Watchdog,
+//      Storage: ghostutils.LocalStorage{Root: "./diagnostics"},
+//  }
+//  go watchdog.Run(ctx)
+type Watchdog struct {
+	Config  WatchdogConfig
+	Storage Storage
+	// Pool reports DB connections in use and the pool size. The
+	// SurrealDB client holds a single connection, so pool usage is
+	// only checked for callers that provide it.
+	Pool func() (inUse, size int)
+	// OnAlert defaults to logging the alert.
+	OnAlert func(WatchdogAlert)
+	// Restart defaults to sending the process an interrupt, which
+	// servers stopping on SIGINT handle as a graceful shutdown.
+	Restart func()
+
+	mu        sync.Mutex
+	breaches  map[string]int
+	restarted bool
+}
+
+// Sample reads the current state of the process.
+func (w *Watchdog) Sample() WatchdogSample {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	sample := WatchdogSample{At: time.Now().UTC(), HeapBytes: mem.HeapAlloc, Goroutines: runtime.NumGoroutine()}
+	if w.Pool != nil {
+		sample.PoolInUse, sample.PoolSize = w.Pool()
+	}
+	return sample
+}
+
+type watchdogCheck struct {
+	name         string
+	value, limit float64
+}
+
+// Check compares sample with the limits and returns the alerts that
+// became sustained with it, acting on them.
+func (w *Watchdog) Check(ctx context.Context, sample WatchdogSample) []WatchdogAlert {
+	sustained := w.Config.Sustained
+	if sustained <= 0 {
+		sustained = 3
+	}
+	checks := []watchdogCheck{
+		{WatchdogHeap, float64(sample.HeapBytes) / (1 << 20), float64(w.Config.MaxHeapMB)},
+		{WatchdogGoroutines, float64(sample.Goroutines), float64(w.Config.MaxGoroutines)},
+	}
+	if sample.PoolSize > 0 {
+		checks = append(checks, watchdogCheck{WatchdogPool, float64(sample.PoolInUse) / float64(sample.PoolSize), w.Config.MaxPoolUsage})
+	}
+
+	var alerts []WatchdogAlert
+	w.mu.Lock()
+	if w.breaches == nil {
+		w.breaches = map[string]int{}
+	}
+	for _, check := range checks {
+		if check.limit <= 0 || check.value <= check.limit {
+			w.breaches[check.name] = 0
+			continue
+		}
+		w.breaches[check.name]++
+		if w.breaches[check.name] == sustained {
+			alerts = append(alerts, WatchdogAlert{Check: check.name, Value: check.value, Limit: check.limit, Sample: sample})
+		}
+	}
+	restart := len(alerts) > 0 && w.Config.Restart && !w.restarted
+	if restart {
+		w.restarted = true
+	}
+	w.mu.Unlock()
+
+	if len(alerts) == 0 {
+		return nil
+	}
+	bundle := ""
+	if w.Storage != nil {
+		var err error
+		if bundle, err = w.Bundle(ctx, sample); err != nil {
+			log.Printf("watchdog: writing diagnostics: %v", err)
+		}
+	}
+	for i := range alerts {
+		alerts[i].Bundle = bundle
+		if w.OnAlert != nil {
+			w.OnAlert(alerts[i])
+		} else {
+			log.Printf("watchdog: %s at %.1f over limit %.1f for %d samples, diagnostics %q",
+				alerts[i].Check, alerts[i].Value, alerts[i].Limit, sustained, bundle)
+		}
+	}
+	if restart {
+		log.Printf("watchdog: requesting graceful restart")
+		if w.Restart != nil {
+			w.Restart()
+		} else if err := interruptSelf(); err != nil {
+			log.Printf("watchdog: restart: %v", err)
+		}
+	}
+	return alerts
+}
+
+func interruptSelf() error {
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		return err
+	}
+	return process.Signal(os.Interrupt)
+}
+
+// Bundle writes a goroutine dump, a heap profile and sample to
+// Storage under watchdog/<time>/ and returns that prefix.
+func (w *Watchdog) Bundle(ctx context.Context, sample WatchdogSample) (string, error) {
+	prefix := fmt.Sprintf("watchdog/%s", sample.At.Format("20060102T150405Z"))
+	var goroutines, heap bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&goroutines, 2); err != nil {
+		return "", err
+	}
+	if err := pprof.WriteHeapProfile(&heap); err != nil {
+		return "", err
+	}
+	stats, err := json.MarshalIndent(sample, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	files := []struct {
+		name, contentType string
+		data              []byte
+	}{
+		{"goroutines.txt", "text/plain", goroutines.Bytes()},
+		{"heap.pprof", "application/octet-stream", heap.Bytes()},
+		{"sample.json", "application/json", stats},
+	}
+	for _, file := range files {
+		if err := w.Storage.Put(ctx, prefix+"/"+file.name, bytes.NewReader(file.data), file.contentType); err != nil {
+			return "", err
+		}
+	}
+	return prefix, nil
+}
+
+// Run samples every Config.Interval, 30s by default, until ctx is
+// done.
+func (w *Watchdog) Run(ctx context.Context) {
+	interval := w.Config.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Check(ctx, w.Sample())
+		}
+	}
+}
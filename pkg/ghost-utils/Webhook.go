@@ -0,0 +1,67 @@
+package ghostutils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultWebhookSignatureHeader is the header VerifyWebhook reads
+// when no header name is given.
+const DefaultWebhookSignatureHeader = "X-Ghost-Signature"
+
+// WebhookMaxBytes bounds the bodies VerifyWebhook reads, 25MB like
+// InboundMailOptions.MaxBytes.
+var WebhookMaxBytes int64 = 25 << 20
+
+// VerifyWebhook returns middleware that rejects requests whose body
+// does not match the hex encoded HMAC-SHA256 signature in header.
+// The signature may be prefixed with "sha256=". Bodies over
+// WebhookMaxBytes are answered 413. The body is restored so handlers
+// further down the chain can read it again.
+//
+// Example:
+//  r.POST("/webhooks/mail",
+//      ghostutils.VerifyWebhook(secret, ""),
+//      ghostutils.InboundMailHandler(opts, handle),
+//  )
+func VerifyWebhook(secret string, header string) gin.HandlerFunc {
+	if header == "" {
+		header = DefaultWebhookSignatureHeader
+	}
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, WebhookMaxBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		given := strings.TrimPrefix(c.GetHeader(header), "sha256=")
+		sig, err := hex.DecodeString(given)
+		if err != nil || !hmac.Equal(sig, SignWebhook(secret, body)) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// SignWebhook returns the raw HMAC-SHA256 of body under secret.
+func SignWebhook(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
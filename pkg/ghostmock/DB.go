@@ -0,0 +1,295 @@
+// Package ghostmock is a GhostDB for unit tests of handlers and
+// repositories: calls are answered from expectations set by the test
+// instead of a live SurrealDB, and recorded for assertions.
+package ghostmock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+)
+
+// ErrUnexpected is returned for a call no expectation matches.
+var ErrUnexpected = errors.New("ghostmock: unexpected call")
+
+// Methods of GhostDB, as in Call.Method.
+const (
+	MethodQuery  = "Query"
+	MethodCreate = "Create"
+	MethodSelect = "Select"
+	MethodUpdate = "Update"
+	MethodDelete = "Delete"
+	MethodSignin = "Signin"
+	MethodUse    = "Use"
+)
+
+// Call is a call made to a DB.
+type Call struct {
+	Method string
+	// Target is the SurrealQL of Query, the thing of Create, Select,
+	// Update and Delete, and "namespace/database" for Use.
+	Target string
+	// Vars are the vars of Query and Signin.
+	Vars interface{}
+	// Data is the data of Create and Update.
+	Data interface{}
+}
+
+// DB is a GhostDB answering from expectations. The zero value has no
+// expectations, so every call fails with ErrUnexpected.
+//
+// Example:
+//  db := ghostmock.New()
+//  db.ExpectQuery("SELECT * FROM type::thing($tb, $id)").
+//      WithVars(map[string]interface{}{"id": "42"}).
+//      Return([]Post{{ID: "post:42", Title: "Hello"}})
+//  posts := ghostutils.NewRepository[Post](db, "post")
+//  post, err := posts.Get(ctx, "42")
+//  db.AssertExpectations(t)
+type DB struct {
+	mu           sync.Mutex
+	expectations []*Expectation
+	calls        []Call
+}
+
+var _ ghostutils.GhostDB = (*DB)(nil)
+
+// New returns a DB without expectations.
+func New() *DB {
+	return &DB{}
+}
+
+// Expectation answers the calls of one method whose target contains a
+// text, once unless Times says otherwise.
+type Expectation struct {
+	method string
+	target string
+	vars   map[string]interface{}
+	times  int
+	used   int
+
+	statements []interface{}
+	result     interface{}
+	err        error
+}
+
+func (m *DB) expect(method, target string) *Expectation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := &Expectation{method: method, target: target, times: 1}
+	m.expectations = append(m.expectations, e)
+	return e
+}
+
+// ExpectQuery expects a Query whose SurrealQL contains sql, ignoring
+// differences of whitespace.
+func (m *DB) ExpectQuery(sql string) *Expectation { return m.expect(MethodQuery, sql) }
+
+// ExpectCreate expects a Create of thing, a table or a record id.
+func (m *DB) ExpectCreate(thing string) *Expectation { return m.expect(MethodCreate, thing) }
+
+// ExpectSelect expects a Select of what.
+func (m *DB) ExpectSelect(what string) *Expectation { return m.expect(MethodSelect, what) }
+
+// ExpectUpdate expects an Update of what.
+func (m *DB) ExpectUpdate(what string) *Expectation { return m.expect(MethodUpdate, what) }
+
+// ExpectDelete expects a Delete of what.
+func (m *DB) ExpectDelete(what string) *Expectation { return m.expect(MethodDelete, what) }
+
+// ExpectSignin expects a Signin, answered with an empty token unless
+// Return sets one.
+func (m *DB) ExpectSignin() *Expectation { return m.expect(MethodSignin, "").Return("") }
+
+// ExpectUse expects a Use of namespace and database.
+func (m *DB) ExpectUse(namespace, database string) *Expectation {
+	return m.expect(MethodUse, namespace+"/"+database).Return(nil)
+}
+
+// WithVars only matches calls whose vars hold each of vars, compared
+// as JSON, so the extra vars of the call are ignored.
+func (e *Expectation) WithVars(vars map[string]interface{}) *Expectation {
+	e.vars = vars
+	return e
+}
+
+// Times matches n calls, any number when n is zero or less.
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+// Return answers with results. For Query each result is the result of
+// one statement, all OK; for the other methods results[0] is the
+// result.
+func (e *Expectation) Return(results ...interface{}) *Expectation {
+	e.statements = e.statements[:0]
+	for _, result := range results {
+		e.statements = append(e.statements, statement("OK", "", result))
+	}
+	if len(results) > 0 {
+		e.result = results[0]
+	}
+	return e
+}
+
+// Fail answers a Query with a statement failing with detail, after the
+// statements of Return.
+func (e *Expectation) Fail(detail string) *Expectation {
+	e.statements = append(e.statements, statement("ERR", detail, nil))
+	return e
+}
+
+// Error makes the call itself fail with err, as a lost connection does.
+func (e *Expectation) Error(err error) *Expectation {
+	e.err = err
+	return e
+}
+
+func statement(status, detail string, result interface{}) map[string]interface{} {
+	s := map[string]interface{}{"status": status, "time": "0s", "result": result}
+	if detail != "" {
+		s["detail"] = detail
+		delete(s, "result")
+	}
+	return s
+}
+
+// normalize turns v into what the driver decodes from JSON, so results
+// unmarshal as they would from the database.
+func normalize(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+func compact(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func (e *Expectation) matches(call Call) bool {
+	if e.method != call.Method || (e.times > 0 && e.used >= e.times) {
+		return false
+	}
+	if call.Method == MethodQuery {
+		if !strings.Contains(compact(call.Target), compact(e.target)) {
+			return false
+		}
+	} else if e.target != "" && e.target != call.Target {
+		return false
+	}
+	if len(e.vars) == 0 {
+		return true
+	}
+	got, err := normalize(call.Vars)
+	gotVars, ok := got.(map[string]interface{})
+	if err != nil || !ok {
+		return false
+	}
+	want, err := normalize(e.vars)
+	if err != nil {
+		return false
+	}
+	for key, value := range want.(map[string]interface{}) {
+		if !reflect.DeepEqual(gotVars[key], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// answer records call and answers it from the first matching
+// expectation.
+func (m *DB) answer(call Call) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, call)
+	for _, e := range m.expectations {
+		if !e.matches(call) {
+			continue
+		}
+		e.used++
+		if e.err != nil {
+			return nil, e.err
+		}
+		if call.Method == MethodQuery {
+			return normalize(e.statements)
+		}
+		return normalize(e.result)
+	}
+	return nil, fmt.Errorf("%w: %s %s", ErrUnexpected, call.Method, compact(call.Target))
+}
+
+// Query implements GhostDB.
+func (m *DB) Query(sql string, vars interface{}) (interface{}, error) {
+	return m.answer(Call{Method: MethodQuery, Target: sql, Vars: vars})
+}
+
+// Create implements GhostDB.
+func (m *DB) Create(thing string, data interface{}) (interface{}, error) {
+	return m.answer(Call{Method: MethodCreate, Target: thing, Data: data})
+}
+
+// Select implements GhostDB.
+func (m *DB) Select(what string) (interface{}, error) {
+	return m.answer(Call{Method: MethodSelect, Target: what})
+}
+
+// Update implements GhostDB.
+func (m *DB) Update(what string, data interface{}) (interface{}, error) {
+	return m.answer(Call{Method: MethodUpdate, Target: what, Data: data})
+}
+
+// Delete implements GhostDB.
+func (m *DB) Delete(what string) (interface{}, error) {
+	return m.answer(Call{Method: MethodDelete, Target: what})
+}
+
+// Signin implements GhostDB.
+func (m *DB) Signin(vars interface{}) (interface{}, error) {
+	return m.answer(Call{Method: MethodSignin, Vars: vars})
+}
+
+// Use implements GhostDB.
+func (m *DB) Use(namespace, database string) (interface{}, error) {
+	return m.answer(Call{Method: MethodUse, Target: namespace + "/" + database})
+}
+
+// Calls returns the calls made so far, in order.
+func (m *DB) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// Reset removes the expectations and the calls.
+func (m *DB) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expectations, m.calls = nil, nil
+}
+
+// AssertExpectations fails t for every expectation not called as many
+// times as it expects.
+func (m *DB) AssertExpectations(t testing.TB) {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.expectations {
+		if e.times > 0 && e.used < e.times {
+			t.Errorf("ghostmock: %s %q called %d of %d times", e.method, e.target, e.used, e.times)
+		} else if e.times <= 0 && e.used == 0 {
+			t.Errorf("ghostmock: %s %q not called", e.method, e.target)
+		}
+	}
+}
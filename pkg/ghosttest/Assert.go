@@ -0,0 +1,158 @@
+package ghosttest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+)
+
+// Response is a response read by Request.Do, with assertions failing
+// the test that return the response so they chain.
+type Response struct {
+	*http.Response
+	Body []byte
+
+	t    testing.TB
+	name string
+}
+
+// errorf fails the test, quoting the start of the body.
+func (r *Response) errorf(format string, args ...interface{}) {
+	r.t.Helper()
+	body := string(r.Body)
+	if len(body) > 512 {
+		body = body[:512] + "…"
+	}
+	args = append([]interface{}{r.name}, args...)
+	r.t.Errorf("%s: "+format+"\nbody: %s", append(args, body)...)
+}
+
+// AssertStatus checks the status code.
+func (r *Response) AssertStatus(code int) *Response {
+	r.t.Helper()
+	if r.StatusCode != code {
+		r.errorf("status %d, want %d", r.StatusCode, code)
+	}
+	return r
+}
+
+// AssertHeader checks a response header.
+func (r *Response) AssertHeader(name, want string) *Response {
+	r.t.Helper()
+	if got := r.Header.Get(name); got != want {
+		r.errorf("header %s is %q, want %q", name, got, want)
+	}
+	return r
+}
+
+// AssertRedirect checks the response redirects to location.
+func (r *Response) AssertRedirect(location string) *Response {
+	r.t.Helper()
+	if r.StatusCode < 300 || r.StatusCode > 399 {
+		r.errorf("status %d is not a redirect", r.StatusCode)
+	}
+	return r.AssertHeader("Location", location)
+}
+
+// AssertContains checks the body contains each of parts.
+func (r *Response) AssertContains(parts ...string) *Response {
+	r.t.Helper()
+	for _, part := range parts {
+		if !bytes.Contains(r.Body, []byte(part)) {
+			r.errorf("body does not contain %q", part)
+		}
+	}
+	return r
+}
+
+// AssertNotContains checks the body contains none of parts.
+func (r *Response) AssertNotContains(parts ...string) *Response {
+	r.t.Helper()
+	for _, part := range parts {
+		if bytes.Contains(r.Body, []byte(part)) {
+			r.errorf("body contains %q", part)
+		}
+	}
+	return r
+}
+
+// JSON decodes the body into v, failing the test if it is not JSON.
+func (r *Response) JSON(v interface{}) *Response {
+	r.t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		r.errorf("body is not JSON: %v", err)
+	}
+	return r
+}
+
+// Data decodes the data of the envelope of OK and Created into v.
+func (r *Response) Data(v interface{}) *Response {
+	r.t.Helper()
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	r.JSON(&envelope)
+	if len(envelope.Data) == 0 {
+		r.errorf("no data in the envelope")
+		return r
+	}
+	if err := json.Unmarshal(envelope.Data, v); err != nil {
+		r.errorf("decoding the data: %v", err)
+	}
+	return r
+}
+
+// AssertJSON checks the body is the JSON encoding of want, ignoring
+// formatting and the order of keys.
+func (r *Response) AssertJSON(want interface{}) *Response {
+	r.t.Helper()
+	var got, expected interface{}
+	if err := json.Unmarshal(r.Body, &got); err != nil {
+		r.errorf("body is not JSON: %v", err)
+		return r
+	}
+	data, err := json.Marshal(want)
+	if err == nil {
+		err = json.Unmarshal(data, &expected)
+	}
+	if err != nil {
+		r.t.Fatalf("ghosttest: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		r.errorf("body is not %s", data)
+	}
+	return r
+}
+
+// AssertError checks the response failed through Fail with status
+// and the error code, e.g. "not_found".
+func (r *Response) AssertError(status int, code string) *Response {
+	r.t.Helper()
+	r.AssertStatus(status)
+	var envelope ghostutils.Envelope
+	r.JSON(&envelope)
+	if envelope.Error == nil {
+		r.errorf("no error in the envelope")
+	} else if envelope.Error.Code != code {
+		r.errorf("error code %q, want %q", envelope.Error.Code, code)
+	}
+	return r
+}
+
+// AssertHTMX checks the response is an htmx partial: HTML without the
+// layout of full pages.
+func (r *Response) AssertHTMX() *Response {
+	r.t.Helper()
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "text/html") {
+		r.errorf("content type %q is not HTML", r.Header.Get("Content-Type"))
+	}
+	if bytes.Contains(bytes.ToLower(r.Body), []byte("<html")) {
+		r.errorf("body is a full page")
+	}
+	return r
+}
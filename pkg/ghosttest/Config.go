@@ -0,0 +1,143 @@
+// Package ghosttest helps testing ghost projects: a test server wired
+// like Setup, temporary ghost.testing.yaml files, a SurrealDB namespace
+// per test and assertions on the responses.
+package ghosttest
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the config file the tests load, searched from the
+// working directory of the test up to the root of the module.
+const ConfigFile = "ghost.testing.yaml"
+
+// Environment variables overriding the test config.
+const (
+	// ConfigEnv is the path of the config file to load instead of
+	// ConfigFile.
+	ConfigEnv = "GHOST_TEST_CONFIG"
+	// SurrealURLEnv is the SurrealDB the tests connect to.
+	SurrealURLEnv = "GHOST_TEST_SURREALDB_URL"
+)
+
+// DefaultSurrealURL is the SurrealDB of the tests without a config
+// file, a local one started with
+//  surreal start --user root --pass root memory
+const DefaultSurrealURL = "ws://localhost:8000/rpc"
+
+// configs are the config files written by WriteConfig, per test.
+var configs sync.Map
+
+// WriteConfig writes config as a ghost.testing.yaml in a temporary
+// directory removed after the test, and makes it the config of the
+// test for Config, DB and NewTestServer.
+//
+// Example:
+//  config := ghosttest.DefaultConfig()
+//  config.RateLimit.Enabled = true
+//  ghosttest.WriteConfig(t, config)
+//  srv := ghosttest.NewTestServer(t, posts)
+//
+// Returns:
+//  the path of the file
+func WriteConfig(t testing.TB, config ghostutils.GhostConfig) string {
+	t.Helper()
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("ghosttest: %v", err)
+	}
+	return WriteConfigYAML(t, string(data))
+}
+
+// WriteConfigYAML is WriteConfig for the text of the file.
+//
+// Example:
+//  ghosttest.WriteConfigYAML(t, `
+//  name: blog
+//  surrealdb:
+//      surrealdb-url: ws://localhost:8000/rpc
+//      surrealdb-database: blog
+//  `)
+func WriteConfigYAML(t testing.TB, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ConfigFile)
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("ghosttest: %v", err)
+	}
+	configs.Store(t, path)
+	t.Cleanup(func() { configs.Delete(t) })
+	return path
+}
+
+// DefaultConfig returns the config of the tests without a config
+// file: the SurrealDB of SurrealURLEnv, DefaultSurrealURL by default,
+// signed in as root.
+func DefaultConfig() ghostutils.GhostConfig {
+	config := ghostutils.GhostConfig{Name: "ghosttest", Port: 8080}
+	config.SurrealDB.URL = os.Getenv(SurrealURLEnv)
+	if config.SurrealDB.URL == "" {
+		config.SurrealDB.URL = DefaultSurrealURL
+	}
+	config.SurrealDB.Username = "root"
+	config.SurrealDB.Password = "root"
+	config.SurrealDB.Namespace = "test"
+	config.SurrealDB.Database = "test"
+	return config
+}
+
+// configPath returns the config file of t, empty when there is none.
+func configPath(t testing.TB) string {
+	if path, ok := configs.Load(t); ok {
+		return path.(string)
+	}
+	if path := os.Getenv(ConfigEnv); path != "" {
+		return path
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, ConfigFile)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Config returns the config of the test: the file written by
+// WriteConfig, else the file of ConfigEnv, else the ConfigFile found
+// from the working directory, else DefaultConfig. SurrealURLEnv
+// overrides the SurrealDB of any of them.
+func Config(t testing.TB) ghostutils.GhostConfig {
+	t.Helper()
+	config := DefaultConfig()
+	if path := configPath(t); path != "" {
+		loaded, err := ghostutils.NewFromPath(path, "")
+		if err != nil {
+			t.Fatalf("ghosttest: %s: %v", path, err)
+		}
+		config = loaded
+	}
+	if url := os.Getenv(SurrealURLEnv); url != "" {
+		config.SurrealDB.URL = url
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("ghosttest: %v", err)
+	}
+	return config
+}
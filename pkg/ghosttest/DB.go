@@ -0,0 +1,129 @@
+package ghosttest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync"
+	"testing"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// RequireDBEnv, when set, fails the tests that cannot connect to
+// SurrealDB instead of skipping them, e.g. in CI.
+const RequireDBEnv = "GHOST_TEST_REQUIRE_DB"
+
+// testDB is the connection of one test.
+type testDB struct {
+	db     *surrealdb.DB
+	config ghostutils.GhostConfig
+}
+
+// dbs are the connections opened by DB, per test.
+var dbs sync.Map
+
+// DB returns the connection of the test to a namespace of its own,
+// named test_<random>, in the SurrealDB of Config. The namespace is
+// removed and the connection closed after the test, so the config
+// must sign in as a root user. Every call within a test returns the
+// same connection, which NewTestServer uses too.
+//
+// The test is skipped when SurrealDB cannot be reached, unless
+// RequireDBEnv is set.
+//
+// Example:
+//  func TestCreatePost(t *testing.T) {
+//      db := ghosttest.DB(t)
+//      ghosttest.Seed(t, db, "fixtures")
+//      srv := ghosttest.NewTestServer(t, NewPostsRoute(db))
+//      srv.PostJSON("/posts", Post{Title: "Hello"}).AssertStatus(http.StatusCreated)
+//  }
+func DB(t testing.TB) *surrealdb.DB {
+	t.Helper()
+	return connection(t).db
+}
+
+func connection(t testing.TB) *testDB {
+	t.Helper()
+	if conn, ok := dbs.Load(t); ok {
+		return conn.(*testDB)
+	}
+	config := Config(t)
+	config.SurrealDB.Namespace = "test_" + randomHex(6)
+	if config.SurrealDB.Retry.MaxAttempts > 3 {
+		// a missing database should not hold the test for long
+		config.SurrealDB.Retry.MaxAttempts = 3
+	}
+	db, err := config.Connect()
+	if err != nil {
+		if os.Getenv(RequireDBEnv) == "" {
+			t.Skipf("ghosttest: no SurrealDB at %s: %v", config.SurrealDB.URL, err)
+		}
+		t.Fatalf("ghosttest: connecting to %s: %v", config.SurrealDB.URL, err)
+	}
+	conn := &testDB{db: db, config: config}
+	dbs.Store(t, conn)
+	t.Cleanup(func() {
+		dbs.Delete(t)
+		if _, err := db.Query("REMOVE NAMESPACE "+config.SurrealDB.Namespace, map[string]interface{}{}); err != nil {
+			t.Logf("ghosttest: removing namespace %s: %v", config.SurrealDB.Namespace, err)
+		}
+		db.Close()
+	})
+	return conn
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Seed writes the fixture files of dir to db, see ghostutils.Seed,
+// failing the test on error.
+//
+// Returns:
+//  []ghostutils.Fixture written
+func Seed(t testing.TB, db *surrealdb.DB, dir string) []ghostutils.Fixture {
+	t.Helper()
+	fixtures, err := ghostutils.Seed(db, dir)
+	if err != nil {
+		t.Fatalf("ghosttest: seeding %s: %v", dir, err)
+	}
+	return fixtures
+}
+
+// Migrate applies the migrations of dir to db, see ghostutils.Migrate,
+// failing the test on error.
+func Migrate(t testing.TB, db *surrealdb.DB, dir string) {
+	t.Helper()
+	if _, err := ghostutils.Migrate(db, dir); err != nil {
+		t.Fatalf("ghosttest: migrating %s: %v", dir, err)
+	}
+}
+
+// Exec runs sql on db, such as DEFINE statements or records a test
+// needs, failing the test when a statement fails.
+func Exec(t testing.TB, db *surrealdb.DB, sql string, vars map[string]interface{}) {
+	t.Helper()
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	raw, err := db.Query(sql, vars)
+	if err != nil {
+		t.Fatalf("ghosttest: %v", err)
+	}
+	var statements []surrealdb.RawQuery[interface{}]
+	if err := surrealdb.Unmarshal(raw, &statements); err != nil {
+		t.Fatalf("ghosttest: %v", err)
+	}
+	for i, statement := range statements {
+		if statement.Status != "OK" {
+			t.Fatalf("ghosttest: statement %d: %s", i+1, statement.Detail)
+		}
+	}
+}
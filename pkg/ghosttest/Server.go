@@ -0,0 +1,198 @@
+package ghosttest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	ghostutils "github.com/adamkali/ghost_utils/pkg/ghost-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/surrealdb/surrealdb.go"
+)
+
+// Server is a running test server and the client of the test. The
+// client keeps cookies, so sessions and CSRF tokens carry over from
+// one request to the next, and does not follow redirects.
+type Server struct {
+	*httptest.Server
+	Engine *gin.Engine
+	DB     *surrealdb.DB
+	Config ghostutils.GhostConfig
+
+	t      testing.TB
+	client *http.Client
+}
+
+// NewTestServer starts a server wired from the config of the test as
+// Setup wires it, on the connection of DB, with routes registered on
+// it. The server is closed after the test, and the jobs and hooks
+// the setup started are stopped, see App.Stop.
+//
+// Example:
+//  db := ghosttest.DB(t)
+//  srv := ghosttest.NewTestServer(t, NewPostsRoute(db))
+//  res := srv.Get("/posts").AssertStatus(http.StatusOK)
+//  var posts []Post
+//  res.Data(&posts)
+func NewTestServer(t testing.TB, routes ...ghostutils.GhostRoute) *Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	conn := connection(t)
+	engine := gin.New()
+	app, err := conn.config.SetupAppWithDB(engine, conn.db)
+	t.Cleanup(func() {
+		if app == nil {
+			return
+		}
+		if err := app.Stop(context.Background()); err != nil {
+			t.Errorf("ghosttest: stop: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("ghosttest: setup: %v", err)
+	}
+	for _, route := range routes {
+		route.Route(engine)
+	}
+	return NewEngineServer(t, engine, conn.db, conn.config)
+}
+
+// NewEngineServer serves engine, set up by the test itself, as a
+// Server. db and config are only kept for the test.
+func NewEngineServer(t testing.TB, engine *gin.Engine, db *surrealdb.DB, config ghostutils.GhostConfig) *Server {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("ghosttest: %v", err)
+	}
+	server := httptest.NewServer(engine)
+	t.Cleanup(server.Close)
+	client := server.Client()
+	client.Jar = jar
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &Server{Server: server, Engine: engine, DB: db, Config: config, t: t, client: client}
+}
+
+// Request is a request being built for a Server.
+type Request struct {
+	server *Server
+	method string
+	path   string
+	header http.Header
+	body   io.Reader
+}
+
+// NewRequest starts a request of method on path, relative to the
+// server.
+//
+// Example:
+//  srv.NewRequest(http.MethodPost, "/posts").
+//      Form(url.Values{"title": {"Hello"}}).
+//      HTMX().
+//      Do().
+//      AssertStatus(http.StatusOK).
+//      AssertContains("Hello")
+func (s *Server) NewRequest(method, path string) *Request {
+	return &Request{server: s, method: method, path: path, header: http.Header{}}
+}
+
+// Header sets a request header.
+func (r *Request) Header(name, value string) *Request {
+	r.header.Set(name, value)
+	return r
+}
+
+// Bearer authenticates the request with token.
+func (r *Request) Bearer(token string) *Request {
+	return r.Header("Authorization", "Bearer "+token)
+}
+
+// HTMX marks the request as sent by htmx.
+func (r *Request) HTMX() *Request {
+	return r.Header("HX-Request", "true")
+}
+
+// JSON sends v encoded as JSON.
+func (r *Request) JSON(v interface{}) *Request {
+	data, err := json.Marshal(v)
+	if err != nil {
+		r.server.t.Fatalf("ghosttest: %v", err)
+	}
+	r.body = bytes.NewReader(data)
+	return r.Header("Content-Type", "application/json")
+}
+
+// Form sends values url encoded.
+func (r *Request) Form(values url.Values) *Request {
+	r.body = strings.NewReader(values.Encode())
+	return r.Header("Content-Type", "application/x-www-form-urlencoded")
+}
+
+// Body sends body with the content type.
+func (r *Request) Body(body io.Reader, contentType string) *Request {
+	r.body = body
+	return r.Header("Content-Type", contentType)
+}
+
+// Do sends the request, failing the test if it cannot be sent, and
+// reads the whole response.
+func (r *Request) Do() *Response {
+	t := r.server.t
+	t.Helper()
+	req, err := http.NewRequest(r.method, r.server.URL+r.path, r.body)
+	if err != nil {
+		t.Fatalf("ghosttest: %v", err)
+	}
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+	res, err := r.server.client.Do(req)
+	if err != nil {
+		t.Fatalf("ghosttest: %s %s: %v", r.method, r.path, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ghosttest: %s %s: %v", r.method, r.path, err)
+	}
+	return &Response{Response: res, Body: body, t: t, name: r.method + " " + r.path}
+}
+
+// Get sends a GET of path.
+func (s *Server) Get(path string) *Response {
+	s.t.Helper()
+	return s.NewRequest(http.MethodGet, path).Do()
+}
+
+// PostJSON sends a POST of v as JSON to path.
+func (s *Server) PostJSON(path string, v interface{}) *Response {
+	s.t.Helper()
+	return s.NewRequest(http.MethodPost, path).JSON(v).Do()
+}
+
+// PostForm sends a POST of the url encoded values to path.
+func (s *Server) PostForm(path string, values url.Values) *Response {
+	s.t.Helper()
+	return s.NewRequest(http.MethodPost, path).Form(values).Do()
+}
+
+// PatchJSON sends a PATCH of v as JSON to path.
+func (s *Server) PatchJSON(path string, v interface{}) *Response {
+	s.t.Helper()
+	return s.NewRequest(http.MethodPatch, path).JSON(v).Do()
+}
+
+// Delete sends a DELETE of path.
+func (s *Server) Delete(path string) *Response {
+	s.t.Helper()
+	return s.NewRequest(http.MethodDelete, path).Do()
+}